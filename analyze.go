@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/petuhovskiy/overload/autoai"
+)
+
+// runAnalyze compares the latest executions of every query with the previous ones
+// and prints statistically significant regressions.
+func runAnalyze(args []string) {
+	fs := flag.NewFlagSet("analyze", flag.ExitOnError)
+	since := fs.Duration("since", 30*24*time.Hour, "only consider executions newer than this")
+	onlyRegressions := fs.Bool("regressions", false, "print only regressions")
+	labels := labelsFlag{}
+	fs.Var(labels, "label", "only consider runs with this label, in key=value format (repeatable)")
+	workload := fs.String("workload", "", "only consider runs with this workload fingerprint, \"latest\" for the workload of the latest run")
+	_ = fs.Parse(args)
+
+	pool := connectHistory()
+	defer pool.Close()
+	dbHistory := autoai.NewDBHistory(pool)
+
+	if *workload == "latest" {
+		fingerprint, err := dbHistory.LatestWorkloadFingerprint(labels)
+		if err != nil {
+			fmt.Println("Error: failed to find the latest workload:", err)
+			os.Exit(1)
+		}
+		*workload = fingerprint
+		fmt.Println("Workload:", fingerprint)
+	}
+
+	infos, err := dbHistory.LoadQueryExecInfos(time.Now().Add(-*since), labels, *workload)
+	if err != nil {
+		fmt.Println("Error: failed to load history:", err)
+		os.Exit(1)
+	}
+
+	regressions := autoai.DetectRegressions(infos)
+	if *onlyRegressions {
+		var filtered []autoai.Regression
+		for _, r := range regressions {
+			if r.Verdict == autoai.VerdictRegression {
+				filtered = append(filtered, r)
+			}
+		}
+		regressions = filtered
+	}
+
+	if err := autoai.PrintRegressions(os.Stdout, regressions); err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+}
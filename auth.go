@@ -0,0 +1,23 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/petuhovskiy/overload/internal/auth"
+)
+
+// setupAuth enables cloud IAM token auth for workload connections, if AUTH_PROVIDER is set.
+func setupAuth() {
+	name := os.Getenv("AUTH_PROVIDER")
+	if name == "" {
+		return
+	}
+	provider, err := auth.New(name)
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+
+	auth.SetProvider(provider)
+}
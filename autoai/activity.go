@@ -0,0 +1,148 @@
+package autoai
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/petuhovskiy/overload/internal/dbconn"
+	"github.com/petuhovskiy/overload/internal/log"
+	"go.uber.org/zap"
+)
+
+// appNamePrefix returns the application_name prefix of workload connections, followed by
+// the query fingerprint, so that their backends can be found in pg_stat_activity. It starts
+// with application_name of the tool's connections, which identifies the run.
+func appNamePrefix() string {
+	return dbconn.AppName() + " "
+}
+
+// ActivityStats is the distribution of ages of the running queries, sampled from
+// pg_stat_activity during the step. Long tails here, not visible in client-side latency,
+// mean stuck executions or queueing on the server.
+type ActivityStats struct {
+	// Samples is the number of running queries seen in all samples.
+	Samples int
+	P50     time.Duration
+	P90     time.Duration
+	P99     time.Duration
+	Max     time.Duration
+	// IdleInTransaction is the number of sampled backends idle in a transaction.
+	IdleInTransaction int `json:",omitempty"`
+	// WaitEvents counts running queries by wait event type, e.g. Lock or IO.
+	WaitEvents map[string]int `json:",omitempty"`
+}
+
+// activitySampler collects ages of running queries of a single application name.
+type activitySampler struct {
+	ages       []time.Duration
+	idleInTx   int
+	waitEvents map[string]int
+}
+
+func (s *activitySampler) sample(ctx context.Context, conn *pgx.Conn, appName string) error {
+	rows, err := conn.Query(ctx, `
+		SELECT state, COALESCE(wait_event_type, ''),
+			COALESCE(extract(epoch FROM clock_timestamp() - query_start), 0)::float8
+		FROM pg_stat_activity
+		WHERE application_name = $1 AND pid <> pg_backend_pid()
+			AND state IN ('active', 'idle in transaction', 'idle in transaction (aborted)')`, appName)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var state, waitEvent string
+		var age float64
+		if err := rows.Scan(&state, &waitEvent, &age); err != nil {
+			return err
+		}
+		if state != "active" {
+			s.idleInTx++
+			continue
+		}
+		s.ages = append(s.ages, time.Duration(age*float64(time.Second)))
+		if waitEvent != "" {
+			if s.waitEvents == nil {
+				s.waitEvents = map[string]int{}
+			}
+			s.waitEvents[waitEvent]++
+		}
+	}
+	return rows.Err()
+}
+
+func (s *activitySampler) stats() *ActivityStats {
+	if len(s.ages) == 0 && s.idleInTx == 0 {
+		return nil
+	}
+	sort.Slice(s.ages, func(i, j int) bool { return s.ages[i] < s.ages[j] })
+	at := func(q float64) time.Duration {
+		if len(s.ages) == 0 {
+			return 0
+		}
+		return s.ages[min(int(q*float64(len(s.ages))), len(s.ages)-1)]
+	}
+	return &ActivityStats{
+		Samples:           len(s.ages),
+		P50:               at(0.5),
+		P90:               at(0.9),
+		P99:               at(0.99),
+		Max:               at(1),
+		IdleInTransaction: s.idleInTx,
+		WaitEvents:        s.waitEvents,
+	}
+}
+
+// sampleActivity polls pg_stat_activity for backends of the query during a step. The returned
+// function stops sampling, logs the distribution and attaches it to the stats.
+func (l *Launcher) sampleActivity(ctx context.Context, connstr string, query Query) func(stats *ExecStats) {
+	if l.conf.ActivitySampleInterval < 0 {
+		return func(*ExecStats) {}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan *ActivityStats, 1)
+	go func() {
+		var sampler activitySampler
+		defer func() { done <- sampler.stats() }()
+
+		conn, err := dbconn.Connect(ctx, connstr)
+		if err != nil {
+			log.Warn(ctx, "failed to connect for activity sampling", zap.Error(err))
+			return
+		}
+		defer conn.Close(context.Background())
+
+		appName := queryAppName(query)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(l.conf.ActivitySampleInterval):
+			}
+
+			if err := sampler.sample(ctx, conn, appName); err != nil {
+				if ctx.Err() == nil {
+					log.Warn(ctx, "failed to sample activity", zap.Error(err))
+				}
+				return
+			}
+		}
+	}()
+
+	return func(stats *ExecStats) {
+		cancel()
+		stats.Activity = <-done
+		if stats.Activity != nil {
+			log.Info(ctx, "running queries age distribution", zap.Any("activity", stats.Activity))
+		}
+	}
+}
+
+// queryAppName returns application_name of the workload connections of the query.
+func queryAppName(query Query) string {
+	return appNamePrefix() + QueryFingerprint(query.SQL)
+}
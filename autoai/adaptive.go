@@ -0,0 +1,101 @@
+package autoai
+
+import (
+	"context"
+	"time"
+
+	"github.com/petuhovskiy/overload/internal/log"
+	"go.uber.org/zap"
+)
+
+const (
+	adaptiveIncrease    = 10
+	adaptiveDecrease    = 0.5
+	adaptiveMaxBackoffs = 3
+	adaptiveMaxSteps    = 30
+)
+
+// AdaptiveLimit is the result of the adaptive concurrency search.
+type AdaptiveLimit struct {
+	// Conns is the max concurrency that didn't violate the SLO.
+	Conns int
+	// QPS is the throughput observed at Conns.
+	QPS     float64
+	Latency time.Duration
+	Points  []RampPoint
+}
+
+// runAdaptive searches for the max sustainable concurrency using AIMD: concurrency is
+// increased additively while latency and error rate are within the SLO, and decreased
+// multiplicatively when the SLO is violated. The search stops after several backoffs,
+// when the concurrency has converged around the sustainable operating point.
+func (l *Launcher) runAdaptive(ctx context.Context, connstr string, query Query, opts execOptions) ExecStats {
+	var (
+		stats    ExecStats
+		limit    AdaptiveLimit
+		backoffs int
+		peakQPS  float64
+		n        = 1
+	)
+
+	for step := 0; step < adaptiveMaxSteps && backoffs < adaptiveMaxBackoffs; step++ {
+		if ctx.Err() != nil {
+			break
+		}
+
+		var point RampPoint
+		stats, point = runStep(ctx, connstr, query, n, opts)
+		limit.Points = append(limit.Points, point)
+		peakQPS = max(peakQPS, point.QPS)
+		go l.db.SaveQueryExecInfo(stats.ToExecInfo(query.SQL, n))
+		l.checkAlerts(ctx, query, stats, point)
+
+		violated := stats.Broken ||
+			point.QPS == 0 ||
+			point.Latency > l.conf.LatencySLO ||
+			point.ErrorRate > l.conf.MaxErrorRate
+
+		log.Info(ctx, "adaptive step finished",
+			zap.Int("conns", n),
+			zap.Float64("qps", point.QPS),
+			zap.Duration("latency", point.Latency),
+			zap.Float64("error_rate", point.ErrorRate),
+			zap.Bool("violated", violated),
+		)
+
+		if stats.Broken {
+			log.Warn(ctx, "query is broken, stopped its executions for the rest of the step", zap.Error(stats.Error))
+		}
+
+		if violated {
+			backoffs++
+			n = max(1, int(float64(n)*adaptiveDecrease))
+			continue
+		}
+
+		if n > limit.Conns {
+			limit.Conns = n
+			limit.QPS = point.QPS
+			limit.Latency = point.Latency
+		}
+		n += adaptiveIncrease
+	}
+
+	log.Info(ctx, "adaptive search finished", zap.Any("limit", limit))
+	go l.db.SaveQueryExecInfo(limit.ToExecInfo(query.SQL))
+
+	stats.PeakQPS = peakQPS
+	return stats
+}
+
+// ToExecInfo converts adaptive limit to a history record.
+func (a *AdaptiveLimit) ToExecInfo(query string) *QueryExecInfo {
+	return &QueryExecInfo{
+		Query:    query,
+		IsFailed: a.Conns == 0,
+		QPS:      float32(a.QPS),
+		Conns:    a.Conns,
+		Comment:  "adaptive limit",
+		Info:     a,
+	}
+}
@@ -0,0 +1,209 @@
+package autoai
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Kinds of anonymized identifiers, used as prefixes of their pseudonyms.
+const (
+	anonSchema   = "sch"
+	anonTable    = "tbl"
+	anonColumn   = "col"
+	anonIndex    = "idx"
+	anonSequence = "seq"
+)
+
+var (
+	// identTokenRegexp matches quoted and bare identifiers.
+	identTokenRegexp  = regexp.MustCompile(`"(?:[^"]|"")+"|[A-Za-z_][A-Za-z0-9_$]*`)
+	pseudonymRegexp   = regexp.MustCompile(`^(?:sch|tbl|col|idx|seq)_\d+$`)
+	simpleIdentRegexp = regexp.MustCompile(`^[a-z_][a-z0-9_$]*$`)
+	nextvalRegexp     = regexp.MustCompile(`nextval\('([^']+)'`)
+)
+
+// Anonymizer replaces names of schemas, tables, columns, indexes and sequences with pseudonyms
+// like tbl_1 in everything sent to the model, and maps generated queries back. The mapping is
+// stable: it's kept in a local file and new names are appended to it, so the same table has
+// the same pseudonym in all runs. The file is never sent anywhere.
+//
+// Methods of a nil Anonymizer return their input unchanged.
+type Anonymizer struct {
+	path string
+
+	mu sync.Mutex
+	// names maps real names to pseudonyms, reverse maps them back.
+	names   map[string]string
+	reverse map[string]string
+	counts  map[string]int
+	dirty   bool
+	// generated maps restored queries to the form they were generated in, to show the model
+	// its own queries in feedback.
+	generated map[string]string
+}
+
+// LoadAnonymizer reads the mapping from the file, the file is created on the first save.
+func LoadAnonymizer(path string) (*Anonymizer, error) {
+	a := &Anonymizer{
+		path:      path,
+		names:     map[string]string{},
+		reverse:   map[string]string{},
+		counts:    map[string]int{},
+		generated: map[string]string{},
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return a, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &a.names); err != nil {
+		return nil, fmt.Errorf("invalid anonymization map %s: %w", path, err)
+	}
+	for name, pseudonym := range a.names {
+		a.reverse[pseudonym] = name
+		kind, _, _ := strings.Cut(pseudonym, "_")
+		a.counts[kind]++
+	}
+	return a, nil
+}
+
+// Save writes the mapping to the file if new names were added.
+func (a *Anonymizer) Save() error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.dirty {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(a.names, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(a.path), filepath.Base(a.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), a.path); err != nil {
+		return err
+	}
+	a.dirty = false
+	return nil
+}
+
+// name returns the pseudonym of the name, a new one of the kind if it's not mapped yet.
+// The public schema is left as is.
+func (a *Anonymizer) name(kind, name string) string {
+	if a == nil || name == "" || (kind == anonSchema && name == "public") {
+		return name
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if pseudonym, ok := a.names[name]; ok {
+		return pseudonym
+	}
+	a.counts[kind]++
+	pseudonym := fmt.Sprintf("%s_%d", kind, a.counts[kind])
+	a.names[name] = pseudonym
+	a.reverse[pseudonym] = name
+	a.dirty = true
+	return pseudonym
+}
+
+// qualified returns the pseudonym of a schema-qualified name.
+func (a *Anonymizer) qualified(kind, name string) string {
+	schema, rel, ok := strings.Cut(name, ".")
+	if !ok {
+		return a.name(kind, name)
+	}
+	return a.name(anonSchema, schema) + "." + a.name(kind, rel)
+}
+
+// hideDefault anonymizes a column default, including the sequence of nextval.
+func (a *Anonymizer) hideDefault(def string) string {
+	if a == nil {
+		return def
+	}
+	for _, m := range nextvalRegexp.FindAllStringSubmatch(def, -1) {
+		a.qualified(anonSequence, strings.ReplaceAll(m[1], `"`, ""))
+	}
+	return a.Hide(def)
+}
+
+// Hide replaces all known names in the text, e.g. a query, a plan or an error message,
+// with their pseudonyms. Unknown words are kept.
+func (a *Anonymizer) Hide(text string) string {
+	if a == nil {
+		return text
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return identTokenRegexp.ReplaceAllStringFunc(text, func(token string) string {
+		name := strings.ToLower(token)
+		if strings.HasPrefix(token, `"`) {
+			name = strings.ReplaceAll(token[1:len(token)-1], `""`, `"`)
+		}
+		if pseudonym, ok := a.names[name]; ok {
+			return pseudonym
+		}
+		return token
+	})
+}
+
+// Restore replaces pseudonyms in the generated query with the real names, quoted if needed.
+func (a *Anonymizer) Restore(sql string) string {
+	if a == nil {
+		return sql
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	restored := identTokenRegexp.ReplaceAllStringFunc(sql, func(token string) string {
+		if !pseudonymRegexp.MatchString(token) {
+			return token
+		}
+		name, ok := a.reverse[token]
+		if !ok {
+			return token
+		}
+		if simpleIdentRegexp.MatchString(name) {
+			return name
+		}
+		return pgx.Identifier{name}.Sanitize()
+	})
+	a.generated[restored] = sql
+	return restored
+}
+
+// hideSQL returns the query as it was generated by the model, or anonymizes it.
+func (a *Anonymizer) hideSQL(sql string) string {
+	if a == nil {
+		return sql
+	}
+	a.mu.Lock()
+	generated, ok := a.generated[sql]
+	a.mu.Unlock()
+	if ok {
+		return generated
+	}
+	return a.Hide(sql)
+}
@@ -0,0 +1,316 @@
+package autoai
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/petuhovskiy/overload/internal/alert"
+	"github.com/petuhovskiy/overload/internal/clientstats"
+	"github.com/petuhovskiy/overload/internal/log"
+	"github.com/petuhovskiy/overload/internal/metrics"
+	"go.uber.org/zap"
+)
+
+// Artifact collects everything recorded during the run in memory, to write it as a single
+// machine-readable file at exit. It doesn't depend on the history database being available.
+type Artifact struct {
+	mu sync.Mutex
+
+	RunID         int `json:",omitempty"`
+	StartedAt     time.Time
+	FinishedAt    time.Time
+	Labels        map[string]string `json:",omitempty"`
+	Metadata      map[string]any    `json:",omitempty"`
+	Config        any               `json:",omitempty"`
+	ServerVersion string            `json:",omitempty"`
+	// WorkloadFingerprint identifies runs of the same workload, see WorkloadFingerprint.
+	WorkloadFingerprint string `json:",omitempty"`
+
+	// Queries are aggregates of all execution steps of every query.
+	Queries []QueryAggregate
+	// Classes are aggregates of all queries of every class, see FileSource.
+	Classes []ClassAggregate `json:",omitempty"`
+	// Records are all history records of the run, including per-second series of every step.
+	Records []*QueryExecInfo
+	Alerts  []alert.Alert `json:",omitempty"`
+	// Client is the resource usage of the load generator.
+	Client clientstats.Summary
+	// Headroom is the sizing conclusion of the run, see TrackHeadroom.
+	Headroom *Headroom `json:",omitempty"`
+	// Metrics is the final snapshot of all metrics.
+	Metrics metrics.Snapshot
+}
+
+// QueryAggregate summarizes all execution steps of a single query.
+type QueryAggregate struct {
+	Fingerprint string
+	Query       string
+	Class       string `json:",omitempty"`
+	Steps       int
+	FailedSteps int
+	Executions  int
+	Errors      int
+	// ErrorCodes counts failed executions by SQLSTATE.
+	ErrorCodes map[string]int `json:",omitempty"`
+	AvgLatency time.Duration
+	P99Latency time.Duration
+	// MaxQPS is the best throughput among the steps.
+	MaxQPS float64
+}
+
+// ClassAggregate summarizes all executions of the queries of a single class.
+type ClassAggregate struct {
+	Class      string
+	Queries    int
+	Executions int
+	Errors     int
+	AvgLatency time.Duration
+	P99Latency time.Duration
+}
+
+// NewArtifact creates an artifact of the run started now. Config should be set
+// before the workload starts.
+func NewArtifact() *Artifact {
+	return &Artifact{StartedAt: time.Now()}
+}
+
+// SetArtifact enables collecting of all records saved to the history into the artifact.
+func (d *DBHistory) SetArtifact(a *Artifact) {
+	d.artifact = a
+}
+
+func (a *Artifact) startRun(runID int, labels map[string]string, metadata map[string]any) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.RunID, a.Labels, a.Metadata = runID, labels, metadata
+}
+
+func (a *Artifact) setServerVersion(version string) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.ServerVersion = version
+}
+
+func (a *Artifact) setWorkloadFingerprint(fingerprint string) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.WorkloadFingerprint = fingerprint
+}
+
+func (a *Artifact) record(info *QueryExecInfo) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.Records = append(a.Records, info)
+}
+
+func (a *Artifact) setHeadroom(h *Headroom) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.Headroom = h
+}
+
+// throughput returns the best total throughput of all queries over headroomWindow windows,
+// and the best throughput of windows with p99 latency within p99.
+func (a *Artifact) throughput(p99 time.Duration) (maxQPS, slaQPS float64) {
+	if a == nil {
+		return 0, 0
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	type window struct {
+		points  []SeriesPoint
+		seconds map[time.Time]bool
+		count   int
+	}
+	windows := map[time.Time]*window{}
+	for _, info := range a.Records {
+		stats, ok := info.Info.(*ExecStats)
+		if !ok {
+			continue
+		}
+		for _, p := range stats.Series {
+			start := p.Time.Truncate(headroomWindow)
+			w := windows[start]
+			if w == nil {
+				w = &window{seconds: map[time.Time]bool{}}
+				windows[start] = w
+			}
+			w.points = append(w.points, p)
+			w.seconds[p.Time] = true
+			w.count += p.Count
+		}
+	}
+
+	for _, w := range windows {
+		qps := float64(w.count) / float64(len(w.seconds))
+		maxQPS = max(maxQPS, qps)
+		if w.count > 0 && seriesPercentile(w.points, 0.99) <= p99 {
+			slaQPS = max(slaQPS, qps)
+		}
+	}
+	return maxQPS, slaQPS
+}
+
+func (a *Artifact) recordAlert(alert alert.Alert) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.Alerts = append(a.Alerts, alert)
+}
+
+// Aggregate computes per-query aggregates of the records collected so far.
+func (a *Artifact) Aggregate() []QueryAggregate {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.aggregate()
+}
+
+// aggregate computes per-query aggregates of execution statistics records.
+func (a *Artifact) aggregate() []QueryAggregate {
+	byFingerprint := map[string]*QueryAggregate{}
+	series := map[string][]SeriesPoint{}
+	for _, info := range a.Records {
+		stats, ok := info.Info.(*ExecStats)
+		if !ok {
+			continue
+		}
+
+		fingerprint := QueryFingerprint(info.Query)
+		agg := byFingerprint[fingerprint]
+		if agg == nil {
+			agg = &QueryAggregate{Fingerprint: fingerprint, Query: info.Query, Class: queryClass(info.Query)}
+			byFingerprint[fingerprint] = agg
+		}
+
+		agg.Steps++
+		if info.IsFailed {
+			agg.FailedSteps++
+		}
+		var executions int
+		for _, p := range stats.Series {
+			executions += p.Count
+			agg.AvgLatency += p.Sum
+		}
+		agg.Executions += executions
+		if len(stats.Series) > 0 {
+			agg.MaxQPS = max(agg.MaxQPS, float64(executions)/float64(len(stats.Series)))
+		}
+		agg.ErrorCodes = mergeErrorCodes(agg.ErrorCodes, stats.ErrorCodes)
+		series[fingerprint] = append(series[fingerprint], stats.Series...)
+	}
+
+	res := make([]QueryAggregate, 0, len(byFingerprint))
+	for fingerprint, agg := range byFingerprint {
+		if agg.Executions > 0 {
+			agg.AvgLatency /= time.Duration(agg.Executions)
+		}
+		for _, n := range agg.ErrorCodes {
+			agg.Errors += n
+		}
+		agg.P99Latency = seriesPercentile(series[fingerprint], 0.99)
+		res = append(res, *agg)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Fingerprint < res[j].Fingerprint })
+	return res
+}
+
+// LogClasses logs per-class aggregates of the records collected so far.
+func (a *Artifact) LogClasses(ctx context.Context) {
+	a.mu.Lock()
+	classes := a.aggregateClasses()
+	a.mu.Unlock()
+
+	for _, c := range classes {
+		log.Info(ctx, "query class summary",
+			zap.String("class", c.Class),
+			zap.Int("queries", c.Queries),
+			zap.Int("executions", c.Executions),
+			zap.Int("errors", c.Errors),
+			zap.Duration("avg_latency", c.AvgLatency),
+			zap.Duration("p99_latency", c.P99Latency),
+		)
+	}
+}
+
+// aggregateClasses computes per-class aggregates of execution statistics records,
+// queries without a class are skipped.
+func (a *Artifact) aggregateClasses() []ClassAggregate {
+	byClass := map[string]*ClassAggregate{}
+	queries := map[string]map[string]bool{}
+	series := map[string][]SeriesPoint{}
+	for _, info := range a.Records {
+		stats, ok := info.Info.(*ExecStats)
+		class := queryClass(info.Query)
+		if !ok || class == "" {
+			continue
+		}
+
+		agg := byClass[class]
+		if agg == nil {
+			agg = &ClassAggregate{Class: class}
+			byClass[class] = agg
+			queries[class] = map[string]bool{}
+		}
+		queries[class][QueryFingerprint(info.Query)] = true
+		for _, p := range stats.Series {
+			agg.Executions += p.Count
+			agg.AvgLatency += p.Sum
+		}
+		for _, n := range stats.ErrorCodes {
+			agg.Errors += n
+		}
+		series[class] = append(series[class], stats.Series...)
+	}
+
+	res := make([]ClassAggregate, 0, len(byClass))
+	for class, agg := range byClass {
+		if agg.Executions > 0 {
+			agg.AvgLatency /= time.Duration(agg.Executions)
+		}
+		agg.Queries = len(queries[class])
+		agg.P99Latency = seriesPercentile(series[class], 0.99)
+		res = append(res, *agg)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Class < res[j].Class })
+	return res
+}
+
+// Write finalizes the artifact and writes it to the file as indented JSON.
+func (a *Artifact) Write(path string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.FinishedAt = time.Now()
+	a.Queries = a.aggregate()
+	a.Classes = a.aggregateClasses()
+	a.Client = clientstats.Default.Summary()
+	a.Metrics = metrics.Default.Snapshot()
+
+	data, err := json.MarshalIndent(a, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
@@ -0,0 +1,176 @@
+package autoai
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/petuhovskiy/overload/errs"
+	"github.com/petuhovskiy/overload/internal/log"
+	"github.com/petuhovskiy/overload/internal/metrics"
+	"go.uber.org/zap"
+)
+
+const (
+	// auditBufferSize is the max number of executions waiting to be written,
+	// executions are dropped when the history database can't keep up.
+	auditBufferSize = 1 << 16
+	// auditBatchSize is the max number of executions written with a single COPY.
+	auditBatchSize = 10000
+	// auditFlushInterval is how often buffered executions are written.
+	auditFlushInterval = time.Second
+)
+
+// auditEntry is a single execution of a query.
+type auditEntry struct {
+	start       time.Time
+	duration    time.Duration
+	conn        uint32
+	fingerprint string
+	// code is the SQLSTATE of a failed execution, empty on success.
+	code string
+}
+
+// AuditLog writes every single execution into query_exec_log, partitioned by day,
+// for post-hoc analysis at full resolution. Executions are buffered and written
+// in batches, nil AuditLog records nothing.
+type AuditLog struct {
+	db      *pgxpool.Pool
+	runID   any
+	entries chan auditEntry
+	done    chan struct{}
+	// partitions are the days with known partitions, accessed only by the writer
+	partitions map[time.Time]bool
+
+	written *metrics.Counter
+	dropped *metrics.Counter
+}
+
+// NewAuditLog creates an audit log of the current run. Run must be started to write it.
+func (d *DBHistory) NewAuditLog() *AuditLog {
+	return &AuditLog{
+		db:         d.db,
+		runID:      d.runIDArg(),
+		entries:    make(chan auditEntry, auditBufferSize),
+		done:       make(chan struct{}),
+		partitions: map[time.Time]bool{},
+		written:    metrics.Default.Counter("audit_log_written_total"),
+		dropped:    metrics.Default.Counter("audit_log_dropped_total"),
+	}
+}
+
+// SetAuditLog enables recording of every execution of the launcher into the audit log.
+func (l *Launcher) SetAuditLog(audit *AuditLog) {
+	l.audit = audit
+}
+
+// record adds the execution to the buffer, it never blocks the workload.
+func (a *AuditLog) record(start time.Time, duration time.Duration, conn uint32, fingerprint string, err error) {
+	if a == nil {
+		return
+	}
+	entry := auditEntry{start: start, duration: duration, conn: conn, fingerprint: fingerprint}
+	if err != nil {
+		entry.code = errs.Code(err)
+	}
+
+	select {
+	case a.entries <- entry:
+	default:
+		a.dropped.Inc()
+	}
+}
+
+// Run writes buffered executions until the context is done, then writes the rest and returns.
+func (a *AuditLog) Run(ctx context.Context) {
+	defer close(a.done)
+	ticker := time.NewTicker(auditFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]auditEntry, 0, auditBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := a.write(batch); err != nil {
+			log.Warn(ctx, "failed to write audit log", zap.Int("executions", len(batch)), zap.Error(err))
+			a.dropped.Add(int64(len(batch)))
+		} else {
+			a.written.Add(int64(len(batch)))
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case entry := <-a.entries:
+			batch = append(batch, entry)
+			if len(batch) >= auditBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-ctx.Done():
+			for {
+				select {
+				case entry := <-a.entries:
+					batch = append(batch, entry)
+					if len(batch) >= auditBatchSize {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// Wait waits until Run has written all executions recorded before its context was done.
+func (a *AuditLog) Wait() {
+	if a == nil {
+		return
+	}
+	<-a.done
+}
+
+// write creates missing daily partitions and copies the batch into the table.
+func (a *AuditLog) write(batch []auditEntry) error {
+	ctx := context.Background()
+	rows := make([][]any, 0, len(batch))
+	for _, e := range batch {
+		day := e.start.UTC().Truncate(24 * time.Hour)
+		if !a.partitions[day] {
+			if err := a.createPartition(ctx, day); err != nil {
+				return fmt.Errorf("failed to create partition: %w", err)
+			}
+			a.partitions[day] = true
+		}
+
+		var code any
+		if e.code != "" {
+			code = e.code
+		}
+		rows = append(rows, []any{
+			e.start, a.runID, e.fingerprint, int64(e.conn),
+			float64(e.duration) / float64(time.Millisecond), code,
+		})
+	}
+
+	_, err := a.db.CopyFrom(ctx,
+		pgx.Identifier{"query_exec_log"},
+		[]string{"start_time", "run_id", "fingerprint", "conn", "duration_ms", "sqlstate"},
+		pgx.CopyFromRows(rows))
+	return err
+}
+
+// createPartition creates the partition of query_exec_log for the UTC day, if it doesn't exist.
+func (a *AuditLog) createPartition(ctx context.Context, day time.Time) error {
+	_, err := a.db.Exec(ctx, fmt.Sprintf(
+		`CREATE TABLE IF NOT EXISTS query_exec_log_%s PARTITION OF query_exec_log FOR VALUES FROM ('%s+00') TO ('%s+00')`,
+		day.Format("20060102"), day.Format(time.DateTime), day.Add(24*time.Hour).Format(time.DateTime)))
+	return err
+}
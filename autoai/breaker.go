@@ -0,0 +1,92 @@
+package autoai
+
+import (
+	"sync"
+	"time"
+)
+
+// circuitBreaker tracks failures of a single query across all connections and trips
+// when the failure rate within the sliding window exceeds the configured threshold.
+// Once tripped, it stays broken and no new executions of the query should be started
+// until the end of the step, the next step starts with a new breaker.
+type circuitBreaker struct {
+	window         time.Duration
+	maxFailureRate float64
+	minSamples     int
+
+	mu      sync.Mutex
+	buckets []breakerBucket
+	broken  bool
+}
+
+// breakerBucket counts executions finished within a single second.
+type breakerBucket struct {
+	second time.Time
+	total  int
+	failed int
+}
+
+func newCircuitBreaker(window time.Duration, maxFailureRate float64, minSamples int) *circuitBreaker {
+	return &circuitBreaker{
+		window:         window,
+		maxFailureRate: maxFailureRate,
+		minSamples:     minSamples,
+	}
+}
+
+// reset returns a new breaker with the same settings for the next step, nil if it's disabled.
+func (b *circuitBreaker) reset() *circuitBreaker {
+	if b == nil {
+		return nil
+	}
+	return newCircuitBreaker(b.window, b.maxFailureRate, b.minSamples)
+}
+
+// record adds the result of a single execution and returns whether the breaker is broken.
+// A nil breaker trips on the first failure.
+func (b *circuitBreaker) record(failed bool) bool {
+	if b == nil {
+		return failed
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	sec := now.Truncate(time.Second)
+	if len(b.buckets) == 0 || b.buckets[len(b.buckets)-1].second.Before(sec) {
+		b.buckets = append(b.buckets, breakerBucket{second: sec})
+	}
+	last := &b.buckets[len(b.buckets)-1]
+	last.total++
+	if failed {
+		last.failed++
+	}
+
+	// drop buckets outside of the window
+	for len(b.buckets) > 0 && now.Sub(b.buckets[0].second) > b.window {
+		b.buckets = b.buckets[1:]
+	}
+
+	var total, failures int
+	for _, bucket := range b.buckets {
+		total += bucket.total
+		failures += bucket.failed
+	}
+
+	if total >= b.minSamples && float64(failures)/float64(total) > b.maxFailureRate {
+		b.broken = true
+	}
+	return b.broken
+}
+
+// isBroken returns true if the breaker has tripped.
+func (b *circuitBreaker) isBroken() bool {
+	if b == nil {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.broken
+}
@@ -0,0 +1,31 @@
+package autoai
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	b := newCircuitBreaker(10*time.Second, 0.5, 4)
+
+	require.False(t, b.record(true), "too few samples")
+	require.False(t, b.record(false))
+	require.False(t, b.record(true))
+	require.True(t, b.record(true), "3 of 4 failed")
+	require.True(t, b.record(false), "stays broken")
+	require.True(t, b.isBroken())
+
+	next := b.reset()
+	require.False(t, next.isBroken(), "every step starts closed")
+	require.True(t, b.isBroken())
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	var b *circuitBreaker
+	require.False(t, b.record(false))
+	require.True(t, b.record(true), "stops on the first error")
+	require.False(t, b.isBroken())
+	require.Nil(t, b.reset())
+}
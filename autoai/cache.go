@@ -0,0 +1,311 @@
+package autoai
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/petuhovskiy/overload/internal/dbconn"
+	"github.com/petuhovskiy/overload/internal/log"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultCacheExecutions     = 1
+	defaultCacheRestartTimeout = 2 * time.Minute
+	cacheEvictTable            = "overload_cache_evict"
+)
+
+// CacheDropper discards database caches before cold executions.
+type CacheDropper interface {
+	DropCache(ctx context.Context, connstr string) error
+}
+
+// SQLCacheDrop executes custom SQL to drop caches.
+type SQLCacheDrop struct {
+	SQL string
+}
+
+func (d SQLCacheDrop) DropCache(ctx context.Context, connstr string) error {
+	conn, err := dbconn.Connect(ctx, connstr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	_, err = conn.Exec(ctx, d.SQL)
+	return err
+}
+
+// RestartCacheDrop restarts the database by calling an HTTP endpoint, e.g. the restart
+// endpoint of a cloud provider API, and waits until the database accepts connections.
+type RestartCacheDrop struct {
+	URL string
+	// Token is sent as a bearer token, if set.
+	Token string
+	// Timeout is the max time to wait for the database after the restart, default 2m.
+	Timeout time.Duration
+}
+
+func (d RestartCacheDrop) DropCache(ctx context.Context, connstr string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.URL, nil)
+	if err != nil {
+		return err
+	}
+	if d.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+d.Token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("restart endpoint returned %s: %s", resp.Status, body)
+	}
+
+	timeout := d.Timeout
+	if timeout == 0 {
+		timeout = defaultCacheRestartTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// the endpoint may return before the database goes down, give it a moment
+	for {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("database is not available after restart: %w", ctx.Err())
+		case <-time.After(time.Second):
+		}
+
+		conn, err := dbconn.Connect(ctx, connstr)
+		if err != nil {
+			continue
+		}
+		err = conn.Ping(ctx)
+		conn.Close(context.Background())
+		if err == nil {
+			return nil
+		}
+	}
+}
+
+// EvictCacheDrop evicts shared buffers by reading a dummy table into them with pg_prewarm.
+// It doesn't drop the OS page cache.
+type EvictCacheDrop struct {
+	// SizeMB is the size of the dummy table, twice the shared_buffers by default.
+	SizeMB int
+}
+
+func (d EvictCacheDrop) DropCache(ctx context.Context, connstr string) error {
+	conn, err := dbconn.Connect(ctx, connstr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, `CREATE EXTENSION IF NOT EXISTS pg_prewarm`); err != nil {
+		return fmt.Errorf("failed to create pg_prewarm extension: %w", err)
+	}
+
+	size := int64(d.SizeMB) << 20
+	if size == 0 {
+		err := conn.QueryRow(ctx, `
+			SELECT 2 * setting::bigint * 8192 FROM pg_settings WHERE name = 'shared_buffers'`).Scan(&size)
+		if err != nil {
+			return fmt.Errorf("failed to get shared_buffers: %w", err)
+		}
+	}
+
+	if err := ensureEvictTable(ctx, conn, size); err != nil {
+		return fmt.Errorf("failed to create eviction table: %w", err)
+	}
+	_, err = conn.Exec(ctx, `SELECT pg_prewarm($1, 'buffer')`, cacheEvictTable)
+	return err
+}
+
+// ensureEvictTable (re)creates the dummy table unless it's already large enough.
+func ensureEvictTable(ctx context.Context, conn *pgx.Conn, size int64) error {
+	var current int64
+	err := conn.QueryRow(ctx, `SELECT COALESCE(pg_relation_size(to_regclass($1)), 0)`, cacheEvictTable).Scan(&current)
+	if err != nil {
+		return err
+	}
+	if current >= size {
+		return nil
+	}
+
+	log.Info(ctx, "creating cache eviction table", zap.Int64("bytes", size))
+	// rows of ~1KB are stored inline without compression, so the table size is predictable
+	_, err = conn.Exec(ctx, fmt.Sprintf(`
+		DROP TABLE IF EXISTS %[1]s;
+		CREATE TABLE %[1]s AS
+		SELECT i, lpad('', 1000, md5(i::text)) AS pad
+		FROM generate_series(1, %[2]d) i`, cacheEvictTable, size/1024+1))
+	return err
+}
+
+// CacheConfig configures the cold/warm cache experiment.
+type CacheConfig struct {
+	Dropper CacheDropper
+	// Executions is the number of executions of every query in every pass, default 1.
+	// Only the first executions after the drop are cold, so keep it small.
+	Executions int
+	// PerQuery drops caches before every query, instead of once before the cold pass.
+	// Otherwise queries touching the same data warm up the cache for each other.
+	PerQuery bool
+}
+
+func (conf *CacheConfig) Normalize() {
+	if conf.Executions == 0 {
+		conf.Executions = defaultCacheExecutions
+	}
+}
+
+// CacheResult is the cold and warm latency of a query.
+type CacheResult struct {
+	Query string
+	Cold  time.Duration
+	Warm  time.Duration
+	Error string `json:",omitempty"`
+}
+
+// Delta is the extra latency caused by the cold cache.
+func (r *CacheResult) Delta() time.Duration {
+	return r.Cold - r.Warm
+}
+
+// ToExecInfo converts the result to a history record.
+func (r *CacheResult) ToExecInfo() *QueryExecInfo {
+	return &QueryExecInfo{
+		Query:    r.Query,
+		IsFailed: r.Error != "",
+		Conns:    1,
+		Comment:  "cache experiment",
+		Info:     r,
+	}
+}
+
+// RunCacheSource loads queries from the source and runs the cache experiment on them.
+func (l *Launcher) RunCacheSource(ctx context.Context, connstr string, source QuerySource, conf CacheConfig) ([]CacheResult, error) {
+	queries, err := loadSource(ctx, connstr, source)
+	if err != nil {
+		return nil, err
+	}
+	return l.RunCacheExperiment(ctx, connstr, queries, conf)
+}
+
+// RunCacheExperiment executes queries once after dropping caches and once warm, and returns
+// the latency of both passes for every query. Every pass uses a new connection, so that
+// connection-local caches are cold too.
+func (l *Launcher) RunCacheExperiment(ctx context.Context, connstr string, queries []Query, conf CacheConfig) ([]CacheResult, error) {
+	conf.Normalize()
+
+	works := make([]*workload, len(queries))
+	results := make([]CacheResult, len(queries))
+	for i, query := range queries {
+		works[i] = newWorkload(query, l.execOptions(query))
+		results[i].Query = query.SQL
+	}
+
+	drop := func() error {
+		start := time.Now()
+		if err := conf.Dropper.DropCache(ctx, connstr); err != nil {
+			return fmt.Errorf("failed to drop cache: %w", err)
+		}
+		log.Info(ctx, "dropped cache", zap.Duration("elapsed", time.Since(start)))
+		return nil
+	}
+
+	measure := func(i int, cold bool) {
+		if results[i].Error != "" {
+			return
+		}
+		latency, err := l.measureCachePass(ctx, connstr, queries[i], works[i], conf.Executions)
+		if err != nil {
+			results[i].Error = err.Error()
+		} else if cold {
+			results[i].Cold = latency
+		} else {
+			results[i].Warm = latency
+		}
+	}
+
+	if conf.PerQuery {
+		for i := range queries {
+			if err := drop(); err != nil {
+				return nil, err
+			}
+			measure(i, true)
+			measure(i, false)
+		}
+	} else {
+		if err := drop(); err != nil {
+			return nil, err
+		}
+		// all cold executions go first, a warm pass in between would load data
+		// of the following queries
+		for i := range queries {
+			measure(i, true)
+		}
+		for i := range queries {
+			measure(i, false)
+		}
+	}
+
+	for i := range results {
+		go l.db.SaveQueryExecInfo(results[i].ToExecInfo())
+	}
+	return results, ctx.Err()
+}
+
+// measureCachePass executes the query on a new connection and returns the average latency.
+func (l *Launcher) measureCachePass(ctx context.Context, connstr string, query Query, work *workload, executions int) (time.Duration, error) {
+	opts := l.execOptions(query)
+	config, err := opts.connConfig(connstr)
+	if err != nil {
+		return 0, err
+	}
+	conn, err := dbconn.ConnectConfig(ctx, config)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close(context.Background())
+
+	rng := newRand()
+	var sum time.Duration
+	for i := 0; i < executions; i++ {
+		start := time.Now()
+		if _, err := work.exec(ctx, conn, rng); err != nil {
+			return 0, err
+		}
+		sum += time.Since(start)
+	}
+	return sum / time.Duration(executions), nil
+}
+
+// PrintCacheResults writes cold and warm latencies as a table.
+func PrintCacheResults(w io.Writer, results []CacheResult) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "COLD\tWARM\tDELTA\tRATIO\tQUERY")
+	for _, r := range results {
+		if r.Error != "" {
+			fmt.Fprintf(tw, "-\t-\t-\t-\t%s (error: %s)\n", truncateQuery(r.Query, 60), r.Error)
+			continue
+		}
+		ratio := 0.0
+		if r.Warm > 0 {
+			ratio = float64(r.Cold) / float64(r.Warm)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%.1fx\t%s\n",
+			r.Cold.Round(time.Microsecond), r.Warm.Round(time.Microsecond),
+			r.Delta().Round(time.Microsecond), ratio, truncateQuery(r.Query, 60))
+	}
+	return tw.Flush()
+}
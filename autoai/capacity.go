@@ -0,0 +1,230 @@
+package autoai
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/petuhovskiy/overload/errs"
+	"github.com/petuhovskiy/overload/internal/limits"
+	"github.com/petuhovskiy/overload/internal/log"
+	"github.com/petuhovskiy/overload/internal/reconnect"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultCapacityQuery          = "SELECT 1"
+	defaultCapacityStartConns     = 10
+	defaultCapacityStep           = 10
+	defaultCapacityMaxConns       = 10000
+	defaultCapacityStepDuration   = 10 * time.Second
+	defaultCapacityLatencyCeiling = 100 * time.Millisecond
+)
+
+// CapacityConfig configures the ramp-to-failure probe.
+type CapacityConfig struct {
+	// Query is executed by every connection, a trivial one by default, so that the limit
+	// depends on the number of connections and not on the work done by them.
+	Query      string
+	StartConns int
+	// Step is the number of connections added after every successful step.
+	Step int
+	// MaxConns stops the ramp without a failure.
+	MaxConns     int
+	StepDuration time.Duration
+	// LatencyCeiling is the max p99 latency of a successful step.
+	LatencyCeiling time.Duration
+}
+
+func (conf *CapacityConfig) Normalize() {
+	if conf.Query == "" {
+		conf.Query = defaultCapacityQuery
+	}
+
+	if conf.StartConns == 0 {
+		conf.StartConns = defaultCapacityStartConns
+	}
+
+	if conf.Step == 0 {
+		conf.Step = defaultCapacityStep
+	}
+
+	if conf.MaxConns == 0 {
+		conf.MaxConns = defaultCapacityMaxConns
+	}
+
+	if conf.StepDuration == 0 {
+		conf.StepDuration = defaultCapacityStepDuration
+	}
+
+	if conf.LatencyCeiling == 0 {
+		conf.LatencyCeiling = defaultCapacityLatencyCeiling
+	}
+}
+
+// CapacityStep is the measurement of a single number of connections.
+type CapacityStep struct {
+	Conns int
+	QPS   float64
+	Avg   time.Duration
+	P99   time.Duration
+	// FailedConns is the number of connections that failed to connect or stopped on an error.
+	FailedConns int
+	ErrorCodes  map[string]int `json:",omitempty"`
+}
+
+// CapacityResult is the practical connection limit found by the probe.
+type CapacityResult struct {
+	Query string
+	// MaxConns is the highest number of connections without errors and within the latency ceiling,
+	// zero if the first step failed.
+	MaxConns int
+	// FailedAt is the number of connections of the first failed step, zero if the ramp
+	// reached the max without failures.
+	FailedAt int
+	// Symptoms describe the failure: errors by SQLSTATE, exceeded latency or a safety limit.
+	Symptoms []string `json:",omitempty"`
+	Steps    []CapacityStep
+}
+
+// RunCapacity adds connections running the query step by step, until errors appear or latency
+// exceeds the ceiling, and reports the last number of connections that worked.
+func (l *Launcher) RunCapacity(ctx context.Context, connstr string, conf CapacityConfig) (CapacityResult, error) {
+	conf.Normalize()
+	query := Query{SQL: conf.Query, Weight: 1}
+	res := CapacityResult{Query: conf.Query}
+
+	safetyConns := safetyMaxConns(connstr)
+	for conns := conf.StartConns; conns <= conf.MaxConns; conns += conf.Step {
+		if safetyConns > 0 && conns > safetyConns {
+			res.FailedAt = conns
+			res.Symptoms = []string{fmt.Sprintf("safety limit of %d connections", safetyConns)}
+			break
+		}
+
+		opts := l.execOptions(query)
+		opts.duration = conf.StepDuration
+		// failed connections are the symptom, they must not be retried
+		opts.reconnect = reconnect.Config{MaxAttempts: 1}
+
+		stats, point := runStep(ctx, connstr, query, conns, opts)
+		if ctx.Err() != nil {
+			return res, ctx.Err()
+		}
+		step := CapacityStep{
+			Conns:       conns,
+			QPS:         point.QPS,
+			Avg:         stats.Avg,
+			P99:         seriesPercentile(stats.Series, 0.99),
+			FailedConns: point.FailedConns,
+			ErrorCodes:  stats.ErrorCodes,
+		}
+		res.Steps = append(res.Steps, step)
+
+		info := stats.ToExecInfo(conf.Query, conns)
+		info.Comment = "capacity: " + info.Comment
+		go l.db.SaveQueryExecInfo(info)
+		log.Info(ctx, "capacity step finished", zap.Any("step", step))
+
+		if symptoms := capacitySymptoms(step, conf.LatencyCeiling); len(symptoms) > 0 {
+			res.FailedAt = conns
+			res.Symptoms = symptoms
+			break
+		}
+		res.MaxConns = conns
+	}
+
+	log.Info(ctx, "capacity probe finished", zap.Int("max_conns", res.MaxConns),
+		zap.Int("failed_at", res.FailedAt), zap.Strings("symptoms", res.Symptoms))
+	return res, nil
+}
+
+// safetyMaxConns returns the safety connection limit of the target, zero if it's not limited.
+func safetyMaxConns(connstr string) int {
+	config, err := pgx.ParseConfig(connstr)
+	if err != nil {
+		return 0
+	}
+	limiter := limits.For(limits.Target(config))
+	if limiter == nil {
+		return 0
+	}
+	return limiter.Config().MaxConns
+}
+
+// capacitySymptoms returns the reasons the step is considered failed, if any.
+func capacitySymptoms(step CapacityStep, ceiling time.Duration) []string {
+	var res []string
+	codes := make([]string, 0, len(step.ErrorCodes))
+	for code := range step.ErrorCodes {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	for _, code := range codes {
+		res = append(res, fmt.Sprintf("%s (%s): %d errors", code, errorCodeSymptom(code), step.ErrorCodes[code]))
+	}
+	if step.FailedConns > 0 && len(codes) == 0 {
+		res = append(res, fmt.Sprintf("%d connections failed", step.FailedConns))
+	}
+	if step.P99 > ceiling {
+		res = append(res, fmt.Sprintf("p99 latency %s above %s", step.P99.Round(time.Microsecond), ceiling))
+	}
+	return res
+}
+
+// errorCodeSymptom describes SQLSTATEs typical for running out of connections or memory.
+func errorCodeSymptom(code string) string {
+	switch {
+	case code == errs.CodeTooManyConnections:
+		return "too many clients"
+	case code == errs.CodeOutOfMemory:
+		return "out of memory"
+	case code == errs.CodeDiskFull:
+		return "disk full"
+	case code == errs.CodeCannotConnectNow:
+		return "cannot connect now"
+	case code == errs.CodeQueryCanceled:
+		return "query canceled"
+	case code == errs.ClientCode:
+		return "client or network error"
+	case strings.HasPrefix(code, errs.ClassConnectionException):
+		return "connection exception"
+	case strings.HasPrefix(code, errs.ClassInsufficientResources):
+		return "insufficient resources"
+	default:
+		return "other error"
+	}
+}
+
+// PrintCapacityResult writes the steps of the probe and the found limit.
+func PrintCapacityResult(w io.Writer, r CapacityResult) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "CONNS\tQPS\tAVG\tP99\tFAILED CONNS\tERRORS")
+	for _, s := range r.Steps {
+		errors := 0
+		for _, n := range s.ErrorCodes {
+			errors += n
+		}
+		fmt.Fprintf(tw, "%d\t%.1f\t%s\t%s\t%d\t%d\n", s.Conns, s.QPS,
+			s.Avg.Round(time.Microsecond), s.P99.Round(time.Microsecond), s.FailedConns, errors)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "\nPractical connection limit: %d\n", r.MaxConns)
+	if r.FailedAt == 0 {
+		fmt.Fprintln(w, "No failures up to the max number of connections")
+		return nil
+	}
+	fmt.Fprintf(w, "Failed at %d connections:\n", r.FailedAt)
+	for _, s := range r.Symptoms {
+		fmt.Fprintf(w, "  %s\n", s)
+	}
+	return nil
+}
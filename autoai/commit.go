@@ -0,0 +1,142 @@
+package autoai
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/petuhovskiy/overload/internal/log"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultCommitConns    = 16
+	defaultCommitDuration = time.Minute
+)
+
+// CommitConfig configures the synchronous_commit comparison.
+type CommitConfig struct {
+	// Conns is the number of connections executing every query.
+	Conns    int
+	Duration time.Duration
+	// Split runs both modes at the same time, each on half of the connections, instead of
+	// back-to-back. Both modes see the same server state, but compete for the WAL.
+	Split bool
+}
+
+func (conf *CommitConfig) Normalize() {
+	if conf.Conns == 0 {
+		conf.Conns = defaultCommitConns
+	}
+
+	if conf.Duration == 0 {
+		conf.Duration = defaultCommitDuration
+	}
+}
+
+// CommitSide is the performance of a query in a single synchronous_commit mode.
+type CommitSide struct {
+	Conns  int
+	QPS    float64
+	Avg    time.Duration
+	P99    time.Duration
+	Errors int
+}
+
+// CommitResult compares a query executed with synchronous_commit on and off.
+type CommitResult struct {
+	Query string
+	On    CommitSide
+	Off   CommitSide
+}
+
+// Speedup is the throughput ratio of asynchronous commit to synchronous commit.
+func (r *CommitResult) Speedup() float64 {
+	if r.On.QPS == 0 {
+		return 0
+	}
+	return r.Off.QPS / r.On.QPS
+}
+
+// RunCommitSource loads queries from the source and runs the synchronous_commit comparison on them.
+func (l *Launcher) RunCommitSource(ctx context.Context, connstr string, source QuerySource, conf CommitConfig) ([]CommitResult, error) {
+	queries, err := loadSource(ctx, connstr, source)
+	if err != nil {
+		return nil, err
+	}
+	return l.RunCommitComparison(ctx, connstr, queries, conf)
+}
+
+// RunCommitComparison executes every query with synchronous_commit on and off with the same
+// number of connections, and returns throughput and latency of both modes.
+func (l *Launcher) RunCommitComparison(ctx context.Context, connstr string, queries []Query, conf CommitConfig) ([]CommitResult, error) {
+	conf.Normalize()
+
+	results := make([]CommitResult, len(queries))
+	for i, query := range queries {
+		ctx := log.With(ctx, zap.String("query", query.SQL))
+		results[i].Query = query.SQL
+
+		conns := conf.Conns
+		if conf.Split {
+			conns = max(1, conns/2)
+		}
+		measure := func(mode string, side *CommitSide) {
+			opts := l.execOptions(query)
+			opts.duration = conf.Duration
+			opts.syncCommit = mode
+
+			stats, point := runStep(ctx, connstr, query, conns, opts)
+			*side = CommitSide{
+				Conns: conns,
+				QPS:   point.QPS,
+				Avg:   stats.Avg,
+				P99:   seriesPercentile(stats.Series, 0.99),
+			}
+			for _, n := range stats.ErrorCodes {
+				side.Errors += n
+			}
+
+			info := stats.ToExecInfo(query.SQL, conns)
+			info.Comment = fmt.Sprintf("synchronous_commit=%s: %s", mode, info.Comment)
+			go l.db.SaveQueryExecInfo(info)
+			log.Info(ctx, "synchronous_commit step finished", zap.String("mode", mode), zap.Any("result", side))
+		}
+
+		if conf.Split {
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				measure("on", &results[i].On)
+			}()
+			measure("off", &results[i].Off)
+			wg.Wait()
+		} else {
+			measure("on", &results[i].On)
+			measure("off", &results[i].Off)
+		}
+
+		if ctx.Err() != nil {
+			return results[:i+1], ctx.Err()
+		}
+	}
+	return results, nil
+}
+
+// PrintCommitResults writes throughput and latency of both modes as a table.
+func PrintCommitResults(w io.Writer, results []CommitResult) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "QPS ON\tQPS OFF\tSPEEDUP\tAVG ON\tAVG OFF\tP99 ON\tP99 OFF\tERRORS\tQUERY")
+	for _, r := range results {
+		fmt.Fprintf(tw, "%.1f\t%.1f\t%.2fx\t%s\t%s\t%s\t%s\t%d\t%s\n",
+			r.On.QPS, r.Off.QPS, r.Speedup(),
+			r.On.Avg.Round(time.Microsecond), r.Off.Avg.Round(time.Microsecond),
+			r.On.P99.Round(time.Microsecond), r.Off.P99.Round(time.Microsecond),
+			r.On.Errors+r.Off.Errors, truncateQuery(r.Query, 60))
+	}
+	return tw.Flush()
+}
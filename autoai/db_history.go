@@ -1,21 +1,31 @@
 package autoai
 
 import (
+	"cmp"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/petuhovskiy/overload/internal/alert"
+	"github.com/petuhovskiy/overload/internal/log"
+	"github.com/petuhovskiy/overload/internal/pgversion"
+	"go.uber.org/zap"
 )
 
-/*
-CREATE TABLE generated_queries (
-    id SERIAL PRIMARY KEY,
-    prompt TEXT NOT NULL,         -- what you asked the API
-    generated_sql TEXT NOT NULL,  -- the SQL query returned by OpenAI
-    created_at TIMESTAMPTZ DEFAULT NOW(),  -- timestamp of when it was saved
-    model_used TEXT               -- optional: which OpenAI model was used
-);
-*/
+// Run is a single invocation of the tool, all history records reference it.
+type Run struct {
+	ID            int               `db:"id"`
+	StartedAt     time.Time         `db:"started_at"`
+	Labels        map[string]string `db:"labels"`
+	Metadata      map[string]any    `db:"metadata"`
+	ServerVersion string            `db:"server_version"` // empty if unknown
+	// WorkloadFingerprint is empty for generated workloads, see WorkloadFingerprint.
+	WorkloadFingerprint string `db:"workload_fingerprint"`
+}
 
 type GeneratedQueryDB struct {
 	ID           int    `db:"id"`
@@ -26,19 +36,6 @@ type GeneratedQueryDB struct {
 	Info         any    `db:"info"`
 }
 
-/*
-CREATE TABLE query_exec_info (
-    id SERIAL PRIMARY KEY,
-    query TEXT,
-    created_at TIMESTAMPTZ DEFAULT now(),
-    is_failed BOOLEAN,
-    qps REAL,
-    conns INT,
-    comment TEXT,
-    info JSONB
-);
-*/
-
 type QueryExecInfo struct {
 	ID        int     `db:"id"`
 	Query     string  `db:"query"`
@@ -51,33 +48,283 @@ type QueryExecInfo struct {
 }
 
 type DBHistory struct {
-	db *pgxpool.Pool
+	db    *pgxpool.Pool
+	runID int
+	// artifact collects all saved records, if set
+	artifact *Artifact
 }
 
 func NewDBHistory(db *pgxpool.Pool) *DBHistory {
 	return &DBHistory{db: db}
 }
 
+// StartRun creates a new run with the given labels and metadata.
+// All records saved afterwards are attached to this run.
+func (d *DBHistory) StartRun(labels map[string]string, metadata map[string]any) (int, error) {
+	if labels == nil {
+		labels = map[string]string{}
+	}
+
+	labelsJSON, err := json.Marshal(labels)
+	if err != nil {
+		return 0, err
+	}
+	metadataJSON, err := json.Marshal(metadata)
+	if err != nil {
+		return 0, err
+	}
+
+	err = d.db.QueryRow(context.Background(), `
+		INSERT INTO runs (labels, metadata)
+		VALUES ($1, $2)
+		RETURNING id`, labelsJSON, metadataJSON).Scan(&d.runID)
+	if err != nil {
+		return 0, err
+	}
+	d.artifact.startRun(d.runID, labels, metadata)
+	return d.runID, nil
+}
+
+// AttachRun attaches all records saved afterwards to an existing run,
+// e.g. one started by the coordinator of a distributed run.
+func (d *DBHistory) AttachRun(runID int) {
+	d.runID = runID
+}
+
+// SaveServerVersion records the version of the target database for the current run.
+func (d *DBHistory) SaveServerVersion(version pgversion.Version) error {
+	d.artifact.setServerVersion(version.Full)
+	if d.runID == 0 {
+		return nil
+	}
+	_, err := d.db.Exec(context.Background(), `UPDATE runs SET server_version = $1 WHERE id = $2`, version.Full, d.runID)
+	return err
+}
+
+// SaveWorkloadFingerprint records the fingerprint of the workload of the current run.
+func (d *DBHistory) SaveWorkloadFingerprint(fingerprint string) error {
+	d.artifact.setWorkloadFingerprint(fingerprint)
+	if d.runID == 0 {
+		return nil
+	}
+	_, err := d.db.Exec(context.Background(), `UPDATE runs SET workload_fingerprint = $1 WHERE id = $2`, fingerprint, d.runID)
+	return err
+}
+
+// LatestWorkloadFingerprint returns the workload fingerprint of the newest fingerprinted run
+// having all the given labels.
+func (d *DBHistory) LatestWorkloadFingerprint(labels map[string]string) (string, error) {
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	labelsJSON, err := json.Marshal(labels)
+	if err != nil {
+		return "", err
+	}
+
+	var fingerprint string
+	err = d.db.QueryRow(context.Background(), `
+		SELECT workload_fingerprint
+		FROM runs
+		WHERE labels @> $1::jsonb AND workload_fingerprint IS NOT NULL
+		ORDER BY id DESC
+		LIMIT 1`, labelsJSON).Scan(&fingerprint)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", fmt.Errorf("no runs with workload fingerprint")
+	}
+	return fingerprint, err
+}
+
+// RunID returns the id of the current run, or zero if no run was started.
+func (d *DBHistory) RunID() int {
+	return d.runID
+}
+
+// runIDArg returns run id as a query argument, NULL if no run was started.
+func (d *DBHistory) runIDArg() any {
+	if d.runID == 0 {
+		return nil
+	}
+	return d.runID
+}
+
 func (d *DBHistory) SaveGeneratedQuery(prompt, generatedSQL, modelUsed string) error {
 	_, err := d.db.Exec(context.Background(), `
-        INSERT INTO generated_queries (prompt, generated_sql, model_used)
-        VALUES ($1, $2, $3)`, prompt, generatedSQL, modelUsed)
+        INSERT INTO generated_queries (prompt, generated_sql, model_used, run_id)
+        VALUES ($1, $2, $3, $4)`, prompt, generatedSQL, modelUsed, d.runIDArg())
 	return err
 }
 
 func (d *DBHistory) SaveQueryExecInfo(info *QueryExecInfo) error {
+	ctx := context.Background()
+	d.artifact.record(info)
+
 	infoJSON, err := json.Marshal(info.Info)
 	if err != nil {
 		return err
 	}
 
-	_, err = d.db.Exec(context.Background(), `
-		INSERT INTO query_exec_info (query, is_failed, qps, conns, comment, info)
-		VALUES ($1, $2, $3, $4, $5, $6)`,
-		info.Query, info.IsFailed, info.QPS, info.Conns, info.Comment, infoJSON)
+	// numeric columns are filled only for execution statistics
+	var avgLatencyMs, p99LatencyMs *float64
+	var execCount, errorCount *int64
+	var topErrorCode *string
+	stats, isStats := info.Info.(*ExecStats)
+	if isStats {
+		avg := float64(stats.Avg) / float64(time.Millisecond)
+		p99 := float64(cmp.Or(stats.P99, seriesPercentile(stats.Series, 0.99))) / float64(time.Millisecond)
+		var count int64
+		for _, p := range stats.Series {
+			count += int64(p.Count)
+		}
+		avgLatencyMs, p99LatencyMs, execCount = &avg, &p99, &count
+
+		var failed int64
+		for _, n := range stats.ErrorCodes {
+			failed += int64(n)
+		}
+		errorCount = &failed
+		if code := stats.TopErrorCode(); code != "" {
+			topErrorCode = &code
+		}
+	}
+
+	fingerprint := QueryFingerprint(info.Query)
+
+	var id int
+	err = d.db.QueryRow(ctx, `
+		INSERT INTO query_exec_info (query, is_failed, qps, conns, comment, info, run_id, fingerprint,
+			avg_latency_ms, p99_latency_ms, exec_count, error_count, top_error_code)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+		RETURNING id`,
+		info.Query, info.IsFailed, info.QPS, info.Conns, info.Comment, infoJSON, d.runIDArg(),
+		fingerprint, avgLatencyMs, p99LatencyMs, execCount, errorCount, topErrorCode).Scan(&id)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	if !isStats || len(stats.Series) == 0 {
+		return nil
+	}
+
+	rows := make([][]any, 0, len(stats.Series))
+	for _, p := range stats.Series {
+		rows = append(rows, []any{
+			p.Time, d.runIDArg(), id, fingerprint, info.Conns,
+			p.QPS(), float64(p.Avg()) / float64(time.Millisecond), float64(p.Max) / float64(time.Millisecond),
+		})
+	}
+	_, err = d.db.CopyFrom(ctx,
+		pgx.Identifier{"query_exec_series"},
+		[]string{"time", "run_id", "exec_id", "fingerprint", "conns", "qps", "avg_latency_ms", "max_latency_ms"},
+		pgx.CopyFromRows(rows),
+	)
+	return err
+}
+
+// SaveAlert records crossed alerting threshold.
+func (d *DBHistory) SaveAlert(a alert.Alert) {
+	d.artifact.recordAlert(a)
+	_, err := d.db.Exec(context.Background(), `
+		INSERT INTO alerts (created_at, source, metric, value, threshold, run_id)
+		VALUES ($1, $2, $3, $4, $5, $6)`,
+		a.Time, a.Source, a.Metric, a.Value, a.Threshold, d.runIDArg())
+	if err != nil {
+		log.Error(context.Background(), "failed to save alert", zap.Error(err))
+	}
+}
+
+// LoadQueryExecInfos loads all execution records created after since, ordered by creation time.
+// If labels are not empty, only records of runs having all these labels are returned.
+// If workload is not empty, only records of runs with this workload fingerprint are returned.
+// Info is returned as raw JSON.
+func (d *DBHistory) LoadQueryExecInfos(since time.Time, labels map[string]string, workload string) ([]QueryExecInfo, error) {
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	labelsJSON, err := json.Marshal(labels)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := d.db.Query(context.Background(), `
+		SELECT qei.id, qei.query, qei.created_at::text, qei.is_failed, qei.qps, qei.conns, qei.comment, COALESCE(qei.info, 'null')
+		FROM query_exec_info qei
+		LEFT JOIN runs r ON r.id = qei.run_id
+		WHERE qei.created_at >= $1
+		  AND ($2::jsonb = '{}' OR r.labels @> $2::jsonb)
+		  AND ($3 = '' OR r.workload_fingerprint = $3)
+		ORDER BY qei.created_at, qei.id`, since, labelsJSON, workload)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []QueryExecInfo
+	for rows.Next() {
+		var info QueryExecInfo
+		var infoJSON []byte
+		err := rows.Scan(&info.ID, &info.Query, &info.CreatedAt, &info.IsFailed, &info.QPS, &info.Conns, &info.Comment, &infoJSON)
+		if err != nil {
+			return nil, err
+		}
+		info.Info = json.RawMessage(infoJSON)
+		res = append(res, info)
+	}
+
+	return res, rows.Err()
+}
+
+// LoadQueryExecInfo loads a single execution record by id. Info is returned as raw JSON.
+func (d *DBHistory) LoadQueryExecInfo(id int) (*QueryExecInfo, error) {
+	var info QueryExecInfo
+	var infoJSON []byte
+	err := d.db.QueryRow(context.Background(), `
+		SELECT id, query, created_at::text, is_failed, qps, conns, comment, COALESCE(info, 'null')
+		FROM query_exec_info
+		WHERE id = $1`, id).
+		Scan(&info.ID, &info.Query, &info.CreatedAt, &info.IsFailed, &info.QPS, &info.Conns, &info.Comment, &infoJSON)
+	if err != nil {
+		return nil, err
+	}
+	info.Info = json.RawMessage(infoJSON)
+	return &info, nil
+}
+
+// ListRuns returns runs having all the given labels, newest first.
+func (d *DBHistory) ListRuns(labels map[string]string) ([]Run, error) {
+	return d.ListWorkloadRuns(labels, "")
+}
+
+// ListWorkloadRuns returns runs having all the given labels and the workload fingerprint,
+// if it's not empty, newest first.
+func (d *DBHistory) ListWorkloadRuns(labels map[string]string, workload string) ([]Run, error) {
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	labelsJSON, err := json.Marshal(labels)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := d.db.Query(context.Background(), `
+		SELECT id, started_at, labels, COALESCE(metadata, '{}'), COALESCE(server_version, ''),
+			COALESCE(workload_fingerprint, '')
+		FROM runs
+		WHERE labels @> $1::jsonb
+		  AND ($2 = '' OR workload_fingerprint = $2)
+		ORDER BY id DESC`, labelsJSON, workload)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []Run
+	for rows.Next() {
+		var run Run
+		if err := rows.Scan(&run.ID, &run.StartedAt, &run.Labels, &run.Metadata, &run.ServerVersion, &run.WorkloadFingerprint); err != nil {
+			return nil, err
+		}
+		res = append(res, run)
+	}
+	return res, rows.Err()
 }
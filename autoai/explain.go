@@ -0,0 +1,162 @@
+package autoai
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/petuhovskiy/overload/internal/dbconn"
+	"github.com/petuhovskiy/overload/internal/log"
+	"go.uber.org/zap"
+)
+
+// PlanAnalysis is the plan of a single execution of the query with run-time statistics,
+// from EXPLAIN (ANALYZE, BUFFERS, FORMAT JSON).
+type PlanAnalysis struct {
+	// Plan is the raw EXPLAIN output.
+	Plan  json.RawMessage
+	Shape string
+	// SeqScans are the tables read with sequential scans.
+	SeqScans        []string `json:",omitempty"`
+	PlanningTimeMs  float64
+	ExecutionTimeMs float64
+	// SharedHitBlocks and SharedReadBlocks are buffers of the whole plan found in and read into shared buffers.
+	SharedHitBlocks  int64
+	SharedReadBlocks int64
+}
+
+// seqScans appends relations read by sequential scans of the node and its children.
+func (n *explainNode) seqScans(tables []string) []string {
+	if n.NodeType == "Seq Scan" && n.RelationName != "" && !slices.Contains(tables, n.RelationName) {
+		tables = append(tables, n.RelationName)
+	}
+	for i := range n.Plans {
+		tables = n.Plans[i].seqScans(tables)
+	}
+	return tables
+}
+
+// explainSQL is the prefix of the query explained with run-time statistics.
+const explainSQL = "EXPLAIN (ANALYZE, BUFFERS, FORMAT JSON) "
+
+// isExplainable returns true for statements which can be explained, DDL and utility
+// statements can't.
+func isExplainable(sql string) bool {
+	kw := statementKeyword(sql)
+	for _, prefix := range []string{"SELECT", "WITH", "VALUES", "TABLE", "INSERT", "UPDATE", "DELETE", "MERGE"} {
+		if kw == prefix || strings.HasPrefix(kw, prefix+" ") || strings.HasPrefix(kw, prefix+"(") {
+			return true
+		}
+	}
+	return false
+}
+
+// explainAnalyze executes the query once with EXPLAIN (ANALYZE, BUFFERS, FORMAT JSON) in a transaction
+// which is rolled back, so that writes of the query are not applied. The execution is limited by the
+// statement timeout of the workload. Queries that can't be explained (e.g. DDL and transaction scripts)
+// return an error.
+func (l *Launcher) explainAnalyze(ctx context.Context, opts execOptions, connstr string, query Query) (*PlanAnalysis, error) {
+	config, err := opts.connConfig(connstr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := dbconn.ConnectConfig(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close(context.Background())
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(context.Background())
+
+	if opts.statementTimeout > 0 {
+		if _, err := tx.Exec(ctx, fmt.Sprintf("SET LOCAL statement_timeout = %d", opts.statementTimeout.Milliseconds())); err != nil {
+			return nil, err
+		}
+	}
+
+	bound := bindQuery(query)
+	var raw []byte
+	err = tx.QueryRow(ctx, explainSQL+bound.sql, bound.args(newRand())...).Scan(&raw)
+	if err != nil {
+		return nil, err
+	}
+	return parsePlan(raw)
+}
+
+// parsePlan parses the output of EXPLAIN (ANALYZE, BUFFERS, FORMAT JSON).
+func parsePlan(raw []byte) (*PlanAnalysis, error) {
+	var plans []struct {
+		Plan          explainNode `json:"Plan"`
+		PlanningTime  float64     `json:"Planning Time"`
+		ExecutionTime float64     `json:"Execution Time"`
+	}
+	if err := json.Unmarshal(raw, &plans); err != nil {
+		return nil, err
+	}
+	if len(plans) == 0 {
+		return nil, fmt.Errorf("empty plan")
+	}
+
+	root := plans[0]
+	return &PlanAnalysis{
+		Plan:             raw,
+		Shape:            root.Plan.shape(),
+		SeqScans:         root.Plan.seqScans(nil),
+		PlanningTimeMs:   root.PlanningTime,
+		ExecutionTimeMs:  root.ExecutionTime,
+		SharedHitBlocks:  root.Plan.SharedHitBlocks,
+		SharedReadBlocks: root.Plan.SharedReadBlocks,
+	}, nil
+}
+
+// capturePlan explains the query once and records the plan in the history, it returns nil if the
+// capture is disabled or the query can't be explained. The plan captured by the validation of
+// generated queries is reused, so that the query is not executed once more.
+func (l *Launcher) capturePlan(ctx context.Context, opts execOptions, connstr string, query Query) *PlanAnalysis {
+	if l.conf.SkipExplainAnalyze {
+		return nil
+	}
+	plan := query.plan
+	if plan == nil {
+		var err error
+		plan, err = l.explainAnalyze(ctx, opts, connstr, query)
+		if err != nil {
+			log.Debug(ctx, "query can't be explained, plan is not captured", zap.Error(err))
+			return nil
+		}
+	}
+	log.Info(ctx, "query plan captured",
+		zap.String("shape", plan.Shape),
+		zap.Strings("seq_scans", plan.SeqScans),
+		zap.Float64("execution_time_ms", plan.ExecutionTimeMs),
+	)
+	go l.db.SaveQueryExecInfo(plan.ToExecInfo(query.SQL))
+	return plan
+}
+
+// ToExecInfo converts the plan to a history record.
+func (p *PlanAnalysis) ToExecInfo(query string) *QueryExecInfo {
+	return &QueryExecInfo{
+		Query:   query,
+		Comment: "explain analyze",
+		Info:    p,
+	}
+}
+
+// planFeedback describes the plan of a query for the prompt, names are hidden by the anonymizer.
+func (g *Generator) planFeedback(plan *PlanAnalysis) string {
+	if plan == nil {
+		return ""
+	}
+	feedback := fmt.Sprintf(", its plan was %s and took %.1fms", g.anonymizer.Hide(plan.Shape), plan.ExecutionTimeMs)
+	if len(plan.SeqScans) > 0 {
+		feedback += fmt.Sprintf(", with sequential scans on %s", g.anonymizer.Hide(strings.Join(plan.SeqScans, ", ")))
+	}
+	return feedback
+}
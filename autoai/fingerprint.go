@@ -0,0 +1,54 @@
+package autoai
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"strings"
+)
+
+// QueryFingerprint returns a stable identifier of the query, which doesn't
+// depend on whitespace, letter case and trailing semicolons.
+func QueryFingerprint(sql string) string {
+	normalized := strings.ToLower(strings.Join(strings.Fields(sql), " "))
+	normalized = strings.TrimRight(normalized, "; ")
+
+	hash := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(hash[:8])
+}
+
+// WorkloadFingerprint returns a stable identifier of the workload, so that runs of the same
+// workload can be found in the history. It depends on normalized queries with their weights,
+// params and classes, and on the configuration, but not on the order of queries.
+func WorkloadFingerprint(queries []Query, config any) (string, error) {
+	type queryKey struct {
+		Fingerprint string
+		Weight      float64
+		Params      map[string]ParamGenerator `json:",omitempty"`
+		Class       string                    `json:",omitempty"`
+	}
+	keys := make([]queryKey, 0, len(queries))
+	for _, q := range queries {
+		keys = append(keys, queryKey{
+			Fingerprint: QueryFingerprint(q.SQL),
+			Weight:      q.Weight,
+			Params:      q.Params,
+			Class:       q.Class,
+		})
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Fingerprint < keys[j].Fingerprint
+	})
+
+	// json sorts map keys, so equal configs are always encoded the same way
+	data, err := json.Marshal(struct {
+		Queries []queryKey
+		Config  any
+	}{keys, config})
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:8]), nil
+}
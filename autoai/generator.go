@@ -2,36 +2,108 @@ package autoai
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"strings"
 	"sync"
-	"time"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/petuhovskiy/overload/errs"
+	"github.com/petuhovskiy/overload/internal/compat"
+	"github.com/petuhovskiy/overload/internal/dbconn"
 	"github.com/petuhovskiy/overload/internal/log"
+	"github.com/petuhovskiy/overload/internal/pgversion"
 	"github.com/sashabaranov/go-openai"
 	"go.uber.org/zap"
 )
 
 type Query struct {
 	SQL string
+	// Weight is the relative share of connections running this query in a mix.
+	Weight float64
+	// Params are value generators for named placeholders in SQL, like :aid.
+	Params map[string]ParamGenerator
+	// Script is set for transaction scripts, it holds all statements including BEGIN and COMMIT.
+	// Generated values of params are shared by all statements of a single execution.
+	Script []string
+	// StatementLatency enables latency capture for every statement of the script.
+	StatementLatency bool
+	// Class groups queries for latency reporting, empty if the query has no class.
+	Class string
+
+	// plan is captured by the validation of a generated query, so that the launcher doesn't
+	// explain it again, nil if it wasn't captured.
+	plan *PlanAnalysis
+}
+
+// Generation focuses, selecting the kind of queries requested from the model.
+const (
+	// FocusDefault is the general OLTP mix.
+	FocusDefault = ""
+	// FocusUpsert asks for conflict-resolution-heavy queries: INSERT ... ON CONFLICT and MERGE.
+	FocusUpsert = "upsert"
+)
+
+// Provider is the chat completion API of the model, implemented by the OpenAI client
+// and by fixtures, see package fixture.
+type Provider interface {
+	CreateChatCompletion(ctx context.Context, req openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error)
 }
 
 type Generator struct {
-	client     *openai.Client
-	history    *DBHistory
-	prevPrompt string
-	launcher   *Launcher
+	client   Provider
+	history  *DBHistory
+	launcher *Launcher
+	focus    string
+	// prevPrompts is the feedback on the previous queries of every target, by target name
+	prevPrompts map[string]string
+	// targets are rotated by DoIteration, current is the target of the running iteration
+	targets []Target
+	next    int
+	current Target
+	// indexAdvice configures index experiments for slow queries, disabled if Mode is empty
+	indexAdvice IndexAdviceConfig
+	// quarantineThreshold is the number of failures that quarantine a query, see SetQuarantineThreshold
+	quarantineThreshold int
+	// anonymizer hides names of the schema from the model, nil if disabled
+	anonymizer *Anonymizer
+	// patternHistory is the number of history records aggregated by pattern, see SetPatternHistory
+	patternHistory int
+	// usage is the token usage of generations of the current iteration
+	usage openai.Usage
+	// validation configures the dry run of generated queries, see SetValidation
+	validation ValidationConfig
+	// iteration is the number of finished iterations, failureModes are the failure modes seen
+	// in them, see Scorecard
+	iteration    int
+	failureModes map[string]bool
 }
 
-func NewGenerator(client *openai.Client, history *DBHistory) *Generator {
+func NewGenerator(client Provider, history *DBHistory, launcher *Launcher) *Generator {
 	return &Generator{
-		client:   client,
-		history:  history,
-		launcher: &Launcher{db: history},
+		client:      client,
+		history:     history,
+		launcher:    launcher,
+		prevPrompts: map[string]string{},
+	}
+}
+
+// SetFocus selects the kind of generated queries, one of the Focus constants.
+func (g *Generator) SetFocus(focus string) error {
+	switch focus {
+	case FocusDefault, FocusUpsert:
+		g.focus = focus
+		return nil
+	default:
+		return errs.Validationf("unknown generation focus %q", focus)
 	}
 }
 
+// SetAnonymizer enables pseudonymization of the schema in prompts, see Anonymizer.
+func (g *Generator) SetAnonymizer(a *Anonymizer) {
+	g.anonymizer = a
+}
+
 // TableInfo holds basic information for a table.
 type TableInfo struct {
 	Schema string
@@ -40,11 +112,12 @@ type TableInfo struct {
 
 func (g *Generator) SavePrevResult(success, failed string) {
 	if success != "" || failed != "" {
-		g.prevPrompt = fmt.Sprintf("\n\nYou previously generated some queries that were executed with the following results:%s%s\n", failed, success)
+		g.prevPrompts[g.current.Name] = fmt.Sprintf("\n\nYou previously generated some queries that were executed with the following results:%s%s\n", failed, success)
 	}
 }
 
-// DumpSchema retrieves the schema of the database and returns it as a string.
+// DumpSchema retrieves the schema of the database and returns it as a string, limited to the schema
+// of the current target if it has one.
 // It returns a compact representation of tables with their columns, primary keys, and foreign keys.
 func (g *Generator) DumpSchema(conn *pgx.Conn) (string, error) {
 	ctx := context.Background()
@@ -54,11 +127,11 @@ func (g *Generator) DumpSchema(conn *pgx.Conn) (string, error) {
 	tableQuery := `
 		SELECT table_schema, table_name 
 		FROM information_schema.tables 
-		WHERE table_schema NOT IN ('pg_catalog', 'information_schema')
+		WHERE table_schema <> ALL($1) AND ($2::text = '' OR table_schema = $2)
 		ORDER BY table_schema, table_name;
 	`
 	// Load all table info into a slice
-	rows, err := conn.Query(ctx, tableQuery)
+	rows, err := conn.Query(ctx, tableQuery, append(compat.SystemSchemas, snapshotSchema, shadowSchema), g.current.Schema)
 	if err != nil {
 		return "", err
 	}
@@ -77,19 +150,30 @@ func (g *Generator) DumpSchema(conn *pgx.Conn) (string, error) {
 	}
 	rows.Close()
 
+	citus, err := isCitus(ctx, conn)
+	if err != nil {
+		return "", err
+	}
+	if citus {
+		sb.WriteString("Tables are distributed with Citus. Queries filtering by the distribution column with equality " +
+			"are routed to a single shard, other queries are executed on all shards.\n\n")
+	}
+
 	// Process each table
 	for _, t := range tables {
 		fullTableName := fmt.Sprintf("%s.%s", t.Schema, t.Name)
 
 		// Get table size for size indication
-		var tableSize int64
-		err = conn.QueryRow(ctx, `SELECT pg_total_relation_size($1)`, fullTableName).Scan(&tableSize)
-		if err != nil {
+		tableSize, err := compat.RelationSize(ctx, conn, quoteTable(fullTableName))
+		if err != nil && !errors.Is(err, compat.ErrUnsupported) {
 			return "", err
 		}
 
 		// Format size in a readable way
 		sizeStr := "small"
+		if errors.Is(err, compat.ErrUnsupported) {
+			sizeStr = "unknown size"
+		}
 		if tableSize > 10*1024*1024 { // 10MB
 			sizeStr = "medium"
 		}
@@ -97,7 +181,21 @@ func (g *Generator) DumpSchema(conn *pgx.Conn) (string, error) {
 			sizeStr = "large"
 		}
 
-		sb.WriteString(fmt.Sprintf("TABLE %s (%s):\n", fullTableName, sizeStr))
+		sb.WriteString(fmt.Sprintf("TABLE %s.%s (%s):\n",
+			g.anonymizer.name(anonSchema, t.Schema), g.anonymizer.name(anonTable, t.Name), sizeStr))
+
+		if citus {
+			distribution, err := citusDistribution(ctx, conn, quoteTable(fullTableName))
+			if err != nil {
+				return "", err
+			}
+			if column, ok := strings.CutPrefix(distribution, "DISTRIBUTED BY "); ok {
+				distribution = "DISTRIBUTED BY " + g.anonymizer.name(anonColumn, column)
+			}
+			if distribution != "" {
+				sb.WriteString("  " + distribution + "\n")
+			}
+		}
 
 		// Retrieve columns with condensed output
 		colQuery := `
@@ -108,7 +206,8 @@ func (g *Generator) DumpSchema(conn *pgx.Conn) (string, error) {
 				CASE WHEN column_default IS NOT NULL THEN 'DEFAULT ' || column_default ELSE '' END as default_value,
 				CASE WHEN EXISTS (
 					SELECT 1 FROM information_schema.table_constraints tc
-					JOIN information_schema.constraint_column_usage ccu ON tc.constraint_name = ccu.constraint_name
+					JOIN information_schema.constraint_column_usage ccu
+					  ON tc.constraint_name = ccu.constraint_name AND tc.constraint_schema = ccu.constraint_schema
 					WHERE tc.table_schema = $1 AND tc.table_name = $2
 					AND tc.constraint_type = 'PRIMARY KEY' AND ccu.column_name = columns.column_name
 				) THEN 'PK' ELSE '' END AS is_pk
@@ -143,13 +242,13 @@ func (g *Generator) DumpSchema(conn *pgx.Conn) (string, error) {
 				parts = append(parts, nullable)
 			}
 			if defaultValue != "" {
-				parts = append(parts, defaultValue)
+				parts = append(parts, g.anonymizer.hideDefault(defaultValue))
 			}
 			if pkStr != "" {
 				parts = append(parts, pkStr)
 			}
 
-			sb.WriteString(fmt.Sprintf("  %s: %s\n", column, strings.Join(parts, " ")))
+			sb.WriteString(fmt.Sprintf("  %s: %s\n", g.anonymizer.name(anonColumn, column), strings.Join(parts, " ")))
 		}
 		colRows.Close()
 
@@ -161,9 +260,9 @@ func (g *Generator) DumpSchema(conn *pgx.Conn) (string, error) {
 				ccu.column_name AS references_column
 			FROM information_schema.table_constraints AS tc
 			JOIN information_schema.key_column_usage AS kcu
-			  ON tc.constraint_name = kcu.constraint_name
+			  ON tc.constraint_name = kcu.constraint_name AND tc.constraint_schema = kcu.constraint_schema
 			JOIN information_schema.constraint_column_usage AS ccu
-			  ON ccu.constraint_name = tc.constraint_name
+			  ON ccu.constraint_name = tc.constraint_name AND ccu.constraint_schema = tc.constraint_schema
 			WHERE tc.constraint_type = 'FOREIGN KEY'
 			  AND tc.table_schema = $1
 			  AND tc.table_name = $2;
@@ -185,7 +284,8 @@ func (g *Generator) DumpSchema(conn *pgx.Conn) (string, error) {
 				fkRows.Close()
 				return "", err
 			}
-			sb.WriteString(fmt.Sprintf("    %s -> %s(%s)\n", colName, refsTable, refsCol))
+			sb.WriteString(fmt.Sprintf("    %s -> %s(%s)\n", g.anonymizer.name(anonColumn, colName),
+				g.anonymizer.qualified(anonTable, refsTable), g.anonymizer.name(anonColumn, refsCol)))
 		}
 		fkRows.Close()
 
@@ -216,9 +316,9 @@ func (g *Generator) DumpSchema(conn *pgx.Conn) (string, error) {
 			// Extract just the essential part of the index definition
 			parts := strings.Split(idxDef, "USING")
 			if len(parts) > 1 {
-				sb.WriteString(fmt.Sprintf("    %s: USING%s\n", idxName, parts[1]))
+				sb.WriteString(fmt.Sprintf("    %s: USING%s\n", g.anonymizer.name(anonIndex, idxName), g.anonymizer.Hide(parts[1])))
 			} else {
-				sb.WriteString(fmt.Sprintf("    %s\n", idxName))
+				sb.WriteString(fmt.Sprintf("    %s\n", g.anonymizer.name(anonIndex, idxName)))
 			}
 		}
 		idxRows.Close()
@@ -229,11 +329,41 @@ func (g *Generator) DumpSchema(conn *pgx.Conn) (string, error) {
 	return sb.String(), nil
 }
 
+// isCitus returns true if the database has Citus metadata tables.
+func isCitus(ctx context.Context, conn *pgx.Conn) (bool, error) {
+	var citus bool
+	err := conn.QueryRow(ctx, `SELECT to_regclass('pg_catalog.pg_dist_partition') IS NOT NULL`).Scan(&citus)
+	return citus, err
+}
+
+// citusDistribution describes how the table is distributed, empty for local tables.
+func citusDistribution(ctx context.Context, conn *pgx.Conn, table string) (string, error) {
+	var method string
+	var column *string
+	err := conn.QueryRow(ctx, `
+		SELECT partmethod::text, column_to_column_name(logicalrelid, partkey)
+		FROM pg_dist_partition
+		WHERE logicalrelid = $1::regclass`, table).Scan(&method, &column)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if column == nil {
+		return "REFERENCE TABLE (replicated to all nodes)", nil
+	}
+	return "DISTRIBUTED BY " + *column, nil
+}
+
 func (g *Generator) Generate(conn *pgx.Conn) ([]Query, error) {
 	schema, err := g.DumpSchema(conn)
 	if err != nil {
 		return nil, err
 	}
+	if err := g.anonymizer.Save(); err != nil {
+		return nil, fmt.Errorf("failed to save anonymization map: %w", err)
+	}
 
 	const promptTemplate = `
 You have a postgres database. Your task is to generate SQL queries for simulating real-life OLTP workload for this database.
@@ -250,16 +380,19 @@ Try not to trigger seqscans on large tables, prefer to use indexes. If the table
 Try not to assume anything about value ranges when writing WHERE clauses, instead prefer using select subqueries to select some random existing values in the table - the easy way to do this is to use LIMIT and OFFSET with random constants.
 Each query should not take more than 30 seconds to run, otherwise it will considered as failed.
 
+%s%s
 The schema of this postgres database is the following:
 
 %s
-%s
+%s%s
 Please generate 5 SQL queries. Do not explain them, just return 5 markdown code blocks with SQL queries.
 Queries must be valid SQL queries and must be executable in database with the given schema.
 Each query must be in a separate code block, and the code block must be marked with "sql" language specifier.
 `
 
-	prompt := fmt.Sprintf(promptTemplate, schema, g.prevPrompt)
+	version := pgversion.FromConn(conn)
+	prompt := fmt.Sprintf(promptTemplate, versionHints(version), focusHints(g.focus, version), schema,
+		g.patternHints(context.Background(), schema), g.prevPrompts[g.current.Name])
 
 	resp, err := g.client.CreateChatCompletion(context.Background(), openai.ChatCompletionRequest{
 		Model: openai.GPT4o,
@@ -271,8 +404,10 @@ Each query must be in a separate code block, and the code block must be marked w
 		},
 	})
 	if err != nil {
-		return nil, err
+		return nil, errs.Generation(err)
 	}
+	g.usage.PromptTokens += resp.Usage.PromptTokens
+	g.usage.CompletionTokens += resp.Usage.CompletionTokens
 
 	fmt.Println("Prompt:")
 	fmt.Println(prompt)
@@ -288,7 +423,9 @@ Each query must be in a separate code block, and the code block must be marked w
 		return nil, err
 	}
 
-	for _, query := range queries {
+	for i, query := range queries {
+		query.SQL = g.anonymizer.Restore(query.SQL)
+		queries[i] = query
 		if err := g.history.SaveGeneratedQuery(prompt, query.SQL, resp.Model); err != nil {
 			log.Error(context.Background(), "Failed to save generated query: %v", zap.Error(err))
 		}
@@ -297,11 +434,49 @@ Each query must be in a separate code block, and the code block must be marked w
 	return queries, nil
 }
 
+// versionHints describes features of the server version, so that generated queries can be executed.
+func versionHints(version pgversion.Version) string {
+	if version.Num == 0 {
+		return ""
+	}
+	hints := fmt.Sprintf("The server is PostgreSQL %s.\n", version)
+	if !version.IsPostgres() {
+		hints = fmt.Sprintf("The server is %s, compatible with PostgreSQL %d. Avoid Postgres-specific functions and extensions.\n",
+			version.Engine, version.Major())
+	}
+	if version.HasMerge() {
+		hints += "You can use MERGE statements.\n"
+	} else {
+		hints += "MERGE is not supported by this version, use INSERT ... ON CONFLICT instead.\n"
+	}
+	if !version.HasGeneratedColumns() {
+		hints += "Generated columns are not supported by this version.\n"
+	}
+	return hints
+}
+
+// focusHints describes the kind of queries requested by the focus.
+func focusHints(focus string, version pgversion.Version) string {
+	if focus != FocusUpsert {
+		return ""
+	}
+	hints := `Focus on conflict resolution. Most queries must insert rows with keys that often already exist
+and resolve the conflict with INSERT ... ON CONFLICT ... DO UPDATE or DO NOTHING, including multi-row upserts
+from SELECT and upserts of a few hot rows (like counters) updated by many sessions at once. Pick conflicting keys
+from existing rows with subqueries, and sometimes use new keys, so that both paths are exercised.
+If a table has no unique constraint to conflict on, create one.
+`
+	if version.HasMerge() {
+		hints += "About half of the queries must be MERGE statements with WHEN MATCHED and WHEN NOT MATCHED clauses.\n"
+	}
+	return hints
+}
+
 func (g *Generator) splitQueries(markdown string) ([]Query, error) {
 	// Split the markdown string into separate queries based on code blocks
 	queries := strings.Split(markdown, "```")
 	if len(queries) < 2 {
-		return nil, fmt.Errorf("invalid markdown format")
+		return nil, errs.Generation(fmt.Errorf("invalid markdown format"))
 	}
 
 	var result []Query
@@ -314,47 +489,65 @@ func (g *Generator) splitQueries(markdown string) ([]Query, error) {
 	return result, nil
 }
 
+// DoIteration generates queries and executes them against connstr, or against the next target
+// if targets are set, see SetTargets.
 func (g *Generator) DoIteration(ctx context.Context, connstr string) error {
-	conn, err := pgx.Connect(ctx, connstr)
+	g.current = g.nextTarget(connstr)
+	connstr = g.current.connstr()
+	if g.current.Name != "" {
+		ctx = log.With(ctx, zap.String("target", g.current.Name))
+		log.Info(ctx, "iteration target")
+	}
+
+	conn, err := dbconn.Connect(ctx, connstr)
 	if err != nil {
-		return fmt.Errorf("failed to connect to database: %v", err)
+		return fmt.Errorf("failed to connect to database: %w", err)
 	}
 
-	queries, err := g.Generate(conn)
+	g.usage = openai.Usage{}
+	queries, failedQueries, generated, err := g.generateValid(ctx, conn)
+	if err != nil {
+		return err
+	}
 
 	wg := sync.WaitGroup{}
 	wg.Add(len(queries))
 
-	failedQueries := ""
 	successQueries := ""
 
 	resMutex := sync.Mutex{}
+	allStats := make([]ExecStats, len(queries))
 
-	for _, query := range queries {
-		go func(q Query) {
+	for i, query := range queries {
+		go func(i int, q Query) {
 			defer wg.Done()
 			stats := g.launcher.Run(ctx, connstr, q)
+			allStats[i] = stats
 
 			resMutex.Lock()
 			defer resMutex.Unlock()
-			if err != nil {
-				log.Error(ctx, "failed to execute query", zap.String("query", q.SQL), zap.Error(err))
-				failedQueries += fmt.Sprintf("\n\nThis query failed to execute with an error:\n```sql\n%s\n```", q.SQL)
+			if stats.Count == 0 && stats.Error != nil {
+				log.Error(ctx, "failed to execute query", zap.String("query", q.SQL), zap.Error(stats.Error))
+				g.recordFailure(ctx, q.SQL, "error: "+stats.Error.Error())
+				failedQueries += fmt.Sprintf("\n\nThis query failed to execute with an error:\n```sql\n%s\n```", g.anonymizer.hideSQL(q.SQL))
 			} else if stats.Count == 0 {
-				failedQueries += fmt.Sprintf("\n\nThis query never finished, most likely timed out:\n```sql\n%s\n```", q.SQL)
+				g.recordFailure(ctx, q.SQL, "timed out")
+				failedQueries += fmt.Sprintf("\n\nThis query never finished, most likely timed out:\n```sql\n%s\n```", g.anonymizer.hideSQL(q.SQL))
 			} else if stats.Avg != 0 {
-				qps := float32(time.Second / stats.Avg)
-				successQueries += fmt.Sprintf("\n\nThis was a good query that was running at a rate %v QPS:\n```sql\n%s\n```", qps, q.SQL)
+				qps := float32(stats.PeakQPS)
+				successQueries += fmt.Sprintf("\n\nThis was a good query that was running at a rate %v QPS%s:\n```sql\n%s\n```", qps, g.planFeedback(stats.Plan), g.anonymizer.hideSQL(q.SQL))
 			}
-		}(query)
+		}(i, query)
 	}
 
 	wg.Wait()
+	g.adviseIndexes(ctx, connstr, queries, allStats)
 
 	fmt.Println("Successful queries:" + successQueries)
 	fmt.Println("Failed queries:" + failedQueries)
 
 	g.SavePrevResult(failedQueries, successQueries)
+	g.reportScorecard(ctx, g.scoreIteration(generated, allStats))
 
 	return nil
 }
@@ -0,0 +1,95 @@
+package autoai
+
+import "fmt"
+
+// GrafanaDashboard returns Grafana dashboard model visualizing the history tables.
+// Datasource is the uid of the Postgres datasource pointing to the history database.
+func GrafanaDashboard(datasource string) map[string]any {
+	ds := map[string]any{"type": "grafana-postgresql-datasource", "uid": datasource}
+
+	const runFilter = "run_id IN ($run_id)"
+
+	id := 0
+	panel := func(title, typ, sql, format string, x, y, w, h int) map[string]any {
+		id++
+		return map[string]any{
+			"id":         id,
+			"title":      title,
+			"type":       typ,
+			"datasource": ds,
+			"gridPos":    map[string]any{"x": x, "y": y, "w": w, "h": h},
+			"targets": []any{map[string]any{
+				"refId":      "A",
+				"datasource": ds,
+				"rawQuery":   true,
+				"editorMode": "code",
+				"format":     format,
+				"rawSql":     sql,
+			}},
+		}
+	}
+
+	panels := []any{
+		panel("QPS per query", "timeseries", fmt.Sprintf(`
+SELECT time AS "time", fingerprint || ' x' || conns AS metric, qps AS value
+FROM query_exec_series
+WHERE $__timeFilter(time) AND %s
+ORDER BY 1`, runFilter), "time_series", 0, 0, 12, 9),
+		panel("Average latency per query, ms", "timeseries", fmt.Sprintf(`
+SELECT time AS "time", fingerprint || ' x' || conns AS metric, avg_latency_ms AS value
+FROM query_exec_series
+WHERE $__timeFilter(time) AND %s
+ORDER BY 1`, runFilter), "time_series", 12, 0, 12, 9),
+		panel("Step results", "table", fmt.Sprintf(`
+SELECT created_at AS "time", run_id, fingerprint, conns, qps, avg_latency_ms, p99_latency_ms, exec_count, comment, left(query, 200) AS query
+FROM query_exec_info
+WHERE $__timeFilter(created_at) AND %s
+ORDER BY created_at DESC`, runFilter), "table", 0, 9, 24, 10),
+		panel("Alerts", "table", fmt.Sprintf(`
+SELECT created_at AS "time", run_id, source, metric, value, threshold
+FROM alerts
+WHERE $__timeFilter(created_at) AND %s
+ORDER BY created_at DESC`, runFilter), "table", 0, 19, 12, 8),
+		panel("Runs", "table", `
+SELECT started_at AS "time", id, labels::text AS labels, metadata::text AS metadata
+FROM runs
+WHERE id IN ($run_id)
+ORDER BY id DESC`, "table", 12, 19, 12, 8),
+	}
+
+	return map[string]any{
+		"uid":           "overload-history",
+		"title":         "overload history",
+		"schemaVersion": 39,
+		"time":          map[string]any{"from": "now-24h", "to": "now"},
+		"panels":        panels,
+		"templating": map[string]any{
+			"list": []any{map[string]any{
+				"name":       "run_id",
+				"label":      "Run",
+				"type":       "query",
+				"datasource": ds,
+				"query":      "SELECT id AS __value, id || ' ' || labels::text AS __text FROM runs ORDER BY id DESC",
+				"multi":      true,
+				"includeAll": true,
+				"refresh":    2,
+			}},
+		},
+		"annotations": map[string]any{
+			"list": []any{map[string]any{
+				"name":       "Alerts",
+				"datasource": ds,
+				"enable":     true,
+				"iconColor":  "red",
+				"target": map[string]any{
+					"rawQuery": true,
+					"format":   "table",
+					"rawSql": fmt.Sprintf(`
+SELECT created_at AS "time", source || ': ' || metric || ' = ' || value AS text
+FROM alerts
+WHERE $__timeFilter(created_at) AND %s`, runFilter),
+				},
+			}},
+		},
+	}
+}
@@ -0,0 +1,325 @@
+package autoai
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/petuhovskiy/overload/internal/clientstats"
+	"github.com/petuhovskiy/overload/internal/dbconn"
+	"github.com/petuhovskiy/overload/internal/log"
+	"github.com/petuhovskiy/overload/internal/pgversion"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultHeadroomInterval = time.Second
+	// headroomWindow smooths per-second throughput, so that a single fast second isn't taken
+	// as the capacity of the server.
+	headroomWindow = 10 * time.Second
+	// boundShare is the share of active backend samples in a wait class that makes the server
+	// bound by it.
+	boundShare = 0.3
+	blockSize  = 8192
+)
+
+// Bottlenecks of the headroom report.
+const (
+	BoundCPU     = "cpu"
+	BoundIO      = "io"
+	BoundLock    = "lock"
+	BoundClient  = "client"
+	BoundUnknown = "unknown"
+)
+
+type HeadroomConfig struct {
+	// P99 is the latency objective of SLA-compliant throughput.
+	P99 time.Duration
+	// Interval is the period of server activity samples.
+	Interval time.Duration
+}
+
+func (c *HeadroomConfig) Normalize() {
+	if c.P99 == 0 {
+		c.P99 = defaultLatencySLO
+	}
+	if c.Interval == 0 {
+		c.Interval = defaultHeadroomInterval
+	}
+}
+
+// Headroom is the sizing conclusion of the run, combining client throughput and latency with
+// server activity samples and statistics.
+type Headroom struct {
+	// MaxQPS is the best total throughput over 10-second windows, SLAQPS is the best throughput
+	// of windows with p99 latency within SLAP99.
+	MaxQPS float64
+	SLAQPS float64
+	SLAP99 time.Duration
+	// ActiveSamples is the number of sampled active client backends, CPUShare, IOShare and
+	// LockShare are the shares of them running on CPU, waiting for IO and waiting for locks.
+	ActiveSamples int
+	CPUShare      float64
+	IOShare       float64
+	LockShare     float64
+	// CacheHitRatio is the share of blocks read from shared buffers, ReadMBps and WriteMBps are
+	// the average IO rates from pg_stat_io, or from block and bgwriter counters before Postgres 16.
+	CacheHitRatio float64
+	ReadMBps      float64
+	WriteMBps     float64
+	// MaxConnections is the number of connections available to clients, PeakConnections is the
+	// most observed at once.
+	MaxConnections  int
+	PeakConnections int
+	// Bound is the main bottleneck, one of the Bound constants.
+	Bound      string
+	Conclusion string
+}
+
+// HeadroomTracker samples server activity until Stop, which adds the headroom to the artifact.
+type HeadroomTracker struct {
+	conf     HeadroomConfig
+	connstr  string
+	artifact *Artifact
+	cancel   context.CancelFunc
+	done     chan struct{}
+
+	mu              sync.Mutex
+	waits           map[string]int
+	peakConnections int
+	maxConnections  int
+	version         pgversion.Version
+	startCounters   serverCounters
+	startTime       time.Time
+}
+
+// serverCounters are cumulative IO statistics of the server.
+type serverCounters struct {
+	blocksRead, blocksHit   int64
+	readBytes, writtenBytes int64
+}
+
+// TrackHeadroom starts sampling server activity. Tracking is disabled if the server can't be queried.
+func TrackHeadroom(ctx context.Context, connstr string, conf HeadroomConfig, artifact *Artifact) *HeadroomTracker {
+	conf.Normalize()
+	t := &HeadroomTracker{
+		conf:      conf,
+		connstr:   connstr,
+		artifact:  artifact,
+		done:      make(chan struct{}),
+		waits:     map[string]int{},
+		startTime: time.Now(),
+	}
+
+	conn, err := dbconn.Connect(ctx, connstr)
+	if err == nil {
+		t.version = pgversion.FromConn(conn)
+		t.startCounters, err = readServerCounters(ctx, conn, t.version)
+		if err == nil {
+			err = conn.QueryRow(ctx, `SELECT current_setting('max_connections')::int
+				- current_setting('superuser_reserved_connections')::int`).Scan(&t.maxConnections)
+		}
+	}
+	if err != nil {
+		log.Warn(ctx, "failed to read server statistics, headroom is not tracked", zap.Error(err))
+		if conn != nil {
+			conn.Close(context.Background())
+		}
+		close(t.done)
+		return t
+	}
+
+	ctx, t.cancel = context.WithCancel(ctx)
+	go func() {
+		defer close(t.done)
+		defer conn.Close(context.Background())
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(conf.Interval):
+				if err := t.sample(ctx, conn); err != nil && ctx.Err() == nil {
+					log.Warn(ctx, "failed to sample server activity", zap.Error(err))
+				}
+			}
+		}
+	}()
+	return t
+}
+
+// sample counts active client backends by wait event type and all client connections.
+func (t *HeadroomTracker) sample(ctx context.Context, conn *pgx.Conn) error {
+	rows, err := conn.Query(ctx, `
+		SELECT coalesce(wait_event_type, 'CPU'), count(*) FILTER (WHERE state = 'active'), count(*)
+		FROM pg_stat_activity
+		WHERE backend_type = 'client backend' AND pid <> pg_backend_pid()
+		GROUP BY 1`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var connections int
+	for rows.Next() {
+		var waitType string
+		var active, total int
+		if err := rows.Scan(&waitType, &active, &total); err != nil {
+			return err
+		}
+		t.waits[waitType] += active
+		connections += total
+	}
+	// the tracker connection is a client too
+	t.peakConnections = max(t.peakConnections, connections+1)
+	return rows.Err()
+}
+
+// readServerCounters reads cumulative IO statistics: block reads of the current database,
+// and IO of the whole server from pg_stat_io, or from block and bgwriter counters before Postgres 16.
+func readServerCounters(ctx context.Context, conn *pgx.Conn, version pgversion.Version) (serverCounters, error) {
+	var c serverCounters
+	err := conn.QueryRow(ctx, `SELECT blks_read, blks_hit FROM pg_stat_database WHERE datname = current_database()`).
+		Scan(&c.blocksRead, &c.blocksHit)
+	if err != nil {
+		return c, err
+	}
+
+	var query string
+	switch {
+	case version.AtLeast(18):
+		query = `SELECT coalesce(sum(read_bytes), 0)::bigint, coalesce(sum(write_bytes), 0)::bigint FROM pg_stat_io`
+	case version.AtLeast(16):
+		query = `SELECT coalesce(sum(reads * op_bytes), 0)::bigint, coalesce(sum(writes * op_bytes), 0)::bigint FROM pg_stat_io`
+	default:
+		query = fmt.Sprintf(`SELECT %[1]d * $1::bigint, %[1]d * (buffers_checkpoint + buffers_clean + buffers_backend)
+			FROM pg_stat_bgwriter`, blockSize)
+		return c, conn.QueryRow(ctx, query, c.blocksRead).Scan(&c.readBytes, &c.writtenBytes)
+	}
+	return c, conn.QueryRow(ctx, query).Scan(&c.readBytes, &c.writtenBytes)
+}
+
+// Stop stops sampling, computes the headroom of the run and adds it to the artifact.
+func (t *HeadroomTracker) Stop(ctx context.Context) *Headroom {
+	if t.cancel == nil {
+		return nil
+	}
+	t.cancel()
+	<-t.done
+
+	h := &Headroom{SLAP99: t.conf.P99, MaxConnections: t.maxConnections, PeakConnections: t.peakConnections}
+	h.MaxQPS, h.SLAQPS = t.artifact.throughput(t.conf.P99)
+
+	for waitType, n := range t.waits {
+		h.ActiveSamples += n
+		switch waitType {
+		case "CPU":
+			h.CPUShare += float64(n)
+		case "IO":
+			h.IOShare += float64(n)
+		case "Lock", "LWLock":
+			h.LockShare += float64(n)
+		}
+	}
+	if h.ActiveSamples > 0 {
+		h.CPUShare /= float64(h.ActiveSamples)
+		h.IOShare /= float64(h.ActiveSamples)
+		h.LockShare /= float64(h.ActiveSamples)
+	}
+
+	statsCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := t.readCounters(statsCtx, h); err != nil {
+		log.Warn(ctx, "failed to read server statistics", zap.Error(err))
+	}
+
+	h.Bound = headroomBound(h, clientstats.Default.Summary().CPUSaturated)
+	h.Conclusion = h.conclusion()
+	log.Info(ctx, "headroom", zap.String("bound", h.Bound), zap.Float64("max_qps", h.MaxQPS),
+		zap.Float64("sla_qps", h.SLAQPS), zap.String("conclusion", h.Conclusion))
+	t.artifact.setHeadroom(h)
+	return h
+}
+
+// readCounters fills IO rates and the cache hit ratio since the start of tracking.
+func (t *HeadroomTracker) readCounters(ctx context.Context, h *Headroom) error {
+	conn, err := dbconn.Connect(ctx, t.connstr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+	end, err := readServerCounters(ctx, conn, t.version)
+	if err != nil {
+		return err
+	}
+
+	start := t.startCounters
+	if blocks := end.blocksRead - start.blocksRead + end.blocksHit - start.blocksHit; blocks > 0 {
+		h.CacheHitRatio = float64(end.blocksHit-start.blocksHit) / float64(blocks)
+	}
+	if elapsed := time.Since(t.startTime).Seconds(); elapsed > 0 {
+		h.ReadMBps = float64(end.readBytes-start.readBytes) / elapsed / (1 << 20)
+		h.WriteMBps = float64(end.writtenBytes-start.writtenBytes) / elapsed / (1 << 20)
+	}
+	return nil
+}
+
+// headroomBound returns the main bottleneck: the client if it ran out of CPU, otherwise the wait
+// class of most active backend samples, or client if the server was mostly idle.
+func headroomBound(h *Headroom, clientSaturated bool) string {
+	switch {
+	case clientSaturated:
+		return BoundClient
+	case h.ActiveSamples == 0:
+		return BoundUnknown
+	case h.LockShare >= boundShare && h.LockShare >= h.IOShare:
+		return BoundLock
+	case h.IOShare >= boundShare && h.IOShare >= h.CPUShare:
+		return BoundIO
+	case h.CPUShare >= boundShare:
+		return BoundCPU
+	default:
+		return BoundUnknown
+	}
+}
+
+// conclusion summarizes the headroom in a sentence per finding.
+func (h *Headroom) conclusion() string {
+	var parts []string
+	switch {
+	case h.MaxQPS == 0:
+		parts = append(parts, "No queries were executed.")
+	case h.SLAQPS == 0:
+		parts = append(parts, fmt.Sprintf("No 10-second window met p99 <= %s, the max observed throughput is %.0f QPS.",
+			h.SLAP99, h.MaxQPS))
+	default:
+		parts = append(parts, fmt.Sprintf("SLA-compliant throughput (p99 <= %s) is %.0f QPS, %.0f%% of the max observed %.0f QPS.",
+			h.SLAP99, h.SLAQPS, 100*h.SLAQPS/h.MaxQPS, h.MaxQPS))
+	}
+
+	switch h.Bound {
+	case BoundClient:
+		parts = append(parts, "The load generator ran out of CPU, the server may have more capacity than measured.")
+	case BoundCPU:
+		parts = append(parts, fmt.Sprintf("The server is CPU-bound, %.0f%% of active backends were on CPU: add cores or optimize queries.",
+			100*h.CPUShare))
+	case BoundIO:
+		parts = append(parts, fmt.Sprintf("The server is IO-bound, %.0f%% of active backends waited for IO, cache hit ratio %.1f%%: add memory or faster storage.",
+			100*h.IOShare, 100*h.CacheHitRatio))
+	case BoundLock:
+		parts = append(parts, fmt.Sprintf("The server is bound by contention, %.0f%% of active backends waited for locks: adding resources is unlikely to help.",
+			100*h.LockShare))
+	default:
+		parts = append(parts, "The server wasn't saturated, the workload is limited by latency or concurrency.")
+	}
+
+	if h.MaxConnections > 0 {
+		parts = append(parts, fmt.Sprintf("%d of %d connections were in use at peak, %d spare.",
+			h.PeakConnections, h.MaxConnections, max(0, h.MaxConnections-h.PeakConnections)))
+	}
+	return strings.Join(parts, " ")
+}
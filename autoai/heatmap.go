@@ -0,0 +1,94 @@
+package autoai
+
+import (
+	"encoding/csv"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// LatencyBuckets are upper bounds of latency histogram buckets, growing exponentially
+// from 100us to ~100s to cover both point lookups and heavy analytical queries.
+var LatencyBuckets = func() []time.Duration {
+	var buckets []time.Duration
+	for b := 100 * time.Microsecond; b <= 100*time.Second; b *= 2 {
+		buckets = append(buckets, b)
+	}
+	return buckets
+}()
+
+// latencyBucket returns the index of the histogram bucket for the given latency.
+func latencyBucket(latency time.Duration) int {
+	return sort.Search(len(LatencyBuckets), func(i int) bool {
+		return latency <= LatencyBuckets[i]
+	})
+}
+
+// WriteHeatmapCSV writes per-second latency histograms as CSV with one row per second
+// and one column per bucket, labeled by the bucket upper bound in milliseconds.
+// This format can be loaded as a matrix into most heatmap plotting tools.
+func WriteHeatmapCSV(w io.Writer, series []SeriesPoint) error {
+	cw := csv.NewWriter(w)
+
+	header := []string{"time"}
+	for _, b := range LatencyBuckets {
+		header = append(header, "le_"+strconv.FormatFloat(float64(b)/float64(time.Millisecond), 'f', -1, 64))
+	}
+	header = append(header, "le_inf")
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+
+	for _, p := range series {
+		row := []string{p.Time.UTC().Format(time.RFC3339)}
+		for i := 0; i <= len(LatencyBuckets); i++ {
+			count := 0
+			if i < len(p.Histogram) {
+				count = p.Histogram[i]
+			}
+			row = append(row, strconv.Itoa(count))
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// seriesPercentile estimates the latency percentile from the histograms of the series.
+// The result is the upper bound of the bucket containing the percentile.
+func seriesPercentile(series []SeriesPoint, q float64) time.Duration {
+	hist := make([]int, len(LatencyBuckets)+1)
+	total := 0
+	for _, p := range series {
+		for i, c := range p.Histogram {
+			hist[i] += c
+			total += c
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+
+	rank := int(q * float64(total))
+	seen := 0
+	for i, c := range hist {
+		seen += c
+		if seen > rank {
+			if i < len(LatencyBuckets) {
+				return LatencyBuckets[i]
+			}
+			break
+		}
+	}
+
+	// percentile is in the overflow bucket, use max latency instead
+	var res time.Duration
+	for _, p := range series {
+		res = max(res, p.Max)
+	}
+	return res
+}
@@ -0,0 +1,348 @@
+package autoai
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/petuhovskiy/overload/errs"
+	"github.com/petuhovskiy/overload/internal/dbconn"
+	"github.com/petuhovskiy/overload/internal/log"
+	"github.com/petuhovskiy/overload/internal/pgversion"
+	"github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
+)
+
+// shadowSchema holds copies of tables used to test suggested indexes.
+const shadowSchema = "overload_shadow"
+
+// Index advice modes.
+const (
+	// IndexAdviceShadow tests the index on a copy of the table, which is dropped afterwards.
+	IndexAdviceShadow = "shadow"
+	// IndexAdviceReal creates the index on the real table and keeps it.
+	IndexAdviceReal = "real"
+)
+
+const (
+	defaultIndexAdviceThreshold = 100 * time.Millisecond
+	defaultIndexAdviceDuration  = 20 * time.Second
+	defaultIndexAdviceConns     = 4
+	// maxShadowTableSize limits the size of tables copied for shadow experiments.
+	maxShadowTableSize = 1 << 30
+)
+
+// IndexAdviceConfig configures index advice experiments of generated queries.
+type IndexAdviceConfig struct {
+	// Mode is IndexAdviceShadow or IndexAdviceReal, empty disables index advice.
+	Mode string
+	// Threshold is the min average latency of a query to ask for an index.
+	Threshold time.Duration
+	// Duration is the duration of measurements before and after the index is created.
+	Duration time.Duration
+	Conns    int
+}
+
+func (conf *IndexAdviceConfig) Normalize() {
+	if conf.Threshold == 0 {
+		conf.Threshold = defaultIndexAdviceThreshold
+	}
+
+	if conf.Duration == 0 {
+		conf.Duration = defaultIndexAdviceDuration
+	}
+
+	if conf.Conns == 0 {
+		conf.Conns = defaultIndexAdviceConns
+	}
+}
+
+// IndexAdvice is the result of a single index experiment.
+type IndexAdvice struct {
+	Mode  string
+	Table string
+	// Index is the statement suggested by the model, as it was executed.
+	Index  string
+	Before CommitSide
+	After  CommitSide
+	Error  string `json:",omitempty"`
+}
+
+// Speedup is the average latency ratio before and after the index was created.
+func (a *IndexAdvice) Speedup() float64 {
+	if a.After.Avg == 0 {
+		return 0
+	}
+	return float64(a.Before.Avg) / float64(a.After.Avg)
+}
+
+// ToExecInfo converts the advice to a history record.
+func (a *IndexAdvice) ToExecInfo(query string) *QueryExecInfo {
+	return &QueryExecInfo{
+		Query:    query,
+		IsFailed: a.Error != "",
+		QPS:      float32(a.After.QPS),
+		Conns:    a.After.Conns,
+		Comment:  "index advice",
+		Info:     a,
+	}
+}
+
+// SetIndexAdvice enables index advice experiments for slow generated queries.
+func (g *Generator) SetIndexAdvice(conf IndexAdviceConfig) error {
+	switch conf.Mode {
+	case "", IndexAdviceShadow, IndexAdviceReal:
+	default:
+		return errs.Validationf("unknown index advice mode %q", conf.Mode)
+	}
+	conf.Normalize()
+	g.indexAdvice = conf
+	return nil
+}
+
+// adviseIndexes runs index experiments for queries slower than the threshold.
+func (g *Generator) adviseIndexes(ctx context.Context, connstr string, queries []Query, stats []ExecStats) {
+	if g.indexAdvice.Mode == "" {
+		return
+	}
+	for i, q := range queries {
+		if stats[i].Count == 0 || stats[i].Avg < g.indexAdvice.Threshold || ctx.Err() != nil {
+			continue
+		}
+		ctx := log.With(ctx, zap.String("query", q.SQL))
+		advice, err := g.adviseIndex(ctx, connstr, q)
+		if err != nil {
+			log.Warn(ctx, "index advice failed", zap.Error(err))
+			if advice == nil {
+				continue
+			}
+			advice.Error = err.Error()
+		}
+		log.Info(ctx, "index advice finished", zap.Any("advice", advice), zap.Float64("speedup", advice.Speedup()))
+		go g.history.SaveQueryExecInfo(advice.ToExecInfo(q.SQL))
+	}
+}
+
+// adviseIndex asks the model for an index for the query and measures the query before and after
+// the index is created. The returned advice is not nil if the index was created.
+func (g *Generator) adviseIndex(ctx context.Context, connstr string, query Query) (*IndexAdvice, error) {
+	conn, err := dbconn.Connect(ctx, connstr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close(context.Background())
+
+	stmt, err := g.suggestIndex(ctx, conn, query)
+	if err != nil {
+		return nil, err
+	}
+	table, err := indexTable(stmt)
+	if err != nil {
+		return nil, err
+	}
+	var schema, relname string
+	var size int64
+	err = conn.QueryRow(ctx, `
+		SELECT n.nspname, c.relname, pg_total_relation_size(c.oid)
+		FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.oid = $1::regclass`, table).Scan(&schema, &relname, &size)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find table %s: %w", table, err)
+	}
+
+	advice := &IndexAdvice{Mode: g.indexAdvice.Mode, Table: schema + "." + relname, Index: stmt}
+	measured := query
+	var searchPath string
+	if g.indexAdvice.Mode == IndexAdviceShadow {
+		if size > maxShadowTableSize {
+			return nil, fmt.Errorf("table %s is too large for a shadow copy: %d bytes", advice.Table, size)
+		}
+		if err := createShadowTable(ctx, conn, schema, relname); err != nil {
+			return nil, fmt.Errorf("failed to create shadow table: %w", err)
+		}
+		defer dropShadowTable(conn, relname)
+
+		shadow := pgx.Identifier{shadowSchema, relname}.Sanitize()
+		advice.Index = indexTableRegexp.ReplaceAllString(stmt, "${1}"+shadow)
+		measured.SQL = shadowQuery(query.SQL, schema, relname, shadow)
+		if err := conn.QueryRow(ctx, "SHOW search_path").Scan(&searchPath); err != nil {
+			return nil, err
+		}
+		// unqualified names resolve to the shadow table first
+		searchPath = shadowSchema + ", " + searchPath
+	}
+
+	advice.Before = g.measureAdvice(ctx, connstr, measured, searchPath, "before")
+	if _, err := conn.Exec(ctx, advice.Index); err != nil {
+		return advice, fmt.Errorf("failed to create index: %w", err)
+	}
+	if _, err := conn.Exec(ctx, "ANALYZE "+quoteTable(advice.Table)); err != nil {
+		log.Warn(ctx, "failed to analyze table", zap.Error(err))
+	}
+	advice.After = g.measureAdvice(ctx, connstr, measured, searchPath, "after")
+	return advice, nil
+}
+
+// measureAdvice runs the query on the configured number of connections.
+func (g *Generator) measureAdvice(ctx context.Context, connstr string, query Query, searchPath, phase string) CommitSide {
+	opts := g.launcher.execOptions(query)
+	opts.duration = g.indexAdvice.Duration
+	opts.searchPath = searchPath
+
+	stats, point := runStep(ctx, connstr, query, g.indexAdvice.Conns, opts)
+	side := CommitSide{
+		Conns: g.indexAdvice.Conns,
+		QPS:   point.QPS,
+		Avg:   stats.Avg,
+		P99:   seriesPercentile(stats.Series, 0.99),
+	}
+	for _, n := range stats.ErrorCodes {
+		side.Errors += n
+	}
+
+	info := stats.ToExecInfo(query.SQL, g.indexAdvice.Conns)
+	info.Comment = fmt.Sprintf("index advice %s: %s", phase, info.Comment)
+	go g.history.SaveQueryExecInfo(info)
+	return side
+}
+
+// suggestIndex asks the model for a single CREATE INDEX statement speeding up the query.
+func (g *Generator) suggestIndex(ctx context.Context, conn *pgx.Conn, query Query) (string, error) {
+	schema, err := g.DumpSchema(conn)
+	if err != nil {
+		return "", err
+	}
+	var plan strings.Builder
+	rows, err := conn.Query(ctx, "EXPLAIN "+query.SQL)
+	if err != nil {
+		return "", fmt.Errorf("failed to explain query: %w", err)
+	}
+	lines, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return "", fmt.Errorf("failed to explain query: %w", err)
+	}
+	for _, line := range lines {
+		plan.WriteString(line + "\n")
+	}
+
+	const promptTemplate = `
+You have a postgres database. This query is slow:
+
+` + "```sql\n%s\n```" + `
+
+Its plan is:
+
+%s
+%s
+The schema of this postgres database is the following:
+
+%s
+Suggest a single index that makes this query faster. Return only one markdown code block marked with "sql"
+language specifier, with a single CREATE INDEX statement and nothing else. Don't explain it.
+`
+	if err := g.anonymizer.Save(); err != nil {
+		return "", fmt.Errorf("failed to save anonymization map: %w", err)
+	}
+	prompt := fmt.Sprintf(promptTemplate, g.anonymizer.hideSQL(query.SQL), g.anonymizer.Hide(plan.String()),
+		versionHints(pgversion.FromConn(conn)), schema)
+	resp, err := g.client.CreateChatCompletion(ctx, openai.ChatCompletionRequest{
+		Model: openai.GPT4o,
+		Messages: []openai.ChatCompletionMessage{
+			{
+				Role:    openai.ChatMessageRoleUser,
+				Content: prompt,
+			},
+		},
+	})
+	if err != nil {
+		return "", errs.Generation(err)
+	}
+	if len(resp.Choices) == 0 {
+		return "", errs.Generation(errors.New("no suggestions returned"))
+	}
+
+	suggested, err := g.splitQueries(resp.Choices[0].Message.Content)
+	if err != nil {
+		return "", err
+	}
+	if len(suggested) != 1 {
+		return "", errs.Generation(fmt.Errorf("expected a single statement, got %d", len(suggested)))
+	}
+	stmt := g.anonymizer.Restore(strings.TrimSuffix(strings.TrimSpace(suggested[0].SQL), ";"))
+	if err := g.history.SaveGeneratedQuery(prompt, stmt, resp.Model); err != nil {
+		log.Error(ctx, "failed to save suggested index", zap.Error(err))
+	}
+	return stmt, nil
+}
+
+// indexTableRegexp matches CREATE INDEX statements, the second group is the table name.
+var indexTableRegexp = regexp.MustCompile(
+	`(?is)^(\s*CREATE\s+(?:UNIQUE\s+)?INDEX\s+(?:CONCURRENTLY\s+)?(?:IF\s+NOT\s+EXISTS\s+)?(?:\S+\s+)?ON\s+(?:ONLY\s+)?)` +
+		`("?[\w$]+"?(?:\."?[\w$]+"?)?)`)
+
+// indexTable validates that the statement is a single CREATE INDEX and returns its table.
+// Anything else suggested by the model is never executed.
+func indexTable(stmt string) (string, error) {
+	m := indexTableRegexp.FindStringSubmatch(stmt)
+	if m == nil {
+		return "", errs.Generation(fmt.Errorf("not a CREATE INDEX statement: %s", stmt))
+	}
+	if strings.Contains(stmt, ";") {
+		return "", errs.Generation(fmt.Errorf("multiple statements suggested: %s", stmt))
+	}
+	return m[2], nil
+}
+
+// createShadowTable copies the table with its indexes and constraints into the shadow schema.
+func createShadowTable(ctx context.Context, conn *pgx.Conn, schema, relname string) error {
+	shadow := pgx.Identifier{shadowSchema, relname}.Sanitize()
+	original := pgx.Identifier{schema, relname}.Sanitize()
+	_, err := conn.Exec(ctx, fmt.Sprintf(`
+		CREATE SCHEMA IF NOT EXISTS %[1]s;
+		DROP TABLE IF EXISTS %[2]s CASCADE;
+		CREATE TABLE %[2]s (LIKE %[3]s INCLUDING ALL);`,
+		pgx.Identifier{shadowSchema}.Sanitize(), shadow, original))
+	if err != nil {
+		return err
+	}
+
+	return pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+		version := pgversion.FromConn(conn)
+		columns, err := insertableColumns(ctx, tx, schema+"."+relname, version)
+		if err != nil {
+			return err
+		}
+		overriding := ""
+		if version.HasIdentityColumns() {
+			overriding = "OVERRIDING SYSTEM VALUE "
+		}
+		list := strings.Join(columns, ", ")
+		_, err = tx.Exec(ctx, fmt.Sprintf("INSERT INTO %s (%s) %sSELECT %s FROM %s; ANALYZE %s",
+			shadow, list, overriding, list, original, shadow))
+		return err
+	})
+}
+
+// dropShadowTable drops the shadow copy with the index, even if the context is done.
+func dropShadowTable(conn *pgx.Conn, relname string) {
+	_, err := conn.Exec(context.Background(), "DROP TABLE IF EXISTS "+pgx.Identifier{shadowSchema, relname}.Sanitize())
+	if err != nil {
+		log.Warn(context.Background(), "failed to drop shadow table", zap.String("table", relname), zap.Error(err))
+	}
+}
+
+// shadowQuery replaces schema-qualified references of the table with the shadow table,
+// unqualified references are resolved by search_path.
+func shadowQuery(sql, schema, relname, shadow string) string {
+	for _, ref := range []string{
+		regexp.QuoteMeta(schema) + `\.` + regexp.QuoteMeta(relname),
+		regexp.QuoteMeta(pgx.Identifier{schema, relname}.Sanitize()),
+	} {
+		sql = regexp.MustCompile(`(?i)(^|[^\w$."])`+ref+`($|[^\w$"])`).ReplaceAllString(sql, "${1}"+shadow+"${2}")
+	}
+	return sql
+}
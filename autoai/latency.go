@@ -0,0 +1,122 @@
+package autoai
+
+import (
+	"math/bits"
+	"time"
+)
+
+const (
+	// latencySubBucketBits sets the precision of latency histograms: values below
+	// 2^latencySubBucketBits microseconds are exact, every higher power of two is split
+	// into 2^(latencySubBucketBits-1) linear sub-buckets, which bounds the error by 1/128.
+	latencySubBucketBits = 8
+	latencySubBuckets    = 1 << latencySubBucketBits
+	latencyHalfBuckets   = latencySubBuckets / 2
+)
+
+// latencyHistogram records latencies with ~1% precision and a fixed number of buckets per
+// power of two, like HDR histograms, so percentiles don't depend on the number of executions.
+type latencyHistogram struct {
+	counts []int64
+	total  int64
+}
+
+// latencyIndex returns the bucket of the latency in microseconds.
+func latencyIndex(us uint64) int {
+	if us < latencySubBuckets {
+		return int(us)
+	}
+	shift := bits.Len64(us) - latencySubBucketBits
+	sub := int(us >> shift)
+	return latencySubBuckets + (shift-1)*latencyHalfBuckets + sub - latencyHalfBuckets
+}
+
+// latencyValue returns the middle of the bucket in microseconds.
+func latencyValue(idx int) uint64 {
+	if idx < latencySubBuckets {
+		return uint64(idx)
+	}
+	shift := (idx-latencySubBuckets)/latencyHalfBuckets + 1
+	sub := uint64((idx-latencySubBuckets)%latencyHalfBuckets + latencyHalfBuckets)
+	return sub<<shift + (1<<shift)/2
+}
+
+func (h *latencyHistogram) record(latency time.Duration) {
+	idx := latencyIndex(uint64(max(latency, 0) / time.Microsecond))
+	if idx >= len(h.counts) {
+		h.counts = append(h.counts, make([]int64, idx+1-len(h.counts))...)
+	}
+	h.counts[idx]++
+	h.total++
+}
+
+// merge adds all latencies recorded by the other histogram.
+func (h *latencyHistogram) merge(other *latencyHistogram) {
+	if other == nil {
+		return
+	}
+	if len(other.counts) > len(h.counts) {
+		h.counts = append(h.counts, make([]int64, len(other.counts)-len(h.counts))...)
+	}
+	for i, n := range other.counts {
+		h.counts[i] += n
+	}
+	h.total += other.total
+}
+
+// percentile returns the latency below which the fraction q of recorded latencies are,
+// zero if nothing was recorded.
+func (h *latencyHistogram) percentile(q float64) time.Duration {
+	if h == nil || h.total == 0 {
+		return 0
+	}
+	rank := int64(q * float64(h.total))
+	var seen int64
+	for i, n := range h.counts {
+		seen += n
+		if seen > rank {
+			return time.Duration(latencyValue(i)) * time.Microsecond
+		}
+	}
+	return time.Duration(latencyValue(len(h.counts)-1)) * time.Microsecond
+}
+
+// recordLatency adds a successful execution to the latency histogram of the stats.
+func (s *ExecStats) recordLatency(latency time.Duration) {
+	if s.latency == nil {
+		s.latency = &latencyHistogram{}
+	}
+	s.latency.record(latency)
+}
+
+// mergeLatency adds executions of the other stats to the latency histograms of the stats.
+func (s *ExecStats) mergeLatency(other ExecStats) {
+	if other.latency != nil {
+		if s.latency == nil {
+			s.latency = &latencyHistogram{}
+		}
+		s.latency.merge(other.latency)
+	}
+	if other.corrected != nil {
+		if s.corrected == nil {
+			s.corrected = &latencyHistogram{}
+		}
+		s.corrected.merge(other.corrected)
+	}
+}
+
+// fillPercentiles sets the latency percentiles and the corrected ones from the histograms.
+// Percentiles are the middles of buckets, so they are capped by the max latency if it's known.
+func (s *ExecStats) fillPercentiles() {
+	percentile := func(h *latencyHistogram, q float64) time.Duration {
+		p := h.percentile(q)
+		if s.Max > 0 {
+			p = min(p, s.Max)
+		}
+		return p
+	}
+	s.P50, s.P90 = percentile(s.latency, 0.5), percentile(s.latency, 0.9)
+	s.P99, s.P999 = percentile(s.latency, 0.99), percentile(s.latency, 0.999)
+	s.CorrectedP50, s.CorrectedP90 = percentile(s.corrected, 0.5), percentile(s.corrected, 0.9)
+	s.CorrectedP99, s.CorrectedP999 = percentile(s.corrected, 0.99), percentile(s.corrected, 0.999)
+}
@@ -0,0 +1,94 @@
+package autoai
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLatencyIndex(t *testing.T) {
+	tests := []struct {
+		us  uint64
+		idx int
+	}{
+		{0, 0},
+		{255, 255},
+		{256, 256},
+		{257, 256},
+		{258, 257},
+		{511, 383},
+		{512, 384},
+		{1023, 511},
+		{1024, 512},
+	}
+	for _, tt := range tests {
+		require.Equal(t, tt.idx, latencyIndex(tt.us), "latencyIndex(%d)", tt.us)
+	}
+}
+
+func TestLatencyValue(t *testing.T) {
+	tests := []struct {
+		idx int
+		us  uint64
+	}{
+		{0, 0},
+		{255, 255},
+		{256, 257},
+		{383, 511},
+		{384, 514},
+		{511, 1022},
+	}
+	for _, tt := range tests {
+		require.Equal(t, tt.us, latencyValue(tt.idx), "latencyValue(%d)", tt.idx)
+	}
+}
+
+func TestLatencyPrecision(t *testing.T) {
+	for us := uint64(1); us < 1<<30; us = us*3/2 + 1 {
+		value := latencyValue(latencyIndex(us))
+		diff := float64(value) - float64(us)
+		require.LessOrEqual(t, diff/float64(us), 1.0/128, "latency %dus reported as %dus", us, value)
+		require.GreaterOrEqual(t, diff/float64(us), -1.0/128, "latency %dus reported as %dus", us, value)
+	}
+}
+
+func TestLatencyPercentile(t *testing.T) {
+	var h latencyHistogram
+	for us := 1; us <= 100; us++ {
+		h.record(time.Duration(us) * time.Microsecond)
+	}
+
+	tests := []struct {
+		q    float64
+		want time.Duration
+	}{
+		{0, time.Microsecond},
+		{0.5, 51 * time.Microsecond},
+		{0.9, 91 * time.Microsecond},
+		{0.99, 100 * time.Microsecond},
+		{1, 100 * time.Microsecond},
+	}
+	for _, tt := range tests {
+		require.Equal(t, tt.want, h.percentile(tt.q), "percentile(%v)", tt.q)
+	}
+}
+
+func TestLatencyPercentileEmpty(t *testing.T) {
+	var h *latencyHistogram
+	require.Zero(t, h.percentile(0.5))
+	require.Zero(t, (&latencyHistogram{}).percentile(0.5))
+}
+
+func TestLatencyMerge(t *testing.T) {
+	var a, b latencyHistogram
+	a.record(10 * time.Microsecond)
+	b.record(time.Millisecond)
+	b.record(time.Millisecond)
+
+	a.merge(&b)
+	a.merge(nil)
+	require.EqualValues(t, 3, a.total)
+	require.Equal(t, 10*time.Microsecond, a.percentile(0))
+	require.InEpsilon(t, float64(time.Millisecond), float64(a.percentile(0.5)), 1.0/128)
+}
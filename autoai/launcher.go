@@ -4,17 +4,520 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"maps"
+	"math"
 	"math/rand/v2"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/petuhovskiy/overload/errs"
+	"github.com/petuhovskiy/overload/internal/alert"
+	"github.com/petuhovskiy/overload/internal/capture"
+	"github.com/petuhovskiy/overload/internal/dbconn"
 	"github.com/petuhovskiy/overload/internal/log"
+	"github.com/petuhovskiy/overload/internal/metrics"
 	"github.com/petuhovskiy/overload/internal/multi"
+	"github.com/petuhovskiy/overload/internal/neon"
+	"github.com/petuhovskiy/overload/internal/pgbenchlog"
+	"github.com/petuhovskiy/overload/internal/reconnect"
 	"go.uber.org/zap"
 )
 
+const (
+	defaultMaxInFlight            = 100
+	defaultBucketSize             = 100
+	defaultLatencySLO             = time.Second
+	defaultMaxErrorRate           = 0.01
+	defaultAdaptiveStepDuration   = 10 * time.Second
+	defaultBreakerFailureRate     = 0.5
+	defaultBreakerWindow          = 10 * time.Second
+	defaultBreakerMinSamples      = 20
+	defaultStatementTimeout       = 30 * time.Second
+	defaultReconnectAttempts      = 3
+	defaultPlanCheckInterval      = 30 * time.Second
+	defaultActivitySampleInterval = time.Second
+	defaultIterationDuration      = time.Minute
+	defaultRampIterations         = 4
+	defaultRampMultiplier         = 2
+)
+
+// LongStatementTimeout is the statement timeout suitable for analytical queries.
+const LongStatementTimeout = 5 * time.Minute
+
+type LauncherConfig struct {
+	// ArrivalRate enables open-loop mode, where queries are dispatched
+	// at this average rate (queries per second) independent of completion.
+	ArrivalRate float64
+	// MaxInFlight limits the number of concurrent queries in open-loop mode.
+	MaxInFlight int
+	// TokenBucket dispatches open-loop queries at the fixed ArrivalRate from a token bucket instead
+	// of Poisson arrivals. Up to BucketSize tokens wait while MaxInFlight queries are running,
+	// so short stalls are caught up later, the rest are dropped.
+	TokenBucket bool
+	BucketSize  int
+
+	// Adaptive enables AIMD search for the max sustainable concurrency
+	// instead of the fixed ramp.
+	Adaptive bool
+	// LatencySLO is the max average latency allowed in adaptive mode.
+	LatencySLO time.Duration
+	// MaxErrorRate is the max fraction of failed executions allowed in adaptive mode.
+	MaxErrorRate float64
+	// AdaptiveStepDuration is the duration of a single adaptive step.
+	AdaptiveStepDuration time.Duration
+
+	// BreakerFailureRate is the fraction of failed executions within BreakerWindow
+	// after which the query is marked as broken and not executed until the end of the step.
+	// Negative value disables the circuit breaker, so that the connection stops on the first error.
+	BreakerFailureRate float64
+	BreakerWindow      time.Duration
+	// BreakerMinSamples is the min number of executions within the window to trip the breaker.
+	BreakerMinSamples int
+
+	// StatementTimeout is the max duration of a single execution, enforced
+	// by the server. Executions exceeding it are counted as failed.
+	StatementTimeout time.Duration
+
+	// Reconnect is the reconnect policy used by every connection.
+	Reconnect reconnect.Config
+
+	// SkipExplainAnalyze disables the capture of the plan with EXPLAIN (ANALYZE, BUFFERS) before
+	// the query is executed under load.
+	SkipExplainAnalyze bool
+
+	// PlanCheckInterval is how often the query plan is checked for changes during the run.
+	// Negative value disables plan watching.
+	PlanCheckInterval time.Duration
+	// ActivitySampleInterval is how often pg_stat_activity is sampled for the running queries
+	// of the workload during a step. Negative value disables sampling.
+	ActivitySampleInterval time.Duration
+
+	// Alerts are thresholds checked after every step.
+	Alerts alert.Config
+
+	// IterationDuration is the duration of every measurement step of the ramp.
+	IterationDuration time.Duration
+	// RampIterations is the number of concurrent steps after the single-connection step.
+	RampIterations int
+	// RampStart is the number of connections of the first concurrent step, every next step
+	// has RampMultiplier times more. Zero picks a random number of connections for every step.
+	RampStart      int
+	RampMultiplier float64
+	// MaxConns caps the number of connections of a ramp step, zero means no cap.
+	MaxConns int
+	// ThinkTime is the pause between executions on every connection in closed-loop mode.
+	ThinkTime time.Duration
+
+	// ConnectPerQuery opens a fresh connection for every execution instead of reusing
+	// a persistent one, to measure connection establishment overhead. Not used in open-loop mode.
+	ConnectPerQuery bool
+	// SSLMode overrides sslmode of the connection string, e.g. to compare "disable" and "require".
+	SSLMode string
+	// SSLRootCert overrides sslrootcert of the connection string, the CA certificate to verify
+	// the server with sslmode=verify-ca or verify-full. SSLCert and SSLKey are the client
+	// certificate and its key, for cert authentication.
+	SSLRootCert string
+	SSLCert     string
+	SSLKey      string
+	// SynchronousCommit sets synchronous_commit of workload sessions, e.g. "off", empty keeps
+	// the server default.
+	SynchronousCommit string
+
+	// TwoPhaseCommit commits every transaction with PREPARE TRANSACTION and COMMIT PREPARED,
+	// single statements are wrapped into transactions. PrepareDwell is the time a transaction
+	// stays prepared before it's committed, holding its locks and the xmin horizon. OrphanRate
+	// is the fraction of prepared transactions never committed, they stay until rolled back
+	// manually with ROLLBACK PREPARED. The server needs max_prepared_transactions > 0.
+	TwoPhaseCommit bool
+	PrepareDwell   time.Duration
+	OrphanRate     float64
+
+	// SerializationRetries is the max number of retries of executions failed with a serialization
+	// failure (40001). Zero means the default of the engine: no retries on Postgres, where they are
+	// a part of the workload, and retries on CockroachDB and other engines. Negative disables retries.
+	SerializationRetries int
+
+	// MixWindow enables the mix scheduler: instead of running a single query, every connection
+	// executes queries picked so that the share of every class (its class comment or statement
+	// keyword) over sliding windows of this duration matches the weights of the mix.
+	MixWindow time.Duration
+
+	// Seed makes workers deterministic: worker i of a step executes the same sequence of queries
+	// and parameters in every run with the same seed, seeded by Seed and i, and ramp steps have
+	// the same numbers of connections. Zero seeds every worker randomly.
+	Seed uint64
+}
+
+func (conf *LauncherConfig) Normalize() {
+	if conf.MaxInFlight == 0 {
+		conf.MaxInFlight = defaultMaxInFlight
+	}
+
+	if conf.BucketSize == 0 {
+		conf.BucketSize = defaultBucketSize
+	}
+
+	if conf.LatencySLO == 0 {
+		conf.LatencySLO = defaultLatencySLO
+	}
+
+	if conf.MaxErrorRate == 0 {
+		conf.MaxErrorRate = defaultMaxErrorRate
+	}
+
+	if conf.AdaptiveStepDuration == 0 {
+		conf.AdaptiveStepDuration = defaultAdaptiveStepDuration
+	}
+
+	if conf.BreakerFailureRate == 0 {
+		conf.BreakerFailureRate = defaultBreakerFailureRate
+	}
+
+	if conf.BreakerWindow == 0 {
+		conf.BreakerWindow = defaultBreakerWindow
+	}
+
+	if conf.BreakerMinSamples == 0 {
+		conf.BreakerMinSamples = defaultBreakerMinSamples
+	}
+
+	if conf.StatementTimeout == 0 {
+		conf.StatementTimeout = defaultStatementTimeout
+	}
+
+	if conf.Reconnect.MaxAttempts == 0 {
+		conf.Reconnect.MaxAttempts = defaultReconnectAttempts
+	}
+
+	if conf.PlanCheckInterval == 0 {
+		conf.PlanCheckInterval = defaultPlanCheckInterval
+	}
+
+	if conf.ActivitySampleInterval == 0 {
+		conf.ActivitySampleInterval = defaultActivitySampleInterval
+	}
+
+	if conf.IterationDuration == 0 {
+		conf.IterationDuration = defaultIterationDuration
+	}
+
+	if conf.RampIterations == 0 {
+		conf.RampIterations = defaultRampIterations
+	}
+
+	if conf.RampMultiplier == 0 {
+		conf.RampMultiplier = defaultRampMultiplier
+	}
+}
+
 type Launcher struct {
-	db *DBHistory
+	db       *DBHistory
+	conf     LauncherConfig
+	alerter  *alert.Alerter
+	recorder *capture.Recorder
+	audit    *AuditLog
+	// pgbenchLog is set if executions are logged in the pgbench --log format
+	pgbenchLog *pgbenchlog.Writer
+	// twoPhase is set if transactions are committed with 2PC
+	twoPhase *twoPhase
+	// notNeon is set once the target turned out not to be Neon.
+	notNeon atomic.Bool
+	// tuning are parameters changed during the run, they override the config.
+	tuning atomic.Pointer[Tuning]
+	// rampRand picks numbers of connections of ramp steps, nil if they are random
+	rampRand *rand.Rand
+	rampMu   sync.Mutex
+	// runMetrics receives query metrics of this launcher only, nil if they are recorded only globally
+	runMetrics *metrics.Registry
+}
+
+func NewLauncher(db *DBHistory, conf LauncherConfig) *Launcher {
+	conf.Normalize()
+	l := &Launcher{
+		db:       db,
+		conf:     conf,
+		alerter:  alert.New(conf.Alerts, db.SaveAlert),
+		twoPhase: newTwoPhase(conf),
+	}
+	if conf.Seed != 0 {
+		l.rampRand = rand.New(rand.NewPCG(conf.Seed, 0))
+	}
+	l.tuning.Store(&Tuning{
+		ArrivalRate: conf.ArrivalRate,
+		ThinkTime:   conf.ThinkTime,
+		MaxConns:    conf.MaxConns,
+	})
+	return l
+}
+
+// SetRecorder enables capture of every statement executed by the launcher.
+func (l *Launcher) SetRecorder(recorder *capture.Recorder) {
+	l.recorder = recorder
+}
+
+// SetPgbenchLog enables logging of every execution of the launcher in the pgbench --log format,
+// every query or transaction script is a pgbench script.
+func (l *Launcher) SetPgbenchLog(w *pgbenchlog.Writer) {
+	l.pgbenchLog = w
+}
+
+// checkAlerts checks step results against alerting thresholds.
+func (l *Launcher) checkAlerts(ctx context.Context, query Query, stats ExecStats, point RampPoint) {
+	source := "launcher " + QueryFingerprint(query.SQL)
+	l.alerter.CheckLatency(ctx, source, seriesPercentile(stats.Series, 0.99))
+	l.alerter.CheckErrorRate(ctx, source, point.ErrorRate)
+}
+
+// execOptions holds the parameters shared by all executions of a single query.
+type execOptions struct {
+	duration         time.Duration
+	statementTimeout time.Duration
+	breaker          *circuitBreaker
+	reconnect        reconnect.Config
+	metrics          queryMetrics
+	connectPerQuery  bool
+	sslParams        map[string]string
+	recorder         *capture.Recorder
+	audit            *AuditLog
+	pgbenchLog       *pgbenchlog.Writer
+	appName          string
+	syncCommit       string
+	twoPhase         *twoPhase
+	// searchPath overrides search_path of the sessions, e.g. to run the query on shadow tables
+	searchPath string
+	// tuning returns parameters changed during the run, nil if they can't be changed.
+	tuning func() Tuning
+	// seed of deterministic workers, zero if they are random, see LauncherConfig.Seed
+	seed uint64
+	// bucketSize enables token bucket dispatch of open-loop executions, see LauncherConfig.TokenBucket
+	bucketSize int
+	// firstWorker is the index of the first worker of the query, when the step is shared
+	// with other queries
+	firstWorker int
+
+	serializationRetries int
+}
+
+// queryMetrics are the shared metrics of a single query.
+type queryMetrics struct {
+	latency    *metrics.Histogram
+	executions *metrics.Counter
+	errors     *metrics.Counter
+	// classLatency is shared by all queries of the class, nil for queries without a class.
+	classLatency *metrics.Histogram
+	// run are the same metrics in the registry of the launcher, see Launcher.SetMetrics
+	run *queryMetrics
+}
+
+func newQueryMetrics(registry *metrics.Registry, query Query) queryMetrics {
+	fingerprint := fingerprints.label(QueryFingerprint(query.SQL))
+	m := queryMetrics{
+		latency:    registry.Histogram("query_latency_seconds", "query", fingerprint),
+		executions: registry.Counter("query_executions_total", "query", fingerprint),
+		errors:     registry.Counter("query_errors_total", "query", fingerprint),
+	}
+	if query.Class != "" {
+		m.classLatency = registry.Histogram("query_class_latency_seconds", "class", query.Class)
+	}
+	return m
+}
+
+// maxQueryFingerprints limits the number of distinct query labels in metrics. Every fingerprint
+// creates series that live until the process exits, so a long session with generated queries
+// would grow /metrics without bound.
+const maxQueryFingerprints = 200
+
+// otherFingerprint is the label of queries seen after the limit is reached.
+const otherFingerprint = "other"
+
+var fingerprints = fingerprintSet{seen: map[string]struct{}{}}
+
+// fingerprintSet remembers the fingerprints that got their own metric series.
+type fingerprintSet struct {
+	mu   sync.Mutex
+	seen map[string]struct{}
+}
+
+// label returns the metric label of the fingerprint, otherFingerprint if there are too many.
+func (s *fingerprintSet) label(fingerprint string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.seen[fingerprint]; ok {
+		return fingerprint
+	}
+	if len(s.seen) >= maxQueryFingerprints {
+		return otherFingerprint
+	}
+	s.seen[fingerprint] = struct{}{}
+	return fingerprint
+}
+
+// SetMetrics makes the launcher record query metrics in the registry too, in addition
+// to metrics.Default, so that they can be reported for this launcher only.
+func (l *Launcher) SetMetrics(registry *metrics.Registry) {
+	l.runMetrics = registry
+}
+
+// queryMetrics returns metrics of the query, recorded in the launcher registry if it's set.
+func (l *Launcher) queryMetrics(query Query) queryMetrics {
+	m := newQueryMetrics(metrics.Default, query)
+	if l.runMetrics != nil {
+		run := newQueryMetrics(l.runMetrics, query)
+		m.run = &run
+	}
+	return m
+}
+
+// record adds a single execution to the metrics.
+func (m *queryMetrics) record(elapsed time.Duration, err error) {
+	if m.run != nil {
+		m.run.record(elapsed, err)
+	}
+	m.executions.Inc()
+	if err != nil {
+		m.errors.Inc()
+		return
+	}
+	m.latency.Observe(elapsed.Seconds())
+	if m.classLatency != nil {
+		m.classLatency.Observe(elapsed.Seconds())
+	}
+}
+
+// connConfig parses connstr and applies the execution options to the connection config.
+func (opts *execOptions) connConfig(connstr string) (*pgx.ConnConfig, error) {
+	config, err := pgx.ParseConfig(withConnParams(connstr, opts.sslParams))
+	if err != nil {
+		return nil, errs.Validation(err)
+	}
+	opts.apply(config)
+	return config, nil
+}
+
+// apply sets session parameters required by the execution options.
+func (opts *execOptions) apply(config *pgx.ConnConfig) {
+	if opts.appName != "" {
+		config.RuntimeParams["application_name"] = opts.appName
+	}
+	if opts.syncCommit != "" {
+		config.RuntimeParams["synchronous_commit"] = opts.syncCommit
+	}
+	if opts.statementTimeout > 0 {
+		config.RuntimeParams["statement_timeout"] = strconv.FormatInt(opts.statementTimeout.Milliseconds(), 10)
+	}
+	if opts.searchPath != "" {
+		config.RuntimeParams["search_path"] = opts.searchPath
+	}
+}
+
+// withConnParams overrides parameters of the connection string, e.g. sslmode, both URL and
+// key-value formats are supported. Empty values are skipped.
+func withConnParams(connstr string, params map[string]string) string {
+	keys := slices.Sorted(maps.Keys(params))
+	keys = slices.DeleteFunc(keys, func(key string) bool { return params[key] == "" })
+	if len(keys) == 0 {
+		return connstr
+	}
+	if strings.HasPrefix(connstr, "postgres://") || strings.HasPrefix(connstr, "postgresql://") {
+		u, err := url.Parse(connstr)
+		if err != nil {
+			return connstr
+		}
+		q := u.Query()
+		for _, key := range keys {
+			q.Set(key, params[key])
+		}
+		u.RawQuery = q.Encode()
+		return u.String()
+	}
+	// the last occurrence of the key wins
+	for _, key := range keys {
+		connstr += " " + key + "=" + quoteConnValue(params[key])
+	}
+	return connstr
+}
+
+// quoteConnValue quotes the value of a key-value connection string if needed.
+func quoteConnValue(v string) string {
+	if !strings.ContainsAny(v, ` '\`) {
+		return v
+	}
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(v) + "'"
+}
+
+// isStatementTimeout returns true if the query was canceled by statement_timeout.
+func isStatementTimeout(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == errs.CodeQueryCanceled
+}
+
+// execOptions returns options for all executions of the query.
+func (l *Launcher) execOptions(query Query) execOptions {
+	return execOptions{
+		duration:         l.conf.IterationDuration,
+		statementTimeout: l.conf.StatementTimeout,
+		breaker:          l.newBreaker(),
+		reconnect:        l.conf.Reconnect,
+		metrics:          l.queryMetrics(query),
+		connectPerQuery:  l.conf.ConnectPerQuery,
+		sslParams: map[string]string{
+			"sslmode":     l.conf.SSLMode,
+			"sslrootcert": l.conf.SSLRootCert,
+			"sslcert":     l.conf.SSLCert,
+			"sslkey":      l.conf.SSLKey,
+		},
+		recorder:             l.recorder,
+		audit:                l.audit,
+		pgbenchLog:           l.pgbenchLog,
+		appName:              queryAppName(query),
+		syncCommit:           l.conf.SynchronousCommit,
+		twoPhase:             l.twoPhase,
+		tuning:               l.Tuning,
+		serializationRetries: l.conf.SerializationRetries,
+		seed:                 l.conf.Seed,
+	}
+}
+
+// workerRand creates the random generator of the worker of the step, deterministic if the seed is set.
+func (opts *execOptions) workerRand(worker int) *rand.Rand {
+	if opts.seed == 0 {
+		return newRand()
+	}
+	return rand.New(rand.NewPCG(opts.seed, uint64(opts.firstWorker+worker)+1))
+}
+
+// rampConns returns the number of connections for the ramp step iter, growing geometrically
+// from RampStart, or a random one if RampStart isn't set.
+func (l *Launcher) rampConns(iter int) int {
+	var n int
+	if l.conf.RampStart > 0 {
+		n = max(int(float64(l.conf.RampStart)*math.Pow(l.conf.RampMultiplier, float64(iter))), 1)
+	} else if l.rampRand != nil {
+		l.rampMu.Lock()
+		n = l.rampRand.IntN(100) + 10
+		l.rampMu.Unlock()
+	} else {
+		n = rand.IntN(100) + 10
+	}
+	if maxConns := l.Tuning().MaxConns; maxConns > 0 {
+		n = min(n, maxConns)
+	}
+	return n
+}
+
+// newBreaker creates a circuit breaker for a single query, or returns nil if it's disabled.
+func (l *Launcher) newBreaker() *circuitBreaker {
+	if l.conf.BreakerFailureRate < 0 {
+		return nil
+	}
+	return newCircuitBreaker(l.conf.BreakerWindow, l.conf.BreakerFailureRate, l.conf.BreakerMinSamples)
 }
 
 func (l *Launcher) Run(ctx context.Context, connstr string, query Query) ExecStats {
@@ -22,90 +525,334 @@ func (l *Launcher) Run(ctx context.Context, connstr string, query Query) ExecSta
 
 	log.Info(ctx, "connecting to database")
 
-	const iterationDuration = time.Minute
+	opts := l.execOptions(query)
+
+	if l.conf.PlanCheckInterval > 0 {
+		watchCtx, stopWatch := context.WithCancel(ctx)
+		defer stopWatch()
+		go l.watchPlan(watchCtx, opts, connstr, query)
+	}
+	plan := l.capturePlan(ctx, opts, connstr, query)
+
+	if l.conf.ArrivalRate > 0 {
+		if l.conf.TokenBucket {
+			opts.bucketSize = l.conf.BucketSize
+		}
+		stats := executeOpenLoop(ctx, connstr, query, l.Tuning().ArrivalRate, l.conf.MaxInFlight, opts)
+		go l.db.SaveQueryExecInfo(stats.ToExecInfo(query.SQL, l.conf.MaxInFlight))
+
+		log.Info(ctx, "query execution statistics", zap.Any("stats", stats))
+		stats.PeakQPS = stats.AchievedQPS
+		stats.Plan = plan
+		return stats
+	}
+
+	if l.conf.Adaptive {
+		opts.duration = l.conf.AdaptiveStepDuration
+		stats := l.runAdaptive(ctx, connstr, query, opts)
+		stats.Plan = plan
+		return stats
+	}
 
-	stats := executeAndMeasure(ctx, connstr, query, iterationDuration)
+	neonDone := l.neonStep(ctx, connstr)
+	activityDone := l.sampleActivity(ctx, connstr, query)
+	stats := executeAndMeasure(ctx, connstr, query, opts, 0)
+	activityDone(&stats)
+	neonDone(&stats)
 	einfo := stats.ToExecInfo(query.SQL, 1)
 	go l.db.SaveQueryExecInfo(einfo)
 
 	log.Info(ctx, "query execution statistics", zap.Any("stats", stats))
 	if stats.ToExecInfo("", 1).IsFailed {
+		stats.PeakQPS = float64(stats.Count) / opts.duration.Seconds()
+		stats.Plan = plan
 		return stats
 	}
 
-	for iter := 0; iter < 4; iter++ {
-		n := rand.IntN(100) + 10
+	points := []RampPoint{{
+		Conns:       1,
+		QPS:         float64(stats.Count) / opts.duration.Seconds(),
+		Latency:     stats.Avg,
+		Timeouts:    stats.Timeouts,
+		TimeoutRate: timeoutRate(stats.Timeouts, stats.Count, stats.ErrorCodes),
+	}}
 
-		ch := make(chan ExecStats, n)
-		multi.RunMany(ctx, n, func(ctx context.Context) error {
-			time.Sleep(time.Duration(rand.IntN(1000)) * time.Millisecond)
+	for iter := 0; iter < l.conf.RampIterations; iter++ {
+		n := l.rampConns(iter)
 
-			res := executeAndMeasure(ctx, connstr, query, iterationDuration)
-			ch <- res
-			return res.Error
-		})
+		var point RampPoint
+		neonDone := l.neonStep(ctx, connstr)
+		activityDone := l.sampleActivity(ctx, connstr, query)
+		stats, point = runStep(ctx, connstr, query, n, opts)
+		activityDone(&stats)
+		neonDone(&stats)
+		points = append(points, point)
+		go l.db.SaveQueryExecInfo(stats.ToExecInfo(query.SQL, n))
+		l.checkAlerts(ctx, query, stats, point)
 
-		var errors []error
-		var sts []ExecStats
+		log.Info(ctx, "query execution statistics", zap.Any("stats", stats))
 
-		var sum time.Duration
-		var count int
-		for i := 0; i < n; i++ {
-			st := <-ch
-			sts = append(sts, st)
+		if stats.Broken {
+			log.Warn(ctx, "query is broken, stopped its executions for the rest of the step", zap.Error(stats.Error))
+		}
+	}
 
-			if st.Count > 0 {
-				sum += st.Avg
-				count++
-			}
+	saturation := detectSaturation(points)
+	log.Info(ctx, "query saturation point", zap.Any("saturation", saturation))
+	go l.db.SaveQueryExecInfo(saturation.ToExecInfo(query.SQL))
 
-			if st.Error != nil {
-				errors = append(errors, st.Error)
-			}
-		}
+	stats.PeakQPS = saturation.MaxQPS
+	stats.Plan = plan
+	return stats
+}
+
+// runStep executes query on n connections concurrently and aggregates the results.
+func runStep(ctx context.Context, connstr string, query Query, n int, opts execOptions) (ExecStats, RampPoint) {
+	opts.breaker = opts.breaker.reset()
+	ch := make(chan ExecStats, n)
+	multi.RunManyIndexed(ctx, n, func(ctx context.Context, worker int) error {
+		time.Sleep(time.Duration(rand.IntN(1000)) * time.Millisecond)
+
+		res := executeAndMeasure(ctx, connstr, query, opts, worker)
+		ch <- res
+		return res.Error
+	})
 
-		if count > 0 {
-			sum /= time.Duration(count)
-			sum /= time.Duration(count)
+	var errors []error
+	var failed int
+	var timeouts int
+	var retries int64
+	var errorCodes []map[string]int
+	var sts []ExecStats
+	var series [][]SeriesPoint
+	var statements [][]StatementStats
+	var results []*ResultStats
+	var connects connectRecorder
+
+	// total is the sum of latencies of all executions, count is the number of connections with results
+	var total time.Duration
+	var count int
+	var queries int
+	var correctedSum time.Duration
+	var correctedCount int
+	for i := 0; i < n; i++ {
+		st := <-ch
+		sts = append(sts, st)
+		series = append(series, st.Series)
+		statements = append(statements, st.Statements)
+		results = append(results, st.Result)
+		if st.ConnectAvg > 0 {
+			connects.count += st.Count
+			connects.sum += st.ConnectAvg * time.Duration(st.Count)
+			connects.max = max(connects.max, st.ConnectMax)
+		}
+		if st.TLSHandshakeAvg > 0 {
+			connects.tlsCount += st.Count
+			connects.tlsSum += st.TLSHandshakeAvg * time.Duration(st.Count)
+			connects.tlsMax = max(connects.tlsMax, st.TLSHandshakeMax)
 		}
+		queries += st.Count
+		timeouts += st.Timeouts
+		retries += st.Retries
+		errorCodes = append(errorCodes, st.ErrorCodes)
+		correctedSum += st.CorrectedAvg * time.Duration(st.CorrectedCount)
+		correctedCount += st.CorrectedCount
 
-		// join all errors in a single error
-		var err error
-		if len(errors) > 0 {
-			err = errors[0]
-			for _, e := range errors[1:] {
-				err = fmt.Errorf("%w; %v", err, e)
-			}
+		if st.Count > 0 {
+			total += st.Avg * time.Duration(st.Count)
+			count++
 		}
 
-		stats = ExecStats{
-			Count: count,
-			Avg:   sum,
-			Error: err,
+		if st.Error != nil {
+			errors = append(errors, st.Error)
+			failed++
 		}
-		go l.db.SaveQueryExecInfo(stats.ToExecInfo(query.SQL, n))
+	}
 
-		log.Info(ctx, "query execution statistics", zap.Any("stats", stats))
+	mergedCodes := mergeErrorCodes(errorCodes...)
+	var failedExecs int
+	for _, executions := range mergedCodes {
+		failedExecs += executions
+	}
+	point := RampPoint{
+		Conns:       n,
+		QPS:         float64(queries) / opts.duration.Seconds(),
+		FailedConns: failed,
+		Timeouts:    timeouts,
+		TimeoutRate: timeoutRate(timeouts, queries, mergedCodes),
+	}
+	if failedExecs > 0 {
+		point.ErrorRate = float64(failedExecs) / float64(queries+failedExecs)
 	}
 
-	return stats
+	if queries > 0 {
+		point.Latency = total / time.Duration(queries)
+	}
+
+	// join all errors in a single error
+	var err error
+	if len(errors) > 0 {
+		err = errors[0]
+		for _, e := range errors[1:] {
+			err = fmt.Errorf("%w; %v", err, e)
+		}
+	}
+
+	stats := ExecStats{
+		Count:           count,
+		Avg:             point.Latency,
+		StepQPS:         point.QPS,
+		Error:           err,
+		Series:          mergeSeries(series...),
+		CorrectedCount:  correctedCount,
+		Broken:          opts.breaker.isBroken(),
+		Timeouts:        timeouts,
+		Statements:      mergeStatementStats(statements...),
+		Result:          mergeResultStats(results...),
+		ConnectAvg:      connects.avg(),
+		ConnectMax:      connects.max,
+		TLSHandshakeAvg: connects.tlsAvg(),
+		TLSHandshakeMax: connects.tlsMax,
+		Retries:         retries,
+		ErrorCodes:      mergedCodes,
+	}
+	if correctedCount > 0 {
+		stats.CorrectedAvg = correctedSum / time.Duration(correctedCount)
+	}
+	for _, st := range sts {
+		stats.mergeLatency(st)
+	}
+	stats.fillPercentiles()
+	return stats, point
 }
 
 type ExecStats struct {
 	Min, Avg, Max time.Duration
-	Count         int
-	Error         error
+	// P50, P90, P99 and P999 are latency percentiles of successful executions with ~1% precision.
+	P50, P90, P99, P999 time.Duration
+	Count               int
+	Error               error
+	// Series holds per-second measurements collected during the execution.
+	Series []SeriesPoint
+	// CorrectedAvg and CorrectedP50..CorrectedP999 are the average latency and the percentiles
+	// corrected for coordinated omission, CorrectedCount is the number of real and synthetic
+	// samples they're based on. Percentiles are set only for closed-loop executions.
+	CorrectedAvg                                            time.Duration
+	CorrectedP50, CorrectedP90, CorrectedP99, CorrectedP999 time.Duration
+	CorrectedCount                                          int
+	// RequestedQPS, AchievedQPS and Dropped are set only for open-loop executions.
+	RequestedQPS float64 `json:",omitempty"`
+	AchievedQPS  float64 `json:",omitempty"`
+	Dropped      int     `json:",omitempty"`
+	// Broken is set when the circuit breaker stopped executions of the query.
+	Broken bool `json:",omitempty"`
+	// Pool is set when the query was executed over a connection pool.
+	Pool *PoolStats `json:",omitempty"`
+	// Timeouts is the number of executions canceled by the statement timeout.
+	Timeouts int
+	// Statements holds per-statement latency of transaction scripts, if enabled.
+	Statements []StatementStats `json:",omitempty"`
+	// Result is set for SELECT queries.
+	Result *ResultStats `json:",omitempty"`
+	// ConnectAvg and ConnectMax are connection establishment times, set only when
+	// every execution opens a new connection. Latency includes them.
+	ConnectAvg time.Duration `json:",omitempty"`
+	ConnectMax time.Duration `json:",omitempty"`
+	// TLSHandshakeAvg and TLSHandshakeMax are parts of the connection establishment times
+	// spent on TLS negotiation, set only for new connections with TLS.
+	TLSHandshakeAvg time.Duration `json:",omitempty"`
+	TLSHandshakeMax time.Duration `json:",omitempty"`
+	// Retries is the number of retried serialization failures, latency includes them.
+	Retries int64 `json:",omitempty"`
+	// ErrorCodes counts failed executions by SQLSTATE, errors without SQLSTATE
+	// (e.g. network errors) are counted as "client".
+	ErrorCodes map[string]int `json:",omitempty"`
+	// Activity is the age distribution of running queries sampled on the server.
+	Activity *ActivityStats `json:",omitempty"`
+	// Neon is set when the target is a Neon compute.
+	Neon *neon.Step `json:",omitempty"`
+	// StepQPS is the throughput of all connections of a ramp step, set only by runStep.
+	StepQPS float64 `json:",omitempty"`
+	// PeakQPS is the max throughput of all steps of Launcher.Run, set only in the stats it returns.
+	PeakQPS float64 `json:",omitempty"`
+	// Plan is the plan captured by Launcher.Run, set only in the stats it returns. It's recorded
+	// separately, with the "explain analyze" comment.
+	Plan *PlanAnalysis `json:"-"`
+
+	// latency is the histogram of the percentiles, kept to merge stats of several connections,
+	// corrected is the same for the corrected percentiles.
+	latency   *latencyHistogram
+	corrected *latencyHistogram
+}
+
+// recordError counts the failed execution by its SQLSTATE and remembers the first error.
+// Statement timeouts are counted separately and marked as errs.ErrTimeout.
+func (s *ExecStats) recordError(err error) {
+	if s.ErrorCodes == nil {
+		s.ErrorCodes = map[string]int{}
+	}
+	s.ErrorCodes[errs.Code(err)]++
+	if isStatementTimeout(err) {
+		s.Timeouts++
+		err = errs.Timeout(err)
+	}
+	if s.Error == nil {
+		s.Error = err
+	}
+}
+
+// timeoutRate returns the fraction of executions canceled by the statement timeout, out of
+// successful and failed ones.
+func timeoutRate(timeouts, succeeded int, errorCodes map[string]int) float64 {
+	executions := succeeded
+	for _, n := range errorCodes {
+		executions += n
+	}
+	if executions == 0 {
+		return 0
+	}
+	return float64(timeouts) / float64(executions)
+}
+
+// TopErrorCode returns the most frequent error code, or empty string if there were no errors.
+func (s *ExecStats) TopErrorCode() string {
+	var top string
+	for code, n := range s.ErrorCodes {
+		if n > s.ErrorCodes[top] || (n == s.ErrorCodes[top] && code < top) {
+			top = code
+		}
+	}
+	return top
+}
+
+// mergeErrorCodes sums error counts of several executions.
+func mergeErrorCodes(all ...map[string]int) map[string]int {
+	var merged map[string]int
+	for _, codes := range all {
+		for code, n := range codes {
+			if merged == nil {
+				merged = map[string]int{}
+			}
+			merged[code] += n
+		}
+	}
+	return merged
 }
 
 func (s *ExecStats) ToExecInfo(query string, conns int) *QueryExecInfo {
 	failed := s.Error != nil || s.Count == 0 || s.Avg == 0
-	qps := 0.0
-	if s.Avg > 0 {
+	// a single connection runs at 1/Avg, steps of several connections know their total rate
+	qps := s.StepQPS
+	if qps == 0 && s.Avg > 0 {
 		qps = 1 / s.Avg.Seconds()
 	}
 
 	comment := ""
-	if s.Error != nil {
+	if s.Broken {
+		comment = fmt.Sprintf("broken: %s", s.Error)
+	} else if s.Timeouts > 0 {
+		comment = fmt.Sprintf("statement timeout: %d executions", s.Timeouts)
+	} else if s.Error != nil {
 		comment = fmt.Sprintf("error: %s", s.Error)
 	} else if s.Count == 0 || s.Avg == 0 {
 		comment = "timeout"
@@ -123,17 +870,36 @@ func (s *ExecStats) ToExecInfo(query string, conns int) *QueryExecInfo {
 	}
 }
 
-func executeAndMeasure(ctx context.Context, connstr string, query Query, duration time.Duration) ExecStats {
-	conn, err := pgx.Connect(ctx, connstr)
+func executeAndMeasure(ctx context.Context, connstr string, query Query, opts execOptions, worker int) ExecStats {
+	config, err := opts.connConfig(connstr)
 	if err != nil {
-		log.Error(ctx, "failed to connect to database", zap.Error(err))
 		return ExecStats{
 			Error: err,
 		}
 	}
-	defer conn.Close(ctx)
 
-	ctx, cancel := context.WithTimeout(ctx, duration)
+	connect := func(ctx context.Context) (*pgx.Conn, error) {
+		return dbconn.ConnectConfig(ctx, config)
+	}
+	var conn *pgx.Conn
+	if !opts.connectPerQuery {
+		conn, err = reconnect.Connect(ctx, opts.reconnect, "launcher", connect)
+		if err != nil {
+			log.Error(ctx, "failed to connect to database", zap.Error(err))
+			return ExecStats{
+				Error:      err,
+				ErrorCodes: map[string]int{errs.Code(err): 1},
+			}
+		}
+		// the connection is replaced if it's lost in the middle of the run
+		defer func() {
+			if conn != nil {
+				conn.Close(context.Background())
+			}
+		}()
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, opts.duration)
 	defer cancel()
 
 	stats := ExecStats{
@@ -143,6 +909,12 @@ func executeAndMeasure(ctx context.Context, connstr string, query Query, duratio
 	}
 
 	sum := time.Duration(0)
+	var series seriesRecorder
+	var corrector omissionCorrector
+	work := newWorkload(query, opts)
+	rng := opts.workerRand(worker)
+	var results resultRecorder
+	var connects connectRecorder
 
 loop:
 	for {
@@ -150,28 +922,121 @@ loop:
 		case <-ctx.Done():
 			break loop
 		default:
+			if opts.breaker.isBroken() {
+				break loop
+			}
+
 			start := time.Now()
-			_, err := conn.Exec(ctx, query.SQL)
+			var res execResult
+			if opts.connectPerQuery {
+				res, err = execFresh(ctx, config, work, rng, &connects)
+			} else {
+				res, err = work.exec(ctx, conn, rng)
+			}
 			if err != nil {
 				if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
 					log.Info(ctx, "query execution timed out or canceled")
 					break loop
 				}
-				stats.Error = err
-				return stats
+				opts.metrics.record(0, err)
+				stats.recordError(err)
+				if opts.breaker.record(true) {
+					break loop
+				}
+				if conn != nil && conn.IsClosed() {
+					conn, err = reconnect.Connect(ctx, opts.reconnect, "launcher", connect)
+					if err != nil {
+						log.Error(ctx, "failed to reconnect to database", zap.Error(err))
+						break loop
+					}
+				}
+				continue
 			}
-			elapsed := time.Since(start)
+			opts.breaker.record(false)
+			finished := time.Now()
+			elapsed := finished.Sub(start)
+			if work.returnsRows {
+				results.record(res)
+			}
+			series.record(finished, elapsed)
+			corrector.record(elapsed)
+			opts.metrics.record(elapsed, nil)
 
 			stats.Count++
 
 			stats.Min = min(stats.Min, elapsed)
 			stats.Max = max(stats.Max, elapsed)
+			stats.recordLatency(elapsed)
 			sum += elapsed
+
+			if !opts.think(ctx) {
+				break loop
+			}
 		}
 	}
 
 	if stats.Count > 0 {
 		stats.Avg = sum / time.Duration(stats.Count)
 	}
+	stats.corrected = &corrector.latency
+	stats.fillPercentiles()
+	stats.Series = series.points
+	stats.CorrectedAvg, stats.CorrectedCount = corrector.avg(), corrector.count
+	stats.Statements = work.statementStats()
+	results.fill(&stats)
+	stats.ConnectAvg, stats.ConnectMax = connects.avg(), connects.max
+	stats.TLSHandshakeAvg, stats.TLSHandshakeMax = connects.tlsAvg(), connects.tlsMax
+	stats.Retries = work.retried.Load()
 	return stats
 }
+
+// execFresh executes the query on a new connection, recording the connection establishment time.
+func execFresh(ctx context.Context, config *pgx.ConnConfig, work *workload, r *rand.Rand, connects *connectRecorder) (execResult, error) {
+	start := time.Now()
+	connCtx, handshake := dbconn.WithTLSHandshake(ctx)
+	conn, err := dbconn.ConnectConfig(connCtx, config)
+	if err != nil {
+		return execResult{}, err
+	}
+	defer conn.Close(context.Background())
+	connects.record(time.Since(start), handshake.Duration)
+
+	return work.exec(ctx, conn, r)
+}
+
+// connectRecorder aggregates connection establishment and TLS handshake times.
+type connectRecorder struct {
+	count int
+	sum   time.Duration
+	max   time.Duration
+
+	tlsCount int
+	tlsSum   time.Duration
+	tlsMax   time.Duration
+}
+
+// record adds a new connection, handshake is zero for connections without TLS.
+func (r *connectRecorder) record(elapsed, handshake time.Duration) {
+	r.count++
+	r.sum += elapsed
+	r.max = max(r.max, elapsed)
+	if handshake > 0 {
+		r.tlsCount++
+		r.tlsSum += handshake
+		r.tlsMax = max(r.tlsMax, handshake)
+	}
+}
+
+func (r *connectRecorder) avg() time.Duration {
+	if r.count == 0 {
+		return 0
+	}
+	return r.sum / time.Duration(r.count)
+}
+
+func (r *connectRecorder) tlsAvg() time.Duration {
+	if r.tlsCount == 0 {
+		return 0
+	}
+	return r.tlsSum / time.Duration(r.tlsCount)
+}
@@ -0,0 +1,141 @@
+package autoai
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"text/tabwriter"
+)
+
+// QueryRank is a single query in the leaderboard.
+type QueryRank struct {
+	Query      string
+	MaxQPS     float64
+	Executions int
+	Failures   int
+}
+
+// ModelRank aggregates the results of all queries generated by a single model.
+type ModelRank struct {
+	Model      string
+	Queries    int
+	Executions int
+	Failures   int
+	AvgQPS     float64
+}
+
+// Leaderboard holds the best and the worst queries across all runs.
+type Leaderboard struct {
+	FastestQueries []QueryRank
+	SlowestQueries []QueryRank
+	FailingQueries []QueryRank
+	Models         []ModelRank
+}
+
+// Leaderboard returns top-n queries by QPS and failure count, and results aggregated by model.
+func (d *DBHistory) Leaderboard(n int) (*Leaderboard, error) {
+	var res Leaderboard
+	var err error
+
+	const byQPS = `
+		SELECT query, max(qps), count(*), count(*) FILTER (WHERE is_failed)
+		FROM query_exec_info
+		WHERE comment = 'ok'
+		GROUP BY query
+		ORDER BY max(qps) %s
+		LIMIT $1`
+
+	res.FastestQueries, err = d.queryRanks(fmt.Sprintf(byQPS, "DESC"), n)
+	if err != nil {
+		return nil, err
+	}
+
+	res.SlowestQueries, err = d.queryRanks(fmt.Sprintf(byQPS, "ASC"), n)
+	if err != nil {
+		return nil, err
+	}
+
+	res.FailingQueries, err = d.queryRanks(`
+		SELECT query, COALESCE(max(qps) FILTER (WHERE NOT is_failed), 0), count(*), count(*) FILTER (WHERE is_failed)
+		FROM query_exec_info
+		GROUP BY query
+		HAVING count(*) FILTER (WHERE is_failed) > 0
+		ORDER BY count(*) FILTER (WHERE is_failed) DESC
+		LIMIT $1`, n)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := d.db.Query(context.Background(), `
+		SELECT
+			COALESCE(g.model_used, 'unknown'),
+			count(DISTINCT g.generated_sql),
+			count(q.id),
+			count(q.id) FILTER (WHERE q.is_failed),
+			COALESCE(avg(q.qps) FILTER (WHERE NOT q.is_failed AND q.comment = 'ok'), 0)
+		FROM generated_queries g
+		LEFT JOIN query_exec_info q ON q.query = g.generated_sql
+		GROUP BY 1
+		ORDER BY 5 DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var m ModelRank
+		if err := rows.Scan(&m.Model, &m.Queries, &m.Executions, &m.Failures, &m.AvgQPS); err != nil {
+			return nil, err
+		}
+		res.Models = append(res.Models, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return &res, nil
+}
+
+func (d *DBHistory) queryRanks(sql string, n int) ([]QueryRank, error) {
+	rows, err := d.db.Query(context.Background(), sql, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []QueryRank
+	for rows.Next() {
+		var r QueryRank
+		if err := rows.Scan(&r.Query, &r.MaxQPS, &r.Executions, &r.Failures); err != nil {
+			return nil, err
+		}
+		res = append(res, r)
+	}
+	return res, rows.Err()
+}
+
+// Print writes the leaderboard as human-readable tables.
+func (l *Leaderboard) Print(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	printQueries := func(title string, ranks []QueryRank) {
+		fmt.Fprintf(tw, "%s\n", title)
+		fmt.Fprintln(tw, "MAX QPS\tEXECUTIONS\tFAILURES\tQUERY")
+		for _, r := range ranks {
+			fmt.Fprintf(tw, "%.1f\t%d\t%d\t%s\n", r.MaxQPS, r.Executions, r.Failures, truncateQuery(r.Query, 80))
+		}
+		fmt.Fprintln(tw)
+	}
+
+	printQueries("FASTEST QUERIES", l.FastestQueries)
+	printQueries("SLOWEST QUERIES", l.SlowestQueries)
+	printQueries("MOST FAILING QUERIES", l.FailingQueries)
+
+	fmt.Fprintln(tw, "MODELS")
+	fmt.Fprintln(tw, "MODEL\tQUERIES\tEXECUTIONS\tFAILURES\tAVG QPS")
+	for _, m := range l.Models {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%.1f\n", m.Model, m.Queries, m.Executions, m.Failures, m.AvgQPS)
+	}
+
+	return tw.Flush()
+}
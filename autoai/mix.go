@@ -0,0 +1,166 @@
+package autoai
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/petuhovskiy/overload/internal/dbconn"
+	"github.com/petuhovskiy/overload/internal/log"
+	"go.uber.org/zap"
+)
+
+// RunSource loads queries from the source and executes them as a weighted mix.
+func (l *Launcher) RunSource(ctx context.Context, connstr string, source QuerySource) error {
+	queries, err := loadSource(ctx, connstr, source)
+	if err != nil {
+		return err
+	}
+
+	log.Info(ctx, "loaded queries", zap.Int("count", len(queries)))
+	l.RunMix(ctx, connstr, queries)
+	return nil
+}
+
+// loadSource loads queries from the source and prepares their parameter generators.
+func loadSource(ctx context.Context, connstr string, source QuerySource) ([]Query, error) {
+	conn, err := dbconn.Connect(ctx, connstr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+	defer conn.Close(ctx)
+
+	queries, err := source.Queries(ctx, conn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load queries: %w", err)
+	}
+	for _, query := range queries {
+		if err := loadParams(ctx, conn, query); err != nil {
+			return nil, err
+		}
+	}
+	return queries, nil
+}
+
+// RunMix executes all queries concurrently, ramping up the total number of connections.
+// On every step connections are split between queries proportionally to their weights,
+// each connection runs a single query for the whole step. With MixWindow the mix scheduler
+// picks the query of every execution instead.
+func (l *Launcher) RunMix(ctx context.Context, connstr string, queries []Query) {
+	if len(queries) == 0 {
+		return
+	}
+	if l.conf.MixWindow > 0 {
+		l.runScheduledMix(ctx, connstr, queries)
+		return
+	}
+
+	opts := make([]execOptions, len(queries))
+	for i, query := range queries {
+		opts[i] = l.execOptions(query)
+	}
+
+	for iter := 0; iter < l.conf.RampIterations; iter++ {
+		n := max(l.rampConns(iter), len(queries))
+		conns := splitConns(n, queries)
+		log.Info(ctx, "running query mix", zap.Int("conns", n), zap.Ints("split", conns))
+
+		neonDone := l.neonStep(ctx, connstr)
+		var wg sync.WaitGroup
+		firstWorker := 0
+		for i, query := range queries {
+			opts[i].firstWorker = firstWorker
+			firstWorker += conns[i]
+			if conns[i] == 0 {
+				continue
+			}
+
+			wg.Add(1)
+			go func(i int, query Query) {
+				defer wg.Done()
+				ctx := log.With(ctx, zap.String("query", query.SQL))
+
+				activityDone := l.sampleActivity(ctx, connstr, query)
+				stats, point := runStep(ctx, connstr, query, conns[i], opts[i])
+				activityDone(&stats)
+				go l.db.SaveQueryExecInfo(stats.ToExecInfo(query.SQL, conns[i]))
+				l.checkAlerts(ctx, query, stats, point)
+
+				log.Info(ctx, "query execution statistics", zap.Any("stats", stats))
+				if stats.Broken {
+					log.Warn(ctx, "query is broken, excluded it from the mix for the rest of the step", zap.Error(stats.Error))
+				}
+			}(i, query)
+		}
+		wg.Wait()
+
+		// Neon metrics belong to the whole mix step, not to any single query
+		var mixStats ExecStats
+		neonDone(&mixStats)
+		if mixStats.Neon != nil {
+			log.Info(ctx, "neon metrics of the mix step", zap.Any("neon", mixStats.Neon))
+		}
+	}
+}
+
+// splitConns distributes n connections between queries proportionally to their weights,
+// using the largest remainder method. Every query gets at least one connection if n allows.
+func splitConns(n int, queries []Query) []int {
+	var total float64
+	for _, q := range queries {
+		total += queryWeight(q)
+	}
+
+	conns := make([]int, len(queries))
+	remainders := make([]float64, len(queries))
+	left := n
+	for i, q := range queries {
+		share := float64(n) * queryWeight(q) / total
+		conns[i] = int(share)
+		remainders[i] = share - float64(conns[i])
+		left -= conns[i]
+	}
+
+	order := make([]int, len(queries))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return remainders[order[a]] > remainders[order[b]]
+	})
+	for _, i := range order {
+		if left == 0 {
+			break
+		}
+		conns[i]++
+		left--
+	}
+
+	// take connections from the largest groups for queries that got none
+	for i := range conns {
+		if conns[i] > 0 {
+			continue
+		}
+		largest := 0
+		for j := range conns {
+			if conns[j] > conns[largest] {
+				largest = j
+			}
+		}
+		if conns[largest] <= 1 {
+			break
+		}
+		conns[largest]--
+		conns[i]++
+	}
+	return conns
+}
+
+// queryWeight returns the weight of the query, defaulting to 1.
+func queryWeight(q Query) float64 {
+	if q.Weight <= 0 {
+		return 1
+	}
+	return q.Weight
+}
@@ -0,0 +1,31 @@
+package autoai
+
+import (
+	"context"
+
+	"github.com/petuhovskiy/overload/internal/neon"
+)
+
+// neonStep takes a snapshot of Neon metrics before a step, the returned function
+// attaches the metrics of the step to its stats. Targets that are not Neon are
+// detected on the first step and skipped afterwards.
+func (l *Launcher) neonStep(ctx context.Context, connstr string) func(stats *ExecStats) {
+	if l.notNeon.Load() {
+		return func(*ExecStats) {}
+	}
+
+	before := neon.Snapshot(ctx, connstr)
+	if before == nil {
+		l.notNeon.Store(true)
+		return func(*ExecStats) {}
+	}
+
+	return func(stats *ExecStats) {
+		after := neon.Snapshot(ctx, connstr)
+		if after == nil {
+			return
+		}
+		step := neon.Delta(*before, *after)
+		stats.Neon = &step
+	}
+}
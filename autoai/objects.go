@@ -0,0 +1,376 @@
+package autoai
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/petuhovskiy/overload/internal/compat"
+	"github.com/petuhovskiy/overload/internal/dbconn"
+	"github.com/petuhovskiy/overload/internal/log"
+	"go.uber.org/zap"
+)
+
+// objectCheckInterval is how often the catalog is checked for objects created by the run.
+const objectCheckInterval = time.Minute
+
+// Kinds of tracked objects, they are dropped in this order.
+var objectKinds = []string{"index", "materialized view", "view", "table", "sequence", "schema"}
+
+// DBObject is a schema object of the target database.
+type DBObject struct {
+	Kind   string
+	Schema string
+	// Name is empty for schemas.
+	Name string
+}
+
+func (o DBObject) String() string {
+	if o.Kind == "schema" {
+		return "schema " + o.Schema
+	}
+	return o.Kind + " " + o.ident()
+}
+
+// ident returns the quoted name of the object.
+func (o DBObject) ident() string {
+	if o.Kind == "schema" {
+		return pgx.Identifier{o.Schema}.Sanitize()
+	}
+	return pgx.Identifier{o.Schema, o.Name}.Sanitize()
+}
+
+// TargetIdentity identifies the target database: the cluster and the database in it.
+type TargetIdentity struct {
+	SystemID string
+	Database string
+}
+
+func (t TargetIdentity) String() string {
+	return fmt.Sprintf("database %q of system %s", t.Database, t.SystemID)
+}
+
+// targetIdentity reads the system identifier of the cluster and the name of the database.
+func targetIdentity(ctx context.Context, conn *pgx.Conn) (TargetIdentity, error) {
+	var t TargetIdentity
+	err := conn.QueryRow(ctx, `
+		SELECT system_identifier::text, current_database() FROM pg_control_system()`).Scan(&t.SystemID, &t.Database)
+	return t, err
+}
+
+// listObjects returns user schemas, tables, indexes, views and sequences of the database
+// with their owners, except partitions and objects of extensions.
+func listObjects(ctx context.Context, conn *pgx.Conn) (map[DBObject]string, error) {
+	rows, err := conn.Query(ctx, `
+		SELECT CASE c.relkind
+				WHEN 'i' THEN 'index' WHEN 'I' THEN 'index'
+				WHEN 'm' THEN 'materialized view' WHEN 'v' THEN 'view'
+				WHEN 'S' THEN 'sequence' ELSE 'table'
+			END, n.nspname, c.relname, pg_get_userbyid(c.relowner)
+		FROM pg_class c JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relkind IN ('r', 'p', 'i', 'I', 'm', 'v', 'S')
+			AND n.nspname <> ALL($1) AND n.nspname NOT LIKE 'pg\_%'
+			-- partitions and chunks go away with their parents, audit log partitions
+			-- of a history table in the same database must stay
+			AND NOT EXISTS (SELECT FROM pg_inherits WHERE inhrelid = c.oid)
+			AND NOT EXISTS (SELECT FROM pg_depend WHERE objid = c.oid AND deptype = 'e')
+		UNION ALL
+		SELECT 'schema', n.nspname, '', pg_get_userbyid(n.nspowner)
+		FROM pg_namespace n
+		WHERE n.nspname <> ALL($1) AND n.nspname NOT LIKE 'pg\_%'
+			AND NOT EXISTS (SELECT FROM pg_depend WHERE objid = n.oid AND deptype = 'e')`, compat.SystemSchemas)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	objects := map[DBObject]string{}
+	for rows.Next() {
+		var o DBObject
+		var owner string
+		if err := rows.Scan(&o.Kind, &o.Schema, &o.Name, &owner); err != nil {
+			return nil, err
+		}
+		objects[o] = owner
+	}
+	return objects, rows.Err()
+}
+
+// foreignSessions returns the number of client sessions of the database that don't belong
+// to the run: their application_name is neither appName of the tool's own connections nor
+// starts with it, like the names of the workload connections.
+func foreignSessions(ctx context.Context, conn *pgx.Conn, appName string) (int, error) {
+	var n int
+	err := conn.QueryRow(ctx, `
+		SELECT count(*) FROM pg_stat_activity
+		WHERE datname = current_database() AND pid <> pg_backend_pid()
+			AND backend_type = 'client backend'
+			AND application_name <> $1
+			AND left(application_name, length($1) + 1) <> $1 || ' '`, appName).Scan(&n)
+	return n, err
+}
+
+// ObjectTracker records schema objects created in the target database during the run,
+// by the tool itself or by generated queries, so that `cleanup` can drop them later.
+// Objects are found by comparing the catalog with its state at the start of the run.
+//
+// The catalog doesn't tell which session created an object, so objects are recorded as
+// verified only if they are owned by the role of the run and no other client sessions were
+// seen in the database since the previous check. Sessions of the run are told by their
+// application_name, set by dbconn.SetAppName before tracking starts. Sessions are sampled
+// at every check, so short ones in between can still be missed.
+type ObjectTracker struct {
+	connstr string
+	history *DBHistory
+	// role is the user the run connects as, appName is application_name of its connections
+	role    string
+	appName string
+	// known are the objects that existed at the start or were already recorded
+	known map[DBObject]string
+	// foreign is true if sessions outside the run were seen since the last check
+	foreign bool
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+// TrackObjects records the identity of the target database, takes the state of the catalog
+// and starts checking it for new objects until Stop. Tracking is disabled if the catalog
+// can't be read.
+func TrackObjects(ctx context.Context, connstr string, history *DBHistory) *ObjectTracker {
+	t := &ObjectTracker{connstr: connstr, history: history, appName: dbconn.AppName(), done: make(chan struct{})}
+	if err := t.start(ctx); err != nil {
+		log.Warn(ctx, "failed to list objects, created objects are not tracked", zap.Error(err))
+		t.known = nil
+		close(t.done)
+		return t
+	}
+
+	ctx, t.cancel = context.WithCancel(ctx)
+	go func() {
+		defer close(t.done)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(objectCheckInterval):
+				t.check(ctx)
+			}
+		}
+	}()
+	return t
+}
+
+// start saves the target identity and takes the initial state of the catalog.
+func (t *ObjectTracker) start(ctx context.Context) error {
+	conn, err := dbconn.Connect(ctx, t.connstr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	target, err := targetIdentity(ctx, conn)
+	if err != nil {
+		return fmt.Errorf("failed to identify the target database: %w", err)
+	}
+	if err := t.history.SaveRunTarget(target); err != nil {
+		return fmt.Errorf("failed to save the target database: %w", err)
+	}
+	if err := conn.QueryRow(ctx, "SELECT current_user").Scan(&t.role); err != nil {
+		return err
+	}
+	t.known, err = listObjects(ctx, conn)
+	return err
+}
+
+// Stop stops the periodic checks and records objects created since the last one.
+func (t *ObjectTracker) Stop() {
+	if t.known == nil {
+		return
+	}
+	t.cancel()
+	<-t.done
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	t.check(ctx)
+}
+
+// check records objects missing from the known ones, it's not safe for concurrent use.
+func (t *ObjectTracker) check(ctx context.Context) {
+	conn, err := dbconn.Connect(ctx, t.connstr)
+	if err != nil {
+		log.Warn(ctx, "failed to check created objects", zap.Error(err))
+		return
+	}
+	defer conn.Close(context.Background())
+	sessions, err := foreignSessions(ctx, conn, t.appName)
+	if err != nil {
+		log.Warn(ctx, "failed to check sessions, created objects are not verified", zap.Error(err))
+		sessions = 1
+	}
+	t.foreign = t.foreign || sessions > 0
+	objects, err := listObjects(ctx, conn)
+	if err != nil {
+		log.Warn(ctx, "failed to check created objects", zap.Error(err))
+		return
+	}
+
+	var created []RunObject
+	for o, owner := range objects {
+		if _, ok := t.known[o]; !ok {
+			created = append(created, RunObject{DBObject: o, Verified: owner == t.role && !t.foreign})
+		}
+	}
+	if len(created) > 0 {
+		if err := t.history.SaveRunObjects(created); err != nil {
+			log.Warn(ctx, "failed to save created objects", zap.Error(err))
+			return
+		}
+		for _, o := range created {
+			t.known[o.DBObject] = objects[o.DBObject]
+		}
+		log.Info(ctx, "recorded objects created by the run", zap.Int("count", len(created)))
+	}
+	// sessions seen now may have created objects before the next check
+	t.foreign = sessions > 0
+}
+
+// Cleanup drops objects created by the run that still exist, dependent objects are dropped
+// with CASCADE. It refuses to run against a database other than the target of the run.
+// Unverified objects, which may have been created outside the run, are skipped unless
+// unverified is set. With dryRun nothing is dropped. It returns the dropped and the skipped objects.
+func Cleanup(ctx context.Context, connstr string, history *DBHistory, runID int, dryRun, unverified bool) ([]DBObject, []DBObject, error) {
+	target, err := history.RunTarget(runID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load the target database of run %d: %w", runID, err)
+	}
+	objects, err := history.RunObjects(runID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load objects of run %d: %w", runID, err)
+	}
+
+	conn, err := dbconn.Connect(ctx, connstr)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close(context.Background())
+	current, err := targetIdentity(ctx, conn)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to identify the database: %w", err)
+	}
+	if current != target {
+		return nil, nil, fmt.Errorf("run %d targeted %s, but CONNSTR points to %s", runID, target, current)
+	}
+	existing, err := listObjects(ctx, conn)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	slices.SortStableFunc(objects, func(a, b RunObject) int {
+		return slices.Index(objectKinds, a.Kind) - slices.Index(objectKinds, b.Kind)
+	})
+	var dropped, skipped []DBObject
+	for _, o := range objects {
+		// objects are dropped with CASCADE, so the ones dropped before may be gone
+		if _, ok := existing[o.DBObject]; !ok {
+			continue
+		}
+		if !o.Verified && !unverified {
+			log.Info(ctx, "skipped unverified object", zap.Stringer("object", o))
+			skipped = append(skipped, o.DBObject)
+			continue
+		}
+		if !dryRun {
+			if _, err := conn.Exec(ctx, fmt.Sprintf("DROP %s IF EXISTS %s CASCADE", o.Kind, o.ident())); err != nil {
+				return dropped, skipped, fmt.Errorf("failed to drop %s: %w", o, err)
+			}
+			if err := history.MarkObjectDropped(runID, o.DBObject); err != nil {
+				return dropped, skipped, err
+			}
+		}
+		log.Info(ctx, "dropped object", zap.Stringer("object", o), zap.Bool("dry_run", dryRun))
+		dropped = append(dropped, o.DBObject)
+	}
+	return dropped, skipped, nil
+}
+
+// RunObject is an object recorded by the run.
+type RunObject struct {
+	DBObject
+	// Verified is false if the object may have been created outside the run.
+	Verified bool
+}
+
+// SaveRunTarget records the target database of the current run.
+func (d *DBHistory) SaveRunTarget(target TargetIdentity) error {
+	if d.runID == 0 {
+		return nil
+	}
+	_, err := d.db.Exec(context.Background(), `
+		UPDATE runs SET target_system_id = $1, target_database = $2 WHERE id = $3`,
+		target.SystemID, target.Database, d.runID)
+	return err
+}
+
+// RunTarget returns the target database of the run, it fails if it wasn't recorded.
+func (d *DBHistory) RunTarget(runID int) (TargetIdentity, error) {
+	var systemID, database *string
+	err := d.db.QueryRow(context.Background(), `
+		SELECT target_system_id, target_database FROM runs WHERE id = $1`, runID).Scan(&systemID, &database)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return TargetIdentity{}, fmt.Errorf("run %d not found", runID)
+	}
+	if err != nil {
+		return TargetIdentity{}, err
+	}
+	if systemID == nil || database == nil {
+		return TargetIdentity{}, fmt.Errorf("target database of run %d is unknown", runID)
+	}
+	return TargetIdentity{SystemID: *systemID, Database: *database}, nil
+}
+
+// SaveRunObjects records objects created by the current run.
+func (d *DBHistory) SaveRunObjects(objects []RunObject) error {
+	if d.runID == 0 {
+		return nil
+	}
+	batch := &pgx.Batch{}
+	for _, o := range objects {
+		batch.Queue(`
+			INSERT INTO run_objects (run_id, kind, schema_name, name, verified) VALUES ($1, $2, $3, $4, $5)
+			ON CONFLICT DO NOTHING`, d.runID, o.Kind, o.Schema, o.Name, o.Verified)
+	}
+	return d.db.SendBatch(context.Background(), batch).Close()
+}
+
+// RunObjects returns objects created by the run that were not dropped by cleanup.
+func (d *DBHistory) RunObjects(runID int) ([]RunObject, error) {
+	rows, err := d.db.Query(context.Background(), `
+		SELECT kind, schema_name, name, verified FROM run_objects
+		WHERE run_id = $1 AND dropped_at IS NULL
+		ORDER BY created_at, schema_name, name`, runID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []RunObject
+	for rows.Next() {
+		var o RunObject
+		if err := rows.Scan(&o.Kind, &o.Schema, &o.Name, &o.Verified); err != nil {
+			return nil, err
+		}
+		res = append(res, o)
+	}
+	return res, rows.Err()
+}
+
+// MarkObjectDropped records that the object of the run was dropped.
+func (d *DBHistory) MarkObjectDropped(runID int, o DBObject) error {
+	_, err := d.db.Exec(context.Background(), `
+		UPDATE run_objects SET dropped_at = now()
+		WHERE run_id = $1 AND kind = $2 AND schema_name = $3 AND name = $4`, runID, o.Kind, o.Schema, o.Name)
+	return err
+}
@@ -0,0 +1,54 @@
+package autoai
+
+import "time"
+
+// omissionCorrector compensates for coordinated omission in closed-loop measurements.
+//
+// A worker that waits for a slow query doesn't issue the queries it intended to issue
+// in the meantime, so slow responses suppress the samples that would have observed them.
+// The corrector assumes queries are intended to start every expected interval (the running
+// average latency) and, for every query slower than that, accounts the skipped queries as
+// synthetic samples that waited from their intended start time until the slow query finished.
+type omissionCorrector struct {
+	realCount int
+	realSum   time.Duration
+
+	count int
+	sum   time.Duration
+	// latency holds real and synthetic samples, for corrected percentiles
+	latency latencyHistogram
+}
+
+// record adds a real sample together with the synthetic samples it suppressed.
+func (c *omissionCorrector) record(elapsed time.Duration) {
+	interval := elapsed
+	if c.realCount > 0 {
+		interval = c.realSum / time.Duration(c.realCount)
+	}
+
+	c.realCount++
+	c.realSum += elapsed
+	c.count++
+	c.sum += elapsed
+	c.latency.record(elapsed)
+
+	if interval <= 0 || elapsed <= interval {
+		return
+	}
+
+	// synthetic samples are elapsed-interval, elapsed-2*interval, ... while positive
+	k := int64((elapsed - 1) / interval)
+	c.count += int(k)
+	c.sum += time.Duration(k)*elapsed - interval*time.Duration(k*(k+1)/2)
+	for i := int64(1); i <= k; i++ {
+		c.latency.record(elapsed - time.Duration(i)*interval)
+	}
+}
+
+// avg returns the corrected average latency.
+func (c *omissionCorrector) avg() time.Duration {
+	if c.count == 0 {
+		return 0
+	}
+	return c.sum / time.Duration(c.count)
+}
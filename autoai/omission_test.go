@@ -0,0 +1,31 @@
+package autoai
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOmissionCorrector(t *testing.T) {
+	var c omissionCorrector
+	for range 99 {
+		c.record(time.Millisecond)
+	}
+	// a stall of 100ms suppressed 99 executions that would have waited 1ms..99ms
+	c.record(100 * time.Millisecond)
+
+	require.Equal(t, 199, c.count)
+	require.EqualValues(t, c.count, c.latency.total)
+	require.Equal(t, (99*time.Millisecond+100*time.Millisecond+4950*time.Millisecond)/199, c.avg())
+
+	require.Equal(t, time.Millisecond, c.latency.percentile(0.5).Round(time.Millisecond))
+	require.InEpsilon(t, float64(91*time.Millisecond), float64(c.latency.percentile(0.95)), 1.0/128)
+
+	var uncorrected latencyHistogram
+	for range 99 {
+		uncorrected.record(time.Millisecond)
+	}
+	uncorrected.record(100 * time.Millisecond)
+	require.Equal(t, time.Millisecond, uncorrected.percentile(0.95).Round(time.Millisecond), "the stall is invisible without the correction")
+}
@@ -0,0 +1,209 @@
+package autoai
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/petuhovskiy/overload/internal/dbconn"
+	"github.com/petuhovskiy/overload/internal/log"
+	"go.uber.org/zap"
+)
+
+// executeOpenLoop dispatches query at the given average arrival rate (queries per second)
+// with Poisson inter-arrival times, independent of query completion. At most maxInFlight
+// queries are executed at the same time, arrivals exceeding this cap are dropped.
+//
+// If opts.bucketSize is set, queries are dispatched at the fixed rate from a token bucket
+// instead: tokens are added at even intervals and wait in the bucket while maxInFlight
+// queries are running, tokens which don't fit into the bucket are dropped.
+//
+// Latency is measured from the intended arrival time, so it includes any queueing
+// on the client side and is not affected by coordinated omission.
+func executeOpenLoop(ctx context.Context, connstr string, query Query, rate float64, maxInFlight int, opts execOptions) ExecStats {
+	poolConfig, err := pgxpool.ParseConfig(withConnParams(connstr, opts.sslParams))
+	if err != nil {
+		return ExecStats{Error: err}
+	}
+	poolConfig.MaxConns = int32(maxInFlight)
+	opts.apply(poolConfig.ConnConfig)
+	dbconn.ConfigurePool(poolConfig)
+
+	pool, err := pgxpool.NewWithConfig(ctx, poolConfig)
+	if err != nil {
+		log.Error(ctx, "failed to connect to database", zap.Error(err))
+		return ExecStats{Error: err}
+	}
+	defer pool.Close()
+
+	ctx, cancel := context.WithTimeout(ctx, opts.duration)
+	defer cancel()
+
+	monitor := newPoolMonitor(pool)
+	go monitor.run(ctx)
+
+	stats := ExecStats{
+		Min:          time.Hour,
+		RequestedQPS: rate,
+	}
+
+	var (
+		mu         sync.Mutex
+		wg         sync.WaitGroup
+		sum        time.Duration
+		series     seriesRecorder
+		inFlight   = make(chan struct{}, maxInFlight)
+		arrival    = time.Now()
+		dispatched int
+		work       = newWorkload(query, opts)
+		results    resultRecorder
+		rng        = newRand()
+		// freed is signaled when an execution finishes, so that tokens waiting in the bucket are dispatched
+		freed = make(chan struct{}, 1)
+	)
+
+	// dispatch executes the query arrived at the intended time, it must hold a slot in inFlight
+	dispatch := func(intended time.Time) {
+		dispatched++
+
+		// rand is not safe for concurrent use, every execution gets its own
+		execRand := rand.New(rand.NewPCG(rng.Uint64(), rng.Uint64()))
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() {
+				<-inFlight
+				select {
+				case freed <- struct{}{}:
+				default:
+				}
+			}()
+
+			var res execResult
+			conn, err := monitor.acquire(ctx)
+			if err == nil {
+				res, err = work.exec(ctx, conn, execRand)
+				conn.Release()
+			}
+			finished := time.Now()
+			elapsed := finished.Sub(intended)
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if err != nil {
+				if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+					return
+				}
+				opts.metrics.record(0, err)
+				stats.recordError(err)
+				opts.breaker.record(true)
+				return
+			}
+			opts.breaker.record(false)
+			opts.metrics.record(elapsed, nil)
+			if work.returnsRows {
+				results.record(res)
+			}
+
+			stats.Count++
+			stats.Min = min(stats.Min, elapsed)
+			stats.Max = max(stats.Max, elapsed)
+			stats.recordLatency(elapsed)
+			sum += elapsed
+			series.record(finished, elapsed)
+		}()
+	}
+
+	// tokens are the intended arrival times of queries waiting in the bucket
+	var tokens []time.Time
+
+loop:
+	for {
+		if opts.tuning != nil && opts.tuning().ArrivalRate > 0 {
+			rate = opts.tuning().ArrivalRate
+		}
+
+		if opts.bucketSize > 0 {
+			select {
+			case <-ctx.Done():
+				break loop
+			case <-freed:
+			case <-time.After(time.Until(arrival)):
+				if len(tokens) < opts.bucketSize {
+					tokens = append(tokens, arrival)
+				} else {
+					stats.Dropped++
+				}
+				arrival = arrival.Add(time.Duration(float64(time.Second) / rate))
+			}
+
+			if opts.breaker.isBroken() {
+				break loop
+			}
+
+		spend:
+			for len(tokens) > 0 {
+				select {
+				case inFlight <- struct{}{}:
+					dispatch(tokens[0])
+					tokens = tokens[1:]
+				default:
+					break spend
+				}
+			}
+			continue
+		}
+
+		arrival = arrival.Add(time.Duration(rand.ExpFloat64() / rate * float64(time.Second)))
+
+		select {
+		case <-ctx.Done():
+			break loop
+		case <-time.After(time.Until(arrival)):
+		}
+
+		if opts.breaker.isBroken() {
+			break loop
+		}
+
+		select {
+		case inFlight <- struct{}{}:
+		default:
+			stats.Dropped++
+			continue
+		}
+		dispatch(arrival)
+	}
+
+	wg.Wait()
+
+	if stats.Count > 0 {
+		stats.Avg = sum / time.Duration(stats.Count)
+	}
+	stats.fillPercentiles()
+	stats.Series = series.points
+	// the rate could be changed during the step, the last one is reported
+	stats.RequestedQPS = rate
+	stats.AchievedQPS = float64(stats.Count) / opts.duration.Seconds()
+	stats.Broken = opts.breaker.isBroken()
+	stats.Pool = monitor.stats()
+	stats.Statements = work.statementStats()
+	stats.Retries = work.retried.Load()
+	results.fill(&stats)
+
+	log.Info(ctx, "open loop finished",
+		zap.Int("dispatched", dispatched),
+		zap.Int("dropped", stats.Dropped),
+		zap.Int("bucket_tokens", len(tokens)),
+		zap.Float64("requested_qps", rate),
+		zap.Float64("achieved_qps", stats.AchievedQPS),
+		zap.Duration("acquire_avg", stats.Pool.AcquireAvg),
+		zap.Duration("acquire_max", stats.Pool.AcquireMax),
+	)
+	return stats
+}
@@ -0,0 +1,319 @@
+package autoai
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/petuhovskiy/overload/errs"
+)
+
+// ParamGenerator produces values for a named placeholder in a query template.
+type ParamGenerator interface {
+	Next(r *rand.Rand) any
+}
+
+// paramLoader is implemented by generators that need to read data from the database before use.
+type paramLoader interface {
+	load(ctx context.Context, conn *pgx.Conn) error
+}
+
+// UniformInt generates integers uniformly distributed in [Min, Max].
+type UniformInt struct {
+	Min, Max int64
+}
+
+func (g *UniformInt) Next(r *rand.Rand) any {
+	return g.Min + r.Int64N(g.Max-g.Min+1)
+}
+
+// maxZipfs bounds the number of cached zipf generators of a ZipfKey, the cache is dropped
+// when it's full, together with generators of workers of finished steps.
+const maxZipfs = 1024
+
+// ZipfKey generates integers in [Min, Max] with zipfian distribution, Min being the most frequent.
+// S is the skew parameter and must be greater than 1.
+type ZipfKey struct {
+	Min, Max int64
+	S        float64
+
+	// zipfs holds the generator of every random source, every worker has its own source.
+	// Creating a generator is more expensive than sampling it.
+	zipfs      sync.Map // *rand.Rand -> *rand.Zipf
+	zipfsCount atomic.Int64
+}
+
+func (g *ZipfKey) Next(r *rand.Rand) any {
+	zipf, ok := g.zipfs.Load(r)
+	if !ok {
+		if g.zipfsCount.Add(1) > maxZipfs {
+			g.zipfs.Clear()
+			g.zipfsCount.Store(1)
+		}
+		zipf, _ = g.zipfs.LoadOrStore(r, rand.NewZipf(r, g.S, 1, uint64(g.Max-g.Min)))
+	}
+	return g.Min + int64(zipf.(*rand.Zipf).Uint64())
+}
+
+// TimestampWindow generates timestamps uniformly distributed in the last Window before now.
+type TimestampWindow struct {
+	Window time.Duration
+}
+
+func (g *TimestampWindow) Next(r *rand.Rand) any {
+	return time.Now().Add(-time.Duration(r.Int64N(int64(g.Window) + 1)))
+}
+
+// ColumnSample generates values sampled from a column of an existing table.
+// Up to Limit random values are loaded once before the execution.
+type ColumnSample struct {
+	Table, Column string
+	Limit         int
+
+	values []any
+}
+
+func (g *ColumnSample) load(ctx context.Context, conn *pgx.Conn) error {
+	limit := g.Limit
+	if limit <= 0 {
+		limit = 10000
+	}
+
+	table := pgx.Identifier(strings.Split(g.Table, ".")).Sanitize()
+	column := pgx.Identifier{g.Column}.Sanitize()
+	rows, err := conn.Query(ctx, fmt.Sprintf(
+		"SELECT %s FROM %s WHERE %s IS NOT NULL ORDER BY random() LIMIT %d", column, table, column, limit))
+	if err != nil {
+		return err
+	}
+	values, err := pgx.CollectRows(rows, pgx.RowTo[any])
+	if err != nil {
+		return err
+	}
+	if len(values) == 0 {
+		return fmt.Errorf("no values in %s.%s", g.Table, g.Column)
+	}
+	g.values = values
+	return nil
+}
+
+func (g *ColumnSample) Next(r *rand.Rand) any {
+	if len(g.values) == 0 {
+		return nil
+	}
+	return g.values[r.IntN(len(g.values))]
+}
+
+// ParseParam parses a param definition in the form "name kind args...":
+//
+//	aid uniform 1 100000
+//	key zipf 1 1000000 1.1
+//	ts timestamp 24h
+//	uid sample users.id
+func ParseParam(def string) (string, ParamGenerator, error) {
+	fields := strings.Fields(def)
+	if len(fields) < 2 {
+		return "", nil, errs.Validationf("invalid param %q", def)
+	}
+	name, kind, args := fields[0], fields[1], fields[2:]
+
+	var gen ParamGenerator
+	var err error
+	switch kind {
+	case "uniform":
+		var min, max int64
+		err = parseParamArgs(args, &min, &max)
+		if err == nil && min > max {
+			err = fmt.Errorf("min is greater than max")
+		}
+		gen = &UniformInt{Min: min, Max: max}
+	case "zipf":
+		var min, max int64
+		s := 1.1
+		if len(args) == 2 {
+			err = parseParamArgs(args, &min, &max)
+		} else {
+			err = parseParamArgs(args, &min, &max, &s)
+		}
+		if err == nil && (min > max || s <= 1) {
+			err = fmt.Errorf("min must not exceed max and skew must be greater than 1")
+		}
+		gen = &ZipfKey{Min: min, Max: max, S: s}
+	case "timestamp":
+		var window time.Duration
+		err = parseParamArgs(args, &window)
+		gen = &TimestampWindow{Window: window}
+	case "sample":
+		table, column, ok := cutLast(strings.Join(args, ""), ".")
+		if len(args) != 1 || !ok {
+			err = fmt.Errorf("expected table.column")
+		}
+		gen = &ColumnSample{Table: table, Column: column}
+	default:
+		err = fmt.Errorf("unknown generator %q", kind)
+	}
+	if err != nil {
+		return "", nil, errs.Validationf("invalid param %q: %w", def, err)
+	}
+	return name, gen, nil
+}
+
+// parseParamArgs parses args into the given pointers, number of args must match.
+func parseParamArgs(args []string, dst ...any) error {
+	if len(args) != len(dst) {
+		return fmt.Errorf("expected %d arguments, got %d", len(dst), len(args))
+	}
+	for i, arg := range args {
+		var err error
+		switch d := dst[i].(type) {
+		case *int64:
+			*d, err = strconv.ParseInt(arg, 10, 64)
+		case *float64:
+			*d, err = strconv.ParseFloat(arg, 64)
+		case *time.Duration:
+			*d, err = time.ParseDuration(arg)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func cutLast(s, sep string) (string, string, bool) {
+	i := strings.LastIndex(s, sep)
+	if i < 0 {
+		return s, "", false
+	}
+	return s[:i], s[i+len(sep):], true
+}
+
+// loadParams prepares generators of the query that need data from the database.
+func loadParams(ctx context.Context, conn *pgx.Conn, query Query) error {
+	for name, gen := range query.Params {
+		if loader, ok := gen.(paramLoader); ok {
+			if err := loader.load(ctx, conn); err != nil {
+				return fmt.Errorf("failed to load param %s: %w", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// boundQuery is a query template with named placeholders replaced by positional ones.
+type boundQuery struct {
+	sql    string
+	names  []string
+	params map[string]ParamGenerator
+}
+
+// bindQuery replaces :name placeholders that have generators with $N parameters.
+// Placeholders inside quotes and comments, and :: casts are left untouched.
+func bindQuery(query Query) boundQuery {
+	return bindSQL(query.SQL, query.Params)
+}
+
+func bindSQL(sql string, params map[string]ParamGenerator) boundQuery {
+	if len(params) == 0 {
+		return boundQuery{sql: sql}
+	}
+
+	var (
+		sb      strings.Builder
+		names   []string
+		indexes = map[string]int{}
+	)
+	for i := 0; i < len(sql); i++ {
+		c := sql[i]
+		switch {
+		case c == '\'' || c == '"':
+			end := strings.IndexByte(sql[i+1:], c)
+			if end < 0 {
+				sb.WriteString(sql[i:])
+				i = len(sql)
+				continue
+			}
+			sb.WriteString(sql[i : i+end+2])
+			i += end + 1
+			continue
+		case strings.HasPrefix(sql[i:], "--"):
+			end := strings.IndexByte(sql[i:], '\n')
+			if end < 0 {
+				end = len(sql) - i
+			}
+			sb.WriteString(sql[i : i+end])
+			i += end - 1
+			continue
+		case c == ':' && (i == 0 || sql[i-1] != ':'):
+			name := paramName(sql[i+1:])
+			if _, ok := params[name]; ok && name != "" {
+				idx, ok := indexes[name]
+				if !ok {
+					names = append(names, name)
+					idx = len(names)
+					indexes[name] = idx
+				}
+				sb.WriteString("$" + strconv.Itoa(idx))
+				i += len(name)
+				continue
+			}
+		}
+		sb.WriteByte(c)
+	}
+	return boundQuery{sql: sb.String(), names: names, params: params}
+}
+
+// paramName returns the identifier at the start of s.
+func paramName(s string) string {
+	for i, c := range s {
+		isLetter := c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+		isDigit := c >= '0' && c <= '9'
+		if !isLetter && !(isDigit && i > 0) {
+			return s[:i]
+		}
+	}
+	return s
+}
+
+// args generates values for all parameters of the query.
+func (q *boundQuery) args(r *rand.Rand) []any {
+	return q.argsFrom(generateParams(q.params, r))
+}
+
+// argsFrom returns parameters of the query from already generated values.
+func (q *boundQuery) argsFrom(values map[string]any) []any {
+	if len(q.names) == 0 {
+		return nil
+	}
+	args := make([]any, len(q.names))
+	for i, name := range q.names {
+		args[i] = values[name]
+	}
+	return args
+}
+
+// generateParams generates a value for every param. Params are generated in the order
+// of their names, so that a seeded generator always produces the same values.
+func generateParams(params map[string]ParamGenerator, r *rand.Rand) map[string]any {
+	if len(params) == 0 {
+		return nil
+	}
+	values := make(map[string]any, len(params))
+	for _, name := range slices.Sorted(maps.Keys(params)) {
+		values[name] = params[name].Next(r)
+	}
+	return values
+}
+
+// newRand creates a random generator for a single worker.
+func newRand() *rand.Rand {
+	return rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64()))
+}
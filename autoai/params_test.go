@@ -0,0 +1,27 @@
+package autoai
+
+import (
+	"math/rand/v2"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestZipfKey(t *testing.T) {
+	g := &ZipfKey{Min: 10, Max: 1000, S: 1.1}
+	r := rand.New(rand.NewPCG(1, 2))
+	expected := rand.NewZipf(rand.New(rand.NewPCG(1, 2)), 1.1, 1, 990)
+
+	for range 1000 {
+		v := g.Next(r).(int64)
+		require.Equal(t, 10+int64(expected.Uint64()), v)
+		require.GreaterOrEqual(t, v, int64(10))
+		require.LessOrEqual(t, v, int64(1000))
+	}
+	require.EqualValues(t, 1, g.zipfsCount.Load(), "the generator is created once per source")
+
+	for i := range maxZipfs + 1 {
+		g.Next(rand.New(rand.NewPCG(uint64(i), 0)))
+	}
+	require.LessOrEqual(t, g.zipfsCount.Load(), int64(maxZipfs))
+}
@@ -0,0 +1,211 @@
+package autoai
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/petuhovskiy/overload/internal/log"
+	"go.uber.org/zap"
+)
+
+const (
+	// defaultPatternHistory is the number of the latest execution records aggregated into
+	// pattern statistics for the prompt.
+	defaultPatternHistory = 5000
+	// maxPromptPatterns is the number of the most frequent patterns described in the prompt.
+	maxPromptPatterns = 10
+)
+
+var (
+	tableRefRegexp = regexp.MustCompile(`(?i)\b(?:FROM|JOIN|INTO|UPDATE)\s+((?:"[^"]+"|[a-z_][a-z0-9_$]*)(?:\.(?:"[^"]+"|[a-z_][a-z0-9_$]*))?)`)
+	joinRegexp     = regexp.MustCompile(`(?i)\bJOIN\b`)
+	subqueryRegexp = regexp.MustCompile(`(?i)\(\s*SELECT\b`)
+	schemaTableRe  = regexp.MustCompile(`(?m)^TABLE ([^ ]+)\.([^ ]+) \(`)
+)
+
+// SetPatternHistory sets the number of the latest execution records of the history which are
+// aggregated by query pattern for the prompt. Zero keeps the default of 5000, negative disables
+// pattern statistics in the prompt.
+func (g *Generator) SetPatternHistory(records int) {
+	g.patternHistory = records
+}
+
+// QueryOutcome is the result of all executions of a query in the history.
+type QueryOutcome struct {
+	SQL string
+	// Succeeded is set if any execution step of the query succeeded, AvgLatency is the average
+	// latency of successful steps.
+	Succeeded  bool
+	AvgLatency time.Duration
+}
+
+// QueryOutcomes returns outcomes of queries executed within the latest records of query_exec_info.
+func (d *DBHistory) QueryOutcomes(records int) ([]QueryOutcome, error) {
+	rows, err := d.db.Query(context.Background(), `
+		SELECT min(query), bool_or(NOT is_failed), coalesce(avg(avg_latency_ms) FILTER (WHERE NOT is_failed), 0)
+		FROM query_exec_info
+		WHERE exec_count IS NOT NULL AND id > (SELECT coalesce(max(id), 0) - $1 FROM query_exec_info)
+		GROUP BY fingerprint`, records)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []QueryOutcome
+	for rows.Next() {
+		var (
+			outcome QueryOutcome
+			avgMs   float64
+		)
+		if err := rows.Scan(&outcome.SQL, &outcome.Succeeded, &avgMs); err != nil {
+			return nil, err
+		}
+		outcome.AvgLatency = time.Duration(avgMs * float64(time.Millisecond))
+		res = append(res, outcome)
+	}
+	return res, rows.Err()
+}
+
+// queryPattern is the shape of a query: its statement, the tables it touches, and whether it
+// has joins and subqueries.
+type queryPattern struct {
+	Statement string
+	Tables    []string
+	Join      bool
+	Subquery  bool
+}
+
+func parsePattern(sql string) queryPattern {
+	p := queryPattern{
+		Join:     joinRegexp.MatchString(sql),
+		Subquery: subqueryRegexp.MatchString(sql),
+	}
+	if fields := strings.Fields(statementKeyword(sql)); len(fields) > 0 {
+		p.Statement = strings.TrimSuffix(fields[0], ";")
+	}
+	for _, m := range tableRefRegexp.FindAllStringSubmatch(sql, -1) {
+		table := strings.ToLower(strings.ReplaceAll(m[1], `"`, ""))
+		if !slices.Contains(p.Tables, table) {
+			p.Tables = append(p.Tables, table)
+		}
+	}
+	sort.Strings(p.Tables)
+	return p
+}
+
+func (p queryPattern) String() string {
+	s := p.Statement
+	if len(p.Tables) > 0 {
+		s += " on " + strings.Join(p.Tables, ", ")
+	}
+	switch {
+	case p.Join && p.Subquery:
+		s += " with joins and subqueries"
+	case p.Join:
+		s += " with joins"
+	case p.Subquery:
+		s += " with subqueries"
+	}
+	return s
+}
+
+// patternStats aggregates outcomes of queries of the same pattern.
+type patternStats struct {
+	pattern   string
+	total     int
+	succeeded int
+	latency   time.Duration
+}
+
+// patternHints returns the prompt section with success rates of query patterns from the history,
+// limited to patterns touching tables of the schema. It's empty without history.
+func (g *Generator) patternHints(ctx context.Context, schema string) string {
+	if g.patternHistory < 0 {
+		return ""
+	}
+	records := g.patternHistory
+	if records == 0 {
+		records = defaultPatternHistory
+	}
+	outcomes, err := g.history.QueryOutcomes(records)
+	if err != nil {
+		log.Warn(ctx, "failed to load query history for the prompt", zap.Error(err))
+		return ""
+	}
+
+	tables := map[string]bool{}
+	for _, m := range schemaTableRe.FindAllStringSubmatch(schema, -1) {
+		tables[strings.ToLower(m[1]+"."+m[2])] = true
+		tables[strings.ToLower(m[2])] = true
+	}
+
+	byPattern := map[string]*patternStats{}
+	for _, outcome := range outcomes {
+		// patterns are described with the names the model sees
+		pattern := parsePattern(g.anonymizer.hideSQL(outcome.SQL))
+		// names which aren't tables of the schema are CTEs, columns of EXTRACT(... FROM ...) and the like,
+		// tables are described without schemas, so that qualified and bare references match
+		var known []string
+		for _, t := range pattern.Tables {
+			if !tables[t] {
+				continue
+			}
+			if _, name, ok := strings.Cut(t, "."); ok {
+				t = name
+			}
+			if !slices.Contains(known, t) {
+				known = append(known, t)
+			}
+		}
+		sort.Strings(known)
+		pattern.Tables = known
+		if len(pattern.Tables) == 0 {
+			continue
+		}
+		key := pattern.String()
+		s, ok := byPattern[key]
+		if !ok {
+			s = &patternStats{pattern: key}
+			byPattern[key] = s
+		}
+		s.total++
+		if outcome.Succeeded {
+			s.succeeded++
+			s.latency += outcome.AvgLatency
+		}
+	}
+	if len(byPattern) == 0 {
+		return ""
+	}
+
+	var stats []*patternStats
+	for _, s := range byPattern {
+		stats = append(stats, s)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].total != stats[j].total {
+			return stats[i].total > stats[j].total
+		}
+		return stats[i].pattern < stats[j].pattern
+	})
+	if len(stats) > maxPromptPatterns {
+		stats = stats[:maxPromptPatterns]
+	}
+
+	var sb strings.Builder
+	sb.WriteString("\nThis is what has worked on this schema historically, by query pattern:\n")
+	for _, s := range stats {
+		fmt.Fprintf(&sb, "- %s: %d of %d queries succeeded", s.pattern, s.succeeded, s.total)
+		if s.succeeded > 0 {
+			fmt.Fprintf(&sb, ", average latency %s", (s.latency / time.Duration(s.succeeded)).Round(time.Microsecond))
+		}
+		sb.WriteString("\n")
+	}
+	sb.WriteString("Prefer patterns that succeed, and avoid or fix patterns that fail.\n")
+	return sb.String()
+}
@@ -0,0 +1,128 @@
+package autoai
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/petuhovskiy/overload/internal/dbconn"
+	"github.com/petuhovskiy/overload/internal/log"
+	"go.uber.org/zap"
+)
+
+// explainNode is a node of EXPLAIN (FORMAT JSON) output. Buffers are set only with ANALYZE and BUFFERS.
+type explainNode struct {
+	NodeType         string        `json:"Node Type"`
+	RelationName     string        `json:"Relation Name"`
+	IndexName        string        `json:"Index Name"`
+	JoinType         string        `json:"Join Type"`
+	SharedHitBlocks  int64         `json:"Shared Hit Blocks"`
+	SharedReadBlocks int64         `json:"Shared Read Blocks"`
+	Plans            []explainNode `json:"Plans"`
+}
+
+// shape returns a compact representation of the plan tree, ignoring costs and row estimates.
+func (n *explainNode) shape() string {
+	var sb strings.Builder
+	sb.WriteString(n.NodeType)
+	if n.JoinType != "" {
+		sb.WriteString(" " + n.JoinType)
+	}
+	if n.RelationName != "" || n.IndexName != "" {
+		sb.WriteString("[" + strings.TrimSpace(n.RelationName+" "+n.IndexName) + "]")
+	}
+	if len(n.Plans) > 0 {
+		children := make([]string, 0, len(n.Plans))
+		for i := range n.Plans {
+			children = append(children, n.Plans[i].shape())
+		}
+		sb.WriteString("(" + strings.Join(children, ", ") + ")")
+	}
+	return sb.String()
+}
+
+// explainShape runs EXPLAIN for the query and returns the plan shape.
+func explainShape(ctx context.Context, conn *pgx.Conn, sql string, args ...any) (string, error) {
+	var raw []byte
+	err := conn.QueryRow(ctx, "EXPLAIN (FORMAT JSON) "+sql, args...).Scan(&raw)
+	if err != nil {
+		return "", err
+	}
+
+	var plans []struct {
+		Plan explainNode `json:"Plan"`
+	}
+	if err := json.Unmarshal(raw, &plans); err != nil {
+		return "", err
+	}
+	if len(plans) == 0 {
+		return "", fmt.Errorf("empty plan")
+	}
+	return plans[0].Plan.shape(), nil
+}
+
+// PlanFlip describes a change of the query plan during the run.
+type PlanFlip struct {
+	Time   time.Time
+	Before string
+	After  string
+}
+
+// watchPlan periodically explains the query and records every plan change, until the context is done.
+// Queries that can't be explained (e.g. DDL) are not watched.
+func (l *Launcher) watchPlan(ctx context.Context, opts execOptions, connstr string, query Query) {
+	config, err := opts.connConfig(connstr)
+	if err != nil {
+		return
+	}
+
+	conn, err := dbconn.ConnectConfig(ctx, config)
+	if err != nil {
+		log.Warn(ctx, "failed to connect for plan watching", zap.Error(err))
+		return
+	}
+	defer conn.Close(context.Background())
+
+	bound := bindQuery(query)
+	rng := newRand()
+
+	var prev string
+	for {
+		shape, err := explainShape(ctx, conn, bound.sql, bound.args(rng)...)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Debug(ctx, "query can't be explained, not watching plan", zap.Error(err))
+			}
+			return
+		}
+
+		if prev != "" && shape != prev {
+			flip := PlanFlip{
+				Time:   time.Now(),
+				Before: prev,
+				After:  shape,
+			}
+			log.Warn(ctx, "query plan changed", zap.String("before", prev), zap.String("after", shape))
+			go l.db.SaveQueryExecInfo(flip.ToExecInfo(query.SQL))
+		}
+		prev = shape
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(l.conf.PlanCheckInterval):
+		}
+	}
+}
+
+// ToExecInfo converts plan flip to a history record.
+func (f *PlanFlip) ToExecInfo(query string) *QueryExecInfo {
+	return &QueryExecInfo{
+		Query:   query,
+		Comment: "plan flip",
+		Info:    f,
+	}
+}
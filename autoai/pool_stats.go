@@ -0,0 +1,117 @@
+package autoai
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/petuhovskiy/overload/internal/log"
+	"go.uber.org/zap"
+)
+
+// PoolSample is a snapshot of connection pool utilization.
+type PoolSample struct {
+	Time     time.Time
+	Total    int32
+	Idle     int32
+	Acquired int32
+	// EmptyAcquires is the number of acquires that had to wait for a connection since the previous sample.
+	EmptyAcquires int64
+}
+
+// PoolStats describes how the connection pool was used during the execution.
+type PoolStats struct {
+	MaxConns   int32
+	AcquireAvg time.Duration
+	AcquireMax time.Duration
+	Samples    []PoolSample
+}
+
+// poolMonitor measures acquire latency and samples pool utilization every second.
+type poolMonitor struct {
+	pool *pgxpool.Pool
+
+	mu         sync.Mutex
+	acquireSum time.Duration
+	acquireMax time.Duration
+	acquires   int
+	samples    []PoolSample
+}
+
+func newPoolMonitor(pool *pgxpool.Pool) *poolMonitor {
+	return &poolMonitor{pool: pool}
+}
+
+// acquire acquires a connection from the pool and records the time spent waiting for it.
+func (m *poolMonitor) acquire(ctx context.Context) (*pgxpool.Conn, error) {
+	start := time.Now()
+	conn, err := m.pool.Acquire(ctx)
+	elapsed := time.Since(start)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.acquires++
+	m.acquireSum += elapsed
+	m.acquireMax = max(m.acquireMax, elapsed)
+
+	return conn, nil
+}
+
+// run samples pool utilization every second until the context is done.
+func (m *poolMonitor) run(ctx context.Context) {
+	var lastEmptyAcquires int64
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+
+		stat := m.pool.Stat()
+		sample := PoolSample{
+			Time:          time.Now(),
+			Total:         stat.TotalConns(),
+			Idle:          stat.IdleConns(),
+			Acquired:      stat.AcquiredConns(),
+			EmptyAcquires: stat.EmptyAcquireCount() - lastEmptyAcquires,
+		}
+		lastEmptyAcquires = stat.EmptyAcquireCount()
+
+		m.mu.Lock()
+		m.samples = append(m.samples, sample)
+		acquireAvg := time.Duration(0)
+		if m.acquires > 0 {
+			acquireAvg = m.acquireSum / time.Duration(m.acquires)
+		}
+		m.mu.Unlock()
+
+		log.Debug(ctx, "pool stats",
+			zap.Int32("total", sample.Total),
+			zap.Int32("idle", sample.Idle),
+			zap.Int32("acquired", sample.Acquired),
+			zap.Int64("empty_acquires", sample.EmptyAcquires),
+			zap.Duration("acquire_avg", acquireAvg),
+		)
+	}
+}
+
+// stats returns the collected pool statistics.
+func (m *poolMonitor) stats() *PoolStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	res := &PoolStats{
+		MaxConns:   m.pool.Stat().MaxConns(),
+		AcquireMax: m.acquireMax,
+		Samples:    m.samples,
+	}
+	if m.acquires > 0 {
+		res.AcquireAvg = m.acquireSum / time.Duration(m.acquires)
+	}
+	return res
+}
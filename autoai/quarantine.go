@@ -0,0 +1,121 @@
+package autoai
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/petuhovskiy/overload/internal/log"
+	"go.uber.org/zap"
+)
+
+// defaultQuarantineThreshold is the number of failures after which a generated query
+// is quarantined.
+const defaultQuarantineThreshold = 2
+
+// SetQuarantineThreshold sets the number of failed or timed out executions after which
+// a generated query is quarantined. Zero keeps the default of 2, negative disables the quarantine.
+func (g *Generator) SetQuarantineThreshold(threshold int) {
+	g.quarantineThreshold = threshold
+}
+
+func (g *Generator) quarantineEnabled() bool {
+	return g.quarantineThreshold >= 0
+}
+
+func (g *Generator) threshold() int {
+	if g.quarantineThreshold == 0 {
+		return defaultQuarantineThreshold
+	}
+	return g.quarantineThreshold
+}
+
+// filterQuarantined removes quarantined queries and returns the feedback for the model
+// about every removed query, so that it stops generating them.
+func (g *Generator) filterQuarantined(ctx context.Context, queries []Query) ([]Query, string) {
+	if !g.quarantineEnabled() || len(queries) == 0 {
+		return queries, ""
+	}
+	quarantined, err := g.history.QuarantinedQueries(g.threshold())
+	if err != nil {
+		log.Warn(ctx, "failed to load query quarantine", zap.Error(err))
+		return queries, ""
+	}
+
+	var (
+		res      []Query
+		feedback string
+	)
+	for _, q := range queries {
+		entry, ok := quarantined[QueryFingerprint(q.SQL)]
+		if !ok {
+			res = append(res, q)
+			continue
+		}
+		log.Warn(ctx, "skipping quarantined query",
+			zap.String("query", q.SQL), zap.Int("failures", entry.Failures), zap.String("reason", entry.Reason))
+		feedback += fmt.Sprintf("\n\nThis query is known to fail (%s) and was not executed, don't generate it again:\n```sql\n%s\n```",
+			g.anonymizer.Hide(entry.Reason), g.anonymizer.hideSQL(q.SQL))
+	}
+	return res, feedback
+}
+
+// recordFailure counts a failure of the query towards its quarantine.
+func (g *Generator) recordFailure(ctx context.Context, sql string, reason string) {
+	if !g.quarantineEnabled() {
+		return
+	}
+	failures, err := g.history.RecordQueryFailure(sql, reason)
+	if err != nil {
+		log.Warn(ctx, "failed to record query failure", zap.Error(err))
+		return
+	}
+	if failures == g.threshold() {
+		log.Info(ctx, "query quarantined", zap.String("query", sql), zap.Int("failures", failures))
+	}
+}
+
+// QuarantineEntry is a generated query which failed repeatedly.
+type QuarantineEntry struct {
+	Failures int
+	// Reason is the cause of the last failure.
+	Reason string
+}
+
+// RecordQueryFailure counts a failed or timed out execution of the query and returns
+// the number of its failures in all runs.
+func (d *DBHistory) RecordQueryFailure(sql string, reason string) (int, error) {
+	var failures int
+	err := d.db.QueryRow(context.Background(), `
+		INSERT INTO query_quarantine (fingerprint, query, reason, run_id)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (fingerprint) DO UPDATE SET
+			failures = query_quarantine.failures + 1,
+			reason = excluded.reason,
+			run_id = excluded.run_id,
+			last_failed_at = now()
+		RETURNING failures`, QueryFingerprint(sql), sql, reason, d.runIDArg()).Scan(&failures)
+	return failures, err
+}
+
+// QuarantinedQueries returns queries with at least threshold failures by their fingerprints.
+func (d *DBHistory) QuarantinedQueries(threshold int) (map[string]QuarantineEntry, error) {
+	rows, err := d.db.Query(context.Background(), `
+		SELECT fingerprint, failures, reason FROM query_quarantine WHERE failures >= $1`, threshold)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := map[string]QuarantineEntry{}
+	for rows.Next() {
+		var (
+			fingerprint string
+			entry       QuarantineEntry
+		)
+		if err := rows.Scan(&fingerprint, &entry.Failures, &entry.Reason); err != nil {
+			return nil, err
+		}
+		res[fingerprint] = entry
+	}
+	return res, rows.Err()
+}
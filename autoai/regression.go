@@ -0,0 +1,193 @@
+package autoai
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/petuhovskiy/overload/internal/stat"
+)
+
+const (
+	// regressionAlpha is the significance level of the statistical test.
+	regressionAlpha = 0.05
+	// regressionMinChange is the min relative change of medians to be reported,
+	// tiny but significant changes are not interesting.
+	regressionMinChange = 0.05
+)
+
+const (
+	VerdictRegression  = "REGRESSION"
+	VerdictImprovement = "IMPROVEMENT"
+	VerdictNoChange    = "no change"
+)
+
+// Regression compares the latest execution of a query with the previous executions
+// of the same query at the same concurrency.
+type Regression struct {
+	Fingerprint  string
+	Query        string
+	Conns        int
+	BaselineRuns int
+
+	// QPS and latencies are medians of per-second measurements.
+	BaselineQPS     float64
+	CurrentQPS      float64
+	QPSPValue       float64
+	BaselineLatency time.Duration
+	CurrentLatency  time.Duration
+	LatencyPValue   float64
+
+	Verdict string
+}
+
+// seriesSamples holds per-second measurements of a single execution.
+type seriesSamples struct {
+	qps     []float64
+	latency []float64
+}
+
+func loadSeriesSamples(info QueryExecInfo) (seriesSamples, bool) {
+	raw, ok := info.Info.(json.RawMessage)
+	if !ok {
+		return seriesSamples{}, false
+	}
+
+	var stats struct {
+		Series []SeriesPoint
+	}
+	if err := json.Unmarshal(raw, &stats); err != nil {
+		return seriesSamples{}, false
+	}
+
+	// first and last seconds are usually incomplete
+	if len(stats.Series) < 3 {
+		return seriesSamples{}, false
+	}
+	points := stats.Series[1 : len(stats.Series)-1]
+
+	var res seriesSamples
+	for _, p := range points {
+		res.qps = append(res.qps, p.QPS())
+		if p.Count > 0 {
+			res.latency = append(res.latency, float64(p.Avg()))
+		}
+	}
+	return res, true
+}
+
+// DetectRegressions groups successful executions by query fingerprint and concurrency and
+// compares the per-second measurements of the latest execution against all previous ones
+// using Mann-Whitney U test. Infos must be ordered by creation time.
+func DetectRegressions(infos []QueryExecInfo) []Regression {
+	type groupKey struct {
+		fingerprint string
+		conns       int
+	}
+	type group struct {
+		query string
+		runs  []seriesSamples
+	}
+
+	groups := map[groupKey]*group{}
+	var keys []groupKey
+	for _, info := range infos {
+		if info.IsFailed || info.Comment != "ok" {
+			continue
+		}
+		samples, ok := loadSeriesSamples(info)
+		if !ok {
+			continue
+		}
+
+		key := groupKey{QueryFingerprint(info.Query), info.Conns}
+		g, ok := groups[key]
+		if !ok {
+			g = &group{query: info.Query}
+			groups[key] = g
+			keys = append(keys, key)
+		}
+		g.runs = append(g.runs, samples)
+	}
+
+	var res []Regression
+	for _, key := range keys {
+		g := groups[key]
+		if len(g.runs) < 2 {
+			continue
+		}
+
+		current := g.runs[len(g.runs)-1]
+		var baseline seriesSamples
+		for _, run := range g.runs[:len(g.runs)-1] {
+			baseline.qps = append(baseline.qps, run.qps...)
+			baseline.latency = append(baseline.latency, run.latency...)
+		}
+
+		r := Regression{
+			Fingerprint:     key.fingerprint,
+			Query:           g.query,
+			Conns:           key.conns,
+			BaselineRuns:    len(g.runs) - 1,
+			BaselineQPS:     stat.Median(baseline.qps),
+			CurrentQPS:      stat.Median(current.qps),
+			QPSPValue:       stat.MannWhitney(baseline.qps, current.qps),
+			BaselineLatency: time.Duration(stat.Median(baseline.latency)),
+			CurrentLatency:  time.Duration(stat.Median(current.latency)),
+			LatencyPValue:   stat.MannWhitney(baseline.latency, current.latency),
+		}
+		r.Verdict = r.verdict()
+		res = append(res, r)
+	}
+
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].Verdict == VerdictRegression && res[j].Verdict != VerdictRegression
+	})
+	return res
+}
+
+func (r *Regression) verdict() string {
+	qpsSignificant := r.QPSPValue < regressionAlpha
+	latencySignificant := r.LatencyPValue < regressionAlpha
+
+	switch {
+	case qpsSignificant && r.CurrentQPS < r.BaselineQPS*(1-regressionMinChange):
+		return VerdictRegression
+	case latencySignificant && float64(r.CurrentLatency) > float64(r.BaselineLatency)*(1+regressionMinChange):
+		return VerdictRegression
+	case qpsSignificant && r.CurrentQPS > r.BaselineQPS*(1+regressionMinChange):
+		return VerdictImprovement
+	case latencySignificant && float64(r.CurrentLatency) < float64(r.BaselineLatency)*(1-regressionMinChange):
+		return VerdictImprovement
+	default:
+		return VerdictNoChange
+	}
+}
+
+// PrintRegressions writes a human-readable table of regressions.
+func PrintRegressions(w io.Writer, regressions []Regression) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "VERDICT\tFINGERPRINT\tCONNS\tRUNS\tQPS\tQPS P\tLATENCY\tLATENCY P\tQUERY")
+	for _, r := range regressions {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%.1f -> %.1f\t%.3f\t%v -> %v\t%.3f\t%s\n",
+			r.Verdict, r.Fingerprint, r.Conns, r.BaselineRuns,
+			r.BaselineQPS, r.CurrentQPS, r.QPSPValue,
+			r.BaselineLatency.Round(time.Microsecond), r.CurrentLatency.Round(time.Microsecond), r.LatencyPValue,
+			truncateQuery(r.Query, 60),
+		)
+	}
+	return tw.Flush()
+}
+
+// truncateQuery returns the query on a single line, limited to n characters.
+func truncateQuery(sql string, n int) string {
+	sql = strings.Join(strings.Fields(sql), " ")
+	if len(sql) > n {
+		return sql[:n-3] + "..."
+	}
+	return sql
+}
@@ -0,0 +1,103 @@
+package autoai
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	// usefulThroughputRatio is the fraction of the max throughput that is still considered
+	// saturated, adding connections after reaching it doesn't improve throughput much.
+	usefulThroughputRatio = 0.9
+	// latencyDegradationRatio is how many times the latency should grow compared to
+	// the lowest concurrency to be considered degraded.
+	latencyDegradationRatio = 2.0
+)
+
+// RampPoint is the throughput and latency measured at a single concurrency level.
+type RampPoint struct {
+	Conns   int
+	QPS     float64
+	Latency time.Duration
+	// ErrorRate is the fraction of executions that failed with an error, FailedConns is
+	// the number of connections that saw at least one error.
+	ErrorRate   float64
+	FailedConns int
+	// Timeouts is the number of executions canceled by the statement timeout, TimeoutRate
+	// is their fraction of all executions.
+	Timeouts    int
+	TimeoutRate float64
+}
+
+// Saturation describes the point where adding more connections stops being useful.
+type Saturation struct {
+	// MaxQPS is the max throughput observed at any concurrency.
+	MaxQPS float64
+	// MaxUsefulConns is the lowest concurrency reaching 90% of MaxQPS.
+	MaxUsefulConns int
+	// LatencyKneeConns is the lowest concurrency where latency doubled compared
+	// to the lowest concurrency, or zero if latency never degraded.
+	LatencyKneeConns int
+	// FirstTimeoutConns is the lowest concurrency where executions hit the statement timeout,
+	// or zero if none did. Timeout rates of every level are in Points.
+	FirstTimeoutConns int
+	Points            []RampPoint
+}
+
+// detectSaturation finds the saturation point from measurements at different concurrency levels.
+func detectSaturation(points []RampPoint) Saturation {
+	points = append([]RampPoint(nil), points...)
+	sort.SliceStable(points, func(i, j int) bool {
+		return points[i].Conns < points[j].Conns
+	})
+
+	sat := Saturation{Points: points}
+	if len(points) == 0 {
+		return sat
+	}
+
+	for _, p := range points {
+		sat.MaxQPS = max(sat.MaxQPS, p.QPS)
+	}
+
+	for _, p := range points {
+		if p.QPS >= sat.MaxQPS*usefulThroughputRatio {
+			sat.MaxUsefulConns = p.Conns
+			break
+		}
+	}
+
+	for _, p := range points {
+		if p.Timeouts > 0 {
+			sat.FirstTimeoutConns = p.Conns
+			break
+		}
+	}
+
+	baseline := points[0].Latency
+	for _, p := range points[1:] {
+		if baseline > 0 && float64(p.Latency) > float64(baseline)*latencyDegradationRatio {
+			sat.LatencyKneeConns = p.Conns
+			break
+		}
+	}
+
+	return sat
+}
+
+// ToExecInfo converts saturation to a history record.
+func (s *Saturation) ToExecInfo(query string) *QueryExecInfo {
+	comment := "saturation"
+	if s.FirstTimeoutConns > 0 {
+		comment = fmt.Sprintf("saturation, timeouts from %d conns", s.FirstTimeoutConns)
+	}
+	return &QueryExecInfo{
+		Query:    query,
+		IsFailed: s.MaxQPS == 0,
+		QPS:      float32(s.MaxQPS),
+		Conns:    s.MaxUsefulConns,
+		Comment:  comment,
+		Info:     s,
+	}
+}
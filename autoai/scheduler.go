@@ -0,0 +1,475 @@
+package autoai
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/petuhovskiy/overload/internal/dbconn"
+	"github.com/petuhovskiy/overload/internal/log"
+	"github.com/petuhovskiy/overload/internal/metrics"
+	"github.com/petuhovskiy/overload/internal/multi"
+	"github.com/petuhovskiy/overload/internal/reconnect"
+	"go.uber.org/zap"
+)
+
+// mixBucket is the resolution of the sliding window of the mix scheduler.
+const mixBucket = time.Second
+
+// mixClass is a group of queries sharing a target share of the mix.
+type mixClass struct {
+	name    string
+	target  float64
+	queries []int
+	weights []float64
+}
+
+// mixClassName returns the mix class of the query: its class comment, or the statement
+// keyword, e.g. select or update.
+func mixClassName(q Query) string {
+	if q.Class != "" {
+		return q.Class
+	}
+	if len(q.Script) > 0 {
+		return "transaction"
+	}
+	fields := strings.Fields(statementKeyword(q.SQL))
+	if len(fields) == 0 {
+		return "other"
+	}
+	return strings.ToLower(fields[0])
+}
+
+// mixScheduler picks the query of every execution, so that the share of executions of every
+// class over the sliding window stays close to its target, regardless of how fast
+// the queries of each class are, or how often they fail. It's safe for concurrent use.
+type mixScheduler struct {
+	classes []mixClass
+	broken  func(query int) bool
+	// seeded picks classes randomly by their targets with the generator of the worker,
+	// so that every worker executes a deterministic sequence, the window only tracks shares
+	seeded bool
+
+	mu sync.Mutex
+	// counts are executions started by every class in every bucket of the window,
+	// the last bucket is the current one
+	counts     [][]int
+	bucketTime time.Time
+	// started and succeeded are totals of the current step
+	started   []int64
+	succeeded []int64
+	shares    []*metrics.Gauge
+}
+
+func newMixScheduler(queries []Query, window time.Duration, broken func(query int) bool) *mixScheduler {
+	s := &mixScheduler{broken: broken}
+	byName := map[string]int{}
+	var total float64
+	for i, q := range queries {
+		name := mixClassName(q)
+		idx, ok := byName[name]
+		if !ok {
+			idx = len(s.classes)
+			byName[name] = idx
+			s.classes = append(s.classes, mixClass{name: name})
+		}
+		c := &s.classes[idx]
+		c.queries = append(c.queries, i)
+		c.weights = append(c.weights, queryWeight(q))
+		c.target += queryWeight(q)
+		total += queryWeight(q)
+	}
+
+	buckets := max(1, int(window/mixBucket))
+	s.counts = make([][]int, len(s.classes))
+	for i := range s.classes {
+		s.classes[i].target /= total
+		s.counts[i] = make([]int, buckets)
+		s.shares = append(s.shares, metrics.Default.Gauge("mix_window_share", "class", s.classes[i].name))
+	}
+	s.started = make([]int64, len(s.classes))
+	s.succeeded = make([]int64, len(s.classes))
+	return s
+}
+
+// next returns the query to execute and its class, or false if all queries are broken.
+func (s *mixScheduler) next(now time.Time, r *rand.Rand) (query, class int, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.advance(now)
+
+	window := make([]int, len(s.classes))
+	var total int
+	for c := range s.classes {
+		for _, n := range s.counts[c] {
+			window[c] += n
+		}
+		total += window[c]
+	}
+
+	class = -1
+	if s.seeded {
+		class = s.pickClass(r)
+	} else {
+		// the class lagging behind its target the most goes next
+		var bestDeficit float64
+		for c := range s.classes {
+			if !s.available(c) {
+				continue
+			}
+			deficit := s.classes[c].target*float64(total+1) - float64(window[c])
+			if class == -1 || deficit > bestDeficit {
+				class, bestDeficit = c, deficit
+			}
+		}
+	}
+	if class == -1 {
+		return 0, 0, false
+	}
+
+	s.counts[class][len(s.counts[class])-1]++
+	s.started[class]++
+	return s.pickQuery(class, r), class, true
+}
+
+// available returns true if the class has queries that are not broken.
+func (s *mixScheduler) available(class int) bool {
+	for _, q := range s.classes[class].queries {
+		if !s.broken(q) {
+			return true
+		}
+	}
+	return false
+}
+
+// pickClass picks an available class randomly, proportionally to class targets,
+// or returns -1 if all classes are broken.
+func (s *mixScheduler) pickClass(r *rand.Rand) int {
+	var total float64
+	for c := range s.classes {
+		if s.available(c) {
+			total += s.classes[c].target
+		}
+	}
+	x := r.Float64() * total
+	pick := -1
+	for c := range s.classes {
+		if !s.available(c) {
+			continue
+		}
+		pick = c
+		x -= s.classes[c].target
+		if x < 0 {
+			break
+		}
+	}
+	return pick
+}
+
+// pickQuery picks a query of the class randomly, proportionally to query weights.
+func (s *mixScheduler) pickQuery(class int, r *rand.Rand) int {
+	c := &s.classes[class]
+	var total float64
+	for i, q := range c.queries {
+		if !s.broken(q) {
+			total += c.weights[i]
+		}
+	}
+	x := r.Float64() * total
+	pick := -1
+	for i, q := range c.queries {
+		if s.broken(q) {
+			continue
+		}
+		pick = q
+		x -= c.weights[i]
+		if x < 0 {
+			break
+		}
+	}
+	return pick
+}
+
+// advance shifts the window to the bucket of now, exporting window shares on every shift.
+func (s *mixScheduler) advance(now time.Time) {
+	bucket := now.Truncate(mixBucket)
+	if s.bucketTime.IsZero() {
+		s.bucketTime = bucket
+		return
+	}
+	shift := int(bucket.Sub(s.bucketTime) / mixBucket)
+	if shift <= 0 {
+		return
+	}
+	s.bucketTime = bucket
+	s.exportShares()
+
+	for c := range s.counts {
+		counts := s.counts[c]
+		if shift >= len(counts) {
+			clear(counts)
+			continue
+		}
+		copy(counts, counts[shift:])
+		clear(counts[len(counts)-shift:])
+	}
+}
+
+func (s *mixScheduler) exportShares() {
+	var total int
+	sums := make([]int, len(s.classes))
+	for c := range s.classes {
+		for _, n := range s.counts[c] {
+			sums[c] += n
+		}
+		total += sums[c]
+	}
+	if total == 0 {
+		return
+	}
+	for c := range s.classes {
+		s.shares[c].Set(float64(sums[c]) / float64(total))
+	}
+}
+
+// done records the outcome of an execution of the class.
+func (s *mixScheduler) done(class int, err error) {
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.succeeded[class]++
+}
+
+// report returns achieved shares of the step and resets step totals.
+func (s *mixScheduler) report() []MixShare {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var started, succeeded int64
+	for c := range s.classes {
+		started += s.started[c]
+		succeeded += s.succeeded[c]
+	}
+	res := make([]MixShare, len(s.classes))
+	for c, class := range s.classes {
+		res[c] = MixShare{
+			Class:      class.name,
+			Target:     class.target,
+			Executions: s.started[c],
+			Succeeded:  s.succeeded[c],
+		}
+		if started > 0 {
+			res[c].Achieved = float64(s.started[c]) / float64(started)
+		}
+		if succeeded > 0 {
+			res[c].AchievedSucceeded = float64(s.succeeded[c]) / float64(succeeded)
+		}
+	}
+	clear(s.started)
+	clear(s.succeeded)
+	return res
+}
+
+// MixShare is the target and achieved share of a mix class within a step.
+type MixShare struct {
+	Class  string
+	Target float64
+	// Achieved is the share of started executions, AchievedSucceeded is the share of successful ones.
+	Achieved          float64
+	AchievedSucceeded float64
+	Executions        int64
+	Succeeded         int64
+}
+
+// MixReport is the statement mix achieved by the scheduler within a step.
+type MixReport struct {
+	Conns  int
+	Shares []MixShare
+}
+
+// ToExecInfo converts the report to a history record.
+func (r *MixReport) ToExecInfo() *QueryExecInfo {
+	var executions int64
+	for _, s := range r.Shares {
+		executions += s.Executions
+	}
+	return &QueryExecInfo{
+		Query:    "statement mix",
+		IsFailed: executions == 0,
+		Conns:    r.Conns,
+		Comment:  "mix schedule",
+		Info:     r,
+	}
+}
+
+// PrintMixReport writes target and achieved shares of every class as a table.
+func PrintMixReport(w io.Writer, r MixReport) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "CLASS\tTARGET\tACHIEVED\tSUCCEEDED\tEXECUTIONS")
+	for _, s := range r.Shares {
+		fmt.Fprintf(tw, "%s\t%.1f%%\t%.1f%%\t%.1f%%\t%d\n",
+			s.Class, s.Target*100, s.Achieved*100, s.AchievedSucceeded*100, s.Executions)
+	}
+	return tw.Flush()
+}
+
+// mixQueryStats aggregates executions of a single query by all connections of a step.
+type mixQueryStats struct {
+	mu     sync.Mutex
+	stats  ExecStats
+	sum    time.Duration
+	series seriesRecorder
+}
+
+func (m *mixQueryStats) record(finished time.Time, elapsed time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err != nil {
+		m.stats.recordError(err)
+		return
+	}
+	m.series.record(finished, elapsed)
+	if m.stats.Count == 0 {
+		m.stats.Min = elapsed
+	}
+	m.stats.Count++
+	m.stats.Min = min(m.stats.Min, elapsed)
+	m.stats.Max = max(m.stats.Max, elapsed)
+	m.stats.recordLatency(elapsed)
+	m.sum += elapsed
+}
+
+func (m *mixQueryStats) result() ExecStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats := m.stats
+	if stats.Count > 0 {
+		stats.Avg = m.sum / time.Duration(stats.Count)
+	}
+	stats.fillPercentiles()
+	stats.Series = m.series.points
+	return stats
+}
+
+// runScheduledMix executes the query mix like RunMix, but every connection runs queries picked
+// by the mix scheduler instead of a single assigned query.
+func (l *Launcher) runScheduledMix(ctx context.Context, connstr string, queries []Query) {
+	opts := make([]execOptions, len(queries))
+	for i, query := range queries {
+		opts[i] = l.execOptions(query)
+	}
+	sched := newMixScheduler(queries, l.conf.MixWindow, func(query int) bool {
+		return opts[query].breaker.isBroken()
+	})
+	sched.seeded = l.conf.Seed != 0
+
+	for iter := 0; iter < l.conf.RampIterations; iter++ {
+		n := max(l.rampConns(iter), len(queries))
+		log.Info(ctx, "running scheduled query mix", zap.Int("conns", n))
+
+		for i := range opts {
+			opts[i].breaker = opts[i].breaker.reset()
+		}
+		stats := make([]mixQueryStats, len(queries))
+		neonDone := l.neonStep(ctx, connstr)
+		multi.RunManyIndexed(ctx, n, func(ctx context.Context, worker int) error {
+			return l.runScheduledConn(ctx, connstr, queries, opts, sched, stats, worker)
+		})
+
+		for i, query := range queries {
+			st := stats[i].result()
+			st.Broken = opts[i].breaker.isBroken()
+			go l.db.SaveQueryExecInfo(st.ToExecInfo(query.SQL, n))
+			log.Info(ctx, "query execution statistics", zap.String("query", query.SQL), zap.Any("stats", st))
+		}
+
+		report := MixReport{Conns: n, Shares: sched.report()}
+		go l.db.SaveQueryExecInfo(report.ToExecInfo())
+		log.Info(ctx, "statement mix of the step", zap.Any("mix", report.Shares))
+
+		var mixStats ExecStats
+		neonDone(&mixStats)
+		if mixStats.Neon != nil {
+			log.Info(ctx, "neon metrics of the mix step", zap.Any("neon", mixStats.Neon))
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// runScheduledConn executes queries picked by the scheduler on a single connection for a step.
+func (l *Launcher) runScheduledConn(ctx context.Context, connstr string, queries []Query, opts []execOptions, sched *mixScheduler, stats []mixQueryStats, worker int) error {
+	// session parameters are the same for all queries, except for application_name
+	base := opts[0]
+	base.appName = appNamePrefix() + "mix"
+	config, err := base.connConfig(connstr)
+	if err != nil {
+		return err
+	}
+	time.Sleep(time.Duration(rand.IntN(1000)) * time.Millisecond)
+
+	connect := func(ctx context.Context) (*pgx.Conn, error) {
+		return dbconn.ConnectConfig(ctx, config)
+	}
+	conn, err := reconnect.Connect(ctx, base.reconnect, "launcher", connect)
+	if err != nil {
+		return err
+	}
+	// the connection is replaced if it's lost in the middle of the step
+	defer func() {
+		if conn != nil {
+			conn.Close(context.Background())
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, base.duration)
+	defer cancel()
+
+	works := make([]*workload, len(queries))
+	rng := base.workerRand(worker)
+	for ctx.Err() == nil {
+		q, class, ok := sched.next(time.Now(), rng)
+		if !ok {
+			return nil
+		}
+		if works[q] == nil {
+			works[q] = newWorkload(queries[q], opts[q])
+		}
+
+		start := time.Now()
+		_, err := works[q].exec(ctx, conn, rng)
+		finished := time.Now()
+		if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+			return nil
+		}
+		sched.done(class, err)
+		stats[q].record(finished, finished.Sub(start), err)
+		if err != nil {
+			opts[q].metrics.record(0, err)
+			opts[q].breaker.record(true)
+			if conn.IsClosed() {
+				if conn, err = reconnect.Connect(ctx, base.reconnect, "launcher", connect); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		opts[q].breaker.record(false)
+		opts[q].metrics.record(finished.Sub(start), nil)
+
+		if !opts[q].think(ctx) {
+			return nil
+		}
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package autoai
+
+import "context"
+
+// historySchema creates all history tables. It's safe to apply it multiple times,
+// columns added after the table was introduced are added with ALTER TABLE.
+//
+// All tables have timestamp columns, run_id and plain numeric columns, so they can be
+// queried by Grafana's Postgres datasource without digging into JSON.
+const historySchema = `
+CREATE TABLE IF NOT EXISTS runs (
+    id SERIAL PRIMARY KEY,
+    started_at TIMESTAMPTZ DEFAULT now(),
+    labels JSONB NOT NULL DEFAULT '{}',  -- arbitrary user labels, e.g. {"branch": "pg17"}
+    metadata JSONB                       -- information about the environment of the run
+);
+CREATE INDEX IF NOT EXISTS runs_labels_idx ON runs USING GIN (labels);
+ALTER TABLE runs ADD COLUMN IF NOT EXISTS server_version TEXT;
+-- identifies runs of the same queries and configuration, see WorkloadFingerprint
+ALTER TABLE runs ADD COLUMN IF NOT EXISTS workload_fingerprint TEXT;
+CREATE INDEX IF NOT EXISTS runs_workload_fingerprint_idx ON runs (workload_fingerprint);
+-- identifies the target database of tracked objects, cleanup refuses to run against another one
+ALTER TABLE runs ADD COLUMN IF NOT EXISTS target_system_id TEXT;
+ALTER TABLE runs ADD COLUMN IF NOT EXISTS target_database TEXT;
+
+CREATE TABLE IF NOT EXISTS generated_queries (
+    id SERIAL PRIMARY KEY,
+    prompt TEXT NOT NULL,         -- what you asked the API
+    generated_sql TEXT NOT NULL,  -- the SQL query returned by OpenAI
+    created_at TIMESTAMPTZ DEFAULT NOW(),  -- timestamp of when it was saved
+    model_used TEXT               -- optional: which OpenAI model was used
+);
+ALTER TABLE generated_queries ADD COLUMN IF NOT EXISTS run_id INT REFERENCES runs(id);
+-- 'simple' configuration keeps SQL keywords and identifiers as is, without stemming and stop words
+ALTER TABLE generated_queries ADD COLUMN IF NOT EXISTS search tsvector
+    GENERATED ALWAYS AS (to_tsvector('simple', generated_sql || ' ' || prompt)) STORED;
+CREATE INDEX IF NOT EXISTS generated_queries_search_idx ON generated_queries USING GIN (search);
+
+CREATE TABLE IF NOT EXISTS query_exec_info (
+    id SERIAL PRIMARY KEY,
+    query TEXT,
+    created_at TIMESTAMPTZ DEFAULT now(),
+    is_failed BOOLEAN,
+    qps REAL,
+    conns INT,
+    comment TEXT,
+    info JSONB
+);
+ALTER TABLE query_exec_info ADD COLUMN IF NOT EXISTS run_id INT REFERENCES runs(id);
+ALTER TABLE query_exec_info ADD COLUMN IF NOT EXISTS fingerprint TEXT;
+ALTER TABLE query_exec_info ADD COLUMN IF NOT EXISTS avg_latency_ms DOUBLE PRECISION;
+ALTER TABLE query_exec_info ADD COLUMN IF NOT EXISTS p99_latency_ms DOUBLE PRECISION;
+ALTER TABLE query_exec_info ADD COLUMN IF NOT EXISTS exec_count BIGINT;
+ALTER TABLE query_exec_info ADD COLUMN IF NOT EXISTS error_count BIGINT;
+-- the most frequent SQLSTATE of failed executions, all codes are in info->'ErrorCodes'
+ALTER TABLE query_exec_info ADD COLUMN IF NOT EXISTS top_error_code TEXT;
+CREATE INDEX IF NOT EXISTS query_exec_info_created_at_idx ON query_exec_info (created_at);
+CREATE INDEX IF NOT EXISTS query_exec_info_run_id_idx ON query_exec_info (run_id);
+
+-- per-second measurements of every execution step
+CREATE TABLE IF NOT EXISTS query_exec_series (
+    time TIMESTAMPTZ NOT NULL,
+    run_id INT REFERENCES runs(id),
+    exec_id INT REFERENCES query_exec_info(id),
+    fingerprint TEXT,
+    conns INT,
+    qps DOUBLE PRECISION,
+    avg_latency_ms DOUBLE PRECISION,
+    max_latency_ms DOUBLE PRECISION
+);
+CREATE INDEX IF NOT EXISTS query_exec_series_time_idx ON query_exec_series (time);
+
+-- every single execution of audited runs, daily partitions are created when rows are written
+CREATE TABLE IF NOT EXISTS query_exec_log (
+    start_time TIMESTAMPTZ NOT NULL,
+    run_id INT,
+    fingerprint TEXT,
+    conn BIGINT,          -- backend PID of the connection
+    duration_ms DOUBLE PRECISION,
+    sqlstate TEXT         -- NULL for successful executions
+) PARTITION BY RANGE (start_time);
+CREATE INDEX IF NOT EXISTS query_exec_log_run_id_idx ON query_exec_log (run_id, start_time);
+
+-- generated queries which failed or timed out, quarantined ones are not executed again
+CREATE TABLE IF NOT EXISTS query_quarantine (
+    fingerprint TEXT PRIMARY KEY,
+    query TEXT NOT NULL,
+    failures INT NOT NULL DEFAULT 1,
+    reason TEXT,          -- cause of the last failure
+    run_id INT REFERENCES runs(id),
+    first_failed_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    last_failed_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- schema objects created in the target database by runs, dropped by the cleanup command
+CREATE TABLE IF NOT EXISTS run_objects (
+    run_id INT NOT NULL REFERENCES runs(id),
+    kind TEXT NOT NULL,   -- schema, table, index, view, materialized view or sequence
+    schema_name TEXT NOT NULL,
+    name TEXT NOT NULL,   -- empty for schemas
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),  -- when the object was found
+    dropped_at TIMESTAMPTZ,
+    PRIMARY KEY (run_id, kind, schema_name, name)
+);
+-- objects which may have been created by sessions outside the run are not verified,
+-- cleanup skips them unless asked explicitly
+ALTER TABLE run_objects ADD COLUMN IF NOT EXISTS verified BOOLEAN NOT NULL DEFAULT false;
+
+-- latency objectives of workload phases evaluated at the end of every phase
+CREATE TABLE IF NOT EXISTS sla_results (
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    run_id INT REFERENCES runs(id),
+    phase TEXT NOT NULL,  -- name of the plan step
+    sla TEXT NOT NULL,
+    percentile DOUBLE PRECISION NOT NULL,
+    max_latency_ms DOUBLE PRECISION NOT NULL,
+    latency_ms DOUBLE PRECISION NOT NULL,
+    executions BIGINT NOT NULL,
+    passed BOOLEAN NOT NULL
+);
+CREATE INDEX IF NOT EXISTS sla_results_created_at_idx ON sla_results (created_at);
+
+CREATE TABLE IF NOT EXISTS alerts (
+    id SERIAL PRIMARY KEY,
+    created_at TIMESTAMPTZ DEFAULT now(),
+    source TEXT,
+    metric TEXT,
+    value DOUBLE PRECISION,
+    threshold DOUBLE PRECISION
+);
+ALTER TABLE alerts ADD COLUMN IF NOT EXISTS run_id INT REFERENCES runs(id);
+
+-- cost and outcome of every iteration of the generation loop
+CREATE TABLE IF NOT EXISTS iteration_scorecards (
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    run_id INT REFERENCES runs(id),
+    iteration INT NOT NULL,
+    target TEXT,                  -- empty without multiple targets
+    prompt_tokens INT NOT NULL,
+    completion_tokens INT NOT NULL,
+    generated INT NOT NULL,       -- queries returned by the model
+    succeeded INT NOT NULL,       -- queries executed successfully at least once
+    peak_qps DOUBLE PRECISION NOT NULL,
+    new_failure_modes TEXT[] NOT NULL  -- SQLSTATE codes, "client" and "timeout" not seen before in the run
+);
+CREATE INDEX IF NOT EXISTS iteration_scorecards_run_id_idx ON iteration_scorecards (run_id);
+`
+
+// Migrate creates missing history tables and columns.
+func (d *DBHistory) Migrate() error {
+	_, err := d.db.Exec(context.Background(), historySchema)
+	return err
+}
@@ -0,0 +1,112 @@
+package autoai
+
+import (
+	"context"
+	"slices"
+	"sort"
+
+	"github.com/petuhovskiy/overload/errs"
+	"github.com/petuhovskiy/overload/internal/log"
+	"github.com/petuhovskiy/overload/internal/metrics"
+	"go.uber.org/zap"
+)
+
+// Scorecard is the cost and the outcome of a single iteration of the generation loop.
+type Scorecard struct {
+	Iteration        int
+	Target           string
+	PromptTokens     int
+	CompletionTokens int
+	// Generated is the number of queries returned by the model, Succeeded is the number
+	// of them executed successfully at least once. Quarantined queries are not executed.
+	Generated int
+	Succeeded int
+	// PeakQPS is the max throughput reached by any query of the iteration.
+	PeakQPS float64
+	// NewFailureModes are SQLSTATE codes, "client" errors and "timeout" of never finished
+	// queries, which weren't seen in the previous iterations of the run.
+	NewFailureModes []string
+}
+
+// failureModes returns the kinds of failures of the query execution.
+func failureModes(stats ExecStats) []string {
+	var modes []string
+	for code := range stats.ErrorCodes {
+		modes = append(modes, code)
+	}
+	if stats.Error != nil {
+		modes = append(modes, errs.Code(stats.Error))
+	}
+	if stats.Count == 0 && stats.Error == nil {
+		modes = append(modes, "timeout")
+	}
+	return modes
+}
+
+// scoreIteration builds the scorecard of the finished iteration from the stats of its queries,
+// remembering failure modes for the next iterations.
+func (g *Generator) scoreIteration(generated int, allStats []ExecStats) Scorecard {
+	g.iteration++
+	card := Scorecard{
+		Iteration:        g.iteration,
+		Target:           g.current.Name,
+		PromptTokens:     g.usage.PromptTokens,
+		CompletionTokens: g.usage.CompletionTokens,
+		Generated:        generated,
+	}
+	if g.failureModes == nil {
+		g.failureModes = map[string]bool{}
+	}
+	for _, stats := range allStats {
+		if stats.Count > 0 {
+			card.Succeeded++
+		}
+		card.PeakQPS = max(card.PeakQPS, stats.PeakQPS)
+		for _, mode := range failureModes(stats) {
+			if !g.failureModes[mode] && !slices.Contains(card.NewFailureModes, mode) {
+				card.NewFailureModes = append(card.NewFailureModes, mode)
+			}
+		}
+	}
+	for _, mode := range card.NewFailureModes {
+		g.failureModes[mode] = true
+	}
+	sort.Strings(card.NewFailureModes)
+	return card
+}
+
+// reportScorecard logs the scorecard, exports token usage and saves the scorecard to the history.
+func (g *Generator) reportScorecard(ctx context.Context, card Scorecard) {
+	metrics.Default.Counter("autoai_tokens_total", "kind", "prompt").Add(int64(card.PromptTokens))
+	metrics.Default.Counter("autoai_tokens_total", "kind", "completion").Add(int64(card.CompletionTokens))
+	metrics.Default.Counter("autoai_generated_queries_total").Add(int64(card.Generated))
+	metrics.Default.Counter("autoai_succeeded_queries_total").Add(int64(card.Succeeded))
+
+	log.Info(ctx, "iteration scorecard",
+		zap.Int("iteration", card.Iteration),
+		zap.Int("prompt_tokens", card.PromptTokens),
+		zap.Int("completion_tokens", card.CompletionTokens),
+		zap.Int("generated", card.Generated),
+		zap.Int("succeeded", card.Succeeded),
+		zap.Float64("peak_qps", card.PeakQPS),
+		zap.Strings("new_failure_modes", card.NewFailureModes),
+	)
+	if err := g.history.SaveScorecard(card); err != nil {
+		log.Warn(ctx, "failed to save iteration scorecard", zap.Error(err))
+	}
+}
+
+// SaveScorecard saves the scorecard of a generation iteration.
+func (d *DBHistory) SaveScorecard(card Scorecard) error {
+	modes := card.NewFailureModes
+	if modes == nil {
+		modes = []string{}
+	}
+	_, err := d.db.Exec(context.Background(), `
+		INSERT INTO iteration_scorecards (run_id, iteration, target, prompt_tokens, completion_tokens,
+			generated, succeeded, peak_qps, new_failure_modes)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		d.runIDArg(), card.Iteration, card.Target, card.PromptTokens, card.CompletionTokens,
+		card.Generated, card.Succeeded, card.PeakQPS, modes)
+	return err
+}
@@ -0,0 +1,385 @@
+package autoai
+
+import (
+	"context"
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/petuhovskiy/overload/internal/capture"
+	"github.com/petuhovskiy/overload/internal/compat"
+	"github.com/petuhovskiy/overload/internal/pgbenchlog"
+	"github.com/petuhovskiy/overload/internal/pgversion"
+)
+
+// execer is a connection that can execute queries, either a single connection or a pooled one.
+type execer interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+}
+
+// execResult describes the result set of a single execution, it's filled only for row-returning queries.
+type execResult struct {
+	firstRow time.Duration
+	rows     int64
+	bytes    int64
+}
+
+// StatementStats holds latency of a single statement of a transaction script.
+type StatementStats struct {
+	SQL      string
+	Count    int
+	Avg, Max time.Duration
+}
+
+// workload executes a query or a transaction script, binding params on every execution.
+type workload struct {
+	query Query
+	stmts []boundQuery
+	// sleeps are client-side pauses of the script by statement index, nil for SQL statements
+	sleeps []*sleepStep
+	// returnsRows is set for queries executed with Query to consume the result set.
+	returnsRows bool
+	recorder    *capture.Recorder
+	audit       *AuditLog
+	pgbenchLog  *pgbenchlog.Writer
+	fingerprint string
+	// retries is the configured number of retries of serialization failures, see compat.SerializationRetries.
+	retries     int
+	maxRetries  int
+	retriesOnce sync.Once
+	retried     atomic.Int64
+	// twoPhase is set if transactions are committed with 2PC
+	twoPhase *twoPhase
+
+	mu        sync.Mutex
+	stmtStats []StatementStats
+	stmtSums  []time.Duration
+}
+
+func newWorkload(query Query, opts execOptions) *workload {
+	w := &workload{
+		query:       query,
+		recorder:    opts.recorder,
+		audit:       opts.audit,
+		pgbenchLog:  opts.pgbenchLog,
+		fingerprint: QueryFingerprint(query.SQL),
+		retries:     opts.serializationRetries,
+		twoPhase:    opts.twoPhase,
+	}
+	if len(query.Script) == 0 {
+		w.stmts = []boundQuery{bindQuery(query)}
+		w.returnsRows = isSelectStatement(query.SQL)
+		return w
+	}
+
+	w.sleeps = make([]*sleepStep, len(query.Script))
+	for i, stmt := range query.Script {
+		w.stmts = append(w.stmts, bindSQL(stmt, query.Params))
+		if isSleepStatement(stmt) {
+			// scripts are validated when parsed
+			w.sleeps[i], _ = parseSleep(stmt)
+		}
+	}
+	if query.StatementLatency {
+		w.stmtStats = make([]StatementStats, len(query.Script))
+		w.stmtSums = make([]time.Duration, len(query.Script))
+		for i, stmt := range query.Script {
+			w.stmtStats[i].SQL = stmt
+		}
+	}
+	return w
+}
+
+// exec executes the query, retrying serialization failures with backoff if it's enabled for the engine.
+func (w *workload) exec(ctx context.Context, conn execer, r *rand.Rand) (execResult, error) {
+	w.retriesOnce.Do(func() {
+		w.maxRetries = compat.SerializationRetries(connVersion(conn), w.retries)
+	})
+
+	values := generateParams(w.query.Params, r)
+	start := time.Now()
+	for attempt := 0; ; attempt++ {
+		res, err := w.execOnce(ctx, conn, values, r)
+		retry := err != nil && attempt < w.maxRetries && compat.IsSerializationFailure(err)
+		if !retry || !compat.WaitSerializationRetry(ctx, attempt+1) {
+			elapsed := time.Since(start)
+			w.audit.record(start, elapsed, connPID(conn), w.fingerprint, err)
+			w.pgbenchLog.Record(connPID(conn), w.fingerprint, w.query.SQL, start, elapsed, err)
+			return res, err
+		}
+		w.retried.Add(1)
+	}
+}
+
+// execOnce executes the query once. A failed script is rolled back, so that the connection
+// can be used for the next execution.
+func (w *workload) execOnce(ctx context.Context, conn execer, values map[string]any, r *rand.Rand) (execResult, error) {
+	if w.twoPhase != nil {
+		return w.execTwoPhase(ctx, conn, values, r)
+	}
+	if len(w.query.Script) == 0 {
+		stmt := w.stmts[0]
+		args := stmt.argsFrom(values)
+		w.record(conn, stmt.sql, args)
+		if w.returnsRows {
+			return queryAndDrain(ctx, conn, stmt.sql, args...)
+		}
+		_, err := conn.Exec(ctx, stmt.sql, args...)
+		return execResult{}, err
+	}
+
+	for i, stmt := range w.stmts {
+		var err error
+		start := time.Now()
+		if sleep := w.sleeps[i]; sleep != nil {
+			err = sleep.sleep(ctx, r)
+		} else {
+			args := stmt.argsFrom(values)
+			w.record(conn, stmt.sql, args)
+			_, err = conn.Exec(ctx, stmt.sql, args...)
+		}
+		if err != nil {
+			if i > 0 {
+				w.record(conn, "ROLLBACK", nil)
+				_, _ = conn.Exec(context.Background(), "ROLLBACK")
+			}
+			return execResult{}, err
+		}
+		w.recordStatement(i, time.Since(start))
+	}
+	return execResult{}, nil
+}
+
+// execTwoPhase executes the query in a transaction committed with 2PC. COMMIT of a script
+// is replaced with PREPARE TRANSACTION, a single statement is wrapped into a transaction.
+func (w *workload) execTwoPhase(ctx context.Context, conn execer, values map[string]any, r *rand.Rand) (execResult, error) {
+	stmts := w.stmts
+	if len(w.query.Script) == 0 {
+		stmts = []boundQuery{{sql: "BEGIN"}, w.stmts[0], {sql: "COMMIT"}}
+	}
+
+	var res execResult
+	for i, stmt := range stmts {
+		var err error
+		switch {
+		case len(w.query.Script) > 0 && w.sleeps[i] != nil:
+			err = w.sleeps[i].sleep(ctx, r)
+		case isCommitStatement(stmt.sql):
+			w.record(conn, "PREPARE TRANSACTION", nil)
+			err = w.twoPhase.commit(ctx, conn)
+		case w.returnsRows && len(w.query.Script) == 0:
+			args := stmt.argsFrom(values)
+			w.record(conn, stmt.sql, args)
+			res, err = queryAndDrain(ctx, conn, stmt.sql, args...)
+		default:
+			args := stmt.argsFrom(values)
+			w.record(conn, stmt.sql, args)
+			start := time.Now()
+			_, err = conn.Exec(ctx, stmt.sql, args...)
+			if len(w.query.Script) > 0 {
+				w.recordStatement(i, time.Since(start))
+			}
+		}
+		if err != nil {
+			if i > 0 {
+				w.record(conn, "ROLLBACK", nil)
+				_, _ = conn.Exec(context.Background(), "ROLLBACK")
+			}
+			return execResult{}, err
+		}
+	}
+	return res, nil
+}
+
+// record writes the statement to the capture, if it's enabled.
+func (w *workload) record(conn execer, sql string, args []any) {
+	if w.recorder == nil {
+		return
+	}
+	if pgConn := connPgConn(conn); pgConn != nil {
+		w.recorder.Record(pgConn, sql, args)
+	}
+}
+
+// connPgConn returns the underlying connection, nil if it's unknown.
+func connPgConn(conn execer) *pgconn.PgConn {
+	switch c := conn.(type) {
+	case *pgx.Conn:
+		return c.PgConn()
+	case *pgxpool.Conn:
+		return c.Conn().PgConn()
+	}
+	return nil
+}
+
+// connPID returns the backend PID of the connection, used to identify connections in logs.
+func connPID(conn execer) uint32 {
+	if pgConn := connPgConn(conn); pgConn != nil {
+		return pgConn.PID()
+	}
+	return 0
+}
+
+// connVersion returns the server version of the connection.
+func connVersion(conn execer) pgversion.Version {
+	switch c := conn.(type) {
+	case *pgx.Conn:
+		return pgversion.FromConn(c)
+	case *pgxpool.Conn:
+		return pgversion.FromConn(c.Conn())
+	}
+	return pgversion.Version{}
+}
+
+// queryAndDrain executes the query and reads the whole result set, measuring
+// time to the first row and the size of the result.
+func queryAndDrain(ctx context.Context, conn execer, sql string, args ...any) (execResult, error) {
+	var res execResult
+	start := time.Now()
+	rows, err := conn.Query(ctx, sql, args...)
+	if err != nil {
+		return res, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if res.rows == 0 {
+			res.firstRow = time.Since(start)
+		}
+		res.rows++
+		for _, v := range rows.RawValues() {
+			res.bytes += int64(len(v))
+		}
+	}
+	if res.rows == 0 {
+		res.firstRow = time.Since(start)
+	}
+	return res, rows.Err()
+}
+
+// isSelectStatement returns true for statements returning a result set.
+func isSelectStatement(sql string) bool {
+	kw := statementKeyword(sql)
+	for _, prefix := range []string{"SELECT", "WITH", "VALUES", "TABLE", "SHOW", "EXPLAIN"} {
+		if kw == prefix || strings.HasPrefix(kw, prefix+" ") || strings.HasPrefix(kw, prefix+"(") {
+			return true
+		}
+	}
+	return false
+}
+
+// resultRecorder aggregates result set measurements of row-returning queries.
+type resultRecorder struct {
+	count    int
+	firstSum time.Duration
+	firstMax time.Duration
+	rows     int64
+	bytes    int64
+}
+
+func (r *resultRecorder) record(res execResult) {
+	r.count++
+	r.firstSum += res.firstRow
+	r.firstMax = max(r.firstMax, res.firstRow)
+	r.rows += res.rows
+	r.bytes += res.bytes
+}
+
+// fill sets result set fields of the stats, if any results were recorded.
+func (r *resultRecorder) fill(stats *ExecStats) {
+	if r.count == 0 {
+		return
+	}
+	stats.Result = &ResultStats{
+		FirstRowAvg: r.firstSum / time.Duration(r.count),
+		FirstRowMax: r.firstMax,
+		Rows:        r.rows,
+		Bytes:       r.bytes,
+		Executions:  r.count,
+	}
+}
+
+// ResultStats describes result sets of a SELECT query. Full execution latency in ExecStats
+// includes draining the result, FirstRowAvg shows how much of it is spent before the first row.
+type ResultStats struct {
+	FirstRowAvg time.Duration
+	FirstRowMax time.Duration
+	// Rows and Bytes are totals over all executions.
+	Rows       int64
+	Bytes      int64
+	Executions int
+}
+
+// mergeResultStats merges result set stats of several workers.
+func mergeResultStats(all ...*ResultStats) *ResultStats {
+	var res *ResultStats
+	for _, st := range all {
+		if st == nil || st.Executions == 0 {
+			continue
+		}
+		if res == nil {
+			res = &ResultStats{}
+		}
+		total := res.FirstRowAvg*time.Duration(res.Executions) + st.FirstRowAvg*time.Duration(st.Executions)
+		res.Executions += st.Executions
+		res.FirstRowAvg = total / time.Duration(res.Executions)
+		res.FirstRowMax = max(res.FirstRowMax, st.FirstRowMax)
+		res.Rows += st.Rows
+		res.Bytes += st.Bytes
+	}
+	return res
+}
+
+func (w *workload) recordStatement(i int, elapsed time.Duration) {
+	if w.stmtStats == nil {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	st := &w.stmtStats[i]
+	st.Count++
+	st.Max = max(st.Max, elapsed)
+	w.stmtSums[i] += elapsed
+	st.Avg = w.stmtSums[i] / time.Duration(st.Count)
+}
+
+// statementStats returns per-statement latency, or nil if it's not captured.
+func (w *workload) statementStats() []StatementStats {
+	if w.stmtStats == nil {
+		return nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]StatementStats(nil), w.stmtStats...)
+}
+
+// mergeStatementStats merges per-statement latency of several workers.
+func mergeStatementStats(all ...[]StatementStats) []StatementStats {
+	var res []StatementStats
+	for _, stats := range all {
+		if res == nil && stats != nil {
+			res = make([]StatementStats, len(stats))
+			for i := range stats {
+				res[i].SQL = stats[i].SQL
+			}
+		}
+		for i, st := range stats {
+			if i >= len(res) || st.Count == 0 {
+				continue
+			}
+			total := res[i].Avg*time.Duration(res[i].Count) + st.Avg*time.Duration(st.Count)
+			res[i].Count += st.Count
+			res[i].Avg = total / time.Duration(res[i].Count)
+			res[i].Max = max(res[i].Max, st.Max)
+		}
+	}
+	return res
+}
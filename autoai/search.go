@@ -0,0 +1,43 @@
+package autoai
+
+import (
+	"context"
+	"strings"
+)
+
+// SearchGeneratedQueries returns generated queries matching the search term, best matches first.
+// Term supports web search syntax: quoted phrases, OR and -exclusions, e.g. `"skip locked" -delete`.
+// If exact is set, term is matched as a case-insensitive substring of the generated SQL instead.
+func (d *DBHistory) SearchGeneratedQueries(term string, exact bool, limit int) ([]GeneratedQueryDB, error) {
+	sql := `
+		SELECT id, prompt, generated_sql, created_at::text, COALESCE(model_used, '')
+		FROM generated_queries
+		WHERE search @@ websearch_to_tsquery('simple', $1)
+		ORDER BY ts_rank(search, websearch_to_tsquery('simple', $1)) DESC, id DESC
+		LIMIT $2`
+	if exact {
+		sql = `
+		SELECT id, prompt, generated_sql, created_at::text, COALESCE(model_used, '')
+		FROM generated_queries
+		WHERE generated_sql ILIKE '%' || $1 || '%'
+		ORDER BY id DESC
+		LIMIT $2`
+		term = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(term)
+	}
+
+	rows, err := d.db.Query(context.Background(), sql, term, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []GeneratedQueryDB
+	for rows.Next() {
+		var q GeneratedQueryDB
+		if err := rows.Scan(&q.ID, &q.Prompt, &q.GeneratedSQL, &q.CreatedAt, &q.ModelUsed); err != nil {
+			return nil, err
+		}
+		res = append(res, q)
+	}
+	return res, rows.Err()
+}
@@ -0,0 +1,108 @@
+package autoai
+
+import (
+	"sort"
+	"time"
+)
+
+// SeriesPoint holds measurements for queries finished within a single second.
+type SeriesPoint struct {
+	// Time is the start of the second, truncated to the second.
+	Time  time.Time
+	Count int
+	// Sum is the total latency of all queries finished within this second.
+	Sum time.Duration
+	Max time.Duration
+	// Histogram holds the number of queries in each of LatencyBuckets,
+	// the last element counts queries slower than the last bucket.
+	Histogram []int `json:",omitempty"`
+}
+
+// QPS returns the number of queries finished within this second.
+func (p SeriesPoint) QPS() float64 {
+	return float64(p.Count)
+}
+
+// Avg returns the average latency of queries finished within this second.
+func (p SeriesPoint) Avg() time.Duration {
+	if p.Count == 0 {
+		return 0
+	}
+	return p.Sum / time.Duration(p.Count)
+}
+
+// seriesRecorder accumulates per-second buckets of query latencies.
+type seriesRecorder struct {
+	points []SeriesPoint
+}
+
+// record adds a query that finished at the given time with the given latency.
+func (r *seriesRecorder) record(finished time.Time, elapsed time.Duration) {
+	sec := finished.Truncate(time.Second)
+
+	if len(r.points) == 0 {
+		r.points = append(r.points, SeriesPoint{Time: sec})
+	}
+	// fill the seconds without finished queries, they are important for spotting stalls
+	for r.points[len(r.points)-1].Time.Before(sec) {
+		next := r.points[len(r.points)-1].Time.Add(time.Second)
+		r.points = append(r.points, SeriesPoint{Time: next})
+	}
+
+	// concurrent queries can be recorded slightly out of order
+	idx := int(sec.Sub(r.points[0].Time) / time.Second)
+	if idx < 0 {
+		idx = 0
+	}
+
+	p := &r.points[idx]
+	p.Count++
+	p.Sum += elapsed
+	p.Max = max(p.Max, elapsed)
+	if p.Histogram == nil {
+		p.Histogram = make([]int, len(LatencyBuckets)+1)
+	}
+	p.Histogram[latencyBucket(elapsed)]++
+}
+
+// mergeSeries combines several series into one, summing points with the same time.
+func mergeSeries(series ...[]SeriesPoint) []SeriesPoint {
+	byTime := make(map[time.Time]*SeriesPoint)
+	for _, s := range series {
+		for _, p := range s {
+			m, ok := byTime[p.Time]
+			if !ok {
+				m = &SeriesPoint{Time: p.Time}
+				byTime[p.Time] = m
+			}
+			m.Count += p.Count
+			m.Sum += p.Sum
+			m.Max = max(m.Max, p.Max)
+			if p.Histogram != nil {
+				if m.Histogram == nil {
+					m.Histogram = make([]int, len(p.Histogram))
+				}
+				for i, c := range p.Histogram {
+					m.Histogram[i] += c
+				}
+			}
+		}
+	}
+
+	times := make([]time.Time, 0, len(byTime))
+	for t := range byTime {
+		times = append(times, t)
+	}
+	sort.Slice(times, func(i, j int) bool {
+		return times[i].Before(times[j])
+	})
+
+	var result []SeriesPoint
+	for _, t := range times {
+		for len(result) > 0 && result[len(result)-1].Time.Add(time.Second).Before(t) {
+			result = append(result, SeriesPoint{Time: result[len(result)-1].Time.Add(time.Second)})
+		}
+		result = append(result, *byTime[t])
+	}
+	return result
+}
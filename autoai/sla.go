@@ -0,0 +1,87 @@
+package autoai
+
+import (
+	"context"
+	"regexp"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// SLA is a latency objective of a workload phase, e.g. p99 < 50ms for point reads.
+type SLA struct {
+	Name string
+	// Percentile of the latency, e.g. 99 or 99.9.
+	Percentile float64
+	MaxLatency time.Duration
+	// Class limits the SLA to queries of the class, Query to queries matching the regexp.
+	// The SLA covers all queries if both are empty.
+	Class string
+	Query *regexp.Regexp
+}
+
+func (s *SLA) matches(sql string) bool {
+	if s.Class != "" && queryClass(sql) != s.Class {
+		return false
+	}
+	return s.Query == nil || s.Query.MatchString(sql)
+}
+
+// SLAResult is the evaluation of an SLA over the executions of a phase.
+type SLAResult struct {
+	SLA        string
+	Percentile float64
+	MaxLatency time.Duration
+	Latency    time.Duration
+	Executions int
+	// Passed is false if the latency exceeds the max, or if there were no matching executions.
+	Passed bool
+}
+
+// EvaluateSLAs computes the latency percentile of every SLA from the latency histograms
+// of the matching queries recorded so far.
+func (a *Artifact) EvaluateSLAs(slas []SLA) []SLAResult {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	res := make([]SLAResult, 0, len(slas))
+	for _, sla := range slas {
+		var series []SeriesPoint
+		var executions int
+		for _, info := range a.Records {
+			stats, ok := info.Info.(*ExecStats)
+			if !ok || !sla.matches(info.Query) {
+				continue
+			}
+			for _, p := range stats.Series {
+				executions += p.Count
+			}
+			series = append(series, stats.Series...)
+		}
+
+		latency := seriesPercentile(series, sla.Percentile/100)
+		res = append(res, SLAResult{
+			SLA:        sla.Name,
+			Percentile: sla.Percentile,
+			MaxLatency: sla.MaxLatency,
+			Latency:    latency,
+			Executions: executions,
+			Passed:     executions > 0 && latency <= sla.MaxLatency,
+		})
+	}
+	return res
+}
+
+// SaveSLAResults records the SLA evaluation of the phase of the current run.
+func (d *DBHistory) SaveSLAResults(phase string, results []SLAResult) error {
+	batch := &pgx.Batch{}
+	for _, r := range results {
+		batch.Queue(`
+			INSERT INTO sla_results (run_id, phase, sla, percentile, max_latency_ms, latency_ms, executions, passed)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+			d.runIDArg(), phase, r.SLA, r.Percentile,
+			float64(r.MaxLatency)/float64(time.Millisecond), float64(r.Latency)/float64(time.Millisecond),
+			r.Executions, r.Passed)
+	}
+	return d.db.SendBatch(context.Background(), batch).Close()
+}
@@ -0,0 +1,104 @@
+package autoai
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"time"
+)
+
+// sleepCommand is the statement of a transaction script that pauses it on the client.
+const sleepCommand = `\sleep`
+
+// sleepStep is a client-side pause between statements of a transaction script, simulating
+// application processing while the transaction stays open, idle in transaction.
+type sleepStep struct {
+	// dist is one of fixed, uniform, exponential and normal
+	dist string
+	a, b time.Duration
+}
+
+// isSleepStatement returns true for \sleep statements of transaction scripts.
+func isSleepStatement(stmt string) bool {
+	fields := strings.Fields(statementKeyword(stmt))
+	return len(fields) > 0 && fields[0] == strings.ToUpper(sleepCommand)
+}
+
+// parseSleep parses a \sleep statement with one of the distributions:
+//
+//	\sleep 50ms                  fixed duration
+//	\sleep uniform 10ms 200ms    uniform between min and max
+//	\sleep exponential 100ms     exponential with the mean, long tail of slow requests
+//	\sleep normal 100ms 20ms     normal with the mean and the standard deviation, cut at zero
+func parseSleep(stmt string) (*sleepStep, error) {
+	fields := strings.Fields(strings.TrimSuffix(strings.TrimSpace(sleepLine(stmt)), ";"))[1:]
+	if len(fields) == 1 {
+		fields = []string{"fixed", fields[0]}
+	}
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("invalid sleep %q", stmt)
+	}
+
+	step := &sleepStep{dist: fields[0]}
+	var args []*time.Duration
+	switch step.dist {
+	case "fixed", "exponential":
+		args = []*time.Duration{&step.a}
+	case "uniform", "normal":
+		args = []*time.Duration{&step.a, &step.b}
+	default:
+		return nil, fmt.Errorf("invalid sleep %q: unknown distribution %q", stmt, step.dist)
+	}
+	if len(fields)-1 != len(args) {
+		return nil, fmt.Errorf("invalid sleep %q: expected %d durations, got %d", stmt, len(args), len(fields)-1)
+	}
+	for i, dst := range args {
+		d, err := time.ParseDuration(fields[i+1])
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid sleep %q: invalid duration %q", stmt, fields[i+1])
+		}
+		*dst = d
+	}
+	if step.dist == "uniform" && step.a > step.b {
+		return nil, fmt.Errorf("invalid sleep %q: min is greater than max", stmt)
+	}
+	return step, nil
+}
+
+// sleepLine returns the first line of the statement that is not a comment.
+func sleepLine(stmt string) string {
+	for _, line := range strings.Split(stmt, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "--") {
+			return line
+		}
+	}
+	return ""
+}
+
+// duration returns a random duration of the pause.
+func (s *sleepStep) duration(r *rand.Rand) time.Duration {
+	switch s.dist {
+	case "uniform":
+		return s.a + time.Duration(r.Int64N(int64(s.b-s.a)+1))
+	case "exponential":
+		return time.Duration(r.ExpFloat64() * float64(s.a))
+	case "normal":
+		return max(0, s.a+time.Duration(r.NormFloat64()*float64(s.b)))
+	default:
+		return s.a
+	}
+}
+
+// sleep pauses the script, it returns an error if the context is done first.
+func (s *sleepStep) sleep(ctx context.Context, r *rand.Rand) error {
+	timer := time.NewTimer(s.duration(r))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
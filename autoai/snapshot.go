@@ -0,0 +1,318 @@
+package autoai
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/petuhovskiy/overload/internal/log"
+	"github.com/petuhovskiy/overload/internal/pgversion"
+	"go.uber.org/zap"
+)
+
+// snapshotSchema holds copies of snapshotted tables.
+const snapshotSchema = "overload_snapshot"
+
+// TableSnapshot resets workload tables to a known state between iterations.
+//
+// Take copies tables with CREATE TABLE AS into a separate schema, Restore truncates
+// the original tables and reloads them from the copies. Original tables are never dropped,
+// so indexes, constraints and dependent objects are preserved.
+type TableSnapshot struct {
+	// Tables are schema-qualified names of the tables, all user tables if empty. Tables
+	// referencing them with foreign keys are added to the snapshot, so that they can be truncated.
+	Tables []string
+
+	// sequences are the states of sequences owned by the tables at the time of the snapshot.
+	sequences []sequenceState
+}
+
+// sequenceState is the state of a sequence, as returned by setval.
+type sequenceState struct {
+	Name      string
+	LastValue int64
+	IsCalled  bool
+}
+
+// Take snapshots current state of the tables, replacing the previous snapshot.
+func (s *TableSnapshot) Take(ctx context.Context, conn *pgx.Conn) error {
+	if len(s.Tables) == 0 {
+		tables, err := userTables(ctx, conn)
+		if err != nil {
+			return fmt.Errorf("failed to list tables: %w", err)
+		}
+		s.Tables = tables
+	} else {
+		tables, err := referencingTables(ctx, conn, s.Tables)
+		if err != nil {
+			return fmt.Errorf("failed to list referencing tables: %w", err)
+		}
+		s.Tables = tables
+	}
+
+	if _, err := conn.Exec(ctx, "CREATE SCHEMA IF NOT EXISTS "+snapshotSchema); err != nil {
+		return err
+	}
+	s.sequences = nil
+	for _, table := range s.Tables {
+		copyName := snapshotTable(table)
+		_, err := conn.Exec(ctx, fmt.Sprintf(`
+			DROP TABLE IF EXISTS %[1]s;
+			CREATE TABLE %[1]s AS SELECT * FROM %[2]s;`, copyName, quoteTable(table)))
+		if err != nil {
+			return fmt.Errorf("failed to snapshot %s: %w", table, err)
+		}
+
+		sequences, err := ownedSequences(ctx, conn, table)
+		if err != nil {
+			return fmt.Errorf("failed to snapshot sequences of %s: %w", table, err)
+		}
+		s.sequences = append(s.sequences, sequences...)
+	}
+
+	log.Info(ctx, "tables snapshot taken", zap.Strings("tables", s.Tables), zap.Int("sequences", len(s.sequences)))
+	return nil
+}
+
+// Restore truncates the tables and reloads them from the snapshot, in a single transaction.
+// Foreign keys of the tables are dropped for the reload and validated again when they are
+// recreated, so the tables can be loaded in any order, and owned sequences are reset to
+// their state at the time of the snapshot. Tables outside the snapshot that reference
+// the snapshotted ones, created after Take, are truncated with a warning.
+func (s *TableSnapshot) Restore(ctx context.Context, conn *pgx.Conn) error {
+	if len(s.Tables) == 0 {
+		return nil
+	}
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	quoted := make([]string, len(s.Tables))
+	for i, table := range s.Tables {
+		quoted[i] = quoteTable(table)
+	}
+
+	keys, err := foreignKeys(ctx, tx, quoted)
+	if err != nil {
+		return fmt.Errorf("failed to list foreign keys: %w", err)
+	}
+	for _, fk := range keys {
+		if _, err := tx.Exec(ctx, fmt.Sprintf("ALTER TABLE %s DROP CONSTRAINT %s", fk.Table, fk.Name)); err != nil {
+			return fmt.Errorf("failed to drop foreign key %s: %w", fk.Name, err)
+		}
+	}
+
+	// tables created after the snapshot, e.g. by generated CREATE TABLE statements, may reference
+	// the snapshotted ones, they have no snapshot and can only be emptied
+	referencing, err := referencingTables(ctx, tx, s.Tables)
+	if err != nil {
+		return fmt.Errorf("failed to list referencing tables: %w", err)
+	}
+	truncated := slices.Clone(quoted)
+	var outside []string
+	for _, table := range referencing {
+		if !slices.Contains(s.Tables, table) {
+			outside = append(outside, table)
+			truncated = append(truncated, quoteTable(table))
+		}
+	}
+	if len(outside) > 0 {
+		log.Warn(ctx, "truncating tables without snapshot that reference snapshotted tables", zap.Strings("tables", outside))
+	}
+
+	if _, err := tx.Exec(ctx, "TRUNCATE "+strings.Join(truncated, ", ")); err != nil {
+		return fmt.Errorf("failed to truncate tables: %w", err)
+	}
+
+	version := pgversion.FromConn(conn)
+	overriding := ""
+	if version.HasIdentityColumns() {
+		overriding = "OVERRIDING SYSTEM VALUE "
+	}
+	for _, table := range s.Tables {
+		columns, err := restoredColumns(ctx, tx, table, version)
+		if err != nil {
+			return fmt.Errorf("failed to get columns of %s: %w", table, err)
+		}
+		list := strings.Join(columns, ", ")
+		_, err = tx.Exec(ctx, fmt.Sprintf("INSERT INTO %s (%s) %sSELECT %s FROM %s",
+			quoteTable(table), list, overriding, list, snapshotTable(table)))
+		if err != nil {
+			return fmt.Errorf("failed to restore %s: %w", table, err)
+		}
+	}
+
+	for _, fk := range keys {
+		if _, err := tx.Exec(ctx, fmt.Sprintf("ALTER TABLE %s ADD CONSTRAINT %s %s", fk.Table, fk.Name, fk.Definition)); err != nil {
+			return fmt.Errorf("failed to recreate foreign key %s: %w", fk.Name, err)
+		}
+	}
+	for _, seq := range s.sequences {
+		if _, err := tx.Exec(ctx, "SELECT setval($1::regclass, $2, $3)", seq.Name, seq.LastValue, seq.IsCalled); err != nil {
+			return fmt.Errorf("failed to reset sequence %s: %w", seq.Name, err)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	// statistics of the restored tables should not depend on the previous iteration
+	if _, err := conn.Exec(ctx, "ANALYZE "+strings.Join(quoted, ", ")); err != nil {
+		log.Warn(ctx, "failed to analyze restored tables", zap.Error(err))
+	}
+	log.Info(ctx, "tables restored from snapshot", zap.Strings("tables", s.Tables))
+	return nil
+}
+
+// referencingTables returns the tables together with all tables referencing them with
+// foreign keys, directly or through other tables. TRUNCATE fails on a table referenced
+// by a table that is not truncated too.
+func referencingTables(ctx context.Context, conn execer, tables []string) ([]string, error) {
+	quoted := make([]string, len(tables))
+	for i, table := range tables {
+		quoted[i] = quoteTable(table)
+	}
+	rows, err := conn.Query(ctx, `
+		WITH RECURSIVE refs(oid) AS (
+			SELECT t::regclass::oid FROM unnest($1::text[]) t
+			UNION
+			SELECT c.conrelid FROM pg_constraint c JOIN refs ON c.confrelid = refs.oid
+			WHERE c.contype = 'f' AND c.conislocal
+		)
+		SELECT n.nspname || '.' || r.relname
+		FROM refs
+		JOIN pg_class r ON r.oid = refs.oid
+		JOIN pg_namespace n ON n.oid = r.relnamespace
+		ORDER BY 1`, quoted)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
+
+// ownedSequences returns the current state of sequences owned by columns of the table,
+// serial and identity columns.
+func ownedSequences(ctx context.Context, conn *pgx.Conn, table string) ([]sequenceState, error) {
+	rows, err := conn.Query(ctx, `
+		SELECT s.oid::regclass::text
+		FROM pg_depend d
+		JOIN pg_class s ON s.oid = d.objid
+		WHERE d.classid = 'pg_class'::regclass AND d.refclassid = 'pg_class'::regclass
+		  AND d.refobjid = $1::regclass AND d.deptype IN ('a', 'i') AND s.relkind = 'S'
+		ORDER BY 1`, quoteTable(table))
+	if err != nil {
+		return nil, err
+	}
+	names, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, err
+	}
+
+	states := make([]sequenceState, len(names))
+	for i, name := range names {
+		states[i].Name = name
+		// the name is already quoted by the regclass output
+		err := conn.QueryRow(ctx, "SELECT last_value, is_called FROM "+name).Scan(&states[i].LastValue, &states[i].IsCalled)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return states, nil
+}
+
+// foreignKey is a foreign key constraint defined on a table.
+type foreignKey struct {
+	// Table and Name are quoted.
+	Table      string
+	Name       string
+	Definition string
+}
+
+// foreignKeys returns the foreign keys defined on the tables. Keys inherited by partitions
+// are skipped, they are recreated together with the key of the parent.
+func foreignKeys(ctx context.Context, tx pgx.Tx, quoted []string) ([]foreignKey, error) {
+	rows, err := tx.Query(ctx, `
+		SELECT conrelid::regclass::text, quote_ident(conname), pg_get_constraintdef(oid)
+		FROM pg_constraint
+		WHERE contype = 'f' AND conislocal AND conrelid = ANY($1::regclass[])
+		ORDER BY 1, 2`, quoted)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowToStructByPos[foreignKey])
+}
+
+// userTables returns all ordinary and partitioned tables outside of system schemas.
+// Partitions are excluded, their data is copied through the parent table.
+func userTables(ctx context.Context, conn *pgx.Conn) ([]string, error) {
+	relFilter := "c.relkind IN ('r', 'p') AND NOT c.relispartition"
+	if !pgversion.FromConn(conn).HasPartitions() {
+		relFilter = "c.relkind = 'r'"
+	}
+	rows, err := conn.Query(ctx, `
+		SELECT n.nspname || '.' || c.relname
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE `+relFilter+`
+		  AND n.nspname NOT IN ('pg_catalog', 'information_schema', $1, $2)
+		  AND n.nspname NOT LIKE 'pg_toast%'
+		ORDER BY 1`, snapshotSchema, shadowSchema)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
+
+// insertableColumns returns quoted names of the columns that are not generated.
+func insertableColumns(ctx context.Context, tx pgx.Tx, table string, version pgversion.Version) ([]string, error) {
+	generatedFilter := ""
+	if version.HasGeneratedColumns() {
+		generatedFilter = "AND attgenerated = ''"
+	}
+	rows, err := tx.Query(ctx, `
+		SELECT quote_ident(attname)
+		FROM pg_attribute
+		WHERE attrelid = $1::regclass AND attnum > 0 AND NOT attisdropped `+generatedFilter+`
+		ORDER BY attnum`, quoteTable(table))
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
+
+// restoredColumns returns quoted names of the columns reloaded from the snapshot: columns
+// of the snapshot copy that still exist in the table and are not generated. Columns may be
+// added or dropped by generated queries after the snapshot, added ones get their defaults.
+func restoredColumns(ctx context.Context, tx pgx.Tx, table string, version pgversion.Version) ([]string, error) {
+	generatedFilter := ""
+	if version.HasGeneratedColumns() {
+		generatedFilter = "AND t.attgenerated = ''"
+	}
+	rows, err := tx.Query(ctx, `
+		SELECT quote_ident(t.attname)
+		FROM pg_attribute t
+		JOIN pg_attribute s ON s.attrelid = $2::regclass AND s.attname = t.attname
+			AND s.attnum > 0 AND NOT s.attisdropped
+		WHERE t.attrelid = $1::regclass AND t.attnum > 0 AND NOT t.attisdropped `+generatedFilter+`
+		ORDER BY t.attnum`, quoteTable(table), snapshotTable(table))
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
+
+// quoteTable quotes schema-qualified table name.
+func quoteTable(table string) string {
+	return pgx.Identifier(strings.SplitN(table, ".", 2)).Sanitize()
+}
+
+// snapshotTable returns the name of the table copy in the snapshot schema.
+func snapshotTable(table string) string {
+	return pgx.Identifier{snapshotSchema, strings.ReplaceAll(table, ".", "__")}.Sanitize()
+}
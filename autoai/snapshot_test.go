@@ -0,0 +1,57 @@
+package autoai
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/stretchr/testify/require"
+)
+
+// TestSnapshotRestoreAlteredTable restores a table whose columns were added and dropped
+// after the snapshot. It needs a database in CONNSTR.
+func TestSnapshotRestoreAlteredTable(t *testing.T) {
+	connstr := os.Getenv("CONNSTR")
+	if connstr == "" {
+		t.Skip("CONNSTR is not set")
+	}
+	ctx := context.Background()
+	conn, err := pgx.Connect(ctx, connstr)
+	require.NoError(t, err)
+	defer conn.Close(ctx)
+
+	const table = "public.overload_test_snapshot"
+	cleanup := func() {
+		_, _ = conn.Exec(ctx, "DROP TABLE IF EXISTS "+quoteTable(table)+", "+snapshotTable(table))
+	}
+	cleanup()
+	defer cleanup()
+
+	_, err = conn.Exec(ctx, `
+		CREATE TABLE public.overload_test_snapshot (id int PRIMARY KEY, a text, b text);
+		INSERT INTO public.overload_test_snapshot VALUES (1, 'a1', 'b1'), (2, 'a2', 'b2');`)
+	require.NoError(t, err)
+
+	snapshot := &TableSnapshot{Tables: []string{table}}
+	require.NoError(t, snapshot.Take(ctx, conn))
+
+	_, err = conn.Exec(ctx, `
+		ALTER TABLE public.overload_test_snapshot DROP COLUMN a;
+		ALTER TABLE public.overload_test_snapshot ADD COLUMN c int DEFAULT 7;
+		DELETE FROM public.overload_test_snapshot;`)
+	require.NoError(t, err)
+
+	require.NoError(t, snapshot.Restore(ctx, conn))
+
+	rows, err := conn.Query(ctx, "SELECT id, b, c FROM public.overload_test_snapshot ORDER BY id")
+	require.NoError(t, err)
+	type row struct {
+		ID int
+		B  string
+		C  int
+	}
+	restored, err := pgx.CollectRows(rows, pgx.RowToStructByPos[row])
+	require.NoError(t, err)
+	require.Equal(t, []row{{1, "b1", 7}, {2, "b2", 7}}, restored)
+}
@@ -0,0 +1,304 @@
+package autoai
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/petuhovskiy/overload/errs"
+)
+
+// QuerySource provides queries for the launcher.
+type QuerySource interface {
+	Queries(ctx context.Context, conn *pgx.Conn) ([]Query, error)
+}
+
+// Queries generates queries for the database schema, so that Generator can be used as a QuerySource.
+func (g *Generator) Queries(_ context.Context, conn *pgx.Conn) ([]Query, error) {
+	return g.Generate(conn)
+}
+
+// StaticSource is a fixed list of queries.
+type StaticSource []Query
+
+func (s StaticSource) Queries(_ context.Context, _ *pgx.Conn) ([]Query, error) {
+	return s, nil
+}
+
+// FileSource reads queries from a .sql file.
+//
+// Statements are separated by semicolons. Files with statements containing semicolons
+// that can't be split automatically can use `-- @query` marker lines instead, then the file
+// is split only by markers. The weight of the query is set by a `-- weight: N` comment
+// inside the statement, by default all queries have weight 1. Queries with zero weight
+// are skipped, e.g. to turn off a class of a preset with its vars.
+//
+// Statements can contain named placeholders like :aid, bound at execution time to values
+// from generators declared by `-- param: aid uniform 1 100000` comments, see ParseParam.
+//
+// A `-- class: name` comment groups queries into a class, e.g. pruned and cross-partition
+// lookups, latency is reported for every class in addition to every query.
+//
+// Statements from BEGIN to COMMIT are grouped into a transaction script executed as a single
+// unit, a `-- statement-latency` comment inside it enables latency capture for every statement.
+// A `\sleep 50ms` statement inside it pauses the transaction on the client, see parseSleep.
+type FileSource struct {
+	Path string
+}
+
+func (s *FileSource) Queries(_ context.Context, _ *pgx.Conn) ([]Query, error) {
+	content, err := os.ReadFile(s.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	queries, err := ParseQueries(string(content))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", s.Path, err)
+	}
+	if len(queries) == 0 {
+		return nil, errs.Validationf("no queries in %s", s.Path)
+	}
+	return queries, nil
+}
+
+var (
+	queryMarkerRegexp = regexp.MustCompile(`(?m)^\s*--\s*@query\b.*$`)
+	weightRegexp      = regexp.MustCompile(`(?m)^\s*--\s*weight:\s*(\S+)\s*$`)
+	paramRegexp       = regexp.MustCompile(`(?m)^\s*--\s*param:\s*(.+?)\s*$`)
+	classRegexp       = regexp.MustCompile(`(?m)^\s*--\s*class:\s*(\S+)\s*$`)
+
+	statementLatencyRegexp = regexp.MustCompile(`(?m)^\s*--\s*statement-latency\s*$`)
+)
+
+// ParseQueries splits SQL script into queries, see FileSource for the format.
+func ParseQueries(script string) ([]Query, error) {
+	var units [][]string
+	if queryMarkerRegexp.MatchString(script) {
+		for _, chunk := range queryMarkerRegexp.Split(script, -1) {
+			stmts := nonEmptyStatements(splitStatements(chunk))
+			if len(stmts) > 1 && isBeginStatement(stmts[0]) {
+				units = append(units, stmts)
+			} else if len(stmts) > 0 {
+				units = append(units, []string{chunk})
+			}
+		}
+	} else {
+		units = groupTransactions(nonEmptyStatements(splitStatements(script)))
+	}
+
+	var queries []Query
+	for _, unit := range units {
+		query, err := parseQuery(unit)
+		if err != nil {
+			return nil, err
+		}
+		if query.Weight == 0 {
+			continue
+		}
+		queries = append(queries, query)
+	}
+	return queries, nil
+}
+
+// parseQuery creates a query from a single statement or a transaction script.
+func parseQuery(stmts []string) (Query, error) {
+	for i := range stmts {
+		stmts[i] = strings.TrimSuffix(strings.TrimSpace(stmts[i]), ";")
+	}
+	text := strings.Join(stmts, ";\n")
+	query := Query{
+		SQL:    text,
+		Weight: 1,
+	}
+	if len(stmts) > 1 {
+		query.Script = stmts
+		query.StatementLatency = statementLatencyRegexp.MatchString(text)
+	}
+	for _, stmt := range stmts {
+		if !isSleepStatement(stmt) {
+			continue
+		}
+		if len(stmts) == 1 {
+			return Query{}, errs.Validationf("%s is allowed only inside transaction scripts", sleepCommand)
+		}
+		if _, err := parseSleep(stmt); err != nil {
+			return Query{}, errs.Validation(err)
+		}
+	}
+
+	if m := weightRegexp.FindStringSubmatch(text); m != nil {
+		weight, err := strconv.ParseFloat(m[1], 64)
+		if err != nil || weight < 0 {
+			return Query{}, errs.Validationf("invalid weight %q", m[1])
+		}
+		query.Weight = weight
+	}
+	query.Class = queryClass(text)
+	for _, m := range paramRegexp.FindAllStringSubmatch(text, -1) {
+		name, gen, err := ParseParam(m[1])
+		if err != nil {
+			return Query{}, err
+		}
+		if query.Params == nil {
+			query.Params = map[string]ParamGenerator{}
+		}
+		query.Params[name] = gen
+	}
+	return query, nil
+}
+
+// queryClass returns the class of the query from the `-- class:` comment, empty if there is none.
+func queryClass(sql string) string {
+	if m := classRegexp.FindStringSubmatch(sql); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+// groupTransactions groups statements from BEGIN to COMMIT into a single unit,
+// other statements are returned as separate units.
+func groupTransactions(stmts []string) [][]string {
+	var (
+		units [][]string
+		tx    []string
+	)
+	for _, stmt := range stmts {
+		switch {
+		case tx != nil:
+			tx = append(tx, stmt)
+			if isEndStatement(stmt) {
+				units = append(units, tx)
+				tx = nil
+			}
+		case isBeginStatement(stmt):
+			tx = []string{stmt}
+		default:
+			units = append(units, []string{stmt})
+		}
+	}
+	if tx != nil {
+		// unterminated transaction is committed implicitly
+		units = append(units, append(tx, "COMMIT"))
+	}
+	return units
+}
+
+func nonEmptyStatements(stmts []string) []string {
+	var res []string
+	for _, stmt := range stmts {
+		if !isEmptyStatement(stmt) {
+			res = append(res, stmt)
+		}
+	}
+	return res
+}
+
+// statementKeyword returns the first line of the statement that is not a comment, in upper case.
+func statementKeyword(stmt string) string {
+	for _, line := range strings.Split(stmt, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "--") {
+			return strings.ToUpper(line)
+		}
+	}
+	return ""
+}
+
+func isBeginStatement(stmt string) bool {
+	kw := statementKeyword(stmt)
+	return kw == "BEGIN" || strings.HasPrefix(kw, "BEGIN ") || strings.HasPrefix(kw, "START TRANSACTION")
+}
+
+func isEndStatement(stmt string) bool {
+	kw := statementKeyword(stmt)
+	return kw == "COMMIT" || kw == "END" || kw == "ROLLBACK"
+}
+
+// isEmptyStatement returns true if the statement consists only of comments and semicolons.
+func isEmptyStatement(sql string) bool {
+	for _, line := range strings.Split(sql, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && line != ";" && !strings.HasPrefix(line, "--") {
+			return false
+		}
+	}
+	return true
+}
+
+// splitStatements splits script by semicolons that are not inside quotes, dollar-quoted
+// strings or comments. Semicolons are not included in the result.
+func splitStatements(script string) []string {
+	var (
+		parts []string
+		start int
+	)
+
+	for i := 0; i < len(script); i++ {
+		switch {
+		case script[i] == '\'' || script[i] == '"':
+			// skip quoted string or identifier, doubled quotes are handled as two strings
+			end := strings.IndexByte(script[i+1:], script[i])
+			if end < 0 {
+				i = len(script)
+			} else {
+				i += end + 1
+			}
+		case strings.HasPrefix(script[i:], "--"):
+			end := strings.IndexByte(script[i:], '\n')
+			if end < 0 {
+				i = len(script)
+			} else {
+				i += end
+			}
+		case strings.HasPrefix(script[i:], "/*"):
+			end := strings.Index(script[i+2:], "*/")
+			if end < 0 {
+				i = len(script)
+			} else {
+				i += end + 3
+			}
+		case script[i] == '$':
+			// dollar quote is $tag$ where tag is optional
+			tagEnd := strings.IndexByte(script[i+1:], '$')
+			if tagEnd < 0 {
+				continue
+			}
+			tag := script[i : i+tagEnd+2]
+			if !isDollarTag(tag) {
+				continue
+			}
+			end := strings.Index(script[i+len(tag):], tag)
+			if end < 0 {
+				i = len(script)
+			} else {
+				i += len(tag) + end + len(tag) - 1
+			}
+		case script[i] == ';':
+			parts = append(parts, script[start:i])
+			start = i + 1
+		}
+	}
+
+	if start < len(script) {
+		parts = append(parts, script[start:])
+	}
+	return parts
+}
+
+// isDollarTag checks that tag is $$ or $identifier$, to not confuse it with $1 parameters.
+func isDollarTag(tag string) bool {
+	inner := tag[1 : len(tag)-1]
+	for i, c := range inner {
+		isLetter := c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+		isDigit := c >= '0' && c <= '9'
+		if !isLetter && !(isDigit && i > 0) {
+			return false
+		}
+	}
+	return true
+}
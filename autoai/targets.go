@@ -0,0 +1,63 @@
+package autoai
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Target is a database or a schema that generated queries are executed against. The generator
+// rotates between targets on every iteration and keeps the feedback of every target apart.
+type Target struct {
+	// Name identifies the target in logs.
+	Name    string
+	Connstr string
+	// Schema limits the schema dump to the tables of the schema and is the search_path
+	// of the queries, empty for all schemas of the database.
+	Schema string
+}
+
+// ParseTargets parses a list of targets, every item is either a schema name of the connstr
+// database or a connection string URL of another database.
+func ParseTargets(items []string, connstr string) ([]Target, error) {
+	var targets []Target
+	names := map[string]bool{}
+	for _, item := range items {
+		t := Target{Name: item, Connstr: connstr, Schema: item}
+		if strings.HasPrefix(item, "postgres://") || strings.HasPrefix(item, "postgresql://") {
+			config, err := pgx.ParseConfig(item)
+			if err != nil {
+				return nil, fmt.Errorf("invalid target: %w", err)
+			}
+			t = Target{Name: fmt.Sprintf("%s:%d/%s", config.Host, config.Port, config.Database), Connstr: item}
+		}
+		if names[t.Name] {
+			return nil, fmt.Errorf("duplicate target %s", t.Name)
+		}
+		names[t.Name] = true
+		targets = append(targets, t)
+	}
+	return targets, nil
+}
+
+// connstr returns the connection string of the target sessions.
+func (t Target) connstr() string {
+	return withConnParams(t.Connstr, map[string]string{"search_path": t.Schema})
+}
+
+// SetTargets makes DoIteration rotate between the targets instead of its connstr.
+func (g *Generator) SetTargets(targets []Target) {
+	g.targets = targets
+	g.next = 0
+}
+
+// nextTarget returns the target of the next iteration, connstr without configured targets.
+func (g *Generator) nextTarget(connstr string) Target {
+	if len(g.targets) == 0 {
+		return Target{Connstr: connstr}
+	}
+	t := g.targets[g.next%len(g.targets)]
+	g.next++
+	return t
+}
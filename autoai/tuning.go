@@ -0,0 +1,57 @@
+package autoai
+
+import (
+	"context"
+	"time"
+
+	"github.com/petuhovskiy/overload/internal/log"
+	"go.uber.org/zap"
+)
+
+// Tuning holds launcher parameters that can be changed while the run is in progress,
+// to steer a long experiment manually.
+type Tuning struct {
+	// ArrivalRate is the arrival rate of open-loop executions, applied to the next arrival.
+	// It doesn't switch between open-loop and closed-loop modes.
+	ArrivalRate float64
+	// ThinkTime is the pause between executions on every closed-loop connection,
+	// applied to the next execution.
+	ThinkTime time.Duration
+	// MaxConns caps the number of connections, applied from the next ramp step.
+	MaxConns int
+}
+
+// Tuning returns the current values of the tunable parameters.
+func (l *Launcher) Tuning() Tuning {
+	return *l.tuning.Load()
+}
+
+// Tune changes tunable parameters of the running launcher.
+func (l *Launcher) Tune(ctx context.Context, t Tuning) {
+	prev := l.tuning.Swap(&t)
+	if *prev != t {
+		log.Info(ctx, "launcher parameters changed", zap.Any("before", *prev), zap.Any("after", t))
+	}
+}
+
+// thinkTime returns the current pause between executions.
+func (opts *execOptions) thinkTime() time.Duration {
+	if opts.tuning == nil {
+		return 0
+	}
+	return opts.tuning().ThinkTime
+}
+
+// think pauses between executions, it returns false if the context is done.
+func (opts *execOptions) think(ctx context.Context) bool {
+	pause := opts.thinkTime()
+	if pause <= 0 {
+		return true
+	}
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(pause):
+		return true
+	}
+}
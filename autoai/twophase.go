@@ -0,0 +1,76 @@
+package autoai
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"sync/atomic"
+	"time"
+
+	"github.com/petuhovskiy/overload/internal/log"
+	"github.com/petuhovskiy/overload/internal/metrics"
+	"go.uber.org/zap"
+)
+
+// TwoPhaseGIDPrefix is the prefix of global transaction ids of all prepared transactions,
+// orphans can be found in pg_prepared_xacts by it.
+const TwoPhaseGIDPrefix = "overload_"
+
+// twoPhase commits transactions with PREPARE TRANSACTION and COMMIT PREPARED, keeping them
+// in-doubt in between. Some transactions can be left prepared forever as orphans.
+type twoPhase struct {
+	dwell      time.Duration
+	orphanRate float64
+	// prefix makes ids unique across runs, orphans of previous runs keep their ids
+	prefix string
+	seq    atomic.Int64
+
+	prepared *metrics.Counter
+	orphaned *metrics.Counter
+}
+
+func newTwoPhase(conf LauncherConfig) *twoPhase {
+	if !conf.TwoPhaseCommit {
+		return nil
+	}
+	return &twoPhase{
+		dwell:      conf.PrepareDwell,
+		orphanRate: conf.OrphanRate,
+		prefix:     fmt.Sprintf("%s%08x_", TwoPhaseGIDPrefix, rand.Uint32()),
+		prepared:   metrics.Default.Counter("twophase_prepared_total"),
+		orphaned:   metrics.Default.Counter("twophase_orphaned_total"),
+	}
+}
+
+// commit prepares the open transaction, waits for the dwell time and commits it,
+// unless it's chosen to become an orphan.
+func (t *twoPhase) commit(ctx context.Context, conn execer) error {
+	// ids consist of letters, digits and underscores, so they don't need escaping
+	gid := fmt.Sprintf("%s%d", t.prefix, t.seq.Add(1))
+	if _, err := conn.Exec(ctx, fmt.Sprintf("PREPARE TRANSACTION '%s'", gid)); err != nil {
+		return err
+	}
+	t.prepared.Inc()
+
+	if t.orphanRate > 0 && rand.Float64() < t.orphanRate {
+		t.orphaned.Inc()
+		log.Info(ctx, "left prepared transaction orphaned", zap.String("gid", gid))
+		return nil
+	}
+
+	if t.dwell > 0 {
+		select {
+		case <-ctx.Done():
+		case <-time.After(t.dwell):
+		}
+	}
+	// the prepared transaction is not bound to the session, so it's committed even if the run is over
+	_, err := conn.Exec(context.Background(), fmt.Sprintf("COMMIT PREPARED '%s'", gid))
+	return err
+}
+
+// isCommitStatement returns true for statements committing a transaction.
+func isCommitStatement(stmt string) bool {
+	kw := statementKeyword(stmt)
+	return kw == "COMMIT" || kw == "END"
+}
@@ -0,0 +1,206 @@
+package autoai
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/petuhovskiy/overload/errs"
+	"github.com/petuhovskiy/overload/internal/log"
+	"github.com/petuhovskiy/overload/internal/metrics"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultValidationTimeout = 5 * time.Second
+	defaultValidationRetries = 2
+)
+
+// ValidationConfig configures the dry run of generated queries before they are executed
+// under load.
+type ValidationConfig struct {
+	// Timeout is the statement timeout of the dry run. Queries still running when it expires
+	// are accepted, they passed parsing and permission checks. Negative disables validation.
+	Timeout time.Duration
+	// Retries is the number of times the model is asked to replace rejected queries
+	// within an iteration. Negative disables replacements.
+	Retries int
+}
+
+func (conf *ValidationConfig) Normalize() {
+	if conf.Timeout == 0 {
+		conf.Timeout = defaultValidationTimeout
+	}
+
+	if conf.Retries == 0 {
+		conf.Retries = defaultValidationRetries
+	}
+}
+
+// SetValidation configures the dry run of generated queries, see ValidationConfig.
+func (g *Generator) SetValidation(conf ValidationConfig) {
+	conf.Normalize()
+	g.validation = conf
+}
+
+// rejectedQuery is a generated query which failed the dry run.
+type rejectedQuery struct {
+	Query Query
+	Err   error
+}
+
+// validateQueries runs every query once in a transaction which is rolled back, and returns
+// queries which failed. Explainable queries run with EXPLAIN ANALYZE and keep their plans. Queries run one after another with savepoints, so that queries using
+// tables created by the previous ones are validated too.
+func (g *Generator) validateQueries(ctx context.Context, conn *pgx.Conn, queries []Query) ([]Query, []rejectedQuery, error) {
+	conf := g.validation
+	conf.Normalize()
+	if conf.Timeout < 0 || len(queries) == 0 {
+		return queries, nil, nil
+	}
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback(context.Background())
+
+	if _, err := tx.Exec(ctx, fmt.Sprintf("SET LOCAL statement_timeout = %d", conf.Timeout.Milliseconds())); err != nil {
+		return nil, nil, err
+	}
+
+	var (
+		valid    []Query
+		rejected []rejectedQuery
+	)
+	for _, q := range queries {
+		if _, err := tx.Exec(ctx, "SAVEPOINT validate"); err != nil {
+			return nil, nil, err
+		}
+		var execErr error
+		if g.explainInValidation(q) {
+			// the plan is captured by the same execution, see Launcher.capturePlan
+			var raw []byte
+			execErr = tx.QueryRow(ctx, explainSQL+q.SQL).Scan(&raw)
+			if execErr == nil {
+				if plan, err := parsePlan(raw); err == nil {
+					q.plan = plan
+				}
+			}
+		} else {
+			_, execErr = tx.Exec(ctx, q.SQL)
+		}
+		if execErr != nil {
+			if _, err := tx.Exec(ctx, "ROLLBACK TO SAVEPOINT validate"); err != nil {
+				return nil, nil, err
+			}
+		} else if _, err := tx.Exec(ctx, "RELEASE SAVEPOINT validate"); err != nil {
+			return nil, nil, err
+		}
+
+		if execErr != nil && !passedValidation(execErr) {
+			if ctx.Err() != nil {
+				return nil, nil, ctx.Err()
+			}
+			log.Warn(ctx, "generated query rejected by validation", zap.String("query", q.SQL), zap.Error(execErr))
+			metrics.Default.Counter("autoai_rejected_queries_total").Inc()
+			rejected = append(rejected, rejectedQuery{Query: q, Err: execErr})
+			continue
+		}
+		valid = append(valid, q)
+	}
+	return valid, rejected, nil
+}
+
+// explainInValidation returns true if the query is validated with EXPLAIN ANALYZE, to capture
+// its plan in the same run.
+func (g *Generator) explainInValidation(q Query) bool {
+	if g.launcher == nil || g.launcher.conf.SkipExplainAnalyze {
+		return false
+	}
+	return len(q.Script) == 0 && len(q.Params) == 0 && isExplainable(q.SQL)
+}
+
+// passedValidation returns true if the query failed the dry run only because of the way it's run:
+// it was canceled by the statement timeout or can't run inside a transaction block.
+func passedValidation(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+	switch pgErr.Code {
+	case errs.CodeQueryCanceled,
+		errs.CodeActiveSQLTransaction: // e.g. CREATE INDEX CONCURRENTLY
+		return true
+	}
+	return false
+}
+
+// rejectionFeedback describes rejected queries for the model, so that it replaces them.
+func (g *Generator) rejectionFeedback(rejected []rejectedQuery) string {
+	var feedback string
+	for _, r := range rejected {
+		feedback += fmt.Sprintf("\n\nThis query was rejected because it failed with an error: %s\n```sql\n%s\n```",
+			g.anonymizer.Hide(r.Err.Error()), g.anonymizer.hideSQL(r.Query.SQL))
+	}
+	return feedback
+}
+
+// generateValid generates queries and validates them, asking the model to replace rejected
+// queries up to Retries times. It returns valid queries, no more than the model generated
+// at first, the feedback about rejected queries and the number of all generated queries.
+func (g *Generator) generateValid(ctx context.Context, conn *pgx.Conn) ([]Query, string, int, error) {
+	conf := g.validation
+	conf.Normalize()
+
+	queries, err := g.Generate(conn)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	want := len(queries)
+	generated := len(queries)
+
+	var (
+		valid    []Query
+		feedback string
+		prev     = g.prevPrompts[g.current.Name]
+	)
+	defer func() {
+		g.prevPrompts[g.current.Name] = prev
+	}()
+	for attempt := 0; ; attempt++ {
+		var failedQueries string
+		queries, failedQueries = g.filterQuarantined(ctx, queries)
+		feedback += failedQueries
+
+		accepted, rejected, err := g.validateQueries(ctx, conn, queries)
+		if err != nil {
+			return nil, "", generated, fmt.Errorf("failed to validate queries: %w", err)
+		}
+		for _, r := range rejected {
+			g.recordFailure(ctx, r.Query.SQL, "rejected: "+r.Err.Error())
+		}
+		valid = append(valid, accepted...)
+		if len(valid) >= want || len(rejected) == 0 || attempt >= conf.Retries {
+			feedback += g.rejectionFeedback(rejected)
+			break
+		}
+
+		log.Info(ctx, "asking the model to replace rejected queries", zap.Int("rejected", len(rejected)))
+		feedback += g.rejectionFeedback(rejected)
+		g.prevPrompts[g.current.Name] = prev + "\n\nSome of the queries you generated were rejected before execution, generate valid replacements for them." + feedback
+		queries, err = g.Generate(conn)
+		if err != nil {
+			return nil, "", generated, err
+		}
+		generated += len(queries)
+	}
+
+	if len(valid) > want {
+		valid = valid[:want]
+	}
+	return valid, feedback, generated, nil
+}
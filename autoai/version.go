@@ -0,0 +1,28 @@
+package autoai
+
+import (
+	"context"
+
+	"github.com/petuhovskiy/overload/internal/dbconn"
+	"github.com/petuhovskiy/overload/internal/log"
+	"github.com/petuhovskiy/overload/internal/pgversion"
+	"go.uber.org/zap"
+)
+
+// DetectServerVersion connects to the database and records the server version for the current run.
+// Failures are only logged, the version is unknown in this case.
+func DetectServerVersion(ctx context.Context, connstr string, history *DBHistory) pgversion.Version {
+	conn, err := dbconn.Connect(ctx, connstr)
+	if err != nil {
+		log.Warn(ctx, "failed to detect server version", zap.Error(err))
+		return pgversion.Version{}
+	}
+	defer conn.Close(context.Background())
+
+	version := pgversion.FromConn(conn)
+	log.Info(ctx, "detected server version", zap.Stringer("version", version))
+	if err := history.SaveServerVersion(version); err != nil {
+		log.Warn(ctx, "failed to save server version", zap.Error(err))
+	}
+	return version
+}
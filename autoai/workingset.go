@@ -0,0 +1,239 @@
+package autoai
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/petuhovskiy/overload/internal/dbconn"
+	"github.com/petuhovskiy/overload/internal/log"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultWorkingSetTable        = "overload_workingset"
+	defaultWorkingSetConns        = 16
+	defaultWorkingSetStepDuration = time.Minute
+	defaultWorkingSetWarmup       = 10 * time.Second
+	// workingSetRowWidth is the width of the padding of every row, rows of ~1KB are stored
+	// inline without compression, so the size of the working set is predictable
+	workingSetRowWidth = 1000
+)
+
+// WorkingSetConfig configures the working set sweep.
+type WorkingSetConfig struct {
+	// Sizes are the working set sizes in bytes, measured from the smallest.
+	Sizes []int64
+	Table string
+	// TableSize is the min size of the table in bytes, twice the largest working set by default.
+	// An existing table is reused if it's large enough.
+	TableSize    int64
+	Conns        int
+	StepDuration time.Duration
+	// Warmup is the duration of reads before every measured step, so that the step measures
+	// the steady state of the cache, not its warming.
+	Warmup time.Duration
+}
+
+func (conf *WorkingSetConfig) Normalize() {
+	if conf.Table == "" {
+		conf.Table = defaultWorkingSetTable
+	}
+
+	if conf.TableSize == 0 && len(conf.Sizes) > 0 {
+		conf.TableSize = 2 * slices.Max(conf.Sizes)
+	}
+
+	if conf.Conns == 0 {
+		conf.Conns = defaultWorkingSetConns
+	}
+
+	if conf.StepDuration == 0 {
+		conf.StepDuration = defaultWorkingSetStepDuration
+	}
+
+	if conf.Warmup == 0 {
+		conf.Warmup = defaultWorkingSetWarmup
+	}
+}
+
+// WorkingSetStep is the measurement of a single working set size.
+type WorkingSetStep struct {
+	Size int64
+	// Keys is the number of the hottest keys covering the working set.
+	Keys int64
+	QPS  float64
+	Avg  time.Duration
+	P99  time.Duration
+	// HitRatio is the share of heap and index block reads of the table served by shared buffers.
+	HitRatio float64
+	Errors   int
+}
+
+// WorkingSetResult is the sweep over working set sizes.
+type WorkingSetResult struct {
+	SharedBuffers int64
+	TableSize     int64
+	Steps         []WorkingSetStep
+}
+
+// RunWorkingSet executes point reads constrained to the hottest keys of the table, covering
+// every working set size in turn, and reports throughput, latency and the buffer hit ratio
+// of every size. Comparing the sizes with shared_buffers and RAM shows the hit-rate cliff.
+func (l *Launcher) RunWorkingSet(ctx context.Context, connstr string, conf WorkingSetConfig) (WorkingSetResult, error) {
+	conf.Normalize()
+	var res WorkingSetResult
+	if len(conf.Sizes) == 0 {
+		return res, fmt.Errorf("no working set sizes")
+	}
+	sizes := slices.Sorted(slices.Values(conf.Sizes))
+
+	conn, err := dbconn.Connect(ctx, connstr)
+	if err != nil {
+		return res, err
+	}
+	defer conn.Close(context.Background())
+
+	table := pgx.Identifier{conf.Table}.Sanitize()
+	rowSize, err := ensureWorkingSetTable(ctx, conn, table, conf.TableSize)
+	if err != nil {
+		return res, fmt.Errorf("failed to create working set table: %w", err)
+	}
+	if err := conn.QueryRow(ctx, `SELECT pg_table_size(to_regclass($1))`, table).Scan(&res.TableSize); err != nil {
+		return res, err
+	}
+	err = conn.QueryRow(ctx, `SELECT setting::bigint * 8192 FROM pg_settings WHERE name = 'shared_buffers'`).Scan(&res.SharedBuffers)
+	if err != nil {
+		return res, fmt.Errorf("failed to get shared_buffers: %w", err)
+	}
+	log.Info(ctx, "working set table is ready", zap.String("table_size", formatBytes(res.TableSize)),
+		zap.String("shared_buffers", formatBytes(res.SharedBuffers)))
+
+	for _, size := range sizes {
+		keys := max(1, size/rowSize)
+		query := Query{
+			SQL:    fmt.Sprintf("SELECT pad FROM %s WHERE id = :id", table),
+			Weight: 1,
+			Params: map[string]ParamGenerator{"id": &UniformInt{Min: 1, Max: keys}},
+		}
+		opts := l.execOptions(query)
+
+		opts.duration = conf.Warmup
+		runStep(ctx, connstr, query, conf.Conns, opts)
+
+		before, err := tableBlockStats(ctx, conn, table)
+		if err != nil {
+			return res, err
+		}
+		opts.duration = conf.StepDuration
+		stats, point := runStep(ctx, connstr, query, conf.Conns, opts)
+		if ctx.Err() != nil {
+			return res, ctx.Err()
+		}
+		after, err := tableBlockStats(ctx, conn, table)
+		if err != nil {
+			return res, err
+		}
+
+		step := WorkingSetStep{
+			Size: size,
+			Keys: keys,
+			QPS:  point.QPS,
+			Avg:  stats.Avg,
+			P99:  seriesPercentile(stats.Series, 0.99),
+		}
+		for _, n := range stats.ErrorCodes {
+			step.Errors += n
+		}
+		if hits, reads := after.hits-before.hits, after.reads-before.reads; hits+reads > 0 {
+			step.HitRatio = float64(hits) / float64(hits+reads)
+		}
+		res.Steps = append(res.Steps, step)
+		info := stats.ToExecInfo(query.SQL, conf.Conns)
+		info.Comment = fmt.Sprintf("working set %s: %s", formatBytes(size), info.Comment)
+		go l.db.SaveQueryExecInfo(info)
+		log.Info(ctx, "working set step finished", zap.Any("step", step))
+	}
+	return res, nil
+}
+
+// ensureWorkingSetTable creates and fills the table unless it's already large enough,
+// and returns the average size of a row in bytes, including its share of the index.
+func ensureWorkingSetTable(ctx context.Context, conn *pgx.Conn, table string, size int64) (int64, error) {
+	var current, rows int64
+	err := conn.QueryRow(ctx, `
+		SELECT COALESCE(pg_total_relation_size(to_regclass($1)), 0),
+			COALESCE((SELECT reltuples::bigint FROM pg_class WHERE oid = to_regclass($1)), 0)`, table).
+		Scan(&current, &rows)
+	if err != nil {
+		return 0, err
+	}
+
+	if current < size || rows <= 0 {
+		log.Info(ctx, "creating working set table", zap.String("size", formatBytes(size)))
+		// ids are inserted in order, so the hottest keys are packed into the first pages
+		_, err = conn.Exec(ctx, fmt.Sprintf(`
+			DROP TABLE IF EXISTS %[1]s;
+			CREATE TABLE %[1]s AS
+			SELECT i::bigint AS id, lpad('', %[2]d, md5(i::text)) AS pad
+			FROM generate_series(1, %[3]d) i;
+			ALTER TABLE %[1]s ADD PRIMARY KEY (id);
+			VACUUM ANALYZE %[1]s;`, table, workingSetRowWidth, size/workingSetRowWidth+1))
+		if err != nil {
+			return 0, err
+		}
+		err = conn.QueryRow(ctx, `
+			SELECT pg_total_relation_size(to_regclass($1)), reltuples::bigint
+			FROM pg_class WHERE oid = to_regclass($1)`, table).Scan(&current, &rows)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return max(1, current/max(1, rows)), nil
+}
+
+// blockStats are cumulative buffer hits and reads of a table and its indexes.
+type blockStats struct {
+	hits, reads int64
+}
+
+func tableBlockStats(ctx context.Context, conn *pgx.Conn, table string) (blockStats, error) {
+	var s blockStats
+	// statistics are flushed by backends with a delay
+	_, _ = conn.Exec(ctx, `SELECT pg_stat_clear_snapshot()`)
+	err := conn.QueryRow(ctx, `
+		SELECT COALESCE(heap_blks_hit, 0) + COALESCE(idx_blks_hit, 0),
+			COALESCE(heap_blks_read, 0) + COALESCE(idx_blks_read, 0)
+		FROM pg_statio_user_tables WHERE relid = to_regclass($1)`, table).Scan(&s.hits, &s.reads)
+	return s, err
+}
+
+// formatBytes formats the size with a binary unit, e.g. 512MB.
+func formatBytes(b int64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%dB", b)
+	}
+	div, exp := int64(unit), 0
+	for n := b / unit; n >= unit && exp < 3; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.4g%cB", float64(b)/float64(div), "KMGT"[exp])
+}
+
+// PrintWorkingSetResult writes the steps of the sweep.
+func PrintWorkingSetResult(w io.Writer, r WorkingSetResult) error {
+	fmt.Fprintf(w, "shared_buffers: %s, table: %s\n\n", formatBytes(r.SharedBuffers), formatBytes(r.TableSize))
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "WORKING SET\tKEYS\tQPS\tAVG\tP99\tHIT RATIO\tERRORS")
+	for _, s := range r.Steps {
+		fmt.Fprintf(tw, "%s\t%d\t%.1f\t%s\t%s\t%.2f%%\t%d\n", formatBytes(s.Size), s.Keys, s.QPS,
+			s.Avg.Round(time.Microsecond), s.P99.Round(time.Microsecond), s.HitRatio*100, s.Errors)
+	}
+	return tw.Flush()
+}
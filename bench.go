@@ -0,0 +1,491 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/petuhovskiy/overload/ingest"
+	"github.com/petuhovskiy/overload/workload/blob"
+	"github.com/petuhovskiy/overload/workload/gin"
+	"github.com/petuhovskiy/overload/workload/prepared"
+	"github.com/petuhovskiy/overload/workload/queue"
+	"github.com/petuhovskiy/overload/workload/rls"
+)
+
+// runBench dispatches benchmark subcommands.
+func runBench(args []string) {
+	if len(args) == 0 {
+		fmt.Println("Usage: bench ingest-methods|ingest-overhead|ingest-widths|blobs|prepared|gin|rls|queue [flags]")
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "ingest-methods":
+		runBenchIngestMethods(args[1:])
+	case "ingest-overhead":
+		runBenchIngestOverhead(args[1:])
+	case "ingest-widths":
+		runBenchIngestWidths(args[1:])
+	case "blobs":
+		runBenchBlobs(args[1:])
+	case "prepared":
+		runBenchPrepared(args[1:])
+	case "gin":
+		runBenchGin(args[1:])
+	case "rls":
+		runBenchRLS(args[1:])
+	case "queue":
+		runBenchQueue(args[1:])
+	default:
+		fmt.Println("Error: unknown bench command", args[0])
+		os.Exit(1)
+	}
+}
+
+// runBenchIngestMethods compares ingestion methods on the database from CONNSTR.
+func runBenchIngestMethods(args []string) {
+	fs := flag.NewFlagSet("bench ingest-methods", flag.ExitOnError)
+	duration := fs.Duration("duration", 0, "duration of every method run (default 1m)")
+	workers := fs.Int("workers", 1, "concurrent connections per method")
+	table := fs.String("table", "bench_ingest", "table to ingest into, truncated before every method")
+	batchSize := fs.Int("batch", 10000, "rows per batch")
+	methodsFlag := fs.String("methods", "", "comma-separated methods to run, all by default")
+	commitsFlag := fs.String("batches-per-commit", "1", "comma-separated numbers of batches per transaction, every method runs with each of them")
+	hypertable := fs.Bool("hypertable", false, "create the table as a TimescaleDB hypertable")
+	partitioned := fs.Bool("partitioned", false, "create the table with native range partitioning by mtime")
+	chunkInterval := fs.Duration("chunk-interval", 0, "chunk interval of the hypertable or partition interval (default 24h)")
+	distributeBy := fs.String("distribute-by", "", "create the table as a Citus distributed table sharded by this column")
+	compressibilityFlag := fs.String("compressibility", "", "comma-separated fractions of the filler made of a repeated character, from 0 (random) to 1 (constant), every method runs with each of them")
+	_ = fs.Parse(args)
+
+	connstr := os.Getenv("CONNSTR")
+	if connstr == "" {
+		fmt.Println("Error: CONNSTR environment variable not set")
+		os.Exit(1)
+	}
+	setupTarget(connstr)
+
+	methods := ingest.Methods
+	if *methodsFlag != "" {
+		methods = nil
+		for _, name := range strings.Split(*methodsFlag, ",") {
+			found := false
+			for _, m := range ingest.Methods {
+				if m.Name == name {
+					methods = append(methods, m)
+					found = true
+				}
+			}
+			if !found {
+				fmt.Println("Error: unknown method", name)
+				os.Exit(1)
+			}
+		}
+	}
+
+	conf := ingest.BenchConfig{
+		Ingest: ingest.Config{
+			TableName:     *table,
+			BatchSize:     *batchSize,
+			Hypertable:    *hypertable,
+			Partitioned:   *partitioned,
+			ChunkInterval: *chunkInterval,
+
+			DistributionColumn: *distributeBy,
+		},
+		Duration: *duration,
+		Workers:  *workers,
+	}
+	var batchesPerCommit []int
+	for _, value := range strings.Split(*commitsFlag, ",") {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			fmt.Println("Error: invalid batches per commit", value)
+			os.Exit(1)
+		}
+		batchesPerCommit = append(batchesPerCommit, n)
+	}
+
+	// nil runs methods with their own payload
+	compressibility := []*float64{nil}
+	if *compressibilityFlag != "" {
+		compressibility = nil
+		for _, value := range strings.Split(*compressibilityFlag, ",") {
+			c, err := parseCompressibility(value)
+			if err != nil {
+				fmt.Println("Error:", err)
+				os.Exit(1)
+			}
+			compressibility = append(compressibility, c)
+		}
+	}
+
+	var results []ingest.BenchResult
+	var err error
+bench:
+	for _, n := range batchesPerCommit {
+		for _, c := range compressibility {
+			conf.Ingest.BatchesPerCommit = n
+			conf.Ingest.Compressibility = c
+			var res []ingest.BenchResult
+			res, err = ingest.BenchMethods(context.Background(), connstr, conf, methods)
+			for i := range res {
+				if len(batchesPerCommit) > 1 {
+					res[i].Method = fmt.Sprintf("%s/%d", res[i].Method, n)
+				}
+				if c != nil {
+					res[i].Method = fmt.Sprintf("%s/c%g", res[i].Method, *c)
+				}
+			}
+			results = append(results, res...)
+			if err != nil {
+				break bench
+			}
+		}
+	}
+	ingest.PrintBenchResults(os.Stdout, results)
+	if err != nil {
+		fmt.Println("Error: benchmark failed:", err)
+		os.Exit(1)
+	}
+}
+
+// runBenchIngestOverhead measures the throughput cost of foreign keys and an audit trigger
+// on the ingest table, running the same method with and without them.
+func runBenchIngestOverhead(args []string) {
+	fs := flag.NewFlagSet("bench ingest-overhead", flag.ExitOnError)
+	method := fs.String("method", "copy", "ingestion method to run")
+	fks := fs.Int("fks", 3, "number of foreign keys to add (0-3: bid, tid, aid), 0 to skip the foreign key variants")
+	trigger := fs.Bool("trigger", true, "run the variants with the audit trigger")
+	duration := fs.Duration("duration", 0, "duration of every variant run (default 1m)")
+	workers := fs.Int("workers", 1, "concurrent connections")
+	table := fs.String("table", "bench_ingest", "table to ingest into, truncated before every variant")
+	batchSize := fs.Int("batch", 10000, "rows per batch")
+	_ = fs.Parse(args)
+
+	connstr := os.Getenv("CONNSTR")
+	if connstr == "" {
+		fmt.Println("Error: CONNSTR environment variable not set")
+		os.Exit(1)
+	}
+	setupTarget(connstr)
+
+	var m *ingest.Method
+	for i := range ingest.Methods {
+		if ingest.Methods[i].Name == *method {
+			m = &ingest.Methods[i]
+		}
+	}
+	if m == nil {
+		fmt.Println("Error: unknown method", *method)
+		os.Exit(1)
+	}
+
+	conf := ingest.BenchConfig{
+		Ingest: ingest.Config{
+			TableName:    *table,
+			BatchSize:    *batchSize,
+			ForeignKeys:  *fks,
+			AuditTrigger: *trigger,
+		},
+		Duration: *duration,
+		Workers:  *workers,
+	}
+	results, err := ingest.BenchOverhead(context.Background(), connstr, conf, *m)
+	ingest.PrintBenchResults(os.Stdout, results)
+	if err != nil {
+		fmt.Println("Error: benchmark failed:", err)
+		os.Exit(1)
+	}
+}
+
+// runBenchIngestWidths ingests the same volume with rows of different widths,
+// to show per-row overhead against raw bandwidth.
+func runBenchIngestWidths(args []string) {
+	fs := flag.NewFlagSet("bench ingest-widths", flag.ExitOnError)
+	method := fs.String("method", "copy", "ingestion method to run")
+	widthsFlag := fs.String("widths", "50,500,5000", "comma-separated row widths in bytes")
+	volumeMB := fs.Int64("volume-mb", 1024, "data volume ingested with every width, in MB")
+	duration := fs.Duration("duration", 0, "max duration of every width run (default 1m)")
+	workers := fs.Int("workers", 1, "concurrent connections")
+	table := fs.String("table", "bench_ingest", "prefix of tables to ingest into, one per width, truncated before every run")
+	batchSize := fs.Int("batch", 10000, "rows per batch, capped at 64MB of data")
+	compressibilityFlag := fs.String("compressibility", "", "fraction of the filler made of a repeated character, from 0 (random) to 1 (constant)")
+	_ = fs.Parse(args)
+
+	connstr := os.Getenv("CONNSTR")
+	if connstr == "" {
+		fmt.Println("Error: CONNSTR environment variable not set")
+		os.Exit(1)
+	}
+	setupTarget(connstr)
+
+	var m *ingest.Method
+	for i := range ingest.Methods {
+		if ingest.Methods[i].Name == *method {
+			m = &ingest.Methods[i]
+		}
+	}
+	if m == nil {
+		fmt.Println("Error: unknown method", *method)
+		os.Exit(1)
+	}
+
+	var widths []int
+	for _, value := range strings.Split(*widthsFlag, ",") {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			fmt.Println("Error: invalid row width", value)
+			os.Exit(1)
+		}
+		widths = append(widths, n)
+	}
+
+	compressibility, err := parseCompressibility(*compressibilityFlag)
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+
+	conf := ingest.BenchConfig{
+		Ingest: ingest.Config{
+			TableName:       *table,
+			BatchSize:       *batchSize,
+			Compressibility: compressibility,
+		},
+		Duration: *duration,
+		Workers:  *workers,
+	}
+	results, err := ingest.BenchWidths(context.Background(), connstr, conf, *m, widths, *volumeMB<<20)
+	ingest.PrintWidthResults(os.Stdout, results)
+	if err != nil {
+		fmt.Println("Error: benchmark failed:", err)
+		os.Exit(1)
+	}
+}
+
+// runBenchBlobs measures throughput of large values stored as large objects or bytea.
+func runBenchBlobs(args []string) {
+	fs := flag.NewFlagSet("bench blobs", flag.ExitOnError)
+	modes := fs.String("modes", strings.Join(blob.Modes, ","), "comma-separated storage modes to run: lo, bytea")
+	sizeKB := fs.Int("size-kb", 16<<10, "size of every value in KB")
+	chunkKB := fs.Int("chunk-kb", 256, "size of a single write or read call in KB")
+	workers := fs.Int("workers", 4, "concurrent connections")
+	duration := fs.Duration("duration", 0, "duration of every mode run (default 1m)")
+	readRatio := fs.Float64("read-ratio", 0.5, "fraction of operations reading stored values, negative for writes only")
+	keep := fs.Int("keep", 100, "number of stored values, older ones are deleted")
+	table := fs.String("table", "overload_blobs", "table referencing the values")
+	_ = fs.Parse(args)
+
+	connstr := os.Getenv("CONNSTR")
+	if connstr == "" {
+		fmt.Println("Error: CONNSTR environment variable not set")
+		os.Exit(1)
+	}
+	setupTarget(connstr)
+
+	var results []blob.Result
+	var err error
+	for _, mode := range strings.Split(*modes, ",") {
+		var res blob.Result
+		res, err = blob.Run(context.Background(), connstr, blob.Config{
+			Mode:      mode,
+			TableName: *table,
+			Size:      *sizeKB << 10,
+			ChunkSize: *chunkKB << 10,
+			Workers:   *workers,
+			Duration:  *duration,
+			ReadRatio: *readRatio,
+			Keep:      *keep,
+		})
+		results = append(results, res)
+		if err != nil {
+			break
+		}
+	}
+	blob.PrintResults(os.Stdout, results)
+	if err != nil {
+		fmt.Println("Error: benchmark failed:", err)
+		os.Exit(1)
+	}
+}
+
+// runBenchPrepared stresses the plan cache with thousands of prepared statements per session.
+func runBenchPrepared(args []string) {
+	fs := flag.NewFlagSet("bench prepared", flag.ExitOnError)
+	statements := fs.Int("statements", 2000, "distinct statements prepared by every session")
+	workers := fs.Int("workers", 8, "concurrent sessions")
+	duration := fs.Duration("duration", 0, "duration of the run (default 1m)")
+	deallocateEvery := fs.Int("deallocate-every", 50000, "executions per session between DEALLOCATE ALL, negative to never deallocate")
+	planCacheMode := fs.String("plan-cache-mode", "", "plan_cache_mode of the sessions, e.g. force_generic_plan")
+	rows := fs.Int("rows", 100000, "rows seeded into the table")
+	table := fs.String("table", "overload_prepared", "table queried by the statements")
+	_ = fs.Parse(args)
+
+	connstr := os.Getenv("CONNSTR")
+	if connstr == "" {
+		fmt.Println("Error: CONNSTR environment variable not set")
+		os.Exit(1)
+	}
+	setupTarget(connstr)
+
+	res, err := prepared.Run(context.Background(), connstr, prepared.Config{
+		TableName:       *table,
+		Rows:            *rows,
+		Statements:      *statements,
+		Workers:         *workers,
+		Duration:        *duration,
+		DeallocateEvery: *deallocateEvery,
+		PlanCacheMode:   *planCacheMode,
+	})
+	prepared.PrintResult(os.Stdout, res)
+	if err != nil {
+		fmt.Println("Error: benchmark failed:", err)
+		os.Exit(1)
+	}
+}
+
+// runBenchGin measures GIN index maintenance for every combination of document type and
+// fastupdate setting.
+func runBenchGin(args []string) {
+	fs := flag.NewFlagSet("bench gin", flag.ExitOnError)
+	modes := fs.String("modes", strings.Join(gin.Modes, ","), "comma-separated indexed column types to run: tsvector, jsonb")
+	fastUpdate := fs.String("fastupdate", "on,off", "comma-separated fastupdate settings of the index to run")
+	pendingListLimit := fs.Int("pending-list-limit-kb", 0, "gin_pending_list_limit of the index in KB, server default if zero")
+	workers := fs.Int("workers", 8, "concurrent connections")
+	duration := fs.Duration("duration", 0, "duration of every run (default 1m)")
+	batchSize := fs.Int("batch", 100, "rows per insert")
+	updateRatio := fs.Float64("update-ratio", 0.3, "fraction of operations updating an existing row, negative for inserts only")
+	words := fs.Int("words", 20, "words or keys per document")
+	stall := fs.Duration("stall", 500*time.Millisecond, "write latency counted as a stall")
+	rows := fs.Int("rows", 100000, "rows seeded into an empty table")
+	_ = fs.Parse(args)
+
+	connstr := os.Getenv("CONNSTR")
+	if connstr == "" {
+		fmt.Println("Error: CONNSTR environment variable not set")
+		os.Exit(1)
+	}
+	setupTarget(connstr)
+
+	var results []gin.Result
+	var err error
+	for _, mode := range strings.Split(*modes, ",") {
+		for _, fu := range strings.Split(*fastUpdate, ",") {
+			if fu != "on" && fu != "off" {
+				fmt.Println("Error: fastupdate must be on or off, got", fu)
+				os.Exit(1)
+			}
+
+			var res gin.Result
+			res, err = gin.Run(context.Background(), connstr, gin.Config{
+				Mode:             mode,
+				FastUpdate:       fu == "on",
+				PendingListLimit: *pendingListLimit,
+				Rows:             *rows,
+				Workers:          *workers,
+				Duration:         *duration,
+				BatchSize:        *batchSize,
+				UpdateRatio:      *updateRatio,
+				Words:            *words,
+				StallThreshold:   *stall,
+			})
+			results = append(results, res)
+			if err != nil {
+				break
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	gin.PrintResults(os.Stdout, results)
+	if err != nil {
+		fmt.Println("Error: benchmark failed:", err)
+		os.Exit(1)
+	}
+}
+
+// runBenchRLS measures the overhead of role switching and row-level security policies.
+func runBenchRLS(args []string) {
+	fs := flag.NewFlagSet("bench rls", flag.ExitOnError)
+	modes := fs.String("modes", strings.Join(rls.Modes, ","), "comma-separated modes to run: plain, set-role, rls")
+	roles := fs.Int("roles", 100, "number of tenant roles")
+	workers := fs.Int("workers", 8, "concurrent connections")
+	duration := fs.Duration("duration", 0, "duration of every mode run (default 1m)")
+	rows := fs.Int("rows", 1000000, "rows seeded into an empty table")
+	table := fs.String("table", "overload_rls", "table with tenant rows")
+	_ = fs.Parse(args)
+
+	connstr := os.Getenv("CONNSTR")
+	if connstr == "" {
+		fmt.Println("Error: CONNSTR environment variable not set")
+		os.Exit(1)
+	}
+	setupTarget(connstr)
+
+	var results []rls.Result
+	var err error
+	for _, mode := range strings.Split(*modes, ",") {
+		var res rls.Result
+		res, err = rls.Run(context.Background(), connstr, rls.Config{
+			Mode:      mode,
+			TableName: *table,
+			Roles:     *roles,
+			Rows:      *rows,
+			Workers:   *workers,
+			Duration:  *duration,
+		})
+		results = append(results, res)
+		if err != nil {
+			break
+		}
+	}
+	rls.PrintResults(os.Stdout, results)
+	if err != nil {
+		fmt.Println("Error: benchmark failed:", err)
+		os.Exit(1)
+	}
+}
+
+// runBenchQueue runs a job queue with producers and SKIP LOCKED consumers.
+func runBenchQueue(args []string) {
+	fs := flag.NewFlagSet("bench queue", flag.ExitOnError)
+	producers := fs.Int("producers", 4, "concurrent producer connections")
+	consumers := fs.Int("consumers", 8, "concurrent consumer connections")
+	rate := fs.Float64("rate", 1000, "tasks inserted per second by all producers, negative for as fast as possible")
+	fetch := fs.Int("fetch", 10, "max tasks locked by a consumer at once")
+	workTime := fs.Duration("work-time", 0, "processing time of a batch of tasks, spent holding the locks")
+	deleteDone := fs.Bool("delete", false, "delete processed tasks instead of marking them done")
+	duration := fs.Duration("duration", 0, "duration of the run (default 1m)")
+	table := fs.String("table", "overload_queue", "queue table")
+	_ = fs.Parse(args)
+
+	connstr := os.Getenv("CONNSTR")
+	if connstr == "" {
+		fmt.Println("Error: CONNSTR environment variable not set")
+		os.Exit(1)
+	}
+	setupTarget(connstr)
+
+	res, err := queue.Run(context.Background(), connstr, queue.Config{
+		TableName: *table,
+		Producers: *producers,
+		Consumers: *consumers,
+		Duration:  *duration,
+		Rate:      *rate,
+		FetchSize: *fetch,
+		WorkTime:  *workTime,
+		Delete:    *deleteDone,
+	})
+	queue.PrintResult(os.Stdout, res)
+	if err != nil {
+		fmt.Println("Error: benchmark failed:", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/petuhovskiy/overload/autoai"
+	"github.com/petuhovskiy/overload/internal/log"
+	"go.uber.org/zap"
+)
+
+// runCache runs queries from a file with cold and warm caches and reports the latency delta.
+func runCache(args []string) {
+	fs := flag.NewFlagSet("cache", flag.ExitOnError)
+	labels := labelsFlag{}
+	fs.Var(labels, "label", "attach label to the run, in key=value format (repeatable)")
+	queriesFile := fs.String("queries", "", "queries to run, in the .sql file format")
+	drop := fs.String("drop", "evict", "how to drop caches: evict, restart or sql")
+	evictMB := fs.Int("evict-mb", 0, "size of the table read to evict shared buffers (default 2x shared_buffers)")
+	restartURL := fs.String("restart-url", "", "endpoint called with POST to restart the database, token from CACHE_RESTART_TOKEN")
+	dropSQL := fs.String("drop-sql", "", "custom SQL that drops caches")
+	executions := fs.Int("executions", 1, "executions of every query in every pass")
+	perQuery := fs.Bool("per-query", false, "drop caches before every query")
+	_ = fs.Parse(args)
+
+	connstr := os.Getenv("CONNSTR")
+	if connstr == "" || *queriesFile == "" {
+		fmt.Println("Error: CONNSTR environment variable and -queries are required")
+		os.Exit(1)
+	}
+	setupTarget(connstr)
+
+	var dropper autoai.CacheDropper
+	switch *drop {
+	case "evict":
+		dropper = autoai.EvictCacheDrop{SizeMB: *evictMB}
+	case "restart":
+		if *restartURL == "" {
+			fmt.Println("Error: -restart-url is required for restart")
+			os.Exit(1)
+		}
+		dropper = autoai.RestartCacheDrop{URL: *restartURL, Token: os.Getenv("CACHE_RESTART_TOKEN")}
+	case "sql":
+		if *dropSQL == "" {
+			fmt.Println("Error: -drop-sql is required for sql")
+			os.Exit(1)
+		}
+		dropper = autoai.SQLCacheDrop{SQL: *dropSQL}
+	default:
+		fmt.Println("Error: unknown -drop", *drop)
+		os.Exit(1)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	pool := connectHistory()
+	defer pool.Close()
+	dbHistory := autoai.NewDBHistory(pool)
+	if err := dbHistory.Migrate(); err != nil {
+		fmt.Println("Error: failed to migrate history schema:", err)
+		os.Exit(1)
+	}
+	runID, err := dbHistory.StartRun(labels, runMetadata(*queriesFile, ""))
+	if err != nil {
+		fmt.Println("Error: failed to start run:", err)
+		os.Exit(1)
+	}
+	ctx = log.With(ctx, zap.Int("run_id", runID))
+	autoai.DetectServerVersion(ctx, connstr, dbHistory)
+
+	launcher := autoai.NewLauncher(dbHistory, launcherConfig())
+	results, err := launcher.RunCacheSource(ctx, connstr, &autoai.FileSource{Path: *queriesFile}, autoai.CacheConfig{
+		Dropper:    dropper,
+		Executions: *executions,
+		PerQuery:   *perQuery,
+	})
+	if err != nil {
+		fmt.Println("Error: cache experiment failed:", err)
+		os.Exit(1)
+	}
+	_ = autoai.PrintCacheResults(os.Stdout, results)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/petuhovskiy/overload/autoai"
+	"github.com/petuhovskiy/overload/internal/log"
+	"go.uber.org/zap"
+)
+
+// runCapacity adds connections running a trivial query until they fail and reports the limit.
+func runCapacity(args []string) {
+	fs := flag.NewFlagSet("capacity", flag.ExitOnError)
+	labels := labelsFlag{}
+	fs.Var(labels, "label", "attach label to the run, in key=value format (repeatable)")
+	query := fs.String("query", "", "query executed by every connection (default SELECT 1)")
+	start := fs.Int("start", 0, "connections of the first step (default 10)")
+	step := fs.Int("step", 0, "connections added on every step (default 10)")
+	maxConns := fs.Int("max", 0, "stop the ramp at this number of connections (default 10000)")
+	stepDuration := fs.Duration("step-duration", 0, "duration of every step (default 10s)")
+	latencyCeiling := fs.Duration("latency-ceiling", 0, "max p99 latency of a successful step (default 100ms)")
+	_ = fs.Parse(args)
+
+	connstr := os.Getenv("CONNSTR")
+	if connstr == "" {
+		fmt.Println("Error: CONNSTR environment variable not set")
+		os.Exit(1)
+	}
+	setupTarget(connstr)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	pool := connectHistory()
+	defer pool.Close()
+	dbHistory := autoai.NewDBHistory(pool)
+	if err := dbHistory.Migrate(); err != nil {
+		fmt.Println("Error: failed to migrate history schema:", err)
+		os.Exit(1)
+	}
+	metadata := runMetadata("", "")
+	metadata["mode"] = "capacity"
+	runID, err := dbHistory.StartRun(labels, metadata)
+	if err != nil {
+		fmt.Println("Error: failed to start run:", err)
+		os.Exit(1)
+	}
+	ctx = log.With(ctx, zap.Int("run_id", runID))
+	autoai.DetectServerVersion(ctx, connstr, dbHistory)
+
+	launcher := autoai.NewLauncher(dbHistory, launcherConfig())
+	result, err := launcher.RunCapacity(ctx, connstr, autoai.CapacityConfig{
+		Query:          *query,
+		StartConns:     *start,
+		Step:           *step,
+		MaxConns:       *maxConns,
+		StepDuration:   *stepDuration,
+		LatencyCeiling: *latencyCeiling,
+	})
+	_ = autoai.PrintCapacityResult(os.Stdout, result)
+	if err != nil && ctx.Err() == nil {
+		fmt.Println("Error: capacity probe failed:", err)
+		os.Exit(1)
+	}
+}
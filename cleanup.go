@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/petuhovskiy/overload/autoai"
+)
+
+// runCleanup drops tables, indexes and schemas created in the target database by a run.
+func runCleanup(args []string) {
+	fs := flag.NewFlagSet("cleanup", flag.ExitOnError)
+	runID := fs.Int("run-id", 0, "run that created the objects")
+	dryRun := fs.Bool("dry-run", false, "print the objects without dropping them")
+	unverified := fs.Bool("unverified", false, "also drop objects which may have been created outside the run")
+	_ = fs.Parse(args)
+
+	if *runID == 0 {
+		fmt.Println("Error: -run-id is required")
+		os.Exit(1)
+	}
+	connstr := os.Getenv("CONNSTR")
+	if connstr == "" {
+		fmt.Println("Error: CONNSTR environment variable not set")
+		os.Exit(1)
+	}
+	setupTarget(connstr)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	pool := connectHistory()
+	defer pool.Close()
+	dbHistory := autoai.NewDBHistory(pool)
+	if err := dbHistory.Migrate(); err != nil {
+		fmt.Println("Error: failed to migrate history schema:", err)
+		os.Exit(1)
+	}
+
+	dropped, skipped, err := autoai.Cleanup(ctx, connstr, dbHistory, *runID, *dryRun, *unverified)
+	verb := "Dropped"
+	if *dryRun {
+		verb = "Would drop"
+	}
+	for _, o := range dropped {
+		fmt.Println(verb, o)
+	}
+	for _, o := range skipped {
+		fmt.Println("Skipped unverified", o)
+	}
+	if len(skipped) > 0 {
+		fmt.Println("Objects may have been created outside the run, use -unverified to drop them")
+	}
+	if err != nil {
+		fmt.Println("Error: cleanup failed:", err)
+		os.Exit(1)
+	}
+	if len(dropped) == 0 {
+		fmt.Println("No objects of run", *runID, "left to drop")
+	}
+}
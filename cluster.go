@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/petuhovskiy/overload/api"
+	"github.com/petuhovskiy/overload/autoai"
+	"github.com/petuhovskiy/overload/internal/clientstats"
+	"github.com/petuhovskiy/overload/internal/log"
+	"github.com/petuhovskiy/overload/internal/server"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+)
+
+// runCoordinate distributes a workload between agents and waits for them to finish.
+func runCoordinate(args []string) {
+	fs := flag.NewFlagSet("coordinate", flag.ExitOnError)
+	addr := fs.String("addr", "localhost:50052", "address to listen on, non-loopback addresses require API_TOKEN or mTLS")
+	agents := fs.Int("agents", 1, "number of agents to wait for")
+	preset := fs.String("preset", "", "built-in preset to run")
+	queriesFile := fs.String("queries", "", "query file to run")
+	labels := labelsFlag{}
+	fs.Var(labels, "label", "attach label to the run, in key=value format (repeatable)")
+	_ = fs.Parse(args)
+
+	if (*preset == "") == (*queriesFile == "") {
+		fmt.Println("Error: exactly one of -preset and -queries is required")
+		os.Exit(1)
+	}
+	var queries string
+	if *queriesFile != "" {
+		content, err := os.ReadFile(*queriesFile)
+		if err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+		queries = string(content)
+	}
+
+	pool := connectHistory()
+	defer pool.Close()
+	dbHistory := autoai.NewDBHistory(pool)
+	if err := dbHistory.Migrate(); err != nil {
+		fmt.Println("Error: failed to migrate history schema:", err)
+		os.Exit(1)
+	}
+
+	security := apiSecurity()
+	opts, err := security.ServerOptions(*addr)
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	conf := server.CoordinatorConfig{
+		Agents:  *agents,
+		Preset:  *preset,
+		Queries: queries,
+		Labels:  labels,
+	}
+	// the schema is set up once here, agents only run the workload
+	if *preset != "" {
+		connstr := os.Getenv("CONNSTR")
+		if connstr == "" {
+			fmt.Println("Error: CONNSTR environment variable is required to set up the preset")
+			os.Exit(1)
+		}
+		if err := conf.SetupSchema(ctx, connstr); err != nil {
+			fmt.Println("Error: failed to set up preset:", err)
+			os.Exit(1)
+		}
+	}
+
+	listener, err := net.Listen("tcp", *addr)
+	if err != nil {
+		fmt.Println("Error: failed to listen:", err)
+		os.Exit(1)
+	}
+
+	coordinator := server.NewCoordinator(dbHistory, conf)
+	grpcServer := grpc.NewServer(opts...)
+	api.RegisterCoordinatorServer(grpcServer, coordinator)
+
+	go func() {
+		if err := grpcServer.Serve(listener); err != nil {
+			log.Error(ctx, "coordinator server failed", zap.Error(err))
+			cancel()
+		}
+	}()
+	log.Info(ctx, "waiting for agents", zap.String("addr", listener.Addr().String()), zap.Int("agents", *agents), zap.Stringer("security", security))
+
+	coordinator.Wait(ctx)
+	grpcServer.Stop()
+}
+
+// runAgent executes workload shards assigned by the coordinator against CONNSTR.
+func runAgent(args []string) {
+	hostname, _ := os.Hostname()
+
+	fs := flag.NewFlagSet("agent", flag.ExitOnError)
+	coordinatorAddr := fs.String("coordinator", "localhost:50052", "address of the coordinator")
+	name := fs.String("name", fmt.Sprintf("%s-%d", hostname, os.Getpid()), "name of the agent")
+	_ = fs.Parse(args)
+
+	connstr := os.Getenv("CONNSTR")
+	if connstr == "" {
+		fmt.Println("Error: CONNSTR environment variable not set")
+		os.Exit(1)
+	}
+	setupTarget(connstr)
+
+	pool := connectHistory()
+	defer pool.Close()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	startHealth(ctx, connstr, pool)
+	startMetrics(ctx)
+	go clientstats.Default.Run(ctx, time.Second)
+	defer clientstats.Default.LogSummary(ctx)
+
+	err := server.RunAgent(ctx, pool, server.AgentConfig{
+		Coordinator: *coordinatorAddr,
+		Name:        *name,
+		Connstr:     connstr,
+		Launcher:    launcherConfig(),
+		Supervisor:  supervisorConfig(),
+		Security:    apiSecurity(),
+	})
+	if err != nil && ctx.Err() == nil {
+		fmt.Println("Error: agent failed:", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/petuhovskiy/overload/autoai"
+	"github.com/petuhovskiy/overload/internal/log"
+	"go.uber.org/zap"
+)
+
+// runCommit runs write queries with synchronous_commit on and off and reports the difference.
+func runCommit(args []string) {
+	fs := flag.NewFlagSet("commit", flag.ExitOnError)
+	labels := labelsFlag{}
+	fs.Var(labels, "label", "attach label to the run, in key=value format (repeatable)")
+	queriesFile := fs.String("queries", "", "queries to run, in the .sql file format")
+	conns := fs.Int("conns", 16, "connections executing every query")
+	duration := fs.Duration("duration", 0, "duration of every mode (default 1m)")
+	split := fs.Bool("split", false, "run both modes at the same time on half of the connections each")
+	_ = fs.Parse(args)
+
+	connstr := os.Getenv("CONNSTR")
+	if connstr == "" || *queriesFile == "" {
+		fmt.Println("Error: CONNSTR environment variable and -queries are required")
+		os.Exit(1)
+	}
+	setupTarget(connstr)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	pool := connectHistory()
+	defer pool.Close()
+	dbHistory := autoai.NewDBHistory(pool)
+	if err := dbHistory.Migrate(); err != nil {
+		fmt.Println("Error: failed to migrate history schema:", err)
+		os.Exit(1)
+	}
+	runID, err := dbHistory.StartRun(labels, runMetadata(*queriesFile, ""))
+	if err != nil {
+		fmt.Println("Error: failed to start run:", err)
+		os.Exit(1)
+	}
+	ctx = log.With(ctx, zap.Int("run_id", runID))
+	autoai.DetectServerVersion(ctx, connstr, dbHistory)
+
+	launcher := autoai.NewLauncher(dbHistory, launcherConfig())
+	results, err := launcher.RunCommitSource(ctx, connstr, &autoai.FileSource{Path: *queriesFile}, autoai.CommitConfig{
+		Conns:    *conns,
+		Duration: *duration,
+		Split:    *split,
+	})
+	_ = autoai.PrintCommitResults(os.Stdout, results)
+	if err != nil && ctx.Err() == nil {
+		fmt.Println("Error: commit comparison failed:", err)
+		os.Exit(1)
+	}
+}
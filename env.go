@@ -0,0 +1,267 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/petuhovskiy/overload/autoai"
+	"github.com/petuhovskiy/overload/ingest"
+	"github.com/petuhovskiy/overload/internal/alert"
+	"github.com/petuhovskiy/overload/internal/backfill"
+	"github.com/petuhovskiy/overload/internal/bloat"
+	"github.com/petuhovskiy/overload/internal/multi"
+	"github.com/petuhovskiy/overload/internal/noise"
+	"github.com/petuhovskiy/overload/internal/server"
+)
+
+// envFloat parses float environment variable, returns zero if it's not set.
+func envFloat(name string) float64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0
+	}
+	res, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		fmt.Printf("Error: invalid %s: %v\n", name, err)
+		os.Exit(1)
+	}
+	return res
+}
+
+// envInt parses int environment variable, returns zero if it's not set.
+func envInt(name string) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0
+	}
+	res, err := strconv.Atoi(value)
+	if err != nil {
+		fmt.Printf("Error: invalid %s: %v\n", name, err)
+		os.Exit(1)
+	}
+	return res
+}
+
+// envDuration parses duration environment variable, returns zero if it's not set.
+func envDuration(name string) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0
+	}
+	res, err := time.ParseDuration(value)
+	if err != nil {
+		fmt.Printf("Error: invalid %s: %v\n", name, err)
+		os.Exit(1)
+	}
+	return res
+}
+
+// envVars parses a comma-separated list of name=value pairs with int values, like
+// "pruned=9,cross_partition=1", returns nil if it's not set.
+func envVars(name string) map[string]int {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil
+	}
+	res := map[string]int{}
+	for _, pair := range strings.Split(value, ",") {
+		key, val, ok := strings.Cut(pair, "=")
+		n, err := strconv.Atoi(strings.TrimSpace(val))
+		if !ok || err != nil {
+			fmt.Printf("Error: invalid %s: %q is not name=value\n", name, pair)
+			os.Exit(1)
+		}
+		res[strings.TrimSpace(key)] = n
+	}
+	return res
+}
+
+// supervisorConfig reads the restart policy of supervised jobs from environment variables.
+func supervisorConfig() multi.SupervisorConfig {
+	return multi.SupervisorConfig{
+		MaxRestarts:   envInt("MAX_RESTARTS"),
+		RestartWindow: envDuration("RESTART_WINDOW"),
+	}
+}
+
+// apiSecurity returns authentication settings of the gRPC services.
+func apiSecurity() server.Security {
+	return server.Security{
+		Token:    os.Getenv("API_TOKEN"),
+		CertFile: os.Getenv("API_TLS_CERT"),
+		KeyFile:  os.Getenv("API_TLS_KEY"),
+		CAFile:   os.Getenv("API_TLS_CA"),
+	}
+}
+
+// envList parses a comma-separated list environment variable, returns nil if it's not set.
+func envList(name string) []string {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil
+	}
+	var res []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			res = append(res, item)
+		}
+	}
+	return res
+}
+
+// parseCompressibility parses a payload compressibility between 0 and 1, returns nil if it's empty.
+func parseCompressibility(value string) (*float64, error) {
+	if value == "" {
+		return nil, nil
+	}
+	res, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || res < 0 || res > 1 {
+		return nil, fmt.Errorf("compressibility %q is not between 0 and 1", value)
+	}
+	return &res, nil
+}
+
+// envCompressibility parses a payload compressibility environment variable, returns nil if it's not set.
+func envCompressibility(name string) *float64 {
+	res, err := parseCompressibility(os.Getenv(name))
+	if err != nil {
+		fmt.Printf("Error: invalid %s: %v\n", name, err)
+		os.Exit(1)
+	}
+	return res
+}
+
+// alertConfig reads alerting thresholds from environment variables.
+func alertConfig() alert.Config {
+	return alert.Config{
+		P99Latency:     envDuration("ALERT_P99_LATENCY"),
+		ErrorRate:      envFloat("ALERT_ERROR_RATE"),
+		ReplicationLag: envDuration("ALERT_REPLICATION_LAG"),
+		DBSize:         uint64(envInt("ALERT_DB_SIZE")),
+		WebhookURL:     os.Getenv("ALERT_WEBHOOK_URL"),
+	}
+}
+
+// launcherConfig reads launcher settings from environment variables.
+func launcherConfig() autoai.LauncherConfig {
+	return autoai.LauncherConfig{
+		ArrivalRate:  envFloat("ARRIVAL_RATE"),
+		MaxInFlight:  envInt("MAX_IN_FLIGHT"),
+		TokenBucket:  os.Getenv("TOKEN_BUCKET") == "1",
+		BucketSize:   envInt("TOKEN_BUCKET_SIZE"),
+		Adaptive:     os.Getenv("ADAPTIVE") == "1",
+		LatencySLO:   envDuration("LATENCY_SLO"),
+		MaxErrorRate: envFloat("MAX_ERROR_RATE"),
+
+		BreakerFailureRate: envFloat("BREAKER_FAILURE_RATE"),
+		StatementTimeout:   envDuration("STATEMENT_TIMEOUT"),
+		SkipExplainAnalyze: os.Getenv("EXPLAIN_ANALYZE") == "0",
+		Alerts:             alertConfig(),
+		ConnectPerQuery:    os.Getenv("CONNECT_PER_QUERY") == "1",
+		SSLMode:            os.Getenv("SSLMODE"),
+		SSLRootCert:        os.Getenv("SSLROOTCERT"),
+		SSLCert:            os.Getenv("SSLCERT"),
+		SSLKey:             os.Getenv("SSLKEY"),
+		SynchronousCommit:  os.Getenv("SYNCHRONOUS_COMMIT"),
+		MaxConns:           envInt("MAX_CONNS"),
+		IterationDuration:  envDuration("ITERATION_DURATION"),
+		RampIterations:     envInt("RAMP_ITERATIONS"),
+		RampStart:          envInt("RAMP_START"),
+		RampMultiplier:     envFloat("RAMP_MULTIPLIER"),
+		ThinkTime:          envDuration("THINK_TIME"),
+
+		SerializationRetries:   envInt("SERIALIZATION_RETRIES"),
+		ActivitySampleInterval: envDuration("ACTIVITY_SAMPLE_INTERVAL"),
+
+		TwoPhaseCommit: os.Getenv("TWO_PHASE_COMMIT") == "1",
+		PrepareDwell:   envDuration("PREPARE_DWELL"),
+		OrphanRate:     envFloat("ORPHAN_RATE"),
+		MixWindow:      envDuration("MIX_WINDOW"),
+		Seed:           uint64(envInt("SEED")),
+	}
+}
+
+// diskConfig reads disk-full forecasting settings from environment variables.
+func diskConfig() ingest.DiskConfig {
+	return ingest.DiskConfig{
+		Quota:       uint64(envInt("DISK_QUOTA")),
+		WarnBefore:  envDuration("DISK_WARN_BEFORE"),
+		PauseBefore: envDuration("DISK_PAUSE_BEFORE"),
+		Databases:   envList("STATS_DATABASES"),
+	}
+}
+
+// warmupConfig reads dataset seeding settings from environment variables.
+func warmupConfig() ingest.WarmupConfig {
+	conf := ingest.WarmupConfig{
+		Fill: ingest.FillConfig{
+			Ingest:  ingest.Config{TableName: os.Getenv("WARMUP_TABLE")},
+			Workers: envInt("WARMUP_WORKERS"),
+		},
+		MinRows:   int64(envInt("WARMUP_ROWS")),
+		MinDBSize: int64(envInt("WARMUP_DB_SIZE")),
+	}
+	if name := os.Getenv("WARMUP_METHOD"); name != "" {
+		for _, m := range ingest.Methods {
+			if m.Name == name {
+				conf.Fill.Method = m
+			}
+		}
+		if conf.Fill.Method.Run == nil {
+			fmt.Printf("Error: invalid WARMUP_METHOD: unknown ingest method %q\n", name)
+			os.Exit(1)
+		}
+	}
+	return conf
+}
+
+// indexAdviceConfig reads index advice settings from environment variables.
+func indexAdviceConfig() autoai.IndexAdviceConfig {
+	return autoai.IndexAdviceConfig{
+		Mode:      os.Getenv("INDEX_ADVICE"),
+		Threshold: envDuration("INDEX_ADVICE_THRESHOLD"),
+		Duration:  envDuration("INDEX_ADVICE_DURATION"),
+		Conns:     envInt("INDEX_ADVICE_CONNS"),
+	}
+}
+
+// backfillConfig reads online backfill settings from environment variables.
+func backfillConfig() backfill.Config {
+	return backfill.Config{
+		Table:       os.Getenv("BACKFILL_TABLE"),
+		AddColumn:   os.Getenv("BACKFILL_ADD_COLUMN"),
+		Set:         os.Getenv("BACKFILL_SET"),
+		Where:       os.Getenv("BACKFILL_WHERE"),
+		KeyColumn:   os.Getenv("BACKFILL_KEY"),
+		BatchSize:   envInt("BACKFILL_BATCH_SIZE"),
+		Sleep:       envDuration("BACKFILL_SLEEP"),
+		StartDelay:  envDuration("BACKFILL_START_DELAY"),
+		LockTimeout: envDuration("BACKFILL_LOCK_TIMEOUT"),
+	}
+}
+
+// noiseConfig reads background noise workload settings from environment variables.
+func noiseConfig() noise.Config {
+	return noise.Config{
+		QPS:       envFloat("NOISE_QPS"),
+		Conns:     envInt("NOISE_CONNS"),
+		TableName: os.Getenv("NOISE_TABLE"),
+		ReadRatio: envFloat("NOISE_READ_RATIO"),
+	}
+}
+
+// bloatConfig reads bloat reporting settings from environment variables.
+func bloatConfig() bloat.Config {
+	var tables []string
+	if value := os.Getenv("BLOAT_TABLES"); value != "" {
+		tables = strings.Split(value, ",")
+	}
+	return bloat.Config{
+		Interval: envDuration("BLOAT_INTERVAL"),
+		Tables:   tables,
+		Exact:    os.Getenv("BLOAT_EXACT") == "1",
+	}
+}
@@ -0,0 +1,100 @@
+// Package errs defines kinds of failures returned by the public APIs of ingest and autoai,
+// so that embedding programs can branch on them with errors.Is instead of matching messages.
+// Errors of a kind keep the message and the chain of the original error.
+package errs
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+var (
+	// ErrConnect is a failure to connect or authenticate to the database.
+	ErrConnect = errors.New("connect")
+	// ErrTimeout is an execution canceled by the statement timeout.
+	ErrTimeout = errors.New("timeout")
+	// ErrGeneration is a failure to generate queries or advice with the model.
+	ErrGeneration = errors.New("generation")
+	// ErrValidation is an invalid configuration, connection string or workload.
+	ErrValidation = errors.New("validation")
+)
+
+// kindError marks the error with its kind, without changing the message.
+type kindError struct {
+	kind error
+	err  error
+}
+
+func (e *kindError) Error() string {
+	return e.err.Error()
+}
+
+func (e *kindError) Unwrap() []error {
+	return []error{e.kind, e.err}
+}
+
+// wrap marks err with the kind, nil and errors of the kind are returned as is.
+func wrap(kind, err error) error {
+	if err == nil || errors.Is(err, kind) {
+		return err
+	}
+	return &kindError{kind: kind, err: err}
+}
+
+// Connect marks err as ErrConnect.
+func Connect(err error) error {
+	return wrap(ErrConnect, err)
+}
+
+// Timeout marks err as ErrTimeout.
+func Timeout(err error) error {
+	return wrap(ErrTimeout, err)
+}
+
+// Generation marks err as ErrGeneration.
+func Generation(err error) error {
+	return wrap(ErrGeneration, err)
+}
+
+// Validation marks err as ErrValidation.
+func Validation(err error) error {
+	return wrap(ErrValidation, err)
+}
+
+// Validationf formats a new ErrValidation error.
+func Validationf(format string, args ...any) error {
+	return Validation(fmt.Errorf(format, args...))
+}
+
+// ClientCode is the code of errors not reported by the server, e.g. network errors.
+const ClientCode = "client"
+
+// SQLSTATE codes of server errors handled by the tool.
+const (
+	CodeActiveSQLTransaction = "25001"
+	CodeSerializationFailure = "40001"
+	CodeDuplicateObject      = "42710"
+	CodeDiskFull             = "53100"
+	CodeOutOfMemory          = "53200"
+	CodeTooManyConnections   = "53300"
+	CodeLockNotAvailable     = "55P03"
+	CodeQueryCanceled        = "57014"
+	CodeCannotConnectNow     = "57P03"
+)
+
+// SQLSTATE classes, the first two characters of the codes.
+const (
+	ClassConnectionException   = "08"
+	ClassInsufficientResources = "53"
+)
+
+// Code returns SQLSTATE of the error, or ClientCode for errors not reported by the server.
+func Code(err error) string {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code
+	}
+	return ClientCode
+}
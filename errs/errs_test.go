@@ -0,0 +1,41 @@
+package errs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"server", &pgconn.PgError{Code: "23505"}, "23505"},
+		{"wrapped", fmt.Errorf("insert failed: %w", &pgconn.PgError{Code: "40001"}), "40001"},
+		{"kind", Timeout(&pgconn.PgError{Code: "57014"}), "57014"},
+		{"network", errors.New("connection reset by peer"), ClientCode},
+		{"context", context.DeadlineExceeded, ClientCode},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, Code(tt.err))
+		})
+	}
+}
+
+func TestKinds(t *testing.T) {
+	base := errors.New("dial tcp: connection refused")
+	err := Connect(base)
+	require.ErrorIs(t, err, ErrConnect)
+	require.ErrorIs(t, err, base)
+	require.Equal(t, base.Error(), err.Error())
+	require.Same(t, err, Connect(err), "errors of the kind are not wrapped again")
+	require.NoError(t, Validation(nil))
+	require.ErrorIs(t, Validationf("bad %s", "config"), ErrValidation)
+}
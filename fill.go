@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/petuhovskiy/overload/ingest"
+)
+
+// runFill inserts an exact number of rows into the table and verifies the final count.
+func runFill(args []string) {
+	fs := flag.NewFlagSet("fill", flag.ExitOnError)
+	rows := fs.Int64("rows", 0, "exact number of rows to insert")
+	methodName := fs.String("method", "copy", "ingest method: copy, generate or values")
+	workers := fs.Int("workers", 1, "concurrent connections, rows are split between them")
+	table := fs.String("table", "", "table to insert into (default data42)")
+	batchSize := fs.Int("batch", 0, "rows per batch (default 1000000)")
+	timeOrdered := fs.Bool("time-ordered", false, "generate mtime increasing with the insertion time")
+	batchesPerCommit := fs.Int("batches-per-commit", 1, "batches per transaction of every worker")
+	compressibilityFlag := fs.String("compressibility", "", "fraction of the filler made of a repeated character, from 0 (random) to 1 (constant)")
+	_ = fs.Parse(args)
+
+	connstr := os.Getenv("CONNSTR")
+	if connstr == "" || *rows <= 0 {
+		fmt.Println("Error: CONNSTR environment variable and -rows are required")
+		os.Exit(1)
+	}
+	compressibility, err := parseCompressibility(*compressibilityFlag)
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+	setupTarget(connstr)
+
+	var method *ingest.Method
+	for _, m := range ingest.Methods {
+		if m.Name == *methodName {
+			method = &m
+		}
+	}
+	if method == nil {
+		fmt.Println("Error: unknown method", *methodName)
+		os.Exit(1)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	summary, err := ingest.Fill(ctx, connstr, ingest.FillConfig{
+		Ingest: ingest.Config{
+			TableName:   *table,
+			BatchSize:   *batchSize,
+			TimeOrdered: *timeOrdered,
+			Rows:        *rows,
+
+			BatchesPerCommit: *batchesPerCommit,
+			Compressibility:  compressibility,
+		},
+		Method:  *method,
+		Workers: *workers,
+	})
+	ingest.PrintFillSummary(os.Stdout, summary)
+	if err != nil {
+		fmt.Println("Error: fill failed:", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/petuhovskiy/overload/internal/dbconn"
+	"github.com/petuhovskiy/overload/internal/health"
+	"github.com/petuhovskiy/overload/internal/log"
+	"go.uber.org/zap"
+)
+
+// startHealth serves /healthz and /readyz on HEALTH_ADDR, if set. Readiness requires
+// the target database from connstr and the history database to be reachable.
+func startHealth(ctx context.Context, connstr string, history *pgxpool.Pool) {
+	addr := os.Getenv("HEALTH_ADDR")
+	if addr == "" {
+		return
+	}
+
+	health.Default.AddCheck("target", func(ctx context.Context) error {
+		conn, err := dbconn.Connect(ctx, connstr)
+		if err != nil {
+			return err
+		}
+		return conn.Close(ctx)
+	})
+	health.Default.AddCheck("history", history.Ping)
+	go health.Default.Run(ctx)
+
+	go func() {
+		log.Info(ctx, "health server started", zap.String("addr", addr))
+		err := http.ListenAndServe(addr, health.Default.Handler())
+		log.Error(ctx, "health server stopped", zap.Error(err))
+	}()
+}
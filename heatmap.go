@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/petuhovskiy/overload/autoai"
+)
+
+// runHeatmap exports per-second latency histograms of a single execution record as CSV.
+func runHeatmap(args []string) {
+	fs := flag.NewFlagSet("heatmap", flag.ExitOnError)
+	id := fs.Int("id", 0, "id of the query_exec_info record")
+	out := fs.String("out", "", "output file, stdout if empty")
+	_ = fs.Parse(args)
+
+	pool := connectHistory()
+	defer pool.Close()
+	dbHistory := autoai.NewDBHistory(pool)
+
+	info, err := dbHistory.LoadQueryExecInfo(*id)
+	if err != nil {
+		fmt.Println("Error: failed to load history:", err)
+		os.Exit(1)
+	}
+
+	var stats struct {
+		Series []autoai.SeriesPoint
+	}
+	if err := json.Unmarshal(info.Info.(json.RawMessage), &stats); err != nil {
+		fmt.Println("Error: failed to parse stats:", err)
+		os.Exit(1)
+	}
+
+	w := os.Stdout
+	if *out != "" {
+		w, err = os.Create(*out)
+		if err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+		defer w.Close()
+	}
+
+	if err := autoai.WriteHeatmapCSV(w, stats.Series); err != nil {
+		fmt.Println("Error: failed to write heatmap:", err)
+		os.Exit(1)
+	}
+}
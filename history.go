@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/petuhovskiy/overload/autoai"
+)
+
+// runHistory dispatches `history` subcommands.
+func runHistory(args []string) {
+	if len(args) == 0 {
+		fmt.Println("Error: history subcommand is required: leaderboard, grafana-export, search")
+		os.Exit(1)
+	}
+
+	switch args[0] {
+	case "leaderboard":
+		runHistoryLeaderboard(args[1:])
+	case "grafana-export":
+		runHistoryGrafanaExport(args[1:])
+	case "search":
+		runHistorySearch(args[1:])
+	default:
+		fmt.Println("Error: unknown history subcommand", args[0])
+		os.Exit(1)
+	}
+}
+
+// runHistoryLeaderboard prints the best and the worst queries across all runs.
+func runHistoryLeaderboard(args []string) {
+	fs := flag.NewFlagSet("history leaderboard", flag.ExitOnError)
+	limit := fs.Int("n", 10, "number of queries in each table")
+	_ = fs.Parse(args)
+
+	pool := connectHistory()
+	defer pool.Close()
+	dbHistory := autoai.NewDBHistory(pool)
+
+	leaderboard, err := dbHistory.Leaderboard(*limit)
+	if err != nil {
+		fmt.Println("Error: failed to load leaderboard:", err)
+		os.Exit(1)
+	}
+
+	if err := leaderboard.Print(os.Stdout); err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+}
+
+// runHistoryGrafanaExport writes Grafana provisioning files: the datasource pointing
+// to the history database and the dashboard visualizing it.
+func runHistoryGrafanaExport(args []string) {
+	fs := flag.NewFlagSet("history grafana-export", flag.ExitOnError)
+	dir := fs.String("dir", "grafana", "output directory, mounted as /etc/grafana/provisioning")
+	datasource := fs.String("datasource", "overload-history", "uid of the Postgres datasource")
+	_ = fs.Parse(args)
+
+	dashboard, err := json.MarshalIndent(autoai.GrafanaDashboard(*datasource), "", "  ")
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+
+	// datasource is provisioned from LOGS_CONNSTR, if it's set. The password is not written
+	// to the file, Grafana expands the placeholder from its environment.
+	datasourceYAML := ""
+	if logsConnstr := os.Getenv("LOGS_CONNSTR"); logsConnstr != "" {
+		config, err := pgx.ParseConfig(logsConnstr)
+		if err != nil {
+			fmt.Println("Error: invalid LOGS_CONNSTR:", err)
+			os.Exit(1)
+		}
+		datasourceYAML = fmt.Sprintf(`apiVersion: 1
+datasources:
+  - name: overload history
+    uid: %s
+    type: grafana-postgresql-datasource
+    url: %s:%d
+    user: %s
+    jsonData:
+      database: %s
+      sslmode: %s
+    secureJsonData:
+      password: $%s
+`, *datasource, config.Host, config.Port, config.User, config.Database, grafanaSSLMode(config), grafanaPasswordEnv)
+		if config.Password != "" {
+			fmt.Printf("set %s in the environment of Grafana to the password of LOGS_CONNSTR\n", grafanaPasswordEnv)
+		}
+	}
+
+	dashboardsYAML := `apiVersion: 1
+providers:
+  - name: overload
+    type: file
+    options:
+      path: /etc/grafana/provisioning/dashboards
+`
+
+	files := map[string][]byte{
+		"dashboards/overload.json": dashboard,
+		"dashboards/overload.yaml": []byte(dashboardsYAML),
+	}
+	if datasourceYAML != "" {
+		files["datasources/overload.yaml"] = []byte(datasourceYAML)
+	}
+
+	for name, content := range files {
+		path := filepath.Join(*dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+		if err := os.WriteFile(path, content, 0o644); err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+		fmt.Println("written", path)
+	}
+}
+
+// grafanaPasswordEnv is the environment variable of Grafana the datasource password is read from.
+const grafanaPasswordEnv = "OVERLOAD_HISTORY_PASSWORD"
+
+// grafanaSSLMode returns the sslmode of the connection config for the Grafana datasource, which
+// can't fall back to another mode: prefer is provisioned as require and allow as disable.
+func grafanaSSLMode(config *pgx.ConnConfig) string {
+	switch tls := config.TLSConfig; {
+	case tls == nil:
+		return "disable"
+	case !tls.InsecureSkipVerify:
+		return "verify-full"
+	case tls.VerifyPeerCertificate != nil:
+		return "verify-ca"
+	default:
+		return "require"
+	}
+}
+
+// runHistorySearch prints generated queries matching the search term.
+func runHistorySearch(args []string) {
+	fs := flag.NewFlagSet("history search", flag.ExitOnError)
+	limit := fs.Int("n", 20, "max number of results")
+	exact := fs.Bool("exact", false, "match term as a substring of the query instead of full-text search")
+	_ = fs.Parse(args)
+
+	term := strings.Join(fs.Args(), " ")
+	if term == "" {
+		fmt.Println("Error: search term is required")
+		os.Exit(1)
+	}
+
+	pool := connectHistory()
+	defer pool.Close()
+	dbHistory := autoai.NewDBHistory(pool)
+
+	queries, err := dbHistory.SearchGeneratedQueries(term, *exact, *limit)
+	if err != nil {
+		fmt.Println("Error: failed to search history:", err)
+		os.Exit(1)
+	}
+
+	for _, q := range queries {
+		fmt.Printf("-- #%d %s %s\n%s\n\n", q.ID, q.CreatedAt, q.ModelUsed, q.GeneratedSQL)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/petuhovskiy/overload/ingest"
+	"github.com/petuhovskiy/overload/internal/alert"
+	"github.com/petuhovskiy/overload/internal/metrics"
+	"github.com/petuhovskiy/overload/internal/multi"
+)
+
+// runIngest ingests rows with the method into the table until interrupted or for the duration,
+// reporting database growth every second.
+func runIngest(args []string) {
+	if len(args) == 0 || args[0] == "-h" || args[0] == "-help" {
+		fmt.Println("Usage: ingest copy|generate|values [flags]")
+		os.Exit(1)
+	}
+	var method *ingest.Method
+	for i := range ingest.Methods {
+		if ingest.Methods[i].Name == args[0] {
+			method = &ingest.Methods[i]
+		}
+	}
+	if method == nil {
+		fmt.Println("Error: unknown ingest method", args[0])
+		os.Exit(1)
+	}
+
+	fs := flag.NewFlagSet("ingest "+method.Name, flag.ExitOnError)
+	workers := fs.Int("workers", 10, "concurrent connections")
+	duration := fs.Duration("duration", 0, "stop after the duration, runs until interrupted by default")
+	table := fs.String("table", "", "table to insert into (default data42)")
+	batchSize := fs.Int("batch", 0, "rows per batch (default 1000000)")
+	batchesPerCommit := fs.Int("batches-per-commit", 1, "batches per transaction of every worker")
+	retryBatches := fs.Bool("retry-batches", false, "replay batches of transactions lost with the connection, unless they were committed")
+	timeOrdered := fs.Bool("time-ordered", false, "generate mtime increasing with the insertion time")
+	rowWidth := fs.Int("row-width", 0, "data width of a row in bytes, the filler is sized to fit (default 46)")
+	compressibilityFlag := fs.String("compressibility", "", "fraction of the filler made of a repeated character, from 0 (random) to 1 (constant)")
+	hypertable := fs.Bool("hypertable", false, "create the table as a TimescaleDB hypertable")
+	partitioned := fs.Bool("partitioned", false, "create the table with native range partitioning by mtime")
+	chunkInterval := fs.Duration("chunk-interval", 0, "chunk interval of the hypertable or partition interval (default 24h)")
+	distributeBy := fs.String("distribute-by", "", "create the table as a Citus distributed table sharded by this column")
+	_ = fs.Parse(args[1:])
+
+	connstr := os.Getenv("CONNSTR")
+	if connstr == "" {
+		fmt.Println("Error: CONNSTR environment variable not set")
+		os.Exit(1)
+	}
+	compressibility, err := parseCompressibility(*compressibilityFlag)
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+	setupTarget(connstr)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	if *duration > 0 {
+		ctx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+	}
+
+	conf := ingest.Config{
+		TableName:     *table,
+		BatchSize:     *batchSize,
+		TimeOrdered:   *timeOrdered,
+		Hypertable:    *hypertable,
+		Partitioned:   *partitioned,
+		ChunkInterval: *chunkInterval,
+		RowWidth:      *rowWidth,
+
+		DistributionColumn: *distributeBy,
+		BatchesPerCommit:   *batchesPerCommit,
+		RetryBatches:       *retryBatches,
+		Compressibility:    compressibility,
+	}
+	conf.Normalize()
+	// the table is created once, so that workers don't race on DDL
+	if err := ingest.CreateTable(ctx, connstr, conf); err != nil {
+		fmt.Println("Error: failed to create table:", err)
+		os.Exit(1)
+	}
+
+	go ingest.ReportUploadSpeed(ctx, connstr, alert.New(alertConfig()), diskConfig())
+	go metrics.Default.RunFlush(ctx, 10*time.Second)
+	startMetrics(ctx)
+
+	supervisor := multi.NewSupervisor(supervisorConfig())
+	supervisor.RunMany(ctx, *workers, "ingest", func(ctx context.Context) error {
+		return method.Run(ctx, connstr, conf)
+	})
+	supervisor.LogSummary(context.Background())
+}
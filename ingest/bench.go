@@ -0,0 +1,159 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/petuhovskiy/overload/internal/clientstats"
+	"github.com/petuhovskiy/overload/internal/compat"
+	"github.com/petuhovskiy/overload/internal/dbconn"
+	"github.com/petuhovskiy/overload/internal/log"
+	"github.com/petuhovskiy/overload/internal/metrics"
+	"github.com/petuhovskiy/overload/internal/multi"
+	"go.uber.org/zap"
+)
+
+// Method is an ingestion strategy.
+type Method struct {
+	Name string
+	Run  func(ctx context.Context, connstr string, conf Config) error
+}
+
+// Methods are all available ingestion strategies.
+var Methods = []Method{
+	{Name: "copy", Run: RunCopy},
+	{Name: "generate", Run: RunGenerate},
+	{Name: "values", Run: RunValues},
+}
+
+// BenchConfig configures the comparison of ingestion methods.
+type BenchConfig struct {
+	Ingest Config
+	// Duration of every method run.
+	Duration time.Duration
+	// Workers is the number of concurrent connections per method.
+	Workers int
+}
+
+func (conf *BenchConfig) Normalize() {
+	conf.Ingest.Normalize()
+
+	if conf.Duration == 0 {
+		conf.Duration = time.Minute
+	}
+
+	if conf.Workers == 0 {
+		conf.Workers = 1
+	}
+}
+
+// BenchResult holds measurements of a single method run.
+type BenchResult struct {
+	Method      string
+	Rows        int64
+	RowsPerSec  float64
+	MBPerSec    float64
+	WALMBPerSec float64
+	// ClientCPU is the fraction of a single core used by the process.
+	ClientCPU float64
+	Error     error
+}
+
+// BenchMethods runs every method for the same duration with the same settings, starting
+// from an empty table each time, and returns the results in the order of methods.
+func BenchMethods(ctx context.Context, connstr string, conf BenchConfig, methods []Method) ([]BenchResult, error) {
+	conf.Normalize()
+
+	conn, err := dbconn.Connect(ctx, connstr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close(context.Background())
+
+	if err := createTable(ctx, conn, conf.Ingest); err != nil {
+		return nil, fmt.Errorf("failed to create table: %w", err)
+	}
+
+	var results []BenchResult
+	for _, method := range methods {
+		ctx := log.With(ctx, zap.String("method", method.Name))
+		log.Info(ctx, "benchmarking ingest method", zap.Duration("duration", conf.Duration))
+
+		res, err := benchMethod(ctx, conn, connstr, conf, method)
+		if err != nil {
+			return results, err
+		}
+		log.Info(ctx, "ingest method finished", zap.Any("result", res))
+		if conf.Ingest.Hypertable {
+			logChunks(ctx, conn, conf.Ingest.TableName)
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+func benchMethod(ctx context.Context, conn *pgx.Conn, connstr string, conf BenchConfig, method Method) (BenchResult, error) {
+	res := BenchResult{Method: method.Name}
+
+	if _, err := conn.Exec(ctx, fmt.Sprintf("TRUNCATE %s", conf.Ingest.TableName)); err != nil {
+		return res, fmt.Errorf("failed to truncate table: %w", err)
+	}
+
+	// WAL volume is not measured on engines without WAL functions
+	startLSN, err := compat.WALPosition(ctx, conn)
+	if err != nil && !errors.Is(err, compat.ErrUnsupported) {
+		return res, err
+	}
+	rowsCounter := metrics.Default.Counter("ingest_rows_total", "method", method.Name, "table", conf.Ingest.TableName)
+	startRows := rowsCounter.Value()
+	startCPU := clientstats.CPUTime()
+	start := time.Now()
+
+	runCtx, cancel := context.WithTimeout(ctx, conf.Duration)
+	res.Error = multi.RunWorkers(runCtx, conf.Workers, func(ctx context.Context, _ int) error {
+		return method.Run(ctx, connstr, conf.Ingest)
+	})
+	cancel()
+
+	elapsed := time.Since(start).Seconds()
+	cpu := clientstats.CPUTime() - startCPU
+
+	var walBytes int64
+	if startLSN != "" {
+		walBytes, err = compat.WALBytesSince(ctx, conn, startLSN)
+		if err != nil {
+			return res, err
+		}
+	}
+	tableBytes, err := compat.RelationSize(ctx, conn, conf.Ingest.TableName)
+	if err != nil && !errors.Is(err, compat.ErrUnsupported) {
+		return res, err
+	}
+
+	res.Rows = rowsCounter.Value() - startRows
+	res.RowsPerSec = float64(res.Rows) / elapsed
+	res.MBPerSec = float64(tableBytes) / elapsed / (1 << 20)
+	res.WALMBPerSec = float64(walBytes) / elapsed / (1 << 20)
+	res.ClientCPU = cpu.Seconds() / elapsed
+	return res, nil
+}
+
+// PrintBenchResults prints the comparison table.
+func PrintBenchResults(w io.Writer, results []BenchResult) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "METHOD\tROWS\tROWS/S\tMB/S\tWAL MB/S\tCLIENT CPU\tERROR")
+	for _, r := range results {
+		errText := ""
+		if r.Error != nil {
+			errText = r.Error.Error()
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%.0f\t%.1f\t%.1f\t%.0f%%\t%s\n",
+			r.Method, r.Rows, r.RowsPerSec, r.MBPerSec, r.WALMBPerSec, r.ClientCPU*100, errText)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,30 @@
+package ingest
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// createDistributedTable distributes the table across Citus workers by the column,
+// it's a no-op if the table is already distributed.
+func createDistributedTable(ctx context.Context, conn *pgx.Conn, tableName, column string) error {
+	if _, err := conn.Exec(ctx, "CREATE EXTENSION IF NOT EXISTS citus"); err != nil {
+		return fmt.Errorf("failed to create citus extension: %w", err)
+	}
+
+	var distributed bool
+	err := conn.QueryRow(ctx, `
+		SELECT EXISTS (SELECT 1 FROM pg_dist_partition WHERE logicalrelid = $1::regclass)`,
+		tableName).Scan(&distributed)
+	if err != nil || distributed {
+		return err
+	}
+
+	_, err = conn.Exec(ctx, `SELECT create_distributed_table($1::regclass::text, $2)`, tableName, column)
+	if err != nil {
+		return fmt.Errorf("failed to create distributed table: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,324 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/petuhovskiy/overload/internal/log"
+	"github.com/petuhovskiy/overload/internal/metrics"
+	"github.com/petuhovskiy/overload/internal/reconnect"
+	"go.uber.org/zap"
+)
+
+const (
+	// txStatusPollInterval is the pause between checks of a transaction whose backend hasn't noticed
+	// the lost connection yet.
+	txStatusPollInterval = 100 * time.Millisecond
+	// progressInterval is how often every worker logs its ingest progress.
+	progressInterval = 2 * time.Second
+)
+
+// batchFunc executes a single batch on the connection and returns the number of inserted rows.
+// It can be called again with a new connection when the batch is replayed.
+type batchFunc func(ctx context.Context, conn *pgx.Conn) (int64, error)
+
+// committer groups batches into explicit transactions of BatchesPerCommit batches.
+// With a single batch per commit every batch is an implicit transaction. Rows are counted
+// in ingest_rows_total when they are committed.
+//
+// With RetryBatches every transaction is explicit and its xid is remembered. When the connection
+// is lost, the committer reconnects, checks whether the transaction was committed and replays
+// its batches if it wasn't, so that every batch is applied exactly once.
+type committer struct {
+	conn    *pgx.Conn
+	connect func(ctx context.Context) (*pgx.Conn, error)
+	batches int
+	rows    *metrics.Counter
+	latency *metrics.Histogram
+
+	retryBatches bool
+	reconnect    reconnect.Config
+	committed    *metrics.Counter
+	replayed     *metrics.Counter
+
+	inTx        bool
+	pending     int
+	pendingRows int64
+
+	// xid and pid identify the open transaction, replay holds its batches, with RetryBatches
+	xid      int64
+	pid      uint32
+	replay   []batchFunc
+	lastRows int64
+
+	// committed rows of the worker, for progress logs
+	started        time.Time
+	total          int64
+	lastReport     time.Time
+	lastReportRows int64
+}
+
+func newCommitter(conn *pgx.Conn, connect func(ctx context.Context) (*pgx.Conn, error), conf Config, method string) *committer {
+	return &committer{
+		conn:         conn,
+		connect:      connect,
+		batches:      conf.BatchesPerCommit,
+		rows:         metrics.Default.Counter("ingest_rows_total", "method", method, "table", conf.TableName),
+		latency:      metrics.Default.Histogram("ingest_commit_seconds", "method", method, "table", conf.TableName),
+		retryBatches: conf.RetryBatches,
+		reconnect:    conf.Reconnect,
+		committed:    metrics.Default.Counter("ingest_recovered_total", "method", method, "table", conf.TableName, "outcome", "committed"),
+		replayed:     metrics.Default.Counter("ingest_recovered_total", "method", method, "table", conf.TableName, "outcome", "replayed"),
+		started:      time.Now(),
+		lastReport:   time.Now(),
+	}
+}
+
+// count counts committed rows and logs the progress of the worker every progressInterval.
+func (c *committer) count(ctx context.Context, rows int64) {
+	c.rows.Add(rows)
+	c.total += rows
+
+	now := time.Now()
+	if now.Sub(c.lastReport) < progressInterval {
+		return
+	}
+	log.Info(ctx, "ingest progress",
+		zap.Int64("rows_inserted", c.total),
+		zap.Float64("rows_per_second", float64(c.total-c.lastReportRows)/now.Sub(c.lastReport).Seconds()),
+		zap.Duration("elapsed", now.Sub(c.started)),
+	)
+	c.lastReport, c.lastReportRows = now, c.total
+}
+
+// enabled returns true if batches are grouped into explicit transactions.
+func (c *committer) enabled() bool {
+	return c.batches > 1 || c.retryBatches
+}
+
+// exec executes the batch in the current transaction and commits it after every BatchesPerCommit
+// batches, returns the number of inserted rows.
+func (c *committer) exec(ctx context.Context, batch batchFunc) (int64, error) {
+	if !c.retryBatches {
+		if err := c.begin(ctx); err != nil {
+			return 0, fmt.Errorf("failed to begin transaction: %w", err)
+		}
+		var n int64
+		err := c.retry(ctx, func() error {
+			var err error
+			n, err = batch(ctx, c.conn)
+			return err
+		})
+		if err != nil {
+			return 0, err
+		}
+		return n, c.batchDone(ctx, n)
+	}
+
+	c.replay = append(c.replay, batch)
+	from := len(c.replay) - 1
+	for {
+		n, err := c.apply(ctx, from)
+		if err == nil {
+			return n, nil
+		}
+		if !c.conn.IsClosed() || ctx.Err() != nil {
+			return 0, err
+		}
+		log.Warn(ctx, "connection lost during ingest batch, recovering", zap.Int64("xid", c.xid), zap.Error(err))
+		committed, err := c.recover(ctx)
+		if err != nil {
+			return 0, err
+		}
+		if committed {
+			return c.lastRows, nil
+		}
+		from = 0
+	}
+}
+
+// apply executes batches of the replay list starting from the index in the current transaction,
+// and commits it if it's full. It returns the number of rows of the last batch.
+func (c *committer) apply(ctx context.Context, from int) (int64, error) {
+	if err := c.begin(ctx); err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	for _, batch := range c.replay[from:] {
+		n, err := batch(ctx, c.conn)
+		if err != nil {
+			return 0, err
+		}
+		c.pending++
+		c.pendingRows += n
+		c.lastRows = n
+	}
+	if c.pending < max(1, c.batches) {
+		return c.lastRows, nil
+	}
+	return c.lastRows, c.commit(ctx)
+}
+
+// recover reconnects after the connection was lost and resolves the open transaction. It returns
+// true if the transaction was committed, otherwise all its batches must be replayed.
+func (c *committer) recover(ctx context.Context) (bool, error) {
+	conn, err := reconnect.Connect(ctx, c.reconnect, "ingest", c.connect)
+	if err != nil {
+		return false, err
+	}
+	c.conn = conn
+
+	if c.inTx {
+		committed, err := c.txCommitted(ctx)
+		if err != nil {
+			return false, fmt.Errorf("failed to check transaction %d: %w", c.xid, err)
+		}
+		if committed {
+			// the commit was applied, only its acknowledgement was lost
+			log.Info(ctx, "lost transaction was committed", zap.Int64("xid", c.xid))
+			c.committed.Inc()
+			c.count(ctx, c.pendingRows)
+			c.reset()
+			return true, nil
+		}
+	}
+
+	log.Info(ctx, "replaying batches of lost transaction", zap.Int64("xid", c.xid), zap.Int("batches", len(c.replay)))
+	c.replayed.Inc()
+	c.inTx, c.pending, c.pendingRows = false, 0, 0
+	return false, nil
+}
+
+// txCommitted returns the final status of the open transaction, its backend is terminated
+// if it's still running, e.g. the server hasn't noticed the lost connection yet.
+func (c *committer) txCommitted(ctx context.Context) (bool, error) {
+	for {
+		var status *string
+		if err := c.conn.QueryRow(ctx, "SELECT txid_status($1)", c.xid).Scan(&status); err != nil {
+			return false, err
+		}
+		switch {
+		case status == nil:
+			return false, errors.New("transaction status is unknown")
+		case *status != "in progress":
+			return *status == "committed", nil
+		}
+
+		if _, err := c.conn.Exec(ctx, "SELECT pg_terminate_backend($1)", c.pid); err != nil {
+			return false, err
+		}
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-time.After(txStatusPollInterval):
+		}
+	}
+}
+
+// begin starts a transaction before the batch, if there is no open one.
+func (c *committer) begin(ctx context.Context) error {
+	if !c.enabled() || c.inTx {
+		return nil
+	}
+	if !c.retryBatches {
+		if _, err := c.conn.Exec(ctx, "BEGIN"); err != nil {
+			return err
+		}
+		c.inTx = true
+		return nil
+	}
+
+	if _, err := c.conn.Exec(ctx, "BEGIN"); err != nil {
+		return err
+	}
+	if err := c.conn.QueryRow(ctx, "SELECT txid_current()").Scan(&c.xid); err != nil {
+		if !c.conn.IsClosed() {
+			_, _ = c.conn.Exec(ctx, "ROLLBACK")
+		}
+		return err
+	}
+	c.pid = c.conn.PgConn().PID()
+	c.inTx = true
+	return nil
+}
+
+// batchDone counts rows of the batch and commits the transaction after every BatchesPerCommit batches.
+func (c *committer) batchDone(ctx context.Context, rows int64) error {
+	if !c.enabled() {
+		c.count(ctx, rows)
+		return nil
+	}
+	c.pending++
+	c.pendingRows += rows
+	if c.pending < c.batches {
+		return nil
+	}
+	return c.commit(ctx)
+}
+
+// commit commits the open transaction, if any.
+func (c *committer) commit(ctx context.Context) error {
+	if !c.inTx {
+		return nil
+	}
+	start := time.Now()
+	_, err := c.conn.Exec(ctx, "COMMIT")
+	if err != nil && c.retryBatches && c.conn.IsClosed() {
+		// the outcome is resolved after reconnecting
+		return err
+	}
+	rows := c.pendingRows
+	c.reset()
+	if err != nil {
+		return err
+	}
+	c.count(ctx, rows)
+	c.latency.Observe(time.Since(start).Seconds())
+	return nil
+}
+
+// reset forgets the open transaction.
+func (c *committer) reset() {
+	c.inTx, c.pending, c.pendingRows = false, 0, 0
+	c.replay = c.replay[:0]
+}
+
+// finish commits batches inserted so far when ingest stops, even if the context is done.
+func (c *committer) finish() error {
+	ctx := context.Background()
+	if !c.retryBatches {
+		return c.commit(ctx)
+	}
+	for len(c.replay) > 0 {
+		if c.inTx {
+			err := c.commit(ctx)
+			if err == nil || !c.conn.IsClosed() {
+				return err
+			}
+		}
+		committed, err := c.recover(ctx)
+		if err != nil || committed {
+			return err
+		}
+		if _, err := c.apply(ctx, 0); err != nil && !c.conn.IsClosed() {
+			return err
+		}
+	}
+	return nil
+}
+
+// close closes the current connection.
+func (c *committer) close() {
+	c.conn.Close(context.Background())
+}
+
+// retry executes the batch with retries, unless it's a part of an explicit transaction,
+// where a failed batch aborts the whole transaction.
+func (c *committer) retry(ctx context.Context, batch func() error) error {
+	if c.enabled() {
+		return batch()
+	}
+	return withRetries(ctx, c.conn, batch)
+}
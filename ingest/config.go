@@ -3,18 +3,71 @@ package ingest
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/petuhovskiy/overload/internal/reconnect"
 )
 
 const (
-	defaultTableName = "data42"
-	defaultBatchSize = 1000000
+	defaultTableName     = "data42"
+	defaultBatchSize     = 1000000
+	defaultChunkInterval = 24 * time.Hour
+	// defaultFillerWidth is the width of filler in pgbench_history.
+	defaultFillerWidth = 22
+	// rowFixedWidth is the data width of all columns except filler: four ints and a timestamp.
+	rowFixedWidth = 4*4 + 8
 )
 
 type Config struct {
 	TableName string
 	BatchSize int
+	Reconnect reconnect.Config
+
+	// Hypertable creates the table as a TimescaleDB hypertable partitioned by mtime,
+	// with chunks of ChunkInterval. Data is generated in time order.
+	Hypertable    bool
+	ChunkInterval time.Duration
+	// Partitioned creates the table with native range partitioning by mtime, with partitions
+	// of ChunkInterval covering the last 30 days and the next 7 days, and a default partition.
+	Partitioned bool
+	// DistributionColumn creates the table as a Citus distributed table sharded by this column,
+	// e.g. aid. Rows have uniformly distributed values of all columns, so they are spread evenly.
+	DistributionColumn string
+
+	// TimeOrdered generates mtime increasing with the insertion time instead of random
+	// timestamps within the last 30 days.
+	TimeOrdered bool
+
+	// ForeignKeys is the number of foreign keys of the table (up to 3: bid, tid, aid), referencing
+	// parent tables seeded with all generated values. AuditTrigger adds a row-level trigger
+	// copying every inserted row into the audit table as jsonb.
+	ForeignKeys  int
+	AuditTrigger bool
+
+	// BatchesPerCommit wraps this many batches into a single explicit transaction, to study
+	// the effect of commit frequency. Zero or one means every batch is committed separately.
+	// Batches of an open transaction are lost if ingest is interrupted in the middle of a batch.
+	BatchesPerCommit int
+
+	// RetryBatches makes every transaction explicit and remembers its xid. Batches are kept
+	// until commit, and after a reconnect the lost transaction is checked with txid_status:
+	// its batches are replayed only if it wasn't committed, so that network blips neither
+	// lose nor duplicate rows. It costs an extra round trip per transaction.
+	RetryBatches bool
+
+	// Rows is the exact number of rows to insert before returning, the last batch is cut
+	// to fit. Zero means ingest until the context is done.
+	Rows int64
+
+	// RowWidth is the data width of a row in bytes, the filler column is sized to fit.
+	// Zero keeps the 22-character filler of pgbench_history, 46 bytes per row.
+	RowWidth int
+
+	// Compressibility is the fraction of the filler made of a repeated character, the rest
+	// is random, from 0 (random, hard to compress) to 1 (constant). Nil keeps the payload
+	// of the method: random for copy and values, a zero-padded sequence number for generate.
+	Compressibility *float64
 }
 
 func (conf *Config) Normalize() {
@@ -25,10 +78,46 @@ func (conf *Config) Normalize() {
 	if conf.BatchSize == 0 {
 		conf.BatchSize = defaultBatchSize
 	}
+
+	if conf.ChunkInterval == 0 {
+		conf.ChunkInterval = defaultChunkInterval
+	}
+}
+
+// nextBatch returns the size of the next batch after inserted rows, zero when all rows are inserted.
+func (conf *Config) nextBatch(inserted int64) int {
+	if conf.Rows == 0 {
+		return conf.BatchSize
+	}
+	return int(min(int64(conf.BatchSize), conf.Rows-inserted))
+}
+
+// fillerWidth returns the number of characters in the filler column.
+func (conf *Config) fillerWidth() int {
+	if conf.RowWidth == 0 {
+		return defaultFillerWidth
+	}
+	return max(1, conf.RowWidth-rowFixedWidth)
+}
+
+// repeatedWidth returns the number of repeated characters at the start of the filler,
+// or -1 if the method payload is used.
+func (conf *Config) repeatedWidth() int {
+	if conf.Compressibility == nil {
+		return -1
+	}
+	ratio := min(1, max(0, *conf.Compressibility))
+	return int(ratio*float64(conf.fillerWidth()) + 0.5)
+}
+
+// timeOrdered returns true if mtime of generated rows should increase with the insertion time.
+func (conf *Config) timeOrdered() bool {
+	return conf.TimeOrdered || conf.Hypertable
 }
 
-// createTable creates table if not exists.
-// It uses default schema for pgbench_history.
+// createTable creates table if not exists, partitioned or converted to a hypertable or a distributed
+// table, and adds foreign keys and the audit trigger if configured.
+// It uses default schema for pgbench_history, with filler of RowWidth.
 //
 // CREATE TABLE pgbench_history (
 //
@@ -40,7 +129,11 @@ func (conf *Config) Normalize() {
 //	filler char(22)
 //
 // );
-func createTable(ctx context.Context, conn *pgx.Conn, tableName string) error {
+func createTable(ctx context.Context, conn *pgx.Conn, conf Config) error {
+	partitionBy := ""
+	if conf.Partitioned {
+		partitionBy = "PARTITION BY RANGE (mtime)"
+	}
 	_, err := conn.Exec(ctx, fmt.Sprintf(`
 		CREATE TABLE IF NOT EXISTS %s (
 			tid int,
@@ -48,8 +141,34 @@ func createTable(ctx context.Context, conn *pgx.Conn, tableName string) error {
 			aid int,
 			delta int,
 			mtime timestamp,
-			filler char(22)
-		);
-	`, tableName))
-	return err
+			filler char(%d)
+		) %s;
+	`, conf.TableName, conf.fillerWidth(), partitionBy))
+	if err != nil {
+		return err
+	}
+	if conf.Partitioned {
+		if err := createPartitions(ctx, conn, conf.TableName, conf.ChunkInterval, time.Now()); err != nil {
+			return err
+		}
+	}
+	if conf.Hypertable {
+		if err := createHypertable(ctx, conn, conf.TableName, conf.ChunkInterval); err != nil {
+			return err
+		}
+	}
+	if conf.DistributionColumn != "" {
+		if err := createDistributedTable(ctx, conn, conf.TableName, conf.DistributionColumn); err != nil {
+			return err
+		}
+	}
+	if conf.ForeignKeys > 0 {
+		if err := addForeignKeys(ctx, conn, conf.TableName, conf.ForeignKeys); err != nil {
+			return err
+		}
+	}
+	if conf.AuditTrigger {
+		return addAuditTrigger(ctx, conn, conf.TableName)
+	}
+	return nil
 }
@@ -0,0 +1,126 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/petuhovskiy/overload/errs"
+)
+
+// foreignKey is a column of the ingest table referencing a parent table, generated values
+// of the column are always in [0, rows), so the parent has all of them.
+type foreignKey struct {
+	column string
+	rows   int
+}
+
+// foreignKeys are the columns that can reference parents, in the order they are added,
+// cheapest parent first.
+var foreignKeys = []foreignKey{
+	{column: "bid", rows: 10_000},
+	{column: "tid", rows: 100_000},
+	{column: "aid", rows: 10_000_000},
+}
+
+// addForeignKeys creates and seeds parent tables and adds n foreign keys to the table,
+// it's a no-op for keys that already exist.
+func addForeignKeys(ctx context.Context, conn *pgx.Conn, tableName string, n int) error {
+	if n > len(foreignKeys) {
+		return errs.Validationf("at most %d foreign keys are supported", len(foreignKeys))
+	}
+	for _, fk := range foreignKeys[:n] {
+		parent := parentTable(tableName, fk.column)
+		// concurrent workers seed the same parent, conflicting rows are skipped
+		_, err := conn.Exec(ctx, fmt.Sprintf(`
+			CREATE TABLE IF NOT EXISTS %[1]s (id int PRIMARY KEY);
+			INSERT INTO %[1]s SELECT generate_series(0, %[2]d - 1)
+			WHERE NOT EXISTS (SELECT 1 FROM %[1]s)
+			ON CONFLICT DO NOTHING`, parent, fk.rows))
+		if err != nil {
+			return fmt.Errorf("failed to create parent table %s: %w", parent, err)
+		}
+
+		_, err = conn.Exec(ctx, fmt.Sprintf(`ALTER TABLE %s ADD CONSTRAINT %s FOREIGN KEY (%s) REFERENCES %s (id)`,
+			tableName, foreignKeyName(tableName, fk.column), fk.column, parent))
+		if err != nil && !isDuplicateObject(err) {
+			return fmt.Errorf("failed to add foreign key on %s: %w", fk.column, err)
+		}
+	}
+	return nil
+}
+
+// dropForeignKeys drops all foreign keys of the table, parent tables are kept.
+func dropForeignKeys(ctx context.Context, conn *pgx.Conn, tableName string) error {
+	for _, fk := range foreignKeys {
+		_, err := conn.Exec(ctx, fmt.Sprintf(`ALTER TABLE %s DROP CONSTRAINT IF EXISTS %s`,
+			tableName, foreignKeyName(tableName, fk.column)))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addAuditTrigger adds a row-level trigger copying every inserted row into the audit table,
+// it's a no-op if the trigger already exists.
+func addAuditTrigger(ctx context.Context, conn *pgx.Conn, tableName string) error {
+	audit := auditTable(tableName)
+	_, err := conn.Exec(ctx, fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %[1]s (
+			id bigint GENERATED BY DEFAULT AS IDENTITY,
+			op text NOT NULL,
+			row_data jsonb NOT NULL,
+			changed_at timestamptz NOT NULL DEFAULT now()
+		);
+		CREATE OR REPLACE FUNCTION %[2]s() RETURNS trigger LANGUAGE plpgsql AS $$
+		BEGIN
+			INSERT INTO %[1]s (op, row_data) VALUES (TG_OP, to_jsonb(NEW));
+			RETURN NEW;
+		END
+		$$`, audit, auditFunction(tableName)))
+	if err != nil {
+		return fmt.Errorf("failed to create audit table: %w", err)
+	}
+
+	_, err = conn.Exec(ctx, fmt.Sprintf(`CREATE TRIGGER %s AFTER INSERT ON %s FOR EACH ROW EXECUTE FUNCTION %s()`,
+		auditTrigger(tableName), tableName, auditFunction(tableName)))
+	if err != nil && !isDuplicateObject(err) {
+		return fmt.Errorf("failed to create audit trigger: %w", err)
+	}
+	return nil
+}
+
+// dropAuditTrigger drops the audit trigger, the audit table is kept.
+func dropAuditTrigger(ctx context.Context, conn *pgx.Conn, tableName string) error {
+	_, err := conn.Exec(ctx, fmt.Sprintf(`DROP TRIGGER IF EXISTS %s ON %s`, auditTrigger(tableName), tableName))
+	return err
+}
+
+func parentTable(tableName, column string) string {
+	return tableName + "_" + column + "_parent"
+}
+
+func foreignKeyName(tableName, column string) string {
+	return tableName + "_" + column + "_fkey"
+}
+
+func auditTable(tableName string) string {
+	return tableName + "_audit"
+}
+
+func auditFunction(tableName string) string {
+	return tableName + "_audit_insert"
+}
+
+func auditTrigger(tableName string) string {
+	return tableName + "_audit"
+}
+
+// isDuplicateObject returns true if the constraint or trigger was created concurrently.
+func isDuplicateObject(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == errs.CodeDuplicateObject
+}
@@ -0,0 +1,169 @@
+package ingest
+
+import (
+	"context"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/petuhovskiy/overload/internal/log"
+	"github.com/petuhovskiy/overload/internal/metrics"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultWarnBefore = time.Hour
+	// growthWindow is the period used to measure the growth rate, per-second growth is too noisy
+	growthWindow = time.Minute
+	// pauseTimeout is how long a pause lasts without being confirmed by a new forecast, so that
+	// ingest isn't paused forever if the stats reporter can't reach the server anymore.
+	pauseTimeout = 30 * time.Second
+)
+
+type DiskConfig struct {
+	// Quota is the max database size in bytes. If not set, the limit reported by the server
+	// is used (neon.max_cluster_size), forecasting is disabled if there is none. Free space
+	// of the server's disk is not visible over SQL, so there is no other source.
+	Quota uint64
+	// WarnBefore is the time to full below which a warning is logged, default 1h.
+	WarnBefore time.Duration
+	// PauseBefore is the time to full below which ingest is paused, zero disables pausing.
+	// Ingest is resumed when the forecast goes back above, e.g. after the quota is raised
+	// or the data is removed.
+	PauseBefore time.Duration
+	// Databases are tracked in addition to the current database, reporting size and growth
+	// of each of them. A single "*" tracks all databases on the instance.
+	Databases []string
+}
+
+func (conf *DiskConfig) Normalize() {
+	if conf.WarnBefore == 0 {
+		conf.WarnBefore = defaultWarnBefore
+	}
+}
+
+// pausedUntil is the time in unix nanoseconds until which ingest is paused because the disk
+// is about to be full, zero if it's not paused. Every forecast extends it by pauseTimeout.
+var pausedUntil atomic.Int64
+
+func isPaused() bool {
+	return time.Now().UnixNano() < pausedUntil.Load()
+}
+
+// waitDiskSpace blocks while ingest is paused, re-checking the pause every second.
+// It returns false if the context is done.
+func waitDiskSpace(ctx context.Context) bool {
+	for isPaused() {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(time.Second):
+		}
+	}
+	if until := pausedUntil.Load(); until != 0 && pausedUntil.CompareAndSwap(until, 0) {
+		log.Warn(ctx, "resuming ingest, disk forecast is not updated", zap.Duration("timeout", pauseTimeout))
+	}
+	return ctx.Err() == nil
+}
+
+// serverQuota returns the database size limit reported by the server, zero if unknown.
+func serverQuota(ctx context.Context, conn *pgx.Conn) uint64 {
+	var setting *string
+	err := conn.QueryRow(ctx, `SELECT current_setting('neon.max_cluster_size', true)`).Scan(&setting)
+	if err != nil || setting == nil {
+		return 0
+	}
+	// megabytes, -1 means unlimited
+	mb, err := strconv.ParseInt(*setting, 10, 64)
+	if err != nil || mb <= 0 {
+		return 0
+	}
+	return uint64(mb) << 20
+}
+
+// diskForecaster estimates when the database reaches the quota, from the growth over the last minute.
+type diskForecaster struct {
+	conf    DiskConfig
+	quota   uint64
+	history []statsSnapshot
+	// rate is the growth in bytes per second. It's not updated while ingest is paused,
+	// so that ingest is resumed only when there is enough space for the previous rate.
+	rate   float64
+	warned bool
+}
+
+// record adds the snapshot and returns the estimated time to full, negative if the database
+// doesn't grow.
+func (f *diskForecaster) record(snapshot statsSnapshot) time.Duration {
+	f.history = append(f.history, snapshot)
+	for len(f.history) > 2 && snapshot.Timestamp.Sub(f.history[1].Timestamp) >= growthWindow {
+		f.history = f.history[1:]
+	}
+
+	if !isPaused() {
+		first := f.history[0]
+		f.rate = 0
+		if elapsed := snapshot.Timestamp.Sub(first.Timestamp).Seconds(); elapsed > 0 {
+			f.rate = (float64(snapshot.DatabaseSize) - float64(first.DatabaseSize)) / elapsed
+		}
+	}
+
+	if snapshot.DatabaseSize >= f.quota {
+		return 0
+	}
+	if f.rate <= 0 {
+		return -1
+	}
+	left := float64(f.quota - snapshot.DatabaseSize)
+	return time.Duration(left / f.rate * float64(time.Second))
+}
+
+// check updates the forecast, warns when the database is about to be full and pauses ingest
+// if configured. It returns the estimated time to full, negative if it's unknown.
+func (f *diskForecaster) check(ctx context.Context, snapshot statsSnapshot) time.Duration {
+	if f.quota == 0 {
+		return -1
+	}
+	timeToFull := f.record(snapshot)
+	metrics.Default.Gauge("disk_quota_used_ratio").Set(float64(snapshot.DatabaseSize) / float64(f.quota))
+	if timeToFull < 0 {
+		metrics.Default.Gauge("disk_time_to_full_seconds").Set(-1)
+		f.warned = false
+		f.setPaused(ctx, false, timeToFull)
+		return timeToFull
+	}
+	metrics.Default.Gauge("disk_time_to_full_seconds").Set(timeToFull.Seconds())
+
+	if timeToFull < f.conf.WarnBefore {
+		if !f.warned {
+			log.Warn(ctx, "database is about to be full",
+				zap.Duration("time_to_full", timeToFull.Round(time.Second)),
+				zap.String("quota", humanizeBytes(int64(f.quota))),
+			)
+		}
+		f.warned = true
+	} else {
+		f.warned = false
+	}
+
+	f.setPaused(ctx, f.conf.PauseBefore > 0 && timeToFull < f.conf.PauseBefore, timeToFull)
+	return timeToFull
+}
+
+func (f *diskForecaster) setPaused(ctx context.Context, pause bool, timeToFull time.Duration) {
+	wasPaused := isPaused()
+	if pause {
+		pausedUntil.Store(time.Now().Add(pauseTimeout).UnixNano())
+	} else {
+		pausedUntil.Store(0)
+	}
+	if wasPaused == pause {
+		return
+	}
+	if pause {
+		log.Warn(ctx, "pausing ingest, database is about to be full", zap.Duration("time_to_full", timeToFull.Round(time.Second)))
+	} else {
+		log.Info(ctx, "resuming ingest")
+	}
+}
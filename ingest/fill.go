@@ -0,0 +1,144 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/petuhovskiy/overload/errs"
+	"github.com/petuhovskiy/overload/internal/compat"
+	"github.com/petuhovskiy/overload/internal/dbconn"
+	"github.com/petuhovskiy/overload/internal/log"
+	"go.uber.org/zap"
+)
+
+// FillConfig configures one-shot ingestion of an exact number of rows.
+type FillConfig struct {
+	// Ingest.Rows is the total number of rows, split between workers.
+	Ingest  Config
+	Method  Method
+	Workers int
+}
+
+func (conf *FillConfig) Normalize() {
+	conf.Ingest.Normalize()
+
+	if conf.Workers == 0 {
+		conf.Workers = 1
+	}
+
+	if conf.Method.Run == nil {
+		conf.Method = Methods[0]
+	}
+}
+
+// FillSummary is the outcome of one-shot ingestion.
+type FillSummary struct {
+	Method     string
+	Rows       int64
+	Elapsed    time.Duration
+	RowsPerSec float64
+	// Before and After are the row counts of the table, After - Before must be equal to Rows.
+	Before     int64
+	After      int64
+	TableBytes int64
+}
+
+// Fill inserts exactly conf.Ingest.Rows rows into the table with concurrent workers, then
+// verifies that the table has grown by that number of rows. The table must not be modified
+// by anyone else during the fill.
+func Fill(ctx context.Context, connstr string, conf FillConfig) (FillSummary, error) {
+	conf.Normalize()
+	summary := FillSummary{Method: conf.Method.Name, Rows: conf.Ingest.Rows}
+	if conf.Ingest.Rows <= 0 {
+		return summary, errs.Validationf("number of rows is required")
+	}
+
+	conn, err := dbconn.Connect(ctx, connstr)
+	if err != nil {
+		return summary, err
+	}
+	defer conn.Close(context.Background())
+
+	if err := createTable(ctx, conn, conf.Ingest); err != nil {
+		return summary, fmt.Errorf("failed to create table: %w", err)
+	}
+	if summary.Before, err = countRows(ctx, conn, conf.Ingest.TableName); err != nil {
+		return summary, err
+	}
+
+	start := time.Now()
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+	)
+	for i := 0; i < conf.Workers; i++ {
+		workerConf := conf.Ingest
+		// a batch lost to a network blip would break the exact count
+		workerConf.RetryBatches = true
+		// the first workers insert the remainder
+		workerConf.Rows = conf.Ingest.Rows / int64(conf.Workers)
+		if int64(i) < conf.Ingest.Rows%int64(conf.Workers) {
+			workerConf.Rows++
+		}
+		if workerConf.Rows == 0 {
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := conf.Method.Run(ctx, connstr, workerConf); err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	summary.Elapsed = time.Since(start)
+	summary.RowsPerSec = float64(summary.Rows) / summary.Elapsed.Seconds()
+	if err := errors.Join(errs...); err != nil {
+		return summary, err
+	}
+	if err := ctx.Err(); err != nil {
+		return summary, err
+	}
+
+	if summary.After, err = countRows(ctx, conn, conf.Ingest.TableName); err != nil {
+		return summary, err
+	}
+	summary.TableBytes, err = compat.RelationSize(ctx, conn, conf.Ingest.TableName)
+	if err != nil && !errors.Is(err, compat.ErrUnsupported) {
+		return summary, err
+	}
+	log.Info(ctx, "fill finished", zap.Any("summary", summary))
+
+	if inserted := summary.After - summary.Before; inserted != summary.Rows {
+		return summary, fmt.Errorf("table has grown by %d rows, expected %d", inserted, summary.Rows)
+	}
+	return summary, nil
+}
+
+func countRows(ctx context.Context, conn *pgx.Conn, table string) (int64, error) {
+	var n int64
+	err := conn.QueryRow(ctx, fmt.Sprintf("SELECT count(*) FROM %s", table)).Scan(&n)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count rows: %w", err)
+	}
+	return n, nil
+}
+
+// PrintFillSummary prints the result of the fill.
+func PrintFillSummary(w io.Writer, s FillSummary) {
+	fmt.Fprintf(w, "Inserted %d rows with %s in %s (%.0f rows/s)\n", s.Rows, s.Method, s.Elapsed.Round(time.Millisecond), s.RowsPerSec)
+	fmt.Fprintf(w, "Table rows: %d -> %d\n", s.Before, s.After)
+	if s.TableBytes > 0 {
+		fmt.Fprintf(w, "Table size: %.1f MB\n", float64(s.TableBytes)/(1<<20))
+	}
+}
@@ -0,0 +1,93 @@
+package ingest
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/petuhovskiy/overload/internal/dbconn"
+	"github.com/petuhovskiy/overload/internal/log"
+	"go.uber.org/zap"
+)
+
+// overheadVariant is a configuration of the ingest table compared by BenchOverhead.
+type overheadVariant struct {
+	name         string
+	foreignKeys  int
+	auditTrigger bool
+}
+
+// BenchOverhead runs the method on the same table without constraints, with foreign keys,
+// with the audit trigger and with both, as configured by conf.Ingest.ForeignKeys and
+// conf.Ingest.AuditTrigger. Results are named after the method and the variant, e.g. "copy+fk".
+func BenchOverhead(ctx context.Context, connstr string, conf BenchConfig, method Method) ([]BenchResult, error) {
+	conf.Normalize()
+
+	variants := []overheadVariant{{name: method.Name}}
+	if conf.Ingest.ForeignKeys > 0 {
+		variants = append(variants, overheadVariant{name: method.Name + "+fk", foreignKeys: conf.Ingest.ForeignKeys})
+	}
+	if conf.Ingest.AuditTrigger {
+		variants = append(variants, overheadVariant{name: method.Name + "+trigger", auditTrigger: true})
+	}
+	if conf.Ingest.ForeignKeys > 0 && conf.Ingest.AuditTrigger {
+		variants = append(variants, overheadVariant{
+			name:         method.Name + "+fk+trigger",
+			foreignKeys:  conf.Ingest.ForeignKeys,
+			auditTrigger: true,
+		})
+	}
+
+	conn, err := dbconn.Connect(ctx, connstr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close(context.Background())
+
+	plain := conf.Ingest
+	plain.ForeignKeys, plain.AuditTrigger = 0, false
+	if err := createTable(ctx, conn, plain); err != nil {
+		return nil, fmt.Errorf("failed to create table: %w", err)
+	}
+
+	var results []BenchResult
+	for _, v := range variants {
+		ctx := log.With(ctx, zap.String("variant", v.name))
+		log.Info(ctx, "benchmarking ingest overhead", zap.Duration("duration", conf.Duration))
+
+		if err := dropForeignKeys(ctx, conn, conf.Ingest.TableName); err != nil {
+			return results, fmt.Errorf("failed to drop foreign keys: %w", err)
+		}
+		if err := dropAuditTrigger(ctx, conn, conf.Ingest.TableName); err != nil {
+			return results, fmt.Errorf("failed to drop audit trigger: %w", err)
+		}
+		if v.foreignKeys > 0 {
+			if err := addForeignKeys(ctx, conn, conf.Ingest.TableName, v.foreignKeys); err != nil {
+				return results, err
+			}
+		}
+		if v.auditTrigger {
+			if err := addAuditTrigger(ctx, conn, conf.Ingest.TableName); err != nil {
+				return results, err
+			}
+			if _, err := conn.Exec(ctx, fmt.Sprintf("TRUNCATE %s", auditTable(conf.Ingest.TableName))); err != nil {
+				return results, fmt.Errorf("failed to truncate audit table: %w", err)
+			}
+		}
+
+		// workers must not change the table set up for the variant
+		variantConf := conf
+		variantConf.Ingest.ForeignKeys, variantConf.Ingest.AuditTrigger = 0, false
+		res, err := benchMethod(ctx, conn, connstr, variantConf, method)
+		res.Method = v.name
+		if err != nil {
+			return results, err
+		}
+		log.Info(ctx, "ingest overhead variant finished", zap.Any("result", res))
+		results = append(results, res)
+	}
+
+	if err := dropForeignKeys(ctx, conn, conf.Ingest.TableName); err != nil {
+		return results, err
+	}
+	return results, dropAuditTrigger(ctx, conn, conf.Ingest.TableName)
+}
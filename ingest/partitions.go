@@ -0,0 +1,57 @@
+package ingest
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/petuhovskiy/overload/internal/dbconn"
+)
+
+const (
+	// partitionsBehind covers random timestamps of generated rows, which are within the last 30 days.
+	partitionsBehind = 30 * 24 * time.Hour
+	// partitionsAhead covers time-ordered rows inserted after the table is created.
+	partitionsAhead = 7 * 24 * time.Hour
+)
+
+// createPartitions creates range partitions of ChunkInterval covering generated timestamps
+// and a default partition for everything else, it's a no-op for existing partitions.
+func createPartitions(ctx context.Context, conn *pgx.Conn, tableName string, interval time.Duration, now time.Time) error {
+	for _, p := range partitionBounds(now, interval) {
+		_, err := conn.Exec(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s_p%s PARTITION OF %s FOR VALUES FROM ('%s') TO ('%s')`,
+			tableName, p[0].Format("20060102_1504"), tableName,
+			p[0].Format(time.DateTime), p[1].Format(time.DateTime)))
+		if err != nil {
+			return fmt.Errorf("failed to create partition: %w", err)
+		}
+	}
+	_, err := conn.Exec(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %[1]s_default PARTITION OF %[1]s DEFAULT`, tableName))
+	if err != nil {
+		return fmt.Errorf("failed to create default partition: %w", err)
+	}
+	return nil
+}
+
+// partitionBounds returns [from, to) ranges of all partitions, aligned to the interval.
+func partitionBounds(now time.Time, interval time.Duration) [][2]time.Time {
+	now = now.UTC()
+	var res [][2]time.Time
+	for from := now.Add(-partitionsBehind).Truncate(interval); from.Before(now.Add(partitionsAhead)); from = from.Add(interval) {
+		res = append(res, [2]time.Time{from, from.Add(interval)})
+	}
+	return res
+}
+
+// CreateTable creates the ingest table with all configured options, so that queries can run
+// against it before the first rows are ingested.
+func CreateTable(ctx context.Context, connstr string, conf Config) error {
+	conf.Normalize()
+	conn, err := dbconn.Connect(ctx, connstr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+	return createTable(ctx, conn, conf)
+}
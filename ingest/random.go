@@ -2,21 +2,35 @@ package ingest
 
 import (
 	"math/rand"
+	"strings"
 	"time"
 )
 
-// generateRandomRow creates a single row of random data for the table
-func generateRandomRow() []interface{} {
+// generateRandomRow creates a single row of random data for the table,
+// with the current time as mtime if the config is time ordered.
+func generateRandomRow(conf *Config) []interface{} {
+	mtime := time.Now()
+	if !conf.timeOrdered() {
+		mtime = mtime.Add(-time.Duration(rand.Intn(30*24)) * time.Hour) // random timestamp within last 30 days
+	}
 	return []interface{}{
 		rand.Intn(100000),           // tid
 		rand.Intn(10000),            // bid
 		rand.Intn(10000000),         // aid
 		rand.Intn(1000000) - 500000, // delta (can be negative)
-		time.Now().Add(-time.Duration(rand.Intn(30*24)) * time.Hour), // random timestamp within last 30 days
-		randomString(22), // filler
+		mtime,                       // mtime
+		generateFiller(conf),        // filler
 	}
 }
 
+// generateFiller returns the filler with the configured compressibility,
+// repeated characters followed by random ones.
+func generateFiller(conf *Config) string {
+	width := conf.fillerWidth()
+	repeated := max(0, conf.repeatedWidth())
+	return strings.Repeat("a", repeated) + randomString(width-repeated)
+}
+
 // randomString generates a random string of specified length
 func randomString(length int) string {
 	const charset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
@@ -0,0 +1,24 @@
+package ingest
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/petuhovskiy/overload/internal/compat"
+	"github.com/petuhovskiy/overload/internal/pgversion"
+)
+
+// withRetries executes the batch, retrying serialization failures on engines that require it.
+// Every batch is a single implicit transaction, so it's safe to retry as a whole.
+func withRetries(ctx context.Context, conn *pgx.Conn, batch func() error) error {
+	retries := compat.SerializationRetries(pgversion.FromConn(conn), 0)
+	for attempt := 0; ; attempt++ {
+		err := batch()
+		if err == nil || attempt >= retries || !compat.IsSerializationFailure(err) {
+			return err
+		}
+		if !compat.WaitSerializationRetry(ctx, attempt+1) {
+			return err
+		}
+	}
+}
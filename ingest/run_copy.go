@@ -6,7 +6,10 @@ import (
 	"time"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/petuhovskiy/overload/internal/dbconn"
 	"github.com/petuhovskiy/overload/internal/log"
+	"github.com/petuhovskiy/overload/internal/metrics"
+	"github.com/petuhovskiy/overload/internal/reconnect"
 	"go.uber.org/zap"
 )
 
@@ -18,73 +21,67 @@ func RunCopy(ctx context.Context, connstr string, conf Config) error {
 
 	conf.Normalize()
 
-	conn, err := pgx.Connect(ctx, connstr)
+	connect := func(ctx context.Context) (*pgx.Conn, error) {
+		return dbconn.Connect(ctx, connstr)
+	}
+	conn, err := reconnect.Connect(ctx, conf.Reconnect, "ingest", connect)
 	if err != nil {
 		return err
 	}
-	defer conn.Close(ctx)
+	// the committer owns the connection, it's replaced after reconnects
+	tx := newCommitter(conn, connect, conf, "copy")
+	defer tx.close()
 
-	if err := createTable(ctx, conn, conf.TableName); err != nil {
+	if err := createTable(ctx, conn, conf); err != nil {
 		return fmt.Errorf("failed to create table: %w", err)
 	}
 
 	// Start tracking metrics
-	startTime := time.Now()
-	rowsInserted := int64(0)
-	lastReportTime := startTime
-	lastReportRows := int64(0)
+	batchLatency := metrics.Default.Histogram("ingest_batch_seconds", "method", "copy", "table", conf.TableName)
 
 	// Column names for the COPY operation
 	columns := []string{"tid", "bid", "aid", "delta", "mtime", "filler"}
 
 	// Process data in batches
+	var inserted int64
 copy:
 	for {
-		select {
-		case <-ctx.Done():
+		if !waitDiskSpace(ctx) {
 			break copy
-		default:
 		}
 
 		// Determine batch size for this iteration
-		batchSize := conf.BatchSize
+		batchSize := conf.nextBatch(inserted)
+		if batchSize == 0 {
+			break
+		}
 
 		// Generate and copy batch of rows
 		rows := make([][]interface{}, batchSize)
 		for i := 0; i < batchSize; i++ {
-			rows[i] = generateRandomRow()
+			rows[i] = generateRandomRow(&conf)
 		}
 
 		// Use CopyFrom for efficient batch insertion
-		n, err := conn.CopyFrom(
-			ctx,
-			pgx.Identifier{conf.TableName},
-			columns,
-			pgx.CopyFromRows(rows),
-		)
+		batchStart := time.Now()
+		n, err := tx.exec(ctx, func(ctx context.Context, conn *pgx.Conn) (int64, error) {
+			return conn.CopyFrom(
+				ctx,
+				pgx.Identifier{conf.TableName},
+				columns,
+				pgx.CopyFromRows(rows),
+			)
+		})
 		if err != nil {
 			return fmt.Errorf("failed to copy data: %w", err)
 		}
 
-		rowsInserted += n
-
-		// Report progress periodically
-		now := time.Now()
-		if now.Sub(lastReportTime) > time.Second*2 {
-			rowsSinceLastReport := rowsInserted - lastReportRows
-			duration := now.Sub(lastReportTime).Seconds()
-			rowsPerSecond := float64(rowsSinceLastReport) / duration
-
-			log.Info(ctx, "ingest progress",
-				zap.Int64("rows_inserted", rowsInserted),
-				zap.Float64("rows_per_second", rowsPerSecond),
-				zap.Duration("elapsed", now.Sub(startTime)),
-			)
-
-			lastReportTime = now
-			lastReportRows = rowsInserted
-		}
+		inserted += n
+		batchLatency.Observe(time.Since(batchStart).Seconds())
 	}
 
+	if err := tx.finish(); err != nil {
+		return fmt.Errorf("failed to commit: %w", err)
+	}
 	return nil
 }
@@ -6,7 +6,10 @@ import (
 	"time"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/petuhovskiy/overload/internal/dbconn"
 	"github.com/petuhovskiy/overload/internal/log"
+	"github.com/petuhovskiy/overload/internal/metrics"
+	"github.com/petuhovskiy/overload/internal/reconnect"
 	"go.uber.org/zap"
 )
 
@@ -19,24 +22,32 @@ func RunGenerate(ctx context.Context, connstr string, conf Config) error {
 
 	conf.Normalize()
 
-	conn, err := pgx.Connect(ctx, connstr)
+	connect := func(ctx context.Context) (*pgx.Conn, error) {
+		return dbconn.Connect(ctx, connstr)
+	}
+	conn, err := reconnect.Connect(ctx, conf.Reconnect, "ingest", connect)
 	if err != nil {
 		return err
 	}
-	defer conn.Close(ctx)
+	// the committer owns the connection, it's replaced after reconnects
+	tx := newCommitter(conn, connect, conf, "generate")
+	defer tx.close()
 
-	if err := createTable(ctx, conn, conf.TableName); err != nil {
+	if err := createTable(ctx, conn, conf); err != nil {
 		return fmt.Errorf("failed to create table: %w", err)
 	}
 
 	// Start tracking metrics
-	startTime := time.Now()
-	rowsInserted := int64(0)
-	lastReportTime := startTime
-	lastReportRows := int64(0)
+	batchLatency := metrics.Default.Histogram("ingest_batch_seconds", "method", "generate", "table", conf.TableName)
 
 	// Create a server-side data generation query
 	// This uses PostgreSQL's random functions to generate data directly in the database
+	mtime := "now() - ((s % 30) * interval '1 day')" // simpler timestamp generation
+	if conf.timeOrdered() {
+		// now() is the same for all batches of a transaction, the wall clock is read
+		// for every row, so rows are ordered across batches
+		mtime = "clock_timestamp()"
+	}
 	insertQuery := fmt.Sprintf(`
 		INSERT INTO %s (tid, bid, aid, delta, mtime, filler)
 		SELECT
@@ -44,48 +55,58 @@ func RunGenerate(ctx context.Context, connstr string, conf Config) error {
 			(s %% 10000)::int, -- bid: use modulo of series value
 			(s %% 10000000)::int, -- aid: use modulo of series value
 			(s %% 1000000 - 500000)::int, -- delta: simpler calculation
-			now() - ((s %% 30) * interval '1 day'), -- simpler timestamp generation
-			lpad(s::text, 22, '0') -- much faster than md5
+			%s,
+			%s
 		FROM (SELECT generate_series AS s FROM generate_series(1, $1)) subq
-	`, conf.TableName)
+	`, conf.TableName, mtime, generateFillerSQL(&conf))
 
 	// Process data in batches
+	var inserted int64
 copy:
 	for {
-		select {
-		case <-ctx.Done():
+		if !waitDiskSpace(ctx) {
 			break copy
-		default:
 		}
 
 		// Determine batch size for this iteration
-		batchSize := conf.BatchSize
+		batchSize := conf.nextBatch(inserted)
+		if batchSize == 0 {
+			break
+		}
 
 		// Execute the insert query with server-side data generation
-		tag, err := conn.Exec(ctx, insertQuery, batchSize)
+		batchStart := time.Now()
+		n, err := tx.exec(ctx, func(ctx context.Context, conn *pgx.Conn) (int64, error) {
+			tag, err := conn.Exec(ctx, insertQuery, batchSize)
+			return tag.RowsAffected(), err
+		})
 		if err != nil {
 			return fmt.Errorf("failed to insert data: %w", err)
 		}
 
-		rowsInserted += tag.RowsAffected()
-
-		// Report progress periodically
-		now := time.Now()
-		if now.Sub(lastReportTime) > time.Second*2 {
-			rowsSinceLastReport := rowsInserted - lastReportRows
-			duration := now.Sub(lastReportTime).Seconds()
-			rowsPerSecond := float64(rowsSinceLastReport) / duration
-
-			log.Info(ctx, "ingest progress",
-				zap.Int64("rows_inserted", rowsInserted),
-				zap.Float64("rows_per_second", rowsPerSecond),
-				zap.Duration("elapsed", now.Sub(startTime)),
-			)
-
-			lastReportTime = now
-			lastReportRows = rowsInserted
-		}
+		inserted += n
+		batchLatency.Observe(time.Since(batchStart).Seconds())
 	}
 
+	if err := tx.finish(); err != nil {
+		return fmt.Errorf("failed to commit: %w", err)
+	}
 	return nil
 }
+
+// generateFillerSQL returns the expression of the filler, a zero-padded sequence number by default
+// or repeated characters followed by random hex with the configured compressibility.
+func generateFillerSQL(conf *Config) string {
+	width, repeated := conf.fillerWidth(), conf.repeatedWidth()
+	if repeated < 0 {
+		return fmt.Sprintf("lpad(s::text, %d, '0') -- much faster than md5", width)
+	}
+	random := width - repeated
+	if random == 0 {
+		return fmt.Sprintf("repeat('a', %d)", width)
+	}
+	// md5 of every row is random, the subquery references s to be evaluated per row
+	return fmt.Sprintf(
+		"lpad((SELECT left(string_agg(md5(random()::text || s), ''), %d) FROM generate_series(1, %d)), %d, 'a')",
+		random, (random+31)/32, width)
+}
@@ -0,0 +1,128 @@
+package ingest
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/petuhovskiy/overload/internal/dbconn"
+	"github.com/petuhovskiy/overload/internal/log"
+	"github.com/petuhovskiy/overload/internal/metrics"
+	"github.com/petuhovskiy/overload/internal/reconnect"
+	"go.uber.org/zap"
+)
+
+// valuesRowsPerStatement is the number of rows in a single INSERT ... VALUES statement,
+// limited by the max number of bind parameters (65535).
+const valuesRowsPerStatement = 1000
+
+// RunValues runs multi-row INSERT ... VALUES queries to ingest data as fast as possible.
+// It generates random data on the client side, like RunCopy, but sends it as bind parameters.
+// Statements of a single batch are pipelined.
+func RunValues(ctx context.Context, connstr string, conf Config) error {
+	log.Info(ctx, "ingest started", zap.Any("conf", conf))
+	defer log.Info(ctx, "ingest finished")
+
+	conf.Normalize()
+
+	connect := func(ctx context.Context) (*pgx.Conn, error) {
+		return dbconn.Connect(ctx, connstr)
+	}
+	conn, err := reconnect.Connect(ctx, conf.Reconnect, "ingest", connect)
+	if err != nil {
+		return err
+	}
+	// the committer owns the connection, it's replaced after reconnects
+	tx := newCommitter(conn, connect, conf, "values")
+	defer tx.close()
+
+	if err := createTable(ctx, conn, conf); err != nil {
+		return fmt.Errorf("failed to create table: %w", err)
+	}
+
+	// Start tracking metrics
+	batchLatency := metrics.Default.Histogram("ingest_batch_seconds", "method", "values", "table", conf.TableName)
+
+	fullQuery := valuesQuery(conf.TableName, valuesRowsPerStatement)
+
+	// Process data in batches
+	var inserted int64
+insert:
+	for {
+		if !waitDiskSpace(ctx) {
+			break insert
+		}
+
+		batchSize := conf.nextBatch(inserted)
+		if batchSize == 0 {
+			break
+		}
+
+		var stmts valuesStatements
+		for left := batchSize; left > 0; left -= valuesRowsPerStatement {
+			n := min(left, valuesRowsPerStatement)
+			query := fullQuery
+			if n != valuesRowsPerStatement {
+				query = valuesQuery(conf.TableName, n)
+			}
+
+			args := make([]any, 0, n*6)
+			for i := 0; i < n; i++ {
+				args = append(args, generateRandomRow(&conf)...)
+			}
+			stmts = append(stmts, valuesStatement{query: query, args: args})
+		}
+
+		batchStart := time.Now()
+		n, err := tx.exec(ctx, func(ctx context.Context, conn *pgx.Conn) (int64, error) {
+			return int64(batchSize), conn.SendBatch(ctx, stmts.batch()).Close()
+		})
+		if err != nil {
+			return fmt.Errorf("failed to insert data: %w", err)
+		}
+
+		inserted += n
+		batchLatency.Observe(time.Since(batchStart).Seconds())
+	}
+
+	if err := tx.finish(); err != nil {
+		return fmt.Errorf("failed to commit: %w", err)
+	}
+	return nil
+}
+
+// valuesStatement is a single INSERT ... VALUES statement of a batch.
+type valuesStatement struct {
+	query string
+	args  []any
+}
+
+// valuesStatements are the statements of a single batch.
+type valuesStatements []valuesStatement
+
+// batch queues the statements into a new pgx.Batch. pgx caches prepared statement names
+// in the queued queries after they are sent, so a batch replayed on a new connection
+// must be built again.
+func (s valuesStatements) batch() *pgx.Batch {
+	batch := &pgx.Batch{}
+	for _, stmt := range s {
+		batch.Queue(stmt.query, stmt.args...)
+	}
+	return batch
+}
+
+// valuesQuery builds INSERT statement for n rows.
+func valuesQuery(tableName string, n int) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "INSERT INTO %s (tid, bid, aid, delta, mtime, filler) VALUES ", tableName)
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		p := i * 6
+		fmt.Fprintf(&sb, "($%d, $%d, $%d, $%d, $%d, $%d)", p+1, p+2, p+3, p+4, p+5, p+6)
+	}
+	return sb.String()
+}
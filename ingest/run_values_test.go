@@ -0,0 +1,67 @@
+package ingest
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValuesStatementsBatch(t *testing.T) {
+	conf := Config{}
+	conf.Normalize()
+	stmts := valuesStatements{
+		{query: valuesQuery("t", 1), args: generateRandomRow(&conf)},
+		{query: valuesQuery("t", 1), args: generateRandomRow(&conf)},
+	}
+
+	first, second := stmts.batch(), stmts.batch()
+	require.NotSame(t, first, second)
+	require.Equal(t, 2, second.Len())
+	for i, q := range second.QueuedQueries {
+		require.NotSame(t, first.QueuedQueries[i], q, "queued queries are not shared between attempts")
+		require.Equal(t, stmts[i].query, q.SQL)
+		require.Equal(t, stmts[i].args, q.Arguments)
+	}
+}
+
+// TestValuesStatementsReplay sends the same statements on a fresh connection, like
+// the committer does after a reconnect. It needs a database in CONNSTR.
+func TestValuesStatementsReplay(t *testing.T) {
+	connstr := os.Getenv("CONNSTR")
+	if connstr == "" {
+		t.Skip("CONNSTR is not set")
+	}
+	ctx := context.Background()
+
+	conf := Config{TableName: "overload_test_values_replay"}
+	conf.Normalize()
+	stmts := valuesStatements{{query: valuesQuery(conf.TableName, 1), args: generateRandomRow(&conf)}}
+
+	connect := func() *pgx.Conn {
+		config, err := pgx.ParseConfig(connstr)
+		require.NoError(t, err)
+		config.DefaultQueryExecMode = pgx.QueryExecModeCacheStatement
+		conn, err := pgx.ConnectConfig(ctx, config)
+		require.NoError(t, err)
+		return conn
+	}
+
+	conn := connect()
+	defer func() {
+		_, _ = conn.Exec(ctx, "DROP TABLE IF EXISTS "+conf.TableName)
+		conn.Close(ctx)
+	}()
+	require.NoError(t, createTable(ctx, conn, conf))
+	require.NoError(t, conn.SendBatch(ctx, stmts.batch()).Close())
+
+	fresh := connect()
+	defer fresh.Close(ctx)
+	require.NoError(t, fresh.SendBatch(ctx, stmts.batch()).Close())
+
+	var rows int
+	require.NoError(t, fresh.QueryRow(ctx, "SELECT count(*) FROM "+conf.TableName).Scan(&rows))
+	require.Equal(t, 2, rows)
+}
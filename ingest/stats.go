@@ -2,11 +2,20 @@ package ingest
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"maps"
+	"slices"
 	"time"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/petuhovskiy/overload/internal/alert"
+	"github.com/petuhovskiy/overload/internal/compat"
+	"github.com/petuhovskiy/overload/internal/dbconn"
 	"github.com/petuhovskiy/overload/internal/log"
+	"github.com/petuhovskiy/overload/internal/metrics"
+	"github.com/petuhovskiy/overload/internal/pgversion"
+	"github.com/petuhovskiy/overload/internal/reconnect"
 	"go.uber.org/zap"
 )
 
@@ -15,11 +24,19 @@ type statsSnapshot struct {
 	DatabaseSize uint64
 	// timestamp of the snapshot
 	Timestamp time.Time
+	// max replay lag of the replicas, zero if it's not measured
+	ReplicationLag time.Duration
+	// sizes of tracked databases by name, nil if none are tracked
+	Databases map[string]uint64
 }
 
 // ReportUploadSpeed will print database size growth every second.
-func ReportUploadSpeed(ctx context.Context, connstr string) {
+// Database size and replication lag are checked by alerter, which can be nil.
+// If the size quota is known, it also forecasts when the database is full.
+func ReportUploadSpeed(ctx context.Context, connstr string, alerter *alert.Alerter, disk DiskConfig) {
 	ctx = log.With(ctx, zap.String("job", "stats"))
+	disk.Normalize()
+	forecaster := &diskForecaster{conf: disk, quota: disk.Quota}
 
 	log.Info(ctx, "started")
 
@@ -45,34 +62,84 @@ func ReportUploadSpeed(ctx context.Context, connstr string) {
 		}
 
 		if conn == nil {
-			conn, err = pgx.Connect(ctx, connstr)
+			conn, err = reconnect.Connect(ctx, reconnect.Config{}, "stats", func(ctx context.Context) (*pgx.Conn, error) {
+				return dbconn.Connect(ctx, connstr)
+			})
 			if err != nil {
 				log.Error(ctx, "failed to connect", zap.Error(err))
 				close()
 				continue
 			}
+			if disk.Quota == 0 {
+				forecaster.quota = serverQuota(ctx, conn)
+			}
 		}
 
-		snapshot, err := getStatsSnapshot(ctx, conn)
+		snapshot, err := getStatsSnapshot(ctx, conn, disk.Databases)
 		if err != nil {
 			log.Error(ctx, "failed to get stats snapshot", zap.Error(err))
 			close()
 			continue
 		}
 
+		metrics.Default.Gauge("db_size_bytes").Set(float64(snapshot.DatabaseSize))
+		alerter.CheckDBSize(ctx, "stats", snapshot.DatabaseSize)
+		if alerter.ChecksReplicationLag() {
+			lag, err := replicationLag(ctx, conn)
+			if err != nil {
+				log.Warn(ctx, "failed to get replication lag", zap.Error(err))
+			} else {
+				snapshot.ReplicationLag = lag
+				metrics.Default.Gauge("replication_lag_seconds").Set(lag.Seconds())
+				alerter.CheckReplicationLag(ctx, "stats", lag)
+			}
+		}
+		timeToFull := forecaster.check(ctx, *snapshot)
+
 		if lastSnapshot != nil {
 			sizeDiff := int64(snapshot.DatabaseSize) - int64(lastSnapshot.DatabaseSize)
 			timeDiff := snapshot.Timestamp.Sub(lastSnapshot.Timestamp).Seconds()
 			speed := float64(sizeDiff) / timeDiff
+			metrics.Default.Gauge("db_growth_bytes_per_second").Set(speed)
 			speedHuman := humanizeBytes(int64(speed)) + "/s"
 			sizeHuman := humanizeBytes(int64(snapshot.DatabaseSize))
 
-			log.Info(ctx, "fetched", zap.Any("speed", speedHuman), zap.String("size", sizeHuman))
+			fields := []zap.Field{zap.Any("speed", speedHuman), zap.String("size", sizeHuman)}
+			if timeToFull >= 0 {
+				fields = append(fields, zap.Duration("time_to_full", timeToFull.Round(time.Second)))
+			}
+			log.Info(ctx, "fetched", fields...)
+			reportDatabases(ctx, snapshot, lastSnapshot)
 		}
 		lastSnapshot = snapshot
 	}
 }
 
+// reportDatabases exports size and growth of every tracked database and logs them.
+func reportDatabases(ctx context.Context, snapshot, last *statsSnapshot) {
+	if len(snapshot.Databases) == 0 {
+		return
+	}
+	timeDiff := snapshot.Timestamp.Sub(last.Timestamp).Seconds()
+	var total uint64
+	var fields []zap.Field
+	for _, name := range slices.Sorted(maps.Keys(snapshot.Databases)) {
+		size := snapshot.Databases[name]
+		total += size
+		metrics.Default.Gauge("database_size_bytes", "database", name).Set(float64(size))
+		// databases created since the last snapshot have no growth yet
+		lastSize, ok := last.Databases[name]
+		if !ok {
+			continue
+		}
+		speed := float64(int64(size)-int64(lastSize)) / timeDiff
+		metrics.Default.Gauge("database_growth_bytes_per_second", "database", name).Set(speed)
+		fields = append(fields, zap.String(name, humanizeBytes(int64(speed))+"/s of "+humanizeBytes(int64(size))))
+	}
+	fields = append(fields, zap.String("total", humanizeBytes(int64(total))))
+	log.Info(ctx, "databases", fields...)
+}
+
 // humanizeBytes converts bytes to human readable format.
 // For example, 1024 -> "1.0 KB", 12345 -> "12.3 KB".
 func humanizeBytes(b int64) string {
@@ -88,14 +155,43 @@ func humanizeBytes(b int64) string {
 	return fmt.Sprintf("%.1f %cB", float64(b)/float64(div), "KMGTPE"[exp])
 }
 
-func getStatsSnapshot(ctx context.Context, conn *pgx.Conn) (*statsSnapshot, error) {
+// getStatsSnapshot fetches the size of the current database and of the tracked databases,
+// see DiskConfig.Databases.
+func getStatsSnapshot(ctx context.Context, conn *pgx.Conn, databases []string) (*statsSnapshot, error) {
 	var snapshot statsSnapshot
 
-	row := conn.QueryRow(ctx, "SELECT pg_database_size(current_database()), now()")
-	err := row.Scan(&snapshot.DatabaseSize, &snapshot.Timestamp)
-	if err != nil {
+	size, err := compat.DatabaseSize(ctx, conn)
+	if err != nil && !errors.Is(err, compat.ErrUnsupported) {
 		return nil, err
 	}
+	snapshot.DatabaseSize = uint64(size)
+	snapshot.Timestamp = time.Now()
+
+	if len(databases) > 0 {
+		names := databases
+		if len(databases) == 1 && databases[0] == "*" {
+			names = nil
+		}
+		sizes, err := compat.DatabaseSizes(ctx, conn, names)
+		if err != nil && !errors.Is(err, compat.ErrUnsupported) {
+			return nil, err
+		}
+		snapshot.Databases = make(map[string]uint64, len(sizes))
+		for name, size := range sizes {
+			snapshot.Databases[name] = uint64(size)
+		}
+	}
 
 	return &snapshot, nil
 }
+
+// replicationLag returns the max replay lag of the replicas.
+func replicationLag(ctx context.Context, conn *pgx.Conn) (time.Duration, error) {
+	// replay_lag is not reported by old servers and other engines
+	if !pgversion.FromConn(conn).HasReplayLag() {
+		return 0, nil
+	}
+	var lag time.Duration
+	err := conn.QueryRow(ctx, "SELECT COALESCE(max(replay_lag), '0'::interval) FROM pg_stat_replication").Scan(&lag)
+	return lag, err
+}
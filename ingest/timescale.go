@@ -0,0 +1,99 @@
+package ingest
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/petuhovskiy/overload/internal/dbconn"
+	"github.com/petuhovskiy/overload/internal/log"
+	"github.com/petuhovskiy/overload/internal/metrics"
+	"go.uber.org/zap"
+)
+
+// Chunk is a single chunk of a TimescaleDB hypertable.
+type Chunk struct {
+	Name       string
+	RangeStart time.Time
+	RangeEnd   time.Time
+	// Rows is the approximate number of rows, based on statistics.
+	Rows int64
+}
+
+// createHypertable converts the empty table to a hypertable partitioned by mtime,
+// it's a no-op if the table is already a hypertable.
+func createHypertable(ctx context.Context, conn *pgx.Conn, tableName string, chunkInterval time.Duration) error {
+	if _, err := conn.Exec(ctx, "CREATE EXTENSION IF NOT EXISTS timescaledb"); err != nil {
+		return fmt.Errorf("failed to create timescaledb extension: %w", err)
+	}
+	_, err := conn.Exec(ctx, `
+		SELECT create_hypertable($1::regclass, 'mtime',
+			chunk_time_interval => $2::interval,
+			if_not_exists => true)`,
+		tableName, chunkInterval)
+	if err != nil {
+		return fmt.Errorf("failed to create hypertable: %w", err)
+	}
+	return nil
+}
+
+// Chunks returns all chunks of the hypertable ordered by time.
+func Chunks(ctx context.Context, conn *pgx.Conn, tableName string) ([]Chunk, error) {
+	rows, err := conn.Query(ctx, `
+		SELECT
+			chunk_name,
+			range_start,
+			range_end,
+			approximate_row_count(format('%I.%I', chunk_schema, chunk_name)::regclass)
+		FROM timescaledb_information.chunks
+		WHERE format('%I.%I', hypertable_schema, hypertable_name)::regclass = $1::regclass
+		ORDER BY range_start`, tableName)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (Chunk, error) {
+		var c Chunk
+		err := row.Scan(&c.Name, &c.RangeStart, &c.RangeEnd, &c.Rows)
+		return c, err
+	})
+}
+
+// logChunks logs per-chunk row counts of the hypertable and exports them as metrics.
+func logChunks(ctx context.Context, conn *pgx.Conn, tableName string) {
+	chunks, err := Chunks(ctx, conn, tableName)
+	if err != nil {
+		log.Warn(ctx, "failed to get hypertable chunks", zap.Error(err))
+		return
+	}
+	for _, c := range chunks {
+		metrics.Default.Gauge("ingest_chunk_rows", "table", tableName, "chunk", c.Name).Set(float64(c.Rows))
+		log.Info(ctx, "hypertable chunk",
+			zap.String("chunk", c.Name),
+			zap.Time("range_start", c.RangeStart),
+			zap.Time("range_end", c.RangeEnd),
+			zap.Int64("rows", c.Rows),
+		)
+	}
+}
+
+// ReportChunks periodically logs per-chunk row counts of the hypertable, until the context is done.
+func ReportChunks(ctx context.Context, connstr string, tableName string, interval time.Duration) {
+	ctx = log.With(ctx, zap.String("job", "chunks"), zap.String("table", tableName))
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+
+		conn, err := dbconn.Connect(ctx, connstr)
+		if err != nil {
+			log.Warn(ctx, "failed to connect", zap.Error(err))
+			continue
+		}
+		logChunks(ctx, conn, tableName)
+		conn.Close(context.Background())
+	}
+}
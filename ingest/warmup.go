@@ -0,0 +1,152 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/petuhovskiy/overload/internal/compat"
+	"github.com/petuhovskiy/overload/internal/dbconn"
+	"github.com/petuhovskiy/overload/internal/log"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultWarmupWorkers = 4
+	// warmupSizeCheckInterval is the pause between database size checks while growing it.
+	warmupSizeCheckInterval = 5 * time.Second
+)
+
+// WarmupConfig configures seeding of a minimum dataset before a measured run.
+type WarmupConfig struct {
+	// Fill is the table, the method and the number of workers to ingest with.
+	Fill FillConfig
+	// MinRows is the min number of rows of the table, MinDBSize is the min size
+	// of the database in bytes. Zero disables the check.
+	MinRows   int64
+	MinDBSize int64
+}
+
+func (conf *WarmupConfig) Normalize() {
+	if conf.Fill.Workers == 0 {
+		conf.Fill.Workers = defaultWarmupWorkers
+	}
+	conf.Fill.Normalize()
+}
+
+// Enabled returns true if any minimum is set.
+func (conf *WarmupConfig) Enabled() bool {
+	return conf.MinRows > 0 || conf.MinDBSize > 0
+}
+
+// Warmup ingests into the table until it has at least MinRows rows and the database has grown
+// to MinDBSize. Existing data counts, so nothing is ingested if the dataset is already there.
+func Warmup(ctx context.Context, connstr string, conf WarmupConfig) error {
+	conf.Normalize()
+	ctx = log.With(ctx, zap.String("table", conf.Fill.Ingest.TableName))
+
+	conn, err := dbconn.Connect(ctx, connstr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+	if err := createTable(ctx, conn, conf.Fill.Ingest); err != nil {
+		return fmt.Errorf("failed to create table: %w", err)
+	}
+
+	if conf.MinRows > 0 {
+		rows, err := countRows(ctx, conn, conf.Fill.Ingest.TableName)
+		if err != nil {
+			return err
+		}
+		if rows < conf.MinRows {
+			log.Info(ctx, "warm-up: seeding rows", zap.Int64("rows", rows), zap.Int64("min_rows", conf.MinRows))
+			fill := conf.Fill
+			fill.Ingest.Rows = conf.MinRows - rows
+			if _, err := Fill(ctx, connstr, fill); err != nil {
+				return fmt.Errorf("failed to seed rows: %w", err)
+			}
+		}
+	}
+
+	if conf.MinDBSize > 0 {
+		size, err := compat.DatabaseSize(ctx, conn)
+		if err != nil {
+			return fmt.Errorf("failed to get database size: %w", err)
+		}
+		if size < conf.MinDBSize {
+			log.Info(ctx, "warm-up: growing the database", zap.Int64("size", size), zap.Int64("min_size", conf.MinDBSize))
+			if err := growDatabase(ctx, connstr, conf); err != nil {
+				return fmt.Errorf("failed to grow the database: %w", err)
+			}
+		}
+	}
+	log.Info(ctx, "warm-up finished")
+	return nil
+}
+
+// growDatabase ingests with all workers until the database reaches MinDBSize.
+func growDatabase(ctx context.Context, connstr string, conf WarmupConfig) error {
+	growCtx, stop := context.WithCancel(ctx)
+	defer stop()
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+	)
+	for i := 0; i < conf.Fill.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// workers are stopped once the size is reached, errors after that are expected
+			if err := conf.Fill.Method.Run(growCtx, connstr, conf.Fill.Ingest); err != nil && growCtx.Err() == nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+				stop()
+			}
+		}()
+	}
+
+	err := waitDatabaseSize(growCtx, connstr, conf.MinDBSize)
+	stop()
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	if err != nil && ctx.Err() == nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+// waitDatabaseSize returns when the database has grown to the size or ctx is done.
+func waitDatabaseSize(ctx context.Context, connstr string, size int64) error {
+	conn, err := dbconn.Connect(ctx, connstr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(warmupSizeCheckInterval):
+		}
+		current, err := compat.DatabaseSize(ctx, conn)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		log.Info(ctx, "warm-up: database size", zap.Int64("size", current), zap.Int64("min_size", size))
+		if current >= size {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package ingest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/petuhovskiy/overload/errs"
+	"github.com/petuhovskiy/overload/internal/dbconn"
+	"github.com/petuhovskiy/overload/internal/log"
+	"go.uber.org/zap"
+)
+
+// maxBatchBytes caps the data volume of a single batch, so that wide rows don't exhaust memory.
+const maxBatchBytes = 64 << 20
+
+// WidthResult holds measurements of ingesting rows of a single width.
+type WidthResult struct {
+	BenchResult
+	// Width is the data width of a row in bytes.
+	Width int
+}
+
+// BenchWidths ingests the same total volume in bytes with rows of every width, each into its
+// own table, and returns the results in the order of widths. Duration of the config caps
+// every run, so widths that don't finish in time are measured on the ingested part.
+func BenchWidths(ctx context.Context, connstr string, conf BenchConfig, method Method, widths []int, volume int64) ([]WidthResult, error) {
+	conf.Normalize()
+
+	conn, err := dbconn.Connect(ctx, connstr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close(context.Background())
+
+	var results []WidthResult
+	for _, width := range widths {
+		if width <= rowFixedWidth {
+			return results, errs.Validationf("row width %d is not larger than fixed columns width %d", width, rowFixedWidth)
+		}
+
+		wconf := conf
+		wconf.Ingest.TableName = fmt.Sprintf("%s_w%d", conf.Ingest.TableName, width)
+		wconf.Ingest.RowWidth = width
+		wconf.Ingest.BatchSize = max(1, min(conf.Ingest.BatchSize, maxBatchBytes/width))
+		// every worker inserts its share of the volume
+		wconf.Ingest.Rows = max(1, volume/int64(width)/int64(conf.Workers))
+
+		ctx := log.With(ctx, zap.Int("width", width))
+		if err := createTable(ctx, conn, wconf.Ingest); err != nil {
+			return results, fmt.Errorf("failed to create table: %w", err)
+		}
+		log.Info(ctx, "benchmarking row width", zap.Int64("rows", wconf.Ingest.Rows*int64(conf.Workers)))
+
+		res, err := benchMethod(ctx, conn, connstr, wconf, method)
+		if err != nil {
+			return results, err
+		}
+		log.Info(ctx, "row width finished", zap.Any("result", res))
+		results = append(results, WidthResult{BenchResult: res, Width: width})
+	}
+	return results, nil
+}
+
+// PrintWidthResults prints the comparison table of row widths.
+func PrintWidthResults(w io.Writer, results []WidthResult) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "WIDTH\tROWS\tROWS/S\tMB/S\tWAL MB/S\tCLIENT CPU\tERROR")
+	for _, r := range results {
+		errText := ""
+		if r.Error != nil {
+			errText = r.Error.Error()
+		}
+		fmt.Fprintf(tw, "%dB\t%d\t%.0f\t%.1f\t%.1f\t%.0f%%\t%s\n",
+			r.Width, r.Rows, r.RowsPerSec, r.MBPerSec, r.WALMBPerSec, r.ClientCPU*100, errText)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,159 @@
+package alert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/petuhovskiy/overload/internal/log"
+	"go.uber.org/zap"
+)
+
+const (
+	MetricP99Latency     = "p99_latency"
+	MetricErrorRate      = "error_rate"
+	MetricReplicationLag = "replication_lag"
+	MetricDBSize         = "db_size"
+)
+
+// Config holds alerting thresholds. Zero threshold disables the check.
+type Config struct {
+	P99Latency     time.Duration
+	ErrorRate      float64
+	ReplicationLag time.Duration
+	// DBSize is the max database size in bytes.
+	DBSize uint64
+	// WebhookURL is notified with JSON-encoded alert, if set.
+	WebhookURL string
+}
+
+// Alert describes a single threshold crossing.
+type Alert struct {
+	Time      time.Time
+	Source    string
+	Metric    string
+	Value     float64
+	Threshold float64
+}
+
+func (a Alert) String() string {
+	return fmt.Sprintf("%s: %s is %g, threshold %g", a.Source, a.Metric, a.Value, a.Threshold)
+}
+
+// Alerter checks metrics against thresholds. Every alert is logged with WARN level and passed
+// to the hooks. Alert fires once when the threshold is crossed and fires again only after
+// the value went back below the threshold. Nil Alerter doesn't check anything.
+type Alerter struct {
+	conf  Config
+	hooks []func(Alert)
+
+	mu     sync.Mutex
+	firing map[string]bool
+}
+
+func New(conf Config, hooks ...func(Alert)) *Alerter {
+	a := &Alerter{
+		conf:   conf,
+		hooks:  hooks,
+		firing: map[string]bool{},
+	}
+	if conf.WebhookURL != "" {
+		a.hooks = append(a.hooks, a.notifyWebhook)
+	}
+	return a
+}
+
+// CheckLatency checks p99 latency reported by the source.
+func (a *Alerter) CheckLatency(ctx context.Context, source string, p99 time.Duration) {
+	if a == nil || a.conf.P99Latency == 0 {
+		return
+	}
+	a.check(ctx, source, MetricP99Latency, p99.Seconds(), a.conf.P99Latency.Seconds())
+}
+
+// CheckErrorRate checks error rate reported by the source.
+func (a *Alerter) CheckErrorRate(ctx context.Context, source string, rate float64) {
+	if a == nil || a.conf.ErrorRate == 0 {
+		return
+	}
+	a.check(ctx, source, MetricErrorRate, rate, a.conf.ErrorRate)
+}
+
+// CheckReplicationLag checks replication lag reported by the source.
+func (a *Alerter) CheckReplicationLag(ctx context.Context, source string, lag time.Duration) {
+	if a == nil || a.conf.ReplicationLag == 0 {
+		return
+	}
+	a.check(ctx, source, MetricReplicationLag, lag.Seconds(), a.conf.ReplicationLag.Seconds())
+}
+
+// ChecksReplicationLag returns true if the replication lag threshold is set, so that
+// sources can skip measuring the lag otherwise.
+func (a *Alerter) ChecksReplicationLag() bool {
+	return a != nil && a.conf.ReplicationLag != 0
+}
+
+// CheckDBSize checks database size reported by the source.
+func (a *Alerter) CheckDBSize(ctx context.Context, source string, size uint64) {
+	if a == nil || a.conf.DBSize == 0 {
+		return
+	}
+	a.check(ctx, source, MetricDBSize, float64(size), float64(a.conf.DBSize))
+}
+
+func (a *Alerter) check(ctx context.Context, source, metric string, value, threshold float64) {
+	key := source + "/" + metric
+
+	a.mu.Lock()
+	wasFiring := a.firing[key]
+	isFiring := value > threshold
+	a.firing[key] = isFiring
+	a.mu.Unlock()
+
+	if !isFiring || wasFiring {
+		return
+	}
+
+	alert := Alert{
+		Time:      time.Now(),
+		Source:    source,
+		Metric:    metric,
+		Value:     value,
+		Threshold: threshold,
+	}
+	log.Warn(ctx, "alert threshold crossed",
+		zap.String("source", source),
+		zap.String("metric", metric),
+		zap.Float64("value", value),
+		zap.Float64("threshold", threshold),
+	)
+
+	for _, hook := range a.hooks {
+		hook(alert)
+	}
+}
+
+// notifyWebhook sends alert to the configured webhook in background.
+func (a *Alerter) notifyWebhook(alert Alert) {
+	go func() {
+		body, err := json.Marshal(map[string]any{
+			"text":  alert.String(),
+			"alert": alert,
+		})
+		if err != nil {
+			return
+		}
+
+		client := http.Client{Timeout: 10 * time.Second}
+		resp, err := client.Post(a.conf.WebhookURL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			log.Error(context.Background(), "failed to notify webhook", zap.Error(err))
+			return
+		}
+		resp.Body.Close()
+	}()
+}
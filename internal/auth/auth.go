@@ -0,0 +1,98 @@
+// Package auth injects short-lived cloud IAM tokens into connection configs, for managed
+// Postgres instances that don't use static passwords.
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"golang.org/x/sync/singleflight"
+)
+
+// refreshBefore is how long before the expiry the token is refreshed,
+// so that it doesn't expire during the connection handshake.
+const refreshBefore = time.Minute
+
+// Token is a short-lived password.
+type Token struct {
+	Value   string
+	Expires time.Time
+}
+
+// Provider fetches a token for the connection.
+type Provider interface {
+	Token(ctx context.Context, config *pgx.ConnConfig) (Token, error)
+}
+
+// New creates a provider by name: aws-rds, gcp or azure.
+func New(name string) (Provider, error) {
+	switch name {
+	case "aws-rds":
+		return NewAWSRDSFromEnv()
+	case "gcp":
+		return &GCP{}, nil
+	case "azure":
+		return &Azure{ClientID: os.Getenv("AZURE_CLIENT_ID")}, nil
+	default:
+		return nil, fmt.Errorf("unknown auth provider %q", name)
+	}
+}
+
+var (
+	mu       sync.Mutex
+	provider Provider
+	tokens   = map[string]Token{}
+	// generation changes with the provider, so that tokens of the old one aren't cached
+	generation int
+	fetches    singleflight.Group
+)
+
+// SetProvider sets the provider used by Apply for all connections, nil disables token auth.
+func SetProvider(p Provider) {
+	mu.Lock()
+	defer mu.Unlock()
+	provider = p
+	tokens = map[string]Token{}
+	generation++
+}
+
+// Apply sets the password of the config to a valid token, if a provider is set.
+// Tokens are cached per server and user, and refreshed shortly before they expire.
+// Concurrent connections to the same server wait for a single fetch of the token.
+func Apply(ctx context.Context, config *pgx.ConnConfig) error {
+	mu.Lock()
+	p, gen := provider, generation
+	key := config.User + "@" + net.JoinHostPort(config.Host, strconv.Itoa(int(config.Port)))
+	token, ok := tokens[key]
+	mu.Unlock()
+	if p == nil {
+		return nil
+	}
+
+	if !ok || time.Until(token.Expires) < refreshBefore {
+		res, err, _ := fetches.Do(fmt.Sprintf("%d/%s", gen, key), func() (any, error) {
+			token, err := p.Token(ctx, config)
+			if err != nil {
+				return nil, err
+			}
+			mu.Lock()
+			if generation == gen {
+				tokens[key] = token
+			}
+			mu.Unlock()
+			return token, nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to fetch auth token: %w", err)
+		}
+		token = res.(Token)
+	}
+	config.Password = token.Value
+	return nil
+}
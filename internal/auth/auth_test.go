@@ -0,0 +1,56 @@
+package auth
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/stretchr/testify/require"
+)
+
+type countingProvider struct {
+	calls atomic.Int32
+	delay time.Duration
+}
+
+func (p *countingProvider) Token(context.Context, *pgx.ConnConfig) (Token, error) {
+	p.calls.Add(1)
+	time.Sleep(p.delay)
+	return Token{Value: "secret", Expires: time.Now().Add(time.Hour)}, nil
+}
+
+func TestApplyFetchesOnce(t *testing.T) {
+	p := &countingProvider{delay: 50 * time.Millisecond}
+	SetProvider(p)
+	defer SetProvider(nil)
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			config := &pgx.ConnConfig{}
+			config.Host, config.Port, config.User = "db", 5432, "app"
+			require.NoError(t, Apply(context.Background(), config))
+			require.Equal(t, "secret", config.Password)
+		}()
+	}
+	wg.Wait()
+	require.EqualValues(t, 1, p.calls.Load())
+}
+
+func TestApplyPerServer(t *testing.T) {
+	p := &countingProvider{}
+	SetProvider(p)
+	defer SetProvider(nil)
+
+	for _, host := range []string{"a", "b", "a"} {
+		config := &pgx.ConnConfig{}
+		config.Host, config.Port, config.User = host, 5432, "app"
+		require.NoError(t, Apply(context.Background(), config))
+	}
+	require.EqualValues(t, 2, p.calls.Load())
+}
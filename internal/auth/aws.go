@@ -0,0 +1,164 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// rdsTokenLifetime is the max lifetime of RDS IAM auth tokens.
+const rdsTokenLifetime = 15 * time.Minute
+
+// AWSRDS generates RDS IAM auth tokens, which are SigV4 presigned connect requests
+// signed locally with the credentials.
+type AWSRDS struct {
+	Region      string
+	Credentials AWSCredentialsProvider
+	// Endpoint overrides host:port of the connection config, e.g. when connecting through a proxy.
+	Endpoint string
+}
+
+// NewAWSRDSFromEnv reads the region from the standard AWS environment variables,
+// credentials are found as described in NewAWSCredentialsFromEnv.
+func NewAWSRDSFromEnv() (*AWSRDS, error) {
+	p := &AWSRDS{
+		Region:      awsRegion(),
+		Credentials: NewAWSCredentialsFromEnv(),
+	}
+	if p.Region == "" {
+		return nil, errors.New("AWS_REGION is required")
+	}
+	return p, nil
+}
+
+func (p *AWSRDS) Token(ctx context.Context, config *pgx.ConnConfig) (Token, error) {
+	creds, err := p.Credentials.Credentials(ctx)
+	if err != nil {
+		return Token{}, err
+	}
+	endpoint := p.Endpoint
+	if endpoint == "" {
+		endpoint = net.JoinHostPort(config.Host, strconv.Itoa(int(config.Port)))
+	}
+	now := time.Now().UTC()
+	expires := now.Add(rdsTokenLifetime)
+	if !creds.Expires.IsZero() && creds.Expires.Before(expires) {
+		// the token is rejected once the credentials it's signed with expire
+		expires = creds.Expires
+	}
+	return Token{
+		Value:   buildRDSToken(creds, p.Region, endpoint, config.User, now),
+		Expires: expires,
+	}, nil
+}
+
+// buildRDSToken presigns GET https://endpoint?Action=connect&DBUser=user for the rds-db service,
+// the token is the presigned URL without the scheme.
+func buildRDSToken(creds AWSCredentials, region, endpoint, user string, now time.Time) string {
+	emptyHash := sha256.Sum256(nil)
+	query := presign(presignRequest{
+		method:      "GET",
+		host:        endpoint,
+		path:        "/",
+		params:      map[string]string{"Action": "connect", "DBUser": user},
+		payloadHash: hex.EncodeToString(emptyHash[:]),
+		service:     "rds-db",
+		region:      region,
+		expires:     rdsTokenLifetime,
+	}, creds, now)
+	return endpoint + "?" + query
+}
+
+// presignRequest is a request signed with SigV4 query parameters, with the host as the only signed header.
+type presignRequest struct {
+	method      string
+	host        string
+	path        string
+	params      map[string]string
+	payloadHash string
+	service     string
+	region      string
+	expires     time.Duration
+}
+
+// presign returns the canonical query string of the request with the X-Amz-* auth params and the signature.
+func presign(req presignRequest, creds AWSCredentials, now time.Time) string {
+	const algorithm = "AWS4-HMAC-SHA256"
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	scope := strings.Join([]string{date, req.region, req.service, "aws4_request"}, "/")
+
+	params := map[string]string{
+		"X-Amz-Algorithm":     algorithm,
+		"X-Amz-Credential":    creds.AccessKeyID + "/" + scope,
+		"X-Amz-Date":          amzDate,
+		"X-Amz-Expires":       strconv.Itoa(int(req.expires.Seconds())),
+		"X-Amz-SignedHeaders": "host",
+	}
+	if creds.SessionToken != "" {
+		params["X-Amz-Security-Token"] = creds.SessionToken
+	}
+	for k, v := range req.params {
+		params[k] = v
+	}
+	query := canonicalQuery(params)
+
+	canonicalRequest := strings.Join([]string{
+		req.method,
+		req.path,
+		query,
+		"host:" + req.host + "\n",
+		"host",
+		req.payloadHash,
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{algorithm, amzDate, scope, hex.EncodeToString(requestHash[:])}, "\n")
+
+	key := signingKey(creds.SecretAccessKey, date, req.region, req.service)
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	return query + "&X-Amz-Signature=" + signature
+}
+
+// signingKey derives the SigV4 key of the date, region and service from the secret key.
+func signingKey(secret, date, region, service string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secret), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	return hmacSHA256(key, "aws4_request")
+}
+
+// canonicalQuery encodes params sorted by key, as required by SigV4.
+func canonicalQuery(params map[string]string) string {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, uriEncode(k)+"="+uriEncode(params[k]))
+	}
+	return strings.Join(parts, "&")
+}
+
+// uriEncode escapes everything except unreserved characters, spaces are encoded as %20.
+func uriEncode(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,265 @@
+package auth
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	imdsURL = "http://169.254.169.254"
+	// ecsCredentialsHost serves credentials of the task role at AWS_CONTAINER_CREDENTIALS_RELATIVE_URI.
+	ecsCredentialsHost = "http://169.254.170.2"
+	// credentialsRefreshBefore is how long before the expiry temporary credentials are refreshed,
+	// longer than the lifetime of tokens signed with them.
+	credentialsRefreshBefore = rdsTokenLifetime + time.Minute
+)
+
+// AWSCredentials sign requests. Expires is zero for long-term access keys.
+type AWSCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Expires         time.Time
+}
+
+// AWSCredentialsProvider fetches credentials to sign requests with.
+type AWSCredentialsProvider interface {
+	Credentials(ctx context.Context) (AWSCredentials, error)
+}
+
+// NewAWSCredentialsFromEnv picks the source of credentials the same way AWS SDKs do: access keys
+// from the environment, a web identity token (IRSA on EKS), the container endpoint (ECS task role)
+// and the instance role from the instance metadata service. Temporary credentials are cached.
+func NewAWSCredentialsFromEnv() AWSCredentialsProvider {
+	if keyID := os.Getenv("AWS_ACCESS_KEY_ID"); keyID != "" {
+		return StaticAWSCredentials{
+			AccessKeyID:     keyID,
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}
+	}
+	if tokenFile := os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"); tokenFile != "" {
+		return &cachedAWSCredentials{provider: &WebIdentityAWSCredentials{
+			RoleARN:     os.Getenv("AWS_ROLE_ARN"),
+			TokenFile:   tokenFile,
+			SessionName: os.Getenv("AWS_ROLE_SESSION_NAME"),
+			Region:      awsRegion(),
+		}}
+	}
+	if uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); uri != "" {
+		return &cachedAWSCredentials{provider: &ContainerAWSCredentials{URL: ecsCredentialsHost + uri}}
+	}
+	if fullURI := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI"); fullURI != "" {
+		return &cachedAWSCredentials{provider: &ContainerAWSCredentials{
+			URL:           fullURI,
+			AuthToken:     os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN"),
+			AuthTokenFile: os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"),
+		}}
+	}
+	return &cachedAWSCredentials{provider: &InstanceAWSCredentials{}}
+}
+
+func awsRegion() string {
+	if region := os.Getenv("AWS_REGION"); region != "" {
+		return region
+	}
+	return os.Getenv("AWS_DEFAULT_REGION")
+}
+
+// StaticAWSCredentials are credentials set explicitly, e.g. access keys of a user.
+type StaticAWSCredentials AWSCredentials
+
+func (c StaticAWSCredentials) Credentials(context.Context) (AWSCredentials, error) {
+	if c.AccessKeyID == "" || c.SecretAccessKey == "" {
+		return AWSCredentials{}, errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are required")
+	}
+	return AWSCredentials(c), nil
+}
+
+// WebIdentityAWSCredentials assume a role with a web identity token, e.g. the service account
+// token of an EKS pod (IRSA). The token file is re-read on every refresh, it's rotated by the kubelet.
+type WebIdentityAWSCredentials struct {
+	RoleARN     string
+	TokenFile   string
+	SessionName string
+	Region      string
+}
+
+func (c *WebIdentityAWSCredentials) Credentials(ctx context.Context) (AWSCredentials, error) {
+	if c.RoleARN == "" {
+		return AWSCredentials{}, errors.New("AWS_ROLE_ARN is required with AWS_WEB_IDENTITY_TOKEN_FILE")
+	}
+	token, err := os.ReadFile(c.TokenFile)
+	if err != nil {
+		return AWSCredentials{}, fmt.Errorf("failed to read web identity token: %w", err)
+	}
+	sessionName := c.SessionName
+	if sessionName == "" {
+		sessionName = fmt.Sprintf("overload-%d", time.Now().Unix())
+	}
+
+	endpoint := "https://sts.amazonaws.com/"
+	if c.Region != "" {
+		endpoint = "https://sts." + c.Region + ".amazonaws.com/"
+	}
+	form := url.Values{}
+	form.Set("Action", "AssumeRoleWithWebIdentity")
+	form.Set("Version", "2011-06-15")
+	form.Set("RoleArn", c.RoleARN)
+	form.Set("RoleSessionName", sessionName)
+	form.Set("WebIdentityToken", strings.TrimSpace(string(token)))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return AWSCredentials{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := metadataClient.Do(req)
+	if err != nil {
+		return AWSCredentials{}, err
+	}
+	defer resp.Body.Close()
+
+	var res struct {
+		Credentials struct {
+			AccessKeyID     string    `xml:"AccessKeyId"`
+			SecretAccessKey string    `xml:"SecretAccessKey"`
+			SessionToken    string    `xml:"SessionToken"`
+			Expiration      time.Time `xml:"Expiration"`
+		} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+		Error struct {
+			Code    string `xml:"Code"`
+			Message string `xml:"Message"`
+		} `xml:"Error"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return AWSCredentials{}, fmt.Errorf("sts returned %s: %w", resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return AWSCredentials{}, fmt.Errorf("sts returned %s: %s: %s", resp.Status, res.Error.Code, res.Error.Message)
+	}
+	return AWSCredentials{
+		AccessKeyID:     res.Credentials.AccessKeyID,
+		SecretAccessKey: res.Credentials.SecretAccessKey,
+		SessionToken:    res.Credentials.SessionToken,
+		Expires:         res.Credentials.Expiration,
+	}, nil
+}
+
+// ContainerAWSCredentials fetch credentials of the ECS task role, or from any container
+// credentials endpoint (EKS Pod Identity, Greengrass) with an authorization token.
+type ContainerAWSCredentials struct {
+	URL           string
+	AuthToken     string
+	AuthTokenFile string
+}
+
+func (c *ContainerAWSCredentials) Credentials(ctx context.Context) (AWSCredentials, error) {
+	headers := map[string]string{}
+	token := c.AuthToken
+	if c.AuthTokenFile != "" {
+		data, err := os.ReadFile(c.AuthTokenFile)
+		if err != nil {
+			return AWSCredentials{}, fmt.Errorf("failed to read container authorization token: %w", err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	if token != "" {
+		headers["Authorization"] = token
+	}
+
+	var res roleCredentials
+	if err := fetchMetadata(ctx, c.URL, headers, &res); err != nil {
+		return AWSCredentials{}, err
+	}
+	return res.credentials(), nil
+}
+
+// InstanceAWSCredentials fetch credentials of the EC2 instance role from the instance
+// metadata service, with IMDSv2 session tokens.
+type InstanceAWSCredentials struct{}
+
+func (c *InstanceAWSCredentials) Credentials(ctx context.Context) (AWSCredentials, error) {
+	token, err := requestMetadata(ctx, http.MethodPut, imdsURL+"/latest/api/token",
+		map[string]string{"X-aws-ec2-metadata-token-ttl-seconds": "300"})
+	if err != nil {
+		return AWSCredentials{}, fmt.Errorf("failed to get IMDS token: %w", err)
+	}
+	headers := map[string]string{"X-aws-ec2-metadata-token": string(token)}
+
+	const credentialsPath = "/latest/meta-data/iam/security-credentials/"
+	roles, err := requestMetadata(ctx, http.MethodGet, imdsURL+credentialsPath, headers)
+	if err != nil {
+		return AWSCredentials{}, fmt.Errorf("failed to get instance role: %w", err)
+	}
+	role, _, _ := strings.Cut(strings.TrimSpace(string(roles)), "\n")
+	if role == "" {
+		return AWSCredentials{}, errors.New("no IAM role attached to the instance")
+	}
+
+	var res roleCredentials
+	if err := fetchMetadata(ctx, imdsURL+credentialsPath+role, headers, &res); err != nil {
+		return AWSCredentials{}, err
+	}
+	return res.credentials(), nil
+}
+
+// roleCredentials is the response of the instance and container credentials endpoints.
+type roleCredentials struct {
+	AccessKeyID     string    `json:"AccessKeyId"`
+	SecretAccessKey string    `json:"SecretAccessKey"`
+	Token           string    `json:"Token"`
+	Expiration      time.Time `json:"Expiration"`
+}
+
+func (r roleCredentials) credentials() AWSCredentials {
+	return AWSCredentials{
+		AccessKeyID:     r.AccessKeyID,
+		SecretAccessKey: r.SecretAccessKey,
+		SessionToken:    r.Token,
+		Expires:         r.Expiration,
+	}
+}
+
+// cachedAWSCredentials reuse temporary credentials until they are about to expire.
+type cachedAWSCredentials struct {
+	provider AWSCredentialsProvider
+
+	mu      sync.Mutex
+	cached  AWSCredentials
+	fetches singleflight.Group
+}
+
+func (c *cachedAWSCredentials) Credentials(ctx context.Context) (AWSCredentials, error) {
+	c.mu.Lock()
+	cached := c.cached
+	c.mu.Unlock()
+	if cached.AccessKeyID != "" && (cached.Expires.IsZero() || time.Until(cached.Expires) > credentialsRefreshBefore) {
+		return cached, nil
+	}
+
+	res, err, _ := c.fetches.Do("", func() (any, error) {
+		creds, err := c.provider.Credentials(ctx)
+		if err != nil {
+			return nil, err
+		}
+		c.mu.Lock()
+		c.cached = creds
+		c.mu.Unlock()
+		return creds, nil
+	})
+	if err != nil {
+		return AWSCredentials{}, fmt.Errorf("failed to fetch AWS credentials: %w", err)
+	}
+	return res.(AWSCredentials), nil
+}
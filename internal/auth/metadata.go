@@ -0,0 +1,107 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	gcpTokenURL   = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+	azureTokenURL = "http://169.254.169.254/metadata/identity/oauth2/token"
+	// azureResource is the audience of tokens for Azure Database for PostgreSQL.
+	azureResource = "https://ossrdbms-aad.database.windows.net"
+)
+
+var metadataClient = &http.Client{Timeout: 10 * time.Second}
+
+// GCP fetches OAuth2 access tokens of the instance service account from the metadata server,
+// used as passwords by Cloud SQL and AlloyDB IAM database authentication.
+type GCP struct{}
+
+func (p *GCP) Token(ctx context.Context, _ *pgx.ConnConfig) (Token, error) {
+	var resp struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	err := fetchMetadata(ctx, gcpTokenURL, map[string]string{"Metadata-Flavor": "Google"}, &resp)
+	if err != nil {
+		return Token{}, err
+	}
+	return Token{
+		Value:   resp.AccessToken,
+		Expires: time.Now().Add(time.Duration(resp.ExpiresIn) * time.Second),
+	}, nil
+}
+
+// Azure fetches Entra ID (Azure AD) tokens of the managed identity from the instance metadata service.
+type Azure struct {
+	// ClientID selects a user-assigned identity, empty means the system-assigned one.
+	ClientID string
+}
+
+func (p *Azure) Token(ctx context.Context, _ *pgx.ConnConfig) (Token, error) {
+	q := url.Values{}
+	q.Set("api-version", "2018-02-01")
+	q.Set("resource", azureResource)
+	if p.ClientID != "" {
+		q.Set("client_id", p.ClientID)
+	}
+
+	// azure returns numbers as strings
+	var resp struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   string `json:"expires_in"`
+	}
+	err := fetchMetadata(ctx, azureTokenURL+"?"+q.Encode(), map[string]string{"Metadata": "true"}, &resp)
+	if err != nil {
+		return Token{}, err
+	}
+	expiresIn, err := strconv.Atoi(resp.ExpiresIn)
+	if err != nil {
+		return Token{}, fmt.Errorf("invalid expires_in %q", resp.ExpiresIn)
+	}
+	return Token{
+		Value:   resp.AccessToken,
+		Expires: time.Now().Add(time.Duration(expiresIn) * time.Second),
+	}, nil
+}
+
+// fetchMetadata requests JSON from the instance metadata server.
+func fetchMetadata(ctx context.Context, url string, headers map[string]string, res any) error {
+	body, err := requestMetadata(ctx, http.MethodGet, url, headers)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, res)
+}
+
+// requestMetadata sends a request without a body to the metadata server and returns the response body.
+func requestMetadata(ctx context.Context, method, url string, headers map[string]string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := metadataClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("metadata server returned %s: %s", resp.Status, body)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
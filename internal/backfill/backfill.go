@@ -0,0 +1,301 @@
+// Package backfill rehearses an online backfill: a column is optionally added with ALTER TABLE
+// and filled by UPDATE over key ranges in batches with pauses, while the foreground workload
+// runs. It reports the impact on the latency of the foreground queries and on replication lag.
+package backfill
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/petuhovskiy/overload/errs"
+	"github.com/petuhovskiy/overload/internal/dbconn"
+	"github.com/petuhovskiy/overload/internal/log"
+	"github.com/petuhovskiy/overload/internal/metrics"
+	"github.com/petuhovskiy/overload/internal/pgversion"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultKeyColumn   = "id"
+	defaultBatchSize   = 1000
+	defaultSleep       = 100 * time.Millisecond
+	defaultStartDelay  = time.Minute
+	defaultLockTimeout = 5 * time.Second
+	lagCheckInterval   = 5 * time.Second
+	logEveryBatches    = 100
+	// foregroundLatency is the histogram of the foreground queries.
+	foregroundLatency = "query_latency_seconds"
+)
+
+type Config struct {
+	// Table is the backfilled table, optionally schema-qualified, empty disables the backfill.
+	Table string
+	// AddColumn is the definition of a column added before the backfill, e.g. "score bigint".
+	AddColumn string
+	// Set is the assignment of the UPDATE, e.g. "score = abalance * 2".
+	Set string
+	// Where limits updated rows within every batch, e.g. "score IS NULL".
+	Where string
+	// KeyColumn is an integer column the batches are ranges of.
+	KeyColumn string
+	// BatchSize is the number of keys of every batch.
+	BatchSize int
+	// Sleep is the pause between batches.
+	Sleep time.Duration
+	// StartDelay is the time the foreground workload runs before the backfill, measured as the baseline.
+	StartDelay time.Duration
+	// LockTimeout limits lock waits of ALTER TABLE and batches, timed out statements are retried
+	// after the pause, so that the backfill never blocks the foreground queries for long.
+	LockTimeout time.Duration
+}
+
+func (conf *Config) Normalize() {
+	if conf.KeyColumn == "" {
+		conf.KeyColumn = defaultKeyColumn
+	}
+
+	if conf.BatchSize == 0 {
+		conf.BatchSize = defaultBatchSize
+	}
+
+	if conf.Sleep == 0 {
+		conf.Sleep = defaultSleep
+	}
+
+	if conf.StartDelay == 0 {
+		conf.StartDelay = defaultStartDelay
+	}
+
+	if conf.LockTimeout == 0 {
+		conf.LockTimeout = defaultLockTimeout
+	}
+}
+
+// Latency summarizes foreground executions within a period.
+type Latency struct {
+	Executions int64
+	Avg        time.Duration
+	P99        time.Duration
+}
+
+func latencyOf(h metrics.HistogramSnapshot) Latency {
+	if h.Count == 0 {
+		return Latency{}
+	}
+	p99 := h.Quantile(0.99)
+	if math.IsInf(p99, 1) {
+		p99 = metrics.HistogramBuckets[len(metrics.HistogramBuckets)-1]
+	}
+	return Latency{
+		Executions: h.Count,
+		Avg:        time.Duration(h.Sum / float64(h.Count) * float64(time.Second)),
+		P99:        time.Duration(p99 * float64(time.Second)),
+	}
+}
+
+// Result is the outcome of the backfill.
+type Result struct {
+	SQL string
+	// AlterDuration is the time of ALTER TABLE, including lock waits and retries.
+	AlterDuration time.Duration `json:",omitempty"`
+	Rows          int64
+	Batches       int
+	// LockTimeouts is the number of statements retried after a lock timeout.
+	LockTimeouts int
+	Duration     time.Duration
+	BatchAvg     time.Duration
+	BatchMax     time.Duration
+	// Baseline is the foreground latency before the backfill, During is while it runs.
+	Baseline Latency
+	During   Latency
+	// BaselineReplicationLag is the lag when the backfill starts, MaxReplicationLag is the max
+	// lag sampled while it runs. Both are zero if there are no replicas.
+	BaselineReplicationLag time.Duration
+	MaxReplicationLag      time.Duration
+}
+
+// Run waits for StartDelay, then backfills the table in batches until all keys are covered.
+func Run(ctx context.Context, connstr string, conf Config) (Result, error) {
+	conf.Normalize()
+	// the table can be schema-qualified, e.g. public.accounts
+	table := pgx.Identifier(strings.SplitN(conf.Table, ".", 2)).Sanitize()
+	key := pgx.Identifier{conf.KeyColumn}.Sanitize()
+	where := ""
+	if conf.Where != "" {
+		where = " AND (" + conf.Where + ")"
+	}
+	res := Result{SQL: fmt.Sprintf("UPDATE %s SET %s WHERE %s BETWEEN $1 AND $2%s", table, conf.Set, key, where)}
+	if conf.Set == "" {
+		return res, errors.New("backfill assignment is not set")
+	}
+
+	start := metrics.Default.Snapshot().HistogramSum(foregroundLatency)
+	select {
+	case <-ctx.Done():
+		return res, ctx.Err()
+	case <-time.After(conf.StartDelay):
+	}
+
+	config, err := pgx.ParseConfig(connstr)
+	if err != nil {
+		return res, err
+	}
+	config.RuntimeParams["lock_timeout"] = strconv.FormatInt(conf.LockTimeout.Milliseconds(), 10)
+	conn, err := dbconn.ConnectConfig(ctx, config)
+	if err != nil {
+		return res, err
+	}
+	defer conn.Close(context.Background())
+
+	began := time.Now()
+	before := metrics.Default.Snapshot().HistogramSum(foregroundLatency)
+	res.Baseline = latencyOf(before.Sub(start))
+	defer func() {
+		res.During = latencyOf(metrics.Default.Snapshot().HistogramSum(foregroundLatency).Sub(before))
+		res.Duration = time.Since(began)
+	}()
+
+	lags := make(chan time.Duration, 1)
+	lagCtx, stopLag := context.WithCancel(ctx)
+	defer func() {
+		stopLag()
+		res.MaxReplicationLag = <-lags
+	}()
+	res.BaselineReplicationLag = watchReplicationLag(lagCtx, connstr, lags)
+
+	if conf.AddColumn != "" {
+		alterStart := time.Now()
+		alter := fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s", table, conf.AddColumn)
+		if err := execRetrying(ctx, conn, conf.Sleep, &res.LockTimeouts, alter); err != nil {
+			return res, fmt.Errorf("failed to add column: %w", err)
+		}
+		res.AlterDuration = time.Since(alterStart)
+		log.Info(ctx, "backfill column added", zap.Duration("elapsed", res.AlterDuration))
+	}
+
+	var minKey, maxKey *int64
+	err = conn.QueryRow(ctx, fmt.Sprintf("SELECT min(%[1]s)::bigint, max(%[1]s)::bigint FROM %[2]s", key, table)).Scan(&minKey, &maxKey)
+	if err != nil {
+		return res, err
+	}
+	if minKey == nil {
+		return res, nil
+	}
+
+	rows := metrics.Default.Counter("backfill_rows_total", "table", conf.Table)
+	batchLatency := metrics.Default.Histogram("backfill_batch_seconds", "table", conf.Table)
+	progress := metrics.Default.Gauge("backfill_progress", "table", conf.Table)
+	log.Info(ctx, "backfill started", zap.String("sql", res.SQL), zap.Int64("min_key", *minKey), zap.Int64("max_key", *maxKey))
+
+	var batchSum time.Duration
+	for from := *minKey; from <= *maxKey; from += int64(conf.BatchSize) {
+		to := min(from+int64(conf.BatchSize)-1, *maxKey)
+		batchStart := time.Now()
+		var tag pgconn.CommandTag
+		err := retryLockTimeouts(ctx, conf.Sleep, &res.LockTimeouts, func() error {
+			var err error
+			tag, err = conn.Exec(ctx, res.SQL, from, to)
+			return err
+		})
+		if err != nil {
+			return res, fmt.Errorf("batch %d-%d failed: %w", from, to, err)
+		}
+		elapsed := time.Since(batchStart)
+
+		res.Batches++
+		res.Rows += tag.RowsAffected()
+		res.BatchMax = max(res.BatchMax, elapsed)
+		batchSum += elapsed
+		res.BatchAvg = batchSum / time.Duration(res.Batches)
+		rows.Add(tag.RowsAffected())
+		batchLatency.Observe(elapsed.Seconds())
+		progress.Set(float64(to-*minKey+1) / float64(*maxKey-*minKey+1))
+		if res.Batches%logEveryBatches == 0 {
+			log.Info(ctx, "backfill progress", zap.Int64("key", to), zap.Int64("rows", res.Rows), zap.Int("batches", res.Batches))
+		}
+
+		select {
+		case <-ctx.Done():
+			return res, ctx.Err()
+		case <-time.After(conf.Sleep):
+		}
+	}
+	return res, nil
+}
+
+// execRetrying executes the statement, retrying it after lock timeouts.
+func execRetrying(ctx context.Context, conn *pgx.Conn, pause time.Duration, timeouts *int, sql string) error {
+	return retryLockTimeouts(ctx, pause, timeouts, func() error {
+		_, err := conn.Exec(ctx, sql)
+		return err
+	})
+}
+
+// retryLockTimeouts calls exec until it doesn't fail with a lock timeout, pausing between attempts.
+func retryLockTimeouts(ctx context.Context, pause time.Duration, timeouts *int, exec func() error) error {
+	for {
+		err := exec()
+		var pgErr *pgconn.PgError
+		if !errors.As(err, &pgErr) || pgErr.Code != errs.CodeLockNotAvailable {
+			return err
+		}
+		*timeouts++
+		log.Warn(ctx, "backfill statement timed out waiting for a lock, retrying")
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(pause):
+		}
+	}
+}
+
+// watchReplicationLag returns the current replication lag and samples it until the context
+// is done, then sends the max lag to the channel.
+func watchReplicationLag(ctx context.Context, connstr string, lags chan<- time.Duration) time.Duration {
+	conn, err := dbconn.Connect(ctx, connstr)
+	if err != nil {
+		log.Warn(ctx, "failed to connect for replication lag checks", zap.Error(err))
+		lags <- 0
+		return 0
+	}
+	// replay_lag is not reported by old servers and other engines
+	if !pgversion.FromConn(conn).HasReplayLag() {
+		conn.Close(context.Background())
+		lags <- 0
+		return 0
+	}
+
+	gauge := metrics.Default.Gauge("backfill_replication_lag_seconds")
+	check := func() time.Duration {
+		var lag time.Duration
+		err := conn.QueryRow(ctx, "SELECT COALESCE(max(replay_lag), '0'::interval) FROM pg_stat_replication").Scan(&lag)
+		if err != nil && ctx.Err() == nil {
+			log.Warn(ctx, "failed to get replication lag", zap.Error(err))
+		}
+		gauge.Set(lag.Seconds())
+		return lag
+	}
+	baseline := check()
+
+	go func() {
+		defer conn.Close(context.Background())
+		var maxLag time.Duration
+		for {
+			select {
+			case <-ctx.Done():
+				lags <- maxLag
+				return
+			case <-time.After(lagCheckInterval):
+			}
+			maxLag = max(maxLag, check())
+		}
+	}()
+	return baseline
+}
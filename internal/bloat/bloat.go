@@ -0,0 +1,254 @@
+// Package bloat periodically estimates dead space in tables and indexes, so that bloat
+// accumulated by update- and delete-heavy workloads can be tracked over time.
+package bloat
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/petuhovskiy/overload/internal/dbconn"
+	"github.com/petuhovskiy/overload/internal/log"
+	"github.com/petuhovskiy/overload/internal/metrics"
+	"github.com/petuhovskiy/overload/internal/reconnect"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultLimit = 20
+	// minPages excludes tables and indexes smaller than 1MB, their bloat doesn't matter,
+	// the same limit is used in index queries
+	minPages = 128
+)
+
+type Config struct {
+	// Interval is how often bloat is estimated, zero or negative disables sampling.
+	Interval time.Duration
+	// Tables are names of the tables to estimate, with their indexes. By default the
+	// largest user tables are estimated.
+	Tables []string
+	// Limit is the max number of tables estimated when Tables are not set, default 20.
+	Limit int
+	// Exact measures bloat with pgstattuple instead of estimating it from statistics, the
+	// extension has to be installed.
+	Exact bool
+}
+
+// Enabled returns true if bloat has to be sampled.
+func (conf Config) Enabled() bool {
+	return conf.Interval > 0
+}
+
+func (conf *Config) Normalize() {
+	if conf.Limit == 0 {
+		conf.Limit = defaultLimit
+	}
+}
+
+// Estimate is the bloat of a single table or index.
+type Estimate struct {
+	// Relation is the schema-qualified name.
+	Relation string
+	// Kind is "table" or "index".
+	Kind  string
+	Size  int64
+	Bloat int64
+}
+
+// Ratio is the share of the relation taken by bloat.
+func (e *Estimate) Ratio() float64 {
+	if e.Size == 0 {
+		return 0
+	}
+	return float64(e.Bloat) / float64(e.Size)
+}
+
+// candidates returns oids of the tables to estimate.
+func candidates(ctx context.Context, conn *pgx.Conn, conf Config) ([]uint32, error) {
+	var rows pgx.Rows
+	var err error
+	if len(conf.Tables) > 0 {
+		rows, err = conn.Query(ctx, `
+			SELECT c.oid FROM unnest($1::text[]) t(name)
+			JOIN pg_class c ON c.oid = to_regclass(t.name)`, conf.Tables)
+	} else {
+		rows, err = conn.Query(ctx, `
+			SELECT c.oid FROM pg_class c
+			JOIN pg_namespace n ON n.oid = c.relnamespace
+			WHERE c.relkind IN ('r', 'm') AND c.relpages >= $1
+				AND n.nspname NOT IN ('pg_catalog', 'information_schema') AND n.nspname NOT LIKE 'pg_toast%'
+			ORDER BY c.relpages DESC
+			LIMIT $2`, minPages, conf.Limit)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[uint32])
+}
+
+// checkPgstattuple returns an error if the pgstattuple extension is not installed in the database.
+func checkPgstattuple(ctx context.Context, conn *pgx.Conn) error {
+	var installed bool
+	err := conn.QueryRow(ctx, `SELECT EXISTS (SELECT FROM pg_extension WHERE extname = 'pgstattuple')`).Scan(&installed)
+	if err != nil {
+		return err
+	}
+	if !installed {
+		return fmt.Errorf("pgstattuple extension is not installed, run CREATE EXTENSION pgstattuple or unset BLOAT_EXACT")
+	}
+	return nil
+}
+
+// Sample estimates bloat of the configured tables, or of the largest ones, and their indexes.
+func Sample(ctx context.Context, conn *pgx.Conn, conf Config) ([]Estimate, error) {
+	conf.Normalize()
+	tables, err := candidates(ctx, conn, conf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tables: %w", err)
+	}
+	return Collect(ctx, conn, tables, conf.Exact)
+}
+
+// Collect estimates bloat of the tables and their btree indexes. With exact set, bloat is
+// measured by pgstattuple instead of estimated from statistics.
+func Collect(ctx context.Context, conn *pgx.Conn, tables []uint32, exact bool) ([]Estimate, error) {
+	tableQuery, indexQuery := estimateTablesQuery, estimateIndexesQuery
+	if exact {
+		tableQuery, indexQuery = exactTablesQuery, exactIndexesQuery
+	}
+
+	var estimates []Estimate
+	for _, q := range []string{tableQuery, indexQuery} {
+		rows, err := conn.Query(ctx, q, tables)
+		if err != nil {
+			return nil, err
+		}
+		res, err := pgx.CollectRows(rows, pgx.RowToStructByPos[Estimate])
+		if err != nil {
+			return nil, err
+		}
+		estimates = append(estimates, res...)
+	}
+	return estimates, nil
+}
+
+// estimateTablesQuery compares the size of the table with the size of its live tuples,
+// computed from row widths in pg_stats: 24 bytes of the tuple header and 4 bytes of the
+// item pointer per row. Alignment padding is ignored, so it slightly overestimates bloat.
+const estimateTablesQuery = `
+SELECT n.nspname || '.' || c.relname, 'table',
+	c.relpages::bigint * current_setting('block_size')::bigint,
+	GREATEST(c.relpages - ceil(c.reltuples * (28 + COALESCE(w.width, 0))
+		/ (current_setting('block_size')::int - 24)), 0)::bigint * current_setting('block_size')::bigint
+FROM pg_class c
+JOIN pg_namespace n ON n.oid = c.relnamespace
+LEFT JOIN LATERAL (
+	SELECT sum((1 - s.null_frac) * s.avg_width) AS width
+	FROM pg_stats s
+	WHERE s.schemaname = n.nspname AND s.tablename = c.relname
+) w ON true
+WHERE c.oid = ANY($1) AND c.reltuples >= 0`
+
+// estimateIndexesQuery does the same for btree indexes, with 8 bytes of the index tuple
+// header, 4 bytes of the item pointer and the default fillfactor of 90.
+const estimateIndexesQuery = `
+SELECT n.nspname || '.' || ic.relname, 'index',
+	ic.relpages::bigint * current_setting('block_size')::bigint,
+	GREATEST(ic.relpages - 1 - ceil(ic.reltuples * (12 + COALESCE(w.width, 0))
+		/ ((current_setting('block_size')::int - 40) * 0.9)), 0)::bigint * current_setting('block_size')::bigint
+FROM pg_index i
+JOIN pg_class ic ON ic.oid = i.indexrelid
+JOIN pg_class tc ON tc.oid = i.indrelid
+JOIN pg_namespace n ON n.oid = ic.relnamespace
+JOIN pg_am am ON am.oid = ic.relam
+LEFT JOIN LATERAL (
+	SELECT sum(s.avg_width) AS width
+	FROM pg_attribute a
+	JOIN pg_stats s ON s.schemaname = n.nspname AND s.tablename = tc.relname AND s.attname = a.attname
+	WHERE a.attrelid = i.indrelid AND a.attnum = ANY(i.indkey)
+) w ON true
+WHERE i.indrelid = ANY($1) AND am.amname = 'btree' AND ic.relpages >= 128 AND ic.reltuples >= 0`
+
+// exactTablesQuery counts dead tuples and free space with pgstattuple_approx, which skips
+// all-visible pages using the visibility map.
+const exactTablesQuery = `
+SELECT n.nspname || '.' || c.relname, 'table', s.table_len, (s.dead_tuple_len + s.approx_free_space)::bigint
+FROM pg_class c
+JOIN pg_namespace n ON n.oid = c.relnamespace,
+LATERAL pgstattuple_approx(c.oid) s
+WHERE c.oid = ANY($1) AND c.relkind IN ('r', 'm')`
+
+// exactIndexesQuery measures the leaf density of btree indexes with pgstatindex, bloat is
+// the space beyond the default fillfactor of 90.
+const exactIndexesQuery = `
+SELECT n.nspname || '.' || ic.relname, 'index', s.index_size,
+	GREATEST(s.index_size * (1 - s.avg_leaf_density / 90), 0)::bigint
+FROM pg_index i
+JOIN pg_class ic ON ic.oid = i.indexrelid
+JOIN pg_namespace n ON n.oid = ic.relnamespace
+JOIN pg_am am ON am.oid = ic.relam,
+LATERAL pgstatindex(ic.oid::regclass) s
+WHERE i.indrelid = ANY($1) AND am.amname = 'btree' AND ic.relpages >= 128 AND s.leaf_pages > 0`
+
+// Run periodically estimates bloat and exports it as gauges, until the context is done.
+// It returns immediately if sampling is disabled.
+func Run(ctx context.Context, connstr string, conf Config) {
+	if !conf.Enabled() {
+		return
+	}
+	conf.Normalize()
+	ctx = log.With(ctx, zap.String("job", "bloat"))
+
+	conn, err := reconnect.Connect(ctx, reconnect.Config{}, "bloat", func(ctx context.Context) (*pgx.Conn, error) {
+		return dbconn.Connect(ctx, connstr)
+	})
+	if err != nil {
+		log.Error(ctx, "failed to connect", zap.Error(err))
+		return
+	}
+	defer conn.Close(context.Background())
+
+	// pgstattuple reads relations, but gives real numbers instead of statistics-based
+	// estimates, which are off on tables that were never analyzed
+	if conf.Exact {
+		if err := checkPgstattuple(ctx, conn); err != nil {
+			log.Error(ctx, "bloat sampling disabled", zap.Error(err))
+			return
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(conf.Interval):
+		}
+
+		estimates, err := Sample(ctx, conn, conf)
+		if err != nil {
+			log.Warn(ctx, "failed to estimate bloat", zap.Error(err))
+			continue
+		}
+		report(ctx, estimates)
+	}
+}
+
+// report exports estimates as gauges and logs the total.
+func report(ctx context.Context, estimates []Estimate) {
+	var size, bloat int64
+	for i := range estimates {
+		e := &estimates[i]
+		metrics.Default.Gauge("bloat_bytes", "relation", e.Relation, "kind", e.Kind).Set(float64(e.Bloat))
+		metrics.Default.Gauge("bloat_ratio", "relation", e.Relation, "kind", e.Kind).Set(e.Ratio())
+		size += e.Size
+		bloat += e.Bloat
+	}
+	metrics.Default.Gauge("bloat_total_bytes").Set(float64(bloat))
+
+	log.Info(ctx, "estimated bloat",
+		zap.Int("relations", len(estimates)),
+		zap.Int64("size", size),
+		zap.Int64("bloat", bloat),
+	)
+}
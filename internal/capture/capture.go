@@ -0,0 +1,189 @@
+// Package capture records executed statements into a replayable log.
+package capture
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/petuhovskiy/overload/internal/log"
+	"go.uber.org/zap"
+)
+
+// Entry is a single executed statement.
+type Entry struct {
+	Time time.Time `json:"time"`
+	// Session identifies the client connection that executed the statement, it's assigned
+	// by the recording process and is never reused, unlike backend PIDs. Zero in captures
+	// recorded before sessions were added.
+	Session uint64 `json:"session,omitempty"`
+	// Conn is the backend PID of the connection that executed the statement.
+	Conn uint32 `json:"conn"`
+	SQL  string `json:"sql"`
+	Args []any  `json:"args,omitempty"`
+}
+
+// sessionKey is the key of the session id in the custom data of the connection.
+const sessionKey = "capture_session"
+
+var lastSession atomic.Uint64
+
+// SessionID returns the id of the connection in the capture, assigning a new one on the first call.
+func SessionID(conn *pgconn.PgConn) uint64 {
+	data := conn.CustomData()
+	if id, ok := data[sessionKey].(uint64); ok {
+		return id
+	}
+	id := lastSession.Add(1)
+	data[sessionKey] = id
+	return id
+}
+
+// session returns the key entries of a single connection are grouped by.
+func (e *Entry) session() uint64 {
+	if e.Session != 0 {
+		return e.Session
+	}
+	// old captures have only PIDs, which are unique among open connections
+	return uint64(e.Conn) << 32
+}
+
+// Recorder writes entries to a gzip-compressed file with one JSON entry per line.
+// It's safe for concurrent use, nil Recorder records nothing.
+type Recorder struct {
+	mu   sync.Mutex
+	file *os.File
+	gz   *gzip.Writer
+	buf  *bufio.Writer
+	enc  *json.Encoder
+	err  error
+}
+
+// NewRecorder creates the capture file, truncating it if it exists.
+func NewRecorder(path string) (*Recorder, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	gz := gzip.NewWriter(file)
+	buf := bufio.NewWriter(gz)
+	return &Recorder{
+		file: file,
+		gz:   gz,
+		buf:  buf,
+		enc:  json.NewEncoder(buf),
+	}, nil
+}
+
+// Record appends a statement executed by the connection to the capture. Write errors
+// are logged once and stop the recording, the workload itself is not affected.
+func (r *Recorder) Record(conn *pgconn.PgConn, sql string, args []any) {
+	if r == nil {
+		return
+	}
+
+	entry := Entry{
+		Time:    time.Now(),
+		Session: SessionID(conn),
+		Conn:    conn.PID(),
+		SQL:     sql,
+		Args:    args,
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return
+	}
+	if err := r.enc.Encode(entry); err != nil {
+		r.err = err
+		log.Error(context.Background(), "failed to write capture, recording stopped", zap.Error(err))
+	}
+}
+
+// Close flushes and closes the capture file.
+func (r *Recorder) Close() error {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return errors.Join(r.buf.Flush(), r.gz.Close(), r.file.Close())
+}
+
+// Reader reads entries from a capture file.
+type Reader struct {
+	file *os.File
+	gz   *gzip.Reader
+	dec  *json.Decoder
+}
+
+func OpenReader(path string) (*Reader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	dec := json.NewDecoder(gz)
+	dec.UseNumber()
+	return &Reader{file: file, gz: gz, dec: dec}, nil
+}
+
+// Next returns the next entry, or io.EOF at the end of the capture.
+// Numeric args are decoded as int64 if possible and float64 otherwise.
+func (r *Reader) Next() (Entry, error) {
+	var entry Entry
+	if err := r.dec.Decode(&entry); err != nil {
+		return Entry{}, err
+	}
+	for i, arg := range entry.Args {
+		if num, ok := arg.(json.Number); ok {
+			if v, err := num.Int64(); err == nil {
+				entry.Args[i] = v
+			} else if v, err := num.Float64(); err == nil {
+				entry.Args[i] = v
+			}
+		}
+	}
+	return entry, nil
+}
+
+func (r *Reader) Close() error {
+	return errors.Join(r.gz.Close(), r.file.Close())
+}
+
+// ReadAll reads all entries of the capture file.
+func ReadAll(path string) ([]Entry, error) {
+	r, err := OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var entries []Entry
+	for {
+		entry, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+}
@@ -0,0 +1,77 @@
+package capture
+
+import (
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeCapture(t *testing.T, lines string) string {
+	path := filepath.Join(t.TempDir(), "capture.jsonl.gz")
+	file, err := os.Create(path)
+	require.NoError(t, err)
+	gz := gzip.NewWriter(file)
+	_, err = gz.Write([]byte(lines))
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+	require.NoError(t, file.Close())
+	return path
+}
+
+func TestReadAll(t *testing.T) {
+	path := writeCapture(t, `{"time":"2024-01-02T03:04:05Z","session":1,"conn":100,"sql":"select $1, $2, $3, $4","args":[42,1.5,"text",null]}
+{"time":"2024-01-02T03:04:06Z","conn":200,"sql":"select 1"}
+`)
+
+	entries, err := ReadAll(path)
+	require.NoError(t, err)
+	require.Equal(t, []Entry{
+		{
+			Time:    time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+			Session: 1,
+			Conn:    100,
+			SQL:     "select $1, $2, $3, $4",
+			Args:    []any{int64(42), 1.5, "text", nil},
+		},
+		{
+			Time: time.Date(2024, 1, 2, 3, 4, 6, 0, time.UTC),
+			Conn: 200,
+			SQL:  "select 1",
+		},
+	}, entries)
+
+	require.EqualValues(t, 1, entries[0].session())
+	require.EqualValues(t, 200<<32, entries[1].session(), "old captures are grouped by PID")
+}
+
+func TestReadAllErrors(t *testing.T) {
+	_, err := ReadAll(filepath.Join(t.TempDir(), "missing.jsonl.gz"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	_, err = ReadAll(writeCapture(t, "{\"sql\":\"select 1\"}\nnot json\n"))
+	require.Error(t, err)
+
+	plain := filepath.Join(t.TempDir(), "plain.jsonl")
+	require.NoError(t, os.WriteFile(plain, []byte("{}\n"), 0o644))
+	_, err = ReadAll(plain)
+	require.Error(t, err, "captures are gzip-compressed")
+}
+
+func TestRecorderEmpty(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.jsonl.gz")
+	r, err := NewRecorder(path)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+
+	entries, err := ReadAll(path)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+
+	var nilRecorder *Recorder
+	nilRecorder.Record(nil, "select 1", nil)
+	require.NoError(t, nilRecorder.Close())
+}
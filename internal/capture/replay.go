@@ -0,0 +1,139 @@
+package capture
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/petuhovskiy/overload/internal/dbconn"
+	"github.com/petuhovskiy/overload/internal/log"
+	"go.uber.org/zap"
+)
+
+// ReplayStats summarizes a replay.
+type ReplayStats struct {
+	Conns      int
+	Statements int
+	Errors     int
+	// Lag is the max delay of a statement behind its original schedule.
+	Lag      time.Duration
+	Duration time.Duration
+}
+
+// Replay executes captured entries against the database, preserving the original
+// timing and the assignment of statements to sessions. Speed scales the timing,
+// e.g. 2 replays twice as fast, zero executes statements without delays.
+//
+// Every session connects right before its first statement and disconnects after its last
+// one, so the number of open connections follows the original run, even when it opened
+// a connection per query.
+//
+// Statements are sent with the simple protocol, so that args decoded from JSON
+// are converted to the original types by the server.
+func Replay(ctx context.Context, connstr string, entries []Entry, speed float64) (ReplayStats, error) {
+	var stats ReplayStats
+	if len(entries) == 0 {
+		return stats, nil
+	}
+
+	bySession := map[uint64][]Entry{}
+	var order []uint64
+	for _, e := range entries {
+		key := e.session()
+		if _, ok := bySession[key]; !ok {
+			order = append(order, key)
+		}
+		bySession[key] = append(bySession[key], e)
+	}
+	stats.Conns = len(order)
+
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		first   = entries[0].Time
+		start   = time.Now()
+		connErr error
+	)
+	for _, e := range entries {
+		first = minTime(first, e.Time)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	for _, key := range order {
+		wg.Add(1)
+		go func(entries []Entry) {
+			defer wg.Done()
+			ctx := log.With(ctx, zap.Uint64("captured_session", entries[0].Session), zap.Uint32("captured_conn", entries[0].Conn))
+
+			var conn *pgx.Conn
+			defer func() {
+				if conn != nil {
+					conn.Close(context.Background())
+				}
+			}()
+			for _, e := range entries {
+				var scheduled time.Time
+				if speed > 0 {
+					scheduled = start.Add(time.Duration(float64(e.Time.Sub(first)) / speed))
+					select {
+					case <-ctx.Done():
+						return
+					case <-time.After(time.Until(scheduled)):
+					}
+				}
+
+				if conn == nil {
+					var err error
+					conn, err = dbconn.Connect(ctx, connstr)
+					if err != nil {
+						mu.Lock()
+						if connErr == nil && ctx.Err() == nil {
+							connErr = err
+						}
+						mu.Unlock()
+						cancel()
+						return
+					}
+				}
+
+				// connecting is included in the lag of the first statement
+				var lag time.Duration
+				if speed > 0 {
+					lag = time.Since(scheduled)
+				}
+
+				_, err := conn.Exec(ctx, e.SQL, append([]any{pgx.QueryExecModeSimpleProtocol}, e.Args...)...)
+				if err != nil {
+					if ctx.Err() != nil {
+						return
+					}
+					log.Debug(ctx, "replayed statement failed", zap.String("sql", e.SQL), zap.Error(err))
+				}
+
+				mu.Lock()
+				stats.Statements++
+				if err != nil {
+					stats.Errors++
+				}
+				stats.Lag = max(stats.Lag, lag)
+				mu.Unlock()
+			}
+		}(bySession[key])
+	}
+
+	wg.Wait()
+	stats.Duration = time.Since(start)
+	if connErr != nil {
+		return stats, connErr
+	}
+	return stats, ctx.Err()
+}
+
+func minTime(a, b time.Time) time.Time {
+	if b.Before(a) {
+		return b
+	}
+	return a
+}
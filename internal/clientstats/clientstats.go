@@ -0,0 +1,166 @@
+// Package clientstats measures resource usage of the load generator itself: CPU time of
+// the process and bytes sent and received on database connections. A throughput plateau
+// with the client CPU or network saturated is a limit of the client, not of the target.
+package clientstats
+
+import (
+	"context"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/petuhovskiy/overload/internal/log"
+	"github.com/petuhovskiy/overload/internal/metrics"
+	"go.uber.org/zap"
+)
+
+// saturatedCPU is the fraction of available cores above which the client is considered saturated.
+const saturatedCPU = 0.9
+
+// Sampler counts connection traffic and periodically samples CPU usage and network rates.
+type Sampler struct {
+	sent     atomic.Int64
+	received atomic.Int64
+	start    time.Time
+	startCPU time.Duration
+
+	mu       sync.Mutex
+	peakCPU  float64
+	peakSend float64
+	peakRecv float64
+}
+
+// Default is the sampler of the whole process, all connections made by dbconn are counted.
+var Default = New()
+
+func New() *Sampler {
+	return &Sampler{start: time.Now(), startCPU: CPUTime()}
+}
+
+// Apply counts traffic of all connections created with the config.
+func (s *Sampler) Apply(config *pgx.ConnConfig) {
+	dial := config.DialFunc
+	config.DialFunc = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &countingConn{Conn: conn, sampler: s}, nil
+	}
+}
+
+// Run samples CPU usage and network rates every interval, until the context is done.
+func (s *Sampler) Run(ctx context.Context, interval time.Duration) {
+	cpuGauge := metrics.Default.Gauge("client_cpu_cores")
+	sendGauge := metrics.Default.Gauge("client_net_send_mbps")
+	recvGauge := metrics.Default.Gauge("client_net_recv_mbps")
+	metrics.Default.Gauge("client_cpu_available_cores").Set(float64(runtime.NumCPU()))
+
+	prevTime, prevCPU := time.Now(), CPUTime()
+	prevSent, prevRecv := s.sent.Load(), s.received.Load()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+
+		now, cpu := time.Now(), CPUTime()
+		sent, recv := s.sent.Load(), s.received.Load()
+		elapsed := now.Sub(prevTime).Seconds()
+
+		cores := (cpu - prevCPU).Seconds() / elapsed
+		sendMBps := float64(sent-prevSent) / elapsed / (1 << 20)
+		recvMBps := float64(recv-prevRecv) / elapsed / (1 << 20)
+		cpuGauge.Set(cores)
+		sendGauge.Set(sendMBps)
+		recvGauge.Set(recvMBps)
+
+		s.mu.Lock()
+		s.peakCPU = max(s.peakCPU, cores)
+		s.peakSend = max(s.peakSend, sendMBps)
+		s.peakRecv = max(s.peakRecv, recvMBps)
+		s.mu.Unlock()
+
+		prevTime, prevCPU, prevSent, prevRecv = now, cpu, sent, recv
+	}
+}
+
+// Summary is the resource usage of the client since the start of the process.
+type Summary struct {
+	// AvailableCores is the number of CPU cores of the client machine.
+	AvailableCores int
+	CPUSeconds     float64
+	// AvgCores and PeakCores are the numbers of cores busy on average and at the busiest sample.
+	AvgCores  float64
+	PeakCores float64
+	// SentBytes and ReceivedBytes are the traffic of all database connections.
+	SentBytes     int64
+	ReceivedBytes int64
+	PeakSendMBps  float64
+	PeakRecvMBps  float64
+	// CPUSaturated is set when the client used almost all cores at some point, so the measured
+	// throughput may be limited by the client.
+	CPUSaturated bool
+}
+
+// Summary returns the resource usage since the start of the process.
+func (s *Sampler) Summary() Summary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cpu := (CPUTime() - s.startCPU).Seconds()
+	res := Summary{
+		AvailableCores: runtime.NumCPU(),
+		CPUSeconds:     cpu,
+		AvgCores:       cpu / time.Since(s.start).Seconds(),
+		PeakCores:      s.peakCPU,
+		SentBytes:      s.sent.Load(),
+		ReceivedBytes:  s.received.Load(),
+		PeakSendMBps:   s.peakSend,
+		PeakRecvMBps:   s.peakRecv,
+	}
+	res.CPUSaturated = res.PeakCores >= saturatedCPU*float64(res.AvailableCores)
+	return res
+}
+
+// LogSummary logs the resource usage, with a warning if the client CPU was saturated.
+func (s *Sampler) LogSummary(ctx context.Context) {
+	summary := s.Summary()
+	log.Info(ctx, "client resource usage", zap.Any("client", summary))
+	if summary.CPUSaturated {
+		log.Warn(ctx, "client CPU was saturated, throughput may be limited by the client",
+			zap.Float64("peak_cores", summary.PeakCores), zap.Int("available_cores", summary.AvailableCores))
+	}
+}
+
+// countingConn counts bytes read from and written to the connection.
+type countingConn struct {
+	net.Conn
+	sampler *Sampler
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.sampler.received.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.sampler.sent.Add(int64(n))
+	return n, err
+}
+
+// CPUTime returns user and system CPU time consumed by the process.
+func CPUTime() time.Duration {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		return 0
+	}
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
@@ -0,0 +1,164 @@
+// Package compat provides alternatives to Postgres-specific queries for wire-compatible engines,
+// such as CockroachDB, so that modules can target them without changes.
+package compat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/petuhovskiy/overload/errs"
+	"github.com/petuhovskiy/overload/internal/pgversion"
+	"github.com/petuhovskiy/overload/internal/reconnect"
+)
+
+// defaultCockroachRetries is the number of retries of serialization failures on CockroachDB,
+// where they are expected under contention because all transactions are serializable.
+const defaultCockroachRetries = 10
+
+// ErrUnsupported is returned for queries that have no alternative on the engine.
+var ErrUnsupported = errors.New("not supported by the database engine")
+
+// SystemSchemas are schemas that don't contain user tables, for all engines.
+var SystemSchemas = []string{"pg_catalog", "information_schema", "crdb_internal", "pg_extension"}
+
+// IsSerializationFailure returns true for errors that should be retried by the client.
+func IsSerializationFailure(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == errs.CodeSerializationFailure
+}
+
+// serializationBackoff spreads retries of conflicting transactions in time, so that they don't
+// collide again right away. It's the reconnect policy with delays fit for transactions.
+var serializationBackoff = reconnect.Config{
+	InitialDelay: 5 * time.Millisecond,
+	MaxDelay:     time.Second,
+	Multiplier:   2,
+	Jitter:       0.5,
+}
+
+// WaitSerializationRetry waits before the retry of a serialization failure, attempt starts from 1.
+// It returns false if the context is done first.
+func WaitSerializationRetry(ctx context.Context, attempt int) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(serializationBackoff.Delay(attempt)):
+		return true
+	}
+}
+
+// SerializationRetries returns the number of retries of serialization failures. Configured zero
+// means the default for the engine: no retries on Postgres, where failures are part of the workload,
+// and retries on other engines. Negative value disables retries.
+func SerializationRetries(v pgversion.Version, configured int) int {
+	switch {
+	case configured < 0:
+		return 0
+	case configured > 0:
+		return configured
+	case v.IsPostgres():
+		return 0
+	default:
+		return defaultCockroachRetries
+	}
+}
+
+// RelationSize returns the total size of the table in bytes, including indexes.
+// Table is a quoted, optionally schema-qualified name.
+func RelationSize(ctx context.Context, conn *pgx.Conn, table string) (int64, error) {
+	var size int64
+	var err error
+	switch v := pgversion.FromConn(conn); {
+	case v.IsPostgres():
+		err = conn.QueryRow(ctx, `SELECT pg_total_relation_size($1::regclass)`, table).Scan(&size)
+	case v.Engine == pgversion.CockroachDB:
+		err = conn.QueryRow(ctx, fmt.Sprintf(
+			`SELECT COALESCE(sum(range_size), 0)::INT8 FROM [SHOW RANGES FROM TABLE %s WITH DETAILS]`, table)).Scan(&size)
+	default:
+		err = ErrUnsupported
+	}
+	return size, err
+}
+
+// DatabaseSize returns the size of the current database in bytes.
+func DatabaseSize(ctx context.Context, conn *pgx.Conn) (int64, error) {
+	var size int64
+	var err error
+	switch v := pgversion.FromConn(conn); {
+	case v.IsPostgres():
+		err = conn.QueryRow(ctx, `SELECT pg_database_size(current_database())`).Scan(&size)
+	case v.Engine == pgversion.CockroachDB:
+		var db string
+		if err := conn.QueryRow(ctx, `SELECT current_database()`).Scan(&db); err != nil {
+			return 0, err
+		}
+		err = conn.QueryRow(ctx, fmt.Sprintf(
+			`SELECT COALESCE(sum(range_size), 0)::INT8 FROM [SHOW RANGES FROM DATABASE %s WITH DETAILS]`,
+			pgx.Identifier{db}.Sanitize())).Scan(&size)
+	default:
+		err = ErrUnsupported
+	}
+	return size, err
+}
+
+// DatabaseSizes returns sizes of databases on the instance in bytes by name, of all databases
+// accepting connections if names are empty. Unknown names are skipped.
+func DatabaseSizes(ctx context.Context, conn *pgx.Conn, names []string) (map[string]int64, error) {
+	if !pgversion.FromConn(conn).IsPostgres() {
+		return nil, ErrUnsupported
+	}
+	rows, err := conn.Query(ctx, `
+		SELECT datname, pg_database_size(oid) FROM pg_database
+		WHERE datallowconn AND NOT datistemplate AND (COALESCE(cardinality($1::text[]), 0) = 0 OR datname = ANY($1))`, names)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sizes := map[string]int64{}
+	for rows.Next() {
+		var (
+			name string
+			size int64
+		)
+		if err := rows.Scan(&name, &size); err != nil {
+			return nil, err
+		}
+		sizes[name] = size
+	}
+	return sizes, rows.Err()
+}
+
+// WALPosition returns the current WAL insert location, for WALBytesSince.
+func WALPosition(ctx context.Context, conn *pgx.Conn) (string, error) {
+	var lsn string
+	var err error
+	switch v := pgversion.FromConn(conn); {
+	case v.HasWALFunctions():
+		err = conn.QueryRow(ctx, `SELECT pg_current_wal_lsn()::text`).Scan(&lsn)
+	case v.HasXLogFunctions():
+		err = conn.QueryRow(ctx, `SELECT pg_current_xlog_location()::text`).Scan(&lsn)
+	default:
+		err = ErrUnsupported
+	}
+	return lsn, err
+}
+
+// WALBytesSince returns the amount of WAL written since the position returned by WALPosition.
+func WALBytesSince(ctx context.Context, conn *pgx.Conn, start string) (int64, error) {
+	var bytes int64
+	var err error
+	switch v := pgversion.FromConn(conn); {
+	case v.HasWALFunctions():
+		err = conn.QueryRow(ctx, `SELECT pg_wal_lsn_diff(pg_current_wal_lsn(), $1::pg_lsn)::bigint`, start).Scan(&bytes)
+	case v.HasXLogFunctions():
+		err = conn.QueryRow(ctx, `SELECT pg_xlog_location_diff(pg_current_xlog_location(), $1::pg_lsn)::bigint`, start).Scan(&bytes)
+	default:
+		err = ErrUnsupported
+	}
+	return bytes, err
+}
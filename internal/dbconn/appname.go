@@ -0,0 +1,37 @@
+package dbconn
+
+import (
+	"sync"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// defaultAppName is application_name of connections before a run is started.
+const defaultAppName = "overload"
+
+var (
+	appNameMu sync.RWMutex
+	appName   = defaultAppName
+)
+
+// SetAppName sets application_name of all connections of the tool that don't set their own,
+// e.g. to tell sessions of the run from other sessions of the database.
+func SetAppName(name string) {
+	appNameMu.Lock()
+	defer appNameMu.Unlock()
+	appName = name
+}
+
+// AppName returns application_name of the tool's connections.
+func AppName() string {
+	appNameMu.RLock()
+	defer appNameMu.RUnlock()
+	return appName
+}
+
+// applyAppName sets application_name, unless it's set by the connection string or the caller.
+func applyAppName(config *pgx.ConnConfig) {
+	if config.RuntimeParams["application_name"] == "" {
+		config.RuntimeParams["application_name"] = AppName()
+	}
+}
@@ -0,0 +1,65 @@
+// Package dbconn connects to the target database, applying cloud auth tokens and safety limits
+// that all modules must respect, routing to proxies and counting client traffic.
+package dbconn
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/petuhovskiy/overload/errs"
+	"github.com/petuhovskiy/overload/internal/auth"
+	"github.com/petuhovskiy/overload/internal/clientstats"
+	"github.com/petuhovskiy/overload/internal/limits"
+)
+
+// Configure applies auth and safety limits to the connection config, and measures
+// the TLS handshake. The config must be used for a single connection.
+func Configure(ctx context.Context, config *pgx.ConnConfig) error {
+	if err := auth.Apply(ctx, config); err != nil {
+		return err
+	}
+	applyRoutes(config)
+	applyAppName(config)
+	limits.Apply(config)
+	clientstats.Default.Apply(config)
+	timeTLS(ctx, config)
+	return nil
+}
+
+// ConfigurePool applies safety limits to the pool config, auth tokens are applied
+// before every new connection, so that the pool outlives the tokens.
+func ConfigurePool(config *pgxpool.Config) {
+	applyRoutes(config.ConnConfig)
+	applyAppName(config.ConnConfig)
+	limits.Apply(config.ConnConfig)
+	clientstats.Default.Apply(config.ConnConfig)
+	config.BeforeConnect = func(ctx context.Context, config *pgx.ConnConfig) error {
+		timeTLS(ctx, config)
+		return auth.Apply(ctx, config)
+	}
+}
+
+// Connect connects to the database from the connection string. Invalid connection strings
+// are errs.ErrValidation, failures to connect are errs.ErrConnect.
+func Connect(ctx context.Context, connstr string) (*pgx.Conn, error) {
+	config, err := pgx.ParseConfig(connstr)
+	if err != nil {
+		return nil, errs.Validation(err)
+	}
+	return ConnectConfig(ctx, config)
+}
+
+// ConnectConfig connects to the database with a configured copy of the config,
+// failures are errs.ErrConnect.
+func ConnectConfig(ctx context.Context, config *pgx.ConnConfig) (*pgx.Conn, error) {
+	config = config.Copy()
+	if err := Configure(ctx, config); err != nil {
+		return nil, errs.Connect(err)
+	}
+	conn, err := pgx.ConnectConfig(ctx, config)
+	if err != nil {
+		return nil, errs.Connect(err)
+	}
+	return conn, nil
+}
@@ -0,0 +1,62 @@
+package dbconn
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/jackc/pgx/v5"
+)
+
+var (
+	routesMu sync.RWMutex
+	// routes map host:port of the database to the address actually dialed
+	routes = map[string]string{}
+)
+
+// Route makes connections to the database at host:port dial addr instead, e.g. a local
+// proxy. The host stays in the config, so TLS verification and SNI use the original name.
+func Route(host string, port uint16, addr string) {
+	routesMu.Lock()
+	defer routesMu.Unlock()
+	routes[net.JoinHostPort(host, strconv.Itoa(int(port)))] = addr
+}
+
+// route returns the address dialed instead of host:port, empty if it's not routed.
+func route(hostPort string) string {
+	routesMu.RLock()
+	defer routesMu.RUnlock()
+	return routes[hostPort]
+}
+
+// applyRoutes redirects dials of routed addresses. Routed hosts are not resolved, so that
+// the dialer sees the original host:port.
+func applyRoutes(config *pgx.ConnConfig) {
+	routesMu.RLock()
+	empty := len(routes) == 0
+	routesMu.RUnlock()
+	if empty {
+		return
+	}
+
+	lookup := config.LookupFunc
+	config.LookupFunc = func(ctx context.Context, host string) ([]string, error) {
+		routesMu.RLock()
+		defer routesMu.RUnlock()
+		for hostPort := range routes {
+			if h, _, _ := net.SplitHostPort(hostPort); h == host {
+				return []string{host}, nil
+			}
+		}
+		return lookup(ctx, host)
+	}
+
+	dial := config.DialFunc
+	config.DialFunc = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if routed := route(addr); routed != "" {
+			addr = routed
+		}
+		return dial(ctx, network, addr)
+	}
+}
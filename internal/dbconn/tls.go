@@ -0,0 +1,65 @@
+package dbconn
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/petuhovskiy/overload/internal/metrics"
+)
+
+// TLSHandshake is the duration of the TLS handshake of a connection, see WithTLSHandshake.
+type TLSHandshake struct {
+	Duration time.Duration
+}
+
+type tlsHandshakeKey struct{}
+
+// WithTLSHandshake returns the context recording the TLS handshake of the connection
+// established with it. Duration stays zero for connections without TLS.
+func WithTLSHandshake(ctx context.Context) (context.Context, *TLSHandshake) {
+	h := &TLSHandshake{}
+	return context.WithValue(ctx, tlsHandshakeKey{}, h), h
+}
+
+// timeTLS measures the TLS handshake of the connection established with the config, from
+// the TCP connection to the verified server certificate, including the SSLRequest round trip.
+// The config must be used for a single connection.
+func timeTLS(ctx context.Context, config *pgx.ConnConfig) {
+	handshake, _ := ctx.Value(tlsHandshakeKey{}).(*TLSHandshake)
+	histogram := metrics.Default.Histogram("tls_handshake_seconds")
+
+	var dialed time.Time
+	dial := config.DialFunc
+	config.DialFunc = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		dialed = time.Now()
+		return conn, err
+	}
+
+	wrap := func(tlsConfig *tls.Config) *tls.Config {
+		if tlsConfig == nil {
+			return nil
+		}
+		tlsConfig = tlsConfig.Clone()
+		verify := tlsConfig.VerifyConnection
+		tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			elapsed := time.Since(dialed)
+			histogram.Observe(elapsed.Seconds())
+			if handshake != nil {
+				handshake.Duration = elapsed
+			}
+			if verify != nil {
+				return verify(state)
+			}
+			return nil
+		}
+		return tlsConfig
+	}
+	config.TLSConfig = wrap(config.TLSConfig)
+	for _, fallback := range config.Fallbacks {
+		fallback.TLSConfig = wrap(fallback.TLSConfig)
+	}
+}
@@ -0,0 +1,236 @@
+// Package faultproxy implements a TCP proxy injecting latency and faults between
+// the workload and the database.
+package faultproxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/petuhovskiy/overload/internal/log"
+	"github.com/petuhovskiy/overload/internal/metrics"
+	"go.uber.org/zap"
+)
+
+// Faults describes the degradation applied to all proxied connections.
+// Zero value proxies traffic as is.
+type Faults struct {
+	// Latency is added to every chunk of data in both directions.
+	Latency time.Duration `json:"latency"`
+	// Jitter is the max random delay added on top of Latency.
+	Jitter time.Duration `json:"jitter"`
+	// Bandwidth caps throughput of every connection in each direction, in bytes per second.
+	Bandwidth int64 `json:"bandwidth"`
+	// ResetRate is the probability of every connection being reset within a second.
+	ResetRate float64 `json:"reset_rate"`
+}
+
+// chunk is a piece of data read from one side, delivered to the other side not before deliverAt.
+type chunk struct {
+	data      []byte
+	deliverAt time.Time
+}
+
+// Proxy forwards TCP connections to the upstream address. Faults can be changed
+// at any time and apply to existing connections too.
+type Proxy struct {
+	upstream string
+	listener net.Listener
+	faults   atomic.Pointer[Faults]
+
+	mu    sync.Mutex
+	conns map[net.Conn]net.Conn
+
+	resets *metrics.Counter
+}
+
+// New starts listening on the listen address, e.g. "127.0.0.1:0".
+func New(listen, upstream string) (*Proxy, error) {
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Proxy{
+		upstream: upstream,
+		listener: listener,
+		conns:    map[net.Conn]net.Conn{},
+		resets:   metrics.Default.Counter("proxy_resets_total"),
+	}
+	p.faults.Store(&Faults{})
+	return p, nil
+}
+
+// Addr returns the address the proxy is listening on.
+func (p *Proxy) Addr() string {
+	return p.listener.Addr().String()
+}
+
+func (p *Proxy) SetFaults(f Faults) {
+	p.faults.Store(&f)
+	log.Info(context.Background(), "proxy faults changed", zap.Any("faults", f))
+}
+
+func (p *Proxy) Faults() Faults {
+	return *p.faults.Load()
+}
+
+// ResetConnections abruptly closes all proxied connections and returns their number.
+func (p *Proxy) ResetConnections() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for client, server := range p.conns {
+		reset(client)
+		server.Close()
+	}
+	p.resets.Add(int64(len(p.conns)))
+	return len(p.conns)
+}
+
+// Serve accepts connections until the context is done.
+func (p *Proxy) Serve(ctx context.Context) {
+	ctx = log.With(ctx, zap.String("job", "proxy"))
+	log.Info(ctx, "proxy started", zap.String("addr", p.Addr()), zap.String("upstream", p.upstream))
+
+	go func() {
+		<-ctx.Done()
+		p.listener.Close()
+		p.ResetConnections()
+	}()
+
+	for {
+		client, err := p.listener.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Error(ctx, "failed to accept connection", zap.Error(err))
+			}
+			return
+		}
+		go p.handle(ctx, client)
+	}
+}
+
+func (p *Proxy) handle(ctx context.Context, client net.Conn) {
+	defer client.Close()
+
+	var dialer net.Dialer
+	server, err := dialer.DialContext(ctx, "tcp", p.upstream)
+	if err != nil {
+		log.Warn(ctx, "failed to connect to upstream", zap.Error(err))
+		return
+	}
+	defer server.Close()
+
+	p.mu.Lock()
+	p.conns[client] = server
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		delete(p.conns, client)
+		p.mu.Unlock()
+	}()
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		p.pipe(server, client)
+		server.Close()
+	}()
+	go func() {
+		defer wg.Done()
+		p.pipe(client, server)
+		client.Close()
+	}()
+	go p.randomResets(client, server, done)
+
+	wg.Wait()
+	close(done)
+}
+
+// randomResets resets the connection with the configured probability every second.
+func (p *Proxy) randomResets(client, server net.Conn, done chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		if rate := p.faults.Load().ResetRate; rate > 0 && rand.Float64() < rate {
+			p.resets.Inc()
+			reset(client)
+			server.Close()
+			return
+		}
+	}
+}
+
+// pipe copies data from src to dst, delaying and throttling it according to the faults.
+// Chunks are delayed independently, so that latency doesn't limit throughput.
+func (p *Proxy) pipe(dst, src net.Conn) {
+	chunks := make(chan chunk, 64)
+
+	go func() {
+		defer close(chunks)
+		for {
+			buf := make([]byte, 32*1024)
+			n, err := src.Read(buf)
+			if n > 0 {
+				f := p.faults.Load()
+				delay := f.Latency
+				if f.Jitter > 0 {
+					delay += rand.N(f.Jitter)
+				}
+				chunks <- chunk{data: buf[:n], deliverAt: time.Now().Add(delay)}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	var lastDelivery time.Time
+	for c := range chunks {
+		// jitter must not reorder the stream
+		deliverAt := c.deliverAt
+		if deliverAt.Before(lastDelivery) {
+			deliverAt = lastDelivery
+		}
+		time.Sleep(time.Until(deliverAt))
+		lastDelivery = deliverAt
+
+		if _, err := dst.Write(c.data); err != nil {
+			if !errors.Is(err, net.ErrClosed) && !errors.Is(err, io.EOF) {
+				log.Debug(context.Background(), "proxy write failed", zap.Error(err))
+			}
+			// unblock the reader
+			src.Close()
+			for range chunks {
+			}
+			return
+		}
+
+		if bw := p.faults.Load().Bandwidth; bw > 0 {
+			time.Sleep(time.Duration(float64(len(c.data)) / float64(bw) * float64(time.Second)))
+		}
+	}
+}
+
+// reset closes the connection with RST instead of FIN.
+func reset(conn net.Conn) {
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		_ = tcp.SetLinger(0)
+	}
+	conn.Close()
+}
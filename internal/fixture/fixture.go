@@ -0,0 +1,162 @@
+// Package fixture records chat completions of the model to files and replays them, so that
+// the generation pipeline runs without network access or API spend, e.g. in integration
+// tests and demos.
+//
+// A fixture directory holds one file per response, replayed in the order of file names:
+//
+//   - NNNNNN.json is a recorded request with its response, written by Recorder
+//   - any other file (e.g. 01-oltp.md) is a canned response, its content is the message
+//     returned by the model, like markdown with sql code blocks
+package fixture
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// Exchange is a recorded request with its response.
+type Exchange struct {
+	Request  openai.ChatCompletionRequest
+	Response openai.ChatCompletionResponse
+}
+
+// Client is the subset of the OpenAI client used by the generator.
+type Client interface {
+	CreateChatCompletion(ctx context.Context, req openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error)
+}
+
+// Recorder passes requests to the client and records every exchange to the directory.
+type Recorder struct {
+	client Client
+	dir    string
+
+	mu   sync.Mutex
+	next int
+}
+
+// NewRecorder creates the directory, recordings are appended after the existing files.
+func NewRecorder(client Client, dir string) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	files, err := responseFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &Recorder{client: client, dir: dir, next: len(files) + 1}, nil
+}
+
+func (r *Recorder) CreateChatCompletion(ctx context.Context, req openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	resp, err := r.client.CreateChatCompletion(ctx, req)
+	if err != nil {
+		return resp, err
+	}
+
+	data, err := json.MarshalIndent(Exchange{Request: req, Response: resp}, "", "  ")
+	if err != nil {
+		return resp, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	path := filepath.Join(r.dir, fmt.Sprintf("%06d.json", r.next))
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return resp, fmt.Errorf("failed to record response: %w", err)
+	}
+	r.next++
+	return resp, nil
+}
+
+// Replayer returns responses from the directory in order, starting over after the last one.
+// Requests are not compared with the recorded ones, since prompts include measurements
+// which differ between runs.
+type Replayer struct {
+	responses []openai.ChatCompletionResponse
+
+	mu   sync.Mutex
+	next int
+}
+
+// NewReplayer reads all responses from the directory.
+func NewReplayer(dir string) (*Replayer, error) {
+	files, err := responseFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no responses in %s", dir)
+	}
+
+	r := &Replayer{}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasSuffix(file, ".json") {
+			r.responses = append(r.responses, cannedResponse(string(data)))
+			continue
+		}
+		var exchange Exchange
+		if err := json.Unmarshal(data, &exchange); err != nil {
+			return nil, fmt.Errorf("invalid recording %s: %w", file, err)
+		}
+		if len(exchange.Response.Choices) == 0 {
+			return nil, fmt.Errorf("recording %s has no choices", file)
+		}
+		r.responses = append(r.responses, exchange.Response)
+	}
+	return r, nil
+}
+
+func (r *Replayer) CreateChatCompletion(ctx context.Context, _ openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return openai.ChatCompletionResponse{}, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	resp := r.responses[r.next%len(r.responses)]
+	r.next++
+	return resp, nil
+}
+
+// cannedResponse wraps the message into a response of the model.
+func cannedResponse(content string) openai.ChatCompletionResponse {
+	return openai.ChatCompletionResponse{
+		Model: "fixture",
+		Choices: []openai.ChatCompletionChoice{{
+			Message: openai.ChatCompletionMessage{
+				Role:    openai.ChatMessageRoleAssistant,
+				Content: content,
+			},
+			FinishReason: openai.FinishReasonStop,
+		}},
+	}
+}
+
+// responseFiles returns regular non-hidden files of the directory sorted by name.
+func responseFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, e := range entries {
+		if e.Type().IsRegular() && !strings.HasPrefix(e.Name(), ".") {
+			files = append(files, filepath.Join(dir, e.Name()))
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
@@ -0,0 +1,150 @@
+// Package health serves liveness and readiness endpoints for container orchestrators.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/petuhovskiy/overload/internal/log"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultCheckInterval = 10 * time.Second
+	checkTimeout         = 5 * time.Second
+)
+
+// Check verifies that a single dependency is reachable.
+type Check func(ctx context.Context) error
+
+// Checker periodically runs checks of the targets and tracks active runs. Results are cached,
+// so that frequent probes don't open connections to the targets.
+type Checker struct {
+	interval time.Duration
+	runs     atomic.Int64
+
+	mu      sync.Mutex
+	checks  map[string]Check
+	results map[string]error
+	checked bool
+}
+
+// Default is the checker used by the whole process.
+var Default = New(defaultCheckInterval)
+
+func New(interval time.Duration) *Checker {
+	return &Checker{
+		interval: interval,
+		checks:   map[string]Check{},
+		results:  map[string]error{},
+	}
+}
+
+// AddCheck registers a target check, the tool is ready only when all checks pass.
+func (c *Checker) AddCheck(name string, check Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checks[name] = check
+}
+
+// RunStarted marks a run as active, RunFinished must be called when it's finished.
+func (c *Checker) RunStarted() {
+	c.runs.Add(1)
+}
+
+// RunFinished marks a run as finished.
+func (c *Checker) RunFinished() {
+	c.runs.Add(-1)
+}
+
+// Run runs all checks every interval, until the context is done.
+func (c *Checker) Run(ctx context.Context) {
+	for {
+		c.runChecks(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(c.interval):
+		}
+	}
+}
+
+func (c *Checker) runChecks(ctx context.Context) {
+	c.mu.Lock()
+	checks := make(map[string]Check, len(c.checks))
+	for name, check := range c.checks {
+		checks[name] = check
+	}
+	c.mu.Unlock()
+
+	results := make(map[string]error, len(checks))
+	for name, check := range checks {
+		checkCtx, cancel := context.WithTimeout(ctx, checkTimeout)
+		err := check(checkCtx)
+		cancel()
+		if err != nil && ctx.Err() == nil {
+			log.Warn(ctx, "health check failed", zap.String("check", name), zap.Error(err))
+		}
+		results[name] = err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.results = results
+	c.checked = true
+}
+
+// Status is the body of health responses.
+type Status struct {
+	Ready      bool              `json:"ready"`
+	ActiveRuns int64             `json:"active_runs"`
+	Targets    map[string]string `json:"targets"`
+}
+
+// Status returns the results of the last checks.
+func (c *Checker) Status() Status {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s := Status{
+		Ready:      c.checked,
+		ActiveRuns: c.runs.Load(),
+		Targets:    map[string]string{},
+	}
+	for name, err := range c.results {
+		if err != nil {
+			s.Ready = false
+			s.Targets[name] = err.Error()
+		} else {
+			s.Targets[name] = "ok"
+		}
+	}
+	return s
+}
+
+// Handler serves /healthz, which succeeds while the process is alive, and /readyz, which
+// succeeds only when all targets are reachable. Both report active runs and target status.
+func (c *Checker) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		writeStatus(w, c.Status(), true)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, _ *http.Request) {
+		status := c.Status()
+		writeStatus(w, status, status.Ready)
+	})
+	return mux
+}
+
+func writeStatus(w http.ResponseWriter, status Status, ok bool) {
+	w.Header().Set("Content-Type", "application/json")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(status)
+}
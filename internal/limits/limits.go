@@ -0,0 +1,329 @@
+// Package limits enforces hard safety caps on the load the tool puts on a database server,
+// regardless of the workload configuration, so that a misconfigured run can't take down
+// a shared environment.
+//
+// Limits are registered per target (host:port) and applied to connection configs of all
+// modules: connections are capped at the dial, queries are throttled by a pgx tracer and
+// writes are throttled on the network connection.
+package limits
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/multitracer"
+	"github.com/petuhovskiy/overload/internal/metrics"
+)
+
+const defaultPort = 5432
+
+// Config describes hard caps for a single target, zero values mean unlimited.
+type Config struct {
+	// MaxConns is the max number of connections open at the same time.
+	MaxConns int
+	// MaxQPS is the max number of queries per second, batches count every queued query.
+	MaxQPS float64
+	// MaxWriteMBps is the max number of megabytes per second sent to the server.
+	MaxWriteMBps float64
+}
+
+// IsZero returns true if no limit is set.
+func (c Config) IsZero() bool {
+	return c == Config{}
+}
+
+// Limiter enforces limits of a single target, it is shared by all connections to the target.
+type Limiter struct {
+	conf  Config
+	conns chan struct{}
+	qps   *bucket
+	write *bucket
+
+	openConns  *metrics.Gauge
+	connWaits  *metrics.Counter
+	queryWaits *metrics.Counter
+	writeWaits *metrics.Counter
+	openMu     sync.Mutex
+	open       int
+}
+
+func newLimiter(target string, conf Config) *Limiter {
+	l := &Limiter{
+		conf:       conf,
+		qps:        newBucket(conf.MaxQPS),
+		write:      newBucket(conf.MaxWriteMBps * 1024 * 1024),
+		openConns:  metrics.Default.Gauge("safety_open_conns", "target", target),
+		connWaits:  metrics.Default.Counter("safety_limit_waits_total", "target", target, "limit", "conns"),
+		queryWaits: metrics.Default.Counter("safety_limit_waits_total", "target", target, "limit", "qps"),
+		writeWaits: metrics.Default.Counter("safety_limit_waits_total", "target", target, "limit", "write"),
+	}
+	if conf.MaxConns > 0 {
+		l.conns = make(chan struct{}, conf.MaxConns)
+	}
+	return l
+}
+
+// Config returns the limits enforced by the limiter.
+func (l *Limiter) Config() Config {
+	return l.conf
+}
+
+// acquireConn waits for a free connection slot.
+func (l *Limiter) acquireConn(ctx context.Context) error {
+	if l.conns != nil {
+		select {
+		case l.conns <- struct{}{}:
+		default:
+			l.connWaits.Inc()
+			select {
+			case l.conns <- struct{}{}:
+			case <-ctx.Done():
+				return fmt.Errorf("waiting for safety connection limit: %w", ctx.Err())
+			}
+		}
+	}
+	l.addOpen(1)
+	return nil
+}
+
+func (l *Limiter) releaseConn() {
+	l.addOpen(-1)
+	if l.conns != nil {
+		<-l.conns
+	}
+}
+
+func (l *Limiter) addOpen(delta int) {
+	l.openMu.Lock()
+	defer l.openMu.Unlock()
+	l.open += delta
+	l.openConns.Set(float64(l.open))
+}
+
+// waitQueries waits until n queries can be sent.
+func (l *Limiter) waitQueries(ctx context.Context, n int) {
+	if l.qps.wait(ctx, float64(n)) {
+		l.queryWaits.Inc()
+	}
+}
+
+// waitWrite waits until n bytes can be sent.
+func (l *Limiter) waitWrite(n int) {
+	if l.write.wait(context.Background(), float64(n)) {
+		l.writeWaits.Inc()
+	}
+}
+
+var (
+	mu       sync.Mutex
+	limiters = map[string]*Limiter{}
+)
+
+// Register sets limits for the target of the connection string, replacing the previous ones.
+// Connections already configured by Apply keep the previous limits.
+func Register(connstr string, conf Config) error {
+	config, err := pgx.ParseConfig(connstr)
+	if err != nil {
+		return err
+	}
+	RegisterTarget(Target(config), conf)
+	return nil
+}
+
+// RegisterTarget sets limits for the target in host:port format.
+func RegisterTarget(target string, conf Config) {
+	mu.Lock()
+	defer mu.Unlock()
+	if conf.IsZero() {
+		delete(limiters, target)
+		return
+	}
+	limiters[target] = newLimiter(target, conf)
+}
+
+// For returns the limiter of the target, or nil if the target is not limited.
+func For(target string) *Limiter {
+	mu.Lock()
+	defer mu.Unlock()
+	return limiters[target]
+}
+
+// Target returns host:port of the server the config connects to.
+func Target(config *pgx.ConnConfig) string {
+	return net.JoinHostPort(config.Host, strconv.Itoa(int(config.Port)))
+}
+
+// NormalizeTarget adds the default port to the target without one.
+func NormalizeTarget(target string) string {
+	if _, _, err := net.SplitHostPort(target); err == nil {
+		return target
+	}
+	return net.JoinHostPort(target, strconv.Itoa(defaultPort))
+}
+
+// Apply enforces limits of the target on all connections created with the config.
+// It's a no-op for targets without limits.
+func Apply(config *pgx.ConnConfig) {
+	l := For(Target(config))
+	if l == nil {
+		return
+	}
+
+	dial := config.DialFunc
+	config.DialFunc = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if err := l.acquireConn(ctx); err != nil {
+			return nil, err
+		}
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			l.releaseConn()
+			return nil, err
+		}
+		return &limitedConn{Conn: conn, limiter: l}, nil
+	}
+	if l.conf.MaxQPS > 0 {
+		// queries are throttled before other tracers see them, so waits aren't counted as latency
+		if config.Tracer != nil {
+			config.Tracer = multitracer.New(&tracer{limiter: l}, config.Tracer)
+		} else {
+			config.Tracer = &tracer{limiter: l}
+		}
+	}
+}
+
+// ParseTargets parses per-target limits separated by semicolons, every entry is a target
+// followed by limits, e.g. "db1:5432 conns=100 qps=2000 write_mbps=50; db2 conns=10".
+func ParseTargets(def string) (map[string]Config, error) {
+	res := map[string]Config{}
+	for _, entry := range strings.Split(def, ";") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) == 1 {
+			return nil, fmt.Errorf("no limits for target %q", fields[0])
+		}
+
+		var conf Config
+		for _, field := range fields[1:] {
+			key, value, ok := strings.Cut(field, "=")
+			if !ok {
+				return nil, fmt.Errorf("invalid limit %q, expected key=value", field)
+			}
+			var err error
+			switch key {
+			case "conns":
+				conf.MaxConns, err = strconv.Atoi(value)
+			case "qps":
+				conf.MaxQPS, err = strconv.ParseFloat(value, 64)
+			case "write_mbps":
+				conf.MaxWriteMBps, err = strconv.ParseFloat(value, 64)
+			default:
+				return nil, fmt.Errorf("unknown limit %q", key)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid limit %q: %w", field, err)
+			}
+		}
+		res[NormalizeTarget(fields[0])] = conf
+	}
+	return res, nil
+}
+
+// limitedConn releases the connection slot on close and throttles writes.
+type limitedConn struct {
+	net.Conn
+	limiter *Limiter
+	once    sync.Once
+}
+
+func (c *limitedConn) Write(b []byte) (int, error) {
+	c.limiter.waitWrite(len(b))
+	return c.Conn.Write(b)
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.limiter.releaseConn)
+	return err
+}
+
+// tracer throttles queries before they are sent.
+type tracer struct {
+	limiter *Limiter
+}
+
+func (t *tracer) TraceQueryStart(ctx context.Context, _ *pgx.Conn, _ pgx.TraceQueryStartData) context.Context {
+	t.limiter.waitQueries(ctx, 1)
+	return ctx
+}
+
+func (t *tracer) TraceQueryEnd(context.Context, *pgx.Conn, pgx.TraceQueryEndData) {}
+
+func (t *tracer) TraceBatchStart(ctx context.Context, _ *pgx.Conn, data pgx.TraceBatchStartData) context.Context {
+	t.limiter.waitQueries(ctx, data.Batch.Len())
+	return ctx
+}
+
+func (t *tracer) TraceBatchQuery(context.Context, *pgx.Conn, pgx.TraceBatchQueryData) {}
+
+func (t *tracer) TraceBatchEnd(context.Context, *pgx.Conn, pgx.TraceBatchEndData) {}
+
+func (t *tracer) TraceCopyFromStart(ctx context.Context, _ *pgx.Conn, _ pgx.TraceCopyFromStartData) context.Context {
+	t.limiter.waitQueries(ctx, 1)
+	return ctx
+}
+
+func (t *tracer) TraceCopyFromEnd(context.Context, *pgx.Conn, pgx.TraceCopyFromEndData) {}
+
+// bucket is a token bucket refilled at the given rate, with a burst of one second.
+// Requests larger than the available tokens go into debt, delaying subsequent ones.
+type bucket struct {
+	rate float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// newBucket returns nil for zero rate, nil bucket never waits.
+func newBucket(rate float64) *bucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &bucket{
+		rate:   rate,
+		tokens: rate,
+		last:   time.Now(),
+	}
+}
+
+// wait takes n tokens, waiting until the debt is repaid. Returns true if it had to wait.
+func (b *bucket) wait(ctx context.Context, n float64) bool {
+	if b == nil {
+		return false
+	}
+
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens = min(b.rate, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= n
+	delay := time.Duration(-b.tokens / b.rate * float64(time.Second))
+	b.mu.Unlock()
+
+	if delay <= 0 {
+		return false
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(delay):
+	}
+	return true
+}
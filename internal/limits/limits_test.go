@@ -0,0 +1,72 @@
+package limits
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTargets(t *testing.T) {
+	res, err := ParseTargets("db1:5432 conns=100 qps=2000 write_mbps=50; db2 conns=10;")
+	require.NoError(t, err)
+	require.Equal(t, map[string]Config{
+		"db1:5432": {MaxConns: 100, MaxQPS: 2000, MaxWriteMBps: 50},
+		"db2:5432": {MaxConns: 10},
+	}, res)
+
+	res, err = ParseTargets("")
+	require.NoError(t, err)
+	require.Empty(t, res)
+}
+
+func TestParseTargetsErrors(t *testing.T) {
+	tests := []struct {
+		def string
+		err string
+	}{
+		{"db1", `no limits for target "db1"`},
+		{"db1 conns", `invalid limit "conns", expected key=value`},
+		{"db1 rps=10", `unknown limit "rps"`},
+		{"db1 conns=many", `invalid limit "conns=many"`},
+		{"db1 qps=1; db2 write_mbps=x", `invalid limit "write_mbps=x"`},
+	}
+	for _, tt := range tests {
+		_, err := ParseTargets(tt.def)
+		require.ErrorContains(t, err, tt.err, tt.def)
+	}
+}
+
+type queryTracer struct {
+	started int
+}
+
+func (t *queryTracer) TraceQueryStart(ctx context.Context, _ *pgx.Conn, _ pgx.TraceQueryStartData) context.Context {
+	t.started++
+	return ctx
+}
+
+func (t *queryTracer) TraceQueryEnd(context.Context, *pgx.Conn, pgx.TraceQueryEndData) {}
+
+func TestApplyKeepsTracer(t *testing.T) {
+	RegisterTarget("limited:5432", Config{MaxQPS: 1000})
+	defer RegisterTarget("limited:5432", Config{})
+
+	existing := &queryTracer{}
+	config := &pgx.ConnConfig{}
+	config.Host, config.Port, config.Tracer = "limited", 5432, existing
+	config.DialFunc = (&net.Dialer{}).DialContext
+	Apply(config)
+
+	require.NotSame(t, existing, config.Tracer)
+	config.Tracer.TraceQueryStart(context.Background(), nil, pgx.TraceQueryStartData{})
+	require.Equal(t, 1, existing.started)
+
+	config = &pgx.ConnConfig{}
+	config.Host, config.Port = "limited", 5432
+	config.DialFunc = (&net.Dialer{}).DialContext
+	Apply(config)
+	require.IsType(t, &tracer{}, config.Tracer)
+}
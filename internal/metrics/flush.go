@@ -0,0 +1,66 @@
+package metrics
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/petuhovskiy/overload/internal/log"
+	"go.uber.org/zap"
+)
+
+// RunFlush logs all metrics every interval until the context is done. Counters are
+// reported together with their rate per second since the previous flush, histograms
+// are reported as count, p50 and p99.
+func (r *Registry) RunFlush(ctx context.Context, interval time.Duration) {
+	ctx = log.With(ctx, zap.String("job", "metrics"))
+
+	prev := r.Snapshot()
+	prevTime := time.Now()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+
+		snapshot := r.Snapshot()
+		now := time.Now()
+		elapsed := now.Sub(prevTime).Seconds()
+
+		var fields []zap.Field
+		for _, key := range sortedKeys(snapshot.Counters) {
+			value := snapshot.Counters[key]
+			rate := float64(value-prev.Counters[key]) / elapsed
+			fields = append(fields, zap.Dict(key, zap.Int64("total", value), zap.Float64("rate", rate)))
+		}
+		for _, key := range sortedKeys(snapshot.Gauges) {
+			fields = append(fields, zap.Float64(key, snapshot.Gauges[key]))
+		}
+		for _, key := range sortedKeys(snapshot.Histograms) {
+			h := snapshot.Histograms[key]
+			fields = append(fields, zap.Dict(key,
+				zap.Int64("count", h.Count),
+				zap.Float64("p50", h.Quantile(0.5)),
+				zap.Float64("p99", h.Quantile(0.99)),
+			))
+		}
+
+		if len(fields) > 0 {
+			log.Info(ctx, "metrics", fields...)
+		}
+
+		prev = snapshot
+		prevTime = now
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,279 @@
+package metrics
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Default is the registry shared by all workloads.
+var Default = NewRegistry()
+
+// Counter is a monotonically increasing value.
+type Counter struct {
+	value atomic.Int64
+}
+
+func (c *Counter) Add(delta int64) {
+	c.value.Add(delta)
+}
+
+func (c *Counter) Inc() {
+	c.value.Add(1)
+}
+
+func (c *Counter) Value() int64 {
+	return c.value.Load()
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	bits atomic.Uint64
+}
+
+func (g *Gauge) Set(value float64) {
+	g.bits.Store(math.Float64bits(value))
+}
+
+func (g *Gauge) Value() float64 {
+	return math.Float64frombits(g.bits.Load())
+}
+
+// HistogramBuckets are upper bounds of histogram buckets in seconds,
+// growing exponentially from 100us to ~100s.
+var HistogramBuckets = func() []float64 {
+	var buckets []float64
+	for b := 0.0001; b <= 100; b *= 2 {
+		buckets = append(buckets, b)
+	}
+	return buckets
+}()
+
+// Histogram counts observations in HistogramBuckets.
+type Histogram struct {
+	counts  []atomic.Int64
+	count   atomic.Int64
+	sumBits atomic.Uint64
+}
+
+func newHistogram() *Histogram {
+	return &Histogram{
+		counts: make([]atomic.Int64, len(HistogramBuckets)+1),
+	}
+}
+
+// Observe adds a single value, usually a latency in seconds.
+func (h *Histogram) Observe(value float64) {
+	idx := sort.SearchFloat64s(HistogramBuckets, value)
+	h.counts[idx].Add(1)
+	h.count.Add(1)
+	for {
+		old := h.sumBits.Load()
+		sum := math.Float64frombits(old) + value
+		if h.sumBits.CompareAndSwap(old, math.Float64bits(sum)) {
+			return
+		}
+	}
+}
+
+// HistogramSnapshot is a point-in-time copy of a histogram.
+type HistogramSnapshot struct {
+	// Counts are non-cumulative counts per bucket, the last one is for values above all buckets.
+	Counts []int64
+	Count  int64
+	Sum    float64
+}
+
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	s := HistogramSnapshot{
+		Counts: make([]int64, len(h.counts)),
+		Count:  h.count.Load(),
+		Sum:    math.Float64frombits(h.sumBits.Load()),
+	}
+	for i := range h.counts {
+		s.Counts[i] = h.counts[i].Load()
+	}
+	return s
+}
+
+// Quantile estimates the quantile as the upper bound of the bucket containing it.
+func (s HistogramSnapshot) Quantile(q float64) float64 {
+	if s.Count == 0 {
+		return 0
+	}
+	rank := int64(q * float64(s.Count))
+	var seen int64
+	for i, c := range s.Counts {
+		seen += c
+		if seen > rank && i < len(HistogramBuckets) {
+			return HistogramBuckets[i]
+		}
+	}
+	return math.Inf(1)
+}
+
+// Sub returns observations made after the prev snapshot of the same histogram.
+func (s HistogramSnapshot) Sub(prev HistogramSnapshot) HistogramSnapshot {
+	res := HistogramSnapshot{
+		Counts: make([]int64, len(s.Counts)),
+		Count:  s.Count - prev.Count,
+		Sum:    s.Sum - prev.Sum,
+	}
+	for i := range s.Counts {
+		res.Counts[i] = s.Counts[i]
+		if i < len(prev.Counts) {
+			res.Counts[i] -= prev.Counts[i]
+		}
+	}
+	return res
+}
+
+// Registry holds all metrics, identified by name and labels.
+type Registry struct {
+	mu         sync.Mutex
+	counters   map[string]*Counter
+	gauges     map[string]*Gauge
+	histograms map[string]*Histogram
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		counters:   map[string]*Counter{},
+		gauges:     map[string]*Gauge{},
+		histograms: map[string]*Histogram{},
+	}
+}
+
+// Counter returns the counter with the given name and labels, creating it if needed.
+// Labels are passed as key-value pairs.
+func (r *Registry) Counter(name string, labels ...string) *Counter {
+	key := metricKey(name, labels)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c, ok := r.counters[key]
+	if !ok {
+		c = &Counter{}
+		r.counters[key] = c
+	}
+	return c
+}
+
+// Gauge returns the gauge with the given name and labels, creating it if needed.
+func (r *Registry) Gauge(name string, labels ...string) *Gauge {
+	key := metricKey(name, labels)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	g, ok := r.gauges[key]
+	if !ok {
+		g = &Gauge{}
+		r.gauges[key] = g
+	}
+	return g
+}
+
+// Histogram returns the histogram with the given name and labels, creating it if needed.
+func (r *Registry) Histogram(name string, labels ...string) *Histogram {
+	key := metricKey(name, labels)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	h, ok := r.histograms[key]
+	if !ok {
+		h = newHistogram()
+		r.histograms[key] = h
+	}
+	return h
+}
+
+// Snapshot is a point-in-time copy of all metrics, keyed by metric key.
+type Snapshot struct {
+	Counters   map[string]int64
+	Gauges     map[string]float64
+	Histograms map[string]HistogramSnapshot
+}
+
+func (r *Registry) Snapshot() Snapshot {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := Snapshot{
+		Counters:   make(map[string]int64, len(r.counters)),
+		Gauges:     make(map[string]float64, len(r.gauges)),
+		Histograms: make(map[string]HistogramSnapshot, len(r.histograms)),
+	}
+	for key, c := range r.counters {
+		s.Counters[key] = c.Value()
+	}
+	for key, g := range r.gauges {
+		s.Gauges[key] = g.Value()
+	}
+	for key, h := range r.histograms {
+		s.Histograms[key] = h.Snapshot()
+	}
+	return s
+}
+
+// metricKey formats metric name with labels in the Prometheus notation, e.g. name{k1="v1",k2="v2"}.
+func metricKey(name string, labels []string) string {
+	if len(labels) == 0 {
+		return name
+	}
+
+	var sb strings.Builder
+	sb.WriteString(name)
+	sb.WriteString("{")
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			sb.WriteString(",")
+		}
+		sb.WriteString(labels[i])
+		sb.WriteString(`="`)
+		sb.WriteString(strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[i+1]))
+		sb.WriteString(`"`)
+	}
+	sb.WriteString("}")
+	return sb.String()
+}
+
+// splitKey splits metric key into name and labels part without braces.
+func splitKey(key string) (string, string) {
+	idx := strings.IndexByte(key, '{')
+	if idx < 0 {
+		return key, ""
+	}
+	return key[:idx], key[idx+1 : len(key)-1]
+}
+
+// CounterSum returns the sum of all counters with the given name, regardless of labels.
+func (s Snapshot) CounterSum(name string) int64 {
+	var sum int64
+	for key, value := range s.Counters {
+		if n, _ := splitKey(key); n == name {
+			sum += value
+		}
+	}
+	return sum
+}
+
+// HistogramSum merges all histograms with the given name, regardless of labels.
+func (s Snapshot) HistogramSum(name string) HistogramSnapshot {
+	res := HistogramSnapshot{Counts: make([]int64, len(HistogramBuckets)+1)}
+	for key, h := range s.Histograms {
+		if n, _ := splitKey(key); n != name {
+			continue
+		}
+		for i, c := range h.Counts {
+			res.Counts[i] += c
+		}
+		res.Count += h.Count
+		res.Sum += h.Sum
+	}
+	return res
+}
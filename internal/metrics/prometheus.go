@@ -0,0 +1,96 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// WritePrometheus writes all metrics in the Prometheus text exposition format.
+func (r *Registry) WritePrometheus(w io.Writer) error {
+	snapshot := r.Snapshot()
+
+	written := map[string]bool{}
+	writeType := func(name, typ string) error {
+		if written[name] {
+			return nil
+		}
+		written[name] = true
+		_, err := fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+		return err
+	}
+
+	for _, key := range sortedKeys(snapshot.Counters) {
+		name, _ := splitKey(key)
+		if err := writeType(name, "counter"); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "%s %d\n", key, snapshot.Counters[key]); err != nil {
+			return err
+		}
+	}
+
+	for _, key := range sortedKeys(snapshot.Gauges) {
+		name, _ := splitKey(key)
+		if err := writeType(name, "gauge"); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "%s %s\n", key, formatFloat(snapshot.Gauges[key])); err != nil {
+			return err
+		}
+	}
+
+	for _, key := range sortedKeys(snapshot.Histograms) {
+		name, labels := splitKey(key)
+		if err := writeType(name, "histogram"); err != nil {
+			return err
+		}
+		if labels != "" {
+			labels += ","
+		}
+
+		h := snapshot.Histograms[key]
+		var cumulative int64
+		for i, c := range h.Counts {
+			cumulative += c
+			le := math.Inf(1)
+			if i < len(HistogramBuckets) {
+				le = HistogramBuckets[i]
+			}
+			_, err := fmt.Fprintf(w, "%s_bucket{%sle=\"%s\"} %d\n", name, labels, formatFloat(le), cumulative)
+			if err != nil {
+				return err
+			}
+		}
+
+		suffix := ""
+		if labels != "" {
+			suffix = "{" + labels[:len(labels)-1] + "}"
+		}
+		if _, err := fmt.Fprintf(w, "%s_sum%s %s\n%s_count%s %d\n", name, suffix, formatFloat(h.Sum), name, suffix, h.Count); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Handler returns HTTP handler serving metrics in the Prometheus format.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		_ = r.WritePrometheus(w)
+	})
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -2,6 +2,7 @@ package multi
 
 import (
 	"context"
+	"errors"
 	"sync"
 
 	"github.com/petuhovskiy/overload/internal/log"
@@ -9,6 +10,13 @@ import (
 )
 
 func RunMany(ctx context.Context, n int, f func(ctx context.Context) error) {
+	RunManyIndexed(ctx, n, func(ctx context.Context, _ int) error {
+		return f(ctx)
+	})
+}
+
+// RunManyIndexed runs f in n goroutines, passing the worker index to each of them.
+func RunManyIndexed(ctx context.Context, n int, f func(ctx context.Context, i int) error) {
 	wg := sync.WaitGroup{}
 	wg.Add(n)
 
@@ -18,7 +26,7 @@ func RunMany(ctx context.Context, n int, f func(ctx context.Context) error) {
 
 		go func() {
 			defer wg.Done()
-			err := f(ctx)
+			err := f(ctx, i)
 			if err != nil {
 				log.Error(ctx, "worker failed", zap.Error(err))
 			} else {
@@ -29,3 +37,24 @@ func RunMany(ctx context.Context, n int, f func(ctx context.Context) error) {
 
 	wg.Wait()
 }
+
+// RunWorkers runs f in n goroutines and waits for all of them. Workers run until ctx is done,
+// so errors returned after that are caused by the end of the run and ignored, the rest are joined.
+func RunWorkers(ctx context.Context, n int, f func(ctx context.Context, i int) error) error {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []error
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := f(ctx, i); err != nil && ctx.Err() == nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
@@ -0,0 +1,145 @@
+package multi
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/petuhovskiy/overload/internal/log"
+	"github.com/petuhovskiy/overload/internal/metrics"
+	"github.com/petuhovskiy/overload/internal/reconnect"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultMaxRestarts   = 10
+	defaultRestartWindow = 10 * time.Minute
+	// healthyRunDuration is how long the job should run to reset the backoff.
+	healthyRunDuration = time.Minute
+)
+
+type SupervisorConfig struct {
+	// MaxRestarts is the max number of restarts of a single job within RestartWindow,
+	// negative means unlimited.
+	MaxRestarts int
+	// RestartWindow is the sliding window the restarts are counted in, so that rare failures
+	// of a long run don't add up to the limit, default 10m.
+	RestartWindow time.Duration
+	// Backoff is the delay policy between restarts, its MaxAttempts is ignored in favor of MaxRestarts.
+	Backoff reconnect.Config
+}
+
+func (conf *SupervisorConfig) Normalize() {
+	if conf.MaxRestarts == 0 {
+		conf.MaxRestarts = defaultMaxRestarts
+	}
+
+	if conf.RestartWindow == 0 {
+		conf.RestartWindow = defaultRestartWindow
+	}
+	conf.Backoff.Normalize()
+}
+
+// Supervisor restarts failed jobs with backoff and counts restarts of every job.
+type Supervisor struct {
+	conf SupervisorConfig
+
+	mu       sync.Mutex
+	restarts map[string]int
+}
+
+func NewSupervisor(conf SupervisorConfig) *Supervisor {
+	conf.Normalize()
+	return &Supervisor{
+		conf:     conf,
+		restarts: map[string]int{},
+	}
+}
+
+// Run runs the job until it finishes without an error or the context is done.
+// Failed job is restarted after a backoff delay, until it exceeds max restarts within
+// the restart window, then the last error is returned.
+func (s *Supervisor) Run(ctx context.Context, name string, job func(ctx context.Context) error) error {
+	ctx = log.With(ctx, zap.String("job", name))
+	restarts := metrics.Default.Counter("job_restarts_total", "job", name)
+
+	attempt := 0
+	// failures are the times of recent failures, within the restart window
+	var failures []time.Time
+	for {
+		start := time.Now()
+		err := job(ctx)
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+
+		// the job was healthy for a while, so this is a new failure rather than a crash loop
+		if time.Since(start) > healthyRunDuration {
+			attempt = 0
+		}
+		attempt++
+
+		now := time.Now()
+		failures = append(failures, now)
+		for len(failures) > 0 && now.Sub(failures[0]) > s.conf.RestartWindow {
+			failures = failures[1:]
+		}
+		if s.conf.MaxRestarts >= 0 && len(failures) > s.conf.MaxRestarts {
+			log.Error(ctx, "job failed, restart limit exceeded",
+				zap.Int("restarts", len(failures)-1), zap.Duration("window", s.conf.RestartWindow), zap.Error(err))
+			return err
+		}
+
+		s.mu.Lock()
+		s.restarts[name]++
+		total := s.restarts[name]
+		s.mu.Unlock()
+
+		delay := s.conf.Backoff.Delay(attempt)
+		log.Warn(ctx, "job failed, restarting", zap.Int("restart", total), zap.Duration("delay", delay), zap.Error(err))
+		restarts.Inc()
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
+
+// RunMany runs n supervised workers, named by the name and the worker index.
+func (s *Supervisor) RunMany(ctx context.Context, n int, name string, job func(ctx context.Context) error) {
+	RunManyIndexed(ctx, n, func(ctx context.Context, i int) error {
+		return s.Run(ctx, fmt.Sprintf("%s-%d", name, i), job)
+	})
+}
+
+// Restarts returns the number of restarts of every job.
+func (s *Supervisor) Restarts() map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res := make(map[string]int, len(s.restarts))
+	for name, n := range s.restarts {
+		res[name] = n
+	}
+	return res
+}
+
+// LogSummary logs the number of restarts of every job that was restarted.
+func (s *Supervisor) LogSummary(ctx context.Context) {
+	restarts := s.Restarts()
+	names := make([]string, 0, len(restarts))
+	for name := range restarts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fields := make([]zap.Field, 0, len(names))
+	for _, name := range names {
+		fields = append(fields, zap.Int(name, restarts[name]))
+	}
+	log.Info(ctx, "supervisor summary", fields...)
+}
@@ -0,0 +1,169 @@
+// Package neon collects metrics specific to Neon computes: local file cache (LFC)
+// efficiency, working set size and the size of the branch.
+package neon
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/petuhovskiy/overload/internal/dbconn"
+	"github.com/petuhovskiy/overload/internal/log"
+	"github.com/petuhovskiy/overload/internal/metrics"
+	"go.uber.org/zap"
+)
+
+const pageSize = 8192
+
+// Stats is a snapshot of Neon compute metrics. Fields that the compute doesn't
+// expose (e.g. on older extension versions) are left zero.
+type Stats struct {
+	Time time.Time
+	// LFCHits and LFCMisses are cumulative local file cache counters.
+	LFCHits   int64
+	LFCMisses int64
+	// LFCUsedMB is the size of the local file cache currently in use.
+	LFCUsedMB int64
+	// WorkingSetBytes is the estimated number of distinct pages accessed since
+	// the compute start, as reported by neon.approximate_working_set_size.
+	WorkingSetBytes int64
+	// ClusterSizeBytes is the logical size of the branch.
+	ClusterSizeBytes int64
+}
+
+// Step is the Neon part of the step statistics.
+type Step struct {
+	// LFCHitRatio is the share of page reads served from the local file cache
+	// during the step, negative if there were no reads.
+	LFCHitRatio      float64
+	LFCHits          int64
+	LFCMisses        int64
+	WorkingSetBytes  int64
+	ClusterSizeBytes int64
+	// ClusterGrowthBytes is the branch size growth during the step.
+	ClusterGrowthBytes int64
+}
+
+// Delta returns statistics of the interval between two snapshots.
+func Delta(before, after Stats) Step {
+	hits := after.LFCHits - before.LFCHits
+	misses := after.LFCMisses - before.LFCMisses
+	ratio := -1.0
+	if hits+misses > 0 {
+		ratio = float64(hits) / float64(hits+misses)
+	}
+	return Step{
+		LFCHitRatio:        ratio,
+		LFCHits:            hits,
+		LFCMisses:          misses,
+		WorkingSetBytes:    after.WorkingSetBytes,
+		ClusterSizeBytes:   after.ClusterSizeBytes,
+		ClusterGrowthBytes: after.ClusterSizeBytes - before.ClusterSizeBytes,
+	}
+}
+
+// Detect reports whether the connection is to a Neon compute. Neon computes always
+// have the timeline id setting, vanilla Postgres doesn't know about it.
+func Detect(ctx context.Context, conn *pgx.Conn) (bool, error) {
+	var timeline *string
+	err := conn.QueryRow(ctx, `SELECT current_setting('neon.timeline_id', true)`).Scan(&timeline)
+	if err != nil {
+		return false, err
+	}
+	return timeline != nil && *timeline != "", nil
+}
+
+// Setup creates the neon extension which provides the LFC views. It's preinstalled
+// on Neon, but may be missing in the database used for the run.
+func Setup(ctx context.Context, conn *pgx.Conn) error {
+	_, err := conn.Exec(ctx, `CREATE EXTENSION IF NOT EXISTS neon`)
+	return err
+}
+
+// Collect takes a snapshot of Neon metrics. Every metric is queried separately, so a
+// missing view or function only leaves its fields zero.
+func Collect(ctx context.Context, conn *pgx.Conn) Stats {
+	s := Stats{Time: time.Now()}
+
+	err := conn.QueryRow(ctx, `
+		SELECT COALESCE(file_cache_hits, 0), COALESCE(file_cache_misses, 0), COALESCE(file_cache_used, 0)
+		FROM neon.neon_stat_file_cache`).Scan(&s.LFCHits, &s.LFCMisses, &s.LFCUsedMB)
+	if err != nil {
+		log.Debug(ctx, "failed to query file cache stats", zap.Error(err))
+	}
+
+	var pages *int64
+	err = conn.QueryRow(ctx, `SELECT neon.approximate_working_set_size(false)`).Scan(&pages)
+	if err != nil {
+		log.Debug(ctx, "failed to query working set size", zap.Error(err))
+	} else if pages != nil {
+		s.WorkingSetBytes = *pages * pageSize
+	}
+
+	err = conn.QueryRow(ctx, `SELECT pg_cluster_size()`).Scan(&s.ClusterSizeBytes)
+	if err != nil {
+		log.Debug(ctx, "failed to query cluster size", zap.Error(err))
+	}
+	return s
+}
+
+// Snapshot connects to the target and takes a snapshot of Neon metrics. It returns
+// nil if the target is not Neon or is unreachable.
+func Snapshot(ctx context.Context, connstr string) *Stats {
+	conn, err := dbconn.Connect(ctx, connstr)
+	if err != nil {
+		return nil
+	}
+	defer conn.Close(context.Background())
+
+	if ok, err := Detect(ctx, conn); err != nil || !ok {
+		return nil
+	}
+	s := Collect(ctx, conn)
+	return &s
+}
+
+// Run periodically collects Neon metrics and exports them as gauges, until the
+// context is done. It returns immediately if the target is not Neon.
+func Run(ctx context.Context, connstr string, interval time.Duration) {
+	ctx = log.With(ctx, zap.String("job", "neon"))
+
+	conn, err := dbconn.Connect(ctx, connstr)
+	if err != nil {
+		log.Warn(ctx, "failed to connect", zap.Error(err))
+		return
+	}
+	defer conn.Close(context.Background())
+
+	ok, err := Detect(ctx, conn)
+	if err != nil || !ok {
+		return
+	}
+	if err := Setup(ctx, conn); err != nil {
+		log.Warn(ctx, "failed to create neon extension, LFC stats are not available", zap.Error(err))
+	}
+	log.Info(ctx, "target is Neon, collecting compute metrics")
+
+	prev := Collect(ctx, conn)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+
+		cur := Collect(ctx, conn)
+		if ctx.Err() != nil {
+			return
+		}
+		step := Delta(prev, cur)
+		prev = cur
+
+		if step.LFCHitRatio >= 0 {
+			metrics.Default.Gauge("neon_lfc_hit_ratio").Set(step.LFCHitRatio)
+		}
+		metrics.Default.Gauge("neon_lfc_used_mb").Set(float64(cur.LFCUsedMB))
+		metrics.Default.Gauge("neon_working_set_bytes").Set(float64(cur.WorkingSetBytes))
+		metrics.Default.Gauge("neon_cluster_size_bytes").Set(float64(cur.ClusterSizeBytes))
+	}
+}
@@ -0,0 +1,203 @@
+// Package noise runs a throttled background workload of mixed reads and writes on its own
+// table, simulating other tenants and applications sharing the database with the experiment.
+// Its metrics are reported separately, under the noise_ prefix.
+package noise
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/petuhovskiy/overload/internal/dbconn"
+	"github.com/petuhovskiy/overload/internal/log"
+	"github.com/petuhovskiy/overload/internal/metrics"
+	"github.com/petuhovskiy/overload/internal/reconnect"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultTableName = "overload_noise"
+	defaultConns     = 2
+	defaultReadRatio = 0.8
+	defaultRows      = 100000
+	// rangeSize is the number of rows read by a range scan.
+	rangeSize = 100
+)
+
+type Config struct {
+	// QPS is the total rate of all noise connections, zero disables the noise.
+	QPS       float64
+	Conns     int
+	TableName string
+	// ReadRatio is the share of reads, the rest are updates and inserts.
+	ReadRatio float64
+	// Rows is the number of rows the table is seeded with.
+	Rows int
+}
+
+func (conf *Config) Normalize() {
+	if conf.Conns == 0 {
+		conf.Conns = defaultConns
+	}
+
+	if conf.TableName == "" {
+		conf.TableName = defaultTableName
+	}
+
+	if conf.ReadRatio == 0 {
+		conf.ReadRatio = defaultReadRatio
+	}
+
+	if conf.Rows == 0 {
+		conf.Rows = defaultRows
+	}
+}
+
+// operation is a kind of noise query.
+type operation struct {
+	name string
+	sql  string
+	args func(r *rand.Rand, rows int) []any
+}
+
+func operations(table string) (reads, writes []operation) {
+	table = pgx.Identifier{table}.Sanitize()
+	reads = []operation{
+		{
+			name: "point-read",
+			sql:  fmt.Sprintf("SELECT payload FROM %s WHERE id = $1", table),
+			args: func(r *rand.Rand, rows int) []any { return []any{r.IntN(rows) + 1} },
+		},
+		{
+			name: "range-read",
+			sql:  fmt.Sprintf("SELECT count(*), max(updated_at) FROM %s WHERE id BETWEEN $1 AND $1 + %d", table, rangeSize),
+			args: func(r *rand.Rand, rows int) []any { return []any{r.IntN(rows) + 1} },
+		},
+	}
+	writes = []operation{
+		{
+			name: "update",
+			sql:  fmt.Sprintf("UPDATE %s SET payload = md5(random()::text), updated_at = now() WHERE id = $1", table),
+			args: func(r *rand.Rand, rows int) []any { return []any{r.IntN(rows) + 1} },
+		},
+		{
+			name: "insert",
+			sql:  fmt.Sprintf("INSERT INTO %s (payload) VALUES (md5(random()::text))", table),
+			args: func(*rand.Rand, int) []any { return nil },
+		},
+	}
+	return reads, writes
+}
+
+// Run executes the noise workload until the context is done. Failures don't stop it,
+// the noise must not affect the main experiment other than by its load.
+func Run(ctx context.Context, connstr string, conf Config) {
+	conf.Normalize()
+	if conf.QPS <= 0 {
+		return
+	}
+	ctx = log.With(ctx, zap.String("job", "noise"))
+	log.Info(ctx, "noise workload started", zap.Any("conf", conf))
+
+	conn, err := reconnect.Connect(ctx, reconnect.Config{}, "noise", func(ctx context.Context) (*pgx.Conn, error) {
+		return dbconn.Connect(ctx, connstr)
+	})
+	if err != nil {
+		log.Error(ctx, "failed to connect", zap.Error(err))
+		return
+	}
+	err = setup(ctx, conn, conf)
+	conn.Close(context.Background())
+	if err != nil {
+		log.Error(ctx, "failed to set up noise table", zap.Error(err))
+		return
+	}
+
+	var wg sync.WaitGroup
+	for range conf.Conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			worker(ctx, connstr, conf)
+		}()
+	}
+	wg.Wait()
+}
+
+// setup creates the table and seeds it, if it's empty.
+func setup(ctx context.Context, conn *pgx.Conn, conf Config) error {
+	table := pgx.Identifier{conf.TableName}.Sanitize()
+	_, err := conn.Exec(ctx, fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+			id bigserial PRIMARY KEY,
+			payload text NOT NULL,
+			updated_at timestamptz NOT NULL DEFAULT now()
+		)`, table))
+	if err != nil {
+		return err
+	}
+
+	var empty bool
+	if err := conn.QueryRow(ctx, fmt.Sprintf("SELECT NOT EXISTS (SELECT FROM %s)", table)).Scan(&empty); err != nil {
+		return err
+	}
+	if !empty {
+		return nil
+	}
+	_, err = conn.Exec(ctx, fmt.Sprintf(
+		"INSERT INTO %s (payload) SELECT md5(i::text) FROM generate_series(1, $1) i", table), conf.Rows)
+	return err
+}
+
+// worker executes queries at its share of the rate, reconnecting after failures.
+func worker(ctx context.Context, connstr string, conf Config) {
+	reads, writes := operations(conf.TableName)
+	rng := rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64()))
+	interval := time.Duration(float64(time.Second) * float64(conf.Conns) / conf.QPS)
+
+	var conn *pgx.Conn
+	defer func() {
+		if conn != nil {
+			conn.Close(context.Background())
+		}
+	}()
+
+	for {
+		// jitter spreads the queries of all connections, keeping the average rate
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Duration(float64(interval) * (0.5 + rng.Float64()))):
+		}
+
+		if conn == nil || conn.IsClosed() {
+			var err error
+			conn, err = reconnect.Connect(ctx, reconnect.Config{}, "noise", func(ctx context.Context) (*pgx.Conn, error) {
+				return dbconn.Connect(ctx, connstr)
+			})
+			if err != nil {
+				return
+			}
+		}
+
+		op := writes[rng.IntN(len(writes))]
+		if rng.Float64() < conf.ReadRatio {
+			op = reads[rng.IntN(len(reads))]
+		}
+		labels := []string{"op", op.name}
+		start := time.Now()
+		_, err := conn.Exec(ctx, op.sql, op.args(rng, conf.Rows)...)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			metrics.Default.Counter("noise_errors_total", labels...).Inc()
+			continue
+		}
+		metrics.Default.Counter("noise_queries_total", labels...).Inc()
+		metrics.Default.Histogram("noise_latency_seconds", labels...).Observe(time.Since(start).Seconds())
+	}
+}
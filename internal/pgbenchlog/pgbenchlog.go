@@ -0,0 +1,106 @@
+// Package pgbenchlog writes per-transaction logs in the format of pgbench --log, so that
+// tooling built around pgbench logs can analyze overload runs unchanged.
+package pgbenchlog
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/petuhovskiy/overload/internal/log"
+	"go.uber.org/zap"
+)
+
+// client is a connection writing transactions, it's a pgbench client.
+type client struct {
+	id           int
+	transactions int64
+}
+
+// Writer writes one line per transaction:
+//
+//	client_id transaction_no time script_no time_epoch time_us
+//
+// where time is the latency in microseconds, or "failed" for failed transactions, and
+// time_epoch and time_us are the completion time. Clients are numbered by connection in
+// the order they first executed a transaction, scripts are numbered by query in the same way
+// and every new script number is logged with its SQL.
+//
+// It's safe for concurrent use, nil Writer records nothing.
+type Writer struct {
+	mu      sync.Mutex
+	file    *os.File
+	buf     *bufio.Writer
+	clients map[uint32]*client
+	scripts map[string]int
+	err     error
+}
+
+// New creates the log file, truncating it if it exists.
+func New(path string) (*Writer, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{
+		file:    file,
+		buf:     bufio.NewWriter(file),
+		clients: map[uint32]*client{},
+		scripts: map[string]int{},
+	}, nil
+}
+
+// Record appends a transaction executed by the connection with the backend PID. Script identifies
+// the query, e.g. its fingerprint, sql is logged when the script is seen first. Write errors
+// are logged once and stop the log, the workload itself is not affected.
+func (w *Writer) Record(conn uint32, script, sql string, start time.Time, latency time.Duration, err error) {
+	if w == nil {
+		return
+	}
+	end := start.Add(latency)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return
+	}
+
+	c, ok := w.clients[conn]
+	if !ok {
+		c = &client{id: len(w.clients)}
+		w.clients[conn] = c
+	}
+	scriptNo, ok := w.scripts[script]
+	if !ok {
+		scriptNo = len(w.scripts)
+		w.scripts[script] = scriptNo
+		log.Info(context.Background(), "pgbench log script", zap.Int("script_no", scriptNo), zap.String("query", sql))
+	}
+
+	elapsed := fmt.Sprint(latency.Microseconds())
+	if err != nil {
+		elapsed = "failed"
+	}
+	_, werr := fmt.Fprintf(w.buf, "%d %d %s %d %d %d\n",
+		c.id, c.transactions, elapsed, scriptNo, end.Unix(), end.Nanosecond()/1000)
+	c.transactions++
+	if werr != nil {
+		w.err = werr
+		log.Error(context.Background(), "failed to write pgbench log, logging stopped", zap.Error(werr))
+	}
+}
+
+// Close flushes and closes the log file.
+func (w *Writer) Close() error {
+	if w == nil {
+		return nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return errors.Join(w.buf.Flush(), w.file.Close())
+}
@@ -0,0 +1,163 @@
+// Package pgversion detects the server version, so that catalog queries and generated
+// workloads can be adapted to older servers and forks.
+package pgversion
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Engine is the server implementation speaking the Postgres wire protocol.
+type Engine string
+
+const (
+	Postgres    Engine = "postgres"
+	CockroachDB Engine = "cockroachdb"
+	// Generic is any other wire-compatible engine, only the most basic catalog queries are used.
+	Generic Engine = "generic"
+)
+
+// ParseEngine parses the engine name, empty name means auto-detection.
+func ParseEngine(name string) (Engine, error) {
+	switch e := Engine(name); e {
+	case "", Postgres, CockroachDB, Generic:
+		return e, nil
+	default:
+		return "", fmt.Errorf("unknown engine %q", name)
+	}
+}
+
+// forcedEngine overrides engine detection, for engines that can't be detected.
+var forcedEngine Engine
+
+// ForceEngine disables engine detection, all servers are assumed to be of the given engine.
+// Empty engine enables detection.
+func ForceEngine(e Engine) {
+	forcedEngine = e
+}
+
+// Version is the server version, reported by the server at connect time.
+type Version struct {
+	// Engine is the server implementation, Postgres unless detected otherwise.
+	Engine Engine
+	// Num is the version in server_version_num format, e.g. 150004 for 15.4 and 90624 for 9.6.24.
+	// Zero means the version couldn't be parsed.
+	Num int
+	// Full is the server_version as reported by the server, e.g. "15.4 (Debian 15.4-1.pgdg120+1)".
+	Full string
+}
+
+// FromConn returns the version of the server the connection is connected to.
+func FromConn(conn *pgx.Conn) Version {
+	v := Parse(conn.PgConn().ParameterStatus("server_version"))
+	switch {
+	case forcedEngine != "":
+		v.Engine = forcedEngine
+	case conn.PgConn().ParameterStatus("crdb_version") != "":
+		v.Engine = CockroachDB
+	}
+	return v
+}
+
+// Parse parses server_version, forks usually report a compatible Postgres version
+// with a suffix, e.g. "13.0.0" or "14.2-fork".
+func Parse(s string) Version {
+	v := Version{Engine: Postgres, Full: s}
+
+	numeric := s
+	if i := strings.IndexFunc(s, func(r rune) bool { return r != '.' && (r < '0' || r > '9') }); i >= 0 {
+		numeric = s[:i]
+	}
+	var parts []int
+	for _, p := range strings.Split(numeric, ".") {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			break
+		}
+		parts = append(parts, n)
+	}
+	if len(parts) == 0 {
+		return v
+	}
+	for len(parts) < 3 {
+		parts = append(parts, 0)
+	}
+
+	if parts[0] >= 10 {
+		v.Num = parts[0]*10000 + parts[1]
+	} else {
+		v.Num = parts[0]*10000 + parts[1]*100 + parts[2]
+	}
+	return v
+}
+
+// Major returns the major version, e.g. 15, or 9 for all 9.x versions.
+func (v Version) Major() int {
+	return v.Num / 10000
+}
+
+// AtLeast returns true if the major version is not older than the given one.
+// Unknown versions are assumed to be recent.
+func (v Version) AtLeast(major int) bool {
+	return v.Num == 0 || v.Major() >= major
+}
+
+func (v Version) String() string {
+	var res string
+	switch {
+	case v.Num == 0:
+		res = fmt.Sprintf("unknown (%q)", v.Full)
+	case v.Major() >= 10:
+		res = fmt.Sprintf("%d.%d", v.Major(), v.Num%10000)
+	default:
+		res = fmt.Sprintf("%d.%d.%d", v.Major(), v.Num/100%100, v.Num%100)
+	}
+	if !v.IsPostgres() {
+		res = fmt.Sprintf("%s (%s)", res, v.Engine)
+	}
+	return res
+}
+
+// IsPostgres returns true if the server is Postgres itself, rather than a compatible engine.
+func (v Version) IsPostgres() bool {
+	return v.Engine == Postgres || v.Engine == ""
+}
+
+// HasMerge returns true if MERGE is supported, since 15.
+func (v Version) HasMerge() bool {
+	return v.AtLeast(15)
+}
+
+// HasGeneratedColumns returns true if pg_attribute.attgenerated exists, since 12.
+func (v Version) HasGeneratedColumns() bool {
+	return v.AtLeast(12)
+}
+
+// HasWALFunctions returns true if pg_current_wal_lsn and pg_wal_lsn_diff exist, since 10.
+// Older versions have the same functions named xlog.
+func (v Version) HasWALFunctions() bool {
+	return v.IsPostgres() && v.AtLeast(10)
+}
+
+// HasXLogFunctions returns true if WAL functions of old versions exist, until 10.
+func (v Version) HasXLogFunctions() bool {
+	return v.IsPostgres() && !v.AtLeast(10)
+}
+
+// HasIdentityColumns returns true if identity columns and OVERRIDING SYSTEM VALUE exist, since 10.
+func (v Version) HasIdentityColumns() bool {
+	return v.AtLeast(10)
+}
+
+// HasReplayLag returns true if pg_stat_replication.replay_lag exists, since 10.
+func (v Version) HasReplayLag() bool {
+	return v.IsPostgres() && v.AtLeast(10)
+}
+
+// HasPartitions returns true if declarative partitioning and pg_class.relispartition exist, since 10.
+func (v Version) HasPartitions() bool {
+	return v.AtLeast(10)
+}
@@ -0,0 +1,55 @@
+package pgversion
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		s      string
+		num    int
+		major  int
+		string string
+	}{
+		{"15.4 (Debian 15.4-1.pgdg120+1)", 150004, 15, "15.4"},
+		{"16.0", 160000, 16, "16.0"},
+		{"17beta1", 170000, 17, "17.0"},
+		{"14.2-fork", 140002, 14, "14.2"},
+		{"13.0.0", 130000, 13, "13.0"},
+		{"10.23", 100023, 10, "10.23"},
+		{"9.6.24", 90624, 9, "9.6.24"},
+		{"9.4", 90400, 9, "9.4.0"},
+		{"", 0, 0, `unknown ("")`},
+		{"devel", 0, 0, `unknown ("devel")`},
+	}
+	for _, tt := range tests {
+		v := Parse(tt.s)
+		require.Equal(t, Postgres, v.Engine, tt.s)
+		require.Equal(t, tt.s, v.Full)
+		require.Equal(t, tt.num, v.Num, tt.s)
+		require.Equal(t, tt.major, v.Major(), tt.s)
+		require.Equal(t, tt.string, v.String(), tt.s)
+	}
+}
+
+func TestAtLeast(t *testing.T) {
+	require.True(t, Parse("15.4").AtLeast(15))
+	require.True(t, Parse("15.4").HasMerge())
+	require.False(t, Parse("14.9").HasMerge())
+	require.False(t, Parse("9.6.24").AtLeast(10))
+	require.True(t, Parse("devel").AtLeast(99), "unknown versions are assumed to be recent")
+}
+
+func TestParseEngine(t *testing.T) {
+	for _, name := range []string{"", "postgres", "cockroachdb", "generic"} {
+		e, err := ParseEngine(name)
+		require.NoError(t, err)
+		require.Equal(t, Engine(name), e)
+	}
+	_, err := ParseEngine("mysql")
+	require.Error(t, err)
+
+	require.Equal(t, "23.1 (cockroachdb)", Version{Engine: CockroachDB, Num: 230001}.String())
+}
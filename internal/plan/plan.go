@@ -0,0 +1,232 @@
+// Package plan runs experiments made of several workloads, executed sequentially or in
+// parallel according to their dependencies.
+package plan
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/petuhovskiy/overload/autoai"
+	"github.com/petuhovskiy/overload/presets"
+)
+
+// Plan describes an experiment. It's read from a JSON file:
+//
+//	{
+//	  "name": "pg17-ingest-then-read",
+//	  "labels": {"branch": "pg17"},
+//	  "steps": [
+//	    {"name": "ingest", "preset": "ingest-heavy", "until_db_size": "100GB"},
+//	    {"name": "read", "preset": "oltp-large", "after": ["ingest"],
+//	     "slas": [{"name": "point reads", "percentile": 99, "max_latency": "50ms", "class": "point"}]},
+//	    {"name": "churn", "preset": "contention", "after": ["read"], "duration": "1h"}
+//	  ]
+//	}
+//
+// Steps without dependencies between them run in parallel.
+type Plan struct {
+	Name string `json:"name"`
+	// Labels are attached to the runs of all steps.
+	Labels map[string]string `json:"labels"`
+	Steps  []Step            `json:"steps"`
+}
+
+// Step is a single workload of the plan, every step is recorded as a separate run.
+type Step struct {
+	Name string `json:"name"`
+	// Preset or Queries (path to a query file) is the workload.
+	Preset  string `json:"preset,omitempty"`
+	Queries string `json:"queries,omitempty"`
+	// After are names of the steps that must finish successfully before this one starts.
+	After []string `json:"after,omitempty"`
+	// Duration stops the step after the given time, e.g. "30m".
+	Duration string `json:"duration,omitempty"`
+	// UntilDBSize stops the step when the database reaches the given size, e.g. "100GB".
+	UntilDBSize string `json:"until_db_size,omitempty"`
+	// Labels are attached to the run of the step, in addition to the plan labels.
+	Labels map[string]string `json:"labels,omitempty"`
+	// SLAs are evaluated when the step finishes.
+	SLAs []SLA `json:"slas,omitempty"`
+
+	duration    time.Duration
+	untilDBSize int64
+	slas        []autoai.SLA
+}
+
+// SLA is a latency objective of the step, see autoai.SLA.
+type SLA struct {
+	Name       string  `json:"name"`
+	Percentile float64 `json:"percentile"`
+	// MaxLatency is a duration, e.g. "50ms".
+	MaxLatency string `json:"max_latency"`
+	// Class limits the SLA to queries of the class, Query to queries matching the regexp.
+	Class string `json:"class,omitempty"`
+	Query string `json:"query,omitempty"`
+}
+
+func (s SLA) parse() (autoai.SLA, error) {
+	res := autoai.SLA{Name: s.Name, Percentile: s.Percentile, Class: s.Class}
+	if s.Name == "" {
+		return res, errors.New("sla has no name")
+	}
+	if s.Percentile <= 0 || s.Percentile >= 100 {
+		return res, fmt.Errorf("sla %q: percentile must be between 0 and 100", s.Name)
+	}
+	var err error
+	if res.MaxLatency, err = time.ParseDuration(s.MaxLatency); err != nil || res.MaxLatency <= 0 {
+		return res, fmt.Errorf("sla %q: invalid max_latency %q", s.Name, s.MaxLatency)
+	}
+	if s.Query != "" {
+		if res.Query, err = regexp.Compile(s.Query); err != nil {
+			return res, fmt.Errorf("sla %q: invalid query: %w", s.Name, err)
+		}
+	}
+	return res, nil
+}
+
+// Load reads and validates the plan file.
+func Load(path string) (*Plan, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var p Plan
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&p); err != nil {
+		return nil, fmt.Errorf("invalid plan: %w", err)
+	}
+	if err := p.validate(); err != nil {
+		return nil, fmt.Errorf("invalid plan: %w", err)
+	}
+	return &p, nil
+}
+
+func (p *Plan) validate() error {
+	if len(p.Steps) == 0 {
+		return errors.New("no steps")
+	}
+
+	names := map[string]bool{}
+	for i := range p.Steps {
+		s := &p.Steps[i]
+		if s.Name == "" {
+			return fmt.Errorf("step #%d has no name", i+1)
+		}
+		if names[s.Name] {
+			return fmt.Errorf("duplicate step %q", s.Name)
+		}
+		names[s.Name] = true
+
+		if (s.Preset == "") == (s.Queries == "") {
+			return fmt.Errorf("step %q must have either preset or queries", s.Name)
+		}
+		if s.Preset != "" {
+			preset, err := presets.Get(s.Preset)
+			if err != nil {
+				return fmt.Errorf("step %q: %w", s.Name, err)
+			}
+			// presets without queries run until stopped
+			if len(preset.Queries) == 0 && s.Duration == "" && s.UntilDBSize == "" {
+				return fmt.Errorf("step %q: preset %q runs forever, set duration or until_db_size", s.Name, s.Preset)
+			}
+		}
+
+		var err error
+		if s.Duration != "" {
+			if s.duration, err = time.ParseDuration(s.Duration); err != nil {
+				return fmt.Errorf("step %q: invalid duration: %w", s.Name, err)
+			}
+		}
+		if s.UntilDBSize != "" {
+			if s.untilDBSize, err = parseSize(s.UntilDBSize); err != nil {
+				return fmt.Errorf("step %q: invalid until_db_size: %w", s.Name, err)
+			}
+		}
+		slaNames := map[string]bool{}
+		for _, sla := range s.SLAs {
+			parsed, err := sla.parse()
+			if err != nil {
+				return fmt.Errorf("step %q: %w", s.Name, err)
+			}
+			if slaNames[sla.Name] {
+				return fmt.Errorf("step %q: duplicate sla %q", s.Name, sla.Name)
+			}
+			slaNames[sla.Name] = true
+			s.slas = append(s.slas, parsed)
+		}
+	}
+
+	for _, s := range p.Steps {
+		for _, dep := range s.After {
+			if !names[dep] {
+				return fmt.Errorf("step %q depends on unknown step %q", s.Name, dep)
+			}
+		}
+	}
+	return p.checkCycles()
+}
+
+// checkCycles returns an error if steps can't be ordered because of circular dependencies.
+func (p *Plan) checkCycles() error {
+	deps := map[string][]string{}
+	for _, s := range p.Steps {
+		deps[s.Name] = s.After
+	}
+
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := map[string]int{}
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch state[name] {
+		case visiting:
+			return fmt.Errorf("circular dependency on step %q", name)
+		case visited:
+			return nil
+		}
+		state[name] = visiting
+		for _, dep := range deps[name] {
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		state[name] = visited
+		return nil
+	}
+	for _, s := range p.Steps {
+		if err := visit(s.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseSize parses sizes like "100GB", "512MB" or "1048576" (bytes), units are powers of 1024.
+func parseSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	multiplier := int64(1)
+	for i, unit := range []string{"KB", "MB", "GB", "TB"} {
+		if strings.HasSuffix(s, unit) {
+			multiplier = 1 << (10 * (i + 1))
+			s = strings.TrimSpace(strings.TrimSuffix(s, unit))
+			break
+		}
+	}
+	s = strings.TrimSuffix(s, "B")
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil || value <= 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(value * float64(multiplier)), nil
+}
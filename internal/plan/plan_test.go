@@ -0,0 +1,87 @@
+package plan
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		s    string
+		want int64
+	}{
+		{"1048576", 1 << 20},
+		{"100B", 100},
+		{"512MB", 512 << 20},
+		{"100GB", 100 << 30},
+		{" 1.5 gb ", 3 << 29},
+		{"2TB", 2 << 40},
+		{"4KB", 4 << 10},
+	}
+	for _, tt := range tests {
+		got, err := parseSize(tt.s)
+		require.NoError(t, err, tt.s)
+		require.Equal(t, tt.want, got, tt.s)
+	}
+
+	for _, s := range []string{"", "0", "-1GB", "GB", "ten", "10PB"} {
+		_, err := parseSize(s)
+		require.Error(t, err, s)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	p := &Plan{Steps: []Step{
+		{Name: "load", Preset: "ingest-heavy", UntilDBSize: "10GB"},
+		{Name: "oltp", Preset: "oltp-small", After: []string{"load"}, Duration: "30m", SLAs: []SLA{
+			{Name: "p99", Percentile: 99, MaxLatency: "50ms", Query: "^select"},
+		}},
+		{Name: "custom", Queries: "queries.sql", After: []string{"load"}},
+	}}
+	require.NoError(t, p.validate())
+	require.EqualValues(t, 10<<30, p.Steps[0].untilDBSize)
+	require.Equal(t, 30*time.Minute, p.Steps[1].duration)
+	require.Len(t, p.Steps[1].slas, 1)
+	require.Equal(t, 50*time.Millisecond, p.Steps[1].slas[0].MaxLatency)
+}
+
+func TestValidateErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []Step
+		err   string
+	}{
+		{"no steps", nil, "no steps"},
+		{"no name", []Step{{Queries: "q.sql"}}, "step #1 has no name"},
+		{"duplicate", []Step{{Name: "a", Queries: "q.sql"}, {Name: "a", Queries: "q.sql"}}, `duplicate step "a"`},
+		{"no workload", []Step{{Name: "a"}}, "must have either preset or queries"},
+		{"both workloads", []Step{{Name: "a", Preset: "oltp-small", Queries: "q.sql"}}, "must have either preset or queries"},
+		{"unknown preset", []Step{{Name: "a", Preset: "nope"}}, `step "a"`},
+		{"runs forever", []Step{{Name: "a", Preset: "ingest-heavy"}}, "runs forever"},
+		{"duration", []Step{{Name: "a", Queries: "q.sql", Duration: "soon"}}, "invalid duration"},
+		{"size", []Step{{Name: "a", Queries: "q.sql", UntilDBSize: "big"}}, "invalid until_db_size"},
+		{"sla without name", []Step{{Name: "a", Queries: "q.sql", SLAs: []SLA{{Percentile: 99, MaxLatency: "1s"}}}}, "sla has no name"},
+		{"sla percentile", []Step{{Name: "a", Queries: "q.sql", SLAs: []SLA{{Name: "s", Percentile: 100, MaxLatency: "1s"}}}}, "percentile must be between 0 and 100"},
+		{"sla latency", []Step{{Name: "a", Queries: "q.sql", SLAs: []SLA{{Name: "s", Percentile: 99, MaxLatency: "0s"}}}}, "invalid max_latency"},
+		{"sla query", []Step{{Name: "a", Queries: "q.sql", SLAs: []SLA{{Name: "s", Percentile: 99, MaxLatency: "1s", Query: "("}}}}, "invalid query"},
+		{"duplicate sla", []Step{{Name: "a", Queries: "q.sql", SLAs: []SLA{
+			{Name: "s", Percentile: 99, MaxLatency: "1s"},
+			{Name: "s", Percentile: 50, MaxLatency: "1s"},
+		}}}, `duplicate sla "s"`},
+		{"unknown dependency", []Step{{Name: "a", Queries: "q.sql", After: []string{"b"}}}, `depends on unknown step "b"`},
+		{"cycle", []Step{
+			{Name: "a", Queries: "q.sql", After: []string{"c"}},
+			{Name: "b", Queries: "q.sql", After: []string{"a"}},
+			{Name: "c", Queries: "q.sql", After: []string{"b"}},
+		}, "circular dependency"},
+		{"self dependency", []Step{{Name: "a", Queries: "q.sql", After: []string{"a"}}}, "circular dependency"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Plan{Steps: tt.steps}
+			require.ErrorContains(t, p.validate(), tt.err)
+		})
+	}
+}
@@ -0,0 +1,327 @@
+package plan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/petuhovskiy/overload/autoai"
+	"github.com/petuhovskiy/overload/internal/compat"
+	"github.com/petuhovskiy/overload/internal/dbconn"
+	"github.com/petuhovskiy/overload/internal/health"
+	"github.com/petuhovskiy/overload/internal/log"
+	"github.com/petuhovskiy/overload/internal/multi"
+	"github.com/petuhovskiy/overload/presets"
+	"go.uber.org/zap"
+)
+
+const sizeCheckInterval = 10 * time.Second
+
+// errStopCondition is the cancellation cause of steps stopped by their duration or size limit,
+// such steps are successful.
+var errStopCondition = errors.New("stop condition reached")
+
+// Step statuses in the results.
+const (
+	StatusOK       = "ok"
+	StatusFailed   = "failed"
+	StatusSkipped  = "skipped"
+	StatusCanceled = "canceled"
+)
+
+type Config struct {
+	// Connstr is the database the workloads are executed against.
+	Connstr string
+	// Launcher are the default launcher settings, presets override only zero fields.
+	Launcher   autoai.LauncherConfig
+	Supervisor multi.SupervisorConfig
+	// History is the database where the runs of the steps are recorded.
+	History *pgxpool.Pool
+}
+
+// Result is the outcome of a single step.
+type Result struct {
+	Step   string
+	RunID  int `json:",omitempty"`
+	Status string
+	Start  time.Time `json:",omitempty"`
+	End    time.Time `json:",omitempty"`
+	Error  string    `json:",omitempty"`
+	// Queries are aggregates of all queries executed by the step.
+	Queries []autoai.QueryAggregate `json:",omitempty"`
+	SLAs    []autoai.SLAResult      `json:",omitempty"`
+}
+
+// SLAFailed reports whether any SLA of the step wasn't met.
+func (r *Result) SLAFailed() bool {
+	for _, sla := range r.SLAs {
+		if !sla.Passed {
+			return true
+		}
+	}
+	return false
+}
+
+// Report is the combined result of all steps of the plan.
+type Report struct {
+	Plan   string
+	PlanID string
+	Labels map[string]string `json:",omitempty"`
+	Start  time.Time
+	End    time.Time
+	Steps  []Result
+}
+
+// Run executes all steps of the plan, each step starts when all its dependencies have finished
+// successfully. Runs of all steps share the plan and plan_id labels, so that they can be found
+// together in the history.
+func Run(ctx context.Context, p *Plan, conf Config) *Report {
+	report := &Report{
+		Plan:   p.Name,
+		PlanID: time.Now().UTC().Format("20060102-150405"),
+		Labels: p.Labels,
+		Start:  time.Now(),
+		Steps:  make([]Result, len(p.Steps)),
+	}
+	ctx = log.With(ctx, zap.String("plan", p.Name), zap.String("plan_id", report.PlanID))
+
+	done := map[string]chan struct{}{}
+	for _, s := range p.Steps {
+		done[s.Name] = make(chan struct{})
+	}
+
+	var mu sync.Mutex
+	status := map[string]string{}
+
+	var wg sync.WaitGroup
+	for i := range p.Steps {
+		step := &p.Steps[i]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(done[step.Name])
+
+			var failed []string
+			for _, dep := range step.After {
+				select {
+				case <-done[dep]:
+				case <-ctx.Done():
+				}
+				mu.Lock()
+				if status[dep] != StatusOK {
+					failed = append(failed, dep)
+				}
+				mu.Unlock()
+			}
+
+			var res Result
+			if len(failed) > 0 {
+				res = Result{
+					Step:   step.Name,
+					Status: StatusSkipped,
+					Error:  "dependencies not finished: " + strings.Join(failed, ", "),
+				}
+				log.Warn(ctx, "plan step skipped", zap.String("step", step.Name), zap.Strings("failed", failed))
+			} else {
+				res = runStep(ctx, p, step, report.PlanID, conf)
+			}
+
+			mu.Lock()
+			status[step.Name] = res.Status
+			report.Steps[i] = res
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	report.End = time.Now()
+	return report
+}
+
+// runStep executes the step as a separate run in the history.
+func runStep(ctx context.Context, p *Plan, step *Step, planID string, conf Config) Result {
+	res := Result{Step: step.Name, Start: time.Now()}
+	ctx = log.With(ctx, zap.String("step", step.Name))
+
+	labels := maps.Clone(p.Labels)
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	maps.Copy(labels, step.Labels)
+	labels["plan"] = p.Name
+	labels["plan_id"] = planID
+	labels["plan_step"] = step.Name
+
+	metadata := map[string]any{"mode": "plan"}
+	if step.Preset != "" {
+		metadata["preset"] = step.Preset
+	}
+
+	history := autoai.NewDBHistory(conf.History)
+	artifact := autoai.NewArtifact()
+	history.SetArtifact(artifact)
+
+	err := func() error {
+		runID, err := history.StartRun(labels, metadata)
+		if err != nil {
+			return fmt.Errorf("failed to start run: %w", err)
+		}
+		res.RunID = runID
+		ctx = log.With(ctx, zap.Int("run_id", runID))
+		log.Info(ctx, "plan step started")
+
+		health.Default.RunStarted()
+		defer health.Default.RunFinished()
+
+		stepCtx, cancel := context.WithCancelCause(ctx)
+		defer cancel(nil)
+		if step.duration > 0 {
+			timer := time.AfterFunc(step.duration, func() { cancel(errStopCondition) })
+			defer timer.Stop()
+		}
+		if step.untilDBSize > 0 {
+			go waitDBSize(stepCtx, conf.Connstr, step.untilDBSize, cancel)
+		}
+
+		autoai.DetectServerVersion(stepCtx, conf.Connstr, history)
+		supervisor := multi.NewSupervisor(conf.Supervisor)
+		defer supervisor.LogSummary(ctx)
+
+		launcherConf := conf.Launcher
+		if step.Preset != "" {
+			preset, err := presets.Get(step.Preset)
+			if err != nil {
+				return err
+			}
+			preset.Override(launcherConf)
+			if err := preset.SetupSchema(stepCtx, conf.Connstr); err != nil {
+				return stepError(stepCtx, err)
+			}
+			launcher := autoai.NewLauncher(history, preset.Launcher)
+			err = preset.Run(stepCtx, conf.Connstr, launcher, supervisor)
+			return stepError(stepCtx, err)
+		}
+
+		launcher := autoai.NewLauncher(history, launcherConf)
+		err = supervisor.Run(stepCtx, "queries", func(ctx context.Context) error {
+			return launcher.RunSource(ctx, conf.Connstr, &autoai.FileSource{Path: step.Queries})
+		})
+		return stepError(stepCtx, err)
+	}()
+
+	res.End = time.Now()
+	res.Queries = artifact.Aggregate()
+	if len(step.slas) > 0 && res.RunID != 0 {
+		res.SLAs = artifact.EvaluateSLAs(step.slas)
+		for _, sla := range res.SLAs {
+			log.Info(ctx, "plan step sla", zap.String("sla", sla.SLA), zap.Duration("latency", sla.Latency),
+				zap.Duration("max_latency", sla.MaxLatency), zap.Bool("passed", sla.Passed))
+		}
+		if err := history.SaveSLAResults(step.Name, res.SLAs); err != nil {
+			log.Warn(ctx, "failed to save sla results", zap.Error(err))
+		}
+	}
+	switch {
+	case err != nil:
+		res.Status, res.Error = StatusFailed, err.Error()
+		log.Error(ctx, "plan step failed", zap.Error(err))
+	case ctx.Err() != nil:
+		res.Status = StatusCanceled
+	default:
+		res.Status = StatusOK
+		log.Info(ctx, "plan step finished", zap.Duration("elapsed", res.End.Sub(res.Start)))
+	}
+	return res
+}
+
+// stepError ignores errors caused by stopping the step.
+func stepError(stepCtx context.Context, err error) error {
+	if stepCtx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// waitDBSize cancels the step when the database grows to the size.
+func waitDBSize(ctx context.Context, connstr string, size int64, cancel context.CancelCauseFunc) {
+	conn, err := dbconn.Connect(ctx, connstr)
+	if err != nil {
+		log.Error(ctx, "failed to connect for database size checks", zap.Error(err))
+		return
+	}
+	defer conn.Close(context.Background())
+
+	for {
+		current, err := compat.DatabaseSize(ctx, conn)
+		switch {
+		case err != nil && ctx.Err() == nil:
+			log.Warn(ctx, "failed to get database size", zap.Error(err))
+		case err == nil && current >= size:
+			log.Info(ctx, "database size reached", zap.Int64("size", current), zap.Int64("limit", size))
+			cancel(errStopCondition)
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(sizeCheckInterval):
+		}
+	}
+}
+
+// PrintReport prints the status and the main statistics of every step.
+func PrintReport(w io.Writer, report *Report) error {
+	fmt.Fprintf(w, "Plan %s (%s), %s\n\n", report.Plan, report.PlanID, report.End.Sub(report.Start).Round(time.Second))
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "STEP\tRUN\tSTATUS\tDURATION\tQUERIES\tEXECUTIONS\tERRORS\tMAX QPS\tSLA\t")
+	for _, res := range report.Steps {
+		var executions, errs int
+		var maxQPS float64
+		for _, q := range res.Queries {
+			executions += q.Executions
+			errs += q.Errors
+			maxQPS = max(maxQPS, q.MaxQPS)
+		}
+		var duration time.Duration
+		if !res.Start.IsZero() {
+			duration = res.End.Sub(res.Start).Round(time.Second)
+		}
+		sla := "-"
+		if len(res.SLAs) > 0 {
+			passed := 0
+			for _, s := range res.SLAs {
+				if s.Passed {
+					passed++
+				}
+			}
+			sla = fmt.Sprintf("%d/%d", passed, len(res.SLAs))
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%d\t%d\t%d\t%.1f\t%s\t\n",
+			res.Step, res.RunID, res.Status, duration, len(res.Queries), executions, errs, maxQPS, sla)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	for _, res := range report.Steps {
+		if res.Error != "" {
+			fmt.Fprintf(w, "\n%s: %s\n", res.Step, res.Error)
+		}
+		for _, s := range res.SLAs {
+			if !s.Passed {
+				fmt.Fprintf(w, "\n%s: sla %q failed, p%g %s > %s (%d executions)\n",
+					res.Step, s.SLA, s.Percentile, s.Latency, s.MaxLatency, s.Executions)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+// Package ready waits for a freshly provisioned database to become usable before the workload
+// starts: the server accepts connections and the required tables and extensions exist.
+package ready
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/petuhovskiy/overload/internal/dbconn"
+	"github.com/petuhovskiy/overload/internal/log"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultInterval       = 2 * time.Second
+	defaultConnectTimeout = 5 * time.Second
+)
+
+type Config struct {
+	// Timeout is the max time to wait, zero disables the probe.
+	Timeout time.Duration
+	// Interval is the pause between attempts.
+	Interval time.Duration
+	// Tables must exist, names can be schema-qualified.
+	Tables []string
+	// Extensions must be installed in the database.
+	Extensions []string
+}
+
+func (c *Config) Normalize() {
+	if c.Interval == 0 {
+		c.Interval = defaultInterval
+	}
+}
+
+// Wait blocks until the database accepts connections and has all required tables and extensions,
+// returns an error with the last failed check if it doesn't happen within the timeout.
+func Wait(ctx context.Context, connstr string, conf Config) error {
+	conf.Normalize()
+	if conf.Timeout == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, conf.Timeout)
+	defer cancel()
+
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		err := check(ctx, connstr, conf)
+		if err == nil {
+			if attempt > 1 {
+				log.Info(ctx, "database is ready", zap.Duration("waited", time.Since(start)), zap.Int("attempts", attempt))
+			}
+			return nil
+		}
+		log.Info(ctx, "waiting for database", zap.Int("attempt", attempt), zap.Error(err))
+
+		select {
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return fmt.Errorf("database not ready after %s: %w", conf.Timeout, err)
+			}
+			return ctx.Err()
+		case <-time.After(conf.Interval):
+		}
+	}
+}
+
+// check returns nil if the database is ready, or the reason why it isn't.
+func check(ctx context.Context, connstr string, conf Config) error {
+	connectCtx, cancel := context.WithTimeout(ctx, defaultConnectTimeout)
+	defer cancel()
+	conn, err := dbconn.Connect(connectCtx, connstr)
+	if err != nil {
+		return fmt.Errorf("failed to connect: %w", err)
+	}
+	defer conn.Close(context.Background())
+
+	if missing, err := missingTables(ctx, conn, conf.Tables); err != nil {
+		return err
+	} else if len(missing) > 0 {
+		return fmt.Errorf("missing tables: %s", strings.Join(missing, ", "))
+	}
+	if missing, err := missingExtensions(ctx, conn, conf.Extensions); err != nil {
+		return err
+	} else if len(missing) > 0 {
+		return fmt.Errorf("missing extensions: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func missingTables(ctx context.Context, conn *pgx.Conn, tables []string) ([]string, error) {
+	var missing []string
+	for _, table := range tables {
+		var exists bool
+		err := conn.QueryRow(ctx, "SELECT to_regclass($1) IS NOT NULL", table).Scan(&exists)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check table %s: %w", table, err)
+		}
+		if !exists {
+			missing = append(missing, table)
+		}
+	}
+	return missing, nil
+}
+
+func missingExtensions(ctx context.Context, conn *pgx.Conn, extensions []string) ([]string, error) {
+	if len(extensions) == 0 {
+		return nil, nil
+	}
+	rows, err := conn.Query(ctx, "SELECT extname FROM pg_extension")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list extensions: %w", err)
+	}
+	installed, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, fmt.Errorf("failed to list extensions: %w", err)
+	}
+
+	var missing []string
+	for _, ext := range extensions {
+		if !slices.Contains(installed, ext) {
+			missing = append(missing, ext)
+		}
+	}
+	return missing, nil
+}
@@ -0,0 +1,110 @@
+package reconnect
+
+import (
+	"context"
+	"math/rand/v2"
+	"time"
+
+	"github.com/petuhovskiy/overload/internal/log"
+	"github.com/petuhovskiy/overload/internal/metrics"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultInitialDelay = 100 * time.Millisecond
+	defaultMaxDelay     = 30 * time.Second
+	defaultMultiplier   = 2
+	defaultJitter       = 0.2
+	// defaultMaxAttempts gives up after ~30s of backoff, so that a server that is down
+	// fails the run instead of hanging it.
+	defaultMaxAttempts = 10
+)
+
+// Config describes the reconnect policy of a module.
+type Config struct {
+	// InitialDelay is the delay after the first failed attempt.
+	InitialDelay time.Duration
+	// MaxDelay is the upper bound of the delay between attempts.
+	MaxDelay time.Duration
+	// Multiplier is applied to the delay after every failed attempt.
+	Multiplier float64
+	// Jitter is the max fraction of the delay that is randomly added or subtracted.
+	Jitter float64
+	// MaxAttempts is the max number of attempts, negative means unlimited.
+	MaxAttempts int
+}
+
+func (conf *Config) Normalize() {
+	if conf.InitialDelay == 0 {
+		conf.InitialDelay = defaultInitialDelay
+	}
+
+	if conf.MaxDelay == 0 {
+		conf.MaxDelay = defaultMaxDelay
+	}
+
+	if conf.Multiplier == 0 {
+		conf.Multiplier = defaultMultiplier
+	}
+
+	if conf.Jitter == 0 {
+		conf.Jitter = defaultJitter
+	}
+
+	if conf.MaxAttempts == 0 {
+		conf.MaxAttempts = defaultMaxAttempts
+	}
+}
+
+// Delay returns the delay before the given attempt, starting from 1 for the first retry.
+func (conf *Config) Delay(attempt int) time.Duration {
+	delay := float64(conf.InitialDelay)
+	for i := 1; i < attempt && delay < float64(conf.MaxDelay); i++ {
+		delay *= conf.Multiplier
+	}
+	delay = min(delay, float64(conf.MaxDelay))
+
+	// random value in [-jitter, +jitter]
+	jitter := (rand.Float64()*2 - 1) * conf.Jitter
+	return time.Duration(delay * (1 + jitter))
+}
+
+// Connect calls connect until it succeeds, the context is done or max attempts are exhausted.
+// Module name is used for logging and as a label of the connection metrics.
+func Connect[T any](ctx context.Context, conf Config, module string, connect func(ctx context.Context) (T, error)) (T, error) {
+	conf.Normalize()
+	attempts := metrics.Default.Counter("connect_attempts_total", "module", module)
+	failures := metrics.Default.Counter("connect_failures_total", "module", module)
+	reconnects := metrics.Default.Counter("reconnects_total", "module", module)
+
+	for attempt := 1; ; attempt++ {
+		attempts.Inc()
+		res, err := connect(ctx)
+		if err == nil {
+			if attempt > 1 {
+				reconnects.Inc()
+				log.Info(ctx, "reconnected", zap.String("module", module), zap.Int("attempt", attempt))
+			}
+			return res, nil
+		}
+		failures.Inc()
+
+		if conf.MaxAttempts > 0 && attempt >= conf.MaxAttempts {
+			return res, err
+		}
+
+		delay := conf.Delay(attempt)
+		log.Warn(ctx, "failed to connect, retrying",
+			zap.String("module", module),
+			zap.Int("attempt", attempt),
+			zap.Duration("delay", delay),
+			zap.Error(err),
+		)
+
+		select {
+		case <-ctx.Done():
+			return res, err
+		case <-time.After(delay):
+		}
+	}
+}
@@ -0,0 +1,186 @@
+// Package runconfig reads workload definitions of the run command from a YAML file.
+package runconfig
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"time"
+
+	"github.com/petuhovskiy/overload/ingest"
+	"github.com/petuhovskiy/overload/presets"
+	"gopkg.in/yaml.v3"
+)
+
+// Modules a workload can run.
+const (
+	ModuleIngest  = "ingest"
+	ModuleAutoAI  = "autoai"
+	ModuleQueries = "queries"
+	ModulePreset  = "preset"
+)
+
+const defaultIngestWorkers = 10
+
+// envRef matches references to environment variables in the file, like ${CONNSTR}.
+var envRef = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// File describes workloads executed together, every workload is recorded as a separate run.
+// It's read from a YAML file, JSON works too:
+//
+//	connstr: ${CONNSTR}
+//	env:
+//	  STATEMENT_TIMEOUT: 30s
+//	workloads:
+//	  - name: events
+//	    module: ingest
+//	    method: copy
+//	    workers: 8
+//	    batch_size: 100000
+//	    duration: 1h
+//	  - name: reads
+//	    module: queries
+//	    queries: reads.sql
+//	    max_conns: 50
+//	    duration: 1h
+//
+// Values can reference environment variables as ${NAME}.
+type File struct {
+	// Connstr is the target database of workloads without their own, CONNSTR overrides it.
+	Connstr string `yaml:"connstr"`
+	// LogsConnstr is the history database, LOGS_CONNSTR overrides it.
+	LogsConnstr string `yaml:"logs_connstr"`
+	// Labels are attached to the runs of all workloads.
+	Labels map[string]string `yaml:"labels"`
+	// Env are defaults of environment variables of the tool, like STATEMENT_TIMEOUT or
+	// SAFETY_MAX_CONNS, variables set in the environment take precedence.
+	Env       map[string]string `yaml:"env"`
+	Workloads []Workload        `yaml:"workloads"`
+}
+
+// Workload is a single module executed against the target database.
+type Workload struct {
+	Name string `yaml:"name"`
+	// Module is one of the Module constants.
+	Module string `yaml:"module"`
+	// Connstr overrides the target database of the file.
+	Connstr string `yaml:"connstr"`
+	// Duration stops the workload, it runs until interrupted by default.
+	Duration time.Duration `yaml:"duration"`
+	// Labels are attached to the run of the workload, in addition to the file labels.
+	Labels map[string]string `yaml:"labels"`
+
+	// MaxConns caps the connections of ramp steps of the queries, preset and autoai modules.
+	MaxConns int `yaml:"max_conns"`
+	// Queries is the query file of the queries module, Preset is the preset of the preset module.
+	Queries string `yaml:"queries"`
+	Preset  string `yaml:"preset"`
+
+	// Method (copy, generate or values), Workers, Table, BatchSize and BatchesPerCommit
+	// configure the ingest module, see ingest.Config.
+	Method           string `yaml:"method"`
+	Workers          int    `yaml:"workers"`
+	Table            string `yaml:"table"`
+	BatchSize        int    `yaml:"batch_size"`
+	BatchesPerCommit int    `yaml:"batches_per_commit"`
+}
+
+// Load reads and validates the file, CONNSTR from the environment overrides its target database.
+func Load(path string) (*File, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	data = envRef.ReplaceAllFunc(data, func(ref []byte) []byte {
+		return []byte(os.Getenv(string(envRef.FindSubmatch(ref)[1])))
+	})
+
+	var f File
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&f); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	if connstr := os.Getenv("CONNSTR"); connstr != "" {
+		f.Connstr = connstr
+	}
+	if err := f.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	return &f, nil
+}
+
+func (f *File) validate() error {
+	if len(f.Workloads) == 0 {
+		return errors.New("no workloads")
+	}
+
+	names := map[string]bool{}
+	for i := range f.Workloads {
+		w := &f.Workloads[i]
+		if w.Name == "" {
+			return fmt.Errorf("workload #%d has no name", i+1)
+		}
+		if names[w.Name] {
+			return fmt.Errorf("duplicate workload %q", w.Name)
+		}
+		names[w.Name] = true
+		if f.ConnstrOf(*w) == "" {
+			return fmt.Errorf("workload %q has no connstr", w.Name)
+		}
+
+		switch w.Module {
+		case ModuleIngest:
+			if w.Method == "" {
+				w.Method = ingest.Methods[0].Name
+			}
+			if !slices.ContainsFunc(ingest.Methods, func(m ingest.Method) bool { return m.Name == w.Method }) {
+				return fmt.Errorf("workload %q: unknown ingest method %q", w.Name, w.Method)
+			}
+			if w.Workers == 0 {
+				w.Workers = defaultIngestWorkers
+			}
+		case ModuleQueries:
+			if w.Queries == "" {
+				return fmt.Errorf("workload %q: queries file is required", w.Name)
+			}
+		case ModulePreset:
+			if _, err := presets.Get(w.Preset); err != nil {
+				return fmt.Errorf("workload %q: %w", w.Name, err)
+			}
+		case ModuleAutoAI:
+		default:
+			return fmt.Errorf("workload %q: unknown module %q, available: %s, %s, %s, %s", w.Name, w.Module,
+				ModuleIngest, ModuleAutoAI, ModuleQueries, ModulePreset)
+		}
+	}
+	return nil
+}
+
+// ConnstrOf returns the target database of the workload.
+func (f *File) ConnstrOf(w Workload) string {
+	if w.Connstr != "" {
+		return w.Connstr
+	}
+	return f.Connstr
+}
+
+// SetEnvDefaults sets environment variables of the file which aren't set in the environment.
+func (f *File) SetEnvDefaults() error {
+	env := map[string]string{"LOGS_CONNSTR": f.LogsConnstr}
+	for name, value := range f.Env {
+		env[name] = value
+	}
+	for name, value := range env {
+		if _, ok := os.LookupEnv(name); ok || value == "" {
+			continue
+		}
+		if err := os.Setenv(name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
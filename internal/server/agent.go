@@ -0,0 +1,137 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/petuhovskiy/overload/api"
+	"github.com/petuhovskiy/overload/autoai"
+	"github.com/petuhovskiy/overload/internal/health"
+	"github.com/petuhovskiy/overload/internal/log"
+	"github.com/petuhovskiy/overload/internal/metrics"
+	"github.com/petuhovskiy/overload/internal/multi"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+)
+
+type AgentConfig struct {
+	// Coordinator is the address of the coordinator.
+	Coordinator string
+	// Name identifies the agent in the coordinator logs.
+	Name string
+	// Connstr is the database the workload is executed against.
+	Connstr    string
+	Launcher   autoai.LauncherConfig
+	Supervisor multi.SupervisorConfig
+	// ReportInterval is how often metrics are sent to the coordinator.
+	ReportInterval time.Duration
+	// Security are the credentials sent to the coordinator.
+	Security Security
+}
+
+func (conf *AgentConfig) Normalize() {
+	if conf.ReportInterval == 0 {
+		conf.ReportInterval = time.Second
+	}
+}
+
+// RunAgent joins the coordinator, executes the assigned shard of the workload and
+// reports metrics back until the workload is finished. Pool is the history database.
+func RunAgent(ctx context.Context, pool *pgxpool.Pool, conf AgentConfig) error {
+	conf.Normalize()
+	ctx = log.With(ctx, zap.String("agent", conf.Name))
+
+	opts, err := conf.Security.DialOptions()
+	if err != nil {
+		return err
+	}
+	// the join stream stays open until the connection is closed, the coordinator
+	// treats its end as the end of the agent
+	conn, err := grpc.NewClient(conf.Coordinator, opts...)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	client := api.NewCoordinatorClient(conn)
+
+	log.Info(ctx, "joining coordinator", zap.String("coordinator", conf.Coordinator))
+	join, err := client.Join(ctx, &api.JoinRequest{Agent: conf.Name})
+	if err != nil {
+		return err
+	}
+	assignment, err := join.Recv()
+	if err != nil {
+		return fmt.Errorf("failed to receive assignment: %w", err)
+	}
+
+	spec := workloadSpec{
+		preset:  assignment.GetPreset(),
+		queries: assignment.GetQueries(),
+		shard:   int(assignment.Shard),
+		shards:  int(assignment.Shards),
+	}
+	run, launcherConf, err := spec.build(conf.Connstr, conf.Launcher)
+	if err != nil {
+		return fmt.Errorf("invalid assignment: %w", err)
+	}
+
+	ctx = log.With(ctx, zap.Int64("run_id", assignment.RunId), zap.Int32("shard", assignment.Shard))
+	log.Info(ctx, "assignment received")
+
+	history := autoai.NewDBHistory(pool)
+	history.AttachRun(int(assignment.RunId))
+	autoai.DetectServerVersion(ctx, conf.Connstr, history)
+	launcher := autoai.NewLauncher(history, launcherConf)
+	supervisor := multi.NewSupervisor(conf.Supervisor)
+
+	report, err := client.Report(ctx)
+	if err != nil {
+		return err
+	}
+	reportCtx, stopReport := context.WithCancel(ctx)
+	reportDone := make(chan error, 1)
+	go func() {
+		reportDone <- sendStats(reportCtx, report, conf.Name, conf.ReportInterval)
+	}()
+
+	health.Default.RunStarted()
+	runErr := run(ctx, launcher, supervisor)
+	health.Default.RunFinished()
+	supervisor.LogSummary(ctx)
+	stopReport()
+
+	if err := <-reportDone; err != nil {
+		log.Warn(ctx, "failed to report stats", zap.Error(err))
+	}
+	if _, err := report.CloseAndRecv(); err != nil {
+		log.Warn(ctx, "failed to finish reporting", zap.Error(err))
+	}
+	return runErr
+}
+
+// sendStats sends metrics every interval until the context is done, and once more at the end.
+func sendStats(ctx context.Context, report api.Coordinator_ReportClient, agent string, interval time.Duration) error {
+	prev := metrics.Default.Snapshot()
+	prevTime := time.Now()
+	for {
+		var stop bool
+		select {
+		case <-ctx.Done():
+			stop = true
+		case <-time.After(interval):
+		}
+
+		snapshot := metrics.Default.Snapshot()
+		now := time.Now()
+		err := report.Send(&api.AgentStats{
+			Agent: agent,
+			Stats: statsMessage(snapshot, prev, now.Sub(prevTime), now),
+		})
+		if err != nil || stop {
+			return err
+		}
+		prev, prevTime = snapshot, now
+	}
+}
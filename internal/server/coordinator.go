@@ -0,0 +1,299 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/petuhovskiy/overload/api"
+	"github.com/petuhovskiy/overload/autoai"
+	"github.com/petuhovskiy/overload/internal/log"
+	"github.com/petuhovskiy/overload/internal/metrics"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const defaultReportInterval = 10 * time.Second
+
+type CoordinatorConfig struct {
+	// Agents is the number of agents the workload is distributed between.
+	Agents int
+	// Preset or Queries is the workload, see StartRunRequest.
+	Preset  string
+	Queries string
+	Labels  map[string]string
+	// ReportInterval is how often merged stats of all agents are logged.
+	ReportInterval time.Duration
+}
+
+// SetupSchema sets up the schema of the preset workload once for all agents, it has
+// to be called before agents join.
+func (conf *CoordinatorConfig) SetupSchema(ctx context.Context, connstr string) error {
+	spec := workloadSpec{preset: conf.Preset, queries: conf.Queries}
+	return spec.setupSchema(ctx, connstr)
+}
+
+func (conf *CoordinatorConfig) Normalize() {
+	if conf.Agents == 0 {
+		conf.Agents = 1
+	}
+
+	if conf.ReportInterval == 0 {
+		conf.ReportInterval = defaultReportInterval
+	}
+}
+
+// Coordinator waits for all agents to join, starts a shared run and assigns
+// every agent a shard of the workload. Agents report their metrics back,
+// which are merged and logged. An agent is finished when it closes its Join
+// or Report stream, so agents that are gone don't block the run.
+type Coordinator struct {
+	api.UnimplementedCoordinatorServer
+
+	history *autoai.DBHistory
+	conf    CoordinatorConfig
+
+	mu       sync.Mutex
+	agents   []string
+	runID    int
+	startErr error
+	stats    map[string]*api.Stats
+	finished map[string]bool
+
+	ready chan struct{}
+	done  chan struct{}
+	// doneOnce closes done, both a failed start and the last finished agent close it
+	doneOnce sync.Once
+}
+
+func NewCoordinator(history *autoai.DBHistory, conf CoordinatorConfig) *Coordinator {
+	conf.Normalize()
+	return &Coordinator{
+		history:  history,
+		conf:     conf,
+		stats:    map[string]*api.Stats{},
+		finished: map[string]bool{},
+		ready:    make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Join assigns the agent a shard once all agents have joined and keeps the stream open
+// until the agent disconnects. Agents leaving before the run has started release their slot.
+func (c *Coordinator) Join(req *api.JoinRequest, stream api.Coordinator_JoinServer) error {
+	ctx := log.With(stream.Context(), zap.String("agent", req.Agent))
+
+	c.mu.Lock()
+	if slices.Contains(c.agents, req.Agent) {
+		c.mu.Unlock()
+		return status.Errorf(codes.AlreadyExists, "agent %s has already joined", req.Agent)
+	}
+	if len(c.agents) >= c.conf.Agents {
+		c.mu.Unlock()
+		return status.Error(codes.ResourceExhausted, "all agents have already joined")
+	}
+	c.agents = append(c.agents, req.Agent)
+	log.Info(ctx, "agent joined", zap.Int("joined", len(c.agents)), zap.Int("expected", c.conf.Agents))
+	if len(c.agents) == c.conf.Agents {
+		c.start(ctx)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		c.leave(ctx, req.Agent)
+		return ctx.Err()
+	case <-c.ready:
+	}
+	if c.startErr != nil {
+		return status.Errorf(codes.Internal, "failed to start run: %v", c.startErr)
+	}
+
+	// the list of agents doesn't change after the start
+	shard := slices.Index(c.agents, req.Agent)
+	assignment := &api.Assignment{
+		RunId:  int64(c.runID),
+		Shard:  int32(shard),
+		Shards: int32(c.conf.Agents),
+	}
+	if c.conf.Preset != "" {
+		assignment.Workload = &api.Assignment_Preset{Preset: c.conf.Preset}
+	} else {
+		assignment.Workload = &api.Assignment_Queries{Queries: c.conf.Queries}
+	}
+	if err := stream.Send(assignment); err != nil {
+		c.finish(req.Agent)
+		return err
+	}
+	log.Info(ctx, "agent assigned", zap.Int("shard", shard))
+
+	<-ctx.Done()
+	c.finish(req.Agent)
+	return nil
+}
+
+// leave releases the slot of the agent which disconnected before the run has started.
+func (c *Coordinator) leave(ctx context.Context, agent string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	select {
+	case <-c.ready:
+		// the slot is taken by the run now
+		c.finishLocked(agent)
+		return
+	default:
+	}
+	c.agents = slices.DeleteFunc(c.agents, func(name string) bool { return name == agent })
+	log.Info(ctx, "agent left before the start", zap.Int("joined", len(c.agents)), zap.Int("expected", c.conf.Agents))
+}
+
+// start creates the shared run, must be called with the lock held.
+func (c *Coordinator) start(ctx context.Context) {
+	spec := workloadSpec{preset: c.conf.Preset, queries: c.conf.Queries, shards: c.conf.Agents}
+	metadata := spec.metadata()
+	metadata["mode"] = "distributed"
+	metadata["agents"] = c.agents
+
+	c.runID, c.startErr = c.history.StartRun(c.conf.Labels, metadata)
+	if c.startErr == nil {
+		log.Info(ctx, "distributed run started", zap.Int("run_id", c.runID))
+	} else {
+		// agents won't execute anything, there is nothing to wait for
+		c.closeDone()
+	}
+	close(c.ready)
+}
+
+func (c *Coordinator) Report(stream api.Coordinator_ReportServer) error {
+	var agent string
+	for {
+		msg, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			// the agent is gone, it won't report anymore
+			c.finish(agent)
+			return err
+		}
+
+		agent = msg.Agent
+		c.mu.Lock()
+		c.stats[agent] = msg.Stats
+		c.mu.Unlock()
+	}
+
+	c.finish(agent)
+	return stream.SendAndClose(&api.ReportResponse{})
+}
+
+func (c *Coordinator) finish(agent string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.finishLocked(agent)
+}
+
+// finishLocked marks the agent finished, it's called for both streams of the agent, only the
+// first call counts. Must be called with the lock held.
+func (c *Coordinator) finishLocked(agent string) {
+	if agent == "" || c.finished[agent] || !slices.Contains(c.agents, agent) {
+		return
+	}
+	c.finished[agent] = true
+	log.Info(context.Background(), "agent finished", zap.String("agent", agent), zap.Int("finished", len(c.finished)))
+	if len(c.finished) == c.conf.Agents {
+		c.closeDone()
+	}
+}
+
+// closeDone unblocks Wait, it's safe to call multiple times.
+func (c *Coordinator) closeDone() {
+	c.doneOnce.Do(func() { close(c.done) })
+}
+
+// Wait logs merged stats every ReportInterval until all agents have finished
+// or the context is done, and returns the final merged stats.
+func (c *Coordinator) Wait(ctx context.Context) *api.Stats {
+	for {
+		select {
+		case <-ctx.Done():
+			return c.Merged()
+		case <-c.done:
+			merged := c.Merged()
+			log.Info(ctx, "distributed run finished", zap.Int("run_id", c.runID), zap.Any("stats", merged))
+			return merged
+		case <-time.After(c.conf.ReportInterval):
+			log.Info(ctx, "distributed run stats", zap.Int("run_id", c.runID), zap.Any("stats", c.Merged()))
+		}
+	}
+}
+
+// Merged returns the latest stats of all agents merged together. Counters, rates and histogram
+// buckets are summed and quantiles are computed from the merged buckets. Gauges take the max
+// value, since they can't be aggregated exactly.
+func (c *Coordinator) Merged() *api.Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	counters := map[string]*api.Counter{}
+	gauges := map[string]*api.Gauge{}
+	histograms := map[string]*metrics.HistogramSnapshot{}
+	merged := &api.Stats{}
+	for _, stats := range c.stats {
+		if merged.Time == nil || stats.Time.AsTime().After(merged.Time.AsTime()) {
+			merged.Time = stats.Time
+		}
+		for _, m := range stats.Counters {
+			if acc, ok := counters[m.Key]; ok {
+				acc.Value += m.Value
+				acc.Rate += m.Rate
+			} else {
+				counters[m.Key] = &api.Counter{Key: m.Key, Value: m.Value, Rate: m.Rate}
+			}
+		}
+		for _, m := range stats.Gauges {
+			if acc, ok := gauges[m.Key]; ok {
+				acc.Value = max(acc.Value, m.Value)
+			} else {
+				gauges[m.Key] = &api.Gauge{Key: m.Key, Value: m.Value}
+			}
+		}
+		for _, m := range stats.Histograms {
+			acc, ok := histograms[m.Key]
+			if !ok {
+				acc = &metrics.HistogramSnapshot{}
+				histograms[m.Key] = acc
+			}
+			acc.Count += m.Count
+			for len(acc.Counts) < len(m.Buckets) {
+				acc.Counts = append(acc.Counts, 0)
+			}
+			for i, count := range m.Buckets {
+				acc.Counts[i] += count
+			}
+		}
+	}
+
+	for _, key := range sortedKeys(counters) {
+		merged.Counters = append(merged.Counters, counters[key])
+	}
+	for _, key := range sortedKeys(gauges) {
+		merged.Gauges = append(merged.Gauges, gauges[key])
+	}
+	for _, key := range sortedKeys(histograms) {
+		h := histograms[key]
+		merged.Histograms = append(merged.Histograms, &api.Histogram{
+			Key:     key,
+			Count:   h.Count,
+			P50:     h.Quantile(0.5),
+			P99:     h.Quantile(0.99),
+			Buckets: h.Counts,
+		})
+	}
+	return merged
+}
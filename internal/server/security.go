@@ -0,0 +1,159 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/petuhovskiy/overload/errs"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Security configures authentication of the gRPC services. Token is a shared secret sent by clients
+// as a bearer token. CertFile and KeyFile enable TLS with this certificate, CAFile verifies the peer:
+// client certificates on the server (mTLS), the server certificate on the client.
+type Security struct {
+	Token    string
+	CertFile string
+	KeyFile  string
+	CAFile   string
+}
+
+// authenticated returns true if clients have to prove their identity with a token or a certificate.
+func (s Security) authenticated() bool {
+	return s.Token != "" || (s.CertFile != "" && s.CAFile != "")
+}
+
+// ServerOptions returns options of a server listening on addr. Without a token or mTLS the server
+// executes requests of anyone who can reach it, so only loopback addresses are allowed.
+func (s Security) ServerOptions(addr string) ([]grpc.ServerOption, error) {
+	if !s.authenticated() && !isLoopback(addr) {
+		return nil, errs.Validationf("refusing to listen on %s without a token or mTLS, set API_TOKEN or API_TLS_CERT, API_TLS_KEY and API_TLS_CA", addr)
+	}
+
+	var opts []grpc.ServerOption
+	if s.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(s.CertFile, s.KeyFile)
+		if err != nil {
+			return nil, errs.Validation(err)
+		}
+		conf := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+		if s.CAFile != "" {
+			pool, err := loadCertPool(s.CAFile)
+			if err != nil {
+				return nil, err
+			}
+			conf.ClientCAs = pool
+			conf.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(conf)))
+	}
+	if s.Token != "" {
+		opts = append(opts,
+			grpc.ChainUnaryInterceptor(func(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+				if err := s.checkToken(ctx); err != nil {
+					return nil, err
+				}
+				return handler(ctx, req)
+			}),
+			grpc.ChainStreamInterceptor(func(srv any, stream grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+				if err := s.checkToken(stream.Context()); err != nil {
+					return err
+				}
+				return handler(srv, stream)
+			}),
+		)
+	}
+	return opts, nil
+}
+
+// checkToken verifies the bearer token of the request.
+func (s Security) checkToken(ctx context.Context) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, value := range md.Get("authorization") {
+		if subtle.ConstantTimeCompare([]byte(value), []byte("Bearer "+s.Token)) == 1 {
+			return nil
+		}
+	}
+	return status.Error(codes.Unauthenticated, "invalid or missing token")
+}
+
+// DialOptions returns options of a client of a server with the same security settings.
+func (s Security) DialOptions() ([]grpc.DialOption, error) {
+	var opts []grpc.DialOption
+	if s.CertFile != "" || s.CAFile != "" {
+		conf := &tls.Config{MinVersion: tls.VersionTLS12}
+		if s.CertFile != "" {
+			cert, err := tls.LoadX509KeyPair(s.CertFile, s.KeyFile)
+			if err != nil {
+				return nil, errs.Validation(err)
+			}
+			conf.Certificates = []tls.Certificate{cert}
+		}
+		if s.CAFile != "" {
+			pool, err := loadCertPool(s.CAFile)
+			if err != nil {
+				return nil, err
+			}
+			conf.RootCAs = pool
+		}
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(conf)))
+	} else {
+		opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	}
+	if s.Token != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(tokenCredentials(s.Token)))
+	}
+	return opts, nil
+}
+
+// tokenCredentials sends the token with every call. It's allowed without TLS, for servers
+// on trusted networks.
+type tokenCredentials string
+
+func (t tokenCredentials) GetRequestMetadata(context.Context, ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + string(t)}, nil
+}
+
+func (t tokenCredentials) RequireTransportSecurity() bool {
+	return false
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errs.Validation(err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errs.Validationf("no certificates in %s", path)
+	}
+	return pool, nil
+}
+
+// isLoopback returns true if addr listens only on the loopback interface.
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// String describes the settings for logs, without secrets.
+func (s Security) String() string {
+	return fmt.Sprintf("token=%t tls=%t mtls=%t", s.Token != "", s.CertFile != "", s.CertFile != "" && s.CAFile != "")
+}
@@ -0,0 +1,276 @@
+// Package server implements the gRPC API for remote control of workloads.
+package server
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/petuhovskiy/overload/api"
+	"github.com/petuhovskiy/overload/autoai"
+	"github.com/petuhovskiy/overload/internal/health"
+	"github.com/petuhovskiy/overload/internal/log"
+	"github.com/petuhovskiy/overload/internal/metrics"
+	"github.com/petuhovskiy/overload/internal/multi"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const defaultStatsInterval = time.Second
+
+type Config struct {
+	// Connstr is the database the workloads are executed against.
+	Connstr string
+	// Launcher are the default launcher settings, presets override only zero fields.
+	Launcher   autoai.LauncherConfig
+	Supervisor multi.SupervisorConfig
+	// AllowQueries enables runs of arbitrary SQL sent in the queries field, otherwise only presets can be started.
+	AllowQueries bool
+}
+
+type Server struct {
+	api.UnimplementedOverloadServer
+
+	pool    *pgxpool.Pool
+	history *autoai.DBHistory
+	conf    Config
+
+	mu     sync.Mutex
+	active map[int]*activeRun
+	// runs tracks goroutines of active runs, done is closed on shutdown
+	runs sync.WaitGroup
+	done chan struct{}
+}
+
+// activeRun is a run started by the server and not finished yet.
+type activeRun struct {
+	cancel context.CancelFunc
+	// metrics are the query metrics of this run only
+	metrics *metrics.Registry
+	// finished is closed when the run goroutine returns
+	finished chan struct{}
+}
+
+// New creates the server, pool is the history database.
+func New(pool *pgxpool.Pool, conf Config) *Server {
+	return &Server{
+		pool:    pool,
+		history: autoai.NewDBHistory(pool),
+		conf:    conf,
+		active:  map[int]*activeRun{},
+		done:    make(chan struct{}),
+	}
+}
+
+// Shutdown cancels active runs, ends stats streams and rejects new runs. It waits for the runs
+// to finish until ctx is done.
+func (s *Server) Shutdown(ctx context.Context) {
+	s.mu.Lock()
+	select {
+	case <-s.done:
+	default:
+		close(s.done)
+	}
+	for _, run := range s.active {
+		run.cancel()
+	}
+	s.mu.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		s.runs.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-ctx.Done():
+		log.Warn(ctx, "shutdown timed out before all runs finished")
+	}
+}
+
+func (s *Server) StartRun(_ context.Context, req *api.StartRunRequest) (*api.StartRunResponse, error) {
+	spec := workloadSpec{shards: 1, setup: true}
+	switch workload := req.Workload.(type) {
+	case *api.StartRunRequest_Preset:
+		spec.preset = workload.Preset
+	case *api.StartRunRequest_Queries:
+		if !s.conf.AllowQueries {
+			return nil, status.Error(codes.PermissionDenied, "runs of queries are disabled, start the server with -allow-queries")
+		}
+		spec.queries = workload.Queries
+	}
+
+	run, launcherConf, err := spec.build(s.conf.Connstr, s.conf.Launcher)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	metadata := spec.metadata()
+	metadata["mode"] = "grpc"
+
+	// every run has its own history, so that records are attached to the right run
+	history := autoai.NewDBHistory(s.pool)
+	runID, err := history.StartRun(req.Labels, metadata)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to start run: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ctx = log.With(ctx, zap.Int("run_id", runID))
+	active := &activeRun{cancel: cancel, metrics: metrics.NewRegistry(), finished: make(chan struct{})}
+	s.mu.Lock()
+	select {
+	case <-s.done:
+		s.mu.Unlock()
+		cancel()
+		return nil, status.Error(codes.Unavailable, "server is shutting down")
+	default:
+	}
+	s.active[runID] = active
+	s.runs.Add(1)
+	s.mu.Unlock()
+
+	health.Default.RunStarted()
+	go func() {
+		defer s.runs.Done()
+		defer health.Default.RunFinished()
+		defer func() {
+			s.mu.Lock()
+			delete(s.active, runID)
+			s.mu.Unlock()
+			cancel()
+			close(active.finished)
+		}()
+
+		autoai.DetectServerVersion(ctx, s.conf.Connstr, history)
+		launcher := autoai.NewLauncher(history, launcherConf)
+		launcher.SetMetrics(active.metrics)
+		supervisor := multi.NewSupervisor(s.conf.Supervisor)
+		err := run(ctx, launcher, supervisor)
+		if err != nil && ctx.Err() == nil {
+			log.Error(ctx, "run failed", zap.Error(err))
+		}
+		supervisor.LogSummary(ctx)
+		log.Info(ctx, "run finished")
+	}()
+
+	return &api.StartRunResponse{RunId: int64(runID)}, nil
+}
+
+func (s *Server) StopRun(_ context.Context, req *api.StopRunRequest) (*api.StopRunResponse, error) {
+	s.mu.Lock()
+	run, ok := s.active[int(req.RunId)]
+	s.mu.Unlock()
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "run %d is not active", req.RunId)
+	}
+
+	run.cancel()
+	return &api.StopRunResponse{}, nil
+}
+
+func (s *Server) StreamStats(req *api.StreamStatsRequest, stream api.Overload_StreamStatsServer) error {
+	interval := defaultStatsInterval
+	if req.Interval != nil && req.Interval.AsDuration() > 0 {
+		interval = req.Interval.AsDuration()
+	}
+
+	// without a run the stream ends only on shutdown
+	registry, finished := metrics.Default, make(chan struct{})
+	if req.RunId != 0 {
+		s.mu.Lock()
+		run, ok := s.active[int(req.RunId)]
+		s.mu.Unlock()
+		if !ok {
+			return status.Errorf(codes.NotFound, "run %d is not active", req.RunId)
+		}
+		registry, finished = run.metrics, run.finished
+	}
+
+	prev := registry.Snapshot()
+	prevTime := time.Now()
+	for {
+		last := false
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-s.done:
+			return status.Error(codes.Unavailable, "server is shutting down")
+		case <-finished:
+			// send the final stats of the run
+			last = true
+		case <-time.After(interval):
+		}
+
+		snapshot := registry.Snapshot()
+		now := time.Now()
+		if err := stream.Send(statsMessage(snapshot, prev, now.Sub(prevTime), now)); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+		prev, prevTime = snapshot, now
+	}
+}
+
+// statsMessage converts metrics snapshot to the API message, with counter rates since prev.
+func statsMessage(snapshot, prev metrics.Snapshot, elapsed time.Duration, now time.Time) *api.Stats {
+	msg := &api.Stats{Time: timestamppb.New(now)}
+	for _, key := range sortedKeys(snapshot.Counters) {
+		value := snapshot.Counters[key]
+		msg.Counters = append(msg.Counters, &api.Counter{
+			Key:   key,
+			Value: value,
+			Rate:  float64(value-prev.Counters[key]) / elapsed.Seconds(),
+		})
+	}
+	for _, key := range sortedKeys(snapshot.Gauges) {
+		msg.Gauges = append(msg.Gauges, &api.Gauge{Key: key, Value: snapshot.Gauges[key]})
+	}
+	for _, key := range sortedKeys(snapshot.Histograms) {
+		h := snapshot.Histograms[key]
+		msg.Histograms = append(msg.Histograms, &api.Histogram{
+			Key:     key,
+			Count:   h.Count,
+			P50:     h.Quantile(0.5),
+			P99:     h.Quantile(0.99),
+			Buckets: h.Counts,
+		})
+	}
+	return msg
+}
+
+func (s *Server) ListRuns(_ context.Context, req *api.ListRunsRequest) (*api.ListRunsResponse, error) {
+	runs, err := s.history.ListRuns(req.Labels)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list runs: %v", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	resp := &api.ListRunsResponse{}
+	for _, run := range runs {
+		_, active := s.active[run.ID]
+		resp.Runs = append(resp.Runs, &api.Run{
+			Id:        int64(run.ID),
+			StartedAt: timestamppb.New(run.StartedAt),
+			Labels:    run.Labels,
+			Active:    active,
+		})
+	}
+	return resp, nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"context"
+
+	"github.com/petuhovskiy/overload/autoai"
+	"github.com/petuhovskiy/overload/errs"
+	"github.com/petuhovskiy/overload/internal/multi"
+	"github.com/petuhovskiy/overload/presets"
+)
+
+// workloadFunc executes a workload with the given launcher.
+type workloadFunc func(ctx context.Context, launcher *autoai.Launcher, supervisor *multi.Supervisor) error
+
+// workloadSpec describes a workload received over the API, either a preset or a query script.
+// When the workload is distributed, every shard executes only a part of it.
+type workloadSpec struct {
+	preset  string
+	queries string
+	shard   int
+	shards  int
+	// setup makes the workload set up the preset schema, distributed workloads are set up
+	// by the coordinator before agents start
+	setup bool
+}
+
+// build returns the workload and the launcher settings for it.
+func (w *workloadSpec) build(connstr string, launcherConf autoai.LauncherConfig) (workloadFunc, autoai.LauncherConfig, error) {
+	switch {
+	case w.preset != "":
+		preset, err := presets.Get(w.preset)
+		if err != nil {
+			return nil, launcherConf, err
+		}
+		preset.Override(launcherConf)
+		// ingest workers are split between shards
+		if preset.IngestWorkers > 0 {
+			preset.IngestWorkers = max(1, (preset.IngestWorkers+w.shards-1)/w.shards)
+		}
+		return func(ctx context.Context, launcher *autoai.Launcher, supervisor *multi.Supervisor) error {
+			if w.setup {
+				if err := preset.SetupSchema(ctx, connstr); err != nil {
+					return err
+				}
+			}
+			return preset.Run(ctx, connstr, launcher, supervisor)
+		}, preset.Launcher, nil
+
+	case w.queries != "":
+		queries, err := autoai.ParseQueries(w.queries)
+		if err != nil {
+			return nil, launcherConf, err
+		}
+		if len(queries) == 0 {
+			return nil, launcherConf, errs.Validationf("no queries")
+		}
+		queries = shardQueries(queries, w.shard, w.shards)
+		return func(ctx context.Context, launcher *autoai.Launcher, _ *multi.Supervisor) error {
+			return launcher.RunSource(ctx, connstr, autoai.StaticSource(queries))
+		}, launcherConf, nil
+
+	default:
+		return nil, launcherConf, errs.Validationf("workload is required")
+	}
+}
+
+// setupSchema sets up the schema of the preset workload, it does nothing for query scripts.
+func (w *workloadSpec) setupSchema(ctx context.Context, connstr string) error {
+	if w.preset == "" {
+		return nil
+	}
+	preset, err := presets.Get(w.preset)
+	if err != nil {
+		return err
+	}
+	return preset.SetupSchema(ctx, connstr)
+}
+
+// metadata describes the workload for the run history.
+func (w *workloadSpec) metadata() map[string]any {
+	metadata := map[string]any{}
+	if w.preset != "" {
+		metadata["preset"] = w.preset
+	}
+	if w.shards > 1 {
+		metadata["shards"] = w.shards
+	}
+	return metadata
+}
+
+// shardQueries assigns queries to shards round-robin. If there are fewer queries than shards,
+// every shard executes all of them.
+func shardQueries(queries []autoai.Query, shard, shards int) []autoai.Query {
+	if shards <= 1 || len(queries) < shards {
+		return queries
+	}
+	var res []autoai.Query
+	for i := shard; i < len(queries); i += shards {
+		res = append(res, queries[i])
+	}
+	return res
+}
@@ -0,0 +1,283 @@
+// Package soak produces periodic digests for multi-day stability runs.
+package soak
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/petuhovskiy/overload/internal/bloat"
+	"github.com/petuhovskiy/overload/internal/dbconn"
+	"github.com/petuhovskiy/overload/internal/log"
+	"github.com/petuhovskiy/overload/internal/metrics"
+	"github.com/petuhovskiy/overload/internal/reconnect"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultDigestInterval = time.Hour
+	defaultDetailInterval = 10 * time.Second
+	defaultDir            = "soak"
+	defaultKeepFiles      = 48
+)
+
+type Config struct {
+	// DigestInterval is how often the digest is emitted.
+	DigestInterval time.Duration
+	// DetailInterval is how often full metrics snapshots are written to the detail file.
+	DetailInterval time.Duration
+	// Dir holds digests and detail files, a new detail file is started with every digest.
+	Dir string
+	// KeepFiles is the number of detail files kept, older ones are removed.
+	KeepFiles int
+	// Bloat selects the tables whose bloat is estimated for every digest, its Interval is ignored.
+	Bloat bloat.Config
+}
+
+func (conf *Config) Normalize() {
+	if conf.DigestInterval == 0 {
+		conf.DigestInterval = defaultDigestInterval
+	}
+
+	if conf.DetailInterval == 0 {
+		conf.DetailInterval = defaultDetailInterval
+	}
+
+	if conf.Dir == "" {
+		conf.Dir = defaultDir
+	}
+
+	if conf.KeepFiles == 0 {
+		conf.KeepFiles = defaultKeepFiles
+	}
+}
+
+// Digest summarizes a single period of the soak run.
+type Digest struct {
+	Start, End time.Time
+
+	QPS       float64
+	ErrorRate float64
+	IngestRPS float64 `json:",omitempty"`
+	// QPSTrend and ErrorRateTrend are relative changes since the previous digest.
+	QPSTrend       float64
+	ErrorRateTrend float64
+
+	DBSize   int64
+	DBGrowth int64
+	// BloatBytes and BloatRatio are the bloat of the largest tables and their indexes,
+	// estimated the same way as bloat_bytes, BloatRelation is the most bloated of them.
+	BloatBytes    int64
+	BloatRatio    float64
+	BloatRelation string  `json:",omitempty"`
+	RelationBloat float64 `json:",omitempty"`
+	Autovacuums   int64
+	Autoanalyze   int64
+}
+
+// dbStats is a snapshot of database-level counters and bloat estimates.
+type dbStats struct {
+	size        int64
+	autovacuum  int64
+	autoanalyze int64
+	bloat       []bloat.Estimate
+}
+
+func getDBStats(ctx context.Context, conn *pgx.Conn, conf bloat.Config) (dbStats, error) {
+	var s dbStats
+	err := conn.QueryRow(ctx, `
+		SELECT pg_database_size(current_database()),
+			COALESCE(sum(autovacuum_count), 0)::bigint,
+			COALESCE(sum(autoanalyze_count), 0)::bigint
+		FROM pg_stat_user_tables`).
+		Scan(&s.size, &s.autovacuum, &s.autoanalyze)
+	if err != nil {
+		return s, err
+	}
+
+	s.bloat, err = bloat.Sample(ctx, conn, conf)
+	if err != nil {
+		return s, fmt.Errorf("failed to estimate bloat: %w", err)
+	}
+	return s, nil
+}
+
+// Run emits digests every DigestInterval and writes detailed metrics to rotated files,
+// until the context is done.
+func Run(ctx context.Context, connstr string, conf Config) {
+	conf.Normalize()
+	ctx = log.With(ctx, zap.String("job", "soak"))
+
+	if err := os.MkdirAll(conf.Dir, 0o755); err != nil {
+		log.Error(ctx, "failed to create soak directory", zap.Error(err))
+		return
+	}
+
+	// the connection is idle between digests for hours, it's reopened if it was dropped
+	var conn *pgx.Conn
+	defer func() {
+		if conn != nil {
+			conn.Close(context.Background())
+		}
+	}()
+	sample := func() (dbStats, error) {
+		if conn == nil || conn.IsClosed() {
+			var err error
+			conn, err = reconnect.Connect(ctx, reconnect.Config{}, "soak", func(ctx context.Context) (*pgx.Conn, error) {
+				return dbconn.Connect(ctx, connstr)
+			})
+			if err != nil {
+				return dbStats{}, err
+			}
+		}
+		return getDBStats(ctx, conn, conf.Bloat)
+	}
+
+	prevMetrics := metrics.Default.Snapshot()
+	prevDB, err := sample()
+	if err != nil {
+		log.Error(ctx, "failed to get database stats", zap.Error(err))
+	}
+	var prevDigest *Digest
+	periodStart := time.Now()
+
+	detail, err := openDetailFile(conf, periodStart)
+	if err != nil {
+		log.Error(ctx, "failed to open detail file", zap.Error(err))
+		return
+	}
+	defer func() { detail.Close() }()
+
+	digestTimer := time.NewTimer(conf.DigestInterval)
+	defer digestTimer.Stop()
+	detailTicker := time.NewTicker(conf.DetailInterval)
+	defer detailTicker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case now := <-detailTicker.C:
+			writeDetail(ctx, detail, now)
+
+		case now := <-digestTimer.C:
+			digestTimer.Reset(conf.DigestInterval)
+
+			snapshot := metrics.Default.Snapshot()
+			db, err := sample()
+			if err != nil {
+				log.Error(ctx, "failed to get database stats", zap.Error(err))
+			}
+
+			digest := makeDigest(periodStart, now, prevMetrics, snapshot, prevDB, db, prevDigest)
+			log.Info(ctx, "soak digest", zap.Any("digest", digest))
+			if err := appendDigest(conf, digest); err != nil {
+				log.Error(ctx, "failed to save digest", zap.Error(err))
+			}
+
+			detail.Close()
+			detail, err = openDetailFile(conf, now)
+			if err != nil {
+				log.Error(ctx, "failed to rotate detail file", zap.Error(err))
+				return
+			}
+			removeOldDetails(ctx, conf)
+
+			prevMetrics, prevDB, prevDigest, periodStart = snapshot, db, &digest, now
+		}
+	}
+}
+
+func makeDigest(start, end time.Time, prevMetrics, metricsNow metrics.Snapshot, prevDB, db dbStats, prevDigest *Digest) Digest {
+	elapsed := end.Sub(start).Seconds()
+	executions := metricsNow.CounterSum("query_executions_total") - prevMetrics.CounterSum("query_executions_total")
+	errors := metricsNow.CounterSum("query_errors_total") - prevMetrics.CounterSum("query_errors_total")
+	ingested := metricsNow.CounterSum("ingest_rows_total") - prevMetrics.CounterSum("ingest_rows_total")
+
+	d := Digest{
+		Start:       start,
+		End:         end,
+		QPS:         float64(executions) / elapsed,
+		IngestRPS:   float64(ingested) / elapsed,
+		DBSize:      db.size,
+		DBGrowth:    db.size - prevDB.size,
+		Autovacuums: db.autovacuum - prevDB.autovacuum,
+		Autoanalyze: db.autoanalyze - prevDB.autoanalyze,
+	}
+	if executions > 0 {
+		d.ErrorRate = float64(errors) / float64(executions)
+	}
+	var size int64
+	for i := range db.bloat {
+		e := &db.bloat[i]
+		size += e.Size
+		d.BloatBytes += e.Bloat
+		if e.Ratio() > d.RelationBloat {
+			d.BloatRelation, d.RelationBloat = e.Relation, e.Ratio()
+		}
+	}
+	if size > 0 {
+		d.BloatRatio = float64(d.BloatBytes) / float64(size)
+	}
+	if prevDigest != nil {
+		d.QPSTrend = relativeChange(prevDigest.QPS, d.QPS)
+		d.ErrorRateTrend = relativeChange(prevDigest.ErrorRate, d.ErrorRate)
+	}
+	return d
+}
+
+func relativeChange(before, after float64) float64 {
+	if before == 0 {
+		return 0
+	}
+	return (after - before) / before
+}
+
+func appendDigest(conf Config, digest Digest) error {
+	f, err := os.OpenFile(filepath.Join(conf.Dir, "digest.jsonl"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewEncoder(f).Encode(digest)
+}
+
+const detailPrefix = "metrics-"
+
+func openDetailFile(conf Config, start time.Time) (*os.File, error) {
+	name := fmt.Sprintf("%s%s.jsonl", detailPrefix, start.UTC().Format("20060102T150405"))
+	return os.Create(filepath.Join(conf.Dir, name))
+}
+
+// writeDetail appends the full metrics snapshot to the detail file.
+func writeDetail(ctx context.Context, f *os.File, now time.Time) {
+	snapshot := metrics.Default.Snapshot()
+	err := json.NewEncoder(f).Encode(struct {
+		Time time.Time
+		metrics.Snapshot
+	}{now, snapshot})
+	if err != nil {
+		log.Error(ctx, "failed to write metrics detail", zap.Error(err))
+	}
+}
+
+// removeOldDetails keeps only the newest KeepFiles detail files.
+func removeOldDetails(ctx context.Context, conf Config) {
+	files, err := filepath.Glob(filepath.Join(conf.Dir, detailPrefix+"*.jsonl"))
+	if err != nil || len(files) <= conf.KeepFiles {
+		return
+	}
+	// names contain sortable timestamps
+	sort.Strings(files)
+	for _, f := range files[:len(files)-conf.KeepFiles] {
+		if err := os.Remove(f); err != nil {
+			log.Warn(ctx, "failed to remove old detail file", zap.String("file", f), zap.Error(err))
+		}
+	}
+}
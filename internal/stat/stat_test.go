@@ -0,0 +1,57 @@
+package stat
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMedian(t *testing.T) {
+	require.Zero(t, Median(nil))
+	require.Equal(t, 2.0, Median([]float64{3, 1, 2}))
+	require.Equal(t, 2.5, Median([]float64{4, 1, 3, 2}))
+
+	values := []float64{3, 1, 2}
+	Median(values)
+	require.Equal(t, []float64{3, 1, 2}, values, "input is not modified")
+}
+
+func TestMannWhitney(t *testing.T) {
+	// reference p-values match scipy.stats.mannwhitneyu(a, b, method="asymptotic")
+	tests := []struct {
+		name string
+		a, b []float64
+		want float64
+	}{
+		{
+			name: "same samples",
+			a:    []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10},
+			b:    []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10},
+			want: 1,
+		},
+		{
+			name: "shifted",
+			a:    []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10},
+			b:    []float64{11, 12, 13, 14, 15, 16, 17, 18, 19, 20},
+			want: 0.00018267,
+		},
+		{
+			name: "overlapping with ties",
+			a:    []float64{1, 2, 2, 3, 4, 5, 5, 6, 7, 8},
+			b:    []float64{4, 5, 5, 6, 7, 8, 8, 9, 10, 11},
+			want: 0.018305,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.InDelta(t, tt.want, MannWhitney(tt.a, tt.b), 1e-4)
+			require.InDelta(t, tt.want, MannWhitney(tt.b, tt.a), 1e-4, "symmetric")
+		})
+	}
+}
+
+func TestMannWhitneyDegenerate(t *testing.T) {
+	require.Equal(t, 1.0, MannWhitney(nil, []float64{1, 2}))
+	require.Equal(t, 1.0, MannWhitney([]float64{1}, nil))
+	require.Equal(t, 1.0, MannWhitney([]float64{5, 5, 5}, []float64{5, 5}), "all values tied")
+}
@@ -1,58 +1,602 @@
 package main
 
 import (
+	"cmp"
 	"context"
+	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/petuhovskiy/overload/autoai"
+	"github.com/petuhovskiy/overload/ingest"
+	"github.com/petuhovskiy/overload/internal/alert"
+	"github.com/petuhovskiy/overload/internal/backfill"
+	"github.com/petuhovskiy/overload/internal/bloat"
+	"github.com/petuhovskiy/overload/internal/capture"
+	"github.com/petuhovskiy/overload/internal/clientstats"
+	"github.com/petuhovskiy/overload/internal/dbconn"
+	"github.com/petuhovskiy/overload/internal/fixture"
+	"github.com/petuhovskiy/overload/internal/health"
 	"github.com/petuhovskiy/overload/internal/log"
+	"github.com/petuhovskiy/overload/internal/metrics"
+	"github.com/petuhovskiy/overload/internal/multi"
+	"github.com/petuhovskiy/overload/internal/neon"
+	"github.com/petuhovskiy/overload/internal/noise"
+	"github.com/petuhovskiy/overload/internal/pgbenchlog"
+	"github.com/petuhovskiy/overload/internal/soak"
+	"github.com/petuhovskiy/overload/presets"
+	"github.com/petuhovskiy/overload/workload"
 	"github.com/sashabaranov/go-openai"
+	"go.uber.org/zap"
 )
 
 func main() {
 	_ = log.DefaultGlobals()
 
+	// without a command the autoai loop, a preset, a query file or a workload is run
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		switch args[0] {
+		case "autoai":
+			args = args[1:]
+		case "ingest":
+			runIngest(os.Args[2:])
+			return
+		case "stats":
+			runStats(os.Args[2:])
+			return
+		case "run":
+			runWorkloads(os.Args[2:])
+			return
+		case "help":
+			printUsage()
+			return
+		case "analyze":
+			runAnalyze(os.Args[2:])
+			return
+		case "heatmap":
+			runHeatmap(os.Args[2:])
+			return
+		case "runs":
+			runRuns(os.Args[2:])
+			return
+		case "history":
+			runHistory(os.Args[2:])
+			return
+		case "replay":
+			runReplay(os.Args[2:])
+			return
+		case "bench":
+			runBench(os.Args[2:])
+			return
+		case "commit":
+			runCommit(os.Args[2:])
+			return
+		case "fill":
+			runFill(os.Args[2:])
+			return
+		case "cache":
+			runCache(os.Args[2:])
+			return
+		case "capacity":
+			runCapacity(os.Args[2:])
+			return
+		case "cleanup":
+			runCleanup(os.Args[2:])
+			return
+		case "plan":
+			runPlan(os.Args[2:])
+			return
+		case "serve":
+			runServe(os.Args[2:])
+			return
+		case "coordinate":
+			runCoordinate(os.Args[2:])
+			return
+		case "agent":
+			runAgent(os.Args[2:])
+			return
+		case "workingset":
+			runWorkingSet(os.Args[2:])
+			return
+		default:
+			fmt.Println("Error: unknown command", os.Args[1])
+			printUsage()
+			os.Exit(1)
+		}
+	}
+
+	labels := labelsFlag{}
+	flag.Var(labels, "label", "attach label to the run, in key=value format (repeatable)")
+	queriesFile := flag.String("queries", "", "run queries from the .sql file instead of generating them")
+	captureFile := flag.String("capture", "", "record all executed statements to a gzip-compressed file for replay")
+	auditLog := flag.Bool("audit", false, "record every execution with its timing and SQLSTATE into query_exec_log in the history database")
+	pgbenchLogFile := flag.String("pgbench-log", "", "log every execution to the file in the pgbench --log format")
+	presetName := flag.String("preset", "", "run a built-in workload preset, \"list\" to show available presets")
+	workloadName := flag.String("workload", "", "run a registered custom workload, \"list\" to show available workloads")
+	resultsFile := flag.String("results", "", "write the machine-readable summary of the run to the file at exit, e.g. results.json")
+	tuneFile := flag.String("tune", "", "apply ARRIVAL_RATE, THINK_TIME and MAX_CONNS from the file whenever it changes")
+	flag.Usage = printUsage
+	_ = flag.CommandLine.Parse(args)
+
+	var preset *presets.Preset
+	if *presetName == "list" {
+		printPresets()
+		return
+	}
+	if *presetName != "" {
+		var err error
+		preset, err = presets.Get(*presetName)
+		if err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+	}
+
+	var custom workload.Workload
+	if *workloadName == "list" {
+		printWorkloads()
+		return
+	}
+	if *workloadName != "" {
+		var err error
+		custom, err = workload.Get(*workloadName)
+		if err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+	}
+
 	connstr := os.Getenv("CONNSTR")
 	if connstr == "" {
 		fmt.Println("Error: DB_CONN_STR environment variable not set")
 		os.Exit(1)
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
+	// interrupt cancels the workload, so that the capture is flushed before exit
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
+	startProxy(ctx, connstr)
+	setupTarget(connstr)
+
+	pool := connectHistory()
+	defer pool.Close()
+	startHealth(ctx, connstr, pool)
+	startMetrics(ctx)
+	dbHistory := autoai.NewDBHistory(pool)
+	artifact := autoai.NewArtifact()
+	dbHistory.SetArtifact(artifact)
+
+	// the history schema may be managed separately, e.g. the role can't run DDL
+	if err := dbHistory.Migrate(); err != nil {
+		log.Warn(ctx, "failed to migrate history schema, using it as is", zap.Error(err))
+	}
+
+	metadata := runMetadata(*queriesFile, *presetName)
+	if custom != nil {
+		metadata["mode"] = "workload"
+		metadata["workload"] = *workloadName
+	}
+	runID, err := dbHistory.StartRun(labels, metadata)
+	if err != nil {
+		fmt.Println("Error: failed to start run:", err)
+		os.Exit(1)
+	}
+	ctx = log.With(ctx, zap.Int("run_id", runID))
+	// sessions of the run are told from other sessions of the database by application_name
+	dbconn.SetAppName(fmt.Sprintf("overload run %d", runID))
+	autoai.DetectServerVersion(ctx, connstr, dbHistory)
+	objects := autoai.TrackObjects(ctx, connstr, dbHistory)
+	headroom := autoai.TrackHeadroom(ctx, connstr, autoai.HeadroomConfig{
+		P99:      cmp.Or(envDuration("HEADROOM_P99"), envDuration("LATENCY_SLO")),
+		Interval: envDuration("HEADROOM_SAMPLE_INTERVAL"),
+	}, artifact)
+
+	launcherConf := launcherConfig()
+	if preset != nil {
+		// settings from the environment take precedence over the preset
+		preset.Override(launcherConf)
+		launcherConf = preset.Launcher
+		if workers := envInt("INGEST_WORKERS"); workers > 0 {
+			preset.IngestWorkers = workers
+		}
+		if batches := envInt("INGEST_BATCHES_PER_COMMIT"); batches > 0 {
+			preset.Ingest.BatchesPerCommit = batches
+		}
+		if os.Getenv("INGEST_RETRY_BATCHES") == "1" {
+			preset.Ingest.RetryBatches = true
+		}
+		if c := envCompressibility("INGEST_COMPRESSIBILITY"); c != nil {
+			preset.Ingest.Compressibility = c
+		}
+		preset.SetVars(envVars("PRESET_VARS"))
+	}
+	launcher := autoai.NewLauncher(dbHistory, launcherConf)
+	artifact.Config = map[string]any{
+		"launcher": launcherConf,
+		"preset":   preset,
+	}
+	saveWorkloadFingerprint(ctx, dbHistory, preset, *queriesFile, artifact.Config)
+	writeResults := func() {
+		if *resultsFile == "" {
+			return
+		}
+		if err := artifact.Write(*resultsFile); err != nil {
+			fmt.Println("Error: failed to write results:", err)
+		}
+	}
+
+	if *tuneFile != "" {
+		go watchTuning(ctx, *tuneFile, launcher)
+	}
+
+	var recorder *capture.Recorder
+	if *captureFile != "" {
+		recorder, err = capture.NewRecorder(*captureFile)
+		if err != nil {
+			fmt.Println("Error: failed to create capture:", err)
+			os.Exit(1)
+		}
+		launcher.SetRecorder(recorder)
+	}
+	var pgbenchLog *pgbenchlog.Writer
+	if *pgbenchLogFile != "" {
+		pgbenchLog, err = pgbenchlog.New(*pgbenchLogFile)
+		if err != nil {
+			fmt.Println("Error: failed to create pgbench log:", err)
+			os.Exit(1)
+		}
+		launcher.SetPgbenchLog(pgbenchLog)
+	}
+	closeCapture := func() {
+		if err := recorder.Close(); err != nil {
+			fmt.Println("Error: failed to close capture:", err)
+		}
+		if err := pgbenchLog.Close(); err != nil {
+			fmt.Println("Error: failed to close pgbench log:", err)
+		}
+	}
+
+	var audit *autoai.AuditLog
+	// the audit log outlives the workload context, to write executions recorded before the interrupt
+	auditCtx, stopAudit := context.WithCancel(context.Background())
+	if *auditLog {
+		audit = dbHistory.NewAuditLog()
+		launcher.SetAuditLog(audit)
+		go audit.Run(auditCtx)
+	}
+	closeAudit := func() {
+		stopAudit()
+		audit.Wait()
+	}
+
+	// soak runs are too long for full-resolution logging, metrics go to rotated files instead
+	soakMode := os.Getenv("SOAK") == "1"
+	if soakMode {
+		go soak.Run(ctx, connstr, soak.Config{
+			DigestInterval: envDuration("SOAK_DIGEST_INTERVAL"),
+			Dir:            os.Getenv("SOAK_DIR"),
+			Bloat:          bloatConfig(),
+		})
+	} else {
+		go metrics.Default.RunFlush(ctx, 10*time.Second)
+	}
+	go neon.Run(ctx, connstr, 10*time.Second)
+	go clientstats.Default.Run(ctx, time.Second)
+	if conf := bloatConfig(); conf.Enabled() {
+		go bloat.Run(ctx, connstr, conf)
+	}
+	go noise.Run(ctx, connstr, noiseConfig())
+	if conf := backfillConfig(); conf.Table != "" {
+		go runBackfill(ctx, connstr, conf, dbHistory)
+	}
+
+	supervisor := multi.NewSupervisor(supervisorConfig())
+
+	if preset != nil && preset.IngestWorkers > 0 {
+		go ingest.ReportUploadSpeed(ctx, connstr, alert.New(alertConfig(), dbHistory.SaveAlert), diskConfig())
+	}
+
+	if preset != nil {
+		if err := preset.SetupSchema(ctx, connstr); err != nil {
+			fmt.Println("Error: failed to set up preset:", err)
+			os.Exit(1)
+		}
+	}
+
+	// the dataset is seeded before the snapshot of tables and before anything is measured
+	if conf := warmupConfig(); conf.Enabled() {
+		if err := ingest.Warmup(ctx, connstr, conf); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			fmt.Println("Error: warm-up failed:", err)
+			os.Exit(1)
+		}
+	}
+
+	resetTables := tableReset(ctx, connstr)
+
+	// preset and query file workloads run once, or in a loop in soak mode
+	var jobName string
+	var iteration func(ctx context.Context) error
+	switch {
+	case preset != nil:
+		jobName = "preset"
+		iteration = func(ctx context.Context) error {
+			return preset.Run(ctx, connstr, launcher, supervisor)
+		}
+	case custom != nil:
+		jobName = "workload"
+		iteration = func(ctx context.Context) error {
+			return workload.Run(ctx, *workloadName, custom, connstr, launcher, dbHistory)
+		}
+	case *queriesFile != "":
+		source := &autoai.FileSource{Path: *queriesFile}
+		jobName = "queries"
+		iteration = func(ctx context.Context) error {
+			return launcher.RunSource(ctx, connstr, source)
+		}
+	}
+
+	health.Default.RunStarted()
+	defer health.Default.RunFinished()
+
+	if iteration != nil {
+		err = supervisor.Run(ctx, jobName, func(ctx context.Context) error {
+			for {
+				if err := resetTables(ctx); err != nil {
+					return fmt.Errorf("failed to reset tables: %w", err)
+				}
+				if err := iteration(ctx); err != nil || !soakMode || ctx.Err() != nil {
+					return err
+				}
+			}
+		})
+		supervisor.LogSummary(ctx)
+		clientstats.Default.LogSummary(ctx)
+		artifact.LogClasses(ctx)
+		closeCapture()
+		closeAudit()
+		objects.Stop()
+		headroom.Stop(ctx)
+		writeResults()
+		if err != nil && ctx.Err() == nil {
+			fmt.Printf("Error: %s failed: %v\n", jobName, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	provider, err := modelProvider()
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+
+	gen := autoai.NewGenerator(provider, dbHistory, launcher)
+	if err := setupGenerator(gen, connstr); err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+
+	err = supervisor.Run(ctx, "autoai", func(ctx context.Context) error {
+		for {
+			if err := resetTables(ctx); err != nil {
+				return fmt.Errorf("failed to reset tables: %w", err)
+			}
+			if err := gen.DoIteration(ctx, connstr); err != nil {
+				return err
+			}
+		}
+	})
+	supervisor.LogSummary(ctx)
+	clientstats.Default.LogSummary(ctx)
+	closeCapture()
+	closeAudit()
+	objects.Stop()
+	headroom.Stop(ctx)
+	writeResults()
+	if err != nil && ctx.Err() == nil {
+		fmt.Println("Error: autoai failed:", err)
+		os.Exit(1)
+	}
+}
+
+// modelProvider returns the OpenAI client, or fixtures configured by LLM_FIXTURES: responses are
+// replayed from the directory, or recorded to it with LLM_FIXTURES_MODE=record.
+func modelProvider() (autoai.Provider, error) {
+	client := openai.NewClient(os.Getenv("OPENAI_TOKEN"))
+	dir := os.Getenv("LLM_FIXTURES")
+	if dir == "" {
+		return client, nil
+	}
+	switch mode := os.Getenv("LLM_FIXTURES_MODE"); mode {
+	case "", "replay":
+		return fixture.NewReplayer(dir)
+	case "record":
+		return fixture.NewRecorder(client, dir)
+	default:
+		return nil, fmt.Errorf("unknown LLM_FIXTURES_MODE %q", mode)
+	}
+}
+
+// setupGenerator configures the autoai generator from environment variables.
+func setupGenerator(gen *autoai.Generator, connstr string) error {
+	if err := gen.SetFocus(os.Getenv("GENERATE_FOCUS")); err != nil {
+		return err
+	}
+	if err := gen.SetIndexAdvice(indexAdviceConfig()); err != nil {
+		return err
+	}
+	gen.SetQuarantineThreshold(envInt("QUARANTINE_AFTER"))
+	gen.SetPatternHistory(envInt("PROMPT_HISTORY"))
+	gen.SetValidation(autoai.ValidationConfig{
+		Timeout: envDuration("VALIDATE_TIMEOUT"),
+		Retries: envInt("VALIDATE_RETRIES"),
+	})
+	targets, err := autoai.ParseTargets(envList("AUTOAI_TARGETS"), connstr)
+	if err != nil {
+		return err
+	}
+	gen.SetTargets(targets)
+	if os.Getenv("ANONYMIZE") == "1" {
+		mapFile := os.Getenv("ANONYMIZE_MAP")
+		if mapFile == "" {
+			mapFile = "anonymize-map.json"
+		}
+		anonymizer, err := autoai.LoadAnonymizer(mapFile)
+		if err != nil {
+			return err
+		}
+		gen.SetAnonymizer(anonymizer)
+	}
+	return nil
+}
+
+// connectHistory connects to the database with history, configured by LOGS_CONNSTR.
+func connectHistory() *pgxpool.Pool {
 	logsConnstr := os.Getenv("LOGS_CONNSTR")
 	pool, err := pgxpool.New(context.Background(), logsConnstr)
 	if err != nil {
 		fmt.Println("Error: failed to connect to database:", err)
 		os.Exit(1)
 	}
-	defer pool.Close()
-	dbHistory := autoai.NewDBHistory(pool)
+	return pool
+}
+
+// runMetadata describes the environment of the run.
+func runMetadata(queriesFile, preset string) map[string]any {
+	hostname, _ := os.Hostname()
+	metadata := map[string]any{
+		"hostname": hostname,
+		"args":     os.Args,
+		"mode":     "autoai",
+	}
+	if queriesFile != "" {
+		metadata["mode"] = "file"
+		metadata["queries"] = queriesFile
+	}
+	if preset != "" {
+		metadata["mode"] = "preset"
+		metadata["preset"] = preset
+	}
+	return metadata
+}
 
-	openaiToken := os.Getenv("OPENAI_TOKEN")
-	openaiClient := openai.NewClient(openaiToken)
+// saveWorkloadFingerprint records the fingerprint of a preset or query file workload, so that
+// later runs of the same workload can be compared with this one. Generated workloads differ
+// on every run and have no fingerprint.
+func saveWorkloadFingerprint(ctx context.Context, dbHistory *autoai.DBHistory, preset *presets.Preset, queriesFile string, config any) {
+	var queries []autoai.Query
+	var err error
+	switch {
+	case preset != nil:
+		queries, err = preset.QueryMix()
+	case queriesFile != "":
+		queries, err = (&autoai.FileSource{Path: queriesFile}).Queries(ctx, nil)
+	default:
+		return
+	}
+	if err != nil {
+		log.Warn(ctx, "failed to load queries for workload fingerprint", zap.Error(err))
+		return
+	}
 
-	gen := autoai.NewGenerator(openaiClient, dbHistory)
+	fingerprint, err := autoai.WorkloadFingerprint(queries, config)
+	if err != nil {
+		log.Warn(ctx, "failed to compute workload fingerprint", zap.Error(err))
+		return
+	}
+	log.Info(ctx, "workload fingerprint", zap.String("fingerprint", fingerprint))
+	if err := dbHistory.SaveWorkloadFingerprint(fingerprint); err != nil {
+		log.Warn(ctx, "failed to save workload fingerprint", zap.Error(err))
+	}
+}
 
-	for {
-		gen.DoIteration(ctx, connstr)
+// runBackfill runs the online backfill next to the workload and records its impact.
+func runBackfill(ctx context.Context, connstr string, conf backfill.Config, dbHistory *autoai.DBHistory) {
+	res, err := backfill.Run(ctx, connstr, conf)
+	if ctx.Err() != nil && res.Batches == 0 {
+		return
+	}
+	comment := "backfill: ok"
+	if err != nil {
+		log.Error(ctx, "backfill failed", zap.Error(err))
+		comment = fmt.Sprintf("backfill: error: %s", err)
 	}
+	log.Info(ctx, "backfill finished", zap.Any("result", res))
+	info := &autoai.QueryExecInfo{
+		Query:    res.SQL,
+		IsFailed: err != nil,
+		Conns:    1,
+		Comment:  comment,
+		Info:     res,
+	}
+	if err := dbHistory.SaveQueryExecInfo(info); err != nil {
+		log.Warn(ctx, "failed to save backfill result", zap.Error(err))
+	}
+}
+
+// printUsage lists commands and the flags of the default mode.
+func printUsage() {
+	fmt.Fprint(flag.CommandLine.Output(), `Usage: overload [command] [flags]
+
+Without a command, the autoai loop (or -preset, -queries, -workload) is run, same as "autoai".
+
+Workloads:
+  autoai       generate queries with the model and run them in a loop
+  run          run workloads defined in a config file
+  ingest       ingest rows with copy, generate or values until interrupted
+  fill         insert an exact number of rows
+  replay       replay a capture
+  plan         run a plan of several workloads
 
-	// // Start the reporter in a separate goroutine
-	// go ingest.ReportUploadSpeed(ctx, connstr)
+Experiments:
+  bench        ingest-methods, ingest-overhead, ingest-widths, blobs, prepared, gin, rls, queue
+  capacity     find the max number of connections within the latency ceiling
+  cache        compare cold and warm cache latency
+  commit       compare synchronous_commit levels
+  workingset   measure read throughput by the hot working set size
 
-	// // Configure and run the ingest operation
-	// conf := ingest.Config{
-	// 	TableName: "data42",
-	// }
+Results:
+  stats        report database growth, replication lag and the disk-full forecast
+  runs         list runs of a workload
+  history      leaderboard, grafana-export, search
+  analyze      compare runs of a workload
+  heatmap      latency heatmap of a run
+  cleanup      drop objects created by a run
 
-	// multi.RunMany(ctx, 10, func(ctx context.Context) error {
-	// 	return ingest.RunCopy(ctx, connstr, conf)
-	// })
+Services:
+  serve        gRPC API
+  coordinate   distributed mode coordinator
+  agent        distributed mode agent
 
-	// // Allow some time for the reporter to show the final results
-	// time.Sleep(5 * time.Second)
+Flags of autoai:
+`)
+	flag.PrintDefaults()
+}
+
+func printWorkloads() {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, w := range workload.List() {
+		fmt.Fprintf(tw, "%s\t%s\n", w.Name, w.Description)
+	}
+	tw.Flush()
+}
+
+// printPresets prints names and descriptions of all built-in presets.
+func printPresets() {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, p := range presets.List() {
+		fmt.Fprintf(tw, "%s\t%s\n", p.Name, p.Description)
+	}
+	tw.Flush()
 }
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/petuhovskiy/overload/autoai"
+	"github.com/petuhovskiy/overload/internal/clientstats"
+	"github.com/petuhovskiy/overload/internal/metrics"
+	"github.com/petuhovskiy/overload/internal/plan"
+)
+
+// runPlan executes all steps of the plan file and prints the combined report.
+func runPlan(args []string) {
+	fs := flag.NewFlagSet("plan", flag.ExitOnError)
+	file := fs.String("file", "plan.json", "plan file to execute")
+	out := fs.String("out", "plan-results.json", "write the combined report of all steps to the file, empty to disable")
+	_ = fs.Parse(args)
+
+	p, err := plan.Load(*file)
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+
+	connstr := os.Getenv("CONNSTR")
+	if connstr == "" {
+		fmt.Println("Error: CONNSTR environment variable not set")
+		os.Exit(1)
+	}
+	setupTarget(connstr)
+
+	pool := connectHistory()
+	defer pool.Close()
+	if err := autoai.NewDBHistory(pool).Migrate(); err != nil {
+		fmt.Println("Error: failed to migrate history schema:", err)
+		os.Exit(1)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	startHealth(ctx, connstr, pool)
+	startMetrics(ctx)
+	go metrics.Default.RunFlush(ctx, 10*time.Second)
+	go clientstats.Default.Run(ctx, time.Second)
+
+	report := plan.Run(ctx, p, plan.Config{
+		Connstr:    connstr,
+		Launcher:   launcherConfig(),
+		Supervisor: supervisorConfig(),
+		History:    pool,
+	})
+
+	if *out != "" {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err == nil {
+			err = os.WriteFile(*out, data, 0o644)
+		}
+		if err != nil {
+			fmt.Println("Error: failed to write report:", err)
+		}
+	}
+	_ = plan.PrintReport(os.Stdout, report)
+	clientstats.Default.LogSummary(ctx)
+
+	for _, res := range report.Steps {
+		if res.Status != plan.StatusOK || res.SLAFailed() {
+			os.Exit(1)
+		}
+	}
+}
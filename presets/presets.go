@@ -0,0 +1,372 @@
+// Package presets contains named built-in workloads, combining schema setup,
+// ingest settings, query mixes and concurrency profiles.
+package presets
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/petuhovskiy/overload/autoai"
+	"github.com/petuhovskiy/overload/ingest"
+	"github.com/petuhovskiy/overload/internal/dbconn"
+	"github.com/petuhovskiy/overload/internal/log"
+	"github.com/petuhovskiy/overload/internal/multi"
+	"github.com/petuhovskiy/overload/internal/pgversion"
+	"go.uber.org/zap"
+)
+
+// chunksReportInterval is how often per-chunk counts of hypertables are logged.
+const chunksReportInterval = time.Minute
+
+//go:embed sql/*.sql
+var sqlFiles embed.FS
+
+type Preset struct {
+	Name        string
+	Description string
+
+	// Setup are names of SQL files creating and seeding the schema, executed in order,
+	// every file in a single implicit transaction.
+	Setup []string
+	// Queries are names of query files (see autoai.FileSource) executed together as a mix.
+	Queries []string
+	// Vars are substituted for {{name}} in all SQL files.
+	Vars map[string]int
+	// MinVersion is the min major Postgres version required by the queries, e.g. 15 for MERGE.
+	MinVersion int
+
+	// IngestWorkers is the number of concurrent ingest connections running in the background.
+	IngestWorkers int
+	IngestMethod  string
+	Ingest        ingest.Config
+
+	Launcher autoai.LauncherConfig
+}
+
+var presets = []Preset{
+	{
+		Name:        "oltp-small",
+		Description: "point reads and short read-write transactions on 100k accounts",
+		Setup:       []string{"accounts_schema.sql", "accounts_seed.sql"},
+		Queries:     []string{"oltp.sql"},
+		Vars:        map[string]int{"accounts": 100_000},
+	},
+	{
+		Name:        "oltp-large",
+		Description: "point reads and short read-write transactions on 10M accounts",
+		Setup:       []string{"accounts_schema.sql", "accounts_seed.sql"},
+		Queries:     []string{"oltp.sql"},
+		Vars:        map[string]int{"accounts": 10_000_000},
+	},
+	{
+		Name:          "ingest-heavy",
+		Description:   "COPY ingest on 8 connections",
+		IngestWorkers: 8,
+		IngestMethod:  "copy",
+		Ingest:        ingest.Config{TableName: "preset_ingest", BatchSize: 100_000},
+	},
+	{
+		Name:        "citus-router",
+		Description: "Citus distributed accounts, mostly single-shard queries routed by the shard key",
+		Setup:       []string{"accounts_schema.sql", "citus_accounts.sql", "accounts_seed.sql"},
+		Queries:     []string{"citus.sql"},
+		Vars:        map[string]int{"accounts": 1_000_000, "single_shard": 19, "cross_shard": 1},
+	},
+	{
+		Name:        "citus-fanout",
+		Description: "Citus distributed accounts, equal mix of single-shard and cross-shard queries",
+		Setup:       []string{"accounts_schema.sql", "citus_accounts.sql", "accounts_seed.sql"},
+		Queries:     []string{"citus.sql"},
+		Vars:        map[string]int{"accounts": 1_000_000, "single_shard": 1, "cross_shard": 1},
+	},
+	{
+		Name:        "sharded",
+		Description: "single-shard and cross-shard transactions on accounts hash-partitioned by the shard key into 16 partitions",
+		Setup:       []string{"sharded_setup.sql"},
+		Queries:     []string{"sharded.sql"},
+		Vars:        map[string]int{"accounts": 1_000_000, "shards": 16, "single_shard": 9, "cross_shard": 1},
+		MinVersion:  11,
+		// the scheduler keeps the ratio of executed transactions, not of connections
+		Launcher: autoai.LauncherConfig{MixWindow: 10 * time.Second},
+	},
+	{
+		Name:          "timescale-ingest",
+		Description:   "time-ordered COPY ingest into a TimescaleDB hypertable with hourly chunks",
+		IngestWorkers: 4,
+		IngestMethod:  "copy",
+		Ingest: ingest.Config{
+			TableName:     "preset_hypertable",
+			BatchSize:     100_000,
+			Hypertable:    true,
+			ChunkInterval: time.Hour,
+		},
+	},
+	{
+		Name:          "partitions",
+		Description:   "pruned single-partition lookups and cross-partition scans with background ingest into daily partitions",
+		Setup:         []string{"partitions_setup.sql"},
+		Queries:       []string{"partitions.sql"},
+		Vars:          map[string]int{"pruned": 4, "cross_partition": 1},
+		IngestWorkers: 2,
+		IngestMethod:  "copy",
+		Ingest: ingest.Config{
+			TableName:     "preset_partitioned",
+			BatchSize:     100_000,
+			Partitioned:   true,
+			ChunkInterval: 24 * time.Hour,
+		},
+		Launcher: autoai.LauncherConfig{StatementTimeout: autoai.LongStatementTimeout},
+	},
+	{
+		Name:        "analytics",
+		Description: "aggregations over 1M events on a few connections",
+		Setup:       []string{"events_setup.sql"},
+		Queries:     []string{"analytics.sql"},
+		Vars:        map[string]int{"events": 1_000_000},
+		Launcher:    autoai.LauncherConfig{StatementTimeout: autoai.LongStatementTimeout, MaxConns: 8},
+	},
+	{
+		Name:          "mixed",
+		Description:   "OLTP and analytical queries with background ingest",
+		Setup:         []string{"accounts_schema.sql", "accounts_seed.sql", "events_setup.sql"},
+		Queries:       []string{"oltp.sql", "analytics.sql"},
+		Vars:          map[string]int{"accounts": 1_000_000, "events": 1_000_000},
+		IngestWorkers: 2,
+		IngestMethod:  "values",
+		Ingest:        ingest.Config{TableName: "preset_ingest", BatchSize: 10_000},
+		Launcher:      autoai.LauncherConfig{StatementTimeout: autoai.LongStatementTimeout, MaxConns: 50},
+	},
+	{
+		Name:        "contention",
+		Description: "row lock contention on a few hot accounts",
+		Setup:       []string{"accounts_schema.sql", "accounts_seed.sql"},
+		Queries:     []string{"contention.sql"},
+		Vars:        map[string]int{"accounts": 100},
+	},
+	{
+		Name:        "upsert",
+		Description: "INSERT ... ON CONFLICT on existing and new keys, hot counters and batch upserts",
+		Setup:       []string{"accounts_schema.sql", "accounts_seed.sql", "upsert_setup.sql"},
+		Queries:     []string{"upsert.sql"},
+		Vars:        map[string]int{"accounts": 1_000_000, "upsert_keys": 1_100_000},
+	},
+	{
+		Name:        "merge",
+		Description: "the upsert workload with MERGE statements, including conditional deletes (Postgres 15+)",
+		Setup:       []string{"accounts_schema.sql", "accounts_seed.sql", "upsert_setup.sql"},
+		Queries:     []string{"merge.sql"},
+		Vars:        map[string]int{"accounts": 1_000_000, "upsert_keys": 1_100_000},
+		MinVersion:  15,
+	},
+}
+
+// Get returns the preset by name.
+func Get(name string) (*Preset, error) {
+	for i := range presets {
+		if presets[i].Name == name {
+			p := presets[i]
+			return &p, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown preset %q, available: %s", name, strings.Join(Names(), ", "))
+}
+
+// Names returns names of all presets, sorted.
+func Names() []string {
+	names := make([]string, len(presets))
+	for i, p := range presets {
+		names[i] = p.Name
+	}
+	sort.Strings(names)
+	return names
+}
+
+// List returns all presets.
+func List() []Preset {
+	return append([]Preset(nil), presets...)
+}
+
+// SetVars overrides preset vars, e.g. to change the proportions of a query mix.
+func (p *Preset) SetVars(vars map[string]int) {
+	merged := make(map[string]int, len(p.Vars)+len(vars))
+	for key, value := range p.Vars {
+		merged[key] = value
+	}
+	for key, value := range vars {
+		merged[key] = value
+	}
+	p.Vars = merged
+}
+
+// Override replaces preset launcher settings with non-zero fields of conf.
+func (p *Preset) Override(conf autoai.LauncherConfig) {
+	dst := &p.Launcher
+	override(&dst.ArrivalRate, conf.ArrivalRate)
+	override(&dst.MaxInFlight, conf.MaxInFlight)
+	override(&dst.TokenBucket, conf.TokenBucket)
+	override(&dst.BucketSize, conf.BucketSize)
+	override(&dst.Adaptive, conf.Adaptive)
+	override(&dst.LatencySLO, conf.LatencySLO)
+	override(&dst.MaxErrorRate, conf.MaxErrorRate)
+	override(&dst.AdaptiveStepDuration, conf.AdaptiveStepDuration)
+	override(&dst.BreakerFailureRate, conf.BreakerFailureRate)
+	override(&dst.BreakerWindow, conf.BreakerWindow)
+	override(&dst.BreakerMinSamples, conf.BreakerMinSamples)
+	override(&dst.StatementTimeout, conf.StatementTimeout)
+
+	override(&dst.Reconnect.InitialDelay, conf.Reconnect.InitialDelay)
+	override(&dst.Reconnect.MaxDelay, conf.Reconnect.MaxDelay)
+	override(&dst.Reconnect.Multiplier, conf.Reconnect.Multiplier)
+	override(&dst.Reconnect.Jitter, conf.Reconnect.Jitter)
+	override(&dst.Reconnect.MaxAttempts, conf.Reconnect.MaxAttempts)
+
+	override(&dst.SkipExplainAnalyze, conf.SkipExplainAnalyze)
+	override(&dst.PlanCheckInterval, conf.PlanCheckInterval)
+	override(&dst.ActivitySampleInterval, conf.ActivitySampleInterval)
+
+	override(&dst.Alerts.P99Latency, conf.Alerts.P99Latency)
+	override(&dst.Alerts.ErrorRate, conf.Alerts.ErrorRate)
+	override(&dst.Alerts.ReplicationLag, conf.Alerts.ReplicationLag)
+	override(&dst.Alerts.DBSize, conf.Alerts.DBSize)
+	override(&dst.Alerts.WebhookURL, conf.Alerts.WebhookURL)
+
+	override(&dst.IterationDuration, conf.IterationDuration)
+	override(&dst.RampIterations, conf.RampIterations)
+	override(&dst.RampStart, conf.RampStart)
+	override(&dst.RampMultiplier, conf.RampMultiplier)
+	override(&dst.MaxConns, conf.MaxConns)
+	override(&dst.ThinkTime, conf.ThinkTime)
+	override(&dst.ConnectPerQuery, conf.ConnectPerQuery)
+	override(&dst.SSLMode, conf.SSLMode)
+	override(&dst.SSLRootCert, conf.SSLRootCert)
+	override(&dst.SSLCert, conf.SSLCert)
+	override(&dst.SSLKey, conf.SSLKey)
+	override(&dst.SynchronousCommit, conf.SynchronousCommit)
+	override(&dst.TwoPhaseCommit, conf.TwoPhaseCommit)
+	override(&dst.PrepareDwell, conf.PrepareDwell)
+	override(&dst.OrphanRate, conf.OrphanRate)
+	override(&dst.SerializationRetries, conf.SerializationRetries)
+	override(&dst.MixWindow, conf.MixWindow)
+	override(&dst.Seed, conf.Seed)
+}
+
+// override sets dst to value if it's not zero.
+func override[T comparable](dst *T, value T) {
+	var zero T
+	if value != zero {
+		*dst = value
+	}
+}
+
+// sql reads the embedded file and substitutes preset vars.
+func (p *Preset) sql(name string) (string, error) {
+	content, err := sqlFiles.ReadFile("sql/" + name)
+	if err != nil {
+		return "", err
+	}
+	text := string(content)
+	for key, value := range p.Vars {
+		text = strings.ReplaceAll(text, "{{"+key+"}}", strconv.Itoa(value))
+	}
+	return text, nil
+}
+
+// QueryMix returns the queries of the preset.
+func (p *Preset) QueryMix() ([]autoai.Query, error) {
+	var queries []autoai.Query
+	for _, name := range p.Queries {
+		text, err := p.sql(name)
+		if err != nil {
+			return nil, err
+		}
+		parsed, err := autoai.ParseQueries(text)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", name, err)
+		}
+		queries = append(queries, parsed...)
+	}
+	return queries, nil
+}
+
+// SetupSchema checks the server version and creates and seeds the tables used by the preset,
+// the ingest table is created first, so that setup files and queries can use it.
+// Setup is idempotent, tables that already have data are not seeded again.
+func (p *Preset) SetupSchema(ctx context.Context, connstr string) error {
+	if p.IngestWorkers > 0 {
+		if err := ingest.CreateTable(ctx, connstr, p.Ingest); err != nil {
+			return fmt.Errorf("failed to create ingest table: %w", err)
+		}
+	}
+	if len(p.Setup) == 0 && p.MinVersion == 0 {
+		return nil
+	}
+
+	conn, err := dbconn.Connect(ctx, connstr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	if version := pgversion.FromConn(conn); !version.AtLeast(p.MinVersion) {
+		return fmt.Errorf("preset %s requires Postgres %d+, the server is %s", p.Name, p.MinVersion, version)
+	}
+
+	for _, name := range p.Setup {
+		text, err := p.sql(name)
+		if err != nil {
+			return err
+		}
+		log.Info(ctx, "running preset setup", zap.String("file", name))
+		if _, err := conn.Exec(ctx, text); err != nil {
+			return fmt.Errorf("failed to run %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// Run runs the preset: ingest workers in the background and the query mix with the given
+// launcher. It returns when the query mix is finished, or when the context is done for presets
+// without queries. The schema has to be set up with SetupSchema first, once for all runs.
+func (p *Preset) Run(ctx context.Context, connstr string, launcher *autoai.Launcher, supervisor *multi.Supervisor) error {
+	ctx = log.With(ctx, zap.String("preset", p.Name))
+
+	queries, err := p.QueryMix()
+	if err != nil {
+		return err
+	}
+
+	ingestCtx, stopIngest := context.WithCancel(ctx)
+	defer stopIngest()
+	if p.IngestWorkers > 0 {
+		method, err := ingestMethod(p.IngestMethod)
+		if err != nil {
+			return err
+		}
+		go supervisor.RunMany(ingestCtx, p.IngestWorkers, "ingest", func(ctx context.Context) error {
+			return method.Run(ctx, connstr, p.Ingest)
+		})
+		if p.Ingest.Hypertable {
+			go ingest.ReportChunks(ingestCtx, connstr, p.Ingest.TableName, chunksReportInterval)
+		}
+	}
+
+	if len(queries) == 0 {
+		<-ctx.Done()
+		return nil
+	}
+	return launcher.RunSource(ctx, connstr, autoai.StaticSource(queries))
+}
+
+func ingestMethod(name string) (ingest.Method, error) {
+	for _, m := range ingest.Methods {
+		if m.Name == name {
+			return m, nil
+		}
+	}
+	return ingest.Method{}, fmt.Errorf("unknown ingest method %q", name)
+}
@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS preset_accounts (
+	aid bigint PRIMARY KEY,
+	bid int NOT NULL,
+	abalance int NOT NULL DEFAULT 0,
+	filler char(84)
+);
+
+CREATE TABLE IF NOT EXISTS preset_history (
+	id bigint GENERATED ALWAYS AS IDENTITY,
+	aid bigint NOT NULL,
+	delta int NOT NULL,
+	mtime timestamptz NOT NULL DEFAULT now()
+);
@@ -0,0 +1,4 @@
+INSERT INTO preset_accounts (aid, bid, filler)
+SELECT s, s % 100, ''
+FROM generate_series(1, {{accounts}}) s
+WHERE NOT EXISTS (SELECT 1 FROM preset_accounts);
@@ -0,0 +1,20 @@
+-- weight: 2
+-- param: since timestamp 720h
+SELECT kind, count(*), sum(amount), avg(amount)
+FROM preset_events
+WHERE created_at > :since
+GROUP BY kind;
+
+-- weight: 1
+SELECT date_trunc('day', created_at) AS day, count(DISTINCT user_id), sum(amount) FILTER (WHERE kind = 'purchase')
+FROM preset_events
+GROUP BY 1
+ORDER BY 1;
+
+-- weight: 1
+SELECT user_id, sum(amount) AS total
+FROM preset_events
+WHERE kind = 'purchase'
+GROUP BY user_id
+ORDER BY total DESC
+LIMIT 100;
@@ -0,0 +1,28 @@
+-- single-shard: point read routed by the distribution column
+-- weight: {{single_shard}}
+-- param: aid uniform 1 {{accounts}}
+SELECT abalance FROM preset_accounts WHERE aid = :aid;
+
+-- single-shard: transaction touching colocated rows of a single account
+-- weight: {{single_shard}}
+BEGIN;
+-- param: aid uniform 1 {{accounts}}
+-- param: delta uniform -5000 5000
+UPDATE preset_accounts SET abalance = abalance + :delta WHERE aid = :aid;
+INSERT INTO preset_history (aid, delta) VALUES (:aid, :delta);
+COMMIT;
+
+-- cross-shard: aggregation fanned out to all shards
+-- weight: {{cross_shard}}
+-- param: bid uniform 0 99
+SELECT count(*), sum(abalance) FROM preset_accounts WHERE bid = :bid;
+
+-- cross-shard: transfer between two accounts, committed with 2PC if they are on different shards
+-- weight: {{cross_shard}}
+BEGIN;
+-- param: src uniform 1 {{accounts}}
+-- param: dst uniform 1 {{accounts}}
+-- param: amount uniform 1 100
+UPDATE preset_accounts SET abalance = abalance - :amount WHERE aid = :src;
+UPDATE preset_accounts SET abalance = abalance + :amount WHERE aid = :dst;
+COMMIT;
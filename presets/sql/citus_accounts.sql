@@ -0,0 +1,9 @@
+-- distributes account tables by aid, history is colocated with accounts,
+-- so that transactions on a single account are routed to a single shard
+CREATE EXTENSION IF NOT EXISTS citus;
+
+SELECT create_distributed_table('preset_accounts', 'aid')
+WHERE NOT EXISTS (SELECT 1 FROM pg_dist_partition WHERE logicalrelid = 'preset_accounts'::regclass);
+
+SELECT create_distributed_table('preset_history', 'aid', colocate_with => 'preset_accounts')
+WHERE NOT EXISTS (SELECT 1 FROM pg_dist_partition WHERE logicalrelid = 'preset_history'::regclass);
@@ -0,0 +1,11 @@
+-- weight: 5
+BEGIN;
+-- param: aid zipf 1 {{accounts}} 1.5
+-- param: delta uniform -100 100
+SELECT abalance FROM preset_accounts WHERE aid = :aid FOR UPDATE;
+UPDATE preset_accounts SET abalance = abalance + :delta WHERE aid = :aid;
+COMMIT;
+
+-- weight: 1
+-- param: aid zipf 1 {{accounts}} 1.5
+SELECT abalance FROM preset_accounts WHERE aid = :aid;
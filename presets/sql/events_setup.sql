@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS preset_events (
+	id bigint PRIMARY KEY,
+	user_id int NOT NULL,
+	kind text NOT NULL,
+	amount numeric(12, 2) NOT NULL,
+	created_at timestamptz NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS preset_events_created_at ON preset_events (created_at);
+
+INSERT INTO preset_events (id, user_id, kind, amount, created_at)
+SELECT s,
+	(random() * 100000)::int,
+	(ARRAY['view', 'click', 'purchase', 'refund'])[1 + s % 4],
+	round((random() * 1000)::numeric, 2),
+	now() - random() * interval '30 days'
+FROM generate_series(1, {{events}}) s
+WHERE NOT EXISTS (SELECT 1 FROM preset_events);
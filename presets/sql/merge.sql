@@ -0,0 +1,29 @@
+-- weight: 4
+-- keys above the seeded range insert new accounts, the rest update existing ones
+-- param: aid uniform 1 {{upsert_keys}}
+-- param: delta uniform -100 100
+MERGE INTO preset_accounts a
+USING (SELECT :aid::bigint AS aid, :delta::int AS delta) s ON a.aid = s.aid
+WHEN MATCHED THEN UPDATE SET abalance = a.abalance + s.delta
+WHEN NOT MATCHED THEN INSERT (aid, bid, abalance, filler) VALUES (s.aid, s.aid % 100, s.delta, '');
+
+-- weight: 3
+-- hot counters, concurrent merges of the same rows wait for each other
+-- param: bucket zipf 1 1000 1.2
+MERGE INTO preset_counters c
+USING (SELECT :bucket::int AS bucket) s ON c.bucket = s.bucket
+WHEN MATCHED THEN UPDATE SET hits = c.hits + 1, updated_at = now()
+WHEN NOT MATCHED THEN INSERT (bucket, hits) VALUES (s.bucket, 1);
+
+-- weight: 2
+-- batch merge, deleting daily totals that drop to zero
+-- param: aid uniform 1 {{accounts}}
+-- param: delta uniform -3 3
+MERGE INTO preset_daily d
+USING (
+	SELECT :aid::bigint + i / 7 AS aid, current_date - i % 7 AS day
+	FROM generate_series(0, 99) i
+) s ON d.aid = s.aid AND d.day = s.day
+WHEN MATCHED AND d.total + :delta <= 0 THEN DELETE
+WHEN MATCHED THEN UPDATE SET total = d.total + :delta
+WHEN NOT MATCHED AND :delta > 0 THEN INSERT (aid, day, total) VALUES (s.aid, s.day, :delta);
@@ -0,0 +1,16 @@
+-- weight: 6
+-- param: aid uniform 1 {{accounts}}
+SELECT abalance FROM preset_accounts WHERE aid = :aid;
+
+-- weight: 3
+BEGIN;
+-- param: aid uniform 1 {{accounts}}
+-- param: delta uniform -5000 5000
+UPDATE preset_accounts SET abalance = abalance + :delta WHERE aid = :aid;
+SELECT abalance FROM preset_accounts WHERE aid = :aid;
+INSERT INTO preset_history (aid, delta) VALUES (:aid, :delta);
+COMMIT;
+
+-- weight: 1
+-- param: bid uniform 0 99
+SELECT count(*), sum(abalance) FROM preset_accounts WHERE bid = :bid AND aid % 100 = 0;
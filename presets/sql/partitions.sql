@@ -0,0 +1,40 @@
+-- pruned: account history within a single daily partition
+-- class: pruned
+-- weight: {{pruned}}
+-- param: day uniform 1 29
+-- param: aid uniform 0 9999999
+SELECT count(*), sum(delta)
+FROM preset_partitioned
+WHERE aid = :aid
+  AND mtime >= date_trunc('day', localtimestamp) - :day::int * interval '1 day'
+  AND mtime < date_trunc('day', localtimestamp) - (:day::int - 1) * interval '1 day';
+
+-- pruned: branch totals for a single day
+-- class: pruned
+-- weight: {{pruned}}
+-- param: day uniform 1 29
+-- param: bid uniform 0 9999
+SELECT tid, sum(delta)
+FROM preset_partitioned
+WHERE bid = :bid
+  AND mtime >= date_trunc('day', localtimestamp) - :day::int * interval '1 day'
+  AND mtime < date_trunc('day', localtimestamp) - (:day::int - 1) * interval '1 day'
+GROUP BY tid;
+
+-- cross-partition: account history over all partitions
+-- class: cross-partition
+-- weight: {{cross_partition}}
+-- param: aid uniform 0 9999999
+SELECT count(*), sum(delta), max(mtime)
+FROM preset_partitioned
+WHERE aid = :aid;
+
+-- cross-partition: daily totals of a branch over the whole month
+-- class: cross-partition
+-- weight: {{cross_partition}}
+-- param: bid uniform 0 9999
+SELECT date_trunc('day', mtime) AS day, count(*), sum(delta)
+FROM preset_partitioned
+WHERE bid = :bid
+GROUP BY 1
+ORDER BY 1;
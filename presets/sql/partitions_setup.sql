@@ -0,0 +1,3 @@
+-- indexes are created on the partitioned table and cascade to all partitions
+CREATE INDEX IF NOT EXISTS preset_partitioned_aid ON preset_partitioned (aid);
+CREATE INDEX IF NOT EXISTS preset_partitioned_bid ON preset_partitioned (bid);
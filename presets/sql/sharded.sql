@@ -0,0 +1,36 @@
+-- single-shard: point read by the shard key
+-- class: single-shard
+-- weight: {{single_shard}}
+-- param: aid uniform 1 {{accounts}}
+SELECT abalance FROM preset_sharded_accounts WHERE aid = :aid;
+
+-- single-shard: transaction on the rows of a single shard key
+-- class: single-shard
+-- weight: {{single_shard}}
+BEGIN;
+-- param: aid uniform 1 {{accounts}}
+-- param: delta uniform -5000 5000
+UPDATE preset_sharded_accounts SET abalance = abalance + :delta WHERE aid = :aid;
+INSERT INTO preset_sharded_history (aid, delta) VALUES (:aid, :delta);
+COMMIT;
+
+-- cross-shard: read of four shard keys
+-- class: cross-shard
+-- weight: {{cross_shard}}
+-- param: a1 uniform 1 {{accounts}}
+-- param: a2 uniform 1 {{accounts}}
+-- param: a3 uniform 1 {{accounts}}
+-- param: a4 uniform 1 {{accounts}}
+SELECT aid, abalance FROM preset_sharded_accounts WHERE aid IN (:a1, :a2, :a3, :a4);
+
+-- cross-shard: transfer between two shard keys, on different shards unless they collide
+-- class: cross-shard
+-- weight: {{cross_shard}}
+BEGIN;
+-- param: src uniform 1 {{accounts}}
+-- param: dst uniform 1 {{accounts}}
+-- param: amount uniform 1 100
+UPDATE preset_sharded_accounts SET abalance = abalance - :amount WHERE aid = :src;
+UPDATE preset_sharded_accounts SET abalance = abalance + :amount WHERE aid = :dst;
+INSERT INTO preset_sharded_history (aid, delta) VALUES (:src, 0 - :amount), (:dst, :amount);
+COMMIT;
@@ -0,0 +1,31 @@
+-- accounts and their history are hash-partitioned by aid, every partition stands for a shard,
+-- changing the number of shards requires dropping the tables
+CREATE TABLE IF NOT EXISTS preset_sharded_accounts (
+	aid bigint PRIMARY KEY,
+	bid int NOT NULL,
+	abalance int NOT NULL DEFAULT 0,
+	filler char(84)
+) PARTITION BY HASH (aid);
+
+CREATE TABLE IF NOT EXISTS preset_sharded_history (
+	aid bigint NOT NULL,
+	delta int NOT NULL,
+	mtime timestamptz NOT NULL DEFAULT now()
+) PARTITION BY HASH (aid);
+
+DO $$
+BEGIN
+	FOR i IN 0..{{shards}} - 1 LOOP
+		EXECUTE format('CREATE TABLE IF NOT EXISTS preset_sharded_accounts_%s PARTITION OF preset_sharded_accounts
+			FOR VALUES WITH (MODULUS %s, REMAINDER %s)', i, {{shards}}, i);
+		EXECUTE format('CREATE TABLE IF NOT EXISTS preset_sharded_history_%s PARTITION OF preset_sharded_history
+			FOR VALUES WITH (MODULUS %s, REMAINDER %s)', i, {{shards}}, i);
+	END LOOP;
+END $$;
+
+CREATE INDEX IF NOT EXISTS preset_sharded_history_aid ON preset_sharded_history (aid);
+
+INSERT INTO preset_sharded_accounts (aid, bid, filler)
+SELECT s, s % 100, ''
+FROM generate_series(1, {{accounts}}) s
+WHERE NOT EXISTS (SELECT 1 FROM preset_sharded_accounts);
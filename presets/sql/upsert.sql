@@ -0,0 +1,29 @@
+-- weight: 4
+-- keys above the seeded range insert new accounts, the rest update existing ones
+-- param: aid uniform 1 {{upsert_keys}}
+-- param: delta uniform -100 100
+INSERT INTO preset_accounts (aid, bid, abalance, filler)
+VALUES (:aid, :aid % 100, :delta, '')
+ON CONFLICT (aid) DO UPDATE SET abalance = preset_accounts.abalance + EXCLUDED.abalance;
+
+-- weight: 3
+-- hot counters, concurrent upserts of the same rows wait for each other
+-- param: bucket zipf 1 1000 1.2
+INSERT INTO preset_counters (bucket, hits)
+VALUES (:bucket, 1)
+ON CONFLICT (bucket) DO UPDATE SET hits = preset_counters.hits + 1, updated_at = now();
+
+-- weight: 2
+-- param: aid uniform 1 {{accounts}}
+-- param: delta uniform 1 100
+INSERT INTO preset_daily (aid, day, total)
+VALUES (:aid, current_date, :delta)
+ON CONFLICT DO NOTHING;
+
+-- weight: 1
+-- batch upsert, every row of the batch conflicts after the first week
+-- param: aid uniform 1 {{accounts}}
+INSERT INTO preset_daily (aid, day, total)
+SELECT :aid::bigint + i / 7, current_date - i % 7, 1
+FROM generate_series(0, 99) i
+ON CONFLICT (aid, day) DO UPDATE SET total = preset_daily.total + EXCLUDED.total;
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS preset_counters (
+	bucket int PRIMARY KEY,
+	hits bigint NOT NULL DEFAULT 0,
+	updated_at timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS preset_daily (
+	aid bigint NOT NULL,
+	day date NOT NULL,
+	total bigint NOT NULL,
+	PRIMARY KEY (aid, day)
+);
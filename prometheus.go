@@ -0,0 +1,27 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+
+	"github.com/petuhovskiy/overload/internal/log"
+	"github.com/petuhovskiy/overload/internal/metrics"
+	"go.uber.org/zap"
+)
+
+// startMetrics serves all metrics in the Prometheus format on METRICS_ADDR, if set.
+func startMetrics(ctx context.Context) {
+	addr := os.Getenv("METRICS_ADDR")
+	if addr == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Default.Handler())
+	go func() {
+		log.Info(ctx, "metrics server started", zap.String("addr", addr))
+		err := http.ListenAndServe(addr, mux)
+		log.Error(ctx, "metrics server stopped", zap.Error(err))
+	}()
+}
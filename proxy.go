@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/petuhovskiy/overload/internal/dbconn"
+	"github.com/petuhovskiy/overload/internal/faultproxy"
+	"github.com/petuhovskiy/overload/internal/log"
+	"go.uber.org/zap"
+)
+
+// startProxy starts the fault injection proxy in front of the database, if enabled by PROXY=1,
+// and routes connections to the database through it. Faults are configured by PROXY_LATENCY,
+// PROXY_JITTER, PROXY_BANDWIDTH and PROXY_RESET_RATE, and can be changed at runtime over HTTP
+// on PROXY_CONTROL_ADDR, which listens on localhost unless another host is given.
+func startProxy(ctx context.Context, connstr string) {
+	if os.Getenv("PROXY") != "1" {
+		return
+	}
+
+	config, err := pgx.ParseConfig(connstr)
+	if err != nil {
+		fmt.Println("Error: invalid CONNSTR:", err)
+		os.Exit(1)
+	}
+
+	upstream := net.JoinHostPort(config.Host, strconv.Itoa(int(config.Port)))
+	proxy, err := faultproxy.New("127.0.0.1:0", upstream)
+	if err != nil {
+		fmt.Println("Error: failed to start proxy:", err)
+		os.Exit(1)
+	}
+	proxy.SetFaults(faultproxy.Faults{
+		Latency:   envDuration("PROXY_LATENCY"),
+		Jitter:    envDuration("PROXY_JITTER"),
+		Bandwidth: int64(envInt("PROXY_BANDWIDTH")),
+		ResetRate: envFloat("PROXY_RESET_RATE"),
+	})
+	go proxy.Serve(ctx)
+
+	if addr := os.Getenv("PROXY_CONTROL_ADDR"); addr != "" {
+		addr = localAddr(addr)
+		go func() {
+			err := http.ListenAndServe(addr, proxy.Handler())
+			log.Error(ctx, "proxy control server stopped", zap.Error(err))
+		}()
+	}
+
+	// the connection string is unchanged, so that TLS verification and SNI see the original host
+	dbconn.Route(config.Host, config.Port, proxy.Addr())
+}
+
+// localAddr binds addresses without a host, like ":8081", to localhost.
+func localAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host != "" {
+		return addr
+	}
+	return net.JoinHostPort("localhost", port)
+}
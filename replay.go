@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/petuhovskiy/overload/internal/capture"
+	"github.com/petuhovskiy/overload/internal/log"
+	"go.uber.org/zap"
+)
+
+// runReplay executes statements from a capture file against the database from CONNSTR.
+func runReplay(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	file := fs.String("file", "", "capture file recorded with -capture")
+	speed := fs.Float64("speed", 1, "timing multiplier, 0 replays without delays")
+	_ = fs.Parse(args)
+
+	connstr := os.Getenv("CONNSTR")
+	if connstr == "" || *file == "" {
+		fmt.Println("Error: CONNSTR environment variable and -file are required")
+		os.Exit(1)
+	}
+	setupTarget(connstr)
+
+	entries, err := capture.ReadAll(*file)
+	if err != nil {
+		fmt.Println("Error: failed to read capture:", err)
+		os.Exit(1)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	log.Info(ctx, "replaying capture", zap.String("file", *file), zap.Int("statements", len(entries)))
+	stats, err := capture.Replay(ctx, connstr, entries, *speed)
+	log.Info(ctx, "replay finished", zap.Any("stats", stats))
+	if err != nil {
+		fmt.Println("Error: replay failed:", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/petuhovskiy/overload/autoai"
+	"github.com/petuhovskiy/overload/ingest"
+	"github.com/petuhovskiy/overload/internal/alert"
+	"github.com/petuhovskiy/overload/internal/clientstats"
+	"github.com/petuhovskiy/overload/internal/health"
+	"github.com/petuhovskiy/overload/internal/log"
+	"github.com/petuhovskiy/overload/internal/metrics"
+	"github.com/petuhovskiy/overload/internal/multi"
+	"github.com/petuhovskiy/overload/internal/runconfig"
+	"github.com/petuhovskiy/overload/presets"
+	"go.uber.org/zap"
+)
+
+// runWorkloads executes all workloads of the config file concurrently, each as a separate run.
+func runWorkloads(args []string) {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	file := fs.String("c", "workload.yaml", "config file with workload definitions")
+	_ = fs.Parse(args)
+
+	conf, err := runconfig.Load(*file)
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+	if err := conf.SetEnvDefaults(); err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+
+	targets := map[string]bool{}
+	for _, w := range conf.Workloads {
+		connstr := conf.ConnstrOf(w)
+		if !targets[connstr] {
+			setupTarget(connstr)
+			targets[connstr] = true
+		}
+	}
+
+	pool := connectHistory()
+	defer pool.Close()
+	if err := autoai.NewDBHistory(pool).Migrate(); err != nil {
+		fmt.Println("Error: failed to migrate history schema:", err)
+		os.Exit(1)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	startHealth(ctx, conf.ConnstrOf(conf.Workloads[0]), pool)
+	startMetrics(ctx)
+	go metrics.Default.RunFlush(ctx, 10*time.Second)
+	go clientstats.Default.Run(ctx, time.Second)
+
+	health.Default.RunStarted()
+	var (
+		wg     sync.WaitGroup
+		failed atomic.Bool
+	)
+	for _, w := range conf.Workloads {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx := log.With(ctx, zap.String("workload", w.Name))
+			if err := runWorkload(ctx, *file, conf, w, pool); err != nil {
+				log.Error(ctx, "workload failed", zap.Error(err))
+				failed.Store(true)
+			}
+		}()
+	}
+	wg.Wait()
+	health.Default.RunFinished()
+	clientstats.Default.LogSummary(ctx)
+
+	if failed.Load() {
+		os.Exit(1)
+	}
+}
+
+// runWorkload executes the module of the workload until it finishes, its duration passes or ctx is done.
+func runWorkload(ctx context.Context, file string, conf *runconfig.File, w runconfig.Workload, pool *pgxpool.Pool) error {
+	connstr := conf.ConnstrOf(w)
+	history := autoai.NewDBHistory(pool)
+	artifact := autoai.NewArtifact()
+	history.SetArtifact(artifact)
+
+	labels := maps.Clone(conf.Labels)
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	maps.Copy(labels, w.Labels)
+	labels["workload"] = w.Name
+	hostname, _ := os.Hostname()
+	metadata := map[string]any{
+		"hostname": hostname,
+		"args":     os.Args,
+		"mode":     w.Module,
+		"config":   file,
+	}
+
+	runID, err := history.StartRun(labels, metadata)
+	if err != nil {
+		return fmt.Errorf("failed to start run: %w", err)
+	}
+	ctx = log.With(ctx, zap.Int("run_id", runID))
+	if w.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, w.Duration)
+		defer cancel()
+	}
+	log.Info(ctx, "workload started", zap.String("module", w.Module))
+	autoai.DetectServerVersion(ctx, connstr, history)
+
+	supervisor := multi.NewSupervisor(supervisorConfig())
+	defer supervisor.LogSummary(ctx)
+
+	launcherConf := launcherConfig()
+	if w.MaxConns > 0 {
+		launcherConf.MaxConns = w.MaxConns
+	}
+
+	switch w.Module {
+	case runconfig.ModuleIngest:
+		err = runIngestWorkload(ctx, connstr, w, history, supervisor)
+	case runconfig.ModuleQueries:
+		launcher := autoai.NewLauncher(history, launcherConf)
+		err = supervisor.Run(ctx, "queries", func(ctx context.Context) error {
+			return launcher.RunSource(ctx, connstr, &autoai.FileSource{Path: w.Queries})
+		})
+	case runconfig.ModulePreset:
+		err = runPresetWorkload(ctx, connstr, w, launcherConf, history, supervisor)
+	case runconfig.ModuleAutoAI:
+		err = runAutoAIWorkload(ctx, connstr, launcherConf, history, supervisor)
+	}
+	if ctx.Err() != nil {
+		// stopped by the duration or an interrupt
+		err = nil
+	}
+	artifact.LogClasses(ctx)
+	log.Info(ctx, "workload finished", zap.Error(err))
+	return err
+}
+
+// runIngestWorkload ingests rows with the workers of the workload, reporting database growth.
+func runIngestWorkload(ctx context.Context, connstr string, w runconfig.Workload, history *autoai.DBHistory, supervisor *multi.Supervisor) error {
+	var method ingest.Method
+	for _, m := range ingest.Methods {
+		if m.Name == w.Method {
+			method = m
+		}
+	}
+	conf := ingest.Config{
+		TableName:        w.Table,
+		BatchSize:        w.BatchSize,
+		BatchesPerCommit: w.BatchesPerCommit,
+	}
+	conf.Normalize()
+	// the table is created once, so that workers don't race on DDL
+	if err := ingest.CreateTable(ctx, connstr, conf); err != nil {
+		return fmt.Errorf("failed to create table: %w", err)
+	}
+
+	go ingest.ReportUploadSpeed(ctx, connstr, alert.New(alertConfig(), history.SaveAlert), diskConfig())
+	supervisor.RunMany(ctx, w.Workers, "ingest", func(ctx context.Context) error {
+		return method.Run(ctx, connstr, conf)
+	})
+	return nil
+}
+
+// runPresetWorkload runs the preset of the workload, the workload settings override the preset.
+func runPresetWorkload(ctx context.Context, connstr string, w runconfig.Workload, launcherConf autoai.LauncherConfig, history *autoai.DBHistory, supervisor *multi.Supervisor) error {
+	preset, err := presets.Get(w.Preset)
+	if err != nil {
+		return err
+	}
+	preset.Override(launcherConf)
+	preset.SetVars(envVars("PRESET_VARS"))
+	if err := preset.SetupSchema(ctx, connstr); err != nil {
+		return fmt.Errorf("failed to set up preset: %w", err)
+	}
+	if preset.IngestWorkers > 0 {
+		go ingest.ReportUploadSpeed(ctx, connstr, alert.New(alertConfig(), history.SaveAlert), diskConfig())
+	}
+	launcher := autoai.NewLauncher(history, preset.Launcher)
+	return preset.Run(ctx, connstr, launcher, supervisor)
+}
+
+// runAutoAIWorkload generates queries with the model and runs them in a loop.
+func runAutoAIWorkload(ctx context.Context, connstr string, launcherConf autoai.LauncherConfig, history *autoai.DBHistory, supervisor *multi.Supervisor) error {
+	provider, err := modelProvider()
+	if err != nil {
+		return err
+	}
+	gen := autoai.NewGenerator(provider, history, autoai.NewLauncher(history, launcherConf))
+	if err := setupGenerator(gen, connstr); err != nil {
+		return err
+	}
+	return supervisor.Run(ctx, "autoai", func(ctx context.Context) error {
+		for {
+			if err := gen.DoIteration(ctx, connstr); err != nil {
+				return err
+			}
+		}
+	})
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/petuhovskiy/overload/autoai"
+)
+
+// runRuns prints runs matching the given labels.
+func runRuns(args []string) {
+	fs := flag.NewFlagSet("runs", flag.ExitOnError)
+	labels := labelsFlag{}
+	fs.Var(labels, "label", "only list runs with this label, in key=value format (repeatable)")
+	workload := fs.String("workload", "", "only list runs with this workload fingerprint")
+	_ = fs.Parse(args)
+
+	pool := connectHistory()
+	defer pool.Close()
+	dbHistory := autoai.NewDBHistory(pool)
+
+	runs, err := dbHistory.ListWorkloadRuns(labels, *workload)
+	if err != nil {
+		fmt.Println("Error: failed to list runs:", err)
+		os.Exit(1)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tSTARTED\tVERSION\tWORKLOAD\tLABELS")
+	for _, run := range runs {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", run.ID, run.StartedAt.Format(time.DateTime), run.ServerVersion, run.WorkloadFingerprint, labelsFlag(run.Labels))
+	}
+	_ = tw.Flush()
+}
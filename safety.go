@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/petuhovskiy/overload/internal/limits"
+	"github.com/petuhovskiy/overload/internal/log"
+	"go.uber.org/zap"
+)
+
+// setupLimits registers hard safety caps that are enforced regardless of the workload config.
+// SAFETY_LIMITS sets limits per target, SAFETY_MAX_CONNS, SAFETY_MAX_QPS and SAFETY_MAX_WRITE_MBPS
+// override them for the target of connstr.
+func setupLimits(connstr string) {
+	targets, err := limits.ParseTargets(os.Getenv("SAFETY_LIMITS"))
+	if err != nil {
+		fmt.Println("Error: invalid SAFETY_LIMITS:", err)
+		os.Exit(1)
+	}
+
+	config, err := pgx.ParseConfig(connstr)
+	if err != nil {
+		fmt.Println("Error: invalid CONNSTR:", err)
+		os.Exit(1)
+	}
+	target := limits.Target(config)
+
+	conf := targets[target]
+	if v := envInt("SAFETY_MAX_CONNS"); v > 0 {
+		conf.MaxConns = v
+	}
+	if v := envFloat("SAFETY_MAX_QPS"); v > 0 {
+		conf.MaxQPS = v
+	}
+	if v := envFloat("SAFETY_MAX_WRITE_MBPS"); v > 0 {
+		conf.MaxWriteMBps = v
+	}
+	targets[target] = conf
+
+	for t, c := range targets {
+		limits.RegisterTarget(t, c)
+	}
+
+	if !conf.IsZero() {
+		log.Info(context.Background(), "safety limits enabled",
+			zap.String("target", target),
+			zap.Int("max_conns", conf.MaxConns),
+			zap.Float64("max_qps", conf.MaxQPS),
+			zap.Float64("max_write_mbps", conf.MaxWriteMBps),
+		)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/petuhovskiy/overload/api"
+	"github.com/petuhovskiy/overload/autoai"
+	"github.com/petuhovskiy/overload/internal/log"
+	"github.com/petuhovskiy/overload/internal/server"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+)
+
+// shutdownTimeout limits the time runs and RPCs have to finish after a termination signal.
+const shutdownTimeout = 10 * time.Second
+
+// runServe starts the gRPC API, workloads are executed against CONNSTR.
+func runServe(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := fs.String("addr", "localhost:50051", "address to listen on, non-loopback addresses require API_TOKEN or mTLS")
+	allowQueries := fs.Bool("allow-queries", false, "allow runs of arbitrary SQL sent in the queries field")
+	_ = fs.Parse(args)
+
+	connstr := os.Getenv("CONNSTR")
+	if connstr == "" {
+		fmt.Println("Error: CONNSTR environment variable not set")
+		os.Exit(1)
+	}
+	setupTarget(connstr)
+
+	pool := connectHistory()
+	defer pool.Close()
+	if err := autoai.NewDBHistory(pool).Migrate(); err != nil {
+		fmt.Println("Error: failed to migrate history schema:", err)
+		os.Exit(1)
+	}
+
+	security := apiSecurity()
+	opts, err := security.ServerOptions(*addr)
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+
+	listener, err := net.Listen("tcp", *addr)
+	if err != nil {
+		fmt.Println("Error: failed to listen:", err)
+		os.Exit(1)
+	}
+
+	grpcServer := grpc.NewServer(opts...)
+	srv := server.New(pool, server.Config{
+		Connstr:      connstr,
+		Launcher:     launcherConfig(),
+		Supervisor:   supervisorConfig(),
+		AllowQueries: *allowQueries,
+	})
+	api.RegisterOverloadServer(grpcServer, srv)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	startHealth(ctx, connstr, pool)
+	startMetrics(ctx)
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+
+		stopped := make(chan struct{})
+		go func() {
+			grpcServer.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-shutdownCtx.Done():
+			log.Warn(ctx, "graceful stop timed out, closing connections")
+			grpcServer.Stop()
+		}
+	}()
+
+	log.Info(ctx, "grpc server started", zap.String("addr", listener.Addr().String()), zap.Stringer("security", security))
+	if err := grpcServer.Serve(listener); err != nil {
+		fmt.Println("Error: grpc server failed:", err)
+		os.Exit(1)
+	}
+}
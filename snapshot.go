@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/petuhovskiy/overload/autoai"
+	"github.com/petuhovskiy/overload/internal/dbconn"
+)
+
+// tableReset takes a snapshot of tables configured by RESET_TABLES ("all" or a comma-separated
+// list) and returns a function restoring them, to be called before every iteration.
+// Returned function does nothing if RESET_TABLES is not set.
+func tableReset(ctx context.Context, connstr string) func(ctx context.Context) error {
+	value := os.Getenv("RESET_TABLES")
+	if value == "" {
+		return func(context.Context) error { return nil }
+	}
+
+	snapshot := &autoai.TableSnapshot{}
+	if value != "all" {
+		snapshot.Tables = strings.Split(value, ",")
+	}
+
+	conn, err := dbconn.Connect(ctx, connstr)
+	if err != nil {
+		fmt.Println("Error: failed to connect to database:", err)
+		os.Exit(1)
+	}
+	defer conn.Close(ctx)
+
+	if err := snapshot.Take(ctx, conn); err != nil {
+		fmt.Println("Error: failed to snapshot tables:", err)
+		os.Exit(1)
+	}
+
+	return func(ctx context.Context) error {
+		conn, err := dbconn.Connect(ctx, connstr)
+		if err != nil {
+			return err
+		}
+		defer conn.Close(ctx)
+		return snapshot.Restore(ctx, conn)
+	}
+}
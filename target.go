@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/petuhovskiy/overload/internal/pgversion"
+	"github.com/petuhovskiy/overload/internal/ready"
+)
+
+// setupTarget configures connections to the target database. Workloads connect with connstr
+// even through a proxy, which only changes the dialed address.
+func setupTarget(connstr string) {
+	setupEngine()
+	setupAuth()
+	setupLimits(connstr)
+	waitReady(connstr)
+}
+
+// setupEngine forces the database engine from COMPAT_ENGINE, for engines that can't be detected.
+func setupEngine() {
+	engine, err := pgversion.ParseEngine(os.Getenv("COMPAT_ENGINE"))
+	if err != nil {
+		fmt.Println("Error: invalid COMPAT_ENGINE:", err)
+		os.Exit(1)
+	}
+	pgversion.ForceEngine(engine)
+}
+
+// waitReady waits for the target database to accept connections and to have the tables
+// and extensions from WAIT_READY_TABLES and WAIT_READY_EXTENSIONS, up to WAIT_READY.
+func waitReady(connstr string) {
+	conf := ready.Config{
+		Timeout:    envDuration("WAIT_READY"),
+		Interval:   envDuration("WAIT_READY_INTERVAL"),
+		Tables:     envList("WAIT_READY_TABLES"),
+		Extensions: envList("WAIT_READY_EXTENSIONS"),
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	if err := ready.Wait(ctx, connstr, conf); err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/petuhovskiy/overload/autoai"
+	"github.com/petuhovskiy/overload/internal/log"
+	"go.uber.org/zap"
+)
+
+// tuneCheckInterval is how often the tuning file is checked for changes.
+const tuneCheckInterval = time.Second
+
+// watchTuning applies launcher parameters from the file every time it changes, until the
+// context is done. Parameters missing from the file keep their values from the start of the run.
+func watchTuning(ctx context.Context, path string, launcher *autoai.Launcher) {
+	ctx = log.With(ctx, zap.String("job", "tune"), zap.String("file", path))
+	base := launcher.Tuning()
+
+	var modTime time.Time
+	for {
+		info, err := os.Stat(path)
+		if err == nil && !info.ModTime().Equal(modTime) {
+			modTime = info.ModTime()
+			tuning, err := readTuning(path, base)
+			if err != nil {
+				log.Warn(ctx, "failed to read tuning file, keeping current parameters", zap.Error(err))
+			} else {
+				launcher.Tune(ctx, tuning)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(tuneCheckInterval):
+		}
+	}
+}
+
+// readTuning parses the tuning file, which has the same KEY=value format and names
+// as the environment variables, e.g. "ARRIVAL_RATE=500". Empty lines and lines starting
+// with # are ignored.
+func readTuning(path string, base autoai.Tuning) (autoai.Tuning, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return base, err
+	}
+	defer f.Close()
+
+	tuning := base
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return base, fmt.Errorf("invalid line %q, expected KEY=value", line)
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+
+		switch key {
+		case "ARRIVAL_RATE":
+			tuning.ArrivalRate, err = strconv.ParseFloat(value, 64)
+		case "THINK_TIME":
+			tuning.ThinkTime, err = time.ParseDuration(value)
+		case "MAX_CONNS":
+			tuning.MaxConns, err = strconv.Atoi(value)
+		default:
+			err = fmt.Errorf("unknown parameter")
+		}
+		if err != nil {
+			return base, fmt.Errorf("invalid %s: %w", key, err)
+		}
+	}
+	return tuning, scanner.Err()
+}
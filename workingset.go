@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/petuhovskiy/overload/autoai"
+	"github.com/petuhovskiy/overload/internal/log"
+	"go.uber.org/zap"
+)
+
+// runWorkingSet measures point reads over hot working sets of increasing size.
+func runWorkingSet(args []string) {
+	fs := flag.NewFlagSet("workingset", flag.ExitOnError)
+	labels := labelsFlag{}
+	fs.Var(labels, "label", "attach label to the run, in key=value format (repeatable)")
+	sizes := fs.String("sizes-mb", "128,512,1024,4096", "comma-separated working set sizes in megabytes")
+	table := fs.String("table", "", "table with the keys (default overload_workingset)")
+	tableSize := fs.Int64("table-mb", 0, "min size of the table in megabytes (default twice the largest working set)")
+	conns := fs.Int("conns", 0, "number of reading connections (default 16)")
+	stepDuration := fs.Duration("step-duration", 0, "duration of every measured step (default 1m)")
+	warmup := fs.Duration("warmup", 0, "duration of reads before every step (default 10s)")
+	_ = fs.Parse(args)
+
+	var sizeBytes []int64
+	for _, s := range strings.Split(*sizes, ",") {
+		mb, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+		if err != nil || mb <= 0 {
+			fmt.Println("Error: invalid working set size:", s)
+			os.Exit(1)
+		}
+		sizeBytes = append(sizeBytes, mb<<20)
+	}
+
+	connstr := os.Getenv("CONNSTR")
+	if connstr == "" {
+		fmt.Println("Error: CONNSTR environment variable not set")
+		os.Exit(1)
+	}
+	setupTarget(connstr)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	pool := connectHistory()
+	defer pool.Close()
+	dbHistory := autoai.NewDBHistory(pool)
+	if err := dbHistory.Migrate(); err != nil {
+		fmt.Println("Error: failed to migrate history schema:", err)
+		os.Exit(1)
+	}
+	metadata := runMetadata("", "")
+	metadata["mode"] = "workingset"
+	runID, err := dbHistory.StartRun(labels, metadata)
+	if err != nil {
+		fmt.Println("Error: failed to start run:", err)
+		os.Exit(1)
+	}
+	ctx = log.With(ctx, zap.Int("run_id", runID))
+	autoai.DetectServerVersion(ctx, connstr, dbHistory)
+
+	launcher := autoai.NewLauncher(dbHistory, launcherConfig())
+	result, err := launcher.RunWorkingSet(ctx, connstr, autoai.WorkingSetConfig{
+		Sizes:        sizeBytes,
+		Table:        *table,
+		TableSize:    *tableSize << 20,
+		Conns:        *conns,
+		StepDuration: *stepDuration,
+		Warmup:       *warmup,
+	})
+	_ = autoai.PrintWorkingSetResult(os.Stdout, result)
+	if err != nil && ctx.Err() == nil {
+		fmt.Println("Error: working set sweep failed:", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,435 @@
+// Package blob runs blob-style workloads: large objects (lo_*) or big bytea values written
+// and read in chunks, which stress TOAST, large object storage and the protocol very
+// differently from row ingest.
+package blob
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/petuhovskiy/overload/internal/dbconn"
+	"github.com/petuhovskiy/overload/internal/log"
+	"github.com/petuhovskiy/overload/internal/metrics"
+	"github.com/petuhovskiy/overload/internal/multi"
+	"github.com/petuhovskiy/overload/workload"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultTableName = "overload_blobs"
+	defaultSize      = 16 << 20
+	defaultChunkSize = 256 << 10
+	defaultWorkers   = 4
+	defaultDuration  = time.Minute
+	defaultReadRatio = 0.5
+	defaultKeep      = 100
+)
+
+// Storage modes.
+const (
+	// ModeLargeObject stores values as large objects, referenced by oid from the table.
+	ModeLargeObject = "lo"
+	// ModeBytea stores values in a bytea column, written with COPY and read with substring.
+	ModeBytea = "bytea"
+)
+
+// Modes are all supported storage modes.
+var Modes = []string{ModeLargeObject, ModeBytea}
+
+type Config struct {
+	Mode      string
+	TableName string
+	// Size is the size of every written value in bytes.
+	Size int
+	// ChunkSize is the size of a single write or read call, values are never held in memory whole.
+	ChunkSize int
+	// Workers is the number of concurrent connections.
+	Workers  int
+	Duration time.Duration
+	// ReadRatio is the fraction of operations reading a random stored value, others write new values.
+	// Negative value means writes only.
+	ReadRatio float64
+	// Keep is the number of stored values, older values are deleted after new writes.
+	Keep int
+}
+
+func (conf *Config) Normalize() {
+	if conf.Mode == "" {
+		conf.Mode = ModeLargeObject
+	}
+
+	if conf.TableName == "" {
+		conf.TableName = defaultTableName
+	}
+
+	if conf.Size == 0 {
+		conf.Size = defaultSize
+	}
+
+	if conf.ChunkSize == 0 {
+		conf.ChunkSize = defaultChunkSize
+	}
+
+	if conf.Workers == 0 {
+		conf.Workers = defaultWorkers
+	}
+
+	if conf.Duration == 0 {
+		conf.Duration = defaultDuration
+	}
+
+	if conf.ReadRatio == 0 {
+		conf.ReadRatio = defaultReadRatio
+	}
+
+	if conf.Keep == 0 {
+		conf.Keep = defaultKeep
+	}
+}
+
+// Result holds throughput measurements of the run.
+type Result struct {
+	Mode          string
+	Writes        int64
+	Reads         int64
+	WriteMBPerSec float64
+	ReadMBPerSec  float64
+	Errors        int64
+}
+
+// Run creates the table, then writes and reads values with all workers for the configured duration.
+func Run(ctx context.Context, connstr string, conf Config) (Result, error) {
+	conf.Normalize()
+	if err := conf.validate(); err != nil {
+		return Result{Mode: conf.Mode}, err
+	}
+
+	conn, err := dbconn.Connect(ctx, connstr)
+	if err != nil {
+		return Result{Mode: conf.Mode}, err
+	}
+	err = createTable(ctx, conn, conf.TableName)
+	conn.Close(context.Background())
+	if err != nil {
+		return Result{Mode: conf.Mode}, fmt.Errorf("failed to create table: %w", err)
+	}
+	return run(ctx, workload.Standalone(workloadName, connstr), conf)
+}
+
+func (conf *Config) validate() error {
+	if conf.Mode != ModeLargeObject && conf.Mode != ModeBytea {
+		return fmt.Errorf("unknown blob mode %q", conf.Mode)
+	}
+	return nil
+}
+
+// run writes and reads values in the created table, connecting with the emitter.
+func run(ctx context.Context, e workload.Emitter, conf Config) (Result, error) {
+	res := Result{Mode: conf.Mode}
+	ctx = log.With(ctx, zap.String("mode", conf.Mode))
+	log.Info(ctx, "blob workload started", zap.Any("conf", conf))
+
+	labels := []string{"mode", conf.Mode, "table", conf.TableName}
+	written := metrics.Default.Counter("blob_written_bytes_total", labels...)
+	read := metrics.Default.Counter("blob_read_bytes_total", labels...)
+	writes := metrics.Default.Counter("blob_writes_total", labels...)
+	reads := metrics.Default.Counter("blob_reads_total", labels...)
+	errs := metrics.Default.Counter("blob_errors_total", labels...)
+	startWritten, startRead := written.Value(), read.Value()
+	startWrites, startReads, startErrs := writes.Value(), reads.Value(), errs.Value()
+
+	runCtx, cancel := context.WithTimeout(ctx, conf.Duration)
+	defer cancel()
+	start := time.Now()
+
+	err := multi.RunWorkers(runCtx, conf.Workers, func(ctx context.Context, _ int) error {
+		return runWorker(ctx, e, conf)
+	})
+
+	elapsed := time.Since(start).Seconds()
+	res.Writes = writes.Value() - startWrites
+	res.Reads = reads.Value() - startReads
+	res.Errors = errs.Value() - startErrs
+	res.WriteMBPerSec = float64(written.Value()-startWritten) / elapsed / (1 << 20)
+	res.ReadMBPerSec = float64(read.Value()-startRead) / elapsed / (1 << 20)
+	log.Info(ctx, "blob workload finished", zap.Any("result", res))
+	return res, err
+}
+
+func createTable(ctx context.Context, conn *pgx.Conn, table string) error {
+	_, err := conn.Exec(ctx, fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+			id bigserial PRIMARY KEY,
+			lo oid,
+			data bytea,
+			size bigint NOT NULL
+		)`, pgx.Identifier{table}.Sanitize()))
+	return err
+}
+
+// worker executes operations on a single connection.
+type worker struct {
+	conn   *pgx.Conn
+	record func(op string, latency time.Duration, err error)
+	conf   Config
+	table  string
+	buf    []byte
+	rng    *rand.Rand
+	// bytes generates the written values
+	bytes *rand.ChaCha8
+
+	written      *metrics.Counter
+	read         *metrics.Counter
+	writes       *metrics.Counter
+	reads        *metrics.Counter
+	errs         *metrics.Counter
+	writeLatency *metrics.Histogram
+	readLatency  *metrics.Histogram
+}
+
+func runWorker(ctx context.Context, e workload.Emitter, conf Config) error {
+	conn, err := e.Connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	labels := []string{"mode", conf.Mode, "table", conf.TableName}
+	bytes := newChaCha8()
+	w := &worker{
+		conn:         conn,
+		record:       e.Record,
+		conf:         conf,
+		table:        pgx.Identifier{conf.TableName}.Sanitize(),
+		buf:          make([]byte, conf.ChunkSize),
+		rng:          rand.New(bytes),
+		bytes:        bytes,
+		written:      metrics.Default.Counter("blob_written_bytes_total", labels...),
+		read:         metrics.Default.Counter("blob_read_bytes_total", labels...),
+		writes:       metrics.Default.Counter("blob_writes_total", labels...),
+		reads:        metrics.Default.Counter("blob_reads_total", labels...),
+		errs:         metrics.Default.Counter("blob_errors_total", labels...),
+		writeLatency: metrics.Default.Histogram("blob_write_seconds", labels...),
+		readLatency:  metrics.Default.Histogram("blob_read_seconds", labels...),
+	}
+
+	for ctx.Err() == nil {
+		var err error
+		if w.rng.Float64() < conf.ReadRatio {
+			err = w.readRandom(ctx)
+		} else {
+			err = w.write(ctx)
+		}
+		if err != nil && ctx.Err() == nil {
+			w.errs.Inc()
+			// broken connections can't be used anymore, other errors are part of the workload
+			if conn.IsClosed() {
+				return err
+			}
+			log.Warn(ctx, "blob operation failed", zap.Error(err))
+		}
+	}
+	return nil
+}
+
+// newChaCha8 returns a randomly seeded generator, which unlike rand.Rand fills byte slices.
+func newChaCha8() *rand.ChaCha8 {
+	var seed [32]byte
+	for i := 0; i < len(seed); i += 8 {
+		binary.LittleEndian.PutUint64(seed[i:], rand.Uint64())
+	}
+	return rand.NewChaCha8(seed)
+}
+
+// write stores a new random value and deletes the oldest values above the limit.
+func (w *worker) write(ctx context.Context) error {
+	start := time.Now()
+	var err error
+	if w.conf.Mode == ModeLargeObject {
+		err = w.writeLargeObject(ctx)
+	} else {
+		err = w.writeBytea(ctx)
+	}
+	w.record("write", time.Since(start), err)
+	if err != nil {
+		return err
+	}
+	w.writeLatency.Observe(time.Since(start).Seconds())
+	w.writes.Inc()
+	w.written.Add(int64(w.conf.Size))
+	return w.deleteOld(ctx)
+}
+
+func (w *worker) writeLargeObject(ctx context.Context) error {
+	return pgx.BeginFunc(ctx, w.conn, func(tx pgx.Tx) error {
+		los := tx.LargeObjects()
+		oid, err := los.Create(ctx, 0)
+		if err != nil {
+			return err
+		}
+		obj, err := los.Open(ctx, oid, pgx.LargeObjectModeWrite)
+		if err != nil {
+			return err
+		}
+		for left := w.conf.Size; left > 0; left -= len(w.buf) {
+			chunk := w.buf[:min(left, len(w.buf))]
+			w.bytes.Read(chunk)
+			if _, err := obj.Write(chunk); err != nil {
+				return err
+			}
+		}
+		if err := obj.Close(); err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, fmt.Sprintf(`INSERT INTO %s (lo, size) VALUES ($1, $2)`, w.table), oid, w.conf.Size)
+		return err
+	})
+}
+
+// writeBytea streams the value with COPY in text format, hex-encoding chunks on the fly.
+func (w *worker) writeBytea(ctx context.Context) error {
+	r, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(w.encodeBytea(pw))
+	}()
+	defer r.Close()
+
+	_, err := w.conn.PgConn().CopyFrom(ctx, r, fmt.Sprintf(`COPY %s (data, size) FROM STDIN`, w.table))
+	return err
+}
+
+// encodeBytea writes a single COPY text row with the random value and its size.
+func (w *worker) encodeBytea(out io.Writer) error {
+	const hexDigits = "0123456789abcdef"
+	hex := make([]byte, 2*len(w.buf))
+
+	if _, err := io.WriteString(out, `\\x`); err != nil {
+		return err
+	}
+	for left := w.conf.Size; left > 0; left -= len(w.buf) {
+		chunk := w.buf[:min(left, len(w.buf))]
+		w.bytes.Read(chunk)
+		for i, b := range chunk {
+			hex[2*i], hex[2*i+1] = hexDigits[b>>4], hexDigits[b&0x0f]
+		}
+		if _, err := out.Write(hex[:2*len(chunk)]); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(out, "\t%d\n", w.conf.Size)
+	return err
+}
+
+// readRandom reads a random stored value chunk by chunk, or writes one if there are none.
+func (w *worker) readRandom(ctx context.Context) error {
+	var id int64
+	var oid *uint32
+	var size int64
+	err := w.conn.QueryRow(ctx, fmt.Sprintf(`
+		SELECT id, lo, size FROM %[1]s
+		WHERE id >= (SELECT min(id) + floor(random() * (max(id) - min(id) + 1)) FROM %[1]s)
+		ORDER BY id LIMIT 1`, w.table)).Scan(&id, &oid, &size)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return w.write(ctx)
+	}
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	var n int64
+	if oid != nil {
+		n, err = w.readLargeObject(ctx, *oid)
+	} else {
+		n, err = w.readBytea(ctx, id, size)
+	}
+	w.read.Add(n)
+	w.record("read", time.Since(start), err)
+	if err != nil {
+		return err
+	}
+	w.readLatency.Observe(time.Since(start).Seconds())
+	w.reads.Inc()
+	return nil
+}
+
+func (w *worker) readLargeObject(ctx context.Context, oid uint32) (int64, error) {
+	var n int64
+	err := pgx.BeginFunc(ctx, w.conn, func(tx pgx.Tx) error {
+		los := tx.LargeObjects()
+		obj, err := los.Open(ctx, oid, pgx.LargeObjectModeRead)
+		if err != nil {
+			return err
+		}
+		for {
+			read, err := obj.Read(w.buf)
+			n += int64(read)
+			if err == io.EOF || (err == nil && read == 0) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+	})
+	return n, err
+}
+
+func (w *worker) readBytea(ctx context.Context, id, size int64) (int64, error) {
+	var n int64
+	for n < size {
+		var chunk []byte
+		// substring positions are 1-based
+		err := w.conn.QueryRow(ctx, fmt.Sprintf(`SELECT substring(data FROM $2 FOR $3) FROM %s WHERE id = $1`, w.table),
+			id, n+1, len(w.buf)).Scan(&chunk)
+		if err != nil {
+			return n, err
+		}
+		if len(chunk) == 0 {
+			break
+		}
+		n += int64(len(chunk))
+	}
+	return n, nil
+}
+
+// deleteOld deletes the oldest values above the Keep limit, unlinking their large objects.
+func (w *worker) deleteOld(ctx context.Context) error {
+	rows, err := w.conn.Query(ctx, fmt.Sprintf(`
+		DELETE FROM %[1]s WHERE id <= (SELECT max(id) FROM %[1]s) - $1
+		RETURNING lo`, w.table), w.conf.Keep)
+	if err != nil {
+		return err
+	}
+	oids, err := pgx.CollectRows(rows, pgx.RowTo[*uint32])
+	if err != nil {
+		return err
+	}
+	for _, oid := range oids {
+		if oid == nil {
+			continue
+		}
+		if _, err := w.conn.Exec(ctx, `SELECT lo_unlink($1)`, *oid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PrintResults prints the throughput table.
+func PrintResults(w io.Writer, results []Result) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "MODE\tWRITES\tWRITE MB/S\tREADS\tREAD MB/S\tERRORS")
+	for _, r := range results {
+		fmt.Fprintf(tw, "%s\t%d\t%.1f\t%d\t%.1f\t%d\n",
+			r.Mode, r.Writes, r.WriteMBPerSec, r.Reads, r.ReadMBPerSec, r.Errors)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,39 @@
+package blob
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/petuhovskiy/overload/workload"
+)
+
+const workloadName = "blob"
+
+func init() {
+	workload.Register(workloadName, "large objects written and read in chunks, like bench blobs", func() workload.Workload {
+		return &Workload{}
+	})
+}
+
+// Workload runs the blob benchmark with Config for its duration as a custom workload,
+// reporting writes and reads as operations.
+type Workload struct {
+	Config Config
+}
+
+func (w *Workload) Setup(ctx context.Context, conn *pgx.Conn) error {
+	w.Config.Normalize()
+	if err := w.Config.validate(); err != nil {
+		return err
+	}
+	return createTable(ctx, conn, w.Config.TableName)
+}
+
+func (w *Workload) Run(ctx context.Context, e workload.Emitter) error {
+	_, err := run(ctx, e, w.Config)
+	return err
+}
+
+func (w *Workload) Teardown(context.Context, *pgx.Conn) error {
+	return nil
+}
@@ -0,0 +1,492 @@
+// Package gin stresses GIN index maintenance: rows with tsvector or jsonb documents are
+// inserted and updated under a GIN index, while the pending list of the index is sampled.
+// With fastupdate on, new entries are appended to the pending list and moved into the index
+// in bulk when the list overflows, stalling the unlucky writer doing the cleanup.
+package gin
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"strings"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/petuhovskiy/overload/internal/dbconn"
+	"github.com/petuhovskiy/overload/internal/log"
+	"github.com/petuhovskiy/overload/internal/metrics"
+	"github.com/petuhovskiy/overload/internal/multi"
+	"github.com/petuhovskiy/overload/workload"
+	"go.uber.org/zap"
+)
+
+const (
+	// ModeTsvector indexes a tsvector column built from random words.
+	ModeTsvector = "tsvector"
+	// ModeJsonb indexes a jsonb column with random keys and values.
+	ModeJsonb = "jsonb"
+)
+
+// Modes are all supported document types.
+var Modes = []string{ModeTsvector, ModeJsonb}
+
+const (
+	defaultMode           = ModeTsvector
+	defaultRows           = 100_000
+	defaultWorkers        = 8
+	defaultDuration       = time.Minute
+	defaultBatchSize      = 100
+	defaultUpdateRatio    = 0.3
+	defaultWords          = 20
+	defaultStallThreshold = 500 * time.Millisecond
+	defaultSampleInterval = time.Second
+)
+
+// vocabularySize is the number of distinct words, small enough for posting lists to be long.
+const vocabularySize = 50_000
+
+type Config struct {
+	Mode string
+	// TableName defaults to overload_gin_<mode>.
+	TableName string
+	// FastUpdate sets the fastupdate storage parameter of the index, PendingListLimit sets
+	// gin_pending_list_limit in KB, zero keeps the server default.
+	FastUpdate       bool
+	PendingListLimit int
+	// Rows is the number of documents the index starts with, existing rows are kept.
+	Rows     int
+	Workers  int
+	Duration time.Duration
+	// BatchSize is the number of rows in a single insert.
+	BatchSize int
+	// UpdateRatio is the fraction of operations updating a random existing row,
+	// negative value means inserts only.
+	UpdateRatio float64
+	// Words is the number of words or keys in a document.
+	Words int
+	// StallThreshold is the write latency counted as a stall.
+	StallThreshold time.Duration
+	// SampleInterval is how often the pending list is sampled.
+	SampleInterval time.Duration
+}
+
+func (conf *Config) Normalize() {
+	if conf.Mode == "" {
+		conf.Mode = defaultMode
+	}
+
+	if conf.TableName == "" {
+		conf.TableName = "overload_gin_" + conf.Mode
+	}
+
+	if conf.Rows == 0 {
+		conf.Rows = defaultRows
+	}
+
+	if conf.Workers == 0 {
+		conf.Workers = defaultWorkers
+	}
+
+	if conf.Duration == 0 {
+		conf.Duration = defaultDuration
+	}
+
+	if conf.BatchSize == 0 {
+		conf.BatchSize = defaultBatchSize
+	}
+
+	if conf.UpdateRatio == 0 {
+		conf.UpdateRatio = defaultUpdateRatio
+	}
+
+	if conf.Words == 0 {
+		conf.Words = defaultWords
+	}
+
+	if conf.StallThreshold == 0 {
+		conf.StallThreshold = defaultStallThreshold
+	}
+
+	if conf.SampleInterval == 0 {
+		conf.SampleInterval = defaultSampleInterval
+	}
+}
+
+// Result holds measurements of a single run.
+type Result struct {
+	Mode       string
+	FastUpdate bool
+	Inserts    int64
+	Updates    int64
+	RowsPerSec float64
+	Errors     int64
+	// AvgLatency and MaxLatency are the latencies of write statements, Stalls is the number
+	// of statements slower than the stall threshold.
+	AvgLatency time.Duration
+	MaxLatency time.Duration
+	Stalls     int64
+	// PeakPendingPages and PeakPendingTuples are the max size of the pending list, Cleanups is
+	// the number of samples where the pending list shrank. Sampled with pgstattuple.
+	PeakPendingPages  int64
+	PeakPendingTuples int64
+	Cleanups          int64
+}
+
+// Run sets up the table, then inserts and updates documents with all workers for the configured duration.
+func Run(ctx context.Context, connstr string, conf Config) (Result, error) {
+	conf.Normalize()
+	if err := conf.validate(); err != nil {
+		return Result{Mode: conf.Mode, FastUpdate: conf.FastUpdate}, err
+	}
+
+	conn, err := dbconn.Connect(ctx, connstr)
+	if err != nil {
+		return Result{Mode: conf.Mode, FastUpdate: conf.FastUpdate}, err
+	}
+	err = setupTable(ctx, conn, conf)
+	conn.Close(context.Background())
+	if err != nil {
+		return Result{Mode: conf.Mode, FastUpdate: conf.FastUpdate}, fmt.Errorf("failed to set up table: %w", err)
+	}
+	return run(ctx, workload.Standalone(workloadName, connstr), conf)
+}
+
+func (conf *Config) validate() error {
+	if conf.Mode != ModeTsvector && conf.Mode != ModeJsonb {
+		return fmt.Errorf("unknown gin mode %q", conf.Mode)
+	}
+	return nil
+}
+
+// run writes documents to the table, connecting with the emitter.
+func run(ctx context.Context, e workload.Emitter, conf Config) (Result, error) {
+	res := Result{Mode: conf.Mode, FastUpdate: conf.FastUpdate}
+	ctx = log.With(ctx, zap.String("mode", conf.Mode), zap.Bool("fastupdate", conf.FastUpdate))
+	log.Info(ctx, "gin workload started", zap.Any("conf", conf))
+
+	// the connection of the run reads the max id and samples the pending list
+	conn, err := e.Connect(ctx)
+	if err != nil {
+		return res, err
+	}
+	defer conn.Close(context.Background())
+
+	var maxID int64
+	err = conn.QueryRow(ctx, fmt.Sprintf("SELECT COALESCE(max(id), 0) FROM %s", pgx.Identifier{conf.TableName}.Sanitize())).Scan(&maxID)
+	if err != nil {
+		return res, err
+	}
+
+	runCtx, cancel := context.WithTimeout(ctx, conf.Duration)
+	defer cancel()
+	start := time.Now()
+
+	s := &sampler{conf: conf, conn: conn}
+	samplerDone := make(chan struct{})
+	go func() {
+		defer close(samplerDone)
+		s.run(runCtx)
+	}()
+
+	ids := &atomic.Int64{}
+	ids.Store(maxID)
+	workers := make([]*worker, conf.Workers)
+	for i := range workers {
+		workers[i] = newWorker(conf, ids, e.Record)
+	}
+	err = multi.RunWorkers(runCtx, conf.Workers, func(ctx context.Context, i int) error {
+		return workers[i].run(ctx, e)
+	})
+	<-samplerDone
+
+	var statements int64
+	var latency time.Duration
+	for _, w := range workers {
+		res.Inserts += w.inserts
+		res.Updates += w.updates
+		res.Errors += w.errors
+		res.Stalls += w.stalls
+		res.MaxLatency = max(res.MaxLatency, w.maxLatency)
+		latency += w.latencySum
+		statements += w.statements
+	}
+	if statements > 0 {
+		res.AvgLatency = latency / time.Duration(statements)
+	}
+	res.RowsPerSec = float64(res.Inserts+res.Updates) / time.Since(start).Seconds()
+	res.PeakPendingPages = s.peakPages
+	res.PeakPendingTuples = s.peakTuples
+	res.Cleanups = s.cleanups
+	log.Info(ctx, "gin workload finished", zap.Any("result", res))
+	return res, err
+}
+
+// setupTable creates and seeds the table, creates the index and applies fastupdate settings to it.
+func setupTable(ctx context.Context, conn *pgx.Conn, conf Config) error {
+	table := pgx.Identifier{conf.TableName}.Sanitize()
+	index := pgx.Identifier{conf.TableName + "_doc"}.Sanitize()
+	_, err := conn.Exec(ctx, fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %[1]s (
+			id bigserial PRIMARY KEY,
+			doc %[2]s NOT NULL,
+			updated_at timestamptz NOT NULL DEFAULT now()
+		);
+		CREATE INDEX IF NOT EXISTS %[3]s ON %[1]s USING gin (doc)`,
+		table, conf.Mode, index))
+	if err != nil {
+		return err
+	}
+
+	params := []string{fmt.Sprintf("fastupdate = %t", conf.FastUpdate)}
+	if conf.PendingListLimit > 0 {
+		params = append(params, fmt.Sprintf("gin_pending_list_limit = %d", conf.PendingListLimit))
+	}
+	_, err = conn.Exec(ctx, fmt.Sprintf("ALTER INDEX %s SET (%s)", index, strings.Join(params, ", ")))
+	if err != nil {
+		return fmt.Errorf("failed to set index parameters: %w", err)
+	}
+	if conf.PendingListLimit <= 0 {
+		_, err = conn.Exec(ctx, fmt.Sprintf("ALTER INDEX %s RESET (gin_pending_list_limit)", index))
+		if err != nil {
+			return err
+		}
+	}
+
+	var rows int64
+	if err := conn.QueryRow(ctx, fmt.Sprintf("SELECT count(*) FROM %s", table)).Scan(&rows); err != nil {
+		return err
+	}
+	if rows == 0 {
+		log.Info(ctx, "seeding gin table", zap.Int("rows", conf.Rows))
+		rng := rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64()))
+		for seeded := 0; seeded < conf.Rows; seeded += 1000 {
+			docs := make([]string, min(1000, conf.Rows-seeded))
+			for i := range docs {
+				docs[i] = document(rng, conf)
+			}
+			if _, err := conn.Exec(ctx, insertSQL(table, conf.Mode), docs); err != nil {
+				return err
+			}
+		}
+		if _, err := conn.Exec(ctx, fmt.Sprintf("ANALYZE %s", table)); err != nil {
+			return err
+		}
+	}
+
+	// every run starts with an empty pending list, left over entries are merged into the index
+	_, err = conn.Exec(ctx, "SELECT gin_clean_pending_list($1::regclass)", index)
+	if err != nil {
+		return fmt.Errorf("failed to clean pending list: %w", err)
+	}
+	return nil
+}
+
+// insertSQL returns the statement inserting documents passed as a text array.
+func insertSQL(table, mode string) string {
+	if mode == ModeJsonb {
+		return fmt.Sprintf(`INSERT INTO %s (doc) SELECT d::jsonb FROM unnest($1::text[]) d`, table)
+	}
+	return fmt.Sprintf(`INSERT INTO %s (doc) SELECT to_tsvector('simple', d) FROM unnest($1::text[]) d`, table)
+}
+
+// updateSQL returns the statement replacing the document of a row.
+func updateSQL(table, mode string) string {
+	if mode == ModeJsonb {
+		return fmt.Sprintf(`UPDATE %s SET doc = $2::jsonb, updated_at = now() WHERE id = $1`, table)
+	}
+	return fmt.Sprintf(`UPDATE %s SET doc = to_tsvector('simple', $2), updated_at = now() WHERE id = $1`, table)
+}
+
+// document returns a random text document, or a random flat json object in jsonb mode.
+// Words are skewed towards the start of the vocabulary, like in natural texts.
+func document(rng *rand.Rand, conf Config) string {
+	var sb strings.Builder
+	if conf.Mode == ModeJsonb {
+		sb.WriteByte('{')
+	}
+	for i := range conf.Words {
+		word := int(float64(vocabularySize) * rng.Float64() * rng.Float64())
+		if conf.Mode == ModeJsonb {
+			if i > 0 {
+				sb.WriteByte(',')
+			}
+			fmt.Fprintf(&sb, `"k%d":"w%d"`, i, word)
+		} else {
+			if i > 0 {
+				sb.WriteByte(' ')
+			}
+			fmt.Fprintf(&sb, "w%d", word)
+		}
+	}
+	if conf.Mode == ModeJsonb {
+		sb.WriteByte('}')
+	}
+	return sb.String()
+}
+
+// worker inserts and updates documents on a single connection.
+type worker struct {
+	conf    Config
+	table   string
+	ids     *atomic.Int64
+	rng     *rand.Rand
+	latency *metrics.Histogram
+	record  func(op string, latency time.Duration, err error)
+
+	inserts    int64
+	updates    int64
+	errors     int64
+	stalls     int64
+	statements int64
+	latencySum time.Duration
+	maxLatency time.Duration
+}
+
+func newWorker(conf Config, ids *atomic.Int64, record func(op string, latency time.Duration, err error)) *worker {
+	return &worker{
+		record:  record,
+		conf:    conf,
+		table:   pgx.Identifier{conf.TableName}.Sanitize(),
+		ids:     ids,
+		rng:     rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64())),
+		latency: metrics.Default.Histogram("gin_write_seconds", "mode", conf.Mode, "table", conf.TableName),
+	}
+}
+
+func (w *worker) run(ctx context.Context, e workload.Emitter) error {
+	conn, err := e.Connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	labels := []string{"mode", w.conf.Mode, "table", w.conf.TableName}
+	rowsCounter := metrics.Default.Counter("gin_rows_total", labels...)
+	stallsCounter := metrics.Default.Counter("gin_stalls_total", labels...)
+	errorsCounter := metrics.Default.Counter("gin_errors_total", labels...)
+
+	insert, update := insertSQL(w.table, w.conf.Mode), updateSQL(w.table, w.conf.Mode)
+	for ctx.Err() == nil {
+		isUpdate := w.rng.Float64() < w.conf.UpdateRatio && w.ids.Load() > 0
+
+		start := time.Now()
+		var rows int
+		if isUpdate {
+			id := w.rng.Int64N(w.ids.Load()) + 1
+			_, err = conn.Exec(ctx, update, id, document(w.rng, w.conf))
+			rows = 1
+		} else {
+			docs := make([]string, w.conf.BatchSize)
+			for i := range docs {
+				docs[i] = document(w.rng, w.conf)
+			}
+			_, err = conn.Exec(ctx, insert, docs)
+			if err == nil {
+				w.ids.Add(int64(len(docs)))
+				rows = len(docs)
+			}
+		}
+		elapsed := time.Since(start)
+		op := "insert"
+		if isUpdate {
+			op = "update"
+		}
+
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			w.record(op, elapsed, err)
+			w.errors++
+			errorsCounter.Inc()
+			log.Warn(ctx, "gin write failed", zap.Error(err))
+			if conn.IsClosed() {
+				return err
+			}
+			continue
+		}
+
+		w.record(op, elapsed, nil)
+		if isUpdate {
+			w.updates++
+		} else {
+			w.inserts += int64(rows)
+		}
+		rowsCounter.Add(int64(rows))
+		w.latency.Observe(elapsed.Seconds())
+		w.statements++
+		w.latencySum += elapsed
+		w.maxLatency = max(w.maxLatency, elapsed)
+		if elapsed >= w.conf.StallThreshold {
+			w.stalls++
+			stallsCounter.Inc()
+			log.Info(ctx, "gin write stalled", zap.Duration("latency", elapsed), zap.Bool("update", isUpdate))
+		}
+	}
+	return nil
+}
+
+// sampler periodically reads the size of the pending list of the index.
+type sampler struct {
+	conf Config
+	conn *pgx.Conn
+
+	peakPages  int64
+	peakTuples int64
+	cleanups   int64
+}
+
+func (s *sampler) run(ctx context.Context) {
+	if _, err := s.conn.Exec(ctx, "CREATE EXTENSION IF NOT EXISTS pgstattuple"); err != nil {
+		log.Warn(ctx, "pgstattuple is not available, pending list is not sampled", zap.Error(err))
+		return
+	}
+
+	labels := []string{"mode", s.conf.Mode, "table", s.conf.TableName}
+	pagesGauge := metrics.Default.Gauge("gin_pending_pages", labels...)
+	tuplesGauge := metrics.Default.Gauge("gin_pending_tuples", labels...)
+
+	var prevPages int64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(s.conf.SampleInterval):
+		}
+
+		var pages, tuples int64
+		err := s.conn.QueryRow(ctx, "SELECT pending_pages::bigint, pending_tuples FROM pgstatginindex($1::regclass)",
+			pgx.Identifier{s.conf.TableName + "_doc"}.Sanitize()).Scan(&pages, &tuples)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Warn(ctx, "failed to sample pending list, sampling disabled", zap.Error(err))
+			}
+			return
+		}
+		pagesGauge.Set(float64(pages))
+		tuplesGauge.Set(float64(tuples))
+
+		s.peakPages = max(s.peakPages, pages)
+		s.peakTuples = max(s.peakTuples, tuples)
+		if pages < prevPages {
+			s.cleanups++
+		}
+		prevPages = pages
+	}
+}
+
+// PrintResults prints the table of all runs.
+func PrintResults(w io.Writer, results []Result) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "MODE\tFASTUPDATE\tROWS/S\tINSERTS\tUPDATES\tAVG LATENCY\tMAX LATENCY\tSTALLS\tPEAK PENDING PAGES\tPEAK PENDING TUPLES\tCLEANUPS\tERRORS")
+	for _, r := range results {
+		fmt.Fprintf(tw, "%s\t%t\t%.0f\t%d\t%d\t%s\t%s\t%d\t%d\t%d\t%d\t%d\n",
+			r.Mode, r.FastUpdate, r.RowsPerSec, r.Inserts, r.Updates,
+			r.AvgLatency.Round(time.Microsecond), r.MaxLatency.Round(time.Millisecond), r.Stalls,
+			r.PeakPendingPages, r.PeakPendingTuples, r.Cleanups, r.Errors)
+	}
+	tw.Flush()
+}
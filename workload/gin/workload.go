@@ -0,0 +1,39 @@
+package gin
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/petuhovskiy/overload/workload"
+)
+
+const workloadName = "gin"
+
+func init() {
+	workload.Register(workloadName, "inserts and updates of tsvector documents under a GIN index, like bench gin", func() workload.Workload {
+		return &Workload{}
+	})
+}
+
+// Workload runs the GIN benchmark with Config for its duration as a custom workload,
+// reporting inserts and updates as operations.
+type Workload struct {
+	Config Config
+}
+
+func (w *Workload) Setup(ctx context.Context, conn *pgx.Conn) error {
+	w.Config.Normalize()
+	if err := w.Config.validate(); err != nil {
+		return err
+	}
+	return setupTable(ctx, conn, w.Config)
+}
+
+func (w *Workload) Run(ctx context.Context, e workload.Emitter) error {
+	_, err := run(ctx, e, w.Config)
+	return err
+}
+
+func (w *Workload) Teardown(context.Context, *pgx.Conn) error {
+	return nil
+}
@@ -0,0 +1,92 @@
+package workload
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/petuhovskiy/overload/autoai"
+)
+
+const (
+	kvKeys        = 100000
+	kvImportRows  = 1000
+	kvImportPause = time.Second
+)
+
+func init() {
+	Register("kv", "key-value gets and puts with periodic COPY imports, a reference for custom workloads", func() Workload {
+		return &kv{}
+	})
+}
+
+// kv is a key-value workload: a mix of point gets and upserts executed by the launcher, and
+// COPY imports of new keys executed on its own connection and reported with Record.
+type kv struct{}
+
+func (kv) Setup(ctx context.Context, conn *pgx.Conn) error {
+	_, err := conn.Exec(ctx, fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS workload_kv (k bigint PRIMARY KEY, v text NOT NULL);
+		INSERT INTO workload_kv SELECT k, md5(k::text) FROM generate_series(1, %d) k ON CONFLICT DO NOTHING;
+		CREATE TABLE IF NOT EXISTS workload_kv_import (k bigint, v text);`, kvKeys))
+	return err
+}
+
+func (kv) Run(ctx context.Context, e Emitter) error {
+	queries, err := autoai.ParseQueries(fmt.Sprintf(`
+		-- weight: 4
+		-- param: k uniform 1 %[1]d
+		SELECT v FROM workload_kv WHERE k = :k;
+
+		-- param: k uniform 1 %[1]d
+		INSERT INTO workload_kv VALUES (:k, md5(random()::text)) ON CONFLICT (k) DO UPDATE SET v = excluded.v;`, kvKeys))
+	if err != nil {
+		return err
+	}
+
+	// imports run while the mix does
+	importCtx, stopImports := context.WithCancel(ctx)
+	importDone := make(chan error, 1)
+	go func() { importDone <- runImports(importCtx, e) }()
+	err = e.Mix(ctx, queries)
+	stopImports()
+	if importErr := <-importDone; err == nil {
+		err = importErr
+	}
+	return err
+}
+
+// runImports copies batches of rows into the import table until ctx is done.
+func runImports(ctx context.Context, e Emitter) error {
+	conn, err := e.Connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	rows := make([][]any, kvImportRows)
+	for {
+		for i := range rows {
+			rows[i] = []any{rand.Int63n(kvKeys), fmt.Sprint(rand.Int63())}
+		}
+		start := time.Now()
+		_, err := conn.CopyFrom(ctx, pgx.Identifier{"workload_kv_import"}, []string{"k", "v"}, pgx.CopyFromRows(rows))
+		if ctx.Err() != nil {
+			return nil
+		}
+		e.Record("copy", time.Since(start), err)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(kvImportPause):
+		}
+	}
+}
+
+func (kv) Teardown(ctx context.Context, conn *pgx.Conn) error {
+	_, err := conn.Exec(ctx, "TRUNCATE workload_kv_import")
+	return err
+}
@@ -0,0 +1,333 @@
+// Package prepared stresses the server-side plan cache: every session prepares thousands of
+// distinct statements over skewed data, so that the server switches between custom and generic
+// plans and the backend memory grows with cached plans until they are deallocated.
+package prepared
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/petuhovskiy/overload/internal/dbconn"
+	"github.com/petuhovskiy/overload/internal/log"
+	"github.com/petuhovskiy/overload/internal/metrics"
+	"github.com/petuhovskiy/overload/internal/multi"
+	"github.com/petuhovskiy/overload/workload"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultTableName       = "overload_prepared"
+	defaultRows            = 100_000
+	defaultStatements      = 2000
+	defaultWorkers         = 8
+	defaultDuration        = time.Minute
+	defaultDeallocateEvery = 50_000
+	defaultSampleInterval  = 5 * time.Second
+)
+
+// hotKey is the value of k in most of the rows, so that the best plan depends on the parameter.
+const hotKey = 0
+
+type Config struct {
+	TableName string
+	// Rows is the size of the skewed table, it's seeded only if empty.
+	Rows int
+	// Statements is the number of distinct statements prepared by every session.
+	Statements int
+	Workers    int
+	Duration   time.Duration
+	// DeallocateEvery is the number of executions per session between DEALLOCATE ALL.
+	// Negative value disables deallocation, so the cache only grows.
+	DeallocateEvery int
+	// PlanCacheMode sets plan_cache_mode of the sessions, e.g. force_generic_plan,
+	// empty keeps the server default.
+	PlanCacheMode string
+	// SampleInterval is how often every session samples its own memory and plan counters.
+	SampleInterval time.Duration
+}
+
+func (conf *Config) Normalize() {
+	if conf.TableName == "" {
+		conf.TableName = defaultTableName
+	}
+
+	if conf.Rows == 0 {
+		conf.Rows = defaultRows
+	}
+
+	if conf.Statements == 0 {
+		conf.Statements = defaultStatements
+	}
+
+	if conf.Workers == 0 {
+		conf.Workers = defaultWorkers
+	}
+
+	if conf.Duration == 0 {
+		conf.Duration = defaultDuration
+	}
+
+	if conf.DeallocateEvery == 0 {
+		conf.DeallocateEvery = defaultDeallocateEvery
+	}
+
+	if conf.SampleInterval == 0 {
+		conf.SampleInterval = defaultSampleInterval
+	}
+}
+
+// Result holds measurements of the run.
+type Result struct {
+	Executions  int64
+	QPS         float64
+	Errors      int64
+	Prepares    int64
+	PrepareAvg  time.Duration
+	Deallocates int64
+	// PeakBackendMemory is the max memory of a single session, PeakPlanCacheMemory is the part
+	// of it held by cached plans. Both are sampled from pg_backend_memory_contexts (Postgres 14+).
+	PeakBackendMemory   int64
+	PeakPlanCacheMemory int64
+	// GenericPlans and CustomPlans are the plan counters of the statements at the last sample,
+	// summed over sessions (Postgres 14+).
+	GenericPlans int64
+	CustomPlans  int64
+}
+
+// Run sets up the table, then prepares and executes statements with all workers for the configured duration.
+func Run(ctx context.Context, connstr string, conf Config) (Result, error) {
+	conf.Normalize()
+	conn, err := dbconn.Connect(ctx, connstr)
+	if err != nil {
+		return Result{}, err
+	}
+	err = setupTable(ctx, conn, conf)
+	conn.Close(context.Background())
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to set up table: %w", err)
+	}
+	return run(ctx, workload.Standalone(workloadName, connstr), conf)
+}
+
+// run executes statements on the table, connecting with the emitter.
+func run(ctx context.Context, e workload.Emitter, conf Config) (Result, error) {
+	log.Info(ctx, "prepared statements workload started", zap.Any("conf", conf))
+
+	runCtx, cancel := context.WithTimeout(ctx, conf.Duration)
+	defer cancel()
+	start := time.Now()
+
+	workers := make([]*worker, conf.Workers)
+	for i := range workers {
+		workers[i] = newWorker(conf, e.Record)
+	}
+	err := multi.RunWorkers(runCtx, conf.Workers, func(ctx context.Context, i int) error {
+		return workers[i].run(ctx, e)
+	})
+
+	res := Result{}
+	var prepareTime time.Duration
+	for _, w := range workers {
+		res.Executions += w.executions
+		res.Errors += w.errors
+		res.Prepares += w.prepares
+		res.Deallocates += w.deallocates
+		res.PeakBackendMemory = max(res.PeakBackendMemory, w.peakMemory)
+		res.PeakPlanCacheMemory = max(res.PeakPlanCacheMemory, w.peakPlanMemory)
+		res.GenericPlans += w.genericPlans
+		res.CustomPlans += w.customPlans
+		prepareTime += w.prepareTime
+	}
+	res.QPS = float64(res.Executions) / time.Since(start).Seconds()
+	if res.Prepares > 0 {
+		res.PrepareAvg = prepareTime / time.Duration(res.Prepares)
+	}
+	log.Info(ctx, "prepared statements workload finished", zap.Any("result", res))
+	return res, err
+}
+
+// setupTable creates the table with a skewed column: most rows have k = hotKey, other values
+// are rare, so that a generic plan is good for some parameters and bad for others.
+func setupTable(ctx context.Context, conn *pgx.Conn, conf Config) error {
+	table := pgx.Identifier{conf.TableName}.Sanitize()
+	_, err := conn.Exec(ctx, fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %[1]s (
+			id int PRIMARY KEY,
+			k int NOT NULL,
+			v text NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS %[2]s ON %[1]s (k);
+		INSERT INTO %[1]s (id, k, v)
+		SELECT i, CASE WHEN i %% 10 = 0 THEN i ELSE %[3]d END, md5(i::text)
+		FROM generate_series(1, %[4]d) i
+		WHERE NOT EXISTS (SELECT 1 FROM %[1]s);
+		ANALYZE %[1]s`,
+		table, pgx.Identifier{conf.TableName + "_k"}.Sanitize(), hotKey, conf.Rows))
+	return err
+}
+
+// statementSQL returns the text of the i-th distinct statement. Statements have a few shapes,
+// the comment makes every text distinct.
+func statementSQL(table string, i int) string {
+	switch i % 4 {
+	case 0:
+		return fmt.Sprintf(`SELECT count(*) FROM %s WHERE k = $1 AND id > $2 /* stmt %d */`, table, i)
+	case 1:
+		return fmt.Sprintf(`SELECT id, v FROM %s WHERE k = $1 AND id > $2 ORDER BY id LIMIT 10 /* stmt %d */`, table, i)
+	case 2:
+		return fmt.Sprintf(`SELECT max(length(v)) FROM %s WHERE k = $1 OR id = $2 /* stmt %d */`, table, i)
+	default:
+		return fmt.Sprintf(`SELECT a.id FROM %[1]s a JOIN %[1]s b ON b.id = a.k WHERE a.k = $1 AND b.id > $2 LIMIT 10 /* stmt %[2]d */`, table, i)
+	}
+}
+
+// worker prepares and executes statements on a single session.
+type worker struct {
+	conf     Config
+	table    string
+	rng      *rand.Rand
+	prepared []bool
+	latency  *metrics.Histogram
+	record   func(op string, latency time.Duration, err error)
+
+	executions     int64
+	errors         int64
+	prepares       int64
+	prepareTime    time.Duration
+	deallocates    int64
+	peakMemory     int64
+	peakPlanMemory int64
+	genericPlans   int64
+	customPlans    int64
+}
+
+func newWorker(conf Config, record func(op string, latency time.Duration, err error)) *worker {
+	return &worker{
+		record:   record,
+		conf:     conf,
+		table:    pgx.Identifier{conf.TableName}.Sanitize(),
+		rng:      rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64())),
+		prepared: make([]bool, conf.Statements),
+		latency:  metrics.Default.Histogram("prepared_exec_seconds", "table", conf.TableName),
+	}
+}
+
+func (w *worker) run(ctx context.Context, e workload.Emitter) error {
+	conn, err := e.Connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+	if w.conf.PlanCacheMode != "" {
+		if _, err := conn.Exec(ctx, "SELECT set_config('plan_cache_mode', $1, false)", w.conf.PlanCacheMode); err != nil {
+			return fmt.Errorf("failed to set plan_cache_mode: %w", err)
+		}
+	}
+
+	executions := metrics.Default.Counter("prepared_executions_total", "table", w.conf.TableName)
+	errorsCounter := metrics.Default.Counter("prepared_errors_total", "table", w.conf.TableName)
+	memory := metrics.Default.Gauge("prepared_backend_memory_bytes", "table", w.conf.TableName)
+
+	sampling := true
+	lastSample := time.Now()
+	sinceDeallocate := 0
+	for ctx.Err() == nil {
+		i := w.rng.IntN(w.conf.Statements)
+		name := fmt.Sprintf("overload_stmt_%d", i)
+		if !w.prepared[i] {
+			start := time.Now()
+			_, err := conn.Prepare(ctx, name, statementSQL(w.table, i))
+			w.record("prepare", time.Since(start), err)
+			if err != nil {
+				return fmt.Errorf("failed to prepare statement: %w", err)
+			}
+			w.prepareTime += time.Since(start)
+			w.prepares++
+			w.prepared[i] = true
+		}
+
+		start := time.Now()
+		_, err := conn.Exec(ctx, name, w.key(), w.rng.IntN(w.conf.Rows))
+		w.executions++
+		executions.Inc()
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			w.record("exec", time.Since(start), err)
+			w.errors++
+			errorsCounter.Inc()
+			if conn.IsClosed() {
+				return err
+			}
+		} else {
+			w.record("exec", time.Since(start), nil)
+			w.latency.Observe(time.Since(start).Seconds())
+		}
+
+		if sampling && time.Since(lastSample) >= w.conf.SampleInterval {
+			lastSample = time.Now()
+			if err := w.sample(ctx, conn); err != nil && ctx.Err() == nil {
+				// memory contexts and plan counters are not available before Postgres 14
+				log.Warn(ctx, "failed to sample plan cache, sampling disabled", zap.Error(err))
+				sampling = false
+			}
+			memory.Set(float64(w.peakMemory))
+		}
+
+		sinceDeallocate++
+		if w.conf.DeallocateEvery > 0 && sinceDeallocate >= w.conf.DeallocateEvery {
+			sinceDeallocate = 0
+			if err := conn.DeallocateAll(ctx); err != nil {
+				return fmt.Errorf("failed to deallocate statements: %w", err)
+			}
+			w.deallocates++
+			clear(w.prepared)
+		}
+	}
+	return nil
+}
+
+// key returns the parameter for k: the hot value half of the time, which has a generic plan
+// different from the best custom plan, or a rare value.
+func (w *worker) key() int {
+	if w.rng.IntN(2) == 0 {
+		return hotKey
+	}
+	return w.rng.IntN(w.conf.Rows/10)*10 + 10
+}
+
+// sample reads memory of the session and plan counters of its prepared statements.
+func (w *worker) sample(ctx context.Context, conn *pgx.Conn) error {
+	var total, plans int64
+	err := conn.QueryRow(ctx, `
+		SELECT COALESCE(sum(total_bytes), 0)::bigint,
+			COALESCE(sum(total_bytes) FILTER (WHERE name IN ('CachedPlan', 'CachedPlanSource', 'CachedPlanQuery')), 0)::bigint
+		FROM pg_backend_memory_contexts`).Scan(&total, &plans)
+	if err != nil {
+		return err
+	}
+	w.peakMemory = max(w.peakMemory, total)
+	w.peakPlanMemory = max(w.peakPlanMemory, plans)
+
+	return conn.QueryRow(ctx, `
+		SELECT COALESCE(sum(generic_plans), 0)::bigint, COALESCE(sum(custom_plans), 0)::bigint
+		FROM pg_prepared_statements`).Scan(&w.genericPlans, &w.customPlans)
+}
+
+// PrintResult prints the summary of the run.
+func PrintResult(w io.Writer, r Result) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Executions\t%d (%.0f/s, %d errors)\n", r.Executions, r.QPS, r.Errors)
+	fmt.Fprintf(tw, "Prepares\t%d (avg %s)\n", r.Prepares, r.PrepareAvg.Round(time.Microsecond))
+	fmt.Fprintf(tw, "Deallocations\t%d\n", r.Deallocates)
+	fmt.Fprintf(tw, "Peak backend memory\t%.1f MB\n", float64(r.PeakBackendMemory)/(1<<20))
+	fmt.Fprintf(tw, "Peak plan cache memory\t%.1f MB\n", float64(r.PeakPlanCacheMemory)/(1<<20))
+	fmt.Fprintf(tw, "Generic / custom plans\t%d / %d\n", r.GenericPlans, r.CustomPlans)
+	tw.Flush()
+}
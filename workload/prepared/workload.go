@@ -0,0 +1,36 @@
+package prepared
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/petuhovskiy/overload/workload"
+)
+
+const workloadName = "prepared"
+
+func init() {
+	workload.Register(workloadName, "thousands of prepared statements per session over skewed data, like bench prepared", func() workload.Workload {
+		return &Workload{}
+	})
+}
+
+// Workload runs the prepared statements benchmark with Config for its duration as a custom
+// workload, reporting prepares and executions as operations.
+type Workload struct {
+	Config Config
+}
+
+func (w *Workload) Setup(ctx context.Context, conn *pgx.Conn) error {
+	w.Config.Normalize()
+	return setupTable(ctx, conn, w.Config)
+}
+
+func (w *Workload) Run(ctx context.Context, e workload.Emitter) error {
+	_, err := run(ctx, e, w.Config)
+	return err
+}
+
+func (w *Workload) Teardown(context.Context, *pgx.Conn) error {
+	return nil
+}
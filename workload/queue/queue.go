@@ -0,0 +1,394 @@
+// Package queue runs a job queue workload on a table: producers insert tasks, consumers
+// lock batches of the oldest tasks with FOR UPDATE SKIP LOCKED and mark them done.
+// Unlike random-row OLTP, all sessions compete for the head of the same index, and dead
+// tuples of processed tasks pile up in front of it.
+package queue
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/petuhovskiy/overload/internal/dbconn"
+	"github.com/petuhovskiy/overload/internal/log"
+	"github.com/petuhovskiy/overload/internal/metrics"
+	"github.com/petuhovskiy/overload/internal/multi"
+	"github.com/petuhovskiy/overload/workload"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultTableName      = "overload_queue"
+	defaultProducers      = 4
+	defaultConsumers      = 8
+	defaultDuration       = time.Minute
+	defaultRate           = 1000
+	defaultFetchSize      = 10
+	defaultPayloadSize    = 200
+	defaultPollInterval   = 10 * time.Millisecond
+	defaultSampleInterval = time.Second
+)
+
+type Config struct {
+	TableName string
+	Producers int
+	Consumers int
+	Duration  time.Duration
+	// Rate is the total number of tasks inserted per second by all producers,
+	// negative value means as fast as possible.
+	Rate float64
+	// FetchSize is the max number of tasks locked and processed by a consumer at once.
+	FetchSize   int
+	PayloadSize int
+	// WorkTime is the processing time of a task, spent by the consumer holding the lock.
+	WorkTime time.Duration
+	// Delete removes processed tasks instead of marking them done.
+	Delete bool
+	// PollInterval is the pause of a consumer that found no tasks.
+	PollInterval time.Duration
+	// SampleInterval is how often the queue depth is sampled.
+	SampleInterval time.Duration
+}
+
+func (conf *Config) Normalize() {
+	if conf.TableName == "" {
+		conf.TableName = defaultTableName
+	}
+
+	if conf.Producers == 0 {
+		conf.Producers = defaultProducers
+	}
+
+	if conf.Consumers == 0 {
+		conf.Consumers = defaultConsumers
+	}
+
+	if conf.Duration == 0 {
+		conf.Duration = defaultDuration
+	}
+
+	if conf.Rate == 0 {
+		conf.Rate = defaultRate
+	}
+
+	if conf.FetchSize == 0 {
+		conf.FetchSize = defaultFetchSize
+	}
+
+	if conf.PayloadSize == 0 {
+		conf.PayloadSize = defaultPayloadSize
+	}
+
+	if conf.PollInterval == 0 {
+		conf.PollInterval = defaultPollInterval
+	}
+
+	if conf.SampleInterval == 0 {
+		conf.SampleInterval = defaultSampleInterval
+	}
+}
+
+// Result holds measurements of the run.
+type Result struct {
+	Produced    int64
+	Consumed    int64
+	ProducedTPS float64
+	ConsumedTPS float64
+	// EmptyPolls is the number of fetches that found no unlocked tasks.
+	EmptyPolls int64
+	Errors     int64
+	// AvgLatency and P99Latency are the times from inserting a task to marking it done.
+	AvgLatency time.Duration
+	P99Latency time.Duration
+	// PeakDepth and FinalDepth are the numbers of pending tasks, sampled during the run.
+	PeakDepth  int64
+	FinalDepth int64
+}
+
+// Run creates the table, then produces and consumes tasks for the configured duration.
+// Tasks left from previous runs are consumed too.
+func Run(ctx context.Context, connstr string, conf Config) (Result, error) {
+	conf.Normalize()
+	conn, err := dbconn.Connect(ctx, connstr)
+	if err != nil {
+		return Result{}, err
+	}
+	err = createTable(ctx, conn, conf.TableName)
+	conn.Close(context.Background())
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to create table: %w", err)
+	}
+	return run(ctx, workload.Standalone(workloadName, connstr), conf)
+}
+
+// run produces and consumes tasks of the table, connecting with the emitter.
+func run(ctx context.Context, e workload.Emitter, conf Config) (Result, error) {
+	log.Info(ctx, "queue workload started", zap.Any("conf", conf))
+
+	// the connection of the run samples the queue depth
+	conn, err := e.Connect(ctx)
+	if err != nil {
+		return Result{}, err
+	}
+	defer conn.Close(context.Background())
+
+	labels := []string{"table", conf.TableName}
+	produced := metrics.Default.Counter("queue_produced_total", labels...)
+	consumed := metrics.Default.Counter("queue_consumed_total", labels...)
+	emptyPolls := metrics.Default.Counter("queue_empty_polls_total", labels...)
+	errs := metrics.Default.Counter("queue_errors_total", labels...)
+	startProduced, startConsumed := produced.Value(), consumed.Value()
+	startEmpty, startErrs := emptyPolls.Value(), errs.Value()
+	// latency of this run only, the global histogram accumulates all runs
+	latency := metrics.NewRegistry().Histogram("queue_latency_seconds")
+
+	runCtx, cancel := context.WithTimeout(ctx, conf.Duration)
+	defer cancel()
+	start := time.Now()
+
+	s := &sampler{conf: conf, conn: conn}
+	samplerDone := make(chan struct{})
+	go func() {
+		defer close(samplerDone)
+		s.run(runCtx)
+	}()
+
+	// the first workers are producers, the rest are consumers
+	err = multi.RunWorkers(runCtx, conf.Producers+conf.Consumers, func(ctx context.Context, i int) error {
+		conn, err := e.Connect(ctx)
+		if err != nil {
+			return err
+		}
+		defer conn.Close(context.Background())
+
+		if i < conf.Producers {
+			p := &producer{conf: conf, produced: produced, errors: errs, record: e.Record}
+			return p.run(ctx, conn)
+		}
+		c := &consumer{conf: conf, consumed: consumed, emptyPolls: emptyPolls, errors: errs, latency: latency, record: e.Record}
+		return c.run(ctx, conn)
+	})
+	<-samplerDone
+	elapsed := time.Since(start).Seconds()
+
+	res := Result{
+		Produced:   produced.Value() - startProduced,
+		Consumed:   consumed.Value() - startConsumed,
+		EmptyPolls: emptyPolls.Value() - startEmpty,
+		Errors:     errs.Value() - startErrs,
+		PeakDepth:  s.peak,
+	}
+	res.ProducedTPS = float64(res.Produced) / elapsed
+	res.ConsumedTPS = float64(res.Consumed) / elapsed
+	snapshot := latency.Snapshot()
+	if snapshot.Count > 0 {
+		res.AvgLatency = time.Duration(snapshot.Sum / float64(snapshot.Count) * float64(time.Second))
+		res.P99Latency = time.Duration(snapshot.Quantile(0.99) * float64(time.Second))
+	}
+	if depth, err := queueDepth(ctx, conn, conf.TableName); err == nil {
+		res.FinalDepth = depth
+	}
+	log.Info(ctx, "queue workload finished", zap.Any("result", res))
+	return res, err
+}
+
+// createTable creates the queue table with a partial index on pending tasks.
+func createTable(ctx context.Context, conn *pgx.Conn, tableName string) error {
+	table := pgx.Identifier{tableName}.Sanitize()
+	_, err := conn.Exec(ctx, fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %[1]s (
+			id bigserial PRIMARY KEY,
+			done boolean NOT NULL DEFAULT false,
+			payload text NOT NULL,
+			created_at timestamptz NOT NULL DEFAULT clock_timestamp(),
+			done_at timestamptz
+		);
+		CREATE INDEX IF NOT EXISTS %[2]s ON %[1]s (id) WHERE NOT done`,
+		table, pgx.Identifier{tableName + "_pending"}.Sanitize()))
+	return err
+}
+
+// queueDepth returns the number of pending tasks.
+func queueDepth(ctx context.Context, conn *pgx.Conn, tableName string) (int64, error) {
+	var depth int64
+	err := conn.QueryRow(ctx, fmt.Sprintf("SELECT count(*) FROM %s WHERE NOT done",
+		pgx.Identifier{tableName}.Sanitize())).Scan(&depth)
+	return depth, err
+}
+
+// producer inserts tasks at its share of the configured rate.
+type producer struct {
+	conf     Config
+	produced *metrics.Counter
+	errors   *metrics.Counter
+	record   func(op string, latency time.Duration, err error)
+}
+
+func (p *producer) run(ctx context.Context, conn *pgx.Conn) error {
+	rng := rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64()))
+	query := fmt.Sprintf("INSERT INTO %s (payload) VALUES ($1)", pgx.Identifier{p.conf.TableName}.Sanitize())
+
+	var interval time.Duration
+	if p.conf.Rate > 0 {
+		interval = time.Duration(float64(time.Second) * float64(p.conf.Producers) / p.conf.Rate)
+	}
+	next := time.Now()
+	for ctx.Err() == nil {
+		if interval > 0 {
+			next = next.Add(interval)
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(time.Until(next)):
+			}
+		}
+
+		start := time.Now()
+		_, err := conn.Exec(ctx, query, payload(rng, p.conf.PayloadSize))
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			p.record("produce", time.Since(start), err)
+			p.errors.Inc()
+			if conn.IsClosed() {
+				return err
+			}
+			continue
+		}
+		p.record("produce", time.Since(start), nil)
+		p.produced.Inc()
+	}
+	return nil
+}
+
+// payload returns a random text of the given size.
+func payload(rng *rand.Rand, size int) string {
+	const charset = "abcdefghijklmnopqrstuvwxyz0123456789"
+	var sb strings.Builder
+	sb.Grow(size)
+	for range size {
+		sb.WriteByte(charset[rng.IntN(len(charset))])
+	}
+	return sb.String()
+}
+
+// consumer locks and processes batches of the oldest pending tasks.
+type consumer struct {
+	conf       Config
+	consumed   *metrics.Counter
+	emptyPolls *metrics.Counter
+	errors     *metrics.Counter
+	latency    *metrics.Histogram
+	record     func(op string, latency time.Duration, err error)
+}
+
+func (c *consumer) run(ctx context.Context, conn *pgx.Conn) error {
+	table := pgx.Identifier{c.conf.TableName}.Sanitize()
+	fetch := fmt.Sprintf(`SELECT id FROM %s WHERE NOT done ORDER BY id LIMIT $1 FOR UPDATE SKIP LOCKED`, table)
+	complete := fmt.Sprintf(`UPDATE %s SET done = true, done_at = clock_timestamp() WHERE id = ANY($1)
+		RETURNING extract(epoch FROM done_at - created_at)::float8`, table)
+	if c.conf.Delete {
+		complete = fmt.Sprintf(`DELETE FROM %s WHERE id = ANY($1)
+			RETURNING extract(epoch FROM clock_timestamp() - created_at)::float8`, table)
+	}
+	globalLatency := metrics.Default.Histogram("queue_latency_seconds", "table", c.conf.TableName)
+
+	for ctx.Err() == nil {
+		var latencies []float64
+		start := time.Now()
+		err := pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+			rows, err := tx.Query(ctx, fetch, c.conf.FetchSize)
+			if err != nil {
+				return err
+			}
+			ids, err := pgx.CollectRows(rows, pgx.RowTo[int64])
+			if err != nil || len(ids) == 0 {
+				return err
+			}
+
+			if c.conf.WorkTime > 0 {
+				time.Sleep(c.conf.WorkTime)
+			}
+			rows, err = tx.Query(ctx, complete, ids)
+			if err != nil {
+				return err
+			}
+			latencies, err = pgx.CollectRows(rows, pgx.RowTo[float64])
+			return err
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			c.record("consume", time.Since(start), err)
+			c.errors.Inc()
+			if conn.IsClosed() {
+				return err
+			}
+			continue
+		}
+
+		if len(latencies) == 0 {
+			c.emptyPolls.Inc()
+			select {
+			case <-ctx.Done():
+			case <-time.After(c.conf.PollInterval):
+			}
+			continue
+		}
+		// only transactions which processed tasks, empty polls are counted separately
+		c.record("consume", time.Since(start), nil)
+		c.consumed.Add(int64(len(latencies)))
+		for _, l := range latencies {
+			c.latency.Observe(l)
+			globalLatency.Observe(l)
+		}
+	}
+	return nil
+}
+
+// sampler periodically reads the queue depth.
+type sampler struct {
+	conf Config
+	conn *pgx.Conn
+	peak int64
+}
+
+func (s *sampler) run(ctx context.Context) {
+	depthGauge := metrics.Default.Gauge("queue_depth", "table", s.conf.TableName)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(s.conf.SampleInterval):
+		}
+
+		depth, err := queueDepth(ctx, s.conn, s.conf.TableName)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Warn(ctx, "failed to sample queue depth", zap.Error(err))
+			}
+			continue
+		}
+		depthGauge.Set(float64(depth))
+		s.peak = max(s.peak, depth)
+	}
+}
+
+// PrintResult prints the summary of the run.
+func PrintResult(w io.Writer, r Result) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Produced\t%d (%.0f/s)\n", r.Produced, r.ProducedTPS)
+	fmt.Fprintf(tw, "Consumed\t%d (%.0f/s)\n", r.Consumed, r.ConsumedTPS)
+	fmt.Fprintf(tw, "Empty polls\t%d\n", r.EmptyPolls)
+	fmt.Fprintf(tw, "Errors\t%d\n", r.Errors)
+	fmt.Fprintf(tw, "Processing latency\tavg %s, p99 <= %s\n", r.AvgLatency.Round(time.Microsecond), r.P99Latency.Round(time.Microsecond))
+	fmt.Fprintf(tw, "Queue depth\tpeak %d, final %d\n", r.PeakDepth, r.FinalDepth)
+	tw.Flush()
+}
@@ -0,0 +1,36 @@
+package queue
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/petuhovskiy/overload/workload"
+)
+
+const workloadName = "queue"
+
+func init() {
+	workload.Register(workloadName, "job queue with FOR UPDATE SKIP LOCKED consumers, like bench queue", func() workload.Workload {
+		return &Workload{}
+	})
+}
+
+// Workload runs the queue benchmark with Config for its duration as a custom workload,
+// reporting inserted tasks and processed batches as operations.
+type Workload struct {
+	Config Config
+}
+
+func (w *Workload) Setup(ctx context.Context, conn *pgx.Conn) error {
+	w.Config.Normalize()
+	return createTable(ctx, conn, w.Config.TableName)
+}
+
+func (w *Workload) Run(ctx context.Context, e workload.Emitter) error {
+	_, err := run(ctx, e, w.Config)
+	return err
+}
+
+func (w *Workload) Teardown(context.Context, *pgx.Conn) error {
+	return nil
+}
@@ -0,0 +1,339 @@
+// Package rls measures the overhead of row-level security with many roles: every transaction
+// switches to the role of a random tenant with SET LOCAL ROLE and works with the rows of the
+// tenant, filtered by a policy instead of an explicit condition.
+package rls
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/petuhovskiy/overload/internal/dbconn"
+	"github.com/petuhovskiy/overload/internal/log"
+	"github.com/petuhovskiy/overload/internal/metrics"
+	"github.com/petuhovskiy/overload/internal/multi"
+	"github.com/petuhovskiy/overload/workload"
+	"go.uber.org/zap"
+)
+
+const (
+	// ModePlain runs transactions as the connecting user with an explicit tenant condition.
+	ModePlain = "plain"
+	// ModeSetRole switches to the tenant role in every transaction, RLS is disabled,
+	// so the difference with plain is the cost of role switching.
+	ModeSetRole = "set-role"
+	// ModeRLS switches to the tenant role and relies on the policy to filter rows,
+	// so the difference with set-role is the cost of policy evaluation.
+	ModeRLS = "rls"
+)
+
+// Modes are all supported modes, from the cheapest.
+var Modes = []string{ModePlain, ModeSetRole, ModeRLS}
+
+const (
+	defaultMode      = ModeRLS
+	defaultTableName = "overload_rls"
+	defaultRoles     = 100
+	defaultRows      = 1_000_000
+	defaultWorkers   = 8
+	defaultDuration  = time.Minute
+	defaultRangeSize = 100
+)
+
+type Config struct {
+	Mode      string
+	TableName string
+	// Roles is the number of tenant roles, every role owns an equal share of the rows.
+	// Roles are named <table>_tenant_<i> and kept after the run.
+	Roles int
+	// Rows is the total number of rows of all tenants, seeded if the table is empty.
+	Rows     int
+	Workers  int
+	Duration time.Duration
+	// RangeSize is the number of ids scanned by the range query, only rows of the tenant match.
+	RangeSize int
+}
+
+func (conf *Config) Normalize() {
+	if conf.Mode == "" {
+		conf.Mode = defaultMode
+	}
+
+	if conf.TableName == "" {
+		conf.TableName = defaultTableName
+	}
+
+	if conf.Roles == 0 {
+		conf.Roles = defaultRoles
+	}
+
+	if conf.Rows == 0 {
+		conf.Rows = defaultRows
+	}
+
+	if conf.Workers == 0 {
+		conf.Workers = defaultWorkers
+	}
+
+	if conf.Duration == 0 {
+		conf.Duration = defaultDuration
+	}
+
+	if conf.RangeSize == 0 {
+		conf.RangeSize = defaultRangeSize
+	}
+}
+
+// Result holds measurements of a single run.
+type Result struct {
+	Mode         string
+	Transactions int64
+	TPS          float64
+	AvgLatency   time.Duration
+	Errors       int64
+}
+
+// Run sets up the roles and policies, then executes tenant transactions with all workers
+// for the configured duration.
+func Run(ctx context.Context, connstr string, conf Config) (Result, error) {
+	conf.Normalize()
+	if err := conf.validate(); err != nil {
+		return Result{Mode: conf.Mode}, err
+	}
+
+	conn, err := dbconn.Connect(ctx, connstr)
+	if err != nil {
+		return Result{Mode: conf.Mode}, err
+	}
+	err = setup(ctx, conn, conf)
+	conn.Close(context.Background())
+	if err != nil {
+		return Result{Mode: conf.Mode}, fmt.Errorf("failed to set up roles and policies: %w", err)
+	}
+	return run(ctx, workload.Standalone(workloadName, connstr), conf)
+}
+
+func (conf *Config) validate() error {
+	if conf.Mode != ModePlain && conf.Mode != ModeSetRole && conf.Mode != ModeRLS {
+		return fmt.Errorf("unknown rls mode %q", conf.Mode)
+	}
+	return nil
+}
+
+// run executes tenant transactions, connecting with the emitter.
+func run(ctx context.Context, e workload.Emitter, conf Config) (Result, error) {
+	res := Result{Mode: conf.Mode}
+	ctx = log.With(ctx, zap.String("mode", conf.Mode))
+	log.Info(ctx, "rls workload started", zap.Any("conf", conf))
+
+	runCtx, cancel := context.WithTimeout(ctx, conf.Duration)
+	defer cancel()
+	start := time.Now()
+
+	workers := make([]*worker, conf.Workers)
+	for i := range workers {
+		workers[i] = newWorker(conf, e.Record)
+	}
+	err := multi.RunWorkers(runCtx, conf.Workers, func(ctx context.Context, i int) error {
+		return workers[i].run(ctx, e)
+	})
+
+	var latency time.Duration
+	for _, w := range workers {
+		res.Transactions += w.transactions
+		res.Errors += w.errors
+		latency += w.latencySum
+	}
+	res.TPS = float64(res.Transactions) / time.Since(start).Seconds()
+	if res.Transactions > 0 {
+		res.AvgLatency = latency / time.Duration(res.Transactions)
+	}
+	log.Info(ctx, "rls workload finished", zap.Any("result", res))
+	return res, err
+}
+
+func rolePrefix(table string) string {
+	return table + "_tenant_"
+}
+
+// roleName returns the name of the i-th tenant role.
+func roleName(table string, i int) string {
+	return fmt.Sprintf("%s%d", rolePrefix(table), i)
+}
+
+// setup creates the table, the roles and the policy, and enables RLS only in rls mode.
+// The connecting user needs CREATEROLE and is granted all tenant roles to switch to them.
+func setup(ctx context.Context, conn *pgx.Conn, conf Config) error {
+	table := pgx.Identifier{conf.TableName}.Sanitize()
+	_, err := conn.Exec(ctx, fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+			id bigint PRIMARY KEY,
+			tenant text NOT NULL,
+			balance bigint NOT NULL DEFAULT 0,
+			payload text NOT NULL
+		)`, table))
+	if err != nil {
+		return err
+	}
+	// the tenant of the row is the name of the role owning it
+	_, err = conn.Exec(ctx, fmt.Sprintf(`
+		INSERT INTO %[1]s (id, tenant, payload)
+		SELECT i, $1::text || (i %% $2::int), md5(i::text)
+		FROM generate_series(0, $3::int - 1) i
+		WHERE NOT EXISTS (SELECT 1 FROM %[1]s)`, table),
+		rolePrefix(conf.TableName), conf.Roles, conf.Rows)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Exec(ctx, "ANALYZE "+table); err != nil {
+		return err
+	}
+
+	for i := range conf.Roles {
+		role := pgx.Identifier{roleName(conf.TableName, i)}.Sanitize()
+		_, err := conn.Exec(ctx, fmt.Sprintf(`
+			DO $$ BEGIN
+				CREATE ROLE %[1]s NOLOGIN;
+			EXCEPTION WHEN duplicate_object THEN NULL;
+			END $$;
+			GRANT SELECT, UPDATE ON %[2]s TO %[1]s;
+			GRANT %[1]s TO CURRENT_USER`, role, table))
+		if err != nil {
+			return fmt.Errorf("failed to create role %s: %w", role, err)
+		}
+	}
+
+	policy := pgx.Identifier{conf.TableName + "_tenant"}.Sanitize()
+	_, err = conn.Exec(ctx, fmt.Sprintf(`
+		DROP POLICY IF EXISTS %[1]s ON %[2]s;
+		CREATE POLICY %[1]s ON %[2]s USING (tenant = current_user)`, policy, table))
+	if err != nil {
+		return err
+	}
+
+	action := "DISABLE"
+	if conf.Mode == ModeRLS {
+		action = "ENABLE"
+	}
+	_, err = conn.Exec(ctx, fmt.Sprintf("ALTER TABLE %s %s ROW LEVEL SECURITY", table, action))
+	return err
+}
+
+// worker runs tenant transactions on a single connection.
+type worker struct {
+	conf    Config
+	table   string
+	rng     *rand.Rand
+	latency *metrics.Histogram
+	record  func(op string, latency time.Duration, err error)
+
+	transactions int64
+	errors       int64
+	latencySum   time.Duration
+}
+
+func newWorker(conf Config, record func(op string, latency time.Duration, err error)) *worker {
+	return &worker{
+		record:  record,
+		conf:    conf,
+		table:   pgx.Identifier{conf.TableName}.Sanitize(),
+		rng:     rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64())),
+		latency: metrics.Default.Histogram("rls_tx_seconds", "mode", conf.Mode, "table", conf.TableName),
+	}
+}
+
+func (w *worker) run(ctx context.Context, e workload.Emitter) error {
+	conn, err := e.Connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	labels := []string{"mode", w.conf.Mode, "table", w.conf.TableName}
+	txCounter := metrics.Default.Counter("rls_transactions_total", labels...)
+	errorsCounter := metrics.Default.Counter("rls_errors_total", labels...)
+
+	for ctx.Err() == nil {
+		start := time.Now()
+		err := w.transaction(ctx, conn)
+		elapsed := time.Since(start)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			w.record("tx", elapsed, err)
+			w.errors++
+			errorsCounter.Inc()
+			log.Warn(ctx, "rls transaction failed", zap.Error(err))
+			if conn.IsClosed() {
+				return err
+			}
+			continue
+		}
+		w.record("tx", elapsed, nil)
+		w.transactions++
+		w.latencySum += elapsed
+		w.latency.Observe(elapsed.Seconds())
+		txCounter.Inc()
+	}
+	return nil
+}
+
+// transaction reads a row, scans a range and updates a row of a random tenant. Without RLS
+// the tenant condition is explicit, with RLS the policy filters the rows.
+func (w *worker) transaction(ctx context.Context, conn *pgx.Conn) error {
+	tenant := w.rng.IntN(w.conf.Roles)
+	role := roleName(w.conf.TableName, tenant)
+	// ids of the tenant are congruent to the tenant number
+	id := int64(w.rng.IntN(max(w.conf.Rows/w.conf.Roles, 1))*w.conf.Roles + tenant)
+
+	// the tenant is the second parameter of every query, unless the policy filters rows
+	tenantCond, args := " AND tenant = $2", []any{id, role}
+	if w.conf.Mode == ModeRLS {
+		tenantCond, args = "", []any{id}
+	}
+
+	return pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+		if w.conf.Mode != ModePlain {
+			if _, err := tx.Exec(ctx, "SET LOCAL ROLE "+pgx.Identifier{role}.Sanitize()); err != nil {
+				return err
+			}
+		}
+
+		var balance int64
+		err := tx.QueryRow(ctx, fmt.Sprintf("SELECT balance FROM %s WHERE id = $1%s", w.table, tenantCond),
+			args...).Scan(&balance)
+		if err != nil {
+			return err
+		}
+
+		var count, sum int64
+		err = tx.QueryRow(ctx, fmt.Sprintf("SELECT count(*), COALESCE(sum(balance), 0) FROM %s WHERE id >= $1 AND id < $1 + %d%s",
+			w.table, w.conf.RangeSize, tenantCond), args...).Scan(&count, &sum)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(ctx, fmt.Sprintf("UPDATE %s SET balance = balance + 1 WHERE id = $1%s", w.table, tenantCond), args...)
+		return err
+	})
+}
+
+// PrintResults prints the table of all runs, with the throughput change relative to the first run.
+func PrintResults(w io.Writer, results []Result) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "MODE\tTRANSACTIONS\tTPS\tAVG LATENCY\tERRORS\tVS FIRST")
+	for _, r := range results {
+		change := "-"
+		if len(results) > 0 && results[0].TPS > 0 {
+			change = fmt.Sprintf("%+.1f%%", (r.TPS/results[0].TPS-1)*100)
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%.0f\t%s\t%d\t%s\n",
+			r.Mode, r.Transactions, r.TPS, r.AvgLatency.Round(time.Microsecond), r.Errors, change)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,39 @@
+package rls
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/petuhovskiy/overload/workload"
+)
+
+const workloadName = "rls"
+
+func init() {
+	workload.Register(workloadName, "tenant transactions under row-level security with many roles, like bench rls", func() workload.Workload {
+		return &Workload{}
+	})
+}
+
+// Workload runs the RLS benchmark with Config for its duration as a custom workload,
+// reporting tenant transactions as operations.
+type Workload struct {
+	Config Config
+}
+
+func (w *Workload) Setup(ctx context.Context, conn *pgx.Conn) error {
+	w.Config.Normalize()
+	if err := w.Config.validate(); err != nil {
+		return err
+	}
+	return setup(ctx, conn, w.Config)
+}
+
+func (w *Workload) Run(ctx context.Context, e workload.Emitter) error {
+	_, err := run(ctx, e, w.Config)
+	return err
+}
+
+func (w *Workload) Teardown(context.Context, *pgx.Conn) error {
+	return nil
+}
@@ -0,0 +1,241 @@
+// Package workload is the API of custom workloads compiled into the tool. A workload registers
+// itself in init, like database/sql drivers, and is selected with the -workload flag:
+//
+//	func init() {
+//		workload.Register("orders", "order processing with COPY imports", func() workload.Workload {
+//			return &Orders{}
+//		})
+//	}
+//
+// Workloads execute SQL through the Emitter, which runs queries with the launcher concurrency,
+// rate limits and statistics, and records operations executed on their own connections, so that
+// both end up in the metrics, the history database and the results file.
+package workload
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/petuhovskiy/overload/autoai"
+	"github.com/petuhovskiy/overload/errs"
+	"github.com/petuhovskiy/overload/internal/dbconn"
+	"github.com/petuhovskiy/overload/internal/log"
+	"github.com/petuhovskiy/overload/internal/metrics"
+	"go.uber.org/zap"
+)
+
+// Workload is a custom workload.
+type Workload interface {
+	// Setup prepares the database, e.g. creates and fills tables. The connection is closed after it.
+	Setup(ctx context.Context, conn *pgx.Conn) error
+	// Run executes the workload until it's finished or ctx is done.
+	Run(ctx context.Context, e Emitter) error
+	// Teardown cleans up after Run, it's called even if Run failed.
+	Teardown(ctx context.Context, conn *pgx.Conn) error
+}
+
+// Emitter executes the workload on the target database.
+type Emitter interface {
+	// Mix executes the queries as a weighted mix with the launcher settings, it returns when
+	// the launcher finishes or ctx is done. See autoai.FileSource for query options like params.
+	Mix(ctx context.Context, queries []autoai.Query) error
+	// Connect opens a connection to the target database with the tool settings, like
+	// authentication and safety limits, for operations that aren't plain queries.
+	Connect(ctx context.Context) (*pgx.Conn, error)
+	// Record reports an operation executed by the workload itself, e.g. a COPY.
+	// It's safe for concurrent use.
+	Record(op string, latency time.Duration, err error)
+}
+
+// Factory creates a new instance of the workload for every run.
+type Factory func() Workload
+
+// Info describes a registered workload.
+type Info struct {
+	Name        string
+	Description string
+	factory     Factory
+}
+
+var (
+	registryMu sync.Mutex
+	registry   = map[string]Info{}
+)
+
+// Register makes the workload available by name, it panics if the name is already registered.
+func Register(name, description string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, ok := registry[name]; ok {
+		panic(fmt.Sprintf("workload %s is already registered", name))
+	}
+	registry[name] = Info{Name: name, Description: description, factory: factory}
+}
+
+// Get returns a new instance of the registered workload.
+func Get(name string) (Workload, error) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	info, ok := registry[name]
+	if !ok {
+		return nil, errs.Validationf("unknown workload %q, available: %v", name, names())
+	}
+	return info.factory(), nil
+}
+
+// List returns all registered workloads sorted by name.
+func List() []Info {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	var res []Info
+	for _, info := range registry {
+		res = append(res, info)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
+
+func names() []string {
+	var res []string
+	for name := range registry {
+		res = append(res, name)
+	}
+	slices.Sort(res)
+	return res
+}
+
+// Run executes the workload against connstr: Setup, Run and Teardown. Statistics of recorded
+// operations are saved to the history when it finishes.
+func Run(ctx context.Context, name string, w Workload, connstr string, launcher *autoai.Launcher, history *autoai.DBHistory) error {
+	ctx = log.With(ctx, zap.String("workload", name))
+	conn, err := dbconn.Connect(ctx, connstr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to database: %w", err)
+	}
+	err = w.Setup(ctx, conn)
+	conn.Close(context.Background())
+	if err != nil {
+		return fmt.Errorf("workload setup failed: %w", err)
+	}
+
+	e := newEmitter(name, connstr, launcher)
+	runErr := w.Run(ctx, e)
+	e.save(ctx, history)
+
+	teardown(ctx, w, connstr)
+
+	if runErr != nil && ctx.Err() == nil {
+		return runErr
+	}
+	return nil
+}
+
+// teardown runs the teardown of the workload, after interrupts too. Its failures are logged,
+// so that they don't hide the error of the run.
+func teardown(ctx context.Context, w Workload, connstr string) {
+	ctx = context.WithoutCancel(ctx)
+	conn, err := dbconn.Connect(ctx, connstr)
+	if err != nil {
+		log.Error(ctx, "failed to connect to database for workload teardown", zap.Error(err))
+		return
+	}
+	defer conn.Close(context.Background())
+	if err := w.Teardown(ctx, conn); err != nil {
+		log.Error(ctx, "workload teardown failed", zap.Error(err))
+	}
+}
+
+// emitter implements Emitter with the launcher, recorded operations are aggregated by name.
+type emitter struct {
+	name     string
+	connstr  string
+	launcher *autoai.Launcher
+
+	mu  sync.Mutex
+	ops map[string]*opStats
+}
+
+type opStats struct {
+	stats   autoai.ExecStats
+	total   time.Duration
+	latency *metrics.Histogram
+	errors  *metrics.Counter
+}
+
+func newEmitter(name, connstr string, launcher *autoai.Launcher) *emitter {
+	return &emitter{
+		name:     name,
+		connstr:  connstr,
+		launcher: launcher,
+		ops:      map[string]*opStats{},
+	}
+}
+
+// Standalone returns an emitter for workloads run by other commands, e.g. benchmarks. It connects
+// to connstr and exports recorded operations as metrics, Mix isn't supported without a launcher.
+func Standalone(name, connstr string) Emitter {
+	return newEmitter(name, connstr, nil)
+}
+
+func (e *emitter) Mix(ctx context.Context, queries []autoai.Query) error {
+	if e.launcher == nil {
+		return errors.New("query mixes are not supported outside of workload runs")
+	}
+	return e.launcher.RunSource(ctx, e.connstr, autoai.StaticSource(queries))
+}
+
+func (e *emitter) Connect(ctx context.Context) (*pgx.Conn, error) {
+	return dbconn.Connect(ctx, e.connstr)
+}
+
+func (e *emitter) Record(op string, latency time.Duration, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	s, ok := e.ops[op]
+	if !ok {
+		s = &opStats{
+			latency: metrics.Default.Histogram("workload_op_seconds", "workload", e.name, "op", op),
+			errors:  metrics.Default.Counter("workload_op_errors_total", "workload", e.name, "op", op),
+		}
+		e.ops[op] = s
+	}
+
+	if err != nil {
+		s.errors.Inc()
+		s.stats.Error = err
+		if s.stats.ErrorCodes == nil {
+			s.stats.ErrorCodes = map[string]int{}
+		}
+		s.stats.ErrorCodes[errs.Code(err)]++
+		return
+	}
+	s.latency.Observe(latency.Seconds())
+	if s.stats.Count == 0 || latency < s.stats.Min {
+		s.stats.Min = latency
+	}
+	s.stats.Max = max(s.stats.Max, latency)
+	s.stats.Count++
+	s.total += latency
+	s.stats.Avg = s.total / time.Duration(s.stats.Count)
+}
+
+// save records statistics of every operation in the history.
+func (e *emitter) save(ctx context.Context, history *autoai.DBHistory) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for op, s := range e.ops {
+		info := s.stats.ToExecInfo(fmt.Sprintf("workload %s: %s", e.name, op), 0)
+		info.Comment = "workload: " + info.Comment
+		log.Info(ctx, "workload operation", zap.String("op", op), zap.Int("count", s.stats.Count),
+			zap.Duration("avg", s.stats.Avg), zap.Duration("max", s.stats.Max), zap.Error(s.stats.Error))
+		if err := history.SaveQueryExecInfo(info); err != nil {
+			log.Error(ctx, "failed to save workload operation", zap.Error(err))
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package workload
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/petuhovskiy/overload/errs"
+	"github.com/stretchr/testify/require"
+)
+
+type testWorkload struct {
+	runs int
+}
+
+func (*testWorkload) Setup(context.Context, *pgx.Conn) error    { return nil }
+func (*testWorkload) Run(context.Context, Emitter) error        { return nil }
+func (*testWorkload) Teardown(context.Context, *pgx.Conn) error { return nil }
+
+func TestRegistry(t *testing.T) {
+	Register("test-b", "second", func() Workload { return &testWorkload{} })
+	Register("test-a", "first", func() Workload { return &testWorkload{} })
+
+	w1, err := Get("test-a")
+	require.NoError(t, err)
+	w2, err := Get("test-a")
+	require.NoError(t, err)
+	require.NotSame(t, w1, w2, "every run gets a new instance")
+
+	_, err = Get("test-missing")
+	require.ErrorIs(t, err, errs.ErrValidation)
+
+	require.Panics(t, func() {
+		Register("test-a", "duplicate", func() Workload { return &testWorkload{} })
+	})
+
+	var names []string
+	for _, info := range List() {
+		names = append(names, info.Name)
+	}
+	require.IsNonDecreasing(t, names)
+	require.Contains(t, names, "kv")
+	require.Contains(t, names, "test-a")
+	require.Contains(t, names, "test-b")
+}
+
+func TestEmitterRecord(t *testing.T) {
+	e := newEmitter("test-record", "", nil)
+	e.Record("copy", 10*time.Millisecond, nil)
+	e.Record("copy", 30*time.Millisecond, nil)
+	e.Record("copy", time.Second, &pgconn.PgError{Code: "40001"})
+	netErr := errors.New("connection reset")
+	e.Record("copy", time.Second, netErr)
+	e.Record("other", 5*time.Millisecond, nil)
+
+	copyStats := e.ops["copy"].stats
+	require.Equal(t, 2, copyStats.Count, "failed operations have no latency")
+	require.Equal(t, 10*time.Millisecond, copyStats.Min)
+	require.Equal(t, 30*time.Millisecond, copyStats.Max)
+	require.Equal(t, 20*time.Millisecond, copyStats.Avg)
+	require.Equal(t, map[string]int{"40001": 1, errs.ClientCode: 1}, copyStats.ErrorCodes)
+	require.Equal(t, netErr, copyStats.Error)
+
+	require.Equal(t, 1, e.ops["other"].stats.Count)
+	require.Nil(t, e.ops["other"].stats.ErrorCodes)
+}
+
+func TestStandaloneMix(t *testing.T) {
+	err := Standalone("test-standalone", "").Mix(context.Background(), nil)
+	require.Error(t, err)
+}